@@ -14,6 +14,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -48,20 +49,20 @@ func main() {
 		wants = os.Args[2:]
 	}
 
-	repository, err := git.OpenRepository(remote, "")
+	repository, err := git.OpenRepository(context.Background(), remote, "")
 	if nil != err {
 		fail("repository error: %v", err)
 	}
 	defer repository.Close()
 
 	if 0 == len(wants) {
-		if m, err := repository.GetRefs(); nil == err {
+		if m, err := repository.GetRefs(context.Background()); nil == err {
 			for n, h := range m {
 				fmt.Println(h, n)
 			}
 		}
 	} else {
-		err := repository.FetchObjects(wants, func(hash string, ot git.ObjectType, content []byte) error {
+		err := repository.FetchObjects(context.Background(), wants, func(hash string, ot git.ObjectType, content []byte) error {
 			switch ot {
 			case git.CommitObject:
 				if c, err := git.DecodeCommit(content); nil == err {
@@ -72,6 +73,10 @@ func main() {
 						c.Committer.Name, c.Committer.Email, c.Committer.Time)
 					fmt.Printf("TreeHash : %s\n",
 						c.TreeHash)
+					if "" != c.SignatureData {
+						fmt.Printf("Signature: %s\n",
+							git.SignatureType(c.SignatureData))
+					}
 					fmt.Println()
 				}
 			case git.TreeObject:
@@ -82,8 +87,23 @@ func main() {
 					}
 					fmt.Println()
 				}
-			case git.BlobObject, git.TagObject:
-				fmt.Printf("blob/tag %s\n", hash)
+			case git.TagObject:
+				if t, err := git.DecodeTag(content); nil == err {
+					fmt.Printf("tag %s\n", hash)
+					fmt.Printf("Name     : %s\n",
+						t.Name)
+					fmt.Printf("Tagger   : %s <%s> at %s\n",
+						t.Tagger.Name, t.Tagger.Email, t.Tagger.Time)
+					fmt.Printf("Target   : %s\n",
+						t.TargetHash)
+					if "" != t.SignatureData {
+						fmt.Printf("Signature: %s\n",
+							git.SignatureType(t.SignatureData))
+					}
+					fmt.Println()
+				}
+			case git.BlobObject:
+				fmt.Printf("blob %s\n", hash)
 				if 240 < len(content) {
 					fmt.Println(string(content[:240]))
 				} else {
@@ -25,6 +25,7 @@ import (
 
 	"github.com/billziss-gh/cgofuse/fuse"
 	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/scrub"
 )
 
 type onefs struct {
@@ -86,5 +87,6 @@ func main() {
 		})
 	}
 
-	pm.Dump(os.Stdout)
+	// dumped paths may contain secrets
+	pm.Dump(scrub.NewWriter(os.Stdout))
 }
@@ -66,7 +66,11 @@ func main() {
 		caseins = true
 	}
 
-	unfs := unionfs.New(unionfs.Config{Fslist: fslist, Caseins: caseins})
+	unfs := unionfs.New(unionfs.Config{
+		Fslist:      fslist,
+		Caseins:     caseins,
+		Interrupted: port.Interrupted,
+	})
 	host := fuse.NewFileSystemHost(unfs)
 	host.SetCapReaddirPlus(true)
 	host.SetCapCaseInsensitive(caseins)
@@ -0,0 +1,71 @@
+/*
+ * cachegc.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/hubfs/fs/hubfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// default time that the local changes of a ref that no longer exists are kept
+const defaultGCAge = 7 * 24 * time.Hour
+
+// Function cacheGC removes the local changes of the refs in the cache directory of the
+// client that no longer exist (see config.gc.age) and prints the result for each. If
+// dryrun is true nothing is removed. It returns the process exit code.
+func cacheGC(client providers.Client, dryrun bool, config []string) int {
+	age := defaultGCAge
+	for _, s := range config {
+		if strings.HasPrefix(s, "config.gc.age=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(s, "config.gc.age="))
+			if nil != err || 0 > d {
+				warn("config error: invalid config.gc.age value: %s",
+					strings.TrimPrefix(s, "config.gc.age="))
+				return 1
+			}
+			age = d
+		}
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	dir := client.GetDirectory()
+	stats, err := hubfs.CollectGarbage(ctx, client, age, dryrun, func(path string, removed bool) {
+		switch {
+		case !removed:
+			fmt.Printf("%s: orphan; kept (modified within %v)\n", path, age)
+		case dryrun:
+			fmt.Printf("%s: orphan; would remove\n", path)
+		default:
+			fmt.Printf("%s: orphan; removed\n", path)
+		}
+	})
+	if nil != err {
+		warn("cache gc error: %v", err)
+		return 1
+	}
+
+	verb := "removed"
+	if dryrun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s: %d refs examined, %d orphans, %s %d (%d bytes)\n",
+		dir, stats.Refs, stats.Orphans, verb, stats.Removed, stats.Bytes)
+	return 0
+}
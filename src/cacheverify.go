@@ -0,0 +1,76 @@
+/*
+ * cacheverify.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/billziss-gh/hubfs/git"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// Function cacheVerify re-hashes the objects in the cache directory of the remote, removes
+// the ones that are corrupt and prints statistics. It returns the process exit code.
+func cacheVerify(provider providers.Provider, config []string) int {
+	client, err := provider.NewClient("")
+	if nil == err {
+		_, err = client.SetConfig(config)
+	}
+	if nil != err {
+		warn("config error: %v", err)
+		return 1
+	}
+
+	dir := client.GetDirectory()
+	if "" == dir {
+		warn("no cache directory")
+		return 1
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		fmt.Printf("%s: no cache\n", dir)
+		return 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	defer signal.Stop(intr)
+	go func() {
+		<-intr
+		cancel()
+	}()
+
+	stats, err := providers.VerifyCache(ctx, dir, func(path string, err error) {
+		if git.ErrChecksum == err {
+			warn("%s: corrupt; removed", path)
+		} else {
+			warn("%s: %v", path, err)
+		}
+	})
+	if nil != err {
+		warn("cache verify error: %v", err)
+		return 1
+	}
+
+	fmt.Printf("%s: %d objects (%d bytes) verified, %d corrupt, %d skipped, %d errors\n",
+		dir, stats.Objects, stats.Bytes, stats.Corrupt, stats.Skipped, stats.Errors)
+	if 0 != stats.Corrupt || 0 != stats.Errors {
+		return 1
+	}
+	return 0
+}
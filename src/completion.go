@@ -0,0 +1,692 @@
+/*
+ * completion.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/billziss-gh/golib/keyring"
+	"github.com/billziss-gh/hubfs/fs/hubfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// duration for which owners, repositories and refs are cached for completion
+const completionTTL = 5 * time.Minute
+
+// timeout for provider requests made during completion
+const completionTimeout = 10 * time.Second
+
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// Type completion is the result of completing a command line word. It is printed as one
+// candidate per line, followed by a directive line that starts with ":" and may contain
+// "n" (do not append a space), "d" (also complete directories) and "f" (also complete
+// files).
+type completion struct {
+	fset      *flag.FlagSet
+	word      string
+	cands     []string
+	directive string
+	remote    bool
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// Function parseCompletion parses the words of a command line that is being completed;
+// the last word is the one to complete. The flags in the command line are parsed into
+// the values of fset, so that options such as -authkey apply to the completion; the
+// returned completion records them in its own flag set.
+func parseCompletion(fset *flag.FlagSet, words []string) *completion {
+	c := &completion{}
+	if 0 < len(words) {
+		c.word = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	valflag := ""
+	i := 0
+	for ; len(words) > i; i++ {
+		w := words[i]
+		if "--" == w {
+			i++
+			break
+		}
+		if !strings.HasPrefix(w, "-") || "-" == w {
+			break
+		}
+		name := strings.TrimLeft(w, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := fset.Lookup(name); nil != f && !isBoolFlag(f) {
+			if len(words) == i+1 {
+				valflag = name
+				break
+			}
+			i++
+		}
+	}
+
+	pset := flag.NewFlagSet(fset.Name(), flag.ContinueOnError)
+	pset.SetOutput(ioutil.Discard)
+	fset.VisitAll(func(f *flag.Flag) {
+		pset.Var(f.Value, f.Name, f.Usage)
+	})
+	pset.Parse(words[:i])
+	c.fset = pset
+
+	switch {
+	case "" != valflag:
+		switch valflag {
+		case "auth":
+			c.cands = []string{"force", "full", "required", "optional", "none", "token="}
+		case "lock":
+			c.directive = "f"
+		case "p":
+			c.cands = profileNames()
+		}
+	case len(words) == i && strings.HasPrefix(c.word, "-"):
+		fset.VisitAll(func(f *flag.Flag) {
+			c.cands = append(c.cands, "-"+f.Name)
+		})
+	default:
+		args := words[i:]
+		if 0 < len(args) && "completion" == args[0] {
+			if 1 == len(args) {
+				c.cands = completionShells
+			}
+			break
+		}
+		if 0 < len(args) && "auth" == args[0] {
+			switch len(args) {
+			case 1:
+				c.cands = []string{"refresh"}
+			case 2:
+				c.remote = true
+			}
+			break
+		}
+		if 0 < len(args) && "cache" == args[0] {
+			switch {
+			case 1 == len(args):
+				c.cands = []string{"verify", "gc"}
+			case 2 == len(args) && "gc" == args[1]:
+				c.cands = []string{"-n"}
+				c.remote = true
+			case 2 == len(args) || (3 == len(args) && "-n" == args[2]):
+				c.remote = true
+			}
+			break
+		}
+		if 0 < len(args) && "pathmap" == args[0] {
+			switch len(args) {
+			case 1:
+				c.cands = []string{"upgrade"}
+			case 2:
+				c.remote = true
+			}
+			break
+		}
+		if 0 < len(args) && "export" == args[0] {
+			switch len(args) {
+			case 1:
+				c.remote = true
+			default:
+				c.directive = "d"
+			}
+			break
+		}
+		if 0 < len(args) && "image" == args[0] {
+			switch len(args) {
+			case 1:
+				c.cands = imageFormatNames
+			case 2:
+				c.remote = true
+			default:
+				c.directive = "f"
+			}
+			break
+		}
+		if 0 < len(args) && "manifest" == args[0] {
+			if 1 == len(args) {
+				c.remote = true
+			}
+			break
+		}
+		if 0 < len(args) && "warmup" == args[0] {
+			switch len(args) {
+			case 1:
+				c.cands = []string{"-trace"}
+			case 2:
+				c.directive = "f"
+			case 3:
+				c.remote = true
+			}
+			break
+		}
+		if 0 < len(args) && "top" == args[0] {
+			if 1 == len(args) {
+				c.directive = "d"
+			}
+			break
+		}
+		if 0 < len(args) && "doctor" == args[0] {
+			args = args[1:]
+		} else if 0 == len(args) {
+			c.cands = []string{"doctor", "auth", "cache", "pathmap", "export", "image", "manifest",
+				"warmup", "top", "completion"}
+		}
+		switch len(args) {
+		case 0:
+			c.remote = true
+			c.directive = "d"
+		case 1:
+			c.directive = "d"
+		}
+	}
+
+	c.cands = filterPrefix(c.cands, c.word)
+	return c
+}
+
+func filterPrefix(names []string, prefix string) []string {
+	res := []string{}
+	for _, n := range names {
+		if strings.HasPrefix(n, prefix) {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func (c *completion) print() {
+	for _, s := range c.cands {
+		if (strings.HasSuffix(s, "/") || strings.HasSuffix(s, "=")) &&
+			!strings.Contains(c.directive, "n") {
+			c.directive += "n"
+		}
+	}
+	for _, s := range c.cands {
+		fmt.Println(s)
+	}
+	fmt.Println(":" + c.directive)
+}
+
+type completionEntry struct {
+	Time  time.Time
+	Names []string
+}
+
+// Type completionCache caches the names retrieved through the provider API in a file, so
+// that repeated completions do not make network requests.
+type completionCache struct {
+	path    string
+	entries map[string]completionEntry
+	dirty   bool
+}
+
+func openCompletionCache(path string) *completionCache {
+	cache := &completionCache{
+		path:    path,
+		entries: make(map[string]completionEntry),
+	}
+	if "" != path {
+		if b, err := ioutil.ReadFile(path); nil == err {
+			json.Unmarshal(b, &cache.entries)
+		}
+	}
+	return cache
+}
+
+func (cache *completionCache) get(key string, fn func() ([]string, error)) ([]string, error) {
+	if e, ok := cache.entries[key]; ok && time.Since(e.Time) < completionTTL {
+		return e.Names, nil
+	}
+	names, err := fn()
+	if nil != err {
+		return nil, err
+	}
+	cache.entries[key] = completionEntry{Time: time.Now(), Names: names}
+	cache.dirty = true
+	return names, nil
+}
+
+func (cache *completionCache) save() {
+	if "" == cache.path || !cache.dirty {
+		return
+	}
+	for k, e := range cache.entries {
+		if time.Since(e.Time) >= completionTTL {
+			delete(cache.entries, k)
+		}
+	}
+	b, err := json.Marshal(cache.entries)
+	if nil != err {
+		return
+	}
+	dir := filepath.Dir(cache.path)
+	if nil != os.MkdirAll(dir, 0700) {
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".completion-*")
+	if nil != err {
+		return
+	}
+	_, err = f.Write(b)
+	if e := f.Close(); nil == err {
+		err = e
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), cache.path)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+	}
+}
+
+// Function completeRemote returns the remotes that complete word. Remotes are completed
+// in the form host/owner/repo/ref; owners, repositories and refs are retrieved through
+// the provider API and cached for completionTTL. Completion never performs interactive
+// auth; it uses the auth token stored in the system keyring if one is present.
+func completeRemote(word string, authmeth string, authkey string, config []string) []string {
+	parts := strings.Split(word, "/")
+	if 1 == len(parts) {
+		res := []string{}
+		for _, name := range providers.GetProviderNames() {
+			if uri, err := url.Parse(name); nil == err && "https" == uri.Scheme {
+				res = append(res, uri.Host+"/")
+			}
+		}
+		return filterPrefix(res, word)
+	}
+	if 4 < len(parts) {
+		return nil
+	}
+
+	provname := providers.GetProviderName(&url.URL{Scheme: "https", Host: parts[0]})
+	provider := providers.GetProvider(provname)
+	if nil == provider {
+		return nil
+	}
+	if "" == authkey {
+		authkey = provname
+	}
+
+	token := ""
+	switch {
+	case "none" == authmeth:
+	case strings.HasPrefix(authmeth, "token="):
+		token = strings.TrimPrefix(authmeth, "token=")
+	default:
+		token, _ = keyring.Get(MyProductName, authkey)
+	}
+	if "" == token {
+		authkey = ""
+	}
+
+	// the cache lives in the client cache directory; determining it requires no requests
+	var dir string
+	if client, err := provider.NewClient(""); nil == err {
+		if _, err = client.SetConfig(config); nil == err {
+			dir = client.GetDirectory()
+		}
+	}
+	cachepath := ""
+	if "" != dir {
+		cachepath = filepath.Join(dir, ".completion")
+	}
+	cache := openCompletionCache(cachepath)
+	defer cache.save()
+
+	var client providers.Client
+	newClient := func() (providers.Client, error) {
+		if nil != client {
+			return client, nil
+		}
+		c, err := provider.NewClient(token)
+		if nil == err {
+			_, err = c.SetConfig(config)
+		}
+		if nil != err {
+			return nil, err
+		}
+		client = c
+		return client, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+
+	prefix := strings.Join(parts[:len(parts)-1], "/") + "/"
+	key := authkey + " " + strings.Join(parts[1:len(parts)-1], "/")
+	var names []string
+	var err error
+	switch len(parts) {
+	case 2:
+		names, err = cache.get(key, func() ([]string, error) {
+			return completeOwners(ctx, newClient, dir)
+		})
+	case 3:
+		names, err = cache.get(key, func() ([]string, error) {
+			return completeRepositories(ctx, newClient, parts[1])
+		})
+	case 4:
+		names, err = cache.get(key, func() ([]string, error) {
+			return completeRefs(ctx, newClient, parts[1], parts[2])
+		})
+	}
+	if nil != err {
+		return nil
+	}
+
+	if 4 == len(parts) {
+		names = encodeRefs(names, config)
+	}
+
+	res := make([]string, 0, len(names))
+	for _, n := range names {
+		if 4 > len(parts) {
+			n += "/"
+		}
+		res = append(res, prefix+n)
+	}
+	return filterPrefix(res, word)
+}
+
+// Function completeOwners returns the owners suggested by the client and the owners
+// that are present in the cache directory dir.
+func completeOwners(ctx context.Context,
+	newClient func() (providers.Client, error), dir string) ([]string, error) {
+
+	client, err := newClient()
+	if nil != err {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	if lst, err := client.GetOwners(ctx); nil == err {
+		for _, elm := range lst {
+			set[elm.Name()] = true
+		}
+	}
+	if s, ok := client.(providers.OwnerSuggester); ok {
+		if lst, err := s.SuggestOwners(ctx); nil == err {
+			for _, n := range lst {
+				set[n] = true
+			}
+		}
+	}
+	if "" != dir {
+		if lst, err := ioutil.ReadDir(dir); nil == err {
+			for _, elm := range lst {
+				if elm.IsDir() && !strings.Contains(elm.Name(), ".") {
+					set[elm.Name()] = true
+				}
+			}
+		}
+	}
+
+	return sortedNames(set), nil
+}
+
+func completeRepositories(ctx context.Context,
+	newClient func() (providers.Client, error), ownername string) ([]string, error) {
+
+	client, err := newClient()
+	if nil != err {
+		return nil, err
+	}
+
+	owner, err := client.OpenOwner(ctx, ownername)
+	if nil != err {
+		return nil, err
+	}
+	defer client.CloseOwner(owner)
+
+	lst, err := client.GetRepositories(ctx, owner)
+	if nil != err {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	for _, elm := range lst {
+		set[elm.Name()] = true
+	}
+	return sortedNames(set), nil
+}
+
+func completeRefs(ctx context.Context,
+	newClient func() (providers.Client, error), ownername string, reponame string) (
+	[]string, error) {
+
+	client, err := newClient()
+	if nil != err {
+		return nil, err
+	}
+
+	owner, err := client.OpenOwner(ctx, ownername)
+	if nil != err {
+		return nil, err
+	}
+	defer client.CloseOwner(owner)
+
+	repository, err := client.OpenRepository(ctx, owner, reponame)
+	if nil != err {
+		return nil, err
+	}
+	defer client.CloseRepository(repository)
+
+	lst, err := repository.GetRefs(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	for _, elm := range lst {
+		r := elm.Name()
+		n := strings.TrimPrefix(r, "refs/heads/")
+		if r == n {
+			n = strings.TrimPrefix(r, "refs/tags/")
+			if r == n {
+				continue
+			}
+		}
+		set[n] = true
+	}
+	return sortedNames(set), nil
+}
+
+// Function encodeRefs maps ref names to directory names using the ref encoding in
+// config (see config.refenc). A remote names at most the first directory of a nested ref.
+func encodeRefs(names []string, config []string) []string {
+	refenc := hubfs.RefEncodingPlus
+	for _, s := range config {
+		if strings.HasPrefix(s, "config.refenc=") {
+			refenc, _ = hubfs.ParseRefEncoding(strings.TrimPrefix(s, "config.refenc="))
+		}
+	}
+	set := make(map[string]bool)
+	for _, n := range names {
+		n = refenc.Encode(n)
+		if i := strings.IndexByte(n, '/'); -1 != i {
+			n = n[:i]
+		}
+		set[n] = true
+	}
+	return sortedNames(set)
+}
+
+func sortedNames(set map[string]bool) []string {
+	res := make([]string, 0, len(set))
+	for n := range set {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Function completionScript returns the completion script for shell.
+func completionScript(shell string) (string, error) {
+	text, ok := completionScripts[shell]
+	if !ok {
+		return "", fmt.Errorf("unknown shell: %s (supported: %s)",
+			shell, strings.Join(completionShells, ", "))
+	}
+	ident := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, progname)
+	var b strings.Builder
+	err := template.Must(template.New(shell).Parse(text)).Execute(&b, struct {
+		Prog  string
+		Ident string
+	}{progname, ident})
+	return b.String(), err
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for {{.Prog}}
+# usage: source <({{.Prog}} completion bash)
+
+_{{.Ident}}_complete()
+{
+    local cur words cword out directive
+    if declare -F _get_comp_words_by_ref >/dev/null; then
+        _get_comp_words_by_ref -n =: cur words cword
+    else
+        cur=${COMP_WORDS[COMP_CWORD]} words=("${COMP_WORDS[@]}") cword=$COMP_CWORD
+    fi
+    out=$("${words[0]}" __complete "${words[@]:1:cword}" 2>/dev/null) || return
+    directive=${out##*$'\n'}
+    out=${out%"$directive"}
+    local IFS=$'\n'
+    COMPREPLY=($(compgen -W "$out" -- "$cur"))
+    case $directive in
+    *f*) COMPREPLY+=($(compgen -f -- "$cur"));;
+    *d*) COMPREPLY+=($(compgen -d -- "$cur"));;
+    esac
+    case $directive in
+    *n*) compopt -o nospace;;
+    esac
+}
+
+complete -o filenames -F _{{.Ident}}_complete {{.Prog}}
+`,
+
+	"zsh": `#compdef {{.Prog}}
+# zsh completion for {{.Prog}}
+# usage: source <({{.Prog}} completion zsh)
+
+_{{.Ident}}()
+{
+    local -a lines cands dirs
+    local directive c
+    lines=("${(@f)$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    directive=${lines[-1]}
+    for c in "${(@)lines[1,-2]}"; do
+        if [[ $c == */ ]]; then
+            dirs+=("$c")
+        else
+            cands+=("$c")
+        fi
+    done
+    (( ${#cands} )) && compadd -- "${cands[@]}"
+    (( ${#dirs} )) && compadd -S '' -- "${dirs[@]}"
+    case $directive in
+    *f*) _files;;
+    *d*) _files -/;;
+    esac
+}
+
+if [ "$funcstack[1]" = "_{{.Ident}}" ]; then
+    _{{.Ident}} "$@"
+else
+    compdef _{{.Ident}} {{.Prog}}
+fi
+`,
+
+	"fish": `# fish completion for {{.Prog}}
+# usage: {{.Prog}} completion fish | source
+
+function __{{.Ident}}_complete
+    set -l args (commandline -opc)
+    set -l cur (commandline -ct)
+    test (count $cur) -eq 0; and set cur ''
+    set -l cmd $args[1]
+    set -e args[1]
+    set -l out ($cmd __complete $args $cur 2>/dev/null)
+    test (count $out) -gt 0; or return
+    set -l directive $out[-1]
+    set -e out[-1]
+    for c in $out
+        echo $c
+    end
+    if string match -q '*f*' -- $directive
+        __fish_complete_path $cur
+    else if string match -q '*d*' -- $directive
+        __fish_complete_directories $cur
+    end
+end
+
+complete -c {{.Prog}} -f -a '(__{{.Ident}}_complete)'
+`,
+
+	"powershell": `# PowerShell completion for {{.Prog}}
+# usage: {{.Prog}} completion powershell | Out-String | Invoke-Expression
+
+Register-ArgumentCompleter -Native -CommandName '{{.Prog}}' -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements |
+        Where-Object { $_.Extent.StartOffset -lt $cursorPosition } |
+        ForEach-Object { $_.ToString() })
+    if ('' -eq $wordToComplete) {
+        if ($PSVersionTable.PSVersion -ge [version]'7.3') { $words += '' } else { $words += '""' }
+    }
+    $cmd = $words[0]
+    $out = @(& $cmd __complete @($words | Select-Object -Skip 1) 2>$null)
+    if (0 -eq $out.Count) { return }
+    $directive = $out[-1]
+    $cands = @($out | Select-Object -SkipLast 1)
+    if ($directive -match '[df]') {
+        $dir = ''
+        $i = $wordToComplete.LastIndexOfAny([char[]]'\/')
+        if (0 -le $i) { $dir = $wordToComplete.Substring(0, $i + 1) }
+        $items = Get-ChildItem -Path "$wordToComplete*" -ErrorAction SilentlyContinue
+        if ($directive -notmatch 'f') { $items = $items | Where-Object { $_.PSIsContainer } }
+        $cands += @($items | ForEach-Object { $dir + $_.Name })
+    }
+    $cands | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        $text = $_
+        if ($text -match '\s') { $text = "'$text'" }
+        [System.Management.Automation.CompletionResult]::new($text, $_, 'ParameterValue', $_)
+    }
+}
+`,
+}
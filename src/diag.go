@@ -0,0 +1,100 @@
+/*
+ * diag.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/metrics"
+)
+
+// The option config.pprof=ADDR serves the net/http/pprof profiles of a mount under
+// /debug/pprof/ and its runtime statistics as JSON under /debug/hubfs on ADDR, which
+// must be a loopback address (e.g. localhost:6060): profiles reveal the paths and names
+// that are being accessed.
+
+// diagStats are the runtime statistics served under /debug/hubfs.
+type diagStats struct {
+	Time        time.Time        `json:"time"`
+	Pid         int              `json:"pid"`
+	Goroutines  map[string]int   `json:"goroutines"` // goroutines by subsystem
+	HeapAlloc   uint64           `json:"heap_alloc"`
+	HeapObjects uint64           `json:"heap_objects"`
+	HeapSys     uint64           `json:"heap_sys"`
+	Sys         uint64           `json:"sys"`
+	NumGC       uint32           `json:"num_gc"`
+	PauseTotal  time.Duration    `json:"pause_total_ns"`
+	Pathmap     int              `json:"pathmap_entries"` // entries of the open path maps
+	Metrics     metrics.Snapshot `json:"metrics"`
+}
+
+// Function serveDiag listens on addr and serves the diagnostics of the mount. The
+// returned function stops listening.
+func serveDiag(addr string) (stop func(), err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); "localhost" != host && (nil == ip || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("config.pprof address is not a loopback address: %s", addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/hubfs", func(w http.ResponseWriter, r *http.Request) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		s := diagStats{
+			Time:        time.Now(),
+			Pid:         os.Getpid(),
+			Goroutines:  metrics.Goroutines(),
+			HeapAlloc:   m.HeapAlloc,
+			HeapObjects: m.HeapObjects,
+			HeapSys:     m.HeapSys,
+			Sys:         m.Sys,
+			NumGC:       m.NumGC,
+			PauseTotal:  time.Duration(m.PauseTotalNs),
+			Pathmap:     unionfs.PathmapEntries(),
+			Metrics:     metrics.Take(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(&s)
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	return func() {
+		server.Close()
+	}, nil
+}
@@ -0,0 +1,204 @@
+/*
+ * doctor.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/golib/keyring"
+	"github.com/billziss-gh/hubfs/fs/port"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// minimum free space in the cache directory before the doctor warns
+const doctorMinFree = 1 << 30
+
+type doctorT struct {
+	failed bool
+}
+
+func (d *doctorT) ok(check string, format string, a ...interface{}) {
+	fmt.Printf("ok    %-12s %s\n", check, fmt.Sprintf(format, a...))
+}
+
+func (d *doctorT) warn(check string, hint string, format string, a ...interface{}) {
+	fmt.Printf("warn  %-12s %s\n", check, fmt.Sprintf(format, a...))
+	if "" != hint {
+		fmt.Printf("      %-12s hint: %s\n", "", hint)
+	}
+}
+
+func (d *doctorT) fail(check string, hint string, format string, a ...interface{}) {
+	d.failed = true
+	fmt.Printf("FAIL  %-12s %s\n", check, fmt.Sprintf(format, a...))
+	if "" != hint {
+		fmt.Printf("      %-12s hint: %s\n", "", hint)
+	}
+}
+
+// Function fuseLoaded reports whether the FUSE library can be loaded.
+func fuseLoaded() (ok bool) {
+	defer func() {
+		if r := recover(); nil != r {
+			ok = false
+		}
+	}()
+	fuse.OptParse([]string{}, "")
+	return true
+}
+
+func (d *doctorT) checkFuse() {
+	if !fuseLoaded() {
+		d.fail("fuse", fuseHint, "cannot load the FUSE library")
+		return
+	}
+	if v := fuseVersion(); "" != v {
+		d.ok("fuse", "%s", v)
+	} else {
+		d.ok("fuse", "loaded (version unknown)")
+	}
+}
+
+func (d *doctorT) checkKeyring() bool {
+	const probe = "doctor-probe"
+	err := keyring.Set(MyProductName, probe, probe)
+	if nil == err {
+		var v string
+		v, err = keyring.Get(MyProductName, probe)
+		keyring.Delete(MyProductName, probe)
+		if nil == err && probe != v {
+			err = fmt.Errorf("key mismatch")
+		}
+	}
+	if nil != err {
+		d.fail("keyring", "use -auth token=T to bypass the system keyring", "%v", err)
+		return false
+	}
+	d.ok("keyring", "accessible")
+	return true
+}
+
+func (d *doctorT) checkToken(provider providers.Provider, authkey string, token string) {
+	var err error
+	if "" == token {
+		token, err = keyring.Get(MyProductName, authkey)
+		if nil != err {
+			d.warn("token", "run \""+progname+" -authonly\" to authorize "+progname,
+				"no auth token stored for %s; only public repositories are available", authkey)
+			return
+		}
+	}
+	if _, err = provider.NewClient(token); nil != err {
+		d.fail("token", "run \""+progname+" -auth force -authonly\" to authorize again",
+			"auth token for %s is not valid: %v", authkey, err)
+		return
+	}
+	d.ok("token", "auth token for %s is valid", authkey)
+}
+
+func (d *doctorT) checkCache(provider providers.Provider, config []string) {
+	client, err := provider.NewClient("")
+	if nil == err {
+		_, err = client.SetConfig(config)
+	}
+	if nil != err {
+		d.fail("cache", "check the config.* options", "%v", err)
+		return
+	}
+
+	dir := client.GetDirectory()
+	if "" == dir {
+		d.fail("cache", "specify a cache directory with -o config.dir=PATH", "no cache directory")
+		return
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if nil == err {
+		var f *os.File
+		f, err = ioutil.TempFile(dir, ".doctor-*")
+		if nil == err {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	if nil != err {
+		d.fail("cache", "make the directory writable or use -o config.dir=PATH",
+			"cache directory %s is not writable: %v", dir, err)
+		return
+	}
+
+	var stat fuse.Statfs_t
+	if errc := port.Statfs(dir, &stat); 0 != errc {
+		d.warn("cache", "", "cannot determine free space in %s: %v", dir, fuse.Error(errc))
+		return
+	}
+	free := stat.Bavail * stat.Frsize
+	if doctorMinFree > free {
+		d.warn("cache", "free up space or use -o config.dir=PATH",
+			"only %dMB free in cache directory %s", free>>20, dir)
+		return
+	}
+	d.ok("cache", "%s (%dMB free)", dir, free>>20)
+}
+
+func (d *doctorT) checkNetwork(uri *url.URL) bool {
+	u := url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: "/"}
+	client := &http.Client{Timeout: 10 * time.Second}
+	rsp, err := client.Head(u.String())
+	if nil != err {
+		d.fail("network", "check the network connection and any proxy settings (HTTPS_PROXY)",
+			"cannot reach %s: %v", u.Host, err)
+		return false
+	}
+	rsp.Body.Close()
+	d.ok("network", "%s is reachable", u.Host)
+	return true
+}
+
+func (d *doctorT) checkMountpoint(mntpnt string) {
+	if "" == mntpnt {
+		return
+	}
+	if hint, err := checkMountpoint(mntpnt); nil != err {
+		d.fail("mountpoint", hint, "%s: %v", mntpnt, err)
+		return
+	}
+	d.ok("mountpoint", "%s is available", mntpnt)
+}
+
+// Function doctor checks the environment for common problems that prevent mounting and
+// prints hints on how to fix them. It returns the process exit code.
+func doctor(provider providers.Provider, authkey string, token string,
+	uri *url.URL, mntpnt string, config []string) int {
+
+	d := &doctorT{}
+	d.checkFuse()
+	keyringok := d.checkKeyring()
+	d.checkCache(provider, config)
+	if d.checkNetwork(uri) && (keyringok || "" != token) {
+		d.checkToken(provider, authkey, token)
+	}
+	d.checkMountpoint(mntpnt)
+
+	if d.failed {
+		return 1
+	}
+	return 0
+}
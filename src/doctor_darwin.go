@@ -0,0 +1,40 @@
+// +build darwin
+
+/*
+ * doctor_darwin.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"regexp"
+)
+
+const fuseHint = "install macFUSE from https://osxfuse.github.io"
+
+const staleUnmountCommand = "umount -f"
+
+var plistVersionRe = regexp.MustCompile(`<key>CFBundleVersion</key>\s*<string>([^<]*)</string>`)
+
+func fuseVersion() string {
+	for _, fs := range []string{"macfuse", "osxfuse"} {
+		b, err := ioutil.ReadFile("/Library/Filesystems/" + fs + ".fs/Contents/Info.plist")
+		if nil != err {
+			continue
+		}
+		if m := plistVersionRe.FindSubmatch(b); nil != m {
+			return fs + " " + string(m[1])
+		}
+	}
+	return ""
+}
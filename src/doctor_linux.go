@@ -0,0 +1,39 @@
+// +build linux
+
+/*
+ * doctor_linux.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const fuseHint = "install FUSE 2 (e.g. \"apt install fuse libfuse2\" or \"dnf install fuse fuse-libs\")"
+
+// the lazy unmount detaches a stale mountpoint even if processes still use it
+const staleUnmountCommand = "fusermount -uz"
+
+func fuseVersion() string {
+	out, err := exec.Command("fusermount", "-V").CombinedOutput()
+	if nil != err {
+		return ""
+	}
+	v := strings.TrimSpace(string(out))
+	if _, err := os.Stat("/dev/fuse"); nil != err {
+		v += " (/dev/fuse is missing)"
+	}
+	return v
+}
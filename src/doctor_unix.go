@@ -0,0 +1,84 @@
+// +build darwin linux
+
+/*
+ * doctor_unix.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func checkMountpoint(mntpnt string) (hint string, err error) {
+	hint = "create an empty directory to mount on"
+	var stat, pstat syscall.Stat_t
+	err = syscall.Stat(mntpnt, &stat)
+	if isStaleError(err) {
+		hint = "unmount it using \"" + staleUnmountCommand + " " + mntpnt +
+			"\" or mount with -o config.recover=1"
+		return hint, errors.New("stale mountpoint of a file system that is no longer running")
+	}
+	if nil != err {
+		return
+	}
+	if syscall.S_IFDIR != stat.Mode&syscall.S_IFMT {
+		return hint, errors.New("not a directory")
+	}
+
+	abs, err := filepath.Abs(mntpnt)
+	if nil == err && nil == syscall.Stat(filepath.Dir(abs), &pstat) &&
+		"/" != abs && stat.Dev != pstat.Dev {
+		return "unmount it using \"umount " + mntpnt + "\" or \"fusermount -u " + mntpnt + "\"",
+			errors.New("already a mountpoint")
+	}
+
+	f, err := os.Open(mntpnt)
+	if nil != err {
+		return "check the permissions of the directory", err
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(1)
+	if 0 != len(names) {
+		return hint, errors.New("directory is not empty")
+	}
+
+	return "", nil
+}
+
+// Function isStaleError reports whether err is the error returned when accessing the
+// mountpoint of a FUSE file system whose process has exited.
+func isStaleError(err error) bool {
+	return syscall.ENOTCONN == err || syscall.ENXIO == err
+}
+
+// Function isStaleMountpoint reports whether mntpnt is the mountpoint of a FUSE file
+// system whose process has exited (e.g. because it crashed).
+func isStaleMountpoint(mntpnt string) bool {
+	var stat syscall.Stat_t
+	return isStaleError(syscall.Stat(mntpnt, &stat))
+}
+
+// Function unmountStale unmounts a stale mountpoint.
+func unmountStale(mntpnt string) error {
+	args := strings.Fields(staleUnmountCommand)
+	out, err := exec.Command(args[0], append(args[1:], mntpnt)...).CombinedOutput()
+	if nil != err && 0 != len(out) {
+		err = errors.New(strings.TrimSpace(string(out)))
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+// +build windows
+
+/*
+ * doctor_windows.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const fuseHint = "install WinFsp from https://github.com/winfsp/winfsp"
+
+func fuseVersion() string {
+	for _, key := range []string{
+		`HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`,
+		`HKLM\SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+	} {
+		out, err := exec.Command("reg", "query", key, "/s", "/f", "WinFsp", "/d").Output()
+		if nil != err {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "HKEY_") {
+				continue
+			}
+			out, err := exec.Command("reg", "query", line, "/v", "DisplayVersion").Output()
+			if nil != err {
+				continue
+			}
+			for _, l := range strings.Split(string(out), "\n") {
+				f := strings.Fields(l)
+				if 3 <= len(f) && "DisplayVersion" == f[0] {
+					return "WinFsp " + f[len(f)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// WinFsp removes the mountpoint of a file system when its process exits, so there are no
+// stale mountpoints on Windows.
+func isStaleMountpoint(mntpnt string) bool {
+	return false
+}
+
+func unmountStale(mntpnt string) error {
+	return nil
+}
+
+func checkMountpoint(mntpnt string) (hint string, err error) {
+	if 2 == len(mntpnt) && ':' == mntpnt[1] {
+		if _, err = os.Stat(mntpnt + `\`); nil == err {
+			return "choose a drive letter that is not in use", errors.New("drive is in use")
+		}
+		return "", nil
+	}
+
+	if _, err = os.Stat(mntpnt); nil == err {
+		return "choose a directory that does not exist; it is created when mounting",
+			errors.New("directory already exists")
+	}
+	abs, err := filepath.Abs(mntpnt)
+	if nil != err {
+		return "", err
+	}
+	if _, err = os.Stat(filepath.Dir(abs)); nil != err {
+		return "create the parent directory", err
+	}
+	return "", nil
+}
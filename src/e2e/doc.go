@@ -0,0 +1,23 @@
+/*
+ * doc.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+// Package e2e contains the end-to-end tests of hubfs. The tests serve fixture
+// repositories from a local git server (git http-backend) and a mock of the GitHub API,
+// and exercise mounting, directory listing, reading, writing to the overlay and the
+// refreshing of refs through the same client and file system that the hubfs program
+// uses. They require a git executable and are skipped if there is none.
+//
+// By default the tests call the file system directly. If the environment variable
+// HUBFS_E2E is set, the file system is also mounted with FUSE and the tests are
+// repeated through the operating system.
+package e2e
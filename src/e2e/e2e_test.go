@@ -0,0 +1,351 @@
+/*
+ * e2e_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package e2e
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/hubfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+const testOwner = "owner"
+const testRepository = "repo"
+
+// testFS is the file system under test, which is accessed either directly or through a
+// mount. Paths are slash-separated and relative to the root of the file system.
+type testFS interface {
+	readdir(path string) ([]string, error)
+	readFile(path string) (string, error)
+	writeFile(path string, content string) error
+}
+
+// directFS accesses a file system by calling it directly.
+type directFS struct {
+	fs fuse.FileSystemInterface
+}
+
+func (d *directFS) readdir(path string) (names []string, err error) {
+	errc, fh := d.fs.Opendir(path)
+	if 0 != errc {
+		return nil, fuse.Error(errc)
+	}
+	defer d.fs.Releasedir(path, fh)
+
+	errc = d.fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			names = append(names, name)
+		}
+		return true
+	}, 0, fh)
+	if 0 != errc {
+		return nil, fuse.Error(errc)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *directFS) readFile(path string) (string, error) {
+	errc, fh := d.fs.Open(path, fuse.O_RDONLY)
+	if 0 != errc {
+		return "", fuse.Error(errc)
+	}
+	defer d.fs.Release(path, fh)
+
+	var res []byte
+	buff := make([]byte, 4096)
+	for {
+		n := d.fs.Read(path, buff, int64(len(res)), fh)
+		if 0 > n {
+			return "", fuse.Error(n)
+		} else if 0 == n {
+			break
+		}
+		res = append(res, buff[:n]...)
+	}
+	return string(res), nil
+}
+
+func (d *directFS) writeFile(path string, content string) error {
+	errc, fh := d.fs.Open(path, fuse.O_WRONLY)
+	if -fuse.ENOENT == errc {
+		errc, fh = d.fs.Create(path, fuse.O_CREAT|fuse.O_WRONLY, 0644)
+	}
+	if 0 != errc {
+		return fuse.Error(errc)
+	}
+	defer d.fs.Release(path, fh)
+
+	if errc = d.fs.Truncate(path, 0, fh); 0 != errc {
+		return fuse.Error(errc)
+	}
+	if n := d.fs.Write(path, []byte(content), 0, fh); 0 > n {
+		return fuse.Error(n)
+	} else if len(content) != n {
+		return fuse.Error(-fuse.EIO)
+	}
+	return nil
+}
+
+// testEnv is the environment of an end-to-end test: a test server with the fixture
+// repository owner/repo and the cache directory that keeps the local changes of its refs.
+type testEnv struct {
+	*testServer
+	dir     string
+	config  []string
+	overlay bool
+	mount   bool
+	mounts  int
+}
+
+// Function runEnv runs fn in a fresh test environment: once calling the file system
+// directly and, if HUBFS_E2E is set, once more through a FUSE mount.
+func runEnv(t *testing.T, overlay bool, config []string, fn func(t *testing.T, env *testEnv)) {
+	modes := []bool{false}
+	if "" != os.Getenv("HUBFS_E2E") {
+		modes = append(modes, true)
+	}
+	for _, mount := range modes {
+		name := "direct"
+		if mount {
+			name = "mount"
+		}
+		if overlay {
+			name += "+overlay"
+		}
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+
+			s.addRepository(testOwner, testRepository, map[string]string{
+				"README.md":    "hello\n",
+				"dir/file.txt": "file\n",
+			})
+			s.tag(testOwner, testRepository, "v1.0")
+
+			fn(t, &testEnv{
+				testServer: s,
+				dir:        filepath.Join(s.root, "cache"),
+				config:     config,
+				overlay:    overlay,
+				mount:      mount,
+			})
+		})
+	}
+}
+
+// Function open creates a client and a file system as the hubfs program does and returns
+// the file system and a function that closes it. The cache directory is shared by all
+// the file systems of an environment, so that local changes persist across opens.
+func (env *testEnv) open(t *testing.T) (testFS, func()) {
+	client, err := providers.NewGithubClient(env.apiURI(), "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = client.SetConfig(append([]string{"config.dir=" + env.dir}, env.config...))
+	if nil != err {
+		t.Fatal(err)
+	}
+	client.StartExpiration()
+
+	ready := make(chan struct{})
+	fsys := hubfs.New(hubfs.Config{
+		Client:  client,
+		Overlay: env.overlay,
+		Init:    func() { close(ready) },
+	})
+
+	if !env.mount {
+		fsys.Init()
+		return &directFS{fsys}, func() {
+			fsys.Destroy()
+			client.StopExpiration()
+		}
+	}
+
+	env.mounts++
+	mnt := filepath.Join(env.root, fmt.Sprintf("mnt%d", env.mounts))
+	tfs, unmount := mountFS(t, fsys, mnt, ready)
+	return tfs, func() {
+		unmount()
+		client.StopExpiration()
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Function poll calls fn until it returns true or a deadline expires.
+func poll(fn func() bool) bool {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if fn() {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fn()
+}
+
+func TestReaddirRead(t *testing.T) {
+	for _, overlay := range []bool{false, true} {
+		runEnv(t, overlay, nil, func(t *testing.T, env *testEnv) {
+			fs, close := env.open(t)
+			defer close()
+
+			if names, err := fs.readdir("/owner"); nil != err || !contains(names, "repo") {
+				t.Error(names, err)
+			}
+			// tags are not listed, but can be accessed by name
+			if names, err := fs.readdir("/owner/repo"); nil != err ||
+				!contains(names, "master") || contains(names, "v1.0") {
+				t.Error(names, err)
+			}
+			if names, err := fs.readdir("/owner/repo/master"); nil != err ||
+				!contains(names, "README.md") || !contains(names, "dir") {
+				t.Error(names, err)
+			}
+			if names, err := fs.readdir("/owner/repo/master/dir"); nil != err ||
+				"[file.txt]" != fmt.Sprint(names) {
+				t.Error(names, err)
+			}
+
+			for path, expect := range map[string]string{
+				"/owner/repo/master/README.md":    "hello\n",
+				"/owner/repo/master/dir/file.txt": "file\n",
+				"/owner/repo/v1.0/README.md":      "hello\n",
+			} {
+				if c, err := fs.readFile(path); nil != err || expect != c {
+					t.Errorf("%s: %q %v", path, c, err)
+				}
+			}
+
+			if _, err := fs.readFile("/owner/repo/master/none"); nil == err {
+				t.Error()
+			}
+			if _, err := fs.readdir("/owner/none"); nil == err {
+				t.Error()
+			}
+			if !overlay {
+				if err := fs.writeFile("/owner/repo/master/new.txt", "new\n"); nil == err {
+					t.Error()
+				}
+			}
+		})
+	}
+}
+
+func TestWriteOverlay(t *testing.T) {
+	runEnv(t, true, nil, func(t *testing.T, env *testEnv) {
+		fs, close := env.open(t)
+		if err := fs.writeFile("/owner/repo/master/new.txt", "new\n"); nil != err {
+			t.Fatal(err)
+		}
+		if err := fs.writeFile("/owner/repo/master/README.md", "changed\n"); nil != err {
+			t.Fatal(err)
+		}
+		if names, err := fs.readdir("/owner/repo/master"); nil != err ||
+			!contains(names, "new.txt") || !contains(names, "README.md") {
+			t.Error(names, err)
+		}
+		if c, err := fs.readFile("/owner/repo/master/README.md"); nil != err || "changed\n" != c {
+			t.Errorf("%q %v", c, err)
+		}
+		close()
+
+		// the local changes are kept in the cache directory
+		path := filepath.Join(env.dir, testOwner, testRepository, "files", "master", "new.txt")
+		if c, err := ioutil.ReadFile(path); nil != err || "new\n" != string(c) {
+			t.Errorf("%q %v", c, err)
+		}
+
+		// and survive a remount
+		fs, close = env.open(t)
+		defer close()
+		for path, expect := range map[string]string{
+			"/owner/repo/master/new.txt":   "new\n",
+			"/owner/repo/master/README.md": "changed\n",
+			"/owner/repo/v1.0/README.md":   "hello\n",
+		} {
+			if c, err := fs.readFile(path); nil != err || expect != c {
+				t.Errorf("%s: %q %v", path, c, err)
+			}
+		}
+		if _, err := fs.readFile("/owner/repo/v1.0/new.txt"); nil == err {
+			t.Error()
+		}
+
+		// the repository on the server is not modified
+		if c := env.show(testOwner, testRepository, "master:README.md"); "hello\n" != c {
+			t.Errorf("%q", c)
+		}
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	for _, overlay := range []bool{false, true} {
+		runEnv(t, overlay, []string{"config.refttl=100ms"}, func(t *testing.T, env *testEnv) {
+			fs, close := env.open(t)
+			defer close()
+
+			if names, err := fs.readdir("/owner/repo"); nil != err ||
+				!contains(names, "master") || contains(names, "feature") {
+				t.Fatal(names, err)
+			}
+			if c, err := fs.readFile("/owner/repo/master/README.md"); nil != err || "hello\n" != c {
+				t.Fatalf("%q %v", c, err)
+			}
+
+			env.commit(testOwner, testRepository, "feature", map[string]string{
+				"feature.txt": "feature\n",
+			})
+			env.commit(testOwner, testRepository, "master", map[string]string{
+				"README.md": "updated\n",
+			})
+
+			// the refs are revalidated once config.refttl has passed
+			if !poll(func() bool {
+				names, err := fs.readdir("/owner/repo")
+				return nil == err && contains(names, "feature")
+			}) {
+				t.Fatal("new branch not found")
+			}
+			if c, err := fs.readFile("/owner/repo/feature/feature.txt"); nil != err ||
+				"feature\n" != c {
+				t.Errorf("%q %v", c, err)
+			}
+
+			// the ref directory of an overlay keeps the commit that it was opened with
+			// for as long as it is in use
+			if !overlay && !poll(func() bool {
+				c, err := fs.readFile("/owner/repo/master/README.md")
+				return nil == err && "updated\n" == c
+			}) {
+				t.Error("updated branch not refreshed")
+			}
+		})
+	}
+}
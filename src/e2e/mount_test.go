@@ -0,0 +1,89 @@
+/*
+ * mount_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// Function mountFS mounts fsys on mnt and waits until ready is closed by the Init method
+// of the file system. It returns the mounted file system and a function that unmounts it.
+func mountFS(t *testing.T, fsys fuse.FileSystemInterface, mnt string, ready <-chan struct{}) (
+	testFS, func()) {
+
+	// FUSE mounts on an existing directory; WinFsp creates the mountpoint directory
+	if "windows" != runtime.GOOS {
+		if err := os.MkdirAll(mnt, 0755); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	host := fuse.NewFileSystemHost(fsys)
+	host.SetCapReaddirPlus(true)
+	done := make(chan bool, 1)
+	go func() {
+		done <- host.Mount(mnt, []string{"-o", "uid=-1,gid=-1"})
+	}()
+
+	select {
+	case <-ready:
+	case <-done:
+		t.Fatal("mount failed")
+	case <-time.After(30 * time.Second):
+		host.Unmount()
+		t.Fatal("mount timed out")
+	}
+
+	return &mountedFS{mnt}, func() {
+		host.Unmount()
+		<-done
+	}
+}
+
+// mountedFS accesses a file system through its mountpoint.
+type mountedFS struct {
+	mnt string
+}
+
+func (m *mountedFS) path(path string) string {
+	return filepath.Join(m.mnt, filepath.FromSlash(path))
+}
+
+func (m *mountedFS) readdir(path string) ([]string, error) {
+	lst, err := ioutil.ReadDir(m.path(path))
+	if nil != err {
+		return nil, err
+	}
+	names := make([]string, 0, len(lst))
+	for _, e := range lst {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+func (m *mountedFS) readFile(path string) (string, error) {
+	c, err := ioutil.ReadFile(m.path(path))
+	return string(c), err
+}
+
+func (m *mountedFS) writeFile(path string, content string) error {
+	return ioutil.WriteFile(m.path(path), []byte(content), 0644)
+}
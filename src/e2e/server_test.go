@@ -0,0 +1,240 @@
+/*
+ * server_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testServer serves fixture repositories over the git smart HTTP protocol (using git
+// http-backend) under /git and a mock of the parts of the GitHub API that hubfs uses to
+// list owners and repositories under /api. The repositories are created and modified
+// with the git executable: bare repositories are kept in root/git/OWNER/NAME.git and
+// their working trees in root/work/OWNER/NAME.
+type testServer struct {
+	t      *testing.T
+	git    string
+	root   string
+	server *httptest.Server
+	lock   sync.Mutex
+	repos  map[string][]string // repository names by owner
+}
+
+// Function newTestServer starts a test server. It skips the test if git (or its
+// http-backend) is not available.
+func newTestServer(t *testing.T) *testServer {
+	git, err := exec.LookPath("git")
+	if nil != err {
+		t.Skip("git not found")
+	}
+	out, err := exec.Command(git, "--exec-path").Output()
+	if nil != err {
+		t.Skip("git --exec-path: ", err)
+	}
+	backend := filepath.Join(strings.TrimSpace(string(out)), "git-http-backend")
+	if "windows" == runtime.GOOS {
+		backend += ".exe"
+	}
+	if _, err := os.Stat(backend); nil != err {
+		t.Skip("git http-backend not found")
+	}
+
+	root, err := ioutil.TempDir("", "hubfs_e2e_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		t:     t,
+		git:   git,
+		root:  root,
+		repos: make(map[string][]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/git/", &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Root: "/git",
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Join(root, "git"),
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+		InheritEnv: []string{"PATH", "TEMP", "TMP"},
+	})
+	mux.Handle("/api/", http.StripPrefix("/api", http.HandlerFunc(s.serveAPI)))
+	s.server = httptest.NewServer(mux)
+
+	return s
+}
+
+func (s *testServer) close() {
+	s.server.Close()
+	os.RemoveAll(s.root)
+}
+
+// Function apiURI returns the URI of the mock GitHub API.
+func (s *testServer) apiURI() string {
+	return s.server.URL + "/api"
+}
+
+func (s *testServer) bareDir(owner string, name string) string {
+	return filepath.Join(s.root, "git", owner, name+".git")
+}
+
+func (s *testServer) workDir(owner string, name string) string {
+	return filepath.Join(s.root, "work", owner, name)
+}
+
+// Function run runs git in dir and returns its output. Commits are made by a fixed
+// author and the configuration of the user running the tests is ignored.
+func (s *testServer) run(dir string, args ...string) string {
+	cmd := exec.Command(s.git, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"HOME="+s.root,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=hubfs",
+		"GIT_AUTHOR_EMAIL=hubfs@example.com",
+		"GIT_COMMITTER_NAME=hubfs",
+		"GIT_COMMITTER_EMAIL=hubfs@example.com")
+	out, err := cmd.CombinedOutput()
+	if nil != err {
+		s.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// Function addRepository creates the repository owner/name with a master branch that
+// contains files (a map of slash-separated paths to contents).
+func (s *testServer) addRepository(owner string, name string, files map[string]string) {
+	bare := s.bareDir(owner, name)
+	work := s.workDir(owner, name)
+	for _, dir := range []string{bare, work} {
+		if err := os.MkdirAll(dir, 0755); nil != err {
+			s.t.Fatal(err)
+		}
+	}
+
+	s.run(bare, "init", "-q", "--bare")
+	s.run(bare, "symbolic-ref", "HEAD", "refs/heads/master")
+	// hubfs fetches commits by hash and trees without their blobs
+	s.run(bare, "config", "uploadpack.allowAnySHA1InWant", "true")
+	s.run(bare, "config", "uploadpack.allowFilter", "true")
+	s.run(work, "init", "-q")
+	s.run(work, "symbolic-ref", "HEAD", "refs/heads/master")
+
+	s.lock.Lock()
+	s.repos[owner] = append(s.repos[owner], name)
+	s.lock.Unlock()
+
+	s.commit(owner, name, "master", files)
+}
+
+// Function commit commits files to branch (which is created from the current branch if
+// it does not exist) and pushes it to the bare repository.
+func (s *testServer) commit(owner string, name string, branch string, files map[string]string) {
+	work := s.workDir(owner, name)
+	if "" != strings.TrimSpace(s.run(work, "branch", "--list", branch)) {
+		s.run(work, "checkout", "-q", branch)
+	} else if "" != strings.TrimSpace(s.run(work, "rev-parse", "--all")) {
+		s.run(work, "checkout", "-q", "-b", branch)
+	}
+	for path, content := range files {
+		path = filepath.Join(work, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); nil != err {
+			s.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); nil != err {
+			s.t.Fatal(err)
+		}
+	}
+	s.run(work, "add", "-A")
+	s.run(work, "commit", "-q", "-m", "commit to "+branch)
+	s.run(work, "push", "-q", s.bareDir(owner, name), "HEAD:refs/heads/"+branch)
+}
+
+// Function tag tags the current commit of the working tree of owner/name and pushes
+// the tag to the bare repository.
+func (s *testServer) tag(owner string, name string, tag string) {
+	work := s.workDir(owner, name)
+	s.run(work, "tag", tag)
+	s.run(work, "push", "-q", s.bareDir(owner, name), "refs/tags/"+tag)
+}
+
+// Function show returns the content of a file at a revision of the bare repository
+// owner/name (e.g. "master:README.md").
+func (s *testServer) show(owner string, name string, rev string) string {
+	return s.run(s.bareDir(owner, name), "show", rev)
+}
+
+// Function serveAPI serves GET /users/OWNER and GET /users/OWNER/repos. All owners are
+// users and all their repositories fit in the first page.
+func (s *testServer) serveAPI(w http.ResponseWriter, r *http.Request) {
+	comp := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if 2 > len(comp) || "users" != comp[0] {
+		http.NotFound(w, r)
+		return
+	}
+
+	owner := comp[1]
+	s.lock.Lock()
+	names, ok := s.repos[owner]
+	names = append([]string(nil), names...)
+	s.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	type repository struct {
+		Name     string `json:"name"`
+		CloneURL string `json:"clone_url"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	}
+	var content interface{}
+	switch {
+	case 2 == len(comp):
+		content = map[string]string{"login": owner, "type": "User"}
+	case 3 == len(comp) && "repos" == comp[2]:
+		lst := []repository{}
+		if "1" == r.URL.Query().Get("page") {
+			for _, n := range names {
+				e := repository{Name: n, CloneURL: s.server.URL + "/git/" + owner + "/" + n + ".git"}
+				e.Owner.Login = owner
+				lst = append(lst, e)
+			}
+		}
+		content = lst
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(content)
+}
@@ -0,0 +1,100 @@
+/*
+ * export.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	pathutil "path"
+	"runtime"
+	"strings"
+
+	"github.com/billziss-gh/hubfs/fs/hubfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// Function export materializes the tree at path (owner/repo/ref[/dir], relative to the
+// remote) in the directory target.
+func export(client providers.Client, prefix string, path string, target string,
+	config []string) int {
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	client.StartExpiration()
+	defer client.StopExpiration()
+
+	stats, err := exportTree(ctx, client, prefix, path, target, config)
+	if nil != err {
+		warn("export error: %v", err)
+		return 1
+	}
+
+	fmt.Printf("%s: %d files (%d hardlinked, %d cloned, %d bytes copied), %d directories, %d symlinks\n",
+		target, stats.Files, stats.Linked, stats.Cloned, stats.Copied, stats.Dirs, stats.Symlinks)
+	return 0
+}
+
+// Function exportTree materializes the tree at path in the directory target using the
+// config options that apply to exports (config.refenc, config.mangle, config.mtime).
+func exportTree(ctx context.Context, client providers.Client, prefix string, path string,
+	target string, config []string) (hubfs.ExportStats, error) {
+
+	refenc := hubfs.RefEncodingPlus
+	mangle := "windows" == runtime.GOOS
+	cmtime := false
+	for _, s := range config {
+		var err error
+		switch {
+		case strings.HasPrefix(s, "config.refenc="):
+			refenc, err = hubfs.ParseRefEncoding(strings.TrimPrefix(s, "config.refenc="))
+		case strings.HasPrefix(s, "config.mangle="):
+			mangle = "1" == strings.TrimPrefix(s, "config.mangle=")
+		case strings.HasPrefix(s, "config.mtime="):
+			cmtime = "commit" == strings.TrimPrefix(s, "config.mtime=")
+		}
+		if nil != err {
+			return hubfs.ExportStats{}, fmt.Errorf("config error: %v", err)
+		}
+	}
+
+	return hubfs.Export(ctx, hubfs.Config{
+		Client:      client,
+		Prefix:      prefix,
+		RefEncoding: refenc,
+		Mangle:      mangle,
+		CommitTime:  cmtime,
+	}, pathutil.Join("/", path), target)
+}
+
+// Function interruptContext returns a context that is canceled when the process is
+// interrupted.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	go func() {
+		select {
+		case <-intr:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(intr)
+		cancel()
+	}
+}
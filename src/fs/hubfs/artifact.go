@@ -0,0 +1,288 @@
+/*
+ * artifact.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// The directory .artifacts in a repository directory presents the build artifacts of
+// the recent workflow runs of the repository (if Config.Artifacts is set). Each artifact
+// is a directory that contains the files of its zip archive. The archive is downloaded
+// when the directory is first listed or looked up; files are decompressed as they are
+// read.
+
+const artifactsName = ".artifacts"
+
+// Type zipNode is a file or directory within the archive of an artifact.
+type zipNode struct {
+	file     *zip.File // nil for a directory
+	time     time.Time
+	children map[string]*zipNode
+	folded   map[string]*zipNode // children by folded name (if case-insensitive)
+}
+
+// Function lookup returns the child of a directory named c. If folded names are indexed,
+// a name that differs only in case from that of a child also matches it.
+func (node *zipNode) lookup(c string) (*zipNode, bool) {
+	if child, ok := node.children[c]; ok {
+		return child, true
+	}
+	if nil != node.folded {
+		child, ok := node.folded[unionfs.Foldpath(c, true, unionfs.UnormNone)]
+		return child, ok
+	}
+	return nil, false
+}
+
+// Type artifactCache keeps the archives of recently used artifacts.
+type artifactCache struct {
+	lock sync.Mutex
+	data map[providers.Asset]*zipNode
+	open []io.Closer
+}
+
+// maximum number of artifacts whose archives are kept open
+const artifactCacheMax = 16
+
+// Function hasArtifacts determines whether the .artifacts directory is presented in the
+// repository opened by obs.
+func (fs *hubfs) hasArtifacts(obs *obstack) bool {
+	_, ok := obs.repository.(providers.ArtifactRepository)
+	return ok && fs.arts
+}
+
+// Function artifactTree returns the root of the tree of files within the archive of an
+// artifact.
+func (fs *hubfs) artifactTree(ctx context.Context, obs *obstack) (*zipNode, error) {
+	fs.zips.lock.Lock()
+	root, ok := fs.zips.data[obs.asset]
+	fs.zips.lock.Unlock()
+	if ok {
+		return root, nil
+	}
+
+	reader, err := obs.repository.(providers.ArtifactRepository).GetArtifactReader(ctx, obs.asset)
+	if nil != err {
+		return nil, err
+	}
+	closer, _ := reader.(io.Closer)
+	sized, ok := reader.(interface{ Size() int64 })
+	if !ok {
+		if nil != closer {
+			closer.Close()
+		}
+		return nil, errors.New("artifact reader has no size")
+	}
+	z, err := zip.NewReader(reader, sized.Size())
+	if nil != err {
+		if nil != closer {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	root = &zipNode{time: obs.asset.Time(), children: make(map[string]*zipNode)}
+	for _, f := range z.File {
+		node := root
+		comp := strings.Split(strings.Trim(path.Clean("/"+f.Name), "/"), "/")
+		for i, c := range comp {
+			if "" == c {
+				break
+			}
+			child, ok := node.children[c]
+			if !ok {
+				child = &zipNode{time: f.Modified, children: make(map[string]*zipNode)}
+				node.children[c] = child
+				if fs.caseins {
+					// index folded names once, instead of comparing with every child
+					// when a name is looked up
+					if nil == node.folded {
+						node.folded = make(map[string]*zipNode)
+					}
+					k := unionfs.Foldpath(c, true, unionfs.UnormNone)
+					if _, ok := node.folded[k]; !ok {
+						node.folded[k] = child
+					}
+				}
+			}
+			if len(comp)-1 == i && !strings.HasSuffix(f.Name, "/") {
+				child.file = f
+			}
+			node = child
+		}
+	}
+
+	fs.zips.lock.Lock()
+	if r, ok := fs.zips.data[obs.asset]; ok {
+		fs.zips.lock.Unlock()
+		if nil != closer {
+			closer.Close()
+		}
+		return r, nil
+	}
+	if nil == fs.zips.data || artifactCacheMax <= len(fs.zips.data) {
+		for _, c := range fs.zips.open {
+			c.Close()
+		}
+		fs.zips.data = make(map[providers.Asset]*zipNode)
+		fs.zips.open = nil
+	}
+	fs.zips.data[obs.asset] = root
+	if nil != closer {
+		fs.zips.open = append(fs.zips.open, closer)
+	}
+	fs.zips.lock.Unlock()
+
+	return root, nil
+}
+
+// Function openartifact opens the artifact or the file within an artifact named by the
+// path component c within the .artifacts directory.
+func (fs *hubfs) openartifact(ctx context.Context, obs *obstack, c string) error {
+	switch obs.special {
+	case specialArtifacts:
+		lst, err := obs.repository.(providers.ArtifactRepository).GetArtifacts(ctx)
+		if nil != err {
+			return err
+		}
+		for _, elm := range lst {
+			if elm.Name() == c || (fs.caseins && strings.EqualFold(elm.Name(), c)) {
+				obs.special, obs.asset = specialArtifact, elm
+				return nil
+			}
+		}
+	case specialArtifact, specialZipEntry:
+		node := obs.znode
+		if nil == node {
+			var err error
+			node, err = fs.artifactTree(ctx, obs)
+			if nil != err {
+				return err
+			}
+		}
+		if nil == node.file {
+			if child, ok := node.lookup(c); ok {
+				obs.special, obs.znode = specialZipEntry, child
+				return nil
+			}
+		}
+	}
+	return providers.ErrNotFound
+}
+
+// Function artifactdir returns the entries of a directory within the .artifacts
+// directory.
+func (fs *hubfs) artifactdir(ctx context.Context, obs *obstack) (res []dirent, err error) {
+	if specialArtifacts == obs.special {
+		lst, err := obs.repository.(providers.ArtifactRepository).GetArtifacts(ctx)
+		if nil != err {
+			return nil, err
+		}
+		res = make([]dirent, len(lst))
+		for i, elm := range lst {
+			res[i].name = elm.Name()
+			fuseStat(&res[i].stat, fuse.S_IFDIR, 0, elm.Time())
+		}
+		return res, nil
+	}
+
+	node := obs.znode
+	if nil == node {
+		node, err = fs.artifactTree(ctx, obs)
+		if nil != err {
+			return nil, err
+		}
+	}
+	res = make([]dirent, 0, len(node.children))
+	for n, child := range node.children {
+		d := dirent{name: n}
+		artifactstat(child, &d.stat)
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// Function artifactstat returns the stat of a directory or file within the .artifacts
+// directory.
+func artifactstat(node *zipNode, stat *fuse.Stat_t) {
+	if nil != node.file {
+		fuseStat(stat, fuse.S_IFREG|uint32(node.file.Mode().Perm()&0111),
+			int64(node.file.UncompressedSize64), node.time)
+	} else {
+		fuseStat(stat, fuse.S_IFDIR, 0, node.time)
+	}
+}
+
+// Type zipReader reads a file within the archive of an artifact. The file is
+// decompressed sequentially; reading at an earlier offset restarts the decompression.
+type zipReader struct {
+	lock sync.Mutex
+	file *zip.File
+	rc   io.ReadCloser
+	pos  int64
+}
+
+func (z *zipReader) ReadAt(p []byte, ofst int64) (n int, err error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	if nil == z.rc || ofst < z.pos {
+		if nil != z.rc {
+			z.rc.Close()
+			z.rc = nil
+		}
+		z.rc, err = z.file.Open()
+		if nil != err {
+			return 0, err
+		}
+		z.pos = 0
+	}
+	if ofst > z.pos {
+		m, err := io.CopyN(ioutil.Discard, z.rc, ofst-z.pos)
+		z.pos += m
+		if nil != err {
+			return 0, err
+		}
+	}
+
+	n, err = io.ReadFull(z.rc, p)
+	z.pos += int64(n)
+	if io.ErrUnexpectedEOF == err {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (z *zipReader) Close() error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if nil != z.rc {
+		z.rc.Close()
+		z.rc = nil
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+ * audit.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	pathutil "path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// An audit log records every open of repository content and the first read through each
+// open file. Each record contains the path of the file, the owner, repository, ref and
+// commit that the file belongs to and the uid, gid and pid of the process that accessed
+// the file (where the OS reports them). Records are written either as JSON lines or in
+// the Common Event Format (CEF).
+
+// AuditRecord is a record of the audit log.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"` // "open" or "read"
+	Path       string    `json:"path"`
+	Owner      string    `json:"owner"`
+	Repository string    `json:"repository"`
+	Ref        string    `json:"ref"`
+	Commit     string    `json:"commit,omitempty"`
+	Uid        uint32    `json:"uid"`
+	Gid        uint32    `json:"gid"`
+	Pid        int       `json:"pid"`
+}
+
+// AuditLog writes audit records to a writer. It may be shared by multiple file systems.
+type AuditLog struct {
+	lock    sync.Mutex
+	writer  io.Writer
+	cef     bool
+	version string
+}
+
+// Function NewAuditLog creates an audit log that writes records to writer in the
+// specified format: "json" (the default) or "cef". The version is reported in the
+// header of CEF records.
+func NewAuditLog(writer io.Writer, format string, version string) (*AuditLog, error) {
+	log := &AuditLog{writer: writer, version: version}
+	switch format {
+	case "", "json":
+	case "cef":
+		log.cef = true
+	default:
+		return nil, errors.New("invalid audit log format: " + format)
+	}
+	return log, nil
+}
+
+// Function Write writes a record to the audit log.
+func (log *AuditLog) Write(rec *AuditRecord) error {
+	var line []byte
+	if log.cef {
+		line = []byte(log.formatCEF(rec))
+	} else {
+		var err error
+		line, err = json.Marshal(rec)
+		if nil != err {
+			return err
+		}
+		line = append(line, '\n')
+	}
+
+	log.lock.Lock()
+	_, err := log.writer.Write(line)
+	log.lock.Unlock()
+	return err
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func (log *AuditLog) formatCEF(rec *AuditRecord) string {
+	h := cefHeaderEscaper.Replace
+	v := cefValueEscaper.Replace
+	return fmt.Sprintf("CEF:0|Hubfs|HUBFS|%s|%s|%s file|3|"+
+		"rt=%d suid=%d sgid=%d spid=%d fname=%s "+
+		"cs1Label=owner cs1=%s cs2Label=repository cs2=%s cs3Label=ref cs3=%s "+
+		"cs4Label=commit cs4=%s\n",
+		h(log.version), h(rec.Event), h(strings.Title(rec.Event)),
+		rec.Time.UnixNano()/int64(time.Millisecond), rec.Uid, rec.Gid, rec.Pid, v(rec.Path),
+		v(rec.Owner), v(rec.Repository), v(rec.Ref), v(rec.Commit))
+}
+
+// Function audit writes an audit record for an access to the content of an open file.
+func (fs *hubfs) audit(event string, path string, obs *obstack) {
+	if nil == fs.auditor || nil == obs.ref {
+		return
+	}
+
+	rec := &AuditRecord{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		Path:       pathutil.Join(fs.prefix, path),
+		Owner:      obs.owner.Name(),
+		Repository: obs.repository.Name(),
+		Ref:        obs.ref.Name(),
+	}
+	if c, ok := obs.ref.(providers.CommitRef); ok {
+		rec.Commit = c.CommitHash()
+	}
+	rec.Uid, rec.Gid, rec.Pid = fuse.Getcontext()
+
+	if err := fs.auditor.Write(rec); nil != err {
+		tracef("audit log error: %v", err)
+	}
+}
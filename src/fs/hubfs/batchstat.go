@@ -0,0 +1,140 @@
+/*
+ * batchstat.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	pathutil "path"
+	"sync"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// Getattr calls often arrive in bursts for the entries of a single directory
+// (e.g. after a Readdir). Instead of resolving each path separately, the stats
+// of all entries of a directory are computed at once and kept for a short time.
+
+// time that a batch of directory entry stats remains valid
+const statBatchTTL = time.Second
+
+// maximum number of directory batches kept
+const statBatchMax = 64
+
+type statBatch struct {
+	expires time.Time
+	stats   map[string]fuse.Stat_t
+}
+
+type statCache struct {
+	lock    sync.Mutex
+	batches map[string]*statBatch
+}
+
+func (c *statCache) get(dirpath string) *statBatch {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	batch, ok := c.batches[dirpath]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(batch.expires) {
+		delete(c.batches, dirpath)
+		return nil
+	}
+	return batch
+}
+
+func (c *statCache) set(dirpath string, lst []dirent) {
+	batch := &statBatch{
+		expires: time.Now().Add(statBatchTTL),
+		stats:   make(map[string]fuse.Stat_t, len(lst)),
+	}
+	for _, e := range lst {
+		batch.stats[e.name] = e.stat
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if nil == c.batches {
+		c.batches = make(map[string]*statBatch)
+	}
+	if statBatchMax <= len(c.batches) {
+		now := time.Now()
+		for k, b := range c.batches {
+			if now.After(b.expires) {
+				delete(c.batches, k)
+			}
+		}
+		for k := range c.batches {
+			if statBatchMax > len(c.batches) {
+				break
+			}
+			delete(c.batches, k)
+		}
+	}
+	c.batches[dirpath] = batch
+}
+
+// Function batchstat retrieves the stat of path from the batch of its directory,
+// computing the batch if necessary. It returns false if the path cannot be served
+// this way, in which case the caller should look up the path directly.
+func (fs *hubfs) batchstat(path string, stat *fuse.Stat_t) (errc int, ok bool) {
+	if 4 > len(split(pathutil.Join(fs.prefix, path))) {
+		// only entries within a ref are batched: /owner/repo/ref/entry
+		return
+	}
+
+	dirpath, name := pathutil.Split(path)
+	if "" == name {
+		return
+	}
+	dirpath = pathutil.Clean(dirpath)
+
+	batch := fs.stats.get(dirpath)
+	if nil == batch {
+		e, obs := fs.iopen(dirpath)
+		if 0 != e {
+			return
+		}
+		if nil == obs.ref || specialNone != obs.special {
+			fs.release(obs)
+			return
+		}
+
+		var lst []dirent
+		err := fs.interruptible(func(ctx context.Context) (err error) {
+			lst, err = fs.treedir(ctx, obs, dirpath)
+			return
+		})
+		fs.release(obs)
+		if nil != err {
+			return
+		}
+
+		fs.stats.set(dirpath, lst)
+		batch = fs.stats.get(dirpath)
+		if nil == batch {
+			return
+		}
+	}
+
+	s, found := batch.stats[name]
+	if !found {
+		// names may differ in case or be absent; let the direct lookup decide
+		return
+	}
+	*stat = s
+	return 0, true
+}
@@ -0,0 +1,234 @@
+/*
+ * export.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	pathutil "path"
+	"path/filepath"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/port"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// Export materializes the tree of a ref (or of a directory within a ref) in a local
+// directory. The blobs of the tree are fetched into the cache in batches and the files
+// are cloned (reflinked) from the cache where the file system supports it, or copied
+// from it otherwise. Files with identical content and mode are hardlinked to each other.
+// Because of this exported files are read-only.
+
+// ExportStats reports the work done by Export.
+type ExportStats struct {
+	Dirs     int   // directories created
+	Files    int   // regular files created
+	Symlinks int   // symbolic links created
+	Linked   int   // files hardlinked to an identical file of the export
+	Cloned   int   // files cloned from the cache
+	Copied   int64 // bytes copied
+}
+
+type exportItem struct {
+	entry providers.TreeEntry
+	path  string // target path
+}
+
+// Function Export materializes the tree at path (relative to c.Prefix) in the directory
+// target, which must not exist or be empty.
+func Export(ctx context.Context, c Config, path string, target string) (
+	stats ExportStats, err error) {
+
+	c.Prefix = pathutil.Clean("/" + c.Prefix)
+	fs := new(c).(*hubfs)
+	errc, obs := fs.open(ctx, path)
+	if 0 != errc {
+		if -fuse.ENOENT == errc {
+			return stats, fmt.Errorf("%s: not found", path)
+		}
+		return stats, fmt.Errorf("%s: %v", path, fuse.Error(errc))
+	}
+	defer fs.release(obs)
+	if nil == obs.ref || specialNone != obs.special {
+		return stats, fmt.Errorf("%s: not a ref or a directory within a ref", path)
+	}
+	if nil != obs.entry && fuse.S_IFDIR != obs.entry.Mode()&fuse.S_IFMT {
+		return stats, fmt.Errorf("%s: not a directory", path)
+	}
+
+	if f, e := os.Open(target); nil == e {
+		_, e = f.Readdirnames(1)
+		f.Close()
+		if io.EOF != e {
+			return stats, fmt.Errorf("%s: not an empty directory", target)
+		}
+	}
+	err = os.MkdirAll(target, 0755)
+	if nil != err {
+		return
+	}
+
+	x := &exporter{fs: fs, obs: obs, stats: &stats, links: make(map[string]string)}
+	var files []exportItem
+	err = x.mkdirs(ctx, obs.entry, target, &files)
+	if nil != err {
+		return
+	}
+
+	if p, ok := obs.repository.(providers.BlobPrefetcher); ok {
+		entries := make([]providers.TreeEntry, len(files))
+		for i, f := range files {
+			entries[i] = f.entry
+		}
+		err = p.PrefetchBlobs(ctx, entries)
+		if nil != err {
+			return
+		}
+	}
+
+	for _, f := range files {
+		err = x.export(ctx, f.entry, f.path)
+		if nil != err {
+			return
+		}
+	}
+
+	return
+}
+
+type exporter struct {
+	fs    *hubfs
+	obs   *obstack
+	stats *ExportStats
+	links map[string]string // cache file and mode -> first exported file
+}
+
+// Function mkdirs creates the directories and symbolic links of the tree of entry and
+// collects its regular files.
+func (x *exporter) mkdirs(ctx context.Context, entry providers.TreeEntry, dir string,
+	files *[]exportItem) error {
+
+	lst, err := x.obs.repository.GetTree(ctx, x.obs.ref, entry)
+	if nil != err {
+		return err
+	}
+
+	for _, e := range lst {
+		name := e.Name()
+		if x.fs.mangle {
+			name = mangleName(name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch e.Mode() & fuse.S_IFMT {
+		case fuse.S_IFDIR:
+			err = os.Mkdir(path, 0755)
+			if nil == err {
+				x.stats.Dirs++
+				err = x.mkdirs(ctx, e, path, files)
+			}
+		case 0160000 /* submodule */ :
+			// like a checkout without initialized submodules
+			err = os.Mkdir(path, 0755)
+			if nil == err {
+				x.stats.Dirs++
+			}
+		case fuse.S_IFLNK:
+			err = os.Symlink(e.Target(), path)
+			if nil == err {
+				x.stats.Symlinks++
+			}
+		default:
+			*files = append(*files, exportItem{e, path})
+		}
+		if nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Function export creates a regular file with the content of entry.
+func (x *exporter) export(ctx context.Context, entry providers.TreeEntry, path string) (
+	err error) {
+
+	mode := os.FileMode(0444)
+	if 0 != entry.Mode()&0111 {
+		mode = 0555
+	}
+
+	reader, err := x.obs.repository.GetBlobReader(ctx, entry)
+	if nil != err {
+		return err
+	}
+	defer reader.(io.Closer).Close()
+
+	// converted content may differ in size from the blob
+	var cache *os.File
+	size := entry.Size()
+	if cf, ok := reader.(providers.CacheFile); ok {
+		cache = cf.CacheFile()
+	}
+	if nil != cache {
+		if info, e := cache.Stat(); nil == e {
+			size = info.Size()
+		}
+	}
+
+	key := ""
+	if nil != cache {
+		key = fmt.Sprintf("%s:%o", cache.Name(), mode)
+		if first, ok := x.links[key]; ok {
+			if nil == os.Link(first, path) {
+				x.stats.Files++
+				x.stats.Linked++
+				return nil
+			}
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if nil != err {
+		return err
+	}
+	if nil == cache || nil != port.Reflink(file, cache) {
+		var n int64
+		n, err = io.Copy(file, io.NewSectionReader(reader, 0, size))
+		x.stats.Copied += n
+	} else {
+		x.stats.Cloned++
+	}
+	if nil == err {
+		err = file.Chmod(mode)
+	}
+	if e := file.Close(); nil == err {
+		err = e
+	}
+	if nil != err {
+		os.Remove(path)
+		return err
+	}
+
+	t := x.fs.mtime(ctx, x.obs, entry)
+	os.Chtimes(path, t, t)
+
+	x.stats.Files++
+	if "" != key {
+		x.links[key] = path
+	}
+	return nil
+}
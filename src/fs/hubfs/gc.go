@@ -0,0 +1,190 @@
+/*
+ * gc.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// The local changes of a writable ref are kept in DIR/owner/repository/files/ref and its
+// path map in DIR/owner/repository/meta/ref (see newOverlay). When a branch or tag is
+// deleted on the server (or its repository is deleted) these directories are no longer
+// reachable through a mount. CollectGarbage removes them, but only once they have not
+// been modified for a retention period, so that changes made shortly before a ref
+// disappeared can still be recovered from the cache directory.
+
+// GCStats reports the work done by CollectGarbage.
+type GCStats struct {
+	Refs    int // refs examined
+	Orphans int // refs that no longer exist
+	Removed int // orphans removed (or that would be removed in a dry run)
+	Bytes   int64
+}
+
+// Function CollectGarbage removes the local changes of the refs in the cache directory of
+// the client that no longer exist on the remote and have not been modified for at least
+// age. The function report is called with the path of the ref (owner/repository/ref) of
+// each orphan and whether it is removed. If dryrun is true nothing is removed. Refs whose
+// existence cannot be determined (e.g. because of a network error) are kept.
+func CollectGarbage(ctx context.Context, client providers.Client, age time.Duration,
+	dryrun bool, report func(path string, removed bool)) (stats GCStats, err error) {
+
+	dir := client.GetDirectory()
+	if "" == dir {
+		return
+	}
+
+	list, err := filepath.Glob(filepath.Join(dir, "*", "*", "files", "*"))
+	if nil != err {
+		return
+	}
+	meta, err := filepath.Glob(filepath.Join(dir, "*", "*", "meta", "*"))
+	if nil != err {
+		return
+	}
+	list = append(list, meta...)
+
+	// group the ref directories by owner and repository
+	type refdirs struct {
+		owner, repository string
+		refs              map[string][]string
+	}
+	var order []string
+	repos := map[string]*refdirs{}
+	for _, path := range list {
+		rel, _ := filepath.Rel(dir, path)
+		comp := strings.Split(filepath.ToSlash(rel), "/")
+		k := comp[0] + "/" + comp[1]
+		rd, ok := repos[k]
+		if !ok {
+			rd = &refdirs{owner: comp[0], repository: comp[1], refs: map[string][]string{}}
+			repos[k] = rd
+			order = append(order, k)
+		}
+		rd.refs[comp[3]] = append(rd.refs[comp[3]], path)
+	}
+
+	now := time.Now()
+	for _, k := range order {
+		if err = ctx.Err(); nil != err {
+			return
+		}
+
+		rd := repos[k]
+		live, ok := gcLiveRefs(ctx, client, rd.owner, rd.repository)
+		if !ok {
+			stats.Refs += len(rd.refs)
+			continue
+		}
+
+		for n, paths := range rd.refs {
+			stats.Refs++
+			if gcIsLive(n, live) {
+				continue
+			}
+			stats.Orphans++
+
+			mtime, size := time.Time{}, int64(0)
+			for _, p := range paths {
+				filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+					if nil == err {
+						if info.ModTime().After(mtime) {
+							mtime = info.ModTime()
+						}
+						if info.Mode().IsRegular() {
+							size += info.Size()
+						}
+					}
+					return nil
+				})
+			}
+			removed := now.Sub(mtime) >= age
+			if removed {
+				stats.Removed++
+				stats.Bytes += size
+				if !dryrun {
+					for _, p := range paths {
+						if e := os.RemoveAll(p); nil != e {
+							tracef("path=%q: %v", p, e)
+						}
+					}
+				}
+			}
+			if nil != report {
+				report(k+"/"+n, removed)
+			}
+		}
+	}
+
+	return
+}
+
+// Function gcLiveRefs returns the overlay directory names of the refs of a repository. It
+// reports false if it cannot determine them; a repository (or owner) that is not found
+// has no refs.
+func gcLiveRefs(ctx context.Context, client providers.Client, ownername string,
+	reponame string) (map[string]bool, bool) {
+
+	owner, err := client.OpenOwner(ctx, ownername)
+	if providers.ErrNotFound == err {
+		return nil, true
+	} else if nil != err {
+		return nil, false
+	}
+	defer client.CloseOwner(owner)
+
+	repository, err := client.OpenRepository(ctx, owner, reponame)
+	if providers.ErrNotFound == err {
+		return nil, true
+	} else if nil != err {
+		return nil, false
+	}
+	defer client.CloseRepository(repository)
+
+	refs, err := repository.GetRefs(ctx)
+	if nil != err {
+		return nil, false
+	}
+	live := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		live[strings.ReplaceAll(refShortName(ref.Name()), "/", refSlashSeparator)] = true
+	}
+	return live, true
+}
+
+// Function gcIsLive reports whether the overlay directory name n belongs to a live ref.
+// Commit refs (named by their hash) do not change and are never orphans; names are also
+// compared case-insensitively, because the overlays of case-insensitive repositories are
+// named after the ref as it was looked up.
+func gcIsLive(n string, live map[string]bool) bool {
+	if live[n] {
+		return true
+	}
+	if _, err := hex.DecodeString(n); nil == err && 4 <= len(n) {
+		return true
+	}
+	for l := range live {
+		if strings.EqualFold(l, n) {
+			return true
+		}
+	}
+	return false
+}
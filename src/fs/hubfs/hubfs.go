@@ -14,7 +14,10 @@
 package hubfs
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"os"
 	pathutil "path"
 	"strings"
 	"sync"
@@ -22,44 +25,117 @@ import (
 
 	"github.com/billziss-gh/cgofuse/fuse"
 	libtrace "github.com/billziss-gh/golib/trace"
+	"github.com/billziss-gh/hubfs/fs/port"
+	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/metrics"
 	"github.com/billziss-gh/hubfs/providers"
 )
 
 type hubfs struct {
 	fuse.FileSystemBase
 	client  providers.Client
+	remote  string
 	prefix  string
+	refenc  RefEncoding
+	caseins bool
+	mangle  bool
+	cmtime  bool
+	arts    bool
+	issues  bool
+	quota   int64
+	auditor *AuditLog
+	tracer  *AccessTrace
+	intr    bool
+	init    func()
 	lock    sync.RWMutex
 	fh      uint64
 	openmap map[uint64]*obstack
+	stats   statCache
+	invalid invalidCache
+	usage   usageCache
+	zips    artifactCache
 }
 
 type obstack struct {
 	owner      providers.Owner
 	repository providers.Repository
+	refdir     string // partial ref name (RefEncodingNested)
 	ref        providers.Ref
+	nref       int // number of path components up to and including the ref
 	entry      providers.TreeEntry
+	special    int    // special (virtual) directory or file (see mangle.go)
+	link       string // target of a special symlink
+	release    providers.Release
+	issue      providers.Issue
+	asset      providers.Asset // release asset or artifact
+	znode      *zipNode        // file or directory within an artifact
 	reader     io.ReaderAt
+	file       *os.File // cache file that backs reader, if any
+}
+
+// fallocate is implemented by file systems that can allocate space for an open file.
+type fallocate interface {
+	Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) int
 }
 
 type Config struct {
 	Client  providers.Client
+	Remote  string // remote name reported in .hubfs_info files
 	Prefix  string
 	Caseins bool
 	Overlay bool
+	Notify  func(path string, action uint32) // notifies the OS of ref directory changes
+
+	VerifyPaths bool              // detect path key collisions in overlays (see unionfs.Pathmap)
+	SortPaths   bool              // write the path maps of overlays in key order
+	Collide     func(path string) // called when a path key collision is detected
+
+	RefEncoding RefEncoding   // mapping of ref names to directory names
+	Unorm       unionfs.Unorm // Unicode normalization form under which paths are compared
+	Mangle      bool          // mangle file names that are invalid on Windows
+	Quota       int64         // space reported as the total space of the file system
+	CommitTime  bool          // report the time of the last commit that modified a file
+	Artifacts   bool          // present the build artifacts of repositories (see artifact.go)
+	Issues      bool          // present the issues of repositories (see issue.go)
+	AuditLog    *AuditLog     // records accesses to repository content
+	AccessTrace *AccessTrace  // records the paths of opened files (see Warmup)
+	TrashDir    string        // backs the trash directories of the root; "" denies them
+	Interrupts  bool          // FUSE requests can be interrupted (mount option intr)
+	Init        func()        // called when the file system is mounted
 }
 
 const refSlashSeparator = "+"
 
+// interval at which long-running operations check for interrupted requests
+const interruptPollInterval = 100 * time.Millisecond
+
 func new(c Config) fuse.FileSystemInterface {
 	return &hubfs{
 		client:  c.Client,
+		remote:  c.Remote,
 		prefix:  c.Prefix,
+		refenc:  c.RefEncoding,
+		caseins: c.Caseins,
+		mangle:  c.Mangle,
+		cmtime:  c.CommitTime,
+		arts:    c.Artifacts,
+		issues:  c.Issues,
+		auditor: c.AuditLog,
+		tracer:  c.AccessTrace,
+		quota:   c.Quota,
+		intr:    c.Interrupts && port.InterruptSupported,
+		init:    c.Init,
 		openmap: make(map[uint64]*obstack),
 	}
 }
 
-func (fs *hubfs) openex(path string, norm bool) (errc int, res *obstack, lst []string) {
+func (fs *hubfs) Init() {
+	if nil != fs.init {
+		fs.init()
+	}
+}
+
+func (fs *hubfs) openex(ctx context.Context, path string, norm bool) (errc int, res *obstack, lst []string) {
 	if strings.HasSuffix(path, "/.") {
 		errc = -fuse.ENOENT
 		return
@@ -69,8 +145,36 @@ func (fs *hubfs) openex(path string, norm bool) (errc int, res *obstack, lst []s
 	obs := &obstack{}
 	var err error
 	for i, c := range lst {
-		switch i {
-		case 0:
+		switch {
+		case specialInfo == obs.special || specialStarredLink == obs.special ||
+			specialAsset == obs.special || specialIssueMd == obs.special ||
+			specialIssueJSON == obs.special || specialRepoInfo == obs.special:
+			err = providers.ErrNotFound
+		case specialStarred == obs.special:
+			err = fs.openstarred(ctx, obs, c)
+		case infoName == c && nil == obs.repository:
+			obs.special = specialInfo
+		case 0 == i && starredName == c && fs.hasStarred():
+			obs.special = specialStarred
+		case nil != obs.repository && nil == obs.ref && "" == obs.refdir &&
+			repoInfoName == c && hasRepoInfo(obs):
+			obs.special = specialRepoInfo
+		case specialReleases <= obs.special && specialAsset > obs.special:
+			err = fs.openrelease(ctx, obs, c)
+		case nil != obs.repository && nil == obs.ref && "" == obs.refdir &&
+			releasesName == c && hasReleases(obs):
+			obs.special = specialReleases
+		case specialArtifacts <= obs.special && specialZipEntry >= obs.special:
+			err = fs.openartifact(ctx, obs, c)
+		case nil != obs.repository && nil == obs.ref && "" == obs.refdir &&
+			artifactsName == c && fs.hasArtifacts(obs):
+			obs.special = specialArtifacts
+		case specialIssues == obs.special:
+			err = fs.openissue(ctx, obs, c)
+		case nil != obs.repository && nil == obs.ref && "" == obs.refdir &&
+			issuesName == c && fs.hasIssues(obs):
+			obs.special = specialIssues
+		case 0 == i:
 			// We disallow some names to speed up operations:
 			//
 			// - All names containing dots: e.g. ".git", ".DS_Store", "autorun.inf"
@@ -78,46 +182,58 @@ func (fs *hubfs) openex(path string, norm bool) (errc int, res *obstack, lst []s
 			if -1 != strings.IndexFunc(c, func(r rune) bool { return '.' == r }) || "HEAD" == c {
 				obs.owner, err = nil, providers.ErrNotFound
 			} else {
-				obs.owner, err = fs.client.OpenOwner(c)
+				obs.owner, err = fs.client.OpenOwner(ctx, c)
 				if norm && nil == err {
 					lst[i] = obs.owner.Name()
 				}
 			}
-		case 1:
-			obs.repository, err = fs.client.OpenRepository(obs.owner, c)
+		case 1 == i:
+			obs.repository, err = fs.client.OpenRepository(ctx, obs.owner, c)
 			if norm && nil == err {
 				lst[i] = obs.repository.Name()
 			}
-		case 2:
-			c = strings.ReplaceAll(c, refSlashSeparator, "/")
-			obs.ref, err = obs.repository.GetRef("refs/heads/" + c)
-			if providers.ErrNotFound == err {
-				obs.ref, err = obs.repository.GetRef("refs/tags/" + c)
-				if providers.ErrNotFound == err {
-					obs.ref, err = obs.repository.GetTempRef(c)
-				}
+		case nil == obs.ref:
+			err = fs.openref(ctx, obs, c)
+			if nil == err && nil != obs.ref {
+				obs.nref = i + 1
 			}
 			if norm && nil == err {
-				r := obs.ref.Name()
-				n := strings.TrimPrefix(r, "refs/heads/")
-				if r == n {
-					n = strings.TrimPrefix(r, "refs/tags/")
-					if r == n {
-						n = r
-					}
+				n := obs.refdir
+				if nil != obs.ref {
+					n = refShortName(obs.ref.Name())
 				}
-				n = strings.ReplaceAll(n, "/", refSlashSeparator)
-				lst[i] = n
+				comp := strings.Split(fs.refenc.Encode(n), "/")
+				if len(comp) <= i+1 {
+					copy(lst[i+1-len(comp):], comp)
+				}
+			}
+		case fs.mangle && (specialNone != obs.special || (nil == obs.entry && mangleDir == c)):
+			switch {
+			case specialNone == obs.special:
+				obs.special = specialDir
+			case specialDir == obs.special && mangleList == c:
+				obs.special = specialNames
+			default:
+				err = providers.ErrNotFound
 			}
 		default:
-			obs.entry, err = obs.repository.GetTreeEntry(obs.ref, obs.entry, c)
+			e := obs.entry
+			obs.entry, err = obs.repository.GetTreeEntry(ctx, obs.ref, e, c)
+			if providers.ErrNotFound == err && fs.mangle {
+				if u := unmangleName(c); u != c {
+					obs.entry, err = obs.repository.GetTreeEntry(ctx, obs.ref, e, u)
+				}
+			}
 			if norm && nil == err {
 				lst[i] = obs.entry.Name()
+				if fs.mangle {
+					lst[i] = mangleName(lst[i])
+				}
 			}
 		}
 		if nil != err {
 			fs.release(obs)
-			errc = fuseErrc(err)
+			errc = fuseCtxErrc(ctx, err)
 			return
 		}
 	}
@@ -125,8 +241,91 @@ func (fs *hubfs) openex(path string, norm bool) (errc int, res *obstack, lst []s
 	return
 }
 
-func (fs *hubfs) open(path string) (errc int, res *obstack) {
-	errc, res, _ = fs.openex(path, false)
+// Function openref opens the ref named by the path component c. With RefEncodingNested
+// a component that is a prefix of ref names (e.g. "feature" for "feature/x") is
+// recorded in obs.refdir and the ref is opened by a subsequent component.
+func (fs *hubfs) openref(ctx context.Context, obs *obstack, c string) (err error) {
+	name := fs.refenc.Decode(c)
+	if "" != obs.refdir {
+		name = obs.refdir + "/" + name
+	}
+	obs.ref, err = obs.repository.GetRef(ctx, "refs/heads/"+name)
+	if providers.ErrNotFound == err {
+		obs.ref, err = obs.repository.GetRef(ctx, "refs/tags/"+name)
+	}
+	if providers.ErrNotFound == err && RefEncodingNested == fs.refenc {
+		var refdir string
+		refdir, err = fs.refdir(ctx, obs.repository, name)
+		if nil == err {
+			obs.refdir = refdir
+			return
+		}
+	}
+	if providers.ErrNotFound == err && "" == obs.refdir {
+		obs.ref, err = obs.repository.GetTempRef(ctx, name)
+	}
+	return
+}
+
+// Function refdir returns the ref name prefix that matches name, if there are branches
+// or tags whose names start with name followed by a slash.
+func (fs *hubfs) refdir(ctx context.Context, repository providers.Repository, name string) (
+	string, error) {
+
+	lst, err := repository.GetRefs(ctx)
+	if nil != err {
+		return "", err
+	}
+	for _, elm := range lst {
+		n := refShortName(elm.Name())
+		if len(n) <= len(name) || '/' != n[len(name)] {
+			continue
+		}
+		if n[:len(name)] == name || (fs.caseins && strings.EqualFold(n[:len(name)], name)) {
+			return n[:len(name)], nil
+		}
+	}
+	return "", providers.ErrNotFound
+}
+
+// Function refShortName returns the name of a ref without its refs/heads/ or refs/tags/
+// prefix.
+func refShortName(r string) string {
+	n := strings.TrimPrefix(r, "refs/heads/")
+	if r == n {
+		n = strings.TrimPrefix(r, "refs/tags/")
+	}
+	return n
+}
+
+// Function refcomps returns the number of leading components of comp (a path relative
+// to the file system prefix) that name a ref, or -1 if comp does not lead to a ref.
+func (fs *hubfs) refcomps(comp []string) int {
+	for k := 3 - len(split(fs.prefix)); len(comp) >= k; k++ {
+		errc, obs := fs.open(context.Background(), "/"+strings.Join(comp[:k], "/"))
+		if 0 != errc {
+			return -1
+		}
+		found := nil != obs.ref
+		fs.release(obs)
+		if found {
+			return k
+		}
+	}
+	return -1
+}
+
+func (fs *hubfs) open(ctx context.Context, path string) (errc int, res *obstack) {
+	errc, res, _ = fs.openex(ctx, path, false)
+	return
+}
+
+// Function iopen opens path while allowing the current FUSE request to be interrupted.
+func (fs *hubfs) iopen(path string) (errc int, res *obstack) {
+	fs.interruptible(func(ctx context.Context) error {
+		errc, res = fs.open(ctx, path)
+		return nil
+	})
 	return
 }
 
@@ -139,20 +338,43 @@ func (fs *hubfs) release(obs *obstack) {
 	}
 }
 
-func (fs *hubfs) getattr(obs *obstack, entry providers.TreeEntry, path string, stat *fuse.Stat_t) (
+// Function mtime returns the modification time of an entry: the time of the last commit
+// that modified it (if Config.CommitTime is set and the repository supports it) or the
+// time of the ref.
+func (fs *hubfs) mtime(ctx context.Context, obs *obstack, entry providers.TreeEntry) time.Time {
+	if fs.cmtime {
+		if r, ok := obs.repository.(providers.CommitTimeRepository); ok {
+			if t, err := r.GetCommitTime(ctx, obs.ref, entry); nil == err {
+				return t
+			}
+		}
+	}
+	return obs.ref.TreeTime()
+}
+
+func (fs *hubfs) getattr(ctx context.Context, obs *obstack, entry providers.TreeEntry, path string, stat *fuse.Stat_t) (
 	target string) {
 
 	if nil != entry {
 		mode := entry.Mode()
-		fuseStat(stat, mode, entry.Size(), obs.ref.TreeTime())
+		fuseStat(stat, mode, entry.Size(), fs.mtime(ctx, obs, entry))
+		if "" != decrypted(entry) {
+			stat.Mode &^= 0222
+		}
 		switch mode & fuse.S_IFMT {
 		case fuse.S_IFLNK:
 			target = entry.Target()
 			stat.Size = int64(len(target))
 		case 0160000 /* submodule */ :
 			target = entry.Target()
-			path = repoPath(pathutil.Join(fs.prefix, path))
-			module, err := obs.repository.GetModule(obs.ref, path, true)
+			comp := split(pathutil.Join(fs.prefix, path))[obs.nref:]
+			if fs.mangle {
+				for i := range comp {
+					comp[i] = unmangleName(comp[i])
+				}
+			}
+			path = strings.Join(comp, "/")
+			module, err := obs.repository.GetModule(ctx, obs.ref, path, true)
 			module = strings.TrimPrefix(module, strings.TrimSuffix(fs.prefix, "/"))
 			if "" != module {
 				target = module + "/" + entry.Target()
@@ -162,6 +384,25 @@ func (fs *hubfs) getattr(obs *obstack, entry providers.TreeEntry, path string, s
 			}
 			stat.Size = int64(len(target))
 		}
+	} else if specialNames == obs.special {
+		data, _ := fs.invalidNames(ctx, obs)
+		fuseStat(stat, fuse.S_IFREG, int64(len(data)), obs.ref.TreeTime())
+	} else if specialInfo == obs.special {
+		fuseStat(stat, fuse.S_IFREG, int64(len(fs.info(obs))), time.Now())
+	} else if specialRepoInfo == obs.special {
+		data, _ := fs.repoInfo(ctx, obs)
+		fuseStat(stat, fuse.S_IFREG, int64(len(data)), time.Now())
+	} else if specialStarredLink == obs.special {
+		target = obs.link
+		fuseStat(stat, fuse.S_IFLNK, int64(len(target)), time.Now())
+	} else if specialReleases <= obs.special && specialAsset >= obs.special {
+		releasestat(obs, stat)
+	} else if specialZipEntry == obs.special {
+		artifactstat(obs.znode, stat)
+	} else if specialArtifact == obs.special {
+		fuseStat(stat, fuse.S_IFDIR, 0, obs.asset.Time())
+	} else if specialIssueMd == obs.special || specialIssueJSON == obs.special {
+		fuseStat(stat, fuse.S_IFREG, int64(len(issuedata(obs))), obs.issue.Time())
 	} else {
 		fuseStat(stat, fuse.S_IFDIR, 0, time.Now())
 	}
@@ -169,12 +410,34 @@ func (fs *hubfs) getattr(obs *obstack, entry providers.TreeEntry, path string, s
 	return
 }
 
+// Function igetattr gets the attributes of an open path. Only attributes that may
+// require network access (the commit time of an entry or the target of a submodule)
+// are computed in a way that allows the current FUSE request to be interrupted.
+func (fs *hubfs) igetattr(obs *obstack, path string, stat *fuse.Stat_t) (target string) {
+	entry := obs.entry
+	if nil == entry || (!fs.cmtime && 0160000 != entry.Mode()&fuse.S_IFMT) {
+		return fs.getattr(context.Background(), obs, entry, path, stat)
+	}
+	fs.interruptible(func(ctx context.Context) error {
+		target = fs.getattr(ctx, obs, entry, path, stat)
+		return nil
+	})
+	return
+}
+
 func (fs *hubfs) Readpath(path string) (errc int, target string) {
 	defer trace(path)(&errc, &target)
 
-	errc, obs, normpath := fs.openex(path, true)
+	var obs *obstack
+	var normpath []string
+	fs.interruptible(func(ctx context.Context) error {
+		errc, obs, normpath = fs.openex(ctx, path, true)
+		return nil
+	})
 	if 0 == errc {
 		fs.release(obs)
+	} else if -fuse.EINTR == errc {
+		return
 	}
 
 	errc = 0
@@ -187,28 +450,90 @@ func (fs *hubfs) Readpath(path string) (errc int, target string) {
 func (fs *hubfs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
 	defer trace(path, fh)(&errc, stat)
 
-	errc, obs := fs.open(path)
+	if errc, ok := fs.batchstat(path, stat); ok {
+		return errc
+	}
+
+	errc, obs := fs.iopen(path)
 	if 0 != errc {
 		return
 	}
 
-	fs.getattr(obs, obs.entry, path, stat)
+	fs.igetattr(obs, path, stat)
 
 	fs.release(obs)
 
 	return
 }
 
+// Decrypted files (see config.gitcrypt.key and config.sops.key) are read-only and carry
+// the extended attribute user.hubfs.decrypted, whose value is the name of the transform
+// that decrypts them. In writable refs they cannot be modified, because their content
+// would be stored in the clear among the local changes.
+
+const decryptedXattr = "user.hubfs.decrypted"
+
+// Function decrypted returns the name of the transform that decrypts the content of an
+// entry, or "" if the content is not encrypted.
+func decrypted(entry providers.TreeEntry) string {
+	if d, ok := entry.(providers.DecryptedTreeEntry); ok {
+		return d.Decrypted()
+	}
+	return ""
+}
+
+// Function isdecrypted reports whether the file at path is decrypted.
+func (fs *hubfs) isdecrypted(path string) bool {
+	errc, obs := fs.iopen(path)
+	if 0 != errc {
+		return false
+	}
+	defer fs.release(obs)
+	return nil != obs.entry && "" != decrypted(obs.entry)
+}
+
+func (fs *hubfs) Getxattr(path string, name string) (errc int, value []byte) {
+	defer trace(path, name)(&errc, &value)
+
+	errc, obs := fs.iopen(path)
+	if 0 != errc {
+		return
+	}
+	defer fs.release(obs)
+
+	if decryptedXattr == name && nil != obs.entry {
+		if n := decrypted(obs.entry); "" != n {
+			return 0, []byte(n)
+		}
+	}
+	return -fuse.ENOATTR, nil
+}
+
+func (fs *hubfs) Listxattr(path string, fill func(name string) bool) (errc int) {
+	defer trace(path)(&errc)
+
+	errc, obs := fs.iopen(path)
+	if 0 != errc {
+		return
+	}
+	defer fs.release(obs)
+
+	if nil != obs.entry && "" != decrypted(obs.entry) {
+		fill(decryptedXattr)
+	}
+	return 0
+}
+
 func (fs *hubfs) Readlink(path string) (errc int, target string) {
 	defer trace(path)(&errc, &target)
 
-	errc, obs := fs.open(path)
+	errc, obs := fs.iopen(path)
 	if 0 != errc {
 		return
 	}
 
 	stat := fuse.Stat_t{}
-	target = fs.getattr(obs, obs.entry, path, &stat)
+	target = fs.igetattr(obs, path, &stat)
 	if "" == target {
 		errc = -fuse.EINVAL
 	}
@@ -221,7 +546,7 @@ func (fs *hubfs) Readlink(path string) (errc int, target string) {
 func (fs *hubfs) Opendir(path string) (errc int, fh uint64) {
 	defer trace(path)(&errc, &fh)
 
-	errc, obs := fs.open(path)
+	errc, obs := fs.iopen(path)
 	if 0 != errc {
 		return
 	}
@@ -231,6 +556,7 @@ func (fs *hubfs) Opendir(path string) (errc int, fh uint64) {
 	fs.openmap[fh] = obs
 	fs.fh++
 	fs.lock.Unlock()
+	metrics.AddGauge("hubfs.handles", 1)
 
 	return
 }
@@ -258,44 +584,140 @@ func (fs *hubfs) Readdir(path string,
 	fill(".", &stat, 0)
 	fill("..", &stat, 0)
 
-	if nil != obs.ref {
-		if lst, err := obs.repository.GetTree(obs.ref, obs.entry); nil == err {
-			for _, elm := range lst {
-				n := elm.Name()
-				fs.getattr(obs, elm, pathutil.Join(path, n), &stat)
-				if !fill(n, &stat, 0) {
-					break
-				}
-			}
+	var lst []dirent
+	err := fs.interruptible(func(ctx context.Context) error {
+		lst = fs.readdir(ctx, obs, path, stat)
+		return ctx.Err()
+	})
+	if nil != err {
+		errc = fuseErrc(err)
+		return
+	}
+
+	for i := range lst {
+		if !fill(lst[i].name, &lst[i].stat, 0) {
+			break
+		}
+	}
+
+	return
+}
+
+// Function treedir returns the entries of a directory within a ref along with their stats.
+func (fs *hubfs) treedir(ctx context.Context, obs *obstack, path string) (res []dirent, err error) {
+	lst, err := obs.repository.GetTree(ctx, obs.ref, obs.entry)
+	if nil != err {
+		return nil, err
+	}
+
+	res = make([]dirent, len(lst))
+	for i, elm := range lst {
+		n := elm.Name()
+		res[i].name = n
+		if fs.mangle {
+			res[i].name = mangleName(n)
+		}
+		fs.getattr(ctx, obs, elm, pathutil.Join(path, n), &res[i].stat)
+	}
+
+	return res, nil
+}
+
+type dirent struct {
+	name string
+	stat fuse.Stat_t
+}
+
+func (fs *hubfs) readdir(ctx context.Context, obs *obstack, path string, stat fuse.Stat_t) (
+	res []dirent) {
+
+	if specialDir == obs.special {
+		s := fuse.Stat_t{}
+		fs.getattr(ctx, &obstack{repository: obs.repository, ref: obs.ref, special: specialNames},
+			nil, "", &s)
+		res = []dirent{{mangleList, s}}
+	} else if specialStarred == obs.special {
+		if lst, err := fs.starreddir(ctx); nil == err {
+			res = lst
+		}
+	} else if specialReleases <= obs.special && specialAsset > obs.special {
+		if lst, err := fs.releasedir(ctx, obs); nil == err {
+			res = lst
+		}
+	} else if specialArtifacts <= obs.special && specialZipEntry >= obs.special {
+		if lst, err := fs.artifactdir(ctx, obs); nil == err {
+			res = lst
+		}
+	} else if specialIssues == obs.special {
+		if lst, err := fs.issuedir(ctx, obs); nil == err {
+			res = lst
+		}
+	} else if nil != obs.ref {
+		if lst, err := fs.treedir(ctx, obs, path); nil == err {
+			fs.stats.set(path, lst)
+			res = lst
 		}
 	} else if nil != obs.repository {
-		if lst, err := obs.repository.GetRefs(); nil == err {
+		if lst, err := obs.repository.GetRefs(ctx); nil == err {
+			prefix := "refs/heads/"
+			if "" != obs.refdir {
+				prefix += obs.refdir + "/"
+			}
+			res = make([]dirent, 0, len(lst)+4)
+			if "" == obs.refdir && hasRepoInfo(obs) {
+				s := fuse.Stat_t{}
+				fs.getattr(ctx, &obstack{repository: obs.repository, special: specialRepoInfo},
+					nil, "", &s)
+				res = append(res, dirent{repoInfoName, s})
+			}
+			if "" == obs.refdir && hasReleases(obs) {
+				res = append(res, dirent{releasesName, stat})
+			}
+			if "" == obs.refdir && fs.hasArtifacts(obs) {
+				res = append(res, dirent{artifactsName, stat})
+			}
+			if "" == obs.refdir && fs.hasIssues(obs) {
+				res = append(res, dirent{issuesName, stat})
+			}
+			seen := make(map[string]bool)
 			for _, elm := range lst {
 				r := elm.Name()
-				n := strings.TrimPrefix(r, "refs/heads/")
+				n := strings.TrimPrefix(r, prefix)
 				if r == n {
 					continue
 				}
-				n = strings.ReplaceAll(n, "/", refSlashSeparator)
-				if !fill(n, &stat, 0) {
-					break
+				n = fs.refenc.Encode(n)
+				if RefEncodingNested == fs.refenc {
+					if i := strings.IndexByte(n, '/'); -1 != i {
+						n = n[:i]
+					}
+					if seen[n] {
+						continue
+					}
+					seen[n] = true
 				}
+				res = append(res, dirent{n, stat})
 			}
 		}
 	} else if nil != obs.owner {
-		if lst, err := fs.client.GetRepositories(obs.owner); nil == err {
+		if lst, err := fs.client.GetRepositories(ctx, obs.owner); nil == err {
+			res = make([]dirent, 0, len(lst)+1)
+			res = append(res, fs.infodirent(obs))
 			for _, elm := range lst {
-				if !fill(elm.Name(), &stat, 0) {
-					break
+				if infoName != elm.Name() {
+					res = append(res, dirent{elm.Name(), stat})
 				}
 			}
 		}
 	} else {
-		if lst, err := fs.client.GetOwners(); nil == err {
+		if lst, err := fs.client.GetOwners(ctx); nil == err {
+			res = make([]dirent, 0, len(lst)+2)
+			res = append(res, fs.infodirent(obs))
+			if fs.hasStarred() {
+				res = append(res, dirent{starredName, stat})
+			}
 			for _, elm := range lst {
-				if !fill(elm.Name(), &stat, 0) {
-					break
-				}
+				res = append(res, dirent{elm.Name(), stat})
 			}
 		}
 	}
@@ -316,6 +738,7 @@ func (fs *hubfs) Releasedir(path string, fh uint64) (errc int) {
 		errc = -fuse.ENOENT
 		return
 	}
+	metrics.AddGauge("hubfs.handles", -1)
 
 	fs.release(obs)
 
@@ -325,16 +748,50 @@ func (fs *hubfs) Releasedir(path string, fh uint64) (errc int) {
 func (fs *hubfs) Open(path string, flags int) (errc int, fh uint64) {
 	defer trace(path, flags)(&errc, &fh)
 
-	errc, obs := fs.open(path)
+	errc, obs := fs.iopen(path)
 	if 0 != errc {
 		return
 	}
 
+	if specialNames == obs.special {
+		var data []byte
+		err := fs.interruptible(func(ctx context.Context) (err error) {
+			data, err = fs.invalidNames(ctx, obs)
+			return
+		})
+		if nil != err {
+			fs.release(obs)
+			errc = fuseErrc(err)
+			return
+		}
+		obs.reader = bytes.NewReader(data)
+	} else if specialInfo == obs.special {
+		obs.reader = bytes.NewReader(fs.info(obs))
+	} else if specialRepoInfo == obs.special {
+		var data []byte
+		err := fs.interruptible(func(ctx context.Context) (err error) {
+			data, err = fs.repoInfo(ctx, obs)
+			return
+		})
+		if nil != err {
+			fs.release(obs)
+			errc = fuseErrc(err)
+			return
+		}
+		obs.reader = bytes.NewReader(data)
+	} else if specialIssueMd == obs.special || specialIssueJSON == obs.special {
+		obs.reader = bytes.NewReader(issuedata(obs))
+	} else if nil != obs.entry {
+		fs.audit("open", path, obs)
+		fs.trace(path, obs)
+	}
+
 	fs.lock.Lock()
 	fh = fs.fh
 	fs.openmap[fh] = obs
 	fs.fh++
 	fs.lock.Unlock()
+	metrics.AddGauge("hubfs.handles", 1)
 
 	return
 }
@@ -343,11 +800,13 @@ func (fs *hubfs) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	defer trace(path, ofst, fh)(&n)
 
 	var reader io.ReaderAt
+	var file *os.File
 
 	fs.lock.RLock()
 	obs, ok := fs.openmap[fh]
 	if ok {
 		reader = obs.reader
+		file = obs.file
 	}
 	fs.lock.RUnlock()
 	if !ok {
@@ -356,30 +815,73 @@ func (fs *hubfs) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	}
 
 	if nil == reader {
-		reader, _ = obs.repository.GetBlobReader(obs.entry)
-		if nil == reader {
-			n = -fuse.EIO
+		n, reader, file = fs.getreader(path, obs)
+		if 0 != n {
 			return
 		}
+	}
+
+	var err error
+	if nil != file {
+		// content is materialized in the disk cache: read directly into the FUSE buffer
+		n, err = file.ReadAt(buff, ofst)
+	} else {
+		n, err = reader.ReadAt(buff, ofst)
+	}
+	if nil != err && io.EOF != err {
+		n = fuseErrc(err)
+		return
+	}
+
+	return
+}
+
+// Function getreader retrieves the blob reader of an open file and keeps it (and
+// its cache file) with the file for subsequent reads. The first retrieval is recorded
+// in the audit log as a read.
+func (fs *hubfs) getreader(path string, obs *obstack) (errc int, reader io.ReaderAt, file *os.File) {
+	if specialNone != obs.special && specialAsset != obs.special &&
+		(specialZipEntry != obs.special || nil == obs.znode.file) {
+		return -fuse.EIO, nil, nil
+	}
 
-		var closer io.Closer
-		fs.lock.Lock()
-		if nil == obs.reader {
-			obs.reader = reader
+	err := fs.interruptible(func(ctx context.Context) (err error) {
+		if specialAsset == obs.special {
+			reader, err = obs.repository.(providers.ReleaseRepository).GetAssetReader(ctx, obs.asset)
+		} else if specialZipEntry == obs.special {
+			reader = &zipReader{file: obs.znode.file}
 		} else {
-			closer = reader.(io.Closer)
-			reader = obs.reader
+			reader, err = obs.repository.GetBlobReader(ctx, obs.entry)
 		}
-		fs.lock.Unlock()
-		if nil != closer {
-			closer.Close()
+		return
+	})
+	if nil == reader {
+		errc = -fuse.EIO
+		if nil != err {
+			errc = fuseErrc(err)
 		}
+		return
 	}
 
-	n, err := reader.ReadAt(buff, ofst)
-	if nil != err && io.EOF != err {
-		n = fuseErrc(err)
-		return
+	if cf, ok := reader.(providers.CacheFile); ok {
+		file = cf.CacheFile()
+	}
+
+	var closer io.Closer
+	fs.lock.Lock()
+	if nil == obs.reader {
+		obs.reader = reader
+		obs.file = file
+	} else {
+		closer = reader.(io.Closer)
+		reader = obs.reader
+		file = obs.file
+	}
+	fs.lock.Unlock()
+	if nil != closer {
+		closer.Close()
+	} else {
+		fs.audit("read", path, obs)
 	}
 
 	return
@@ -398,6 +900,7 @@ func (fs *hubfs) Release(path string, fh uint64) (errc int) {
 		errc = -fuse.ENOENT
 		return
 	}
+	metrics.AddGauge("hubfs.handles", -1)
 
 	if closer, ok := obs.reader.(io.Closer); ok {
 		closer.Close()
@@ -408,14 +911,64 @@ func (fs *hubfs) Release(path string, fh uint64) (errc int) {
 	return
 }
 
+// Function interruptible runs fn with a context that is cancelled when the
+// FUSE request serviced by the calling goroutine is interrupted. It returns
+// context.Canceled if the request was interrupted. If requests cannot be interrupted
+// (see Config.Interrupts) fn is called directly.
+func (fs *hubfs) interruptible(fn func(ctx context.Context) error) error {
+	if !fs.intr {
+		return fn(context.Background())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	ticker := time.NewTicker(interruptPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if port.Interrupted() {
+				cancel()
+				<-done
+				return context.Canceled
+			}
+		}
+	}
+}
+
 func fuseErrc(err error) (errc int) {
 	errc = -fuse.EIO
 	if providers.ErrNotFound == err {
 		errc = -fuse.ENOENT
+	} else if providers.ErrUntrusted == err || providers.ErrPermission == err {
+		errc = -fuse.EACCES
+	} else if providers.ErrRateLimited == err {
+		errc = -fuse.EAGAIN
+	} else if providers.ErrTimeout == err {
+		errc = -fuse.ETIMEDOUT
+	} else if context.Canceled == err {
+		errc = -fuse.EINTR
 	}
 	return
 }
 
+// Function fuseCtxErrc is like fuseErrc, but reports EINTR for any error that
+// occurred after ctx was cancelled.
+func fuseCtxErrc(ctx context.Context, err error) int {
+	if nil != ctx.Err() {
+		return -fuse.EINTR
+	}
+	return fuseErrc(err)
+}
+
 func fuseStat(stat *fuse.Stat_t, mode uint32, size int64, time time.Time) {
 	switch mode & fuse.S_IFMT {
 	case fuse.S_IFDIR:
@@ -445,19 +998,6 @@ func split(path string) []string {
 	return comp
 }
 
-func repoPath(path string) string {
-	slashes := 0
-	for i := 0; len(path) > i; i++ {
-		if '/' == path[i] {
-			slashes++
-			if 4 == slashes {
-				return path[i+1:]
-			}
-		}
-	}
-	return ""
-}
-
 func trace(vals ...interface{}) func(vals ...interface{}) {
 	return libtrace.Trace(1, "", vals...)
 }
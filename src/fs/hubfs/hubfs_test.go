@@ -14,9 +14,28 @@
 package hubfs
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 	"unsafe"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/overlayfs"
+	"github.com/billziss-gh/hubfs/fs/unionfs/memfs"
+	"github.com/billziss-gh/hubfs/providers"
 )
 
 // See https://stackoverflow.com/q/42664837/568557
@@ -65,3 +84,1288 @@ func TestNewOverlay(t *testing.T) {
 		}
 	}
 }
+
+func TestTrash(t *testing.T) {
+	for _, p := range []string{"", "/1", "/1/2", "/1/2/3"} {
+		fs := newOverlay(Config{Prefix: p})
+		split := testGetUnexportedField(reflect.ValueOf(fs).Elem().FieldByName("split"))
+		r := split.Call([]reflect.Value{reflect.ValueOf("/.Trash-1000/files/a")})
+		if "/.Trash-1000" != r[0].String() || "/files/a" != r[1].String() {
+			t.Error(p, r[0].String(), r[1].String())
+		}
+	}
+
+	for _, n := range []string{".Trash", ".Trashes", ".Trash-0", ".Trash-1000"} {
+		if !isTrashName(n) {
+			t.Error(n)
+		}
+	}
+	for _, n := range []string{".trash", ".Trash-", ".Trash-x", ".Trash-1000x", "Trash"} {
+		if isTrashName(n) {
+			t.Error(n)
+		}
+	}
+
+	tmpdir, err := ioutil.TempDir("", "hubfs_trash_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if nil != newTrashfs("", ".Trash-1000") || nil != newTrashfs(tmpdir, ".Trash") {
+		t.Error()
+	}
+
+	fsmap := map[string]fuse.FileSystemInterface{
+		"/r":           memfs.New(),
+		"/.Trash-1000": newTrashfs(tmpdir, ".Trash-1000"),
+	}
+	fs := overlayfs.New(overlayfs.Config{
+		Topfs: memfs.New(),
+		Split: func(path string) (string, string) {
+			comp := split(path)
+			if 0 == len(comp) {
+				return "", path
+			}
+			return "/" + comp[0], "/" + strings.Join(comp[1:], "/")
+		},
+		Newfs: func(prefix string) fuse.FileSystemInterface {
+			return fsmap[prefix]
+		},
+		CopyRename: func(oldprefix string, newprefix string) bool {
+			return isTrashName(strings.TrimPrefix(oldprefix, "/")) ||
+				isTrashName(strings.TrimPrefix(newprefix, "/"))
+		},
+	})
+
+	if errc := fs.Mkdir("/r/d", 0755); 0 != errc {
+		t.Fatal(errc)
+	}
+	if errc := fs.Mknod("/r/d/f", fuse.S_IFREG|0644, 0); 0 != errc {
+		t.Fatal(errc)
+	}
+	errc, fh := fs.Open("/r/d/f", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	fs.Write("/r/d/f", []byte("hello"), 0, fh)
+	fs.Release("/r/d/f", fh)
+	fs.Symlink("f", "/r/d/l")
+	if "windows" != runtime.GOOS {
+		fs.Mknod("/r/d/p", fuse.S_IFIFO|0644, 0)
+	}
+
+	if errc := fs.Mkdir("/.Trash-1000/files", 0700); 0 != errc {
+		t.Fatal(errc)
+	}
+	if errc := fs.Rename("/r/d", "/.Trash-1000/files/d"); 0 != errc {
+		t.Fatal(errc)
+	}
+	stat := fuse.Stat_t{}
+	if errc := fs.Getattr("/r/d", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmpdir, ".Trash-1000", "files", "d", "f"))
+	if nil != err || "hello" != string(b) {
+		t.Error(err, string(b))
+	}
+	if l, err := os.Readlink(filepath.Join(tmpdir, ".Trash-1000", "files", "d", "l")); nil != err || "f" != l {
+		t.Error(err, l)
+	}
+	if "windows" != runtime.GOOS {
+		if info, err := os.Lstat(filepath.Join(tmpdir, ".Trash-1000", "files", "d", "p")); nil != err ||
+			0 == info.Mode()&os.ModeNamedPipe {
+			t.Error(err)
+		}
+	}
+
+	if errc := fs.Rename("/.Trash-1000/files/d", "/r/e"); 0 != errc {
+		t.Fatal(errc)
+	}
+	if errc := fs.Getattr("/r/e/f", &stat, ^uint64(0)); 0 != errc || 5 != stat.Size {
+		t.Error(errc, stat.Size)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, ".Trash-1000", "files", "d")); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+
+	if errc := fs.Rename("/r/e", "/s/e"); -fuse.EXDEV != errc {
+		t.Error(errc)
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	fs := &shardfs{FileSystemInterface: memfs.New(), keeppath: "/.keep"}
+	for _, m := range []uint32{fuse.S_IFREG, fuse.S_IFIFO, fuse.S_IFSOCK} {
+		path := fmt.Sprintf("/%o", m)
+		if errc := fs.Mknod(path, m|0644, 0); 0 != errc {
+			t.Error(path, errc)
+		}
+		stat := fuse.Stat_t{}
+		if errc := fs.Getattr(path, &stat, ^uint64(0)); 0 != errc || m|0644 != stat.Mode {
+			t.Error(path, errc, stat.Mode)
+		}
+	}
+	for _, m := range []uint32{fuse.S_IFCHR, fuse.S_IFBLK} {
+		if errc := fs.Mknod(fmt.Sprintf("/%o", m), m|0644, 0x0101); -fuse.EPERM != errc {
+			t.Error(m, errc)
+		}
+	}
+
+	// a file system that does not support special files
+	fs = &shardfs{FileSystemInterface: &fuse.FileSystemBase{}, keeppath: "/.keep"}
+	if errc := fs.Mknod("/p", fuse.S_IFIFO|0644, 0); -fuse.EPERM != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Mknod("/f", fuse.S_IFREG|0644, 0); -fuse.ENOSYS != errc {
+		t.Error(errc)
+	}
+
+	fs = &shardfs{FileSystemInterface: memfs.New(), keeppath: "/.keep", readonly: true}
+	if errc := fs.Mknod("/p", fuse.S_IFIFO|0644, 0); -fuse.EROFS != errc {
+		t.Error(errc)
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	c := statCache{}
+
+	if nil != c.get("/a") {
+		t.Error()
+	}
+
+	c.set("/a", []dirent{{name: "x"}, {name: "y"}})
+	b := c.get("/a")
+	if nil == b || 2 != len(b.stats) {
+		t.Fatal(b)
+	}
+	if _, ok := b.stats["x"]; !ok {
+		t.Error()
+	}
+
+	b.expires = b.expires.Add(-2 * statBatchTTL)
+	if nil != c.get("/a") {
+		t.Error()
+	}
+
+	for i := 0; 2*statBatchMax > i; i++ {
+		c.set(fmt.Sprintf("/d%d", i), nil)
+	}
+	if statBatchMax < len(c.batches) {
+		t.Error(len(c.batches))
+	}
+}
+
+func TestRefEncoding(t *testing.T) {
+	E := []struct {
+		refenc                 RefEncoding
+		name, encoded, decoded string
+	}{
+		{RefEncodingPlus, "main", "main", "main"},
+		{RefEncodingPlus, "feature/x", "feature+x", "feature/x"},
+		{RefEncodingPlus, "a+b", "a+b", "a/b"},
+		{RefEncodingPercent, "feature/x", "feature%2Fx", "feature/x"},
+		{RefEncodingPercent, "a+b", "a+b", "a+b"},
+		{RefEncodingPercent, "100%/a:b", "100%25%2Fa%3Ab", "100%/a:b"},
+		{RefEncodingPercent, "q?\x01", "q%3F%01", "q?\x01"},
+		{RefEncodingNested, "feature/x", "feature/x", "feature/x"},
+		{RefEncodingNested, "feature/a:b", "feature/a%3Ab", "feature/a:b"},
+	}
+	for _, e := range E {
+		n := e.refenc.Encode(e.name)
+		if e.encoded != n {
+			t.Errorf("%v.Encode(%q) = %q", e.refenc, e.name, n)
+		}
+		d := ""
+		for i, c := range strings.Split(n, "/") {
+			if 0 < i {
+				d += "/"
+			}
+			d += e.refenc.Decode(c)
+		}
+		if RefEncodingNested != e.refenc {
+			d = e.refenc.Decode(n)
+		}
+		if e.decoded != d {
+			t.Errorf("%v.Decode(%q) = %q", e.refenc, n, d)
+		}
+	}
+
+	if "%2" != RefEncodingPercent.Decode("%2") || "%zz" != RefEncodingPercent.Decode("%zz") {
+		t.Error()
+	}
+
+	for _, s := range []string{"", "plus", "percent", "nested"} {
+		if _, err := ParseRefEncoding(s); nil != err {
+			t.Error(err)
+		}
+	}
+	if _, err := ParseRefEncoding("slash"); nil == err {
+		t.Error()
+	}
+}
+
+func TestMangle(t *testing.T) {
+	E := []struct{ name, mangled string }{
+		{"file.txt", "file.txt"},
+		{".gitignore", ".gitignore"},
+		{"a:b", "a\uf03ab"},
+		{"x*?\"<>|\\y", "x\uf02a\uf03f\uf022\uf03c\uf03e\uf07c\uf05cy"},
+		{"tab\t", "tab\uf009"},
+		{"dots..", "dots.\uf02e"},
+		{"space ", "space\uf020"},
+		{"CON", "\uf043ON"},
+		{"nul.txt", "\uf06eul.txt"},
+		{"com1", "\uf063om1"},
+		{"CONSOLE", "CONSOLE"},
+		{"COM10", "COM10"},
+		{".", "."},
+		{"..", ".."},
+	}
+	for _, e := range E {
+		m := mangleName(e.name)
+		if e.mangled != m {
+			t.Errorf("mangleName(%q) = %q", e.name, m)
+		}
+		if u := unmangleName(m); e.name != u {
+			t.Errorf("unmangleName(%q) = %q", m, u)
+		}
+	}
+}
+
+type testStatfsClient struct {
+	providers.Client
+	dir string
+}
+
+func (client *testStatfsClient) GetDirectory() string {
+	return client.dir
+}
+
+func TestStatfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubfs-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "f"), make([]byte, 1<<20), 0644)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	client := &testStatfsClient{dir: dir}
+
+	var vol fuse.Statfs_t
+	fs := new(Config{Client: client})
+	if errc := fs.Statfs("/", &vol); 0 != errc {
+		t.Fatal(errc)
+	}
+
+	// with a quota the used space is the size of the cache directory
+	var stat fuse.Statfs_t
+	fs = new(Config{Client: client, Quota: 4 << 20})
+	if errc := fs.Statfs("/", &stat); 0 != errc {
+		t.Fatal(errc)
+	}
+	if 4<<20 != stat.Blocks*stat.Frsize {
+		t.Error(stat.Blocks, stat.Frsize)
+	}
+	if free := stat.Bavail * stat.Frsize; free > 3<<20 || (vol.Bavail*vol.Frsize >= 3<<20 && free != 3<<20) {
+		t.Error(stat.Bavail, stat.Frsize)
+	}
+
+	// the used space may exceed the quota
+	fs = new(Config{Client: client, Quota: 1 << 10})
+	if errc := fs.Statfs("/", &stat); 0 != errc || 0 != stat.Bavail || 0 != stat.Bfree {
+		t.Error(errc, stat.Bavail, stat.Bfree)
+	}
+}
+
+type testExportEntry struct {
+	name    string
+	mode    uint32
+	content string // file content or symlink target
+	list    []providers.TreeEntry
+}
+
+func (e *testExportEntry) Name() string   { return e.name }
+func (e *testExportEntry) Mode() uint32   { return e.mode }
+func (e *testExportEntry) Size() int64    { return int64(len(e.content)) }
+func (e *testExportEntry) Target() string { return e.content }
+func (e *testExportEntry) Hash() string   { return fmt.Sprintf("%x", e.content) }
+
+type testExportRef struct {
+	providers.Ref
+}
+
+func (r *testExportRef) Name() string        { return "refs/heads/main" }
+func (r *testExportRef) TreeTime() time.Time { return time.Unix(1600000000, 0) }
+
+type testExportBlob struct {
+	*strings.Reader
+	file *os.File
+}
+
+func (b *testExportBlob) Close() error        { return nil }
+func (b *testExportBlob) CacheFile() *os.File { return b.file }
+
+type testExportRepository struct {
+	providers.Repository
+	root     *testExportEntry
+	files    map[string]*os.File
+	prefetch int
+}
+
+func (r *testExportRepository) Name() string { return "repo" }
+
+func (r *testExportRepository) GetRef(ctx context.Context, name string) (providers.Ref, error) {
+	if "refs/heads/main" != name {
+		return nil, providers.ErrNotFound
+	}
+	return &testExportRef{}, nil
+}
+
+func (r *testExportRepository) GetTempRef(ctx context.Context, name string) (providers.Ref, error) {
+	return nil, providers.ErrNotFound
+}
+
+func (r *testExportRepository) GetTree(ctx context.Context, ref providers.Ref,
+	entry providers.TreeEntry) ([]providers.TreeEntry, error) {
+	if nil == entry {
+		return r.root.list, nil
+	}
+	return entry.(*testExportEntry).list, nil
+}
+
+func (r *testExportRepository) GetTreeEntry(ctx context.Context, ref providers.Ref,
+	entry providers.TreeEntry, name string) (providers.TreeEntry, error) {
+	lst, _ := r.GetTree(ctx, ref, entry)
+	for _, e := range lst {
+		if e.Name() == name {
+			return e, nil
+		}
+	}
+	return nil, providers.ErrNotFound
+}
+
+func (r *testExportRepository) GetBlobReader(ctx context.Context,
+	entry providers.TreeEntry) (io.ReaderAt, error) {
+	e := entry.(*testExportEntry)
+	return &testExportBlob{strings.NewReader(e.content), r.files[e.content]}, nil
+}
+
+func (r *testExportRepository) PrefetchBlobs(ctx context.Context,
+	entries []providers.TreeEntry) error {
+	r.prefetch += len(entries)
+	return nil
+}
+
+type testExportOwner struct{}
+
+func (o *testExportOwner) Name() string { return "owner" }
+
+type testExportClient struct {
+	providers.Client
+	repository *testExportRepository
+}
+
+func (client *testExportClient) OpenOwner(ctx context.Context, name string) (providers.Owner, error) {
+	return &testExportOwner{}, nil
+}
+
+func (client *testExportClient) CloseOwner(owner providers.Owner) {
+}
+
+func (client *testExportClient) OpenRepository(ctx context.Context, owner providers.Owner,
+	name string) (providers.Repository, error) {
+	return client.repository, nil
+}
+
+func (client *testExportClient) CloseRepository(repository providers.Repository) {
+}
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubfs-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the blob "same" is in the cache; the blob "other" is not
+	cache := filepath.Join(dir, "cache")
+	err = ioutil.WriteFile(cache, []byte("same"), 0644)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cachefile, err := os.Open(cache)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cachefile.Close()
+
+	repository := &testExportRepository{
+		root: &testExportEntry{list: []providers.TreeEntry{
+			&testExportEntry{name: "a", mode: fuse.S_IFREG | 0644, content: "same"},
+			&testExportEntry{name: "b", mode: fuse.S_IFREG | 0644, content: "other"},
+			&testExportEntry{name: "l", mode: fuse.S_IFLNK, content: "a"},
+			&testExportEntry{name: "m", mode: 0160000},
+			&testExportEntry{name: "d", mode: fuse.S_IFDIR, list: []providers.TreeEntry{
+				&testExportEntry{name: "a", mode: fuse.S_IFREG | 0644, content: "same"},
+				&testExportEntry{name: "x", mode: fuse.S_IFREG | 0755, content: "same"},
+			}},
+		}},
+		files: map[string]*os.File{"same": cachefile},
+	}
+	client := &testExportClient{repository: repository}
+
+	target := filepath.Join(dir, "target")
+	stats, err := Export(context.Background(), Config{Client: client}, "/owner/repo/main", target)
+	if nil != err {
+		t.Fatal(err)
+	}
+	expect := ExportStats{Dirs: 2, Files: 4, Symlinks: 1, Linked: 1}
+	stats.Cloned, stats.Copied = 0, 0
+	if expect != stats {
+		t.Errorf("got %+v", stats)
+	}
+	if 4 != repository.prefetch {
+		t.Error(repository.prefetch)
+	}
+
+	for path, content := range map[string]string{
+		"a": "same", "b": "other", "d/a": "same", "d/x": "same"} {
+		data, err := ioutil.ReadFile(filepath.Join(target, path))
+		if nil != err || content != string(data) {
+			t.Errorf("%s: %q %v", path, data, err)
+		}
+	}
+	if "windows" != runtime.GOOS {
+		a0, _ := os.Stat(filepath.Join(target, "a"))
+		a1, _ := os.Stat(filepath.Join(target, "d/a"))
+		x, _ := os.Stat(filepath.Join(target, "d/x"))
+		if !os.SameFile(a0, a1) || os.SameFile(a0, x) {
+			t.Error("hardlinks")
+		}
+		if 0444 != a0.Mode().Perm() || 0555 != x.Mode().Perm() {
+			t.Error(a0.Mode(), x.Mode())
+		}
+		if l, err := os.Readlink(filepath.Join(target, "l")); nil != err || "a" != l {
+			t.Error(l, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(target, "m")); nil != err || !info.IsDir() {
+		t.Error(err)
+	}
+
+	// a directory within a ref
+	stats, err = Export(context.Background(), Config{Client: client}, "/owner/repo/main/d",
+		filepath.Join(dir, "d"))
+	if nil != err || 2 != stats.Files {
+		t.Error(stats, err)
+	}
+
+	// the target must be empty
+	_, err = Export(context.Background(), Config{Client: client}, "/owner/repo/main", target)
+	if nil == err {
+		t.Error()
+	}
+	_, err = Export(context.Background(), Config{Client: client}, "/owner/repo/none",
+		filepath.Join(dir, "none"))
+	if nil == err {
+		t.Error()
+	}
+}
+
+func TestManifest(t *testing.T) {
+	repository := &testExportRepository{
+		root: &testExportEntry{list: []providers.TreeEntry{
+			&testExportEntry{name: "a", mode: fuse.S_IFREG | 0644, content: "same"},
+			&testExportEntry{name: "l", mode: fuse.S_IFLNK, content: "a"},
+			&testExportEntry{name: "m", mode: 0160000},
+			&testExportEntry{name: "d", mode: fuse.S_IFDIR, list: []providers.TreeEntry{
+				&testExportEntry{name: "x:y", mode: fuse.S_IFREG | 0755, content: "other"},
+			}},
+		}},
+	}
+	client := &testExportClient{repository: repository}
+
+	m, err := BuildManifest(context.Background(), Config{Client: client}, "/owner/repo/main")
+	if nil != err {
+		t.Fatal(err)
+	}
+	expect := Manifest{Ref: "refs/heads/main", Files: map[string]string{
+		"a":     "73616d65",
+		"l":     "61",
+		"d/x:y": "6f74686572",
+	}}
+	if !reflect.DeepEqual(expect, *m) {
+		t.Errorf("got %+v", m)
+	}
+	if 0 != repository.prefetch {
+		t.Error(repository.prefetch)
+	}
+
+	// a directory within a ref; mangled names
+	m, err = BuildManifest(context.Background(), Config{Client: client, Mangle: true},
+		"/owner/repo/main/d")
+	if nil != err || 1 != len(m.Files) || "6f74686572" != m.Files[mangleName("x:y")] ||
+		"x:y" == mangleName("x:y") {
+		t.Error(m, err)
+	}
+
+	for _, path := range []string{"/owner/repo/main/a", "/owner/repo/none", "/owner/repo"} {
+		if _, err := BuildManifest(context.Background(), Config{Client: client}, path); nil == err {
+			t.Error(path)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	rec := &AuditRecord{
+		Time:       time.Unix(1600000000, 0).UTC(),
+		Event:      "open",
+		Path:       "/owner/repo/main/a=b|c",
+		Owner:      "owner",
+		Repository: "repo",
+		Ref:        "refs/heads/main",
+		Commit:     "0123456789abcdef0123456789abcdef01234567",
+		Uid:        1000,
+		Gid:        100,
+		Pid:        42,
+	}
+
+	var buf bytes.Buffer
+	log, err := NewAuditLog(&buf, "json", "1.0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	log.Write(rec)
+	var res AuditRecord
+	if err := json.Unmarshal(buf.Bytes(), &res); nil != err || *rec != res {
+		t.Error(err, buf.String())
+	}
+
+	buf.Reset()
+	log, err = NewAuditLog(&buf, "cef", "1.0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	log.Write(rec)
+	if "CEF:0|Hubfs|HUBFS|1.0|open|Open file|3|"+
+		"rt=1600000000000 suid=1000 sgid=100 spid=42 fname=/owner/repo/main/a\\=b|c "+
+		"cs1Label=owner cs1=owner cs2Label=repository cs2=repo cs3Label=ref cs3=refs/heads/main "+
+		"cs4Label=commit cs4=0123456789abcdef0123456789abcdef01234567\n" != buf.String() {
+		t.Error(buf.String())
+	}
+
+	if _, err := NewAuditLog(&buf, "xml", "1.0"); nil == err {
+		t.Error()
+	}
+}
+
+func TestAccessTrace(t *testing.T) {
+	repository := &testExportRepository{
+		root: &testExportEntry{list: []providers.TreeEntry{
+			&testExportEntry{name: "a", mode: fuse.S_IFREG | 0644, content: "a"},
+			&testExportEntry{name: "d", mode: fuse.S_IFDIR, list: []providers.TreeEntry{
+				&testExportEntry{name: "b", mode: fuse.S_IFREG | 0644, content: "b"},
+			}},
+		}},
+	}
+	client := &testExportClient{repository: repository}
+
+	var buf bytes.Buffer
+	fs := new(Config{Client: client, Prefix: "/owner", AccessTrace: NewAccessTrace(&buf)})
+	for _, path := range []string{"/repo/main/a", "/repo/main/d/b", "/repo/main/a"} {
+		errc, fh := fs.Open(path, fuse.O_RDONLY)
+		if 0 != errc {
+			t.Fatal(path, errc)
+		}
+		fs.Release(path, fh)
+	}
+	if errc, _ := fs.Open("/repo/main/none", fuse.O_RDONLY); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+
+	expect := `{"path":"/owner/repo/main/a"}` + "\n" + `{"path":"/owner/repo/main/d/b"}` + "\n"
+	if expect != buf.String() {
+		t.Error(buf.String())
+	}
+
+	paths, err := ReadAccessTrace(strings.NewReader(buf.String() + "\n"))
+	if nil != err || "[/owner/repo/main/a /owner/repo/main/d/b]" != fmt.Sprint(paths) {
+		t.Error(paths, err)
+	}
+	if _, err := ReadAccessTrace(strings.NewReader("/owner/repo/main/a\n")); nil == err {
+		t.Error()
+	}
+	if _, err := ReadAccessTrace(strings.NewReader(`{"file":"a"}`)); nil == err {
+		t.Error()
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	repository := &testExportRepository{
+		root: &testExportEntry{list: []providers.TreeEntry{
+			&testExportEntry{name: "a", mode: fuse.S_IFREG | 0644, content: "a"},
+			&testExportEntry{name: "l", mode: fuse.S_IFLNK, content: "a"},
+			&testExportEntry{name: "d", mode: fuse.S_IFDIR, list: []providers.TreeEntry{
+				&testExportEntry{name: "b", mode: fuse.S_IFREG | 0755, content: "b"},
+			}},
+		}},
+	}
+	client := &testExportClient{repository: repository}
+
+	stats, err := Warmup(context.Background(), Config{Client: client}, []string{
+		"/owner/repo/main/a",
+		"/owner/repo/main/d/b",
+		"/owner/repo/main/l",
+		"/owner/repo/main/d",
+		"/owner/repo/main/none",
+		"/owner/repo/other/a",
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if (WarmupStats{Files: 2, Missing: 4}) != stats {
+		t.Errorf("got %+v", stats)
+	}
+	if 2 != repository.prefetch {
+		t.Error(repository.prefetch)
+	}
+}
+
+type testInfoClient struct {
+	testExportClient
+}
+
+func (client *testInfoClient) GetOwners(ctx context.Context) ([]providers.Owner, error) {
+	return []providers.Owner{&testExportOwner{}}, nil
+}
+
+func (client *testInfoClient) GetRepositories(ctx context.Context,
+	owner providers.Owner) ([]providers.Repository, error) {
+	return []providers.Repository{client.repository}, nil
+}
+
+func TestInfo(t *testing.T) {
+	client := &testInfoClient{testExportClient{repository: &testExportRepository{}}}
+	fs := new(Config{Client: client, Remote: "github.com"})
+
+	readdir := func(path string) (names []string) {
+		errc, fh := fs.Opendir(path)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+			names = append(names, name)
+			return true
+		}, 0, fh)
+		fs.Releasedir(path, fh)
+		return
+	}
+	read := func(path string) string {
+		var stat fuse.Stat_t
+		if errc := fs.Getattr(path, &stat, ^uint64(0)); 0 != errc ||
+			fuse.S_IFREG != stat.Mode&fuse.S_IFMT {
+			t.Fatal(errc, stat.Mode)
+		}
+		errc, fh := fs.Open(path, fuse.O_RDONLY)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		buf := make([]byte, 4096)
+		n := fs.Read(path, buf, 0, fh)
+		fs.Release(path, fh)
+		if int64(n) != stat.Size {
+			t.Error(n, stat.Size)
+		}
+		return string(buf[:n])
+	}
+
+	if names := fmt.Sprint(readdir("/")); "[. .. .hubfs_info owner]" != names {
+		t.Error(names)
+	}
+	if names := fmt.Sprint(readdir("/owner")); "[. .. .hubfs_info repo]" != names {
+		t.Error(names)
+	}
+
+	if s := read("/.hubfs_info"); !strings.Contains(s, "root of a HUBFS file system") ||
+		!strings.Contains(s, "provider: github.com\n") || !strings.Contains(s, "rate limit: ") {
+		t.Error(s)
+	}
+	if s := read("/owner/.hubfs_info"); !strings.Contains(s, "the owner owner") {
+		t.Error(s)
+	}
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/owner/repo/.hubfs_info", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Getattr("/.hubfs_info/x", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+}
+
+type testStarredClient struct {
+	testInfoClient
+}
+
+func (client *testStarredClient) GetStarred(ctx context.Context) ([]string, error) {
+	return []string{"owner/repo", "other/Project"}, nil
+}
+
+func TestStarred(t *testing.T) {
+	client := &testStarredClient{testInfoClient{testExportClient{repository: &testExportRepository{}}}}
+	fs := new(Config{Client: client, Caseins: true})
+
+	errc, fh := fs.Opendir("/")
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	names := []string{}
+	fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, fh)
+	fs.Releasedir("/", fh)
+	if "[. .. .hubfs_info .starred owner]" != fmt.Sprint(names) {
+		t.Error(names)
+	}
+
+	errc, fh = fs.Opendir("/.starred")
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	links := map[string]fuse.Stat_t{}
+	fs.Readdir("/.starred", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			links[name] = *stat
+		}
+		return true
+	}, 0, fh)
+	fs.Releasedir("/.starred", fh)
+	if 2 != len(links) || fuse.S_IFLNK != links["owner+repo"].Mode&fuse.S_IFMT ||
+		int64(len("/other/Project")) != links["other+Project"].Size {
+		t.Error(links)
+	}
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/.starred", &stat, ^uint64(0)); 0 != errc ||
+		fuse.S_IFDIR != stat.Mode&fuse.S_IFMT {
+		t.Error(errc, stat.Mode)
+	}
+	if errc, target := fs.Readlink("/.starred/owner+repo"); 0 != errc || "/owner/repo" != target {
+		t.Error(errc, target)
+	}
+	if errc, target := fs.Readlink("/.starred/other+project"); 0 != errc || "/other/Project" != target {
+		t.Error(errc, target)
+	}
+	if errc := fs.Getattr("/.starred/none+repo", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Getattr("/.starred/owner+repo/main", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+
+	// .starred is only special in the host directory; elsewhere it names a repository
+	if errc := fs.Getattr("/owner/.starred", &stat, ^uint64(0)); 0 != errc {
+		t.Error(errc)
+	}
+}
+
+type testRelease struct {
+	assets []providers.Asset
+}
+
+func (r *testRelease) Name() string              { return "v1/x" }
+func (r *testRelease) Time() time.Time           { return time.Unix(1600000000, 0) }
+func (r *testRelease) Assets() []providers.Asset { return r.assets }
+
+type testAsset struct {
+	content string
+}
+
+func (a *testAsset) Name() string    { return "a.bin" }
+func (a *testAsset) Size() int64     { return int64(len(a.content)) }
+func (a *testAsset) Time() time.Time { return time.Unix(1600000000, 0) }
+
+type testReleaseRepository struct {
+	testExportRepository
+	release *testRelease
+}
+
+func (r *testReleaseRepository) GetRefs(ctx context.Context) ([]providers.Ref, error) {
+	return []providers.Ref{&testExportRef{}}, nil
+}
+
+func (r *testReleaseRepository) GetReleases(ctx context.Context) ([]providers.Release, error) {
+	return []providers.Release{r.release}, nil
+}
+
+func (r *testReleaseRepository) GetAssetReader(ctx context.Context,
+	asset providers.Asset) (io.ReaderAt, error) {
+	return &testExportBlob{Reader: strings.NewReader(asset.(*testAsset).content)}, nil
+}
+
+type testReleaseClient struct {
+	testExportClient
+	releaseRepository *testReleaseRepository
+}
+
+func (client *testReleaseClient) OpenRepository(ctx context.Context, owner providers.Owner,
+	name string) (providers.Repository, error) {
+	return client.releaseRepository, nil
+}
+
+func TestReleases(t *testing.T) {
+	asset := &testAsset{content: "asset content"}
+	client := &testReleaseClient{releaseRepository: &testReleaseRepository{
+		release: &testRelease{assets: []providers.Asset{asset}}}}
+
+	for _, overlay := range []bool{false, true} {
+		fs := New(Config{Client: client, Overlay: overlay})
+
+		readdir := func(path string) (names []string) {
+			errc, fh := fs.Opendir(path)
+			if 0 != errc {
+				t.Fatal(path, errc)
+			}
+			fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+				if "." != name && ".." != name {
+					names = append(names, name)
+				}
+				return true
+			}, 0, fh)
+			fs.Releasedir(path, fh)
+			return
+		}
+
+		if names := fmt.Sprint(readdir("/owner/repo")); "[.releases main]" != names {
+			t.Error(names)
+		}
+		if names := fmt.Sprint(readdir("/owner/repo/.releases")); "[v1+x]" != names {
+			t.Error(names)
+		}
+		if names := fmt.Sprint(readdir("/owner/repo/.releases/v1+x")); "[assets]" != names {
+			t.Error(names)
+		}
+		if names := fmt.Sprint(readdir("/owner/repo/.releases/v1+x/assets")); "[a.bin]" != names {
+			t.Error(names)
+		}
+
+		path := "/owner/repo/.releases/v1+x/assets/a.bin"
+		var stat fuse.Stat_t
+		if errc := fs.Getattr(path, &stat, ^uint64(0)); 0 != errc ||
+			fuse.S_IFREG != stat.Mode&fuse.S_IFMT || int64(len(asset.content)) != stat.Size {
+			t.Error(errc, stat.Mode, stat.Size)
+		}
+		errc, fh := fs.Open(path, fuse.O_RDONLY)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		buf := make([]byte, 100)
+		n := fs.Read(path, buf, 0, fh)
+		fs.Release(path, fh)
+		if asset.content != string(buf[:n]) {
+			t.Error(n, string(buf[:n]))
+		}
+
+		for _, path := range []string{
+			"/owner/repo/.releases/v2",
+			"/owner/repo/.releases/v1+x/other",
+			"/owner/repo/.releases/v1+x/assets/b.bin",
+			"/owner/repo/.releases/v1+x/assets/a.bin/c",
+		} {
+			if errc := fs.Getattr(path, &stat, ^uint64(0)); -fuse.ENOENT != errc {
+				t.Error(path, errc)
+			}
+		}
+	}
+}
+
+type testArtifact struct {
+	testAsset
+	name string
+}
+
+func (a *testArtifact) Name() string { return a.name }
+func (a *testArtifact) Size() int64  { return -1 }
+
+type testArtifactRepository struct {
+	testReleaseRepository
+	archive []byte
+}
+
+func (r *testArtifactRepository) GetArtifacts(ctx context.Context) ([]providers.Asset, error) {
+	return []providers.Asset{&testArtifact{name: "build-1"}}, nil
+}
+
+func (r *testArtifactRepository) GetArtifactReader(ctx context.Context,
+	artifact providers.Asset) (io.ReaderAt, error) {
+	return bytes.NewReader(r.archive), nil
+}
+
+type testArtifactClient struct {
+	testExportClient
+	artifactRepository *testArtifactRepository
+}
+
+func (client *testArtifactClient) OpenRepository(ctx context.Context, owner providers.Owner,
+	name string) (providers.Repository, error) {
+	return client.artifactRepository, nil
+}
+
+func TestArtifacts(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range []string{"bin/", "bin/tool", "README"} {
+		f, err := w.Create(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			f.Write([]byte(strings.Repeat(name, 1000)))
+		}
+	}
+	w.Close()
+
+	client := &testArtifactClient{artifactRepository: &testArtifactRepository{
+		testReleaseRepository: testReleaseRepository{release: &testRelease{}},
+		archive:               buf.Bytes()}}
+
+	for _, overlay := range []bool{false, true} {
+		fs := New(Config{Client: client, Overlay: overlay, Artifacts: true})
+
+		readdir := func(path string) (names []string) {
+			errc, fh := fs.Opendir(path)
+			if 0 != errc {
+				t.Fatal(path, errc)
+			}
+			fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+				if "." != name && ".." != name {
+					names = append(names, name)
+				}
+				return true
+			}, 0, fh)
+			fs.Releasedir(path, fh)
+			sort.Strings(names)
+			return
+		}
+
+		if names := fmt.Sprint(readdir("/owner/repo")); "[.artifacts .releases main]" != names {
+			t.Error(names)
+		}
+		if names := fmt.Sprint(readdir("/owner/repo/.artifacts")); "[build-1]" != names {
+			t.Error(names)
+		}
+		if names := fmt.Sprint(readdir("/owner/repo/.artifacts/build-1")); "[README bin]" != names {
+			t.Error(names)
+		}
+		if names := fmt.Sprint(readdir("/owner/repo/.artifacts/build-1/bin")); "[tool]" != names {
+			t.Error(names)
+		}
+
+		path := "/owner/repo/.artifacts/build-1/bin/tool"
+		content := strings.Repeat("bin/tool", 1000)
+		var stat fuse.Stat_t
+		if errc := fs.Getattr(path, &stat, ^uint64(0)); 0 != errc ||
+			fuse.S_IFREG != stat.Mode&fuse.S_IFMT || int64(len(content)) != stat.Size {
+			t.Error(errc, stat.Mode, stat.Size)
+		}
+		errc, fh := fs.Open(path, fuse.O_RDONLY)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		data := make([]byte, 100)
+		for _, ofst := range []int64{4000, 16, 7990} {
+			n := fs.Read(path, data, ofst, fh)
+			if end := ofst + int64(n); 0 > n || content[ofst:end] != string(data[:n]) {
+				t.Error(ofst, n)
+			}
+		}
+		fs.Release(path, fh)
+
+		for _, path := range []string{
+			"/owner/repo/.artifacts/build-2",
+			"/owner/repo/.artifacts/build-1/none",
+			"/owner/repo/.artifacts/build-1/README/x",
+		} {
+			if errc := fs.Getattr(path, &stat, ^uint64(0)); -fuse.ENOENT != errc {
+				t.Error(path, errc)
+			}
+		}
+	}
+
+	fs := New(Config{Client: client, Caseins: true, Artifacts: true})
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/owner/repo/.artifacts/build-1/BIN/Tool", &stat, ^uint64(0)); 0 != errc ||
+		fuse.S_IFREG != stat.Mode&fuse.S_IFMT {
+		t.Error(errc, stat.Mode)
+	}
+
+	fs = New(Config{Client: client})
+	if errc := fs.Getattr("/owner/repo/.artifacts", &stat, ^uint64(0)); 0 == errc {
+		t.Error(errc)
+	}
+}
+
+type testIssue struct {
+	number int
+}
+
+func (i *testIssue) Number() int      { return i.number }
+func (i *testIssue) Time() time.Time  { return time.Unix(1600000000, 0) }
+func (i *testIssue) Markdown() []byte { return []byte(fmt.Sprintf("# issue %d\n", i.number)) }
+func (i *testIssue) JSON() []byte     { return []byte(fmt.Sprintf("{\"number\":%d}\n", i.number)) }
+
+type testIssueRepository struct {
+	testReleaseRepository
+}
+
+func (r *testIssueRepository) GetIssues(ctx context.Context) ([]providers.Issue, error) {
+	return []providers.Issue{&testIssue{number: 7}, &testIssue{number: 12}}, nil
+}
+
+type testIssueClient struct {
+	testExportClient
+	issueRepository *testIssueRepository
+}
+
+func (client *testIssueClient) OpenRepository(ctx context.Context, owner providers.Owner,
+	name string) (providers.Repository, error) {
+	return client.issueRepository, nil
+}
+
+func TestIssues(t *testing.T) {
+	client := &testIssueClient{issueRepository: &testIssueRepository{
+		testReleaseRepository: testReleaseRepository{release: &testRelease{}}}}
+
+	for _, overlay := range []bool{false, true} {
+		fs := New(Config{Client: client, Overlay: overlay, Issues: true})
+
+		readdir := func(path string) (names []string) {
+			errc, fh := fs.Opendir(path)
+			if 0 != errc {
+				t.Fatal(path, errc)
+			}
+			fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+				if "." != name && ".." != name {
+					names = append(names, name)
+				}
+				return true
+			}, 0, fh)
+			fs.Releasedir(path, fh)
+			sort.Strings(names)
+			return
+		}
+
+		if names := fmt.Sprint(readdir("/owner/repo")); "[.issues .releases main]" != names {
+			t.Error(names)
+		}
+		if names := fmt.Sprint(readdir("/owner/repo/.issues")); "[12.json 12.md 7.json 7.md]" != names {
+			t.Error(names)
+		}
+
+		for path, content := range map[string]string{
+			"/owner/repo/.issues/7.md":    "# issue 7\n",
+			"/owner/repo/.issues/12.json": "{\"number\":12}\n",
+		} {
+			var stat fuse.Stat_t
+			if errc := fs.Getattr(path, &stat, ^uint64(0)); 0 != errc ||
+				fuse.S_IFREG != stat.Mode&fuse.S_IFMT || int64(len(content)) != stat.Size {
+				t.Error(path, errc, stat.Mode, stat.Size)
+			}
+			errc, fh := fs.Open(path, fuse.O_RDONLY)
+			if 0 != errc {
+				t.Fatal(path, errc)
+			}
+			data := make([]byte, 100)
+			n := fs.Read(path, data, 0, fh)
+			if content != string(data[:n]) {
+				t.Error(path, n, string(data[:n]))
+			}
+			fs.Release(path, fh)
+		}
+
+		for _, path := range []string{
+			"/owner/repo/.issues/8.md",
+			"/owner/repo/.issues/07.md",
+			"/owner/repo/.issues/7.txt",
+			"/owner/repo/.issues/7.md/x",
+		} {
+			var stat fuse.Stat_t
+			if errc := fs.Getattr(path, &stat, ^uint64(0)); -fuse.ENOENT != errc {
+				t.Error(path, errc)
+			}
+		}
+	}
+
+	fs := New(Config{Client: client})
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/owner/repo/.issues", &stat, ^uint64(0)); 0 == errc {
+		t.Error(errc)
+	}
+}
+
+type testMetadataRepository struct {
+	testReleaseRepository
+}
+
+func (r *testMetadataRepository) GetMetadata(ctx context.Context) (
+	*providers.RepositoryMetadata, error) {
+	return &providers.RepositoryMetadata{
+		Name:          "repo",
+		Owner:         "owner",
+		DefaultBranch: "main",
+		Topics:        []string{"fuse"},
+	}, nil
+}
+
+type testMetadataClient struct {
+	testExportClient
+	metadataRepository *testMetadataRepository
+}
+
+func (client *testMetadataClient) OpenRepository(ctx context.Context, owner providers.Owner,
+	name string) (providers.Repository, error) {
+	return client.metadataRepository, nil
+}
+
+func TestRepoInfo(t *testing.T) {
+	client := &testMetadataClient{metadataRepository: &testMetadataRepository{
+		testReleaseRepository: testReleaseRepository{release: &testRelease{}}}}
+
+	for _, overlay := range []bool{false, true} {
+		fs := New(Config{Client: client, Overlay: overlay})
+
+		var names []string
+		var size int64
+		errc, fh := fs.Opendir("/owner/repo")
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		fs.Readdir("/owner/repo", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+			if "." != name && ".." != name {
+				names = append(names, name)
+			}
+			if repoInfoName == name && nil != stat {
+				size = stat.Size
+			}
+			return true
+		}, 0, fh)
+		fs.Releasedir("/owner/repo", fh)
+		sort.Strings(names)
+		if "[.hubfs_repo.json .releases main]" != fmt.Sprint(names) {
+			t.Error(names)
+		}
+
+		path := "/owner/repo/" + repoInfoName
+		var stat fuse.Stat_t
+		if errc := fs.Getattr(path, &stat, ^uint64(0)); 0 != errc ||
+			fuse.S_IFREG != stat.Mode&fuse.S_IFMT || 0 == stat.Size || size != stat.Size {
+			t.Error(errc, stat.Mode, stat.Size, size)
+		}
+		errc, fh = fs.Open(path, fuse.O_RDONLY)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		data := make([]byte, 4096)
+		n := fs.Read(path, data, 0, fh)
+		fs.Release(path, fh)
+		var metadata providers.RepositoryMetadata
+		if int64(n) != stat.Size || nil != json.Unmarshal(data[:n], &metadata) ||
+			"main" != metadata.DefaultBranch || "[fuse]" != fmt.Sprint(metadata.Topics) {
+			t.Error(n, string(data[:n]))
+		}
+
+		if errc := fs.Getattr(path+"/x", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+			t.Error(errc)
+		}
+	}
+}
+
+type testGCClient struct {
+	testExportClient
+	dir string
+}
+
+func (client *testGCClient) GetDirectory() string {
+	return client.dir
+}
+
+func (client *testGCClient) OpenRepository(ctx context.Context, owner providers.Owner,
+	name string) (providers.Repository, error) {
+	switch name {
+	case "repo":
+		return &testReleaseRepository{}, nil
+	case "down":
+		return nil, errors.New("network error")
+	default:
+		return nil, providers.ErrNotFound
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubfs-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, p := range []string{
+		"owner/repo/files/main/a",
+		"owner/repo/meta/main/.unionfs",
+		"owner/repo/files/Old/a",
+		"owner/repo/meta/Old/.unionfs",
+		"owner/repo/files/new/a",
+		"owner/repo/files/0123abcd/a",
+		"owner/gone/files/main/a",
+		"owner/down/files/main/a",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(p))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte("data"), 0644)
+		if !strings.Contains(p, "/new/") {
+			os.Chtimes(path, old, old)
+			os.Chtimes(filepath.Dir(path), old, old)
+		}
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p)))
+		return nil == err
+	}
+
+	client := &testGCClient{dir: dir}
+	for _, dryrun := range []bool{true, false} {
+		var report []string
+		stats, err := CollectGarbage(context.Background(), client, 24*time.Hour, dryrun,
+			func(path string, removed bool) {
+				report = append(report, fmt.Sprintf("%s:%v", path, removed))
+			})
+		if nil != err {
+			t.Fatal(err)
+		}
+		sort.Strings(report)
+		if !reflect.DeepEqual([]string{
+			"owner/gone/main:true",
+			"owner/repo/Old:true",
+			"owner/repo/new:false",
+		}, report) {
+			t.Error(report)
+		}
+		if (GCStats{Refs: 6, Orphans: 3, Removed: 2, Bytes: 12}) != stats {
+			t.Error(stats)
+		}
+		if dryrun != exists("owner/repo/files/Old") || dryrun != exists("owner/repo/meta/Old") ||
+			dryrun != exists("owner/gone/files/main") {
+			t.Error(dryrun)
+		}
+		if !exists("owner/repo/files/main") || !exists("owner/repo/meta/main") ||
+			!exists("owner/repo/files/new") || !exists("owner/repo/files/0123abcd") ||
+			!exists("owner/down/files/main") {
+			t.Error(dryrun)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * info.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/metrics"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// The host directory (the root of the file system) and the owner directories are not
+// part of any repository. Each contains a virtual file .hubfs_info that describes what
+// the directory represents, so that users who stumble into the file system can make
+// sense of it. A repository named .hubfs_info is hidden by this file.
+//
+// Each repository directory contains a virtual file .hubfs_repo.json with the metadata
+// of the repository as reported by the provider, so that scripts can inspect it without
+// calling the provider API themselves. Ref names cannot start with a dot, so this file
+// cannot hide a ref.
+
+const (
+	infoName     = ".hubfs_info"
+	repoInfoName = ".hubfs_repo.json"
+)
+
+// Function info returns the contents of the .hubfs_info file of a host or owner
+// directory.
+func (fs *hubfs) info(obs *obstack) []byte {
+	var b strings.Builder
+	if nil != obs.owner {
+		fmt.Fprintf(&b, "This directory is the owner %s, as seen by HUBFS.\n", obs.owner.Name())
+		b.WriteString("Each subdirectory is a repository of the owner; within a repository\n")
+		b.WriteString("each subdirectory is a branch or tag, which contains the files of the\n")
+		b.WriteString("repository at that branch or tag.\n")
+	} else {
+		b.WriteString("This directory is the root of a HUBFS file system.\n")
+		b.WriteString("Each subdirectory is an owner (a user or organization). Owners that are\n")
+		b.WriteString("not listed can be accessed by name: OWNER/REPOSITORY/BRANCH.\n")
+	}
+	b.WriteString("\n")
+	if "" != fs.remote {
+		fmt.Fprintf(&b, "provider: %s\n", fs.remote)
+	}
+	if rl := metrics.Take().RateLimit; 0 != rl.Limit {
+		fmt.Fprintf(&b, "rate limit: %d of %d requests remaining", rl.Remaining, rl.Limit)
+		if !rl.Reset.IsZero() {
+			fmt.Fprintf(&b, ", resets at %s", rl.Reset.UTC().Format(time.RFC3339))
+		}
+		b.WriteString("\n")
+	} else {
+		b.WriteString("rate limit: unknown\n")
+	}
+	return []byte(b.String())
+}
+
+// Function infodirent returns the directory entry of the .hubfs_info file of the host
+// or owner directory opened by obs.
+func (fs *hubfs) infodirent(obs *obstack) dirent {
+	s := fuse.Stat_t{}
+	fuseStat(&s, fuse.S_IFREG, int64(len(fs.info(obs))), time.Now())
+	return dirent{infoName, s}
+}
+
+// Function hasRepoInfo determines whether the repository opened by obs has a
+// .hubfs_repo.json file.
+func hasRepoInfo(obs *obstack) bool {
+	_, ok := obs.repository.(providers.MetadataRepository)
+	return ok
+}
+
+// Function repoInfo returns the contents of the .hubfs_repo.json file of the repository
+// opened by obs.
+func (fs *hubfs) repoInfo(ctx context.Context, obs *obstack) ([]byte, error) {
+	metadata, err := obs.repository.(providers.MetadataRepository).GetMetadata(ctx)
+	if nil != err {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if nil != err {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,101 @@
+/*
+ * issue.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// The directory .issues in a repository directory presents the recently updated issues
+// and pull requests of the repository (if Config.Issues is set). Each is presented as
+// the read-only files NUMBER.md and NUMBER.json. The list of issues is fetched when the
+// directory is first listed or looked up.
+
+const (
+	issuesName = ".issues"
+	issueMdExt = ".md"
+	issueJSExt = ".json"
+)
+
+// Function hasIssues determines whether the .issues directory is presented in the
+// repository opened by obs.
+func (fs *hubfs) hasIssues(obs *obstack) bool {
+	_, ok := obs.repository.(providers.IssueRepository)
+	return ok && fs.issues
+}
+
+// Function openissue opens the issue file named by the path component c within the
+// .issues directory.
+func (fs *hubfs) openissue(ctx context.Context, obs *obstack, c string) error {
+	special := specialNone
+	n := ""
+	switch {
+	case strings.HasSuffix(c, issueMdExt) ||
+		(fs.caseins && strings.HasSuffix(strings.ToLower(c), issueMdExt)):
+		special, n = specialIssueMd, c[:len(c)-len(issueMdExt)]
+	case strings.HasSuffix(c, issueJSExt) ||
+		(fs.caseins && strings.HasSuffix(strings.ToLower(c), issueJSExt)):
+		special, n = specialIssueJSON, c[:len(c)-len(issueJSExt)]
+	default:
+		return providers.ErrNotFound
+	}
+	number, err := strconv.Atoi(n)
+	if nil != err || strconv.Itoa(number) != n {
+		return providers.ErrNotFound
+	}
+
+	lst, err := obs.repository.(providers.IssueRepository).GetIssues(ctx)
+	if nil != err {
+		return err
+	}
+	for _, elm := range lst {
+		if number == elm.Number() {
+			obs.special, obs.issue = special, elm
+			return nil
+		}
+	}
+	return providers.ErrNotFound
+}
+
+// Function issuedir returns the entries of the .issues directory.
+func (fs *hubfs) issuedir(ctx context.Context, obs *obstack) (res []dirent, err error) {
+	lst, err := obs.repository.(providers.IssueRepository).GetIssues(ctx)
+	if nil != err {
+		return nil, err
+	}
+	res = make([]dirent, 0, 2*len(lst))
+	for _, elm := range lst {
+		n := strconv.Itoa(elm.Number())
+		d := dirent{name: n + issueMdExt}
+		fuseStat(&d.stat, fuse.S_IFREG, int64(len(elm.Markdown())), elm.Time())
+		res = append(res, d)
+		d = dirent{name: n + issueJSExt}
+		fuseStat(&d.stat, fuse.S_IFREG, int64(len(elm.JSON())), elm.Time())
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// Function issuedata returns the contents of the issue file opened by obs.
+func issuedata(obs *obstack) []byte {
+	if specialIssueJSON == obs.special {
+		return obs.issue.JSON()
+	}
+	return obs.issue.Markdown()
+}
@@ -0,0 +1,185 @@
+/*
+ * mangle.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	pathutil "path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// File names in a repository may be invalid on Windows: they may contain characters such
+// as ":" or "*", end in a dot or space, or be reserved device names such as "CON" or
+// "NUL". When mangling is enabled such names are presented with the offending characters
+// mapped to the Unicode private use area (U+F000 plus the character), which is the same
+// mapping that Cygwin and WSL use. The mapping is reversed during lookup.
+//
+// The file .hubfs/invalid-names at the root of a ref lists the paths of the files whose
+// names are mangled.
+
+const (
+	mangleBase = 0xf000
+	mangleDir  = ".hubfs"
+	mangleList = "invalid-names"
+)
+
+const (
+	specialNone        = iota
+	specialDir         // the .hubfs directory
+	specialNames       // the .hubfs/invalid-names file
+	specialInfo        // the .hubfs_info file of the host or an owner directory (see info.go)
+	specialStarred     // the .starred directory (see starred.go)
+	specialStarredLink // a symlink in the .starred directory
+	specialReleases    // the .releases directory (see release.go)
+	specialRelease     // a release in the .releases directory
+	specialAssets      // the assets directory of a release
+	specialAsset       // an asset of a release
+	specialArtifacts   // the .artifacts directory (see artifact.go)
+	specialArtifact    // an artifact in the .artifacts directory
+	specialZipEntry    // a file or directory within an artifact
+	specialIssues      // the .issues directory (see issue.go)
+	specialIssueMd     // the markdown file of an issue
+	specialIssueJSON   // the JSON file of an issue
+	specialRepoInfo    // the .hubfs_repo.json file of a repository (see info.go)
+)
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func invalidChar(c rune) bool {
+	return 0x20 > c || -1 != strings.IndexRune(`\:*?"<>|`, c)
+}
+
+func reservedName(name string) bool {
+	if i := strings.IndexByte(name, '.'); -1 != i {
+		name = name[:i]
+	}
+	return reservedNames[strings.ToUpper(strings.TrimRight(name, " "))]
+}
+
+// Function mangleName returns a name that is valid on Windows for a file name.
+func mangleName(name string) string {
+	if "" == name || "." == name || ".." == name {
+		return name
+	}
+	var b strings.Builder
+	valid := true
+	n := len(name)
+	for i, c := range name {
+		switch {
+		case invalidChar(c),
+			('.' == c || ' ' == c) && n == i+1,
+			0 == i && reservedName(name):
+			c += mangleBase
+			valid = false
+		}
+		b.WriteRune(c)
+	}
+	if valid {
+		return name
+	}
+	return b.String()
+}
+
+// Function unmangleName reverses mangleName.
+func unmangleName(name string) string {
+	if -1 == strings.IndexFunc(name, func(c rune) bool {
+		return mangleBase <= c && mangleBase+0x80 > c
+	}) {
+		return name
+	}
+	return strings.Map(func(c rune) rune {
+		if mangleBase <= c && mangleBase+0x80 > c {
+			c -= mangleBase
+		}
+		return c
+	}, name)
+}
+
+// Type invalidCache keeps the .hubfs/invalid-names contents of recently used refs.
+type invalidCache struct {
+	lock sync.Mutex
+	data map[providers.Ref][]byte
+}
+
+// maximum number of refs whose .hubfs/invalid-names contents are kept
+const invalidCacheMax = 16
+
+// Function invalidNames returns the contents of the .hubfs/invalid-names file of a ref:
+// one line per file whose name is mangled, with the original and mangled paths separated
+// by a tab. The contents are computed by walking the whole tree of the ref.
+func (fs *hubfs) invalidNames(ctx context.Context, obs *obstack) ([]byte, error) {
+	fs.invalid.lock.Lock()
+	data, ok := fs.invalid.data[obs.ref]
+	fs.invalid.lock.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	var lines []string
+	var walk func(entry providers.TreeEntry, orig string, mangled string) error
+	walk = func(entry providers.TreeEntry, orig string, mangled string) error {
+		lst, err := obs.repository.GetTree(ctx, obs.ref, entry)
+		if nil != err {
+			return err
+		}
+		for _, elm := range lst {
+			n := elm.Name()
+			m := mangleName(n)
+			o, p := pathutil.Join(orig, n), pathutil.Join(mangled, m)
+			if n != m {
+				lines = append(lines, fmt.Sprintf("%s\t%s\n", o, p))
+			}
+			if fuse.S_IFDIR == elm.Mode()&fuse.S_IFMT {
+				err = walk(elm, o, p)
+				if nil != err {
+					return err
+				}
+			}
+		}
+		return ctx.Err()
+	}
+	err := walk(nil, "/", "/")
+	if nil != err {
+		return nil, err
+	}
+
+	sort.Strings(lines)
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l)
+	}
+	data = buf.Bytes()
+
+	fs.invalid.lock.Lock()
+	if nil == fs.invalid.data || invalidCacheMax <= len(fs.invalid.data) {
+		fs.invalid.data = make(map[providers.Ref][]byte)
+	}
+	fs.invalid.data[obs.ref] = data
+	fs.invalid.lock.Unlock()
+
+	return data, nil
+}
@@ -0,0 +1,97 @@
+/*
+ * manifest.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	"fmt"
+	pathutil "path"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// A manifest maps the path of every file of the tree of a ref (or of a directory within a
+// ref) to the SHA of its Git blob. It is computed from tree objects only, so no file
+// content is fetched. Paths are relative to the tree and are named as in a mount (see
+// Config.Mangle). Symbolic links are included, because their blobs contain their targets;
+// submodules are omitted.
+
+// Manifest is the manifest of a tree.
+type Manifest struct {
+	Ref    string            `json:"ref"`
+	Commit string            `json:"commit,omitempty"`
+	Files  map[string]string `json:"files"` // path -> blob SHA
+}
+
+// Function BuildManifest builds the manifest of the tree at path (relative to c.Prefix).
+func BuildManifest(ctx context.Context, c Config, path string) (*Manifest, error) {
+	c.Prefix = pathutil.Clean("/" + c.Prefix)
+	fs := new(c).(*hubfs)
+	errc, obs := fs.open(ctx, path)
+	if 0 != errc {
+		if -fuse.ENOENT == errc {
+			return nil, fmt.Errorf("%s: not found", path)
+		}
+		return nil, fmt.Errorf("%s: %v", path, fuse.Error(errc))
+	}
+	defer fs.release(obs)
+	if nil == obs.ref || specialNone != obs.special {
+		return nil, fmt.Errorf("%s: not a ref or a directory within a ref", path)
+	}
+	if nil != obs.entry && fuse.S_IFDIR != obs.entry.Mode()&fuse.S_IFMT {
+		return nil, fmt.Errorf("%s: not a directory", path)
+	}
+
+	m := &Manifest{Ref: obs.ref.Name(), Files: make(map[string]string)}
+	if c, ok := obs.ref.(providers.CommitRef); ok {
+		m.Commit = c.CommitHash()
+	}
+	err := fs.manifest(ctx, obs, obs.entry, "", m.Files)
+	if nil != err {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Function manifest adds the files of the tree of entry to files.
+func (fs *hubfs) manifest(ctx context.Context, obs *obstack, entry providers.TreeEntry,
+	dir string, files map[string]string) error {
+
+	lst, err := obs.repository.GetTree(ctx, obs.ref, entry)
+	if nil != err {
+		return err
+	}
+
+	for _, e := range lst {
+		name := e.Name()
+		if fs.mangle {
+			name = mangleName(name)
+		}
+		path := pathutil.Join(dir, name)
+
+		switch e.Mode() & fuse.S_IFMT {
+		case fuse.S_IFDIR:
+			err = fs.manifest(ctx, obs, e, path, files)
+			if nil != err {
+				return err
+			}
+		case 0160000 /* submodule */ :
+		default:
+			files[path] = e.Hash()
+		}
+	}
+
+	return nil
+}
@@ -14,6 +14,7 @@
 package hubfs
 
 import (
+	"context"
 	"os"
 	pathutil "path"
 	"path/filepath"
@@ -22,8 +23,11 @@ import (
 
 	"github.com/billziss-gh/cgofuse/fuse"
 	"github.com/billziss-gh/hubfs/fs/overlayfs"
+	"github.com/billziss-gh/hubfs/fs/port"
 	"github.com/billziss-gh/hubfs/fs/ptfs"
 	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/metrics"
+	"github.com/billziss-gh/hubfs/providers"
 )
 
 func New(c Config) fuse.FileSystemInterface {
@@ -44,6 +48,10 @@ func New(c Config) fuse.FileSystemInterface {
 		}
 	}
 
+	if nil != c.Notify {
+		notifyRefs(c.Client, c.Prefix, c.RefEncoding, c.Notify)
+	}
+
 	if c.Overlay {
 		return newOverlay(c)
 	} else {
@@ -51,35 +59,98 @@ func New(c Config) fuse.FileSystemInterface {
 	}
 }
 
+// Function notifyRefs arranges for the branches that are created or deleted on the
+// server to be reported as ref directories that are created or deleted under prefix.
+func notifyRefs(client providers.Client, prefix string, refenc RefEncoding,
+	notify func(path string, action uint32)) {
+	n, ok := client.(providers.RefNotifier)
+	if !ok {
+		return
+	}
+	pfx := split(prefix)
+	n.SetRefNotify(func(owner string, repository string, ref string, created bool) {
+		name := strings.TrimPrefix(ref, "refs/heads/")
+		if name == ref {
+			return
+		}
+		lst := append([]string{owner, repository}, strings.Split(refenc.Encode(name), "/")...)
+		if len(pfx) >= len(lst) {
+			return
+		}
+		for i, c := range pfx {
+			if !strings.EqualFold(c, lst[i]) {
+				return
+			}
+		}
+		action := uint32(fuse.NOTIFY_MKDIR)
+		if !created {
+			action = fuse.NOTIFY_RMDIR
+		}
+		notify("/"+strings.Join(lst[len(pfx):], "/"), action)
+	})
+}
+
 func newOverlay(c Config) fuse.FileSystemInterface {
 	scope := c.Prefix
-	scopeSlashes := strings.Count(c.Prefix, "/")
+	scopeComps := len(split(scope))
 	caseins := c.Caseins
 
 	topfs := new(Config{
-		Client:  c.Client,
-		Prefix:  c.Prefix,
-		Caseins: c.Caseins,
+		Client:      c.Client,
+		Remote:      c.Remote,
+		Prefix:      c.Prefix,
+		Caseins:     c.Caseins,
+		RefEncoding: c.RefEncoding,
+		Mangle:      c.Mangle,
+		Quota:       c.Quota,
+		CommitTime:  c.CommitTime,
+		Artifacts:   c.Artifacts,
+		Issues:      c.Issues,
+		AuditLog:    c.AuditLog,
+		AccessTrace: c.AccessTrace,
+		Interrupts:  c.Interrupts,
+		Init:        c.Init,
 	}).(*hubfs)
 
-	split := func(path string) (string, string) {
-		slashes := scopeSlashes
-		for i := 0; len(path) > i; i++ {
-			if '/' == path[i] {
-				slashes++
-				if 4 == slashes {
-					if 0 == i {
-						return "/", path
-					} else {
-						return path[:i], path[i:]
-					}
-				}
-			}
+	// long directory listings of an overlay can only be abandoned if requests can be
+	// interrupted
+	var interrupted func() bool
+	if topfs.intr {
+		interrupted = port.Interrupted
+	}
+
+	// count operations by repository for hubfs top
+	scopeList := split(scope)
+	countop := func(comp []string) {
+		k := 2 - scopeComps
+		if 0 >= k {
+			metrics.CountOp(scopeList[0] + "/" + scopeList[1])
+		} else if len(comp) >= k {
+			metrics.CountOp(strings.Join(append(scopeList[:scopeComps:scopeComps], comp[:k]...), "/"))
+		}
+	}
+
+	// split a path into the path of its ref directory (if any) and the remaining path
+	splitpath := func(path string) (string, string) {
+		comp := split(path)
+		if 0 < len(comp) && isTrashName(comp[0]) {
+			return "/" + comp[0], "/" + strings.Join(comp[1:], "/")
+		}
+		countop(comp)
+		k := 3 - scopeComps
+		if RefEncodingNested == c.RefEncoding && len(comp) >= k {
+			k = topfs.refcomps(comp)
 		}
-		if 3 == slashes && "/" != path {
-			return path, "/"
+		switch {
+		case 0 > k || len(comp) < k ||
+			(0 < k && (releasesName == comp[k-1] || artifactsName == comp[k-1] ||
+				issuesName == comp[k-1] || repoInfoName == comp[k-1])):
+			return "", path
+		case 0 == k:
+			return "/", path
+		default:
+			return "/" + strings.Join(comp[:k], "/"), "/" + strings.Join(comp[k:], "/")
 		}
-		return "", path
 	}
 
 	newfs := func(prefix string) fuse.FileSystemInterface {
@@ -89,20 +160,39 @@ func newOverlay(c Config) fuse.FileSystemInterface {
 			}
 		}()
 
-		errc, obs := topfs.open(prefix)
+		if isTrashName(prefix[1:]) {
+			return newTrashfs(c.TrashDir, prefix[1:])
+		}
+
+		errc, obs := topfs.open(context.Background(), prefix)
 		if 0 != errc {
 			return nil
 		}
 
-		r := obs.ref.Name()
-		n := strings.TrimPrefix(r, "refs/heads/")
-		if r == n {
-			n = strings.TrimPrefix(r, "refs/tags/")
-			if r == n {
-				n = r
-			}
+		// the overlay directories of a ref are named the same regardless of RefEncoding
+		n := strings.ReplaceAll(refShortName(obs.ref.Name()), "/", refSlashSeparator)
+
+		// apply the mount options that are overridden for the repository
+		var mntopts providers.MountOptions
+		if r, ok := obs.repository.(providers.MountOptionsRepository); ok {
+			mntopts = r.MountOptions()
+		}
+		caseins := caseins || mntopts.Caseins
+
+		lofs := new(Config{
+			Client:      topfs.client,
+			Prefix:      pathutil.Join(scope, prefix),
+			Caseins:     caseins,
+			RefEncoding: c.RefEncoding,
+			Mangle:      c.Mangle,
+			CommitTime:  c.CommitTime,
+			AuditLog:    c.AuditLog,
+			AccessTrace: c.AccessTrace,
+			Interrupts:  c.Interrupts,
+		})
+		if mntopts.Readonly {
+			return newShardfs(topfs, prefix, obs, lofs, true)
 		}
-		n = strings.ReplaceAll(n, "/", refSlashSeparator)
 
 		root := filepath.Join(obs.repository.GetDirectory(), "files")
 		err := os.MkdirAll(root, 0700)
@@ -118,25 +208,91 @@ func newOverlay(c Config) fuse.FileSystemInterface {
 			return nil
 		}
 
+		meta := filepath.Join(obs.repository.GetDirectory(), "meta", n)
+		err = os.MkdirAll(meta, 0700)
+		if nil != err {
+			topfs.release(obs)
+			return nil
+		}
+
+		// migrate a path map that was stored alongside the overlay files
+		pmname := filepath.Join(meta, ".unionfs")
+		if _, err = os.Stat(pmname); nil != err {
+			os.Rename(filepath.Join(root, ".unionfs"), pmname)
+		}
+
 		upfs := ptfs.New(root)
-		lofs := new(Config{
-			Client:  topfs.client,
-			Prefix:  pathutil.Join(scope, prefix),
-			Caseins: caseins,
-		})
+		var collide func(path string)
+		if nil != c.Collide {
+			collide = func(path string) {
+				c.Collide(pathutil.Join(scope, prefix, path))
+			}
+		}
 		unfs := unionfs.New(unionfs.Config{
-			Fslist:  []fuse.FileSystemInterface{upfs, lofs},
-			Caseins: caseins,
+			Fslist:      []fuse.FileSystemInterface{upfs, lofs},
+			Pmfs:        ptfs.New(meta),
+			Caseins:     caseins,
+			Unorm:       c.Unorm,
+			Pmverify:    c.VerifyPaths,
+			Pmsorted:    c.SortPaths,
+			Collide:     collide,
+			Interrupted: interrupted,
+			Nocopy:      lofs.(*hubfs).isdecrypted,
 		})
 
-		return newShardfs(topfs, prefix, obs, unfs)
+		return newShardfs(topfs, prefix, obs, unfs, false)
 	}
 
 	return overlayfs.New(overlayfs.Config{
 		Topfs:      topfs,
-		Split:      split,
+		Split:      splitpath,
 		Newfs:      newfs,
 		Caseins:    caseins,
 		TimeToLive: 1 * time.Second,
+		CopyRename: func(oldprefix string, newprefix string) bool {
+			return "" != c.TrashDir &&
+				(isTrashName(strings.TrimPrefix(oldprefix, "/")) ||
+					isTrashName(strings.TrimPrefix(newprefix, "/")))
+		},
 	})
 }
+
+// File managers move deleted files to a trash directory at the root of the volume
+// (.Trash-UID on Linux, .Trashes on macOS), which they create if it does not exist. The
+// trash directories of the root of an overlay are never part of a ref, even when the
+// root is a ref directory; otherwise deleted files would be moved into the local changes
+// of the ref. They are either denied, so that file managers delete files permanently
+// (whiteouts), or backed by directories outside of the refs (Config.TrashDir). Because
+// not all file managers copy files when a rename fails with EXDEV, renames into and out
+// of a trash directory are performed by the overlay by copying.
+
+// Function isTrashName reports whether a name is the name of a trash directory.
+func isTrashName(name string) bool {
+	switch {
+	case ".Trash" == name || ".Trashes" == name:
+		return true
+	case strings.HasPrefix(name, ".Trash-"):
+		for _, r := range name[len(".Trash-"):] {
+			if '0' > r || '9' < r {
+				return false
+			}
+		}
+		return len(".Trash-") < len(name)
+	}
+	return false
+}
+
+// Function newTrashfs returns the file system of a trash directory, or nil if the trash
+// directory is denied. The shared .Trash directory (which must be set up by an
+// administrator) is always denied.
+func newTrashfs(trashdir string, name string) fuse.FileSystemInterface {
+	if "" == trashdir || ".Trash" == name {
+		return nil
+	}
+	root := filepath.Join(trashdir, name)
+	if err := os.MkdirAll(root, 0700); nil != err {
+		tracef("trash=%q: %v", root, err)
+		return nil
+	}
+	return ptfs.New(root)
+}
@@ -0,0 +1,139 @@
+/*
+ * refname.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"errors"
+	"strings"
+)
+
+// RefEncoding determines how ref names (without their refs/heads/ or refs/tags/
+// prefix) are mapped to directory names.
+type RefEncoding int
+
+const (
+	// RefEncodingPlus replaces slashes with "+" (e.g. "feature/x" becomes "feature+x").
+	// This is the default. It is not reversible for ref names that contain "+".
+	RefEncodingPlus RefEncoding = iota
+
+	// RefEncodingPercent percent-encodes slashes, "%" and characters that are not
+	// valid in file names on some systems (e.g. "feature/x" becomes "feature%2Fx").
+	RefEncodingPercent
+
+	// RefEncodingNested maps slashes to nested directories and percent-encodes the
+	// remaining invalid characters (e.g. "feature/x" becomes "feature/x").
+	RefEncodingNested
+)
+
+var refEncodingNames = []string{"plus", "percent", "nested"}
+
+// Function ParseRefEncoding returns the RefEncoding with the given name: "plus",
+// "percent" or "nested". The empty name is the default encoding.
+func ParseRefEncoding(name string) (RefEncoding, error) {
+	if "" == name {
+		return RefEncodingPlus, nil
+	}
+	for i, n := range refEncodingNames {
+		if n == name {
+			return RefEncoding(i), nil
+		}
+	}
+	return RefEncodingPlus, errors.New("invalid ref encoding: " + name)
+}
+
+func (e RefEncoding) String() string {
+	if 0 <= e && int(e) < len(refEncodingNames) {
+		return refEncodingNames[e]
+	}
+	return ""
+}
+
+// Function Encode returns the directory name of a ref name. For RefEncodingNested the
+// result is a relative path with one component per slash-separated part of the name.
+func (e RefEncoding) Encode(name string) string {
+	switch e {
+	case RefEncodingPercent:
+		return percentEncode(name, true)
+	case RefEncodingNested:
+		return percentEncode(name, false)
+	default:
+		return strings.ReplaceAll(name, "/", refSlashSeparator)
+	}
+}
+
+// Function Decode returns the ref name of a directory name. For RefEncodingNested it
+// decodes a single path component.
+func (e RefEncoding) Decode(name string) string {
+	switch e {
+	case RefEncodingPercent, RefEncodingNested:
+		return percentDecode(name)
+	default:
+		return strings.ReplaceAll(name, refSlashSeparator, "/")
+	}
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+func percentEscaped(c byte, slash bool) bool {
+	if '/' == c {
+		return slash
+	}
+	return 0x20 > c || 0x7f == c || -1 != strings.IndexByte(`%\:*?"<>|`, c)
+}
+
+func percentEncode(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; len(s) > i; i++ {
+		c := s[i]
+		if percentEscaped(c, slash) {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return -1
+}
+
+func percentDecode(s string) string {
+	if -1 == strings.IndexByte(s, '%') {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; len(s) > i; i++ {
+		c := s[i]
+		if '%' == c && len(s) > i+2 {
+			if h, l := unhex(s[i+1]), unhex(s[i+2]); 0 <= h && 0 <= l {
+				b.WriteByte(byte(h<<4 | l))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,120 @@
+/*
+ * release.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// The directory .releases in a repository directory presents the releases of the
+// repository: .releases / tag / assets / file. Asset files are read-only; their content
+// is downloaded when they are first read. Ref names cannot start with a dot, so
+// .releases cannot hide a ref.
+
+const (
+	releasesName = ".releases"
+	assetsName   = "assets"
+)
+
+// Function hasReleases determines whether the repository opened by obs has releases.
+func hasReleases(obs *obstack) bool {
+	_, ok := obs.repository.(providers.ReleaseRepository)
+	return ok
+}
+
+// Function releaseName returns the directory name of a release. Slashes in tag names
+// are replaced as in the overlay directories of refs.
+func releaseName(release providers.Release) string {
+	return strings.ReplaceAll(release.Name(), "/", refSlashSeparator)
+}
+
+// Function openrelease opens the release, assets directory or asset named by the path
+// component c within the .releases directory.
+func (fs *hubfs) openrelease(ctx context.Context, obs *obstack, c string) error {
+	match := func(n string) bool {
+		return n == c || (fs.caseins && strings.EqualFold(n, c))
+	}
+	switch obs.special {
+	case specialReleases:
+		lst, err := obs.repository.(providers.ReleaseRepository).GetReleases(ctx)
+		if nil != err {
+			return err
+		}
+		for _, elm := range lst {
+			if match(releaseName(elm)) {
+				obs.special, obs.release = specialRelease, elm
+				return nil
+			}
+		}
+	case specialRelease:
+		if match(assetsName) {
+			obs.special = specialAssets
+			return nil
+		}
+	case specialAssets:
+		for _, elm := range obs.release.Assets() {
+			if match(elm.Name()) {
+				obs.special, obs.asset = specialAsset, elm
+				return nil
+			}
+		}
+	}
+	return providers.ErrNotFound
+}
+
+// Function releasedir returns the entries of a directory within the .releases directory.
+func (fs *hubfs) releasedir(ctx context.Context, obs *obstack) (res []dirent, err error) {
+	switch obs.special {
+	case specialReleases:
+		lst, err := obs.repository.(providers.ReleaseRepository).GetReleases(ctx)
+		if nil != err {
+			return nil, err
+		}
+		res = make([]dirent, len(lst))
+		for i, elm := range lst {
+			res[i].name = releaseName(elm)
+			fuseStat(&res[i].stat, fuse.S_IFDIR, 0, elm.Time())
+		}
+	case specialRelease:
+		res = make([]dirent, 1)
+		res[0].name = assetsName
+		fuseStat(&res[0].stat, fuse.S_IFDIR, 0, obs.release.Time())
+	case specialAssets:
+		lst := obs.release.Assets()
+		res = make([]dirent, len(lst))
+		for i, elm := range lst {
+			res[i].name = elm.Name()
+			fuseStat(&res[i].stat, fuse.S_IFREG, elm.Size(), elm.Time())
+		}
+	}
+	return res, nil
+}
+
+// Function releasestat returns the stat of a directory or file within the .releases
+// directory.
+func releasestat(obs *obstack, stat *fuse.Stat_t) {
+	switch obs.special {
+	case specialReleases:
+		fuseStat(stat, fuse.S_IFDIR, 0, time.Now())
+	case specialRelease, specialAssets:
+		fuseStat(stat, fuse.S_IFDIR, 0, obs.release.Time())
+	case specialAsset:
+		fuseStat(stat, fuse.S_IFREG, obs.asset.Size(), obs.asset.Time())
+	}
+}
@@ -29,16 +29,19 @@ type shardfs struct {
 	prefix   string
 	obs      *obstack
 	keeppath string
+	readonly bool // all modifications fail with EROFS
 	once     sync.Once
 }
 
-func newShardfs(topfs *hubfs, prefix string, obs *obstack, fs fuse.FileSystemInterface) fuse.FileSystemInterface {
+func newShardfs(topfs *hubfs, prefix string, obs *obstack, fs fuse.FileSystemInterface,
+	readonly bool) fuse.FileSystemInterface {
 	return &shardfs{
 		FileSystemInterface: fs,
 		topfs:               topfs,
 		prefix:              prefix,
 		obs:                 obs,
 		keeppath:            "/.keep",
+		readonly:            readonly,
 	}
 }
 
@@ -57,20 +60,45 @@ func (fs *shardfs) initonce() {
 	})
 }
 
+// Function Statfs reports the same space for all refs (see statfs.go).
+func (fs *shardfs) Statfs(path string, stat *fuse.Statfs_t) (errc int) {
+	return fs.topfs.Statfs("/", stat)
+}
+
 func (fs *shardfs) Destroy() {
 	fs.FileSystemInterface.Destroy()
 	fs.topfs.release(fs.obs)
 }
 
+// Function Mknod creates regular files, FIFOs and sockets among the local changes of a
+// ref; FIFOs and sockets are created as such in the cache directory when its file system
+// supports them. Device files are never created. Nodes that cannot be created fail with
+// EPERM, which is what mknod(2) reports for node types that a file system does not support.
 func (fs *shardfs) Mknod(path string, mode uint32, dev uint64) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
+	special := false
+	switch mode & fuse.S_IFMT {
+	case 0, fuse.S_IFREG:
+	case fuse.S_IFIFO, fuse.S_IFSOCK:
+		special = true
+	default:
+		return -fuse.EPERM
+	}
 	errc = fs.FileSystemInterface.Mknod(path, mode, dev)
 	if 0 == errc {
 		fs.initonce()
+	} else if special && -fuse.ENOSYS == errc {
+		errc = -fuse.EPERM
 	}
 	return
 }
 
 func (fs *shardfs) Mkdir(path string, mode uint32) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Mkdir(path, mode)
 	if 0 == errc {
 		fs.initonce()
@@ -79,6 +107,9 @@ func (fs *shardfs) Mkdir(path string, mode uint32) (errc int) {
 }
 
 func (fs *shardfs) Unlink(path string) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Unlink(path)
 	if 0 == errc && fs.keeppath != path {
 		fs.initonce()
@@ -87,6 +118,9 @@ func (fs *shardfs) Unlink(path string) (errc int) {
 }
 
 func (fs *shardfs) Rmdir(path string) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Rmdir(path)
 	if 0 == errc {
 		fs.initonce()
@@ -95,6 +129,9 @@ func (fs *shardfs) Rmdir(path string) (errc int) {
 }
 
 func (fs *shardfs) Link(oldpath string, newpath string) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Link(oldpath, newpath)
 	if 0 == errc {
 		fs.initonce()
@@ -103,6 +140,9 @@ func (fs *shardfs) Link(oldpath string, newpath string) (errc int) {
 }
 
 func (fs *shardfs) Symlink(target string, newpath string) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Symlink(target, newpath)
 	if 0 == errc {
 		fs.initonce()
@@ -125,6 +165,9 @@ func (fs *shardfs) Readlink(path string) (errc int, target string) {
 }
 
 func (fs *shardfs) Rename(oldpath string, newpath string) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Rename(oldpath, newpath)
 	if 0 == errc {
 		fs.initonce()
@@ -133,6 +176,9 @@ func (fs *shardfs) Rename(oldpath string, newpath string) (errc int) {
 }
 
 func (fs *shardfs) Chmod(path string, mode uint32) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Chmod(path, mode)
 	if 0 == errc {
 		fs.initonce()
@@ -141,6 +187,9 @@ func (fs *shardfs) Chmod(path string, mode uint32) (errc int) {
 }
 
 func (fs *shardfs) Chown(path string, uid uint32, gid uint32) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Chown(path, uid, gid)
 	if 0 == errc {
 		fs.initonce()
@@ -149,6 +198,9 @@ func (fs *shardfs) Chown(path string, uid uint32, gid uint32) (errc int) {
 }
 
 func (fs *shardfs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Utimens(path, tmsp)
 	if 0 == errc {
 		fs.initonce()
@@ -157,6 +209,9 @@ func (fs *shardfs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
 }
 
 func (fs *shardfs) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	if fs.readonly {
+		return -fuse.EROFS, ^uint64(0)
+	}
 	errc, fh = fs.FileSystemInterface.Create(path, flags, mode)
 	if 0 == errc {
 		fs.initonce()
@@ -164,7 +219,18 @@ func (fs *shardfs) Create(path string, flags int, mode uint32) (errc int, fh uin
 	return
 }
 
+func (fs *shardfs) Open(path string, flags int) (errc int, fh uint64) {
+	if fs.readonly && (fuse.O_RDONLY != flags&(fuse.O_RDONLY|fuse.O_WRONLY|fuse.O_RDWR) ||
+		0 != flags&fuse.O_TRUNC) {
+		return -fuse.EROFS, ^uint64(0)
+	}
+	return fs.FileSystemInterface.Open(path, flags)
+}
+
 func (fs *shardfs) Truncate(path string, size int64, fh uint64) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Truncate(path, size, fh)
 	if 0 == errc {
 		fs.initonce()
@@ -172,7 +238,24 @@ func (fs *shardfs) Truncate(path string, size int64, fh uint64) (errc int) {
 	return
 }
 
+func (fs *shardfs) Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
+	errc = -fuse.ENOSYS
+	if f, ok := fs.FileSystemInterface.(fallocate); ok {
+		errc = f.Fallocate(path, mode, ofst, length, fh)
+	}
+	if 0 == errc {
+		fs.initonce()
+	}
+	return
+}
+
 func (fs *shardfs) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	n = fs.FileSystemInterface.Write(path, buff, ofst, fh)
 	if 0 <= n {
 		fs.initonce()
@@ -181,6 +264,9 @@ func (fs *shardfs) Write(path string, buff []byte, ofst int64, fh uint64) (n int
 }
 
 func (fs *shardfs) Setxattr(path string, name string, value []byte, flags int) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Setxattr(path, name, value, flags)
 	if 0 == errc {
 		fs.initonce()
@@ -189,6 +275,9 @@ func (fs *shardfs) Setxattr(path string, name string, value []byte, flags int) (
 }
 
 func (fs *shardfs) Removexattr(path string, name string) (errc int) {
+	if fs.readonly {
+		return -fuse.EROFS
+	}
 	errc = fs.FileSystemInterface.Removexattr(path, name)
 	if 0 == errc {
 		fs.initonce()
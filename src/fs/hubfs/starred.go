@@ -0,0 +1,90 @@
+/*
+ * starred.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// The directory .starred in the host directory lists the repositories starred by the
+// authenticated user, so that they can be browsed without remembering their owners. Each
+// repository is presented as a symlink named OWNER+REPOSITORY that points to /OWNER/
+// REPOSITORY. Owner names cannot contain dots, so .starred cannot hide an owner.
+
+const (
+	starredName      = ".starred"
+	starredSeparator = "+"
+)
+
+// Function starred returns the repositories starred by the authenticated user as a map
+// of symlink names to symlink targets.
+func (fs *hubfs) starred(ctx context.Context) (map[string]string, error) {
+	lst, err := fs.client.(providers.StarredLister).GetStarred(ctx)
+	if nil != err {
+		return nil, err
+	}
+	res := make(map[string]string, len(lst))
+	for _, elm := range lst {
+		res[strings.Replace(elm, "/", starredSeparator, 1)] = "/" + elm
+	}
+	return res, nil
+}
+
+// Function openstarred opens the starred repository symlink named by the path
+// component c.
+func (fs *hubfs) openstarred(ctx context.Context, obs *obstack, c string) error {
+	m, err := fs.starred(ctx)
+	if nil != err {
+		return err
+	}
+	if target, ok := m[c]; ok {
+		obs.special, obs.link = specialStarredLink, target
+		return nil
+	}
+	if fs.caseins {
+		for n, target := range m {
+			if strings.EqualFold(n, c) {
+				obs.special, obs.link = specialStarredLink, target
+				return nil
+			}
+		}
+	}
+	return providers.ErrNotFound
+}
+
+// Function starreddir returns the entries of the .starred directory.
+func (fs *hubfs) starreddir(ctx context.Context) (res []dirent, err error) {
+	m, err := fs.starred(ctx)
+	if nil != err {
+		return nil, err
+	}
+	res = make([]dirent, 0, len(m))
+	for n, target := range m {
+		s := fuse.Stat_t{}
+		fuseStat(&s, fuse.S_IFLNK, int64(len(target)), time.Now())
+		res = append(res, dirent{n, s})
+	}
+	return res, nil
+}
+
+// Function hasStarred determines whether the client can list starred repositories.
+func (fs *hubfs) hasStarred() bool {
+	_, ok := fs.client.(providers.StarredLister)
+	return ok
+}
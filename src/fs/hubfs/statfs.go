@@ -0,0 +1,121 @@
+/*
+ * statfs.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/port"
+	"github.com/billziss-gh/hubfs/hooks"
+)
+
+// The file system reports the space of the volume that holds the cache directory, which
+// also holds the writable (upper) layers of refs. When a quota is set the total space is
+// the quota and the free space is the part of the quota that is not used by the cache
+// directory (but no more than the free space of the volume).
+
+// time that the computed usage of the cache directory remains valid
+const usageTimeToLive = 10 * time.Second
+
+// Type usageCache keeps the most recently computed usage of the cache directory.
+type usageCache struct {
+	lock sync.Mutex
+	time time.Time
+	size int64
+	full bool // usage has reached the quota
+}
+
+// Function cacheUsage returns the total size of the files in the cache directory.
+func (fs *hubfs) cacheUsage(dir string) int64 {
+	fs.usage.lock.Lock()
+	defer fs.usage.lock.Unlock()
+
+	if usageTimeToLive > time.Since(fs.usage.time) {
+		return fs.usage.size
+	}
+
+	size := int64(0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if nil == err && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	fs.usage.time = time.Now()
+	fs.usage.size = size
+
+	return size
+}
+
+// Function checkQuota fires the quota hook when the usage of the cache directory reaches
+// the quota. The hook fires again only after the usage has dropped below the quota.
+func (fs *hubfs) checkQuota(size int64) {
+	fs.usage.lock.Lock()
+	full := size >= fs.quota
+	fire := full && !fs.usage.full
+	fs.usage.full = full
+	fs.usage.lock.Unlock()
+
+	if fire {
+		hooks.Fire(hooks.Quota, map[string]string{
+			"quota": strconv.FormatInt(fs.quota, 10),
+			"usage": strconv.FormatInt(size, 10),
+		})
+	}
+}
+
+func (fs *hubfs) Statfs(path string, stat *fuse.Statfs_t) (errc int) {
+	dir := fs.client.GetDirectory()
+	if "" == dir {
+		return -fuse.ENOSYS
+	}
+
+	errc = port.Statfs(dir, stat)
+	if 0 != errc || 0 >= fs.quota {
+		return
+	}
+
+	if 0 == stat.Frsize {
+		stat.Frsize = stat.Bsize
+	}
+	if 0 == stat.Frsize {
+		stat.Frsize = 4096
+	}
+
+	size := fs.cacheUsage(dir)
+	fs.checkQuota(size)
+
+	total := uint64(fs.quota) / stat.Frsize
+	used := (uint64(size) + stat.Frsize - 1) / stat.Frsize
+	free := uint64(0)
+	if total > used {
+		free = total - used
+	}
+
+	stat.Blocks = total
+	if free < stat.Bfree {
+		stat.Bfree = free
+	}
+	if free < stat.Bavail {
+		stat.Bavail = free
+	}
+
+	return 0
+}
@@ -0,0 +1,166 @@
+/*
+ * trace.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hubfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	pathutil "path"
+	"sync"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// An access trace records the path of every file of repository content that is opened,
+// once per path. A trace is written as JSON lines, each of the form {"path":"..."}; the
+// path is relative to the remote (it includes the prefix of the file system). Warmup
+// replays a trace by fetching the content of the traced files into the cache, so that a
+// later mount that accesses the same files finds them there.
+
+// AccessTrace writes the paths of opened files to a writer. It may be shared by multiple
+// file systems.
+type AccessTrace struct {
+	lock   sync.Mutex
+	writer io.Writer
+	seen   map[string]bool
+}
+
+type traceRecord struct {
+	Path string `json:"path"`
+}
+
+// Function NewAccessTrace creates an access trace that writes to writer.
+func NewAccessTrace(writer io.Writer) *AccessTrace {
+	return &AccessTrace{writer: writer, seen: make(map[string]bool)}
+}
+
+// Function Record records a path in the access trace, unless it is already recorded.
+func (t *AccessTrace) Record(path string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.seen[path] {
+		return nil
+	}
+	line, err := json.Marshal(traceRecord{path})
+	if nil != err {
+		return err
+	}
+	_, err = t.writer.Write(append(line, '\n'))
+	if nil == err {
+		t.seen[path] = true
+	}
+	return err
+}
+
+// Function ReadAccessTrace reads the paths of an access trace. Blank lines are ignored.
+func ReadAccessTrace(reader io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if 0 == len(line) {
+			continue
+		}
+		var rec traceRecord
+		if err := json.Unmarshal(line, &rec); nil != err || "" == rec.Path {
+			return nil, fmt.Errorf("invalid trace record at line %d", n)
+		}
+		paths = append(paths, rec.Path)
+	}
+	return paths, scanner.Err()
+}
+
+// Function trace records the path of an open file in the access trace.
+func (fs *hubfs) trace(path string, obs *obstack) {
+	if nil == fs.tracer || nil == obs.ref {
+		return
+	}
+
+	if err := fs.tracer.Record(pathutil.Join(fs.prefix, path)); nil != err {
+		tracef("access trace error: %v", err)
+	}
+}
+
+// WarmupStats reports the work done by Warmup.
+type WarmupStats struct {
+	Files   int // files whose content was fetched
+	Missing int // paths that are not found or are not files
+}
+
+// Function Warmup fetches the content of the files at paths (relative to c.Prefix) into
+// the cache. The content of files in the same repository is fetched in a batch where the
+// repository supports it. Paths that are not found are skipped.
+func Warmup(ctx context.Context, c Config, paths []string) (stats WarmupStats, err error) {
+	c.Prefix = pathutil.Clean("/" + c.Prefix)
+	fs := new(c).(*hubfs)
+
+	// one open obstack is kept per repository, so that its repository (and owner) stay
+	// open until their files have been fetched
+	var repositories []providers.Repository
+	handles := map[providers.Repository]*obstack{}
+	entries := map[providers.Repository][]providers.TreeEntry{}
+	defer func() {
+		for _, obs := range handles {
+			fs.release(obs)
+		}
+	}()
+	for _, path := range paths {
+		errc, obs := fs.open(ctx, pathutil.Join("/", path))
+		if 0 != errc {
+			if -fuse.ENOENT != errc && -fuse.ENOTDIR != errc {
+				return stats, fmt.Errorf("%s: %v", path, fuse.Error(errc))
+			}
+			stats.Missing++
+			continue
+		}
+		if nil == obs.ref || nil == obs.entry || specialNone != obs.special ||
+			fuse.S_IFREG != obs.entry.Mode()&fuse.S_IFMT {
+			fs.release(obs)
+			stats.Missing++
+			continue
+		}
+		if _, ok := handles[obs.repository]; !ok {
+			handles[obs.repository] = obs
+			repositories = append(repositories, obs.repository)
+		} else {
+			fs.release(obs)
+		}
+		entries[obs.repository] = append(entries[obs.repository], obs.entry)
+	}
+
+	for _, repository := range repositories {
+		if p, ok := repository.(providers.BlobPrefetcher); ok {
+			err = p.PrefetchBlobs(ctx, entries[repository])
+			if nil != err {
+				return
+			}
+		}
+		for _, entry := range entries[repository] {
+			var reader io.ReaderAt
+			reader, err = repository.GetBlobReader(ctx, entry)
+			if nil != err {
+				return
+			}
+			reader.(io.Closer).Close()
+			stats.Files++
+		}
+	}
+
+	return
+}
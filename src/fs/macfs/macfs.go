@@ -0,0 +1,460 @@
+/*
+ * macfs.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package macfs
+
+import (
+	"strings"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/unionfs/memfs"
+)
+
+// Package macfs implements a file system that intercepts the metadata files that the
+// macOS Finder and Spotlight create or look up in every directory that they visit
+// (.DS_Store, ._ AppleDouble files, .Trashes, etc.). Without interception each lookup
+// of such a file reaches the underlying file system, which may have to fetch a directory
+// to answer it, and browsing a mount triggers a storm of fetches. Metadata files are
+// either denied (lookups fail with ENOENT and creations with EACCES) or kept in a scratch
+// file system in memory; in either case the underlying file system never sees them.
+// The file .metadata_never_index, which prevents Spotlight from indexing the volume, is
+// presented at the root of the file system.
+//
+// Operations are dispatched by path, so a metadata file cannot be renamed to a regular
+// file or vice versa (EXDEV). Metadata files are not listed in directories.
+
+// Mode determines how metadata files are handled.
+type Mode int
+
+const (
+	Deny    Mode = iota // deny metadata files
+	Scratch             // keep metadata files in memory
+)
+
+// Function ParseMode parses a mode name: "deny" or "scratch".
+func ParseMode(s string) (Mode, bool) {
+	switch s {
+	case "deny":
+		return Deny, true
+	case "scratch":
+		return Scratch, true
+	}
+	return 0, false
+}
+
+// name of the file that prevents Spotlight from indexing a volume
+const neverIndexName = ".metadata_never_index"
+
+var metaNames = map[string]bool{
+	".DS_Store":               true,
+	".Spotlight-V100":         true,
+	".Trashes":                true,
+	".Trash":                  true,
+	".fseventsd":              true,
+	".TemporaryItems":         true,
+	".VolumeIcon.icns":        true,
+	".apdisk":                 true,
+	".localized":              true,
+	"Icon\r":                  true,
+	".DocumentRevisions-V100": true,
+}
+
+// Function IsMetaName reports whether a file name is the name of a metadata file.
+func IsMetaName(name string) bool {
+	return metaNames[name] || strings.HasPrefix(name, "._")
+}
+
+type filesystem struct {
+	fuse.FileSystemInterface
+	mode    Mode
+	scratch fuse.FileSystemInterface
+}
+
+type Config struct {
+	Fs   fuse.FileSystemInterface // underlying file system
+	Mode Mode
+}
+
+func New(c Config) fuse.FileSystemInterface {
+	fs := &filesystem{
+		FileSystemInterface: c.Fs,
+		mode:                c.Mode,
+		scratch:             memfs.New(),
+	}
+	fs.scratch.Mknod("/"+neverIndexName, fuse.S_IFREG|0444, 0)
+	return fs
+}
+
+// Function ismeta reports whether a path is (or is within) a metadata file.
+func ismeta(path string) bool {
+	for _, c := range strings.Split(path, "/") {
+		if IsMetaName(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function dstfs returns the file system that serves a path: the scratch file system for
+// metadata files and the presented .metadata_never_index, the underlying file system
+// otherwise. It returns nil for metadata files that are denied.
+func (fs *filesystem) dstfs(path string) fuse.FileSystemInterface {
+	if "/"+neverIndexName == path {
+		return fs.scratch
+	}
+	if !ismeta(path) {
+		return fs.FileSystemInterface
+	}
+	if Scratch == fs.mode {
+		return fs.scratch
+	}
+	return nil
+}
+
+// Function makedirs creates the parent directories of a path in the scratch file system.
+func (fs *filesystem) makedirs(path string) {
+	lst := strings.Split(path, "/")
+	for i := 2; len(lst) > i; i++ {
+		fs.scratch.Mkdir(strings.Join(lst[:i], "/"), 0777)
+	}
+}
+
+// Function create returns the file system in which a file is created. Metadata files
+// that are denied cannot be created; the parent directories of scratch files are created
+// as needed.
+func (fs *filesystem) create(path string) (fuse.FileSystemInterface, int) {
+	dstfs := fs.dstfs(path)
+	switch {
+	case nil == dstfs:
+		return nil, -fuse.EACCES
+	case fs.scratch == dstfs:
+		if "/"+neverIndexName == path {
+			return nil, -fuse.EEXIST
+		}
+		fs.makedirs(path)
+	}
+	return dstfs, 0
+}
+
+func (fs *filesystem) Mknod(path string, mode uint32, dev uint64) (errc int) {
+	dstfs, errc := fs.create(path)
+	if 0 != errc {
+		return
+	}
+	return dstfs.Mknod(path, mode, dev)
+}
+
+func (fs *filesystem) Mkdir(path string, mode uint32) (errc int) {
+	dstfs, errc := fs.create(path)
+	if 0 != errc {
+		return
+	}
+	return dstfs.Mkdir(path, mode)
+}
+
+func (fs *filesystem) Unlink(path string) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Unlink(path)
+}
+
+func (fs *filesystem) Rmdir(path string) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Rmdir(path)
+}
+
+func (fs *filesystem) Link(oldpath string, newpath string) (errc int) {
+	dstfs := fs.dstfs(oldpath)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	newfs, errc := fs.create(newpath)
+	if 0 != errc {
+		return
+	}
+	if dstfs != newfs {
+		return -fuse.EXDEV
+	}
+	return dstfs.Link(oldpath, newpath)
+}
+
+func (fs *filesystem) Symlink(target string, newpath string) (errc int) {
+	dstfs, errc := fs.create(newpath)
+	if 0 != errc {
+		return
+	}
+	return dstfs.Symlink(target, newpath)
+}
+
+func (fs *filesystem) Readlink(path string) (errc int, target string) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT, ""
+	}
+	return dstfs.Readlink(path)
+}
+
+func (fs *filesystem) Rename(oldpath string, newpath string) (errc int) {
+	dstfs := fs.dstfs(oldpath)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	newfs, errc := fs.create(newpath)
+	if 0 != errc {
+		return
+	}
+	if dstfs != newfs {
+		return -fuse.EXDEV
+	}
+	return dstfs.Rename(oldpath, newpath)
+}
+
+func (fs *filesystem) Chmod(path string, mode uint32) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Chmod(path, mode)
+}
+
+func (fs *filesystem) Chown(path string, uid uint32, gid uint32) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Chown(path, uid, gid)
+}
+
+func (fs *filesystem) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Utimens(path, tmsp)
+}
+
+func (fs *filesystem) Access(path string, mask uint32) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Access(path, mask)
+}
+
+func (fs *filesystem) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EACCES, ^uint64(0)
+	}
+	if fs.scratch != dstfs {
+		return dstfs.Create(path, flags, mode)
+	}
+
+	// the scratch file system has no Create
+	if _, errc = fs.create(path); 0 != errc {
+		return errc, ^uint64(0)
+	}
+	errc = fs.scratch.Mknod(path, fuse.S_IFREG|mode&07777, 0)
+	if 0 != errc && (-fuse.EEXIST != errc || 0 != flags&fuse.O_EXCL) {
+		return errc, ^uint64(0)
+	}
+	errc, fh = fs.scratch.Open(path, flags)
+	if 0 == errc && 0 != flags&fuse.O_TRUNC {
+		fs.scratch.Truncate(path, 0, fh)
+	}
+	return
+}
+
+func (fs *filesystem) Open(path string, flags int) (errc int, fh uint64) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT, ^uint64(0)
+	}
+	return dstfs.Open(path, flags)
+}
+
+func (fs *filesystem) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Getattr(path, stat, fh)
+}
+
+func (fs *filesystem) Truncate(path string, size int64, fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Truncate(path, size, fh)
+}
+
+func (fs *filesystem) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	return dstfs.Read(path, buff, ofst, fh)
+}
+
+func (fs *filesystem) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	return dstfs.Write(path, buff, ofst, fh)
+}
+
+func (fs *filesystem) Flush(path string, fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	return dstfs.Flush(path, fh)
+}
+
+func (fs *filesystem) Release(path string, fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	return dstfs.Release(path, fh)
+}
+
+func (fs *filesystem) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	return dstfs.Fsync(path, datasync, fh)
+}
+
+func (fs *filesystem) Opendir(path string) (errc int, fh uint64) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT, ^uint64(0)
+	}
+	return dstfs.Opendir(path)
+}
+
+func (fs *filesystem) Readdir(path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
+	ofst int64,
+	fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	if fs.scratch == dstfs {
+		return dstfs.Readdir(path, fill, ofst, fh)
+	}
+	return dstfs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if IsMetaName(name) {
+			return true
+		}
+		return fill(name, stat, ofst)
+	}, ofst, fh)
+}
+
+func (fs *filesystem) Releasedir(path string, fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	return dstfs.Releasedir(path, fh)
+}
+
+func (fs *filesystem) Fsyncdir(path string, datasync bool, fh uint64) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.EBADF
+	}
+	return dstfs.Fsyncdir(path, datasync, fh)
+}
+
+func (fs *filesystem) Setxattr(path string, name string, value []byte, flags int) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Setxattr(path, name, value, flags)
+}
+
+func (fs *filesystem) Getxattr(path string, name string) (errc int, value []byte) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT, nil
+	}
+	return dstfs.Getxattr(path, name)
+}
+
+func (fs *filesystem) Removexattr(path string, name string) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Removexattr(path, name)
+}
+
+func (fs *filesystem) Listxattr(path string, fill func(name string) bool) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	return dstfs.Listxattr(path, fill)
+}
+
+func (fs *filesystem) Chflags(path string, flags uint32) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	intf, ok := dstfs.(fuse.FileSystemChflags)
+	if !ok {
+		return -fuse.ENOSYS
+	}
+	return intf.Chflags(path, flags)
+}
+
+func (fs *filesystem) Setcrtime(path string, tmsp fuse.Timespec) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	intf, ok := dstfs.(fuse.FileSystemSetcrtime)
+	if !ok {
+		return -fuse.ENOSYS
+	}
+	return intf.Setcrtime(path, tmsp)
+}
+
+func (fs *filesystem) Setchgtime(path string, tmsp fuse.Timespec) (errc int) {
+	dstfs := fs.dstfs(path)
+	if nil == dstfs {
+		return -fuse.ENOENT
+	}
+	intf, ok := dstfs.(fuse.FileSystemSetchgtime)
+	if !ok {
+		return -fuse.ENOSYS
+	}
+	return intf.Setchgtime(path, tmsp)
+}
+
+var _ fuse.FileSystemInterface = (*filesystem)(nil)
+var _ fuse.FileSystemChflags = (*filesystem)(nil)
+var _ fuse.FileSystemSetcrtime = (*filesystem)(nil)
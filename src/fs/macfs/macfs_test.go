@@ -0,0 +1,174 @@
+/*
+ * macfs_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package macfs
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/unionfs/memfs"
+)
+
+// testfs records the paths that reach the underlying file system.
+type testfs struct {
+	fuse.FileSystemInterface
+	paths []string
+}
+
+func (fs *testfs) Mknod(path string, mode uint32, dev uint64) int {
+	fs.paths = append(fs.paths, path)
+	return fs.FileSystemInterface.Mknod(path, mode, dev)
+}
+
+func (fs *testfs) Open(path string, flags int) (int, uint64) {
+	fs.paths = append(fs.paths, path)
+	return fs.FileSystemInterface.Open(path, flags)
+}
+
+func (fs *testfs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
+	fs.paths = append(fs.paths, path)
+	return fs.FileSystemInterface.Getattr(path, stat, fh)
+}
+
+func newTestfs(t *testing.T) *testfs {
+	fs := &testfs{FileSystemInterface: memfs.New()}
+	fs.Mkdir("/d", 0777)
+	fs.Mknod("/d/file", fuse.S_IFREG|0644, 0)
+	fs.Mknod("/d/.DS_Store", fuse.S_IFREG|0644, 0)
+	fs.paths = nil
+	return fs
+}
+
+func readdir(fs fuse.FileSystemInterface, path string) string {
+	var names []string
+	errc, fh := fs.Opendir(path)
+	if 0 != errc {
+		return fuse.Error(errc).Error()
+	}
+	fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			names = append(names, name)
+		}
+		return true
+	}, 0, fh)
+	fs.Releasedir(path, fh)
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestDeny(t *testing.T) {
+	under := newTestfs(t)
+	fs := New(Config{Fs: under, Mode: Deny})
+
+	var stat fuse.Stat_t
+	for _, path := range []string{"/d/.DS_Store", "/d/._file", "/.Spotlight-V100/Store-V2",
+		"/d/.Trashes"} {
+		if errc := fs.Getattr(path, &stat, ^uint64(0)); -fuse.ENOENT != errc {
+			t.Error(path, errc)
+		}
+	}
+	if errc, _ := fs.Create("/d/._file", fuse.O_CREAT|fuse.O_RDWR, 0644); -fuse.EACCES != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Mkdir("/.Trashes", 0777); -fuse.EACCES != errc {
+		t.Error(errc)
+	}
+	if errc, _ := fs.Open("/d/.DS_Store", fuse.O_RDONLY); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+
+	if errc := fs.Getattr("/.metadata_never_index", &stat, ^uint64(0)); 0 != errc ||
+		fuse.S_IFREG != stat.Mode&fuse.S_IFMT || 0 != stat.Size {
+		t.Error(errc, stat.Mode)
+	}
+	if errc := fs.Getattr("/d/file", &stat, ^uint64(0)); 0 != errc {
+		t.Error(errc)
+	}
+	if "file" != readdir(fs, "/d") {
+		t.Error(readdir(fs, "/d"))
+	}
+
+	if "/d/file" != strings.Join(under.paths, " ") {
+		t.Error(under.paths)
+	}
+}
+
+func TestScratch(t *testing.T) {
+	under := newTestfs(t)
+	fs := New(Config{Fs: under, Mode: Scratch})
+
+	errc, fh := fs.Create("/d/sub/._file", fuse.O_CREAT|fuse.O_RDWR, 0644)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	if n := fs.Write("/d/sub/._file", []byte("meta"), 0, fh); 4 != n {
+		t.Error(n)
+	}
+	fs.Release("/d/sub/._file", fh)
+
+	errc, fh = fs.Open("/d/sub/._file", fuse.O_RDONLY)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	buf := make([]byte, 16)
+	if n := fs.Read("/d/sub/._file", buf, 0, fh); "meta" != string(buf[:n]) {
+		t.Error(string(buf[:n]))
+	}
+	fs.Release("/d/sub/._file", fh)
+
+	// scratch files shadow metadata files of the underlying file system
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/d/.DS_Store", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Mknod("/d/.DS_Store", fuse.S_IFREG|0644, 0); 0 != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Mknod("/.metadata_never_index", fuse.S_IFREG|0644, 0); -fuse.EEXIST != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Rename("/d/._file", "/d/file2"); -fuse.EXDEV != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Rename("/d/file", "/d/._file2"); -fuse.EXDEV != errc {
+		t.Error(errc)
+	}
+	if errc := fs.Rename("/d/sub/._file", "/d/._file2"); 0 != errc {
+		t.Error(errc)
+	}
+
+	if "file" != readdir(fs, "/d") {
+		t.Error(readdir(fs, "/d"))
+	}
+	for _, path := range under.paths {
+		if ismeta(path) {
+			t.Error(path)
+		}
+	}
+}
+
+func TestIsMetaName(t *testing.T) {
+	for _, name := range []string{".DS_Store", "._README.md", ".Trashes", "Icon\r"} {
+		if !IsMetaName(name) {
+			t.Error(name)
+		}
+	}
+	for _, name := range []string{"DS_Store", ".git", "_file", ".metadata_never_index", "Icon"} {
+		if IsMetaName(name) {
+			t.Error(name)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * move.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package overlayfs
+
+import (
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// A rename between the file systems of two different prefixes normally fails with EXDEV,
+// which most applications handle by copying. Some applications (e.g. file managers that
+// move files to a trash directory) do not; for the prefixes allowed by Config.CopyRename
+// such a rename is instead performed by copying the file or directory tree and then
+// removing the original. Unlike a real rename this is not atomic: if the copy fails it is
+// undone, but if the removal of the original fails, both copies remain.
+
+// Function move moves the file or directory tree at oldpath of srcfs to newpath of dstfs.
+func move(srcfs fuse.FileSystemInterface, oldpath string,
+	dstfs fuse.FileSystemInterface, newpath string) int {
+
+	var stat fuse.Stat_t
+	if errc := dstfs.Getattr(newpath, &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		if 0 == errc {
+			return -fuse.EEXIST
+		}
+		return errc
+	}
+
+	if errc := copytree(srcfs, oldpath, dstfs, newpath); 0 != errc {
+		removetree(dstfs, newpath)
+		return errc
+	}
+	return removetree(srcfs, oldpath)
+}
+
+// Function copytree copies the file or directory tree at oldpath of srcfs to newpath of
+// dstfs, which must not exist.
+func copytree(srcfs fuse.FileSystemInterface, oldpath string,
+	dstfs fuse.FileSystemInterface, newpath string) (errc int) {
+
+	var stat fuse.Stat_t
+	if errc = srcfs.Getattr(oldpath, &stat, ^uint64(0)); 0 != errc {
+		return
+	}
+
+	switch stat.Mode & fuse.S_IFMT {
+	case fuse.S_IFDIR:
+		if errc = dstfs.Mkdir(newpath, stat.Mode&07777|0700); 0 != errc {
+			return
+		}
+		var names []string
+		names, errc = readdirnames(srcfs, oldpath)
+		if 0 != errc {
+			return
+		}
+		for _, n := range names {
+			if errc = copytree(srcfs, oldpath+"/"+n, dstfs, newpath+"/"+n); 0 != errc {
+				return
+			}
+		}
+		dstfs.Chmod(newpath, stat.Mode&07777)
+	case fuse.S_IFLNK:
+		var target string
+		if errc, target = srcfs.Readlink(oldpath); 0 != errc {
+			return
+		}
+		return dstfs.Symlink(target, newpath)
+	case fuse.S_IFREG:
+		if errc = copyfile(srcfs, oldpath, dstfs, newpath, stat.Mode&07777); 0 != errc {
+			return
+		}
+	default:
+		if errc = dstfs.Mknod(newpath, stat.Mode&(fuse.S_IFMT|07777), stat.Rdev); 0 != errc {
+			return
+		}
+	}
+
+	dstfs.Utimens(newpath, []fuse.Timespec{stat.Atim, stat.Mtim})
+	return 0
+}
+
+// Function copyfile copies the content of the regular file at oldpath of srcfs to the
+// new file newpath of dstfs.
+func copyfile(srcfs fuse.FileSystemInterface, oldpath string,
+	dstfs fuse.FileSystemInterface, newpath string, mode uint32) (errc int) {
+
+	errc, srcfh := srcfs.Open(oldpath, fuse.O_RDONLY)
+	if 0 != errc {
+		return
+	}
+	defer srcfs.Release(oldpath, srcfh)
+
+	errc, dstfh := dstfs.Create(newpath, fuse.O_CREAT|fuse.O_EXCL|fuse.O_WRONLY, mode)
+	if -fuse.ENOSYS == errc {
+		if errc = dstfs.Mknod(newpath, fuse.S_IFREG|mode, 0); 0 == errc {
+			errc, dstfh = dstfs.Open(newpath, fuse.O_WRONLY)
+		}
+	}
+	if 0 != errc {
+		return
+	}
+	defer dstfs.Release(newpath, dstfh)
+
+	buf := make([]byte, 64*1024)
+	for ofst := int64(0); ; {
+		n := srcfs.Read(oldpath, buf, ofst, srcfh)
+		if 0 > n {
+			return n
+		} else if 0 == n {
+			break
+		}
+		for i := 0; n > i; {
+			m := dstfs.Write(newpath, buf[i:n], ofst, dstfh)
+			if 0 > m {
+				return m
+			} else if 0 == m {
+				return -fuse.EIO
+			}
+			i += m
+			ofst += int64(m)
+		}
+	}
+
+	if errc = dstfs.Flush(newpath, dstfh); -fuse.ENOSYS == errc {
+		errc = 0
+	}
+	return
+}
+
+// Function removetree removes the file or directory tree at path.
+func removetree(fs fuse.FileSystemInterface, path string) (errc int) {
+	var stat fuse.Stat_t
+	if errc = fs.Getattr(path, &stat, ^uint64(0)); 0 != errc {
+		return
+	}
+	if fuse.S_IFDIR != stat.Mode&fuse.S_IFMT {
+		return fs.Unlink(path)
+	}
+
+	names, errc := readdirnames(fs, path)
+	if 0 != errc {
+		return
+	}
+	for _, n := range names {
+		if errc = removetree(fs, path+"/"+n); 0 != errc {
+			return
+		}
+	}
+	return fs.Rmdir(path)
+}
+
+// Function readdirnames returns the names of the entries of a directory other than . and
+// .. in the order in which the file system lists them.
+func readdirnames(fs fuse.FileSystemInterface, path string) (names []string, errc int) {
+	errc, fh := fs.Opendir(path)
+	if 0 != errc {
+		return
+	}
+	defer fs.Releasedir(path, fh)
+	errc = fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			names = append(names, name)
+		}
+		return true
+	}, 0, fh)
+	return
+}
@@ -28,6 +28,7 @@ type filesystem struct {
 	newfs   func(prefix string) fuse.FileSystemInterface
 	caseins bool
 	ttl     time.Duration
+	cprn    func(oldprefix string, newprefix string) bool
 	fsmux   sync.Mutex
 	fsmap   map[string]*shardfs
 	nullfs  *shardfs
@@ -46,6 +47,10 @@ type Config struct {
 	Newfs      func(prefix string) fuse.FileSystemInterface
 	Caseins    bool
 	TimeToLive time.Duration
+
+	// CopyRename reports whether a rename between the file systems of two different
+	// prefixes is performed by copying (see move.go); otherwise it fails with EXDEV.
+	CopyRename func(oldprefix string, newprefix string) bool
 }
 
 func New(c Config) fuse.FileSystemInterface {
@@ -55,6 +60,7 @@ func New(c Config) fuse.FileSystemInterface {
 		newfs:   c.Newfs,
 		caseins: c.Caseins,
 		ttl:     c.TimeToLive,
+		cprn:    c.CopyRename,
 		fsmap:   make(map[string]*shardfs),
 		nullfs:  &shardfs{FileSystemInterface: nullfs.New(), rc: -1},
 	}
@@ -198,16 +204,19 @@ func (fs *filesystem) Readlink(path string) (errc int, target string) {
 
 func (fs *filesystem) Rename(oldpath string, newpath string) (errc int) {
 	oldprefix, _ := fs.split(oldpath)
-	newprefix, newpath := fs.split(newpath)
-	if fs.caseins {
-		if strings.ToUpper(oldprefix) != strings.ToUpper(newprefix) {
-			return -fuse.EXDEV
-		}
-	} else {
-		if oldprefix != newprefix {
+	newprefix, _ := fs.split(newpath)
+	if (fs.caseins && strings.ToUpper(oldprefix) != strings.ToUpper(newprefix)) ||
+		(!fs.caseins && oldprefix != newprefix) {
+		if nil == fs.cprn || !fs.cprn(oldprefix, newprefix) {
 			return -fuse.EXDEV
 		}
+		srcfs, oldpath := fs.acquirefs(oldpath, +1)
+		defer fs.releasefs(srcfs, -1, nil)
+		dstfs, newpath := fs.acquirefs(newpath, +1)
+		defer fs.releasefs(dstfs, -1, nil)
+		return move(srcfs, oldpath, dstfs, newpath)
 	}
+	_, newpath = fs.split(newpath)
 	dstfs, oldpath := fs.acquirefs(oldpath, +1)
 	defer fs.releasefs(dstfs, -1, nil)
 	return dstfs.Rename(oldpath, newpath)
@@ -261,6 +270,20 @@ func (fs *filesystem) Truncate(path string, size int64, fh uint64) (errc int) {
 	return dstfs.Truncate(path, size, fh)
 }
 
+// fallocate is implemented by file systems that can allocate space for an open file
+// (see Fallocate).
+type fallocate interface {
+	Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) int
+}
+
+func (fs *filesystem) Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) (errc int) {
+	dstfs, path := fs.acquirefs(path, 0)
+	if f, ok := dstfs.FileSystemInterface.(fallocate); ok {
+		return f.Fallocate(path, mode, ofst, length, fh)
+	}
+	return -fuse.ENOSYS
+}
+
 func (fs *filesystem) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	dstfs, path := fs.acquirefs(path, 0)
 	return dstfs.Read(path, buff, ofst, fh)
@@ -0,0 +1,35 @@
+// +build linux,cgo
+
+/*
+ * intr_linux.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package port
+
+/*
+#cgo CFLAGS: -DFUSE_USE_VERSION=28 -D_FILE_OFFSET_BITS=64 -I/usr/include/fuse
+#cgo LDFLAGS: -lfuse
+
+#include <fuse.h>
+*/
+import "C"
+
+// InterruptSupported reports whether Interrupted can detect interrupted requests.
+const InterruptSupported = true
+
+// Function Interrupted reports whether the FUSE request currently being
+// processed by the calling thread has been interrupted. It must be called
+// from the goroutine that is servicing the FUSE request and only works when
+// the file system is mounted with the "intr" option.
+func Interrupted() bool {
+	return 0 != C.fuse_interrupted()
+}
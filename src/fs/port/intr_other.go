@@ -0,0 +1,26 @@
+// +build !linux !cgo
+
+/*
+ * intr_other.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package port
+
+// InterruptSupported reports whether Interrupted can detect interrupted requests.
+const InterruptSupported = false
+
+// Function Interrupted reports whether the FUSE request currently being
+// processed by the calling thread has been interrupted. Interrupt
+// notifications are not available on this platform; it always returns false.
+func Interrupted() bool {
+	return false
+}
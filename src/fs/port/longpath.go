@@ -0,0 +1,40 @@
+/*
+ * longpath.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package port
+
+import (
+	"strings"
+)
+
+// Function longpath returns the extended-length form of an absolute Windows path (e.g.
+// \\?\C:\dir or \\?\UNC\server\share\dir), which is not subject to the MAX_PATH limit
+// of 260 characters. The Windows API does not normalize extended-length paths, so slashes
+// are converted to backslashes; the path must not contain "." or ".." components.
+// Relative paths and paths that are already extended-length or device paths are returned
+// unchanged.
+func longpath(path string) string {
+	isSlash := func(c byte) bool {
+		return '\\' == c || '/' == c
+	}
+	switch {
+	case 2 <= len(path) && isSlash(path[0]) && isSlash(path[1]):
+		if 4 <= len(path) && ('?' == path[2] || '.' == path[2]) && isSlash(path[3]) {
+			return path
+		}
+		return `\\?\UNC\` + strings.ReplaceAll(path[2:], "/", `\`)
+	case 3 <= len(path) && ':' == path[1] && 'z'-'a' >= path[0]|0x20-'a' && isSlash(path[2]):
+		return `\\?\` + strings.ReplaceAll(path, "/", `\`)
+	}
+	return path
+}
@@ -0,0 +1,43 @@
+/*
+ * longpath_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package port
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongpath(t *testing.T) {
+	long := strings.Repeat(`\0123456789`, 30)
+	E := []struct{ path, longpath string }{
+		{`C:\`, `\\?\C:\`},
+		{`c:\dir\file`, `\\?\c:\dir\file`},
+		{`C:/dir/file`, `\\?\C:\dir\file`},
+		{`C:` + long, `\\?\C:` + long},
+		{`\\server\share\dir`, `\\?\UNC\server\share\dir`},
+		{`//server/share/dir`, `\\?\UNC\server\share\dir`},
+		{`\\?\C:\dir`, `\\?\C:\dir`},
+		{`\\?\UNC\server\share`, `\\?\UNC\server\share`},
+		{`\\.\pipe\name`, `\\.\pipe\name`},
+		{`C:dir`, `C:dir`},
+		{`dir\file`, `dir\file`},
+		{`\dir\file`, `\dir\file`},
+		{``, ``},
+	}
+	for _, e := range E {
+		if p := longpath(e.path); e.longpath != p {
+			t.Errorf("longpath(%q) = %q", e.path, p)
+		}
+	}
+}
@@ -67,3 +67,7 @@ func copyFusestatFromGostat(dst *fuse.Stat_t, src *syscall.Stat_t) {
 	dst.Blocks = int64(src.Blocks)
 	dst.Birthtim.Sec, dst.Birthtim.Nsec = src.Birthtimespec.Sec, src.Birthtimespec.Nsec
 }
+
+func Fallocate(fh uint64, mode uint32, offset int64, length int64) (errc int) {
+	return -fuse.ENOSYS
+}
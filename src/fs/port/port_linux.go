@@ -66,3 +66,7 @@ func copyFusestatFromGostat(dst *fuse.Stat_t, src *syscall.Stat_t) {
 	dst.Blksize = int64(src.Blksize)
 	dst.Blocks = int64(src.Blocks)
 }
+
+func Fallocate(fh uint64, mode uint32, offset int64, length int64) (errc int) {
+	return Errno(syscall.Fallocate(int(fh), mode, offset, length))
+}
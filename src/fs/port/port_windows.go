@@ -497,6 +497,10 @@ func Fstat(fh uint64, stat *fuse.Stat_t) (errc int) {
 	return 0
 }
 
+func Fallocate(fh uint64, mode uint32, offset int64, length int64) (errc int) {
+	return -fuse.ENOSYS
+}
+
 func Truncate(path string, length int64) (errc int) {
 	errc, fh := open(path, 2 /*FILE_WRITE_DATA*/, syscall.OPEN_EXISTING, 0)
 	if 0 == errc {
@@ -769,16 +773,7 @@ func Errno(err error) int {
 }
 
 func mkwinpathslice(path string) []uint16 {
-	if 2 <= len(path) {
-		if '\\' == path[0] && '\\' == path[1] {
-			if !(4 <= len(path) && '\\' == path[3] && ('?' == path[2] || '.' == path[2])) {
-				path = `\\?\UNC\` + path
-			}
-		} else if ':' == path[1] && 'z'-'a' >= path[0]|0x20-'a' {
-			path = `\\?\` + path
-		}
-	}
-	return utf16.Encode([]rune(path + "\x00"))
+	return utf16.Encode([]rune(longpath(path) + "\x00"))
 }
 
 func mkwinpath(path string) *uint16 {
@@ -0,0 +1,32 @@
+/*
+ * reflink_linux.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package port
+
+import (
+	"os"
+	"syscall"
+)
+
+// ioctl that clones the content of one file into another (FICLONE)
+const ficlone = 0x40049409
+
+// Function Reflink makes dst a copy-on-write clone of src. It fails if the file system
+// does not support cloning or if the files are on different file systems.
+func Reflink(dst *os.File, src *os.File) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if 0 != e {
+		return e
+	}
+	return nil
+}
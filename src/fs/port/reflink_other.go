@@ -0,0 +1,27 @@
+// +build !linux
+
+/*
+ * reflink_other.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package port
+
+import (
+	"os"
+	"syscall"
+)
+
+// Function Reflink makes dst a copy-on-write clone of src. Cloning is not available on
+// this platform; it always fails.
+func Reflink(dst *os.File, src *os.File) error {
+	return syscall.ENOTSUP
+}
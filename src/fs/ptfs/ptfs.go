@@ -142,6 +142,10 @@ func (self *filesystem) Truncate(path string, size int64, fh uint64) (errc int)
 	return
 }
 
+func (self *filesystem) Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) (errc int) {
+	return port.Fallocate(fh, mode, ofst, length)
+}
+
 func (self *filesystem) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	return port.Pread(fh, buff, ofst)
 }
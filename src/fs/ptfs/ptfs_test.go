@@ -0,0 +1,131 @@
+/*
+ * ptfs_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package ptfs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+func TestLongPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "ptfs-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fs := New(root)
+
+	// a directory hierarchy whose paths exceed MAX_PATH (260 characters) on Windows
+	comp := "/" + strings.Repeat("d", 50)
+	dir := ""
+	for i := 0; 7 > i; i++ {
+		dir += comp
+		if errc := fs.Mkdir(dir, 0777); 0 != errc {
+			t.Fatal(errc, len(dir))
+		}
+	}
+	path := dir + "/" + strings.Repeat("f", 50)
+	if 300 > len(root)+len(path) {
+		t.Fatal(len(root) + len(path))
+	}
+
+	errc, fh := fs.Create(path, fuse.O_CREAT|fuse.O_RDWR, 0666)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	if n := fs.Write(path, []byte("hello"), 0, fh); 5 != n {
+		t.Error(n)
+	}
+	fs.Release(path, fh)
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr(path, &stat, ^uint64(0)); 0 != errc || 5 != stat.Size {
+		t.Error(errc, stat.Size)
+	}
+
+	errc, fh = fs.Opendir(dir)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	names := []string{}
+	fs.Readdir(dir, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			names = append(names, name)
+		}
+		return true
+	}, 0, fh)
+	fs.Releasedir(dir, fh)
+	if 1 != len(names) || strings.Repeat("f", 50) != names[0] {
+		t.Error(names)
+	}
+
+	newpath := dir + "/" + strings.Repeat("g", 50)
+	if errc := fs.Rename(path, newpath); 0 != errc {
+		t.Error(errc)
+	}
+	errc, fh = fs.Open(newpath, fuse.O_RDONLY)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	buf := make([]byte, 16)
+	if n := fs.Read(newpath, buf, 0, fh); 5 != n || "hello" != string(buf[:n]) {
+		t.Error(n)
+	}
+	fs.Release(newpath, fh)
+
+	if errc := fs.Unlink(newpath); 0 != errc {
+		t.Error(errc)
+	}
+	for ; "" != dir; dir = dir[:len(dir)-len(comp)] {
+		if errc := fs.Rmdir(dir); 0 != errc {
+			t.Fatal(errc, len(dir))
+		}
+	}
+}
+
+func TestFallocate(t *testing.T) {
+	root, err := ioutil.TempDir("", "ptfs-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fs := New(root).(interface {
+		fuse.FileSystemInterface
+		Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) int
+	})
+
+	errc, fh := fs.Create("/f", fuse.O_CREAT|fuse.O_RDWR, 0666)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	defer fs.Release("/f", fh)
+
+	errc = fs.Fallocate("/f", 0, 0, 4096, fh)
+	if -fuse.ENOSYS == errc || -fuse.EOPNOTSUPP == errc {
+		t.Skip(errc)
+	}
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/f", &stat, fh); 0 != errc || 4096 != stat.Size {
+		t.Error(errc, stat.Size)
+	}
+}
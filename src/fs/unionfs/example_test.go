@@ -0,0 +1,118 @@
+/*
+ * example_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package unionfs_test
+
+import (
+	"fmt"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/fs/unionfs/memfs"
+)
+
+// Function writeFile writes data at the beginning of a file, creating it if necessary.
+// (Memfs does not implement Create.)
+func writeFile(fs fuse.FileSystemInterface, path string, data string) {
+	fs.Mknod(path, fuse.S_IFREG|0644, 0)
+	errc, fh := fs.Open(path, fuse.O_RDWR)
+	if 0 != errc {
+		return
+	}
+	fs.Write(path, []byte(data), 0, fh)
+	fs.Release(path, fh)
+}
+
+// Function readFile returns the contents of a file or the error that reading it failed with.
+func readFile(fs fuse.FileSystemInterface, path string) string {
+	errc, fh := fs.Open(path, fuse.O_RDONLY)
+	if 0 != errc {
+		return fuse.Error(errc).Error()
+	}
+	defer fs.Release(path, fh)
+	buf := make([]byte, 1024)
+	n := fs.Read(path, buf, 0, fh)
+	if 0 > n {
+		return fuse.Error(n).Error()
+	}
+	return string(buf[:n])
+}
+
+// Overlay a writable file system over a read-only one.
+func Example() {
+	fuse.OptParse([]string{}, "")
+
+	lower := memfs.New()
+	lower.Mkdir("/dir", 0755)
+	writeFile(lower, "/dir/a", "lower a")
+	writeFile(lower, "/dir/b", "lower b")
+
+	upper := memfs.New()
+	unfs := unionfs.New(unionfs.Config{
+		Fslist: []fuse.FileSystemInterface{upper, lower},
+	})
+	unfs.Init()
+	defer unfs.Destroy()
+
+	// modify a file of the lower layer and remove another
+	writeFile(unfs, "/dir/a", "upper a")
+	unfs.Unlink("/dir/b")
+
+	fmt.Println(readFile(unfs, "/dir/a"))
+	fmt.Println(readFile(unfs, "/dir/b"))
+	fmt.Println(readFile(lower, "/dir/a"))
+	fmt.Println(readFile(lower, "/dir/b"))
+
+	// Output:
+	// upper a
+	// -fuse.ENOENT
+	// lower a
+	// lower b
+}
+
+// Store the path map in a separate file system, so that the upper layer only contains
+// the files of the union file system.
+func Example_pmfs() {
+	fuse.OptParse([]string{}, "")
+
+	lower := memfs.New()
+	writeFile(lower, "/a", "lower a")
+
+	upper := memfs.New()
+	meta := memfs.New()
+	unfs := unionfs.New(unionfs.Config{
+		Fslist: []fuse.FileSystemInterface{upper, lower},
+		Pmfs:   meta,
+	})
+	unfs.Init()
+	unfs.Unlink("/a")
+	unfs.Destroy()
+
+	var stat fuse.Stat_t
+	fmt.Println(0 == upper.Getattr("/.unionfs", &stat, ^uint64(0)))
+	fmt.Println(0 == meta.Getattr("/.unionfs", &stat, ^uint64(0)))
+
+	// reopen the union file system: the whiteout of /a is read from the path map
+	unfs = unionfs.New(unionfs.Config{
+		Fslist: []fuse.FileSystemInterface{upper, lower},
+		Pmfs:   meta,
+	})
+	unfs.Init()
+	defer unfs.Destroy()
+	fmt.Println(readFile(unfs, "/a"))
+
+	// Output:
+	// false
+	// true
+	// -fuse.ENOENT
+}
@@ -21,6 +21,7 @@ type Filer interface {
 type Filemap struct {
 	Filer
 	Caseins bool
+	Unorm   Unorm
 
 	openmap map[uint64]*fileitem
 	pathmap map[Pathkey]*fileitem
@@ -58,7 +59,7 @@ func (fm *Filemap) NewFile(path string, file interface{}, track bool) (fh uint64
 	fm.openmap[fh] = f
 
 	if track {
-		k := ComputePathkey(path, fm.Caseins)
+		k := ComputePathkeyUnorm(path, fm.Caseins, fm.Unorm)
 		l, ok := fm.pathmap[k]
 		if !ok {
 			l = &fileitem{}
@@ -86,7 +87,7 @@ func (fm *Filemap) DelFile(path string, fh uint64) {
 		delete(fm.openmap, fh)
 
 		if n != f {
-			k := ComputePathkey(path, fm.Caseins)
+			k := ComputePathkeyUnorm(path, fm.Caseins, fm.Unorm)
 			l, ok := fm.pathmap[k]
 			if ok && l.next == l {
 				delete(fm.pathmap, k)
@@ -112,7 +113,7 @@ func (fm *Filemap) GetFile(path string, fh uint64, okreset bool) (file interface
 }
 
 func (fm *Filemap) Remove(path string) {
-	k := ComputePathkey(path, fm.Caseins)
+	k := ComputePathkeyUnorm(path, fm.Caseins, fm.Unorm)
 	l, ok := fm.pathmap[k]
 	if ok {
 		for f := l.next; l != f; {
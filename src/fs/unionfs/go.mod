@@ -0,0 +1,9 @@
+module github.com/billziss-gh/hubfs/fs/unionfs
+
+go 1.14
+
+require (
+	github.com/billziss-gh/cgofuse v1.5.0
+	github.com/billziss-gh/golib v0.2.0
+	golang.org/x/text v0.3.2
+)
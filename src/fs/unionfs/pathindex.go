@@ -0,0 +1,89 @@
+/*
+ * pathindex.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package unionfs
+
+import (
+	pathutil "path"
+	"sync"
+)
+
+// Path keys are one-way hashes, so the path map cannot be enumerated by directory.
+// The path index maps the path key of a directory to the names of its children that
+// have persistent visibility information (whiteout, opaque, subtree). Names are added
+// as paths are set; entries read from the path map file are added as their paths
+// become known (see Pathmap.IndexPath).
+type pathindex struct {
+	lock    sync.Mutex
+	caseins bool
+	unorm   Unorm
+	dirs    map[Pathkey]map[string]string // dir key -> normalized name -> name
+}
+
+func newPathindex(caseins bool, unorm Unorm) *pathindex {
+	return &pathindex{
+		caseins: caseins,
+		unorm:   unorm,
+		dirs:    make(map[Pathkey]map[string]string),
+	}
+}
+
+func persistent(v uint8) bool {
+	switch v & _MASK {
+	case WHITEOUT, OPAQUE, SUBTREE:
+		return true
+	default:
+		return false
+	}
+}
+
+// Function update adds or removes path from the index depending on its visibility.
+func (x *pathindex) update(path string, v uint8) {
+	dir, name := pathutil.Split(path)
+	if "" == name {
+		return
+	}
+	dir = pathutil.Clean(dir)
+	k := ComputePathkeyUnorm(dir, x.caseins, x.unorm)
+	n := Foldpath(name, x.caseins, x.unorm)
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	names := x.dirs[k]
+	if persistent(v) {
+		if nil == names {
+			names = make(map[string]string)
+			x.dirs[k] = names
+		}
+		names[n] = name
+	} else if nil != names {
+		delete(names, n)
+		if 0 == len(names) {
+			delete(x.dirs, k)
+		}
+	}
+}
+
+// Function names returns the indexed child names of a directory.
+func (x *pathindex) names(dir string) []string {
+	k := ComputePathkeyUnorm(dir, x.caseins, x.unorm)
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	names := x.dirs[k]
+	res := make([]string, 0, len(names))
+	for _, name := range names {
+		res = append(res, name)
+	}
+	return res
+}
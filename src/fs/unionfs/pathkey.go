@@ -15,20 +15,124 @@ package unionfs
 
 import (
 	"crypto/sha256"
+	"encoding"
+	"errors"
 	"hash"
 	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
 const Pathkeylen = 16
 
 type Pathkey [Pathkeylen]uint8
 
-// Function ComputePathkey computes the path key for a path.
-func ComputePathkey(path string, caseins bool) (k Pathkey) {
+// Type Unorm is the Unicode normalization form under which paths are compared. Paths
+// that differ only in their normalization (e.g. a precomposed "\u00e9" and a decomposed
+// "e\u0301") compare equal unless Unorm is UnormNone.
+type Unorm uint8
+
+const (
+	UnormNone Unorm = iota // paths are compared byte by byte
+	UnormNFC               // paths are compared (and presented) in NFC form
+	UnormNFD               // paths are compared (and presented) in NFD form
+)
+
+// Function ParseUnorm returns the Unorm with the given name: "none", "nfc" or "nfd".
+// The empty name is UnormNone.
+func ParseUnorm(name string) (Unorm, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return UnormNone, nil
+	case "nfc":
+		return UnormNFC, nil
+	case "nfd":
+		return UnormNFD, nil
+	}
+	return UnormNone, errors.New("invalid unicode normalization: " + name)
+}
+
+// Function Normalize returns s in the normalization form u.
+func (u Unorm) Normalize(s string) string {
+	switch u {
+	case UnormNFC:
+		if !norm.NFC.IsNormalString(s) {
+			s = norm.NFC.String(s)
+		}
+	case UnormNFD:
+		if !norm.NFD.IsNormalString(s) {
+			s = norm.NFD.String(s)
+		}
+	}
+	return s
+}
+
+// Function Foldpath returns the form of a path that is used to compare it with other
+// paths. Case-insensitive paths are compared under Unicode full case folding, which does
+// not depend on the locale: "ß", "ẞ" and "SS" compare equal, whereas the Turkish dotless
+// "ı" and dotted "İ" compare equal to neither "i" nor "I". The path is normalized before
+// and after it is case folded, because case folding may produce sequences that are not
+// normalized.
+func Foldpath(path string, caseins bool, unorm Unorm) string {
+	path = unorm.Normalize(path)
 	if caseins {
-		path = strings.ToUpper(path)
+		path = unorm.Normalize(foldcase(path))
+	}
+	return path
+}
+
+// Function foldcase returns s under Unicode full case folding.
+func foldcase(s string) string {
+	for i := 0; len(s) > i; i++ {
+		if utf8.RuneSelf <= s[i] {
+			// a Caser may be stateful and cannot be shared
+			return cases.Fold().String(s)
+		}
 	}
-	sum := sha256.Sum256([]uint8(path))
+	return strings.ToLower(s)
+}
+
+// Function foldpathLegacy returns the form of a path that was used to compare it with
+// other paths prior to path map file version 3, which upper-cased case-insensitive paths.
+// It is only used to migrate the path keys of such files (see Pathmap.migrate).
+func foldpathLegacy(path string, caseins bool, unorm Unorm) string {
+	path = unorm.Normalize(path)
+	if caseins {
+		path = unorm.Normalize(strings.ToUpper(path))
+	}
+	return path
+}
+
+// Function ComputePathkey computes the path key for a path.
+func ComputePathkey(path string, caseins bool) (k Pathkey) {
+	return ComputePathkeyUnorm(path, caseins, UnormNone)
+}
+
+// Function ComputePathkeyUnorm computes the path key for a path under the Unicode
+// normalization form unorm.
+func ComputePathkeyUnorm(path string, caseins bool, unorm Unorm) (k Pathkey) {
+	sum := sha256.Sum256([]uint8(Foldpath(path, caseins, unorm)))
+	copy(k[1:], sum[:])
+	return
+}
+
+// Function ComputePathkeyCheck computes the path key for a path under the Unicode
+// normalization form unorm, as well as its check value. The check value is made of the
+// bits of the path hash that are not part of the path key; it is used to detect paths
+// whose path keys collide (see Pathmap.Verify).
+func ComputePathkeyCheck(path string, caseins bool, unorm Unorm) (k Pathkey, c Pathkey) {
+	sum := sha256.Sum256([]uint8(Foldpath(path, caseins, unorm)))
+	copy(k[1:], sum[:])
+	copy(c[1:], sum[Pathkeylen-1:])
+	return
+}
+
+// Function computeLegacyPathkey computes the path key for a path as it was computed
+// prior to path map file version 3.
+func computeLegacyPathkey(path string, caseins bool, unorm Unorm) (k Pathkey) {
+	sum := sha256.Sum256([]uint8(foldpathLegacy(path, caseins, unorm)))
 	copy(k[1:], sum[:])
 	return
 }
@@ -36,20 +140,56 @@ func ComputePathkey(path string, caseins bool) (k Pathkey) {
 type PathkeyHash struct {
 	hash.Hash
 	caseins bool
+	unorm   Unorm
+	legacy  bool // compute legacy path keys (see computeLegacyPathkey)
 }
 
 func NewPathkeyHash(caseins bool) PathkeyHash {
-	return PathkeyHash{sha256.New(), caseins}
+	return NewPathkeyHashUnorm(caseins, UnormNone)
 }
 
+func NewPathkeyHashUnorm(caseins bool, unorm Unorm) PathkeyHash {
+	return PathkeyHash{sha256.New(), caseins, unorm, false}
+}
+
+func newLegacyPathkeyHash(caseins bool, unorm Unorm) PathkeyHash {
+	return PathkeyHash{sha256.New(), caseins, unorm, true}
+}
+
+// Function Write adds a part of a path to the hash. Parts must be split at slashes,
+// so that they can be normalized independently.
 func (h PathkeyHash) Write(s string) {
-	if h.caseins {
-		s = strings.ToUpper(s)
+	if h.legacy {
+		h.Hash.Write([]uint8(foldpathLegacy(s, h.caseins, h.unorm)))
+		return
 	}
-	h.Hash.Write([]uint8(s))
+	h.Hash.Write([]uint8(Foldpath(s, h.caseins, h.unorm)))
 }
 
 func (h PathkeyHash) ComputePathkey() (k Pathkey) {
 	copy(k[1:], h.Hash.Sum(nil))
 	return
 }
+
+// Function ComputePathkeyCheck computes the path key and check value of the hashed path
+// (see ComputePathkeyCheck).
+func (h PathkeyHash) ComputePathkeyCheck() (k Pathkey, c Pathkey) {
+	sum := h.Hash.Sum(nil)
+	copy(k[1:], sum)
+	copy(c[1:], sum[Pathkeylen-1:])
+	return
+}
+
+// Function Clone returns a copy of the hash with the same state.
+func (h PathkeyHash) Clone() PathkeyHash {
+	state, err := h.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if nil != err {
+		panic(err)
+	}
+	c := PathkeyHash{sha256.New(), h.caseins, h.unorm, h.legacy}
+	err = c.Hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if nil != err {
+		panic(err)
+	}
+	return c
+}
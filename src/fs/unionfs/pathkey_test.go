@@ -38,3 +38,126 @@ func TestPathkeyCompute(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestPathkeyHashClone(t *testing.T) {
+	for _, caseins := range []bool{false, true} {
+		h := NewPathkeyHash(caseins)
+		h.Write("/a/Bb")
+
+		c := h.Clone()
+		c.Write("/ccc")
+		if ComputePathkey("/a/Bb/ccc", caseins) != c.ComputePathkey() {
+			t.Error()
+		}
+		if ComputePathkey("/a/Bb", caseins) != h.ComputePathkey() {
+			t.Error()
+		}
+	}
+}
+
+func TestPathkeyUnorm(t *testing.T) {
+	nfc, nfd := "/caf\u00e9/\u00c5", "/cafe\u0301/A\u030a"
+
+	if ComputePathkey(nfc, false) == ComputePathkey(nfd, false) {
+		t.Error()
+	}
+	for _, unorm := range []Unorm{UnormNFC, UnormNFD} {
+		if ComputePathkeyUnorm(nfc, false, unorm) != ComputePathkeyUnorm(nfd, false, unorm) {
+			t.Error(unorm)
+		}
+		if ComputePathkeyUnorm("/CAF\u00c9/\u00e5", true, unorm) !=
+			ComputePathkeyUnorm(nfd, true, unorm) {
+			t.Error(unorm)
+		}
+		if ComputePathkeyUnorm("/CAF\u00c9/\u00e5", false, unorm) ==
+			ComputePathkeyUnorm(nfd, false, unorm) {
+			t.Error(unorm)
+		}
+
+		h := NewPathkeyHashUnorm(false, unorm)
+		h.Write("/cafe\u0301")
+		c := h.Clone()
+		c.Write("/A\u030a")
+		if ComputePathkeyUnorm(nfc, false, unorm) != c.ComputePathkey() {
+			t.Error(unorm)
+		}
+	}
+
+	if ComputePathkeyUnorm(nfc, true, UnormNone) != ComputePathkey(nfc, true) {
+		t.Error()
+	}
+}
+
+func TestPathkeyCasefold(t *testing.T) {
+	equal := [][2]string{
+		{"/straße", "/STRASSE"},
+		{"/STRAẞE", "/strasse"},
+		{"/Σίσυφος", "/ΣΊΣΥΦΟΣ"},
+		{"/K", "/k"}, // KELVIN SIGN
+		{"/ﬁle", "/FILE"},
+		{"/Dir/File", "/dIR/fILE"},
+	}
+	for _, e := range equal {
+		if ComputePathkey(e[0], true) != ComputePathkey(e[1], true) {
+			t.Error(e)
+		}
+		if ComputePathkey(e[0], false) == ComputePathkey(e[1], false) {
+			t.Error(e)
+		}
+	}
+
+	distinct := [][2]string{
+		{"/ı", "/i"}, // LATIN SMALL LETTER DOTLESS I
+		{"/ı", "/I"},
+		{"/İ", "/i"}, // LATIN CAPITAL LETTER I WITH DOT ABOVE
+		{"/İ", "/I"},
+		{"/İ", "/ı"},
+	}
+	for _, d := range distinct {
+		if ComputePathkey(d[0], true) == ComputePathkey(d[1], true) {
+			t.Error(d)
+		}
+	}
+
+	for _, unorm := range []Unorm{UnormNFC, UnormNFD} {
+		if ComputePathkeyUnorm("/İ", true, unorm) != ComputePathkeyUnorm("/i̇", true, unorm) {
+			t.Error(unorm)
+		}
+		if ComputePathkeyUnorm("/CafÉ", true, unorm) != ComputePathkeyUnorm("/café", true, unorm) {
+			t.Error(unorm)
+		}
+	}
+
+	h := NewPathkeyHash(true)
+	h.Write("/")
+	h.Write("Straße")
+	h.Write("/")
+	h.Write("ΣΊΣΥΦΟΣ")
+	if ComputePathkey("/strasse/σίσυφοσ", true) != h.ComputePathkey() {
+		t.Error()
+	}
+}
+
+func TestPathkeyLegacy(t *testing.T) {
+	if computeLegacyPathkey("/Dir/File", true, UnormNone) !=
+		computeLegacyPathkey("/DIR/FILE", true, UnormNone) {
+		t.Error()
+	}
+	if computeLegacyPathkey("/Dir/File", true, UnormNone) == ComputePathkey("/Dir/File", true) {
+		t.Error()
+	}
+	if computeLegacyPathkey("/Dir/File", false, UnormNone) != ComputePathkey("/Dir/File", false) {
+		t.Error()
+	}
+	if computeLegacyPathkey("/123", true, UnormNone) != ComputePathkey("/123", true) {
+		t.Error()
+	}
+
+	h := newLegacyPathkeyHash(true, UnormNone)
+	h.Write("/Dir")
+	c := h.Clone()
+	c.Write("/File")
+	if computeLegacyPathkey("/DIR/FILE", true, UnormNone) != c.ComputePathkey() {
+		t.Error()
+	}
+}
@@ -15,9 +15,29 @@ package unionfs
 
 // PATH MAP FILE FORMAT
 //
-// A file is a list of transactions.
+// A file is an optional file header followed by a list of transactions, optionally preceded
+// by version markers.
 //
-//     file : transaction*
+//     file : fileheader? (version | transaction)*
+//
+// A file header is a 16 byte structure at the beginning of the file that contains the magic
+// "PMAP", the version of the writer of the file, the oldest version of a reader that can read
+// the file (compat) and the length of records. Readers refuse files whose compat version is
+// newer than the supported one or whose records have a different length; this allows future
+// format changes to be introduced without being misread by older readers. A file header is
+// written whenever a file is written from the beginning (see Upgrade). (Readers that predate
+// file headers skip them as trash.)
+//
+//     fileheader : 'P' 'M' 'A' 'P' version compat reclen byte[9]
+//
+// A version marker is a 16 byte structure that contains the character 'V' and the version
+// of the file format. Version 2 adds subtree whiteout records. Version 3 changes the path
+// keys of case-insensitive path maps from upper-cased to case folded paths (see Foldpath);
+// records that precede a version 3 marker are legacy records (see PATH KEY MIGRATION). A
+// file without a version marker is version 1. Files with a version that is newer than the
+// supported one are not opened. (Readers that predate version markers skip them as trash.)
+//
+//     version : 'V' number byte[14]
 //
 // A transaction is a list of chunks. A transaction is read into a temp path map. When all
 // transaction chunks have been read and the transaction has been verified as valid, the temp
@@ -60,6 +80,9 @@ package unionfs
 //
 // A record is a path key and is 16 bytes long. The first byte in the path key has the "dirty"
 // bit (bit with value 0x80) set, so that is can be recognized as the beginning of a record.
+// The remaining bits of the first byte contain the visibility of the path: opaque, whiteout,
+// subtree whiteout (version 2) or notexist (delete record). A verification record contains
+// the check value of the path key of the preceding record (see PATH KEY VERIFICATION).
 //
 //     record : byte[16]
 //
@@ -68,6 +91,50 @@ package unionfs
 // (bit with value 0x80) always set (1). Therefore it is easy to identify a header and the
 // beginning of a chunk when recovering from a failed transaction commit.
 
+// PATH MAP SHARDING
+//
+// The in-memory path map is split into shards by the first byte of the path key hash. Each
+// shard has its own lock, so that operations on different keys do not contend with each other.
+// Path map clients take the path map read lock for individual operations (Get/Set/etc.) and
+// the path map (exclusive) lock for compound updates that must be seen as atomic (e.g. the
+// updates of a rename). Write holds the read lock while it streams records to the file one
+// shard at a time, so that compound updates are either fully included in a transaction or not
+// at all, without copying the visibility map. The file format is unaffected by sharding.
+
+// PATH KEY VERIFICATION
+//
+// A path key is a 120-bit truncated hash of a path; two paths whose keys collide would
+// share visibility information, so that one could be hidden by a whiteout of the other.
+// When Verify is set, the path map keeps the check value of each key (the remaining bits
+// of the hash) and a key is claimed by the first path that is looked up or set with it.
+// A lookup of a different path with the same key is a collision: the collision is
+// reported (see Collide and Collisions) and the path is treated as if it had no
+// visibility information. A path that is set takes the key over from the other path.
+// Check values are written as verification records that follow the records of their
+// keys; readers that do not support verification records ignore them.
+
+// RECORD ORDER
+//
+// By default the records of a transaction are written in the order in which they are
+// found in the shards, which depends on Go map iteration and on the order in which keys
+// were dirtied: two path maps with identical contents are generally written differently.
+// When Sorted is set, the records of each transaction are instead collected from all
+// shards and written in key order (each verification record still follows the record
+// of its key), so that identical contents produce byte-identical files, e.g. for
+// deduplicating backups or comparing path map files. Readers do not depend on the order.
+
+// PATH KEY MIGRATION
+//
+// Path keys are one-way hashes, so the legacy keys of a case-insensitive path map file
+// cannot be converted to version 3 keys when the file is read. Instead the keys that are
+// read from legacy records are remembered and each is migrated when its path is first
+// looked up: its visibility information is moved to the version 3 key of the path. A key
+// that is looked up as a version 3 key is not a legacy key and is forgotten. A full
+// transaction that is written while legacy keys remain is preceded by a version 2 marker,
+// so that its keys are still treated as legacy keys when the file is read again. Legacy
+// keys whose paths are never looked up keep their (by then meaningless) records until the
+// file is written in full without legacy keys.
+
 import (
 	"bufio"
 	"bytes"
@@ -75,25 +142,52 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	pathutil "path"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 )
 
 type Pathmap struct {
-	sync.Mutex
+	ndirty  int64 // number of dirty entries; first for atomic alignment
+	nlegacy int64 // number of legacy keys; see PATH KEY MIGRATION
+	sync.RWMutex
 	Caseins  bool
-	vm       map[Pathkey]uint8        // visibility map
-	dl       []Pathkey                // dirty list
-	fs       fuse.FileSystemInterface // file system
-	path     string                   // path map file name
-	fh       uint64                   // path map file handle
-	ofs      int64                    // path map file offset
-	writemux sync.Mutex               // Write mutex
+	Unorm    Unorm
+	Verify   bool                        // detect path key collisions; see PATH KEY VERIFICATION
+	Sorted   bool                        // write records in key order; see RECORD ORDER
+	Collide  func(path string)           // called when a path key collision is detected
+	shards   [pathmapShards]pathmapShard // visibility map shards
+	fs       fuse.FileSystemInterface    // file system
+	path     string                      // path map file name
+	fh       uint64                      // path map file handle
+	ofs      int64                       // path map file offset
+	version  uint8                       // path map file version
+	hdrver   uint8                       // path map file header version; 0 if no header
+	dropped  []DroppedTransaction        // transactions dropped while reading
+	rotated  string                      // path that a corrupt path map file was rotated to
+	writemux sync.Mutex                  // Write mutex
+	index    *pathindex                  // optional directory index
+	dumpmux  sync.Mutex                  // dumpmap mutex
 	dumpmap  map[Pathkey]string
+	legacy   map[Pathkey]struct{} // legacy keys; protected by migmux
+	migmux   sync.Mutex           // serializes migrations with Write
+	collmux  sync.Mutex           // collided mutex
+	collided map[string]bool      // paths whose path keys collided; see collide
+}
+
+type pathmapShard struct {
+	sync.Mutex
+	vm map[Pathkey]uint8   // visibility map
+	dl []Pathkey           // dirty list; a key is in the list iff its _DIRT bit is set
+	ck map[Pathkey]Pathkey // check values; see PATH KEY VERIFICATION
 }
 
+// number of path map shards
+const pathmapShards = 32
+
 const (
 	_DIRT    = uint8(0x80)
 	_MASK    = uint8(0x7f)
@@ -101,64 +195,279 @@ const (
 	OPAQUE   = _MASK - 1
 	WHITEOUT = _MASK - 2
 	NOTEXIST = _MASK - 3
+	SUBTREE  = _MASK - 4 // whiteout of a path and all its descendants
+	_VERIFY  = _MASK - 5 // verification record (path map file only)
 	_MAXVIS  = OPAQUE
 	_MAXIDX  = NOTEXIST
 )
 
+// current path map file format version
+const pathmapVersion = 3
+
+// path map file format version that introduced case folded path keys
+const pathmapFoldVersion = 3
+
+// path map file header magic
+const pathmapMagic = "PMAP"
+
 const pathmapdbg = false
 
+// open path maps; see PathmapEntries
+var pathmaps = struct {
+	sync.Mutex
+	m map[*Pathmap]struct{}
+}{m: make(map[*Pathmap]struct{})}
+
+// Function PathmapEntries returns the number of in-memory entries of all open path maps.
+// It is intended for diagnostics.
+func PathmapEntries() (n int) {
+	pathmaps.Lock()
+	for pm := range pathmaps.m {
+		n += pm.len()
+	}
+	pathmaps.Unlock()
+	return
+}
+
 // Function OpenPathmap opens a path map file on a file system and
 // returns its in-memory representation.
 func OpenPathmap(fs fuse.FileSystemInterface, path string, caseins bool) (int, *Pathmap) {
 	pm := &Pathmap{
 		Caseins: caseins,
-		vm:      make(map[Pathkey]uint8),
 		fs:      fs,
 		path:    path,
 		fh:      ^uint64(0),
 	}
+	pm.reset()
 
 	if nil != pm.fs {
-		var errc int
-		errc, pm.fh = fs.Open(path, fuse.O_RDWR)
+		errc := pm.open()
 		if 0 != errc {
-			errc, pm.fh = fs.Create(path, fuse.O_CREAT|fuse.O_RDWR, 0600)
-			if -fuse.ENOSYS == errc {
-				errc = fs.Mknod(path, 0600, 0)
-				if 0 == errc {
-					errc, pm.fh = fs.Open(path, fuse.O_RDWR)
-				}
-			}
-			if 0 != errc {
-				return errc, nil
-			}
+			return errc, nil
 		}
 
 		n := pm.read()
 		if 0 > n {
 			return n, nil
 		}
+
+		if 0 != len(pm.dropped) {
+			n = pm.rotate()
+			if 0 > n {
+				return n, nil
+			}
+		}
 	}
 
+	pathmaps.Lock()
+	pathmaps.m[pm] = struct{}{}
+	pathmaps.Unlock()
+
 	return 0, pm
 }
 
+func (pm *Pathmap) open() (errc int) {
+	errc, pm.fh = pm.fs.Open(pm.path, fuse.O_RDWR)
+	if 0 != errc {
+		errc, pm.fh = pm.fs.Create(pm.path, fuse.O_CREAT|fuse.O_RDWR, 0600)
+		if -fuse.ENOSYS == errc {
+			errc = pm.fs.Mknod(pm.path, 0600, 0)
+			if 0 == errc {
+				errc, pm.fh = pm.fs.Open(pm.path, fuse.O_RDWR)
+			}
+		}
+	}
+	return
+}
+
+// DroppedTransaction describes a transaction in the path map file that was not applied
+// when the file was read.
+type DroppedTransaction struct {
+	Offset int64 // offset of the transaction in the path map file
+	Reason string
+}
+
+func (pm *Pathmap) drop(ofs int64, reason string) {
+	pm.dropped = append(pm.dropped, DroppedTransaction{ofs, reason})
+}
+
+// Function Dropped returns the transactions that were dropped when the path map file
+// was read. Offsets refer to the file that was rotated (see Rotated).
+func (pm *Pathmap) Dropped() []DroppedTransaction {
+	return pm.dropped
+}
+
+// Function Rotated returns the path that the path map file was moved to because it
+// contained dropped transactions, or "" if the file was not rotated.
+func (pm *Pathmap) Rotated() string {
+	return pm.rotated
+}
+
+// Function Version returns the version of the path map file.
+func (pm *Pathmap) Version() uint8 {
+	return pm.version
+}
+
+// Function Current reports whether the path map file has a file header that was written
+// by the current version. A path map file that is not current is rewritten by Upgrade.
+func (pm *Pathmap) Current() bool {
+	return pathmapVersion == pm.hdrver
+}
+
+// Function Legacy returns the number of legacy keys in the path map (see PATH KEY
+// MIGRATION).
+func (pm *Pathmap) Legacy() int {
+	return int(atomic.LoadInt64(&pm.nlegacy))
+}
+
+// Function Upgrade rewrites the path map file in full in the current file format. As with
+// a full Write, the path map is first appended to the file as a single transaction and
+// then written from the beginning of the file, so that it survives an interrupted upgrade.
+// Legacy keys remain legacy keys.
+func (pm *Pathmap) Upgrade() int {
+	if nil == pm.fs {
+		return -fuse.EPERM
+	}
+
+	pm.writemux.Lock()
+	defer pm.writemux.Unlock()
+
+	pm.RLock()
+	ofs := pm.ofs
+	pm.RUnlock()
+
+	if 0 != ofs {
+		n := pm.writeTransaction(false, ofs, true)
+		if 0 > n {
+			return n
+		}
+	}
+
+	return pm.writeTransaction(false, 0, true)
+}
+
+// Function rotate moves a path map file that contains dropped transactions to path.N
+// and writes the recovered path map to a new file. This preserves the original file for
+// inspection instead of silently continuing with a partially recovered one.
+func (pm *Pathmap) rotate() int {
+	var rotated string
+	var stat fuse.Stat_t
+	for i := 1; ; i++ {
+		rotated = fmt.Sprintf("%s.%d", pm.path, i)
+		errc := pm.fs.Getattr(rotated, &stat, ^uint64(0))
+		if -fuse.ENOENT == errc {
+			break
+		}
+		if 0 != errc {
+			return errc
+		}
+	}
+
+	pm.fs.Release(pm.path, pm.fh)
+	pm.fh = ^uint64(0)
+
+	errc := pm.fs.Rename(pm.path, rotated)
+	if 0 == errc {
+		pm.rotated = rotated
+	}
+
+	// if the rename failed, overwrite the original file with the recovered path map
+	e := pm.open()
+	if 0 != e {
+		return e
+	}
+
+	pm.ofs = 0
+	pm.version = 0
+	n := pm.writeTransaction(false, 0, true)
+	if 0 > n {
+		return n
+	}
+	if 0 != errc {
+		return errc
+	}
+
+	return 0
+}
+
 // Function Close closes a path map.
 func (pm *Pathmap) Close() {
+	pathmaps.Lock()
+	delete(pathmaps.m, pm)
+	pathmaps.Unlock()
+
 	if nil != pm.fs {
 		pm.fs.Release(pm.path, pm.fh)
 	}
 	*pm = Pathmap{}
 }
 
+func (pm *Pathmap) reset() {
+	for i := range pm.shards {
+		pm.shards[i].vm = make(map[Pathkey]uint8)
+		pm.shards[i].dl = nil
+		pm.shards[i].ck = make(map[Pathkey]Pathkey)
+	}
+	atomic.StoreInt64(&pm.ndirty, 0)
+}
+
+func (pm *Pathmap) shard(k Pathkey) *pathmapShard {
+	return &pm.shards[k[1]%pathmapShards]
+}
+
+// Function len returns the number of entries in the path map.
+func (pm *Pathmap) len() (n int) {
+	for i := range pm.shards {
+		s := &pm.shards[i]
+		s.Lock()
+		n += len(s.vm)
+		s.Unlock()
+	}
+	return
+}
+
+// Function entries returns a copy of all entries in the path map.
+func (pm *Pathmap) entries() map[Pathkey]uint8 {
+	vm := make(map[Pathkey]uint8)
+	for i := range pm.shards {
+		s := &pm.shards[i]
+		s.Lock()
+		for k, v := range s.vm {
+			vm[k] = v
+		}
+		s.Unlock()
+	}
+	return vm
+}
+
 // Function Get returns opaqueness and visibility information for a path.
 // Visibility can be one of: unknown, whiteout, notexist, 0, 1, 2, ...
 //
 // The path map lock is NOT taken; it is expected that the client will take
-// the lock appropriately when necessary.
+// the read lock (or the lock for compound updates) appropriately when necessary.
 func (pm *Pathmap) Get(path string) (isopq bool, v uint8) {
 	var ok bool
-	pkh := NewPathkeyHash(pm.Caseins)
+	pkh := NewPathkeyHashUnorm(pm.Caseins, pm.Unorm)
+
+	// compute the keys of the path prefixes, migrating legacy keys as necessary
+	var lkh PathkeyHash
+	legacy := 0 != atomic.LoadInt64(&pm.nlegacy)
+	if legacy {
+		lkh = newLegacyPathkeyHash(pm.Caseins, pm.Unorm)
+	}
+	write := func(s string) {
+		pkh.Write(s)
+		if legacy {
+			lkh.Write(s)
+		}
+	}
+	lookup := func(i int) (uint8, bool) {
+		k, c := pkh.ComputePathkeyCheck()
+		if legacy {
+			pm.migrate(path[:i], k, lkh.ComputePathkey())
+		}
+		return pm.lookup(path[:i], k, c)
+	}
 
 	for i, j := 0, 0; ; {
 		for j = i; len(path) > i && '/' == path[i]; i++ {
@@ -166,9 +475,12 @@ func (pm *Pathmap) Get(path string) (isopq bool, v uint8) {
 		if j == i {
 			break
 		}
-		pkh.Write(path[j:i])
+		write(path[j:i])
 		if j == 0 {
-			if v, ok = pm.vm[pkh.ComputePathkey()]; ok {
+			if v, ok = lookup(i); ok {
+				if SUBTREE == v&_MASK {
+					return isopq, WHITEOUT
+				}
 				isopq = isopq || OPAQUE == v&_MASK
 			}
 		}
@@ -177,8 +489,11 @@ func (pm *Pathmap) Get(path string) (isopq bool, v uint8) {
 		if j == i {
 			break
 		}
-		pkh.Write(path[j:i])
-		if v, ok = pm.vm[pkh.ComputePathkey()]; ok {
+		write(path[j:i])
+		if v, ok = lookup(i); ok {
+			if SUBTREE == v&_MASK {
+				return isopq, WHITEOUT
+			}
 			isopq = isopq || OPAQUE == v&_MASK
 		}
 	}
@@ -198,10 +513,10 @@ func (pm *Pathmap) Get(path string) (isopq bool, v uint8) {
 // Function TryGet returns existence and raw visibility information for a path.
 //
 // The path map lock is NOT taken; it is expected that the client will take
-// the lock appropriately when necessary.
+// the read lock (or the lock for compound updates) appropriately when necessary.
 func (pm *Pathmap) TryGet(path string) (v uint8, ok bool) {
-	k := ComputePathkey(path, pm.Caseins)
-	v, ok = pm.vm[k]
+	k, c := pm.key(path)
+	v, ok = pm.lookup(path, k, c)
 	v &= _MASK
 
 	return
@@ -211,10 +526,10 @@ func (pm *Pathmap) TryGet(path string) (v uint8, ok bool) {
 // (i.e. it has visibility information changes that have not been written).
 //
 // The path map lock is NOT taken; it is expected that the client will take
-// the lock appropriately when necessary.
+// the read lock (or the lock for compound updates) appropriately when necessary.
 func (pm *Pathmap) IsDirty(path string) (dirt bool) {
-	k := ComputePathkey(path, pm.Caseins)
-	v, ok := pm.vm[k]
+	k, c := pm.key(path)
+	v, ok := pm.lookup(path, k, c)
 	if ok {
 		dirt = 0 != v&_DIRT
 	}
@@ -224,71 +539,325 @@ func (pm *Pathmap) IsDirty(path string) (dirt bool) {
 
 // Function Set sets visibility information for path.
 // Visibility can be one of: opaque, whiteout, notexist, 0, 1, 2, ...
+// A subtree whiteout also purges the records of the descendants of path that are
+// known to the directory index, because the subtree whiteout hides them all.
 //
 // The path map lock is NOT taken; it is expected that the client will take
-// the lock appropriately when necessary.
+// the read lock (or the lock for compound updates) appropriately when necessary.
 func (pm *Pathmap) Set(path string, v uint8) {
 	if _MAXVIS < v {
 		panic("invalid value")
 	}
 
-	k := ComputePathkey(path, pm.Caseins)
-	u, ok := pm.vm[k]
+	if SUBTREE == v && nil != pm.index {
+		pm.purge(path)
+	}
+
+	k, c := pm.key(path)
+	if pathmapdbg {
+		pm.AddDumpPath(path)
+	}
+	if pm.Verify {
+		pm.claim(path, k, c, true)
+	}
+
+	s := pm.shard(k)
+	s.Lock()
+	u, ok := s.vm[k]
 	if !ok {
 		u = UNKNOWN
+	}
+	pm.set(s, k, u, v)
+	s.Unlock()
+
+	if nil != pm.index {
+		pm.index.update(path, v)
+	}
+}
+
+// PathVis contains visibility information for a path.
+type PathVis struct {
+	Path string
+	Vis  uint8
+}
 
+// Function SetBatch sets visibility information for multiple paths.
+// Updates are applied in order; each shard is locked once for all of its updates.
+//
+// The path map lock is NOT taken; it is expected that the client will take
+// the read lock (or the lock for compound updates) appropriately when necessary.
+func (pm *Pathmap) SetBatch(batch []PathVis) {
+	keys := make([]Pathkey, len(batch))
+	for i, pv := range batch {
+		if _MAXVIS < pv.Vis {
+			panic("invalid value")
+		}
+		var c Pathkey
+		keys[i], c = pm.key(pv.Path)
+		if pm.Verify {
+			pm.claim(pv.Path, keys[i], c, true)
+		}
 		if pathmapdbg {
-			if nil == pm.dumpmap {
-				pm.dumpmap = make(map[Pathkey]string)
-			}
-			pm.dumpmap[k] = path
+			pm.AddDumpPath(pv.Path)
+		}
+	}
+
+	pm.setKeys(keys, func(i int) uint8 {
+		return batch[i].Vis
+	})
+
+	if nil != pm.index {
+		for _, pv := range batch {
+			pm.index.update(pv.Path, pv.Vis)
+		}
+	}
+}
+
+// Function SetTree sets the same visibility information for multiple paths under a root
+// path. Paths are relative to the root and start with a slash (e.g. "/a/b" for root/a/b);
+// the empty path denotes the root itself. The root is hashed only once.
+//
+// The path map lock is NOT taken; it is expected that the client will take
+// the read lock (or the lock for compound updates) appropriately when necessary.
+func (pm *Pathmap) SetTree(root string, paths []string, v uint8) {
+	if _MAXVIS < v {
+		panic("invalid value")
+	}
+
+	pkh := NewPathkeyHashUnorm(pm.Caseins, pm.Unorm)
+	pkh.Write(root)
+
+	var lkh PathkeyHash
+	legacy := 0 != atomic.LoadInt64(&pm.nlegacy)
+	if legacy {
+		lkh = newLegacyPathkeyHash(pm.Caseins, pm.Unorm)
+		lkh.Write(root)
+	}
+
+	keys := make([]Pathkey, len(paths))
+	for i, path := range paths {
+		var c Pathkey
+		h := pkh.Clone()
+		h.Write(path)
+		keys[i], c = h.ComputePathkeyCheck()
+		if legacy {
+			l := lkh.Clone()
+			l.Write(path)
+			pm.migrate(root+path, keys[i], l.ComputePathkey())
 		}
+		if pm.Verify {
+			pm.claim(root+path, keys[i], c, true)
+		}
+		if pathmapdbg {
+			pm.AddDumpPath(root + path)
+		}
+	}
+
+	pm.setKeys(keys, func(i int) uint8 {
+		return v
+	})
+
+	if nil != pm.index {
+		for _, path := range paths {
+			pm.index.update(root+path, v)
+		}
+	}
+}
+
+func (pm *Pathmap) setKeys(keys []Pathkey, vis func(i int) uint8) {
+	// group updates by shard; order is preserved within a shard (and hence for a key)
+	var groups [pathmapShards][]int
+	for i, k := range keys {
+		g := k[1] % pathmapShards
+		groups[g] = append(groups[g], i)
 	}
 
-	pm.set(k, u, v)
+	for g, idxs := range groups {
+		if 0 == len(idxs) {
+			continue
+		}
+		s := &pm.shards[g]
+		s.Lock()
+		for _, i := range idxs {
+			k := keys[i]
+			u, ok := s.vm[k]
+			if !ok {
+				u = UNKNOWN
+			}
+			pm.set(s, k, u, vis(i))
+		}
+		s.Unlock()
+	}
 }
 
 // Function SetIf sets visibility information for a path only if some already exists.
 // Visibility can be one of: opaque, whiteout, notexist, 0, 1, 2, ...
 //
 // The path map lock is NOT taken; it is expected that the client will take
-// the lock appropriately when necessary.
+// the read lock (or the lock for compound updates) appropriately when necessary.
 func (pm *Pathmap) SetIf(path string, v uint8) {
 	if _MAXVIS < v {
 		panic("invalid value")
 	}
 
-	k := ComputePathkey(path, pm.Caseins)
-	u, ok := pm.vm[k]
-	if !ok {
+	k, c := pm.key(path)
+	if pm.Verify && !pm.claim(path, k, c, false) {
+		return
+	}
+
+	s := pm.shard(k)
+	s.Lock()
+	u, ok := s.vm[k]
+	if ok {
+		pm.set(s, k, u, v)
+	}
+	s.Unlock()
+
+	if ok && nil != pm.index {
+		pm.index.update(path, v)
+	}
+}
+
+// Function SetNew sets visibility information for a path only if none exists.
+// It reports whether the visibility information was set.
+//
+// The path map lock is NOT taken; it is expected that the client will take
+// the read lock (or the lock for compound updates) appropriately when necessary.
+func (pm *Pathmap) SetNew(path string, v uint8) (ok bool) {
+	if _MAXVIS < v {
+		panic("invalid value")
+	}
+
+	k, c := pm.key(path)
+	if pathmapdbg {
+		pm.AddDumpPath(path)
+	}
+	if pm.Verify {
+		pm.claim(path, k, c, true)
+	}
+
+	s := pm.shard(k)
+	s.Lock()
+	if _, found := s.vm[k]; !found {
+		pm.set(s, k, UNKNOWN, v)
+		ok = true
+	}
+	s.Unlock()
+
+	if ok && nil != pm.index {
+		pm.index.update(path, v)
+	}
+
+	return
+}
+
+// Function EnableIndex enables the directory index that is used by Children.
+// It must be called before the path map is used concurrently.
+func (pm *Pathmap) EnableIndex() {
+	if nil == pm.index {
+		pm.index = newPathindex(pm.Caseins, pm.Unorm)
+	}
+}
+
+// Function IndexPath adds a path to the directory index if it has persistent visibility
+// information. This is used for paths whose visibility information was read from the
+// path map file and whose names were not known until now.
+//
+// The path map lock is NOT taken; it is expected that the client will take
+// the read lock (or the lock for compound updates) appropriately when necessary.
+func (pm *Pathmap) IndexPath(path string) {
+	if nil == pm.index {
 		return
 	}
 
-	pm.set(k, u, v)
+	k, c := pm.key(path)
+	v, ok := pm.lookup(path, k, c)
+	if ok && persistent(v) {
+		pm.index.update(path, v)
+	}
+}
+
+// Function Children returns the children of a directory that have persistent visibility
+// information (whiteout, opaque, subtree) and are known to the directory index. The
+// returned visibility is raw (i.e. subtree whiteouts are reported as such). Children
+// returns nil if the directory index is not enabled.
+//
+// The path map lock is NOT taken; it is expected that the client will take
+// the read lock (or the lock for compound updates) appropriately when necessary.
+func (pm *Pathmap) Children(path string) (res []PathVis) {
+	if nil == pm.index {
+		return nil
+	}
+
+	names := pm.index.names(path)
+	sort.Strings(names)
+	res = make([]PathVis, 0, len(names))
+	for _, name := range names {
+		p := pathutil.Join(path, name)
+		k, c := pm.key(p)
+		v, ok := pm.lookup(p, k, c)
+		if ok && persistent(v) {
+			res = append(res, PathVis{p, v & _MASK})
+		}
+	}
+
+	return
+}
+
+// Function purge removes the records of the descendants of path that are known to the
+// directory index. Records that have already been written get a delete record on the
+// next write; all of them are dropped from memory by Purge.
+func (pm *Pathmap) purge(path string) {
+	for _, name := range pm.index.names(path) {
+		p := pathutil.Join(path, name)
+		pm.purge(p)
+
+		k, c := pm.key(p)
+		if pm.Verify && !pm.claim(p, k, c, false) {
+			continue
+		}
+
+		s := pm.shard(k)
+		s.Lock()
+		if u, ok := s.vm[k]; ok {
+			pm.set(s, k, u, NOTEXIST)
+		}
+		s.Unlock()
+
+		pm.index.update(p, NOTEXIST)
+	}
 }
 
-func (pm *Pathmap) set(k Pathkey, u uint8, v uint8) {
+func (pm *Pathmap) set(s *pathmapShard, k Pathkey, u uint8, v uint8) {
 	dirt := u & _DIRT
 	if 0 == dirt {
 		// Set _DIRT bit if visibility "kind" changes.
-		// Kind is one of: unknown/"index", opaque, whiteout, notexist
-		ukind := u & _MASK
-		vkind := v & _MASK
-		if _MAXIDX >= ukind {
-			ukind = UNKNOWN
-		}
-		if _MAXIDX >= vkind {
-			vkind = UNKNOWN
-		}
-		if ukind != vkind {
+		if viskind(u) != viskind(v) {
 			dirt = _DIRT
 		}
 	}
 
-	pm.vm[k] = dirt | v
+	s.vm[k] = dirt | v
 	if u&_DIRT != dirt {
-		pm.dl = append(pm.dl, k)
+		s.dl = append(s.dl, k)
+		atomic.AddInt64(&pm.ndirty, 1)
+	}
+}
+
+// Function viskind returns the visibility "kind", which is one of:
+// unknown/"index"/notexist, opaque, whiteout, subtree.
+func viskind(v uint8) uint8 {
+	v &= _MASK
+	if _MAXIDX >= v && SUBTREE != v {
+		v = UNKNOWN
 	}
+	return v
+}
+
+// Function Dirty returns the number of dirty entries
+// (i.e. entries that have visibility information changes that have not been written).
+func (pm *Pathmap) Dirty() int {
+	return int(atomic.LoadInt64(&pm.ndirty))
 }
 
 // Function read reads the path map file and applies all transactions in it.
@@ -310,14 +879,168 @@ func (pm *Pathmap) read() int {
 		}
 	}
 
+	if pathmapFoldVersion > pm.version {
+		pm.markLegacy()
+	}
+	for k := range pm.legacy {
+		if _, ok := pm.shard(k).vm[k]; !ok {
+			delete(pm.legacy, k)
+		}
+	}
+	atomic.StoreInt64(&pm.nlegacy, int64(len(pm.legacy)))
+
 	return 1
 }
 
+// Function markLegacy marks all keys in the path map as legacy keys. Only the keys of
+// case-insensitive path maps are affected by the version 3 change of path keys.
+//
+// The path map lock is NOT taken; this method is only used during path map
+// construction.
+func (pm *Pathmap) markLegacy() {
+	pm.legacy = nil
+	if !pm.Caseins {
+		return
+	}
+	pm.legacy = make(map[Pathkey]struct{})
+	for i := range pm.shards {
+		for k := range pm.shards[i].vm {
+			pm.legacy[k] = struct{}{}
+		}
+	}
+}
+
+// Function key computes the path key and check value for a path and migrates the
+// visibility information of the path from its legacy key (if any).
+func (pm *Pathmap) key(path string) (Pathkey, Pathkey) {
+	k, c := ComputePathkeyCheck(path, pm.Caseins, pm.Unorm)
+	if 0 != atomic.LoadInt64(&pm.nlegacy) {
+		pm.migrate(path, k, computeLegacyPathkey(path, pm.Caseins, pm.Unorm))
+	}
+	return k, c
+}
+
+// Function lookup returns the visibility information of a path with key k and check
+// value c. If Verify is set and the key belongs to a different path, the collision is
+// reported and the path has no visibility information. Otherwise the key is claimed for
+// the path, if it has not been already.
+func (pm *Pathmap) lookup(path string, k Pathkey, c Pathkey) (v uint8, ok bool) {
+	collision := false
+	s := pm.shard(k)
+	s.Lock()
+	v, ok = s.vm[k]
+	if ok && pm.Verify {
+		if d, found := s.ck[k]; !found {
+			s.ck[k] = c
+		} else if d != c {
+			collision, ok = true, false
+		}
+	}
+	s.Unlock()
+
+	if collision {
+		pm.collide(path)
+	}
+	return
+}
+
+// Function claim claims the key k with check value c for a path whose visibility
+// information is about to be set. If the key belongs to a different path, the collision
+// is reported and the key is claimed only if force is set. It reports whether the key
+// was claimed.
+func (pm *Pathmap) claim(path string, k Pathkey, c Pathkey, force bool) bool {
+	collision := false
+	s := pm.shard(k)
+	s.Lock()
+	_, ok := s.vm[k]
+	if d, found := s.ck[k]; ok && found && d != c {
+		collision = true
+	}
+	if !collision || force {
+		s.ck[k] = c
+	}
+	s.Unlock()
+
+	if collision {
+		pm.collide(path)
+	}
+	return !collision || force
+}
+
+// Function collide reports a path key collision for a path, once per path.
+func (pm *Pathmap) collide(path string) {
+	pm.collmux.Lock()
+	if nil == pm.collided {
+		pm.collided = make(map[string]bool)
+	}
+	report := !pm.collided[path]
+	pm.collided[path] = true
+	pm.collmux.Unlock()
+
+	if report && nil != pm.Collide {
+		pm.Collide(path)
+	}
+}
+
+// Function Collisions returns the paths for which path key collisions were detected.
+func (pm *Pathmap) Collisions() (res []string) {
+	pm.collmux.Lock()
+	for path := range pm.collided {
+		res = append(res, path)
+	}
+	pm.collmux.Unlock()
+	sort.Strings(res)
+	return
+}
+
+// Function migrate moves the visibility information of a path from its legacy key lk to
+// its key k. The legacy key is deleted from the path map file when the path map is next
+// written. Migrations are serialized with the streaming of records by Write, so that a
+// transaction never includes the deletion of a legacy key without the corresponding
+// insertion.
+func (pm *Pathmap) migrate(path string, k Pathkey, lk Pathkey) {
+	pm.migmux.Lock()
+	defer pm.migmux.Unlock()
+
+	_, found := pm.legacy[lk]
+	delete(pm.legacy, lk)
+	delete(pm.legacy, k) // k is not a legacy key
+	atomic.StoreInt64(&pm.nlegacy, int64(len(pm.legacy)))
+	if !found || k == lk {
+		return
+	}
+
+	s := pm.shard(lk)
+	s.Lock()
+	v, ok := s.vm[lk]
+	if ok {
+		pm.set(s, lk, v, NOTEXIST)
+	}
+	s.Unlock()
+	if !ok || !persistent(v) {
+		return
+	}
+
+	v &= _MASK
+	s = pm.shard(k)
+	s.Lock()
+	_, ok = s.vm[k]
+	if !ok {
+		pm.set(s, k, UNKNOWN, v)
+	}
+	s.Unlock()
+
+	if !ok && nil != pm.index {
+		pm.index.update(path, v)
+	}
+}
+
 // Function readTransaction reads a single transaction.
 // It returns a negative error code on error, 0 on EOF, 1 when transaction is found
 // (regardless if it was applied or not).
 func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 	tmp := make(map[Pathkey]uint8)
+	tck := make(map[Pathkey]Pathkey)
 	hsh := sha256.New()
 	ch1 := false
 	cmd := uint8(0)
@@ -325,23 +1048,32 @@ func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 	cnt := uint16(0)
 	equ := true
 
-	var k Pathkey
+	var k, prev Pathkey
 	var sum [12]uint8
+	var start int64
+
+	eof := func(n int) int {
+		if 0 == n && ch1 {
+			pm.drop(start, "incomplete transaction")
+		}
+		return n
+	}
 
 	for {
 		for {
 			n := _pathmapRead(rdr, k[:1])
 			if 0 >= n {
-				return n
+				return eof(n)
 			}
 			if ch1 && '1' == k[0] {
 				// found unexpected chunk 1; abort transaction
 				rdr.UnreadByte()
+				pm.drop(start, "interrupted transaction")
 				return 1
 			}
 			n = _pathmapRead(rdr, k[1:])
 			if 0 >= n {
-				return n
+				return eof(n)
 			}
 			pm.ofs += Pathkeylen
 
@@ -350,7 +1082,26 @@ func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 				if '1' == k[0] && ('P' == cmd || 'S' == cmd || 'A' == cmd) {
 					// found chunk 1; process it and expect chunk not-1
 					ch1 = true
+					start = pm.ofs - Pathkeylen
 					break
+				} else if isFileHeader(k) {
+					// found file header
+					if pathmapVersion < k[5] || Pathkeylen != k[6] {
+						return -fuse.EPROTO
+					}
+					pm.hdrver = k[4]
+					continue
+				} else if isVersionMarker(k) {
+					// found version marker
+					if pathmapVersion < k[1] {
+						return -fuse.EPROTO
+					}
+					if pathmapFoldVersion <= k[1] && pathmapFoldVersion > pm.version {
+						// keys read so far are legacy keys
+						pm.markLegacy()
+					}
+					pm.version = k[1]
+					continue
 				} else {
 					// found trash; loop until chunk 1
 					continue
@@ -361,6 +1112,7 @@ func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 					break
 				} else {
 					// found trash; abort transaction
+					pm.drop(start, "invalid chunk")
 					return 1
 				}
 			}
@@ -372,7 +1124,7 @@ func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 		for idx = 0; cnt > idx; idx++ {
 			n := _pathmapRead(rdr, k[:1])
 			if 0 >= n {
-				return n
+				return eof(n)
 			}
 			if 0 == k[0]&_DIRT {
 				rdr.UnreadByte()
@@ -380,14 +1132,20 @@ func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 			}
 			n = _pathmapRead(rdr, k[1:])
 			if 0 >= n {
-				return n
+				return eof(n)
 			}
 			pm.ofs += Pathkeylen
 
 			hsh.Write(k[:])
 			v := k[0] & _MASK // clear _DIRT bit used to ensure non-zero record
 			k[0] = 0
+			if _VERIFY == v {
+				// verification record: check value of the preceding record's key
+				tck[prev] = k
+				continue
+			}
 			tmp[k] = v
+			prev = k
 		}
 
 		equ = equ && (cnt == idx && bytes.Equal(sum[:], hsh.Sum(nil)[:len(sum)]))
@@ -395,18 +1153,27 @@ func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 		if 'S' == cmd || 'A' == cmd {
 			if equ {
 				if 'S' == cmd {
-					pm.vm = make(map[Pathkey]uint8)
+					pm.reset()
 				}
 				for k, v := range tmp {
+					s := pm.shard(k)
 					switch v {
-					case WHITEOUT, OPAQUE:
+					case WHITEOUT, OPAQUE, SUBTREE:
 						// insert record: add key to map
-						pm.vm[k] = v
+						s.vm[k] = v
+						if c, ok := tck[k]; ok {
+							s.ck[k] = c
+						} else {
+							delete(s.ck, k)
+						}
 					case NOTEXIST:
 						// delete record: delete key from map
-						delete(pm.vm, k)
+						delete(s.vm, k)
+						delete(s.ck, k)
 					}
 				}
+			} else {
+				pm.drop(start, "checksum mismatch")
 			}
 			return 1
 		}
@@ -415,7 +1182,7 @@ func (pm *Pathmap) readTransaction(rdr *bufio.Reader) int {
 
 // Function Write writes the path map to the associated file on the file system.
 //
-// The path map and write locks are taken. This ensures the following:
+// The path map read lock and the write lock are taken. This ensures the following:
 //
 // - If prior to using methods such as Get/Set/etc. a client is careful to take
 // the path map lock, then Write can be used safely in a concurrent manner.
@@ -428,11 +1195,11 @@ func (pm *Pathmap) Write(sync bool) int {
 	pm.writemux.Lock()
 	defer pm.writemux.Unlock()
 
-	pm.Lock()
+	pm.RLock()
 	ofs := pm.ofs
 	cnt := int(ofs / Pathkeylen)
-	full := 1024 < cnt && 2*len(pm.vm) < cnt
-	pm.Unlock()
+	full := 1024 < cnt && 2*pm.len() < cnt
+	pm.RUnlock()
 
 	if full {
 		n := pm.writeTransaction(false, ofs, sync)
@@ -446,48 +1213,114 @@ func (pm *Pathmap) Write(sync bool) int {
 	}
 }
 
-func (pm *Pathmap) writeBegin(incremental bool) (vm map[Pathkey]uint8) {
-	pm.Lock()
+// Function writeShards streams the records of each shard to fn, one shard at a time; if
+// Sorted is set it passes the records of all shards to fn at once in key order. It
+// returns the dirty keys of each shard that were written, so that they can be marked
+// dirty again if the transaction fails.
+func (pm *Pathmap) writeShards(incremental bool, dirty [][]Pathkey, fn func(rec []byte) int) int {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	pm.migmux.Lock()
+	defer pm.migmux.Unlock()
+
+	var rec []byte
+	for i := range pm.shards {
+		if !pm.Sorted {
+			rec = rec[:0]
+		}
+		rec, dirty[i] = pm.shards[i].records(incremental, pm.Verify, rec)
+		atomic.AddInt64(&pm.ndirty, -int64(len(dirty[i])))
+		if !pm.Sorted {
+			if n := fn(rec); 0 > n {
+				return n
+			}
+		}
+	}
+
+	if pm.Sorted {
+		return fn(sortRecords(rec))
+	}
 
-	if incremental {
-		vm = make(map[Pathkey]uint8, len(pm.dl))
+	return 0
+}
+
+// Function sortRecords returns the records in rec ordered by key. A verification record
+// is kept after the record that precedes it.
+func sortRecords(rec []byte) []byte {
+	var idx []int // offsets of the records other than verification records
+	for i := 0; len(rec) > i; i += Pathkeylen {
+		if _DIRT|_VERIFY != rec[i] {
+			idx = append(idx, i)
+		}
+	}
+
+	// the first byte of a record holds its visibility; it is not part of the key
+	sort.SliceStable(idx, func(i, j int) bool {
+		return 0 > bytes.Compare(rec[idx[i]+1:idx[i]+Pathkeylen], rec[idx[j]+1:idx[j]+Pathkeylen])
+	})
 
-		for _, k := range pm.dl {
-			v := pm.vm[k]
+	res := make([]byte, 0, len(rec))
+	for _, i := range idx {
+		res = append(res, rec[i:i+Pathkeylen]...)
+		if n := i + Pathkeylen; len(rec) > n && _DIRT|_VERIFY == rec[n] {
+			res = append(res, rec[n:n+Pathkeylen]...)
+		}
+	}
+	return res
+}
+
+// Function records appends the records of a shard to rec and clears the dirty state
+// of the shard. It returns the appended records and the keys that were dirty.
+func (s *pathmapShard) records(incremental bool, verify bool, rec []byte) ([]byte, []Pathkey) {
+	s.Lock()
+	defer s.Unlock()
+
+	add := func(k Pathkey, v uint8) {
+		c, ok := s.ck[k]
+		k[0] = _DIRT | v // set _DIRT to ensure non-zero record
+		rec = append(rec, k[:]...)
+		if verify && ok && NOTEXIST != v {
+			// verification record: check value of the preceding record's key
+			c[0] = _DIRT | _VERIFY
+			rec = append(rec, c[:]...)
+		}
+	}
+
+	if incremental {
+		for _, k := range s.dl {
+			v := s.vm[k]
 
 			switch v & _MASK {
-			case WHITEOUT, OPAQUE:
+			case WHITEOUT, OPAQUE, SUBTREE:
 				// insert record: add key to map
-				vm[k] = v
+				add(k, v&_MASK)
 			default:
 				// delete record: delete key from map
-				vm[k] = NOTEXIST
+				add(k, NOTEXIST)
 			}
 
-			pm.vm[k] = v & _MASK
+			s.vm[k] = v & _MASK
 		}
 	} else {
-		vm = make(map[Pathkey]uint8, len(pm.vm))
-
-		for k, v := range pm.vm {
+		for k, v := range s.vm {
 			switch v & _MASK {
-			case WHITEOUT, OPAQUE:
+			case WHITEOUT, OPAQUE, SUBTREE:
 				// insert record: add key to map
-				vm[k] = v
+				add(k, v&_MASK)
 			}
 
-			pm.vm[k] = v & _MASK
+			s.vm[k] = v & _MASK
 		}
 	}
 
-	pm.dl = nil
-
-	pm.Unlock()
+	dirty := s.dl
+	s.dl = nil
 
-	return
+	return rec, dirty
 }
 
-func (pm *Pathmap) writeEnd(n *int, ofs *int64, vm map[Pathkey]uint8) {
+func (pm *Pathmap) writeEnd(n *int, ofs *int64, dirty [][]Pathkey) {
 	if 0 < *n {
 		pm.Lock()
 
@@ -495,22 +1328,80 @@ func (pm *Pathmap) writeEnd(n *int, ofs *int64, vm map[Pathkey]uint8) {
 
 		pm.Unlock()
 	} else if 0 > *n {
-		pm.Lock()
-
-		for k, v := range vm {
-			if 0 == v&_DIRT {
-				continue
-			}
-			v = pm.vm[k]
-			if 0 != v&_DIRT {
-				continue
+		pm.RLock()
+
+		for i, keys := range dirty {
+			s := &pm.shards[i]
+			s.Lock()
+			for _, k := range keys {
+				v, ok := s.vm[k]
+				if !ok || 0 != v&_DIRT {
+					continue
+				}
+				s.vm[k] = _DIRT | v
+				s.dl = append(s.dl, k)
+				atomic.AddInt64(&pm.ndirty, 1)
 			}
-			pm.vm[k] = _DIRT | v
-			pm.dl = append(pm.dl, k)
+			s.Unlock()
 		}
 
-		pm.Unlock()
+		pm.RUnlock()
+	}
+}
+
+// Function writeVersion writes a version marker.
+func (pm *Pathmap) writeVersion(ofs *int64, version uint8) int {
+	var k Pathkey
+	k[0] = 'V'
+	k[1] = version
+
+	n := pm.fs.Write(pm.path, k[:], *ofs, pm.fh)
+	if 0 > n {
+		return n
 	}
+	if Pathkeylen != n {
+		return -fuse.EIO
+	}
+	*ofs += Pathkeylen
+	pm.version = version
+	return n
+}
+
+// Function writeFileHeader writes a file header. The compat version of the file is the
+// version of the version marker that follows the header.
+func (pm *Pathmap) writeFileHeader(ofs *int64, compat uint8) int {
+	var k Pathkey
+	copy(k[:], pathmapMagic)
+	k[4] = pathmapVersion
+	k[5] = compat
+	k[6] = Pathkeylen
+
+	n := pm.fs.Write(pm.path, k[:], *ofs, pm.fh)
+	if 0 > n {
+		return n
+	}
+	if Pathkeylen != n {
+		return -fuse.EIO
+	}
+	*ofs += Pathkeylen
+	pm.hdrver = pathmapVersion
+	return n
+}
+
+func isFileHeader(k Pathkey) bool {
+	return pathmapMagic == string(k[:len(pathmapMagic)])
+}
+
+func isVersionMarker(k Pathkey) bool {
+	if 'V' != k[0] || 0 == k[1] {
+		return false
+	}
+	for _, b := range k[2:] {
+		if 0 != b {
+			return false
+		}
+	}
+	return true
 }
 
 // Function writeTransaction writes a single transaction.
@@ -542,25 +1433,47 @@ func (pm *Pathmap) writeTransaction(incremental bool, ofs0 int64, sync bool) (n
 		return n
 	}
 
-	vm := pm.writeBegin(incremental)
-	defer pm.writeEnd(&n, &ofs, vm)
+	dirty := make([][]Pathkey, len(pm.shards))
+	defer pm.writeEnd(&n, &ofs, dirty)
 
-	for k, v := range vm {
-		if len(buf) <= ptr {
-			if n := write('P'); 0 > n {
-				return n
-			}
-
-			ptr = Pathkeylen
-			chi = uint8('0')
-			cnt = uint16(0)
+	version := uint8(pathmapVersion)
+	if !incremental && 0 != atomic.LoadInt64(&pm.nlegacy) {
+		// the transaction includes legacy keys; see PATH KEY MIGRATION
+		version = pathmapFoldVersion - 1
+	}
+	if 0 == ofs0 {
+		if n := pm.writeFileHeader(&ofs, version); 0 > n {
+			return n
 		}
+	}
+	if 0 == ofs0 || version != pm.version {
+		if n := pm.writeVersion(&ofs, version); 0 > n {
+			return n
+		}
+	}
 
-		k[0] = _DIRT | v // set _DIRT to ensure non-zero record
-		copy(buf[ptr:], k[:])
+	n = pm.writeShards(incremental, dirty, func(rec []byte) int {
+		for 0 < len(rec) {
+			if len(buf) <= ptr {
+				if n := write('P'); 0 > n {
+					return n
+				}
+
+				ptr = Pathkeylen
+				chi = uint8('0')
+				cnt = uint16(0)
+			}
+
+			m := copy(buf[ptr:], rec)
+			rec = rec[m:]
 
-		ptr += Pathkeylen
-		cnt++
+			ptr += m
+			cnt += uint16(m / Pathkeylen)
+		}
+		return 0
+	})
+	if 0 > n {
+		return n
 	}
 
 	if Pathkeylen < ptr {
@@ -619,38 +1532,50 @@ func (pm *Pathmap) Sync() int {
 //
 // - If prior to using methods such as Get/Set/etc. a client is careful to take
 // the path map lock, then Purge can be used safely in a concurrent manner.
+//
+// Only the read lock is taken; shards are purged one at a time.
 func (pm *Pathmap) Purge() {
-	pm.Lock()
+	pm.RLock()
 
-	for k, v := range pm.vm {
-		if 0 != v&_DIRT {
-			continue
-		}
+	for i := range pm.shards {
+		s := &pm.shards[i]
+		s.Lock()
+		for k, v := range s.vm {
+			if 0 != v&_DIRT {
+				continue
+			}
 
-		switch v {
-		case WHITEOUT, OPAQUE:
-			// keep record
-		default:
-			delete(pm.vm, k)
+			switch v {
+			case WHITEOUT, OPAQUE, SUBTREE:
+				// keep record
+			default:
+				delete(s.vm, k)
+				delete(s.ck, k)
+			}
 		}
+		s.Unlock()
 	}
 
-	pm.Unlock()
+	pm.RUnlock()
 }
 
 // Function AddDumpPath adds a "known" path for diagnostic purposes.
 func (pm *Pathmap) AddDumpPath(path string) {
-	k := ComputePathkey(path, pm.Caseins)
+	k := ComputePathkeyUnorm(path, pm.Caseins, pm.Unorm)
+	pm.dumpmux.Lock()
 	if nil == pm.dumpmap {
 		pm.dumpmap = make(map[Pathkey]string)
 	}
 	pm.dumpmap[k] = path
+	pm.dumpmux.Unlock()
 }
 
 // Function DumpMem dumps the in-memory path map for diagnostic purposes.
+// Dumps include the paths added by AddDumpPath.
 func (pm *Pathmap) DumpMem(dmp io.Writer) {
-	keys := make([]Pathkey, 0, len(pm.vm))
-	for k := range pm.vm {
+	vm := pm.entries()
+	keys := make([]Pathkey, 0, len(vm))
+	for k := range vm {
 		keys = append(keys, k)
 	}
 
@@ -659,11 +1584,12 @@ func (pm *Pathmap) DumpMem(dmp io.Writer) {
 	})
 
 	for _, k := range keys {
-		pm.dumpkv(k, pm.vm[k], dmp)
+		pm.dumpkv(k, vm[k], dmp)
 	}
 }
 
 // Function Dump dumps the path map file for diagnostic purposes.
+// Dumps include the paths added by AddDumpPath.
 func (pm *Pathmap) Dump(dmp io.Writer) int {
 	if nil == pm.fs {
 		return -fuse.EPERM
@@ -721,6 +1647,13 @@ func (pm *Pathmap) dumpTransaction(rdr *bufio.Reader, pofs *uint64, dmp io.Write
 					// found chunk 1; process it and expect chunk not-1
 					ch1 = true
 					break
+				} else if isFileHeader(k) {
+					fmt.Fprintf(dmp, "HEADER version=%v compat=%v reclen=%v (ofs=%08x)\n\n",
+						k[4], k[5], k[6], *pofs-Pathkeylen)
+					continue
+				} else if isVersionMarker(k) {
+					fmt.Fprintf(dmp, "VERSION %v (ofs=%08x)\n\n", k[1], *pofs-Pathkeylen)
+					continue
 				} else {
 					// found trash; loop until chunk 1
 					continue
@@ -808,8 +1741,12 @@ func (pm *Pathmap) dumpkv(k Pathkey, v uint8, dmp io.Writer) {
 		vstr = "opaque"
 	case WHITEOUT:
 		vstr = "whiteout"
+	case SUBTREE:
+		vstr = "subtree"
 	case NOTEXIST:
 		vstr = "notexist"
+	case _VERIFY:
+		vstr = "verify"
 	default:
 		vstr = fmt.Sprint(v & _MASK)
 	}
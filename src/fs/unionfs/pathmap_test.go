@@ -14,9 +14,14 @@
 package unionfs
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
 )
 
 func TestPathmapOpenClose(t *testing.T) {
@@ -100,6 +105,77 @@ func TestPathmapGetSet(t *testing.T) {
 	}
 }
 
+func TestPathmapSetNew(t *testing.T) {
+	ec, pm := OpenPathmap(nil, "", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	if !pm.SetNew("/a", 42) {
+		t.Error()
+	}
+	if pm.SetNew("/a", 43) {
+		t.Error()
+	}
+	_, v := pm.Get("/a")
+	if 42 != v {
+		t.Error()
+	}
+}
+
+func TestPathmapSetBatch(t *testing.T) {
+	ec, pm := OpenPathmap(nil, "", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	ec, pm2 := OpenPathmap(nil, "", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm2.Close()
+
+	batch := []PathVis{}
+	for i := 0; 1000 > i; i++ {
+		path := fmt.Sprintf("/a/%v", i)
+		v := uint8(i % 3)
+		pm.Set(path, v)
+		batch = append(batch, PathVis{path, v})
+	}
+	for i := 0; 1000 > i; i += 2 {
+		path := fmt.Sprintf("/a/%v", i)
+		pm.Set(path, WHITEOUT)
+		batch = append(batch, PathVis{path, WHITEOUT})
+	}
+	pm2.SetBatch(batch)
+
+	if !reflect.DeepEqual(pm.entries(), pm2.entries()) {
+		t.Error()
+	}
+	if pm.Dirty() != pm2.Dirty() {
+		t.Error()
+	}
+
+	rels := []string{""}
+	for i := 0; 1000 > i; i++ {
+		path := fmt.Sprintf("/a/%v", i)
+		pm.Set(path, NOTEXIST)
+		rels = append(rels, path[len("/a"):])
+	}
+	pm.Set("/a", NOTEXIST)
+	pm2.SetTree("/a", rels, NOTEXIST)
+
+	if !reflect.DeepEqual(pm.entries(), pm2.entries()) {
+		t.Error()
+	}
+	_, v := pm2.Get("/a/42")
+	if NOTEXIST != v {
+		t.Error()
+	}
+}
+
 func TestPathmapGetSetOpaque(t *testing.T) {
 	fs := newTestfs()
 
@@ -394,7 +470,7 @@ func TestPathmapWrite(t *testing.T) {
 			if 0 != ec {
 				t.Error()
 			}
-			if !reflect.DeepEqual(pm.vm, pm2.vm) {
+			if !reflect.DeepEqual(pm.entries(), pm2.entries()) {
 				t.Error()
 			}
 			pm2.Close()
@@ -420,7 +496,7 @@ func TestPathmapWrite(t *testing.T) {
 			if 0 != ec {
 				t.Error()
 			}
-			if len(pm2.vm) != N-i-1 {
+			if pm2.len() != N-i-1 {
 				t.Error()
 			}
 			pm2.Close()
@@ -446,7 +522,7 @@ func TestPathmapWrite(t *testing.T) {
 			if 0 != ec {
 				t.Error()
 			}
-			if len(pm2.vm) != i+1 {
+			if pm2.len() != i+1 {
 				t.Error()
 			}
 			pm2.Close()
@@ -457,7 +533,101 @@ func TestPathmapWrite(t *testing.T) {
 	if 0 != ec {
 		t.Error()
 	}
-	if !reflect.DeepEqual(pm.vm, pm2.vm) {
+	if !reflect.DeepEqual(pm.entries(), pm2.entries()) {
+		t.Error()
+	}
+	pm2.Close()
+}
+
+func TestPathmapDirty(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	for i := 0; 100 > i; i++ {
+		pm.Set("/a", WHITEOUT)
+		pm.Set("/a", OPAQUE)
+		pm.Set("/a", 1)
+	}
+	pm.Set("/b", 0)
+	if 1 != pm.Dirty() {
+		t.Error()
+	}
+
+	pm.Set("/b", WHITEOUT)
+	if 2 != pm.Dirty() {
+		t.Error()
+	}
+
+	n := pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+	if 0 != pm.Dirty() {
+		t.Error()
+	}
+}
+
+type failWritefs struct {
+	fuse.FileSystemInterface
+	fail bool
+}
+
+func (fs *failWritefs) Write(path string, buff []byte, ofst int64, fh uint64) int {
+	if fs.fail {
+		return -fuse.EIO
+	}
+	return fs.FileSystemInterface.Write(path, buff, ofst, fh)
+}
+
+func TestPathmapWriteFailure(t *testing.T) {
+	fs := &failWritefs{FileSystemInterface: newTestfs()}
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	N := 5000
+
+	for i := 0; N > i; i++ {
+		pm.Set(fmt.Sprintf("/%v", i), WHITEOUT)
+	}
+
+	fs.fail = true
+	n := pm.Write(false)
+	if 0 <= n {
+		t.Error()
+	}
+	if N != pm.Dirty() {
+		t.Error()
+	}
+	for i := 0; N > i; i++ {
+		if !pm.IsDirty(fmt.Sprintf("/%v", i)) {
+			t.Error()
+			break
+		}
+	}
+
+	fs.fail = false
+	n = pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+	if pm.IsDirty("/0") || 0 != pm.Dirty() {
+		t.Error()
+	}
+
+	ec, pm2 := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	if N != pm2.len() || !reflect.DeepEqual(pm.entries(), pm2.entries()) {
 		t.Error()
 	}
 	pm2.Close()
@@ -509,7 +679,7 @@ func TestPathmapPurge(t *testing.T) {
 		t.Error()
 	}
 
-	if 1 != len(pm.vm) {
+	if 1 != pm.len() {
 		t.Error()
 	}
 
@@ -517,8 +687,652 @@ func TestPathmapPurge(t *testing.T) {
 	if 0 != ec {
 		t.Error()
 	}
-	if !reflect.DeepEqual(pm.vm, pm2.vm) {
+	if !reflect.DeepEqual(pm.entries(), pm2.entries()) {
 		t.Error()
 	}
 	pm2.Close()
 }
+
+func TestPathmapConcurrent(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	N := 8
+	M := 1000
+
+	var wg sync.WaitGroup
+	for g := 0; N > g; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; M > i; i++ {
+				path := fmt.Sprintf("/%v/%v", g, i)
+				pm.RLock()
+				pm.Set(path, OPAQUE)
+				isopq, v := pm.Get(path)
+				pm.RUnlock()
+				if true != isopq || 0 != v {
+					t.Error()
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; 10 > i; i++ {
+			if n := pm.Write(false); 0 > n {
+				t.Error()
+			}
+		}
+	}()
+	wg.Wait()
+
+	n := pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+	if N*M != pm.len() {
+		t.Error()
+	}
+
+	ec, pm2 := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	if !reflect.DeepEqual(pm.entries(), pm2.entries()) {
+		t.Error()
+	}
+	pm2.Close()
+}
+
+func BenchmarkPathmapGetParallel(b *testing.B) {
+	ec, pm := OpenPathmap(nil, "", false)
+	if 0 != ec {
+		b.Error()
+	}
+	defer pm.Close()
+
+	for i := 0; 100000 > i; i++ {
+		pm.Set(fmt.Sprintf("/%v/%v", i%100, i), uint8(i%10))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			pm.RLock()
+			pm.Get(fmt.Sprintf("/%v/%v", i%100, i%100000))
+			pm.RUnlock()
+			i++
+		}
+	})
+}
+
+func TestPathmapSubtree(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	pm.Set("/a/bb/ccc", WHITEOUT)
+	pm.Set("/a/bb/ddd", WHITEOUT)
+	n := pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+
+	pm.SetTree("/a/bb", []string{"/ccc", "/ddd"}, NOTEXIST)
+	pm.Set("/a/bb", SUBTREE)
+
+	isopq, v := pm.Get("/a/bb")
+	if false != isopq || WHITEOUT != v {
+		t.Error()
+	}
+	isopq, v = pm.Get("/a/bb/ccc")
+	if false != isopq || WHITEOUT != v {
+		t.Error()
+	}
+	isopq, v = pm.Get("/a/bb/eee/fff")
+	if false != isopq || WHITEOUT != v {
+		t.Error()
+	}
+	isopq, v = pm.Get("/a")
+	if false != isopq || UNKNOWN != v {
+		t.Error()
+	}
+
+	n = pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+
+	ec, pm2 := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	if 1 != pm2.len() {
+		t.Error()
+	}
+	if pathmapVersion != pm2.version {
+		t.Error()
+	}
+	isopq, v = pm2.Get("/a/bb/ddd")
+	if false != isopq || WHITEOUT != v {
+		t.Error()
+	}
+	pm2.Close()
+
+	pm.Set("/a/bb", OPAQUE)
+	isopq, v = pm.Get("/a/bb/ccc")
+	if true != isopq || NOTEXIST != v {
+		t.Error()
+	}
+}
+
+func TestPathmapVersion(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	pm.Set("/a", WHITEOUT)
+	n := pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+
+	var k Pathkey
+	k[0] = 'V'
+	k[1] = pathmapVersion + 1
+	fs.Write("/.pathmap$", k[:], pm.ofs, pm.fh)
+
+	ec, pm2 := OpenPathmap(fs, "/.pathmap$", false)
+	if -fuse.EPROTO != ec || nil != pm2 {
+		t.Error()
+	}
+}
+
+func TestPathmapHeader(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	pm.Set("/a", WHITEOUT)
+	n := pm.Write(false)
+	if 0 > n || !pm.Current() {
+		t.Error(n, pm.Current())
+	}
+	var h Pathkey
+	fs.Read("/.pathmap$", h[:], 0, pm.fh)
+	if !isFileHeader(h) || pathmapVersion != h[4] || pathmapVersion != h[5] || Pathkeylen != h[6] {
+		t.Error(h)
+	}
+	fh := pm.fh
+	pm.Close()
+
+	// files with a newer compat version or different record length are not opened
+	for _, i := range []int{5, 6} {
+		k := h
+		k[i]++
+		_, fh = fs.Open("/.pathmap$", fuse.O_RDWR)
+		fs.Write("/.pathmap$", k[:], 0, fh)
+		fs.Release("/.pathmap$", fh)
+		ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+		if -fuse.EPROTO != ec || nil != pm {
+			t.Error(i, ec)
+		}
+	}
+
+	// a file without a header is read and upgraded
+	var z Pathkey
+	_, fh = fs.Open("/.pathmap$", fuse.O_RDWR)
+	fs.Write("/.pathmap$", z[:], 0, fh)
+	fs.Release("/.pathmap$", fh)
+	ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	if pm.Current() || pathmapVersion != pm.Version() {
+		t.Error(pm.Current(), pm.Version())
+	}
+	if v, ok := pm.TryGet("/a"); !ok || WHITEOUT != v {
+		t.Error(v, ok)
+	}
+	n = pm.Upgrade()
+	if 0 > n || !pm.Current() {
+		t.Error(n, pm.Current())
+	}
+	pm.Close()
+
+	ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	if !pm.Current() || 0 != len(pm.Dropped()) {
+		t.Error(pm.Current(), pm.Dropped())
+	}
+	if v, ok := pm.TryGet("/a"); !ok || WHITEOUT != v {
+		t.Error(v, ok)
+	}
+	pm.Close()
+}
+
+func TestPathmapMigrate(t *testing.T) {
+	fs := newTestfs()
+
+	// write a path map file with legacy keys
+	ec, pm := OpenPathmap(fs, "/.pathmap$", true)
+	if 0 != ec {
+		t.Error()
+	}
+	for path, v := range map[string]uint8{
+		"/Dir/File": WHITEOUT,
+		"/Opq":      OPAQUE,
+		"/123":      WHITEOUT,
+		"/Gone":     WHITEOUT,
+	} {
+		k := computeLegacyPathkey(path, true, UnormNone)
+		pm.set(pm.shard(k), k, UNKNOWN, v)
+	}
+	atomic.StoreInt64(&pm.nlegacy, 4)
+	n := pm.writeTransaction(false, 0, false)
+	if 0 > n || pathmapFoldVersion-1 != pm.version {
+		t.Error(n, pm.version)
+	}
+	pm.Close()
+
+	ec, pm = OpenPathmap(fs, "/.pathmap$", true)
+	if 0 != ec {
+		t.Error()
+	}
+	if 4 != pm.nlegacy {
+		t.Error(pm.nlegacy)
+	}
+	isopq, v := pm.Get("/dir/FILE")
+	if false != isopq || WHITEOUT != v {
+		t.Error(isopq, v)
+	}
+	isopq, v = pm.Get("/opq/x")
+	if true != isopq || UNKNOWN != v {
+		t.Error(isopq, v)
+	}
+	if v, ok := pm.TryGet("/123"); !ok || WHITEOUT != v {
+		t.Error(v, ok)
+	}
+	if 1 != pm.nlegacy {
+		t.Error(pm.nlegacy)
+	}
+	n = pm.Write(false)
+	if 0 > n || pathmapVersion != pm.version {
+		t.Error(n, pm.version)
+	}
+	pm.Close()
+
+	// migrated keys are written; unmigrated legacy keys remain legacy keys
+	ec, pm = OpenPathmap(fs, "/.pathmap$", true)
+	if 0 != ec {
+		t.Error()
+	}
+	if 4 != pm.len() || 2 != pm.nlegacy {
+		t.Error(pm.len(), pm.nlegacy)
+	}
+	isopq, v = pm.Get("/DIR/file")
+	if false != isopq || WHITEOUT != v {
+		t.Error(isopq, v)
+	}
+	if v, ok := pm.TryGet("/GONE"); !ok || WHITEOUT != v {
+		t.Error(v, ok)
+	}
+	if 1 != pm.nlegacy {
+		t.Error(pm.nlegacy)
+	}
+
+	// a full transaction with legacy keys is written as a legacy transaction
+	pm.Set("/New", WHITEOUT)
+	n = pm.writeTransaction(false, 0, false)
+	if 0 > n || pathmapFoldVersion-1 != pm.version {
+		t.Error(n, pm.version)
+	}
+	pm.Close()
+
+	ec, pm = OpenPathmap(fs, "/.pathmap$", true)
+	if 0 != ec {
+		t.Error()
+	}
+	for _, path := range []string{"/dir/file", "/123", "/gone", "/new"} {
+		if _, v := pm.Get(path); WHITEOUT != v {
+			t.Error(path, v)
+		}
+	}
+	if isopq, _ := pm.Get("/OPQ/x"); !isopq {
+		t.Error()
+	}
+	if 0 != pm.nlegacy {
+		t.Error(pm.nlegacy)
+	}
+	pm.Close()
+
+	// keys of case-sensitive path maps are unaffected
+	ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	if 0 != pm.nlegacy {
+		t.Error(pm.nlegacy)
+	}
+	pm.Close()
+}
+
+func TestPathmapVerify(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	var collided []string
+	pm.Verify = true
+	pm.Collide = func(path string) {
+		collided = append(collided, path)
+	}
+	pm.Set("/a", WHITEOUT)
+	pm.Set("/b", WHITEOUT)
+	n := pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+	pm.Close()
+
+	// check values are read from verification records
+	ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	pm.Verify = true
+	pm.Collide = func(path string) {
+		collided = append(collided, path)
+	}
+	k, c := ComputePathkeyCheck("/a", false, UnormNone)
+	if d, ok := pm.shard(k).ck[k]; !ok || c != d {
+		t.Error(d, ok)
+	}
+
+	// simulate a collision of the key of /b with another path
+	k, c = ComputePathkeyCheck("/b", false, UnormNone)
+	c[1]++
+	pm.shard(k).ck[k] = c
+	isopq, v := pm.Get("/b")
+	if false != isopq || UNKNOWN != v {
+		t.Error(isopq, v)
+	}
+	if v, ok := pm.TryGet("/b"); ok {
+		t.Error(v, ok)
+	}
+	isopq, v = pm.Get("/a")
+	if false != isopq || WHITEOUT != v {
+		t.Error(isopq, v)
+	}
+	if !reflect.DeepEqual([]string{"/b"}, collided) {
+		t.Error(collided)
+	}
+	if !reflect.DeepEqual([]string{"/b"}, pm.Collisions()) {
+		t.Error(pm.Collisions())
+	}
+
+	// a conditional set does not take the key over; a set does
+	pm.SetIf("/b", NOTEXIST)
+	if v := pm.shard(k).vm[k]; WHITEOUT != v&_MASK {
+		t.Error(v)
+	}
+	pm.Set("/b", NOTEXIST)
+	isopq, v = pm.Get("/b")
+	if false != isopq || NOTEXIST != v {
+		t.Error(isopq, v)
+	}
+	if 1 != len(collided) {
+		t.Error(collided)
+	}
+	pm.Close()
+
+	// a path map file with verification records can be read without verification
+	ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	isopq, v = pm.Get("/b")
+	if false != isopq || WHITEOUT != v {
+		t.Error(isopq, v)
+	}
+	pm.Close()
+}
+
+func TestPathmapRotate(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+
+	pm.Set("/a", WHITEOUT)
+	n := pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+	ofs := pm.ofs
+	pm.Set("/b", WHITEOUT)
+	n = pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+	fs.Truncate("/.pathmap$", pm.ofs-Pathkeylen, pm.fh)
+	pm.Close()
+
+	ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	exp := []DroppedTransaction{{ofs, "incomplete transaction"}}
+	if !reflect.DeepEqual(exp, pm.Dropped()) {
+		t.Error(pm.Dropped())
+	}
+	if "/.pathmap$.1" != pm.Rotated() {
+		t.Error(pm.Rotated())
+	}
+	if _, v := pm.Get("/a"); WHITEOUT != v {
+		t.Error()
+	}
+	if _, v := pm.Get("/b"); UNKNOWN != v {
+		t.Error()
+	}
+	var stat fuse.Stat_t
+	if 0 != fs.Getattr("/.pathmap$.1", &stat, ^uint64(0)) || ofs+Pathkeylen > stat.Size {
+		t.Error()
+	}
+	pm.Close()
+
+	ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+	if 0 != ec {
+		t.Error()
+	}
+	if 0 != len(pm.Dropped()) || "" != pm.Rotated() {
+		t.Error()
+	}
+	if _, v := pm.Get("/a"); WHITEOUT != v {
+		t.Error()
+	}
+	pm.Close()
+}
+
+func TestPathmapChildren(t *testing.T) {
+	fs := newTestfs()
+
+	ec, pm := OpenPathmap(fs, "/.pathmap$", true)
+	if 0 != ec {
+		t.Error()
+	}
+	defer pm.Close()
+
+	if nil != pm.Children("/a") {
+		t.Error()
+	}
+
+	pm.EnableIndex()
+	pm.Set("/a/b", WHITEOUT)
+	pm.Set("/a/c", OPAQUE)
+	pm.Set("/a/d", 0)
+	pm.SetBatch([]PathVis{{"/a/e", WHITEOUT}, {"/a/E", WHITEOUT}})
+	pm.SetTree("/a/f", []string{"/g"}, WHITEOUT)
+	pm.Set("/a/f", SUBTREE)
+
+	res := pm.Children("/A")
+	exp := []PathVis{
+		{"/A/E", WHITEOUT},
+		{"/A/b", WHITEOUT},
+		{"/A/c", OPAQUE},
+		{"/A/f", SUBTREE},
+	}
+	if !reflect.DeepEqual(exp, res) {
+		t.Error(res)
+	}
+
+	pm.Set("/a/b", 0)
+	pm.Purge()
+	res = pm.Children("/a")
+	if 3 != len(res) || "/a/E" != res[0].Path {
+		t.Error(res)
+	}
+
+	n := pm.Write(false)
+	if 0 > n {
+		t.Error()
+	}
+
+	ec, pm2 := OpenPathmap(fs, "/.pathmap$", true)
+	if 0 != ec {
+		t.Error()
+	}
+	pm2.EnableIndex()
+	if 0 != len(pm2.Children("/a")) {
+		t.Error()
+	}
+	pm2.IndexPath("/a/c")
+	pm2.IndexPath("/a/d")
+	res = pm2.Children("/a")
+	if 1 != len(res) || "/a/c" != res[0].Path || OPAQUE != res[0].Vis {
+		t.Error(res)
+	}
+	pm2.Close()
+}
+
+func testPathmapContent(fs fuse.FileSystemInterface, path string) []byte {
+	var stat fuse.Stat_t
+	if 0 != fs.Getattr(path, &stat, ^uint64(0)) {
+		return nil
+	}
+	_, fh := fs.Open(path, fuse.O_RDONLY)
+	defer fs.Release(path, fh)
+	buf := make([]byte, stat.Size)
+	n := fs.Read(path, buf, 0, fh)
+	if 0 > n {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestPathmapSorted(t *testing.T) {
+	paths := make([]string, 0, 1000)
+	for i := 0; 1000 > i; i++ {
+		paths = append(paths, fmt.Sprintf("/d%d/f%d", i%7, i))
+	}
+	vis := []uint8{WHITEOUT, OPAQUE, SUBTREE}
+
+	write := func(verify bool, sorted bool, incremental bool, reverse bool) []byte {
+		fs := newTestfs()
+
+		ec, pm := OpenPathmap(fs, "/.pathmap$", false)
+		if 0 != ec {
+			t.Fatal()
+		}
+		pm.Verify = verify
+		pm.Sorted = sorted
+		for i := range paths {
+			j := i
+			if reverse {
+				j = len(paths) - 1 - i
+			}
+			pm.Set(paths[j], vis[j%len(vis)])
+		}
+		var n int
+		if incremental {
+			n = pm.Write(false)
+		} else {
+			n = pm.writeTransaction(false, 0, false)
+		}
+		if 0 > n {
+			t.Error(n)
+		}
+		pm.Close()
+
+		ec, pm = OpenPathmap(fs, "/.pathmap$", false)
+		if 0 != ec {
+			t.Fatal()
+		}
+		for j, p := range paths {
+			if v, ok := pm.TryGet(p); !ok || vis[j%len(vis)] != v {
+				t.Error(p, v, ok)
+				break
+			}
+		}
+		pm.Close()
+
+		return testPathmapContent(fs, "/.pathmap$")
+	}
+
+	for _, verify := range []bool{false, true} {
+		for _, incremental := range []bool{false, true} {
+			a := write(verify, true, incremental, false)
+			b := write(verify, true, incremental, true)
+			if 0 == len(a) || !bytes.Equal(a, b) {
+				t.Error(verify, incremental, len(a), len(b))
+			}
+
+			// file header, version marker and transaction header precede the records
+			var prev []byte
+			for i := 3 * Pathkeylen; len(a) > i; i += Pathkeylen {
+				if _DIRT|_VERIFY == a[i] {
+					if !verify || nil == prev {
+						t.Error(i)
+					}
+					continue
+				}
+				if nil != prev && 0 <= bytes.Compare(prev, a[i+1:i+Pathkeylen]) {
+					t.Error(i)
+					break
+				}
+				prev = a[i+1 : i+Pathkeylen]
+			}
+		}
+	}
+
+	// without Sorted the order of the records depends on the order in which they were set
+	a := write(false, false, true, false)
+	b := write(false, false, true, true)
+	if len(a) != len(b) || bytes.Equal(a, b) {
+		t.Error(len(a), len(b))
+	}
+}
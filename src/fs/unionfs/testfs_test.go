@@ -14,8 +14,10 @@
 package unionfs
 
 import (
+	"sync"
+
 	"github.com/billziss-gh/cgofuse/fuse"
-	"github.com/billziss-gh/hubfs/fs/memfs"
+	"github.com/billziss-gh/hubfs/fs/unionfs/memfs"
 )
 
 func newTestfs() fuse.FileSystemInterface {
@@ -23,3 +25,133 @@ func newTestfs() fuse.FileSystemInterface {
 
 	return memfs.New()
 }
+
+// Type testFaultfs is an in-memory file system that can be made to fail operations.
+// It can be used as any layer of a union file system (or to store the path map).
+type testFaultfs struct {
+	fuse.FileSystemInterface
+	mux    sync.Mutex
+	faults map[string]int // operation name -> error code returned by the operation
+	shortw bool           // writes transfer at most half of the requested bytes
+}
+
+func newTestFaultfs() *testFaultfs {
+	return &testFaultfs{
+		FileSystemInterface: newTestfs(),
+		faults:              map[string]int{},
+	}
+}
+
+// Function inject makes operation op fail with errc; an errc of 0 removes the fault.
+func (fs *testFaultfs) inject(op string, errc int) {
+	fs.mux.Lock()
+	if 0 == errc {
+		delete(fs.faults, op)
+	} else {
+		fs.faults[op] = errc
+	}
+	fs.mux.Unlock()
+}
+
+// Function shortWrites enables or disables short writes.
+func (fs *testFaultfs) shortWrites(enable bool) {
+	fs.mux.Lock()
+	fs.shortw = enable
+	fs.mux.Unlock()
+}
+
+func (fs *testFaultfs) fault(op string) int {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.faults[op]
+}
+
+func (fs *testFaultfs) Mknod(path string, mode uint32, dev uint64) int {
+	if errc := fs.fault("Mknod"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Mknod(path, mode, dev)
+}
+
+func (fs *testFaultfs) Mkdir(path string, mode uint32) int {
+	if errc := fs.fault("Mkdir"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Mkdir(path, mode)
+}
+
+func (fs *testFaultfs) Unlink(path string) int {
+	if errc := fs.fault("Unlink"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Unlink(path)
+}
+
+func (fs *testFaultfs) Rmdir(path string) int {
+	if errc := fs.fault("Rmdir"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Rmdir(path)
+}
+
+func (fs *testFaultfs) Rename(oldpath string, newpath string) int {
+	if errc := fs.fault("Rename"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Rename(oldpath, newpath)
+}
+
+func (fs *testFaultfs) Create(path string, flags int, mode uint32) (int, uint64) {
+	if errc := fs.fault("Create"); 0 != errc {
+		return errc, ^uint64(0)
+	}
+	return fs.FileSystemInterface.Create(path, flags, mode)
+}
+
+func (fs *testFaultfs) Open(path string, flags int) (int, uint64) {
+	if errc := fs.fault("Open"); 0 != errc {
+		return errc, ^uint64(0)
+	}
+	return fs.FileSystemInterface.Open(path, flags)
+}
+
+func (fs *testFaultfs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
+	if errc := fs.fault("Getattr"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Getattr(path, stat, fh)
+}
+
+func (fs *testFaultfs) Read(path string, buff []byte, ofst int64, fh uint64) int {
+	if errc := fs.fault("Read"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Read(path, buff, ofst, fh)
+}
+
+func (fs *testFaultfs) Write(path string, buff []byte, ofst int64, fh uint64) int {
+	if errc := fs.fault("Write"); 0 != errc {
+		return errc
+	}
+	fs.mux.Lock()
+	shortw := fs.shortw
+	fs.mux.Unlock()
+	if shortw && 1 < len(buff) {
+		buff = buff[:len(buff)/2]
+	}
+	return fs.FileSystemInterface.Write(path, buff, ofst, fh)
+}
+
+func (fs *testFaultfs) Flush(path string, fh uint64) int {
+	if errc := fs.fault("Flush"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Flush(path, fh)
+}
+
+func (fs *testFaultfs) Fsync(path string, datasync bool, fh uint64) int {
+	if errc := fs.fault("Fsync"); 0 != errc {
+		return errc
+	}
+	return fs.FileSystemInterface.Fsync(path, datasync, fh)
+}
@@ -11,14 +11,32 @@
  * Software Foundation.
  */
 
+// Package unionfs implements a union file system that overlays a list of cgofuse file
+// systems. The first file system in the list is the upper (writable) layer; the remaining
+// file systems are lower layers that are never modified. A path is looked up in each layer
+// in order and resolves to the first layer that has it. Files of lower layers are copied
+// up to the upper layer when they are modified; files that are removed are hidden by
+// whiteouts and directories that are recreated are made opaque.
+//
+// Visibility information (whiteouts, opaque directories and the layer that a path resolves
+// to) is kept in a path map (see Pathmap), which is stored in a file in the upper layer or
+// in a separate file system (see Config.Pmfs). Any layer may be any implementation of
+// fuse.FileSystemInterface; the union file system is itself a fuse.FileSystemInterface and
+// can be mounted with fuse.NewFileSystemHost or used as a layer of another file system.
+//
+// Files are copied up into a hidden staging directory of the upper layer and renamed into
+// place once they have been copied in full, so that a copy-up that is interrupted (e.g. by
+// a crash) never leaves a partial file that hides the file of the lower layer. Staged
+// files that are left over are removed when the file system is initialized.
 package unionfs
 
 import (
 	pathutil "path"
 	"runtime"
 	"sort"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/billziss-gh/cgofuse/fuse"
@@ -26,15 +44,25 @@ import (
 
 type filesystem struct {
 	fslist    []fuse.FileSystemInterface // file system list
+	pmfs      fuse.FileSystemInterface   // path map file system (nil: fslist[0])
 	pmpath    string                     // path map file path
+	cppath    string                     // copy-up staging directory path
 	pmsync    bool                       // perform path map file sync
 	lazytick  time.Duration              // lazy writevis tick
+	maxdirty  int                        // dirty path map entries that trigger writevis
+	visindex  bool                       // maintain path map directory index
+	pmverify  bool                       // detect path key collisions
+	pmsorted  bool                       // write path map records in key order
+	collide   func(path string)          // called when a path key collision is detected
+	intr      func() bool                // reports whether the current request was interrupted
+	nocopy    func(path string) bool     // reports whether a lower file must not be copied up
 	nsmux     sync.RWMutex               // namespace mutex
 	pathmap   *Pathmap                   // path map
 	filemux   sync.Mutex                 // open file mutex
 	filemap   *Filemap                   // open file map
 	lazystopC chan struct{}              // lazy writevis stop channel
 	lazystopW *sync.WaitGroup            // lazy writevis stop waitgroup
+	lazyflsC  chan struct{}              // lazy writevis flush channel
 
 	// lock hierarchy:
 	//     nsmux -> pathmap
@@ -46,16 +74,42 @@ type file struct {
 	v     uint8
 	fh    uint64
 	flags int
+	dirs  []dirent // directory snapshot used by Readdir
 }
 
-type Config struct {
-	Fslist   []fuse.FileSystemInterface
-	Pmname   string
-	Pmsync   bool
-	Lazytick time.Duration
-	Caseins  bool
-}
+// number of directory entries between checks for interrupted requests
+const readdirChunk = 1024
 
+// default number of dirty path map entries that trigger writevis
+const defaultMaxdirty = 64 * 1024
+
+// Type Config configures a union file system.
+type Config struct {
+	Fslist   []fuse.FileSystemInterface // layers; Fslist[0] is the upper (writable) layer
+	Pmfs     fuse.FileSystemInterface   // file system that stores the path map (default: Fslist[0])
+	Pmname   string                     // path map file name (default: .unionfs)
+	Pmsync   bool                       // sync the path map file and copied up files when written
+	Lazytick time.Duration              // interval of lazy path map writes (0: write on every change)
+	Maxdirty int                        // dirty path map entries that trigger a path map write
+	Visindex bool                       // maintain a directory index of the path map
+	Caseins  bool                       // paths are compared case-insensitively
+	Unorm    Unorm                      // Unicode normalization form under which paths are compared
+	Pmverify bool                       // detect path key collisions (see Pathmap.Verify)
+	Pmsorted bool                       // write path map records in key order (see Pathmap.Sorted)
+	Collide  func(path string)          // called when a path key collision is detected
+
+	// Interrupted reports whether the request being processed has been interrupted, so
+	// that long directory listings can be abandoned (e.g. port.Interrupted).
+	Interrupted func() bool
+
+	// Nocopy reports whether the file at path of a lower layer must not be copied up to
+	// the upper layer (e.g. because its content must not be stored there). Operations
+	// that would copy it up fail with EACCES.
+	Nocopy func(path string) bool
+}
+
+// Function New creates a union file system. The file system opens its path map and
+// initializes its layers when it is initialized (Init).
 func New(c Config) fuse.FileSystemInterface {
 	if 0 == len(c.Fslist) {
 		c.Fslist = []fuse.FileSystemInterface{&fuse.FileSystemBase{}}
@@ -66,19 +120,36 @@ func New(c Config) fuse.FileSystemInterface {
 
 	fs := &filesystem{}
 	fs.fslist = append(fs.fslist, c.Fslist...)
+	fs.pmfs = c.Pmfs
 	fs.pmpath = pathutil.Join("/", c.Pmname)
+	fs.cppath = fs.pmpath + ".copyup"
 	fs.pmsync = c.Pmsync
 	fs.lazytick = c.Lazytick
-	fs.pathmap = nil // OpenPathmap uses fslist[0]; delay initialization until Init time
+	fs.maxdirty = c.Maxdirty
+	fs.visindex = c.Visindex
+	fs.pmverify = c.Pmverify
+	fs.pmsorted = c.Pmsorted
+	fs.collide = c.Collide
+	fs.intr = c.Interrupted
+	fs.nocopy = c.Nocopy
+	if 0 == fs.maxdirty {
+		fs.maxdirty = defaultMaxdirty
+	}
+	fs.pathmap = nil // OpenPathmap uses pmfs or fslist[0]; delay initialization until Init time
 	fs.filemap = NewFilemap(fs, c.Caseins)
+	fs.filemap.Unorm = c.Unorm
 
 	return fs
 }
 
+func (fs *filesystem) interrupted() bool {
+	return nil != fs.intr && fs.intr()
+}
+
 func (fs *filesystem) getvis(path string, stat *fuse.Stat_t) (errc int, isopq bool, v uint8) {
-	fs.pathmap.Lock()
+	fs.pathmap.RLock()
 	isopq, v = fs.pathmap.Get(path)
-	fs.pathmap.Unlock()
+	fs.pathmap.RUnlock()
 
 	if "linux" == runtime.GOOS || "darwin" == runtime.GOOS {
 		/* Linux/macOS can send us invalid/long paths. Perform check here. */
@@ -108,20 +179,34 @@ func (fs *filesystem) getvis(path string, stat *fuse.Stat_t) (errc int, isopq bo
 			}
 		}
 
-		fs.pathmap.Lock()
+		fs.pathmap.RLock()
 		isopq, v = fs.pathmap.Get(path)
 		if UNKNOWN == v {
-			fs.pathmap.Set(path, u)
-			fs.pathmap.Unlock()
-			if NOTEXIST == u {
-				return -fuse.ENOENT, isopq, NOTEXIST
+			if fs.pathmap.SetNew(path, u) {
+				fs.pathmap.RUnlock()
+				if NOTEXIST == u {
+					return -fuse.ENOENT, isopq, NOTEXIST
+				}
+				if nil != stat {
+					*stat = s
+				}
+				return 0, isopq, u
 			}
+			// visibility was set concurrently
+			isopq, v = fs.pathmap.Get(path)
+		}
+		fs.pathmap.RUnlock()
+	}
+
+	if WHITEOUT == v {
+		var s fuse.Stat_t
+		if 0 == fs.fslist[0].Getattr(path, &s, ^uint64(0)) {
+			isopq, v = fs.revealvis(path, &s)
 			if nil != stat {
 				*stat = s
 			}
-			return 0, isopq, u
+			return 0, isopq, v
 		}
-		fs.pathmap.Unlock()
 	}
 
 	switch v {
@@ -141,23 +226,75 @@ func (fs *filesystem) getvis(path string, stat *fuse.Stat_t) (errc int, isopq bo
 	return
 }
 
+// Function revealvis replaces the whiteouts that hide an existing upper layer entry.
+// Entries are created in (or renamed into) the upper layer before their visibility is
+// set. If the path map was not written afterwards (e.g. because of a crash) the upper
+// layer entry would remain hidden; instead the upper layer entry takes precedence over
+// the whiteout. Whiteouts of parent directories become opaque directories.
+func (fs *filesystem) revealvis(path string, stat *fuse.Stat_t) (isopq bool, v uint8) {
+	fs.pathmap.RLock()
+	defer fs.pathmap.RUnlock()
+
+	pdirs := make([]string, 0, 8)
+	for p := pathutil.Dir(path); "/" != p; p = pathutil.Dir(p) {
+		pdirs = append(pdirs, p)
+	}
+	for i := len(pdirs) - 1; 0 <= i; i-- {
+		if u, ok := fs.pathmap.TryGet(pdirs[i]); ok && (WHITEOUT == u || SUBTREE == u) {
+			fs.pathmap.Set(pdirs[i], OPAQUE)
+		}
+	}
+
+	v = 0
+	if fuse.S_IFDIR == stat.Mode&fuse.S_IFMT {
+		v = OPAQUE
+	}
+	fs.pathmap.Set(path, v)
+
+	return fs.pathmap.Get(path)
+}
+
+// Function haslower determines if a path exists in a lower layer.
+func (fs *filesystem) haslower(path string) bool {
+	var s fuse.Stat_t
+	for _, fs := range fs.fslist[1:] {
+		if 0 == fs.Getattr(path, &s, ^uint64(0)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function previs sets and writes the visibility of a path ahead of an operation on
+// the upper layer. The path map is written only when writes are not lazy.
+func (fs *filesystem) previs(path string, v uint8) (errc int) {
+	fs.setvis(path, v)
+	if 0 == fs.lazytick && nil != fs.pathmap.fs {
+		if n := fs.writevis(); 0 > n {
+			fs.setvis(path, 0)
+			return n
+		}
+	}
+	return 0
+}
+
 func (fs *filesystem) hasvis(path string) (res bool) {
-	fs.pathmap.Lock()
+	fs.pathmap.RLock()
 	_, res = fs.pathmap.TryGet(path)
-	fs.pathmap.Unlock()
+	fs.pathmap.RUnlock()
 	return
 }
 
 func (fs *filesystem) setvis(path string, v uint8) {
-	fs.pathmap.Lock()
+	fs.pathmap.RLock()
 	fs.pathmap.Set(path, v)
-	fs.pathmap.Unlock()
+	fs.pathmap.RUnlock()
 }
 
 func (fs *filesystem) setvisif(path string, v uint8) {
-	fs.pathmap.Lock()
+	fs.pathmap.RLock()
 	fs.pathmap.SetIf(path, v)
-	fs.pathmap.Unlock()
+	fs.pathmap.RUnlock()
 }
 
 func (fs *filesystem) writevis() (errc int) {
@@ -165,12 +302,30 @@ func (fs *filesystem) writevis() (errc int) {
 }
 
 func (fs *filesystem) condwritevis(cond *bool) (errc int) {
-	if *cond && 0 == fs.lazytick {
-		errc = fs.writevis()
+	if *cond {
+		if 0 == fs.lazytick {
+			errc = fs.writevis()
+		} else {
+			fs.flushvis()
+		}
 	}
 	return
 }
 
+// Function flushvis triggers a lazy writevis when the path map has accumulated too
+// many dirty entries. Lazy writes otherwise only happen once per tick; this keeps the
+// dirty list bounded under heavy churn.
+func (fs *filesystem) flushvis() {
+	if 0 > fs.maxdirty || fs.maxdirty > fs.pathmap.Dirty() {
+		return
+	}
+
+	select {
+	case fs.lazyflsC <- struct{}{}:
+	default:
+	}
+}
+
 func (fs *filesystem) _lazyWritevis() {
 	defer fs.lazystopW.Done()
 	ticker := time.NewTicker(fs.lazytick)
@@ -178,6 +333,8 @@ func (fs *filesystem) _lazyWritevis() {
 		select {
 		case <-ticker.C:
 			fs.writevis()
+		case <-fs.lazyflsC:
+			fs.writevis()
 		case <-fs.lazystopC:
 			ticker.Stop()
 			return
@@ -185,21 +342,25 @@ func (fs *filesystem) _lazyWritevis() {
 	}
 }
 
-func (fs *filesystem) lsdir(path string,
-	isopq bool, v uint8, fh uint64,
-	fill func(name string, stat *fuse.Stat_t, ofst int64) bool) {
+type dirent struct {
+	name string
+	stat *fuse.Stat_t
+	v    uint8
+}
 
-	pmname := ""
-	if "/" == path {
-		pmname = pathutil.Base(fs.pmpath)
-	}
+// Function readdir reads the merged contents of a directory from all file systems.
+// If fh is not ^uint64(0) the directory is read from fslist[v] using fh and the
+// returned list starts with the dot dirs when fslist[v] reports them.
+//
+// Enumeration is abandoned with -fuse.EINTR if the FUSE request is interrupted.
+func (fs *filesystem) readdir(path string,
+	isopq bool, v uint8, fh uint64) (errc int, list []dirent) {
 
-	type dirent struct {
-		stat *fuse.Stat_t
-		v    uint8
-	}
+	cnt := 0
+	intr := false
 	dirmap := make(map[string]dirent)
 	dirfill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		name = fs.filemap.Unorm.Normalize(name)
 		if _, ok := dirmap[name]; ok {
 			return true
 		}
@@ -207,7 +368,12 @@ func (fs *filesystem) lsdir(path string,
 			s := *stat
 			stat = &s
 		}
-		dirmap[name] = dirent{stat, v}
+		dirmap[name] = dirent{name, stat, v}
+		cnt++
+		if 0 == cnt%readdirChunk && fs.interrupted() {
+			intr = true
+			return false
+		}
 		return true
 	}
 
@@ -220,54 +386,69 @@ func (fs *filesystem) lsdir(path string,
 	if isopq {
 		n = 1
 	}
-	for ; n > int(v); v++ {
+	for ; n > int(v) && !intr; v++ {
+		if fs.interrupted() {
+			intr = true
+			break
+		}
 		e, fh := fs.fslist[v].Opendir(path)
 		if 0 == e {
 			fs.fslist[v].Readdir(path, dirfill, 0, fh)
 			fs.fslist[v].Releasedir(path, fh)
 		}
 	}
+	if intr {
+		return -fuse.EINTR, nil
+	}
 
 	names := make([]string, 0, len(dirmap))
-	fs.pathmap.Lock()
+	fs.pathmap.RLock()
 	for name := range dirmap {
-		if "." == name || ".." == name || pmname == name {
+		if "." == name || ".." == name || ("/" == path && fs.ispmpath("/"+name)) {
 			continue
 		}
 		_, v = fs.pathmap.Get(pathutil.Join(path, name))
-		if WHITEOUT == v {
+		// upper layer entries take precedence over whiteouts (see revealvis)
+		if WHITEOUT == v && 0 != dirmap[name].v {
+			// make whiteouts read from the path map file known to the index
+			fs.pathmap.IndexPath(pathutil.Join(path, name))
 			continue
 		}
 		names = append(names, name)
 	}
-	fs.pathmap.Unlock()
+	fs.pathmap.RUnlock()
 	sort.Strings(names)
 
+	list = make([]dirent, 0, len(names)+2)
 	if ^uint64(0) != fh {
-		// Readdir: pass dot dirs and 0 offset as required by FUSE
 		if dot, ok := dirmap["."]; ok {
-			fill(".", dot.stat, 0)
-			fill("..", nil, 0)
-		}
-		for _, name := range names {
-			ent := dirmap[name]
-			if !fill(name, ent.stat, 0) {
-				break
-			}
+			list = append(list, dot, dirent{name: ".."})
 		}
-	} else {
-		// !Readdir: use offset parameter to pass visibility information
-		for _, name := range names {
-			ent := dirmap[name]
-			if !fill(name, ent.stat, int64(ent.v)) {
-				break
-			}
+	}
+	for _, name := range names {
+		list = append(list, dirmap[name])
+	}
+
+	return
+}
+
+func (fs *filesystem) lsdir(path string,
+	isopq bool, v uint8,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool) (errc int) {
+
+	// use offset parameter to pass visibility information
+	errc, list := fs.readdir(path, isopq, v, ^uint64(0))
+	for _, ent := range list {
+		if !fill(ent.name, ent.stat, int64(ent.v)) {
+			break
 		}
 	}
+
+	return
 }
 
 func (fs *filesystem) notempty(path string, isopq bool, v uint8) (res bool) {
-	fs.lsdir(path, isopq, v, ^uint64(0), func(name string, stat *fuse.Stat_t, ofst int64) bool {
+	fs.lsdir(path, isopq, v, func(name string, stat *fuse.Stat_t, ofst int64) bool {
 		res = true
 		return false
 	})
@@ -276,7 +457,7 @@ func (fs *filesystem) notempty(path string, isopq bool, v uint8) (res bool) {
 }
 
 func (fs *filesystem) readpath(path string, v uint8) string {
-	if !fs.filemap.Caseins {
+	if !fs.filemap.Caseins && UnormNone == fs.filemap.Unorm {
 		return path
 	}
 
@@ -286,7 +467,9 @@ func (fs *filesystem) readpath(path string, v uint8) string {
 	}
 
 	errc, p := rp.Readpath(path)
-	if 0 != errc || strings.ToUpper(p) != strings.ToUpper(path) {
+	if 0 != errc ||
+		Foldpath(p, fs.filemap.Caseins, fs.filemap.Unorm) !=
+			Foldpath(path, fs.filemap.Caseins, fs.filemap.Unorm) {
 		return path
 	}
 
@@ -433,9 +616,64 @@ func (fs *filesystem) cplink(path string, v uint8, stat *fuse.Stat_t) (errc int)
 	return
 }
 
+// Function cpnode copies up a special file (FIFO, socket or device). Only the node is
+// copied; special files have no content that can be read without side effects.
+func (fs *filesystem) cpnode(path string, v uint8, stat *fuse.Stat_t) (errc int) {
+	path = fs.readpath(path, v)
+
+	srcfs := fs.fslist[v]
+	dstfs := fs.fslist[0]
+
+	if nil == stat {
+		stat = &fuse.Stat_t{}
+		errc = srcfs.Getattr(path, stat, ^uint64(0))
+		if 0 != errc {
+			return
+		}
+	}
+
+	errc = fs.mkpdir(path)
+	if 0 != errc {
+		return
+	}
+
+	errc = dstfs.Mknod(path, stat.Mode&(fuse.S_IFMT|07777), stat.Rdev)
+	if 0 != errc {
+		return
+	}
+
+	/* Chown is best effort because we may not have privileges to perform this operation */
+	errc = dstfs.Chown(path, stat.Uid, stat.Gid)
+
+	errc = fs._cpxattr(path, v)
+	if -fuse.ENOSYS == errc {
+		errc = 0
+	} else if 0 != errc {
+		return
+	}
+
+	fs.setvisif(path, 0)
+	fs.invfile(path)
+
+	return
+}
+
+func iszero(buf []byte) bool {
+	for _, c := range buf {
+		if 0 != c {
+			return false
+		}
+	}
+	return true
+}
+
 func (fs *filesystem) cpfile(path string, v uint8, stat *fuse.Stat_t, srcfh uint64) (errc int) {
 	path = fs.readpath(path, v)
 
+	if nil != fs.nocopy && fs.nocopy(path) {
+		return -fuse.EACCES
+	}
+
 	srcfs := fs.fslist[v]
 	dstfs := fs.fslist[0]
 
@@ -460,31 +698,41 @@ func (fs *filesystem) cpfile(path string, v uint8, stat *fuse.Stat_t, srcfh uint
 		return
 	}
 
+	/* copy into the staging directory and rename into place when the copy is complete */
+	errc = dstfs.Mkdir(fs.cppath, 0700)
+	if 0 != errc && -fuse.EEXIST != errc {
+		return
+	}
+	tmppath := pathutil.Join(fs.cppath, strconv.FormatUint(atomic.AddUint64(&copyupSeq, 1), 10))
+
 	mode := stat.Mode & 0777
-	errc, dstfh := dstfs.Create(path, fuse.O_CREAT|fuse.O_RDWR, mode)
+	errc, dstfh := dstfs.Create(tmppath, fuse.O_CREAT|fuse.O_RDWR, mode)
 	if -fuse.ENOSYS == errc {
-		errc = dstfs.Mknod(path, mode, 0)
+		errc = dstfs.Mknod(tmppath, mode, 0)
 		if 0 == errc {
-			errc, dstfh = dstfs.Open(path, fuse.O_RDWR)
+			errc, dstfh = dstfs.Open(tmppath, fuse.O_RDWR)
 		}
 	}
 	if 0 != errc {
 		return
 	}
-	defer dstfs.Release(path, dstfh)
+	released := false
+	defer func() {
+		if !released {
+			dstfs.Release(tmppath, dstfh)
+		}
+		if 0 != errc {
+			/* remove partial copy so that the copy-up can be retried */
+			dstfs.Unlink(tmppath)
+		}
+	}()
 
 	/* Chown is best effort because we may not have privileges to perform this operation */
-	errc = dstfs.Chown(path, stat.Uid, stat.Gid)
-
-	errc = fs._cpxattr(path, v)
-	if -fuse.ENOSYS == errc {
-		errc = 0
-	} else if 0 != errc {
-		return
-	}
+	errc = dstfs.Chown(tmppath, stat.Uid, stat.Gid)
 
+	/* blocks of zeroes are not written, so that the copy of a sparse file is sparse */
 	buf := make([]byte, 64*1024)
-	ofs := int64(0)
+	ofs, end := int64(0), int64(0)
 	for {
 		n := srcfs.Read(path, buf, ofs, srcfh)
 		if 0 > n {
@@ -494,22 +742,55 @@ func (fs *filesystem) cpfile(path string, v uint8, stat *fuse.Stat_t, srcfh uint
 		if 0 == n {
 			break
 		}
-		m := dstfs.Write(path, buf[:n], ofs, dstfh)
-		if 0 > m {
-			errc = m
+		if !iszero(buf[:n]) {
+			m := dstfs.Write(tmppath, buf[:n], ofs, dstfh)
+			if 0 > m {
+				errc = m
+				return
+			}
+			if n != m {
+				errc = -fuse.EIO
+				return
+			}
+			end = ofs + int64(n)
+		}
+		ofs += int64(n)
+	}
+	if end < ofs {
+		errc = dstfs.Truncate(tmppath, ofs, dstfh)
+		if 0 != errc {
 			return
 		}
-		if n != m {
-			errc = -fuse.EIO
+	}
+
+	errc = dstfs.Flush(tmppath, dstfh)
+	if -fuse.ENOSYS == errc {
+		errc = 0
+	} else if 0 != errc {
+		return
+	}
+
+	if fs.pmsync {
+		errc = dstfs.Fsync(tmppath, false, dstfh)
+		if -fuse.ENOSYS == errc {
+			errc = 0
+		} else if 0 != errc {
 			return
 		}
-		ofs += int64(n)
 	}
 
-	errc = dstfs.Flush(path, dstfh)
+	released = true
+	dstfs.Release(tmppath, dstfh)
+	errc = dstfs.Rename(tmppath, path)
+	if 0 != errc {
+		return
+	}
+
+	errc = fs._cpxattr(path, v)
 	if -fuse.ENOSYS == errc {
 		errc = 0
 	} else if 0 != errc {
+		dstfs.Unlink(path)
 		return
 	}
 
@@ -519,6 +800,31 @@ func (fs *filesystem) cpfile(path string, v uint8, stat *fuse.Stat_t, srcfh uint
 	return
 }
 
+// sequence number of staged copy-ups
+var copyupSeq uint64
+
+// Function rmcopyups removes the staged copy-ups that were left over by copy-ups that were
+// interrupted, together with the staging directory.
+func (fs *filesystem) rmcopyups() {
+	dstfs := fs.fslist[0]
+	errc, fh := dstfs.Opendir(fs.cppath)
+	if 0 != errc {
+		return
+	}
+	names := []string{}
+	dstfs.Readdir(fs.cppath, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			names = append(names, name)
+		}
+		return true
+	}, 0, fh)
+	dstfs.Releasedir(fs.cppath, fh)
+	for _, name := range names {
+		dstfs.Unlink(pathutil.Join(fs.cppath, name))
+	}
+	dstfs.Rmdir(fs.cppath)
+}
+
 func (fs *filesystem) cpany(path string, v uint8, stat *fuse.Stat_t) (errc int) {
 	if nil == stat {
 		stat = &fuse.Stat_t{}
@@ -533,6 +839,8 @@ func (fs *filesystem) cpany(path string, v uint8, stat *fuse.Stat_t) (errc int)
 		errc = fs.cpdir(path, v, stat)
 	case fuse.S_IFLNK:
 		errc = fs.cplink(path, v, stat)
+	case fuse.S_IFIFO, fuse.S_IFSOCK, fuse.S_IFCHR, fuse.S_IFBLK:
+		errc = fs.cpnode(path, v, stat)
 	default:
 		errc = fs.cpfile(path, v, stat, ^uint64(0))
 	}
@@ -559,10 +867,18 @@ func (fs *filesystem) cptree(path string, v uint8, stat *fuse.Stat_t, paths *[]s
 	}
 
 	if fuse.S_IFDIR == stat.Mode&fuse.S_IFMT {
-		fs.lsdir(path, false, v, ^uint64(0), func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		// lower entries of an opaque directory are not necessarily whiteouts (e.g. SUBTREE)
+		fs.pathmap.RLock()
+		isopq, _ := fs.pathmap.Get(path)
+		fs.pathmap.RUnlock()
+
+		e := fs.lsdir(path, isopq, v, func(name string, stat *fuse.Stat_t, ofst int64) bool {
 			errc = fs.cptree(pathutil.Join(path, name), uint8(ofst), stat, paths)
 			return 0 == errc
 		})
+		if 0 != e {
+			errc = e
+		}
 	}
 
 	if 0 == errc && fs.hasvis(path) {
@@ -573,7 +889,7 @@ func (fs *filesystem) cptree(path string, v uint8, stat *fuse.Stat_t, paths *[]s
 }
 
 func (fs *filesystem) mknode(path string, isdir bool, fn func(v uint8) int) (errc int) {
-	if hasPathPrefix(path, fs.pmpath, fs.filemap.Caseins) {
+	if fs.ispmpath(path) {
 		return -fuse.EPERM
 	}
 
@@ -610,7 +926,7 @@ func (fs *filesystem) mknode(path string, isdir bool, fn func(v uint8) int) (err
 }
 
 func (fs *filesystem) rmnode(path string, isdir bool, fn func(v uint8) int) (errc int) {
-	if hasPathPrefix(path, fs.pmpath, fs.filemap.Caseins) {
+	if fs.ispmpath(path) {
 		return -fuse.EPERM
 	}
 
@@ -646,19 +962,30 @@ func (fs *filesystem) rmnode(path string, isdir bool, fn func(v uint8) int) (err
 		if 0 == v {
 			errc = fn(0)
 			if 0 == errc {
-				fs.setvis(path, WHITEOUT)
+				fs.rmvis(path, isdir)
 			}
 		} else {
-			fs.setvis(path, WHITEOUT)
+			fs.rmvis(path, isdir)
 		}
 	}
 
 	return
 }
 
+// Function rmvis sets the visibility of a removed path to whiteout. A removed directory
+// gets a single subtree whiteout that hides the entire directory; the records of its
+// entries, which must all be whiteouts because the directory is empty, are purged from
+// the path map (see Pathmap.Set).
+func (fs *filesystem) rmvis(path string, isdir bool) {
+	if isdir && 1 < len(fs.fslist) {
+		fs.setvis(path, SUBTREE)
+	} else {
+		fs.setvis(path, WHITEOUT)
+	}
+}
+
 func (fs *filesystem) renode(oldpath string, newpath string, link bool, fn func(v uint8) int) (errc int) {
-	if hasPathPrefix(oldpath, fs.pmpath, fs.filemap.Caseins) ||
-		hasPathPrefix(newpath, fs.pmpath, fs.filemap.Caseins) {
+	if fs.ispmpath(oldpath) || fs.ispmpath(newpath) {
 		return -fuse.EPERM
 	}
 
@@ -708,10 +1035,32 @@ func (fs *filesystem) renode(oldpath string, newpath string, link bool, fn func(
 			return
 		}
 
+		errc = fs.mkpdir(newpath)
+		if 0 != errc {
+			return
+		}
+
+		prewo := !link && fuse.S_IFDIR != olds.Mode&fuse.S_IFMT && fs.haslower(oldpath)
+		if prewo {
+			// Write the whiteout of a file that also exists in a lower layer before
+			// the rename. Until the rename the whiteout is overridden by the copied up
+			// upper layer file (see revealvis); after the rename it hides the lower
+			// layer file. A crash at any point leaves either the old or the new name.
+			errc = fs.previs(oldpath, WHITEOUT)
+			if 0 != errc {
+				return
+			}
+		}
+
 		errc = fn(0)
+		if 0 != errc && prewo {
+			fs.setvis(oldpath, 0)
+		}
 		if 0 == errc {
 			fs.pathmap.Lock()
+			batch := make([]PathVis, 0, len(paths)+1)
 			if !link {
+				rels := make([]string, 0, len(paths))
 				for _, path := range paths {
 					if oldpath == path {
 						continue
@@ -720,12 +1069,20 @@ func (fs *filesystem) renode(oldpath string, newpath string, link bool, fn func(
 					if !ok {
 						continue
 					}
-					fs.pathmap.Set(path, NOTEXIST)
-					fs.pathmap.Set(newpath+path[len(oldpath):], v)
+					rels = append(rels, path[len(oldpath):])
+					batch = append(batch, PathVis{newpath + path[len(oldpath):], v})
 				}
-				fs.pathmap.Set(oldpath, WHITEOUT)
+				fs.pathmap.SetTree(oldpath, rels, NOTEXIST)
+				batch = append(batch, PathVis{oldpath, WHITEOUT})
+			}
+			newvis := uint8(0)
+			if fuse.S_IFDIR == olds.Mode&fuse.S_IFMT {
+				// the directory contents have been copied up; lower directory entries at
+				// newpath may no longer be hidden by their own whiteouts (e.g. SUBTREE)
+				newvis = OPAQUE
 			}
-			fs.pathmap.Set(newpath, 0)
+			batch = append(batch, PathVis{newpath, newvis})
+			fs.pathmap.SetBatch(batch)
 			fs.pathmap.Unlock()
 		}
 	}
@@ -734,7 +1091,7 @@ func (fs *filesystem) renode(oldpath string, newpath string, link bool, fn func(
 }
 
 func (fs *filesystem) getnode(path string, fn func(isopq bool, v uint8) int) (errc int) {
-	if hasPathPrefix(path, fs.pmpath, fs.filemap.Caseins) {
+	if fs.ispmpath(path) {
 		return -fuse.EPERM
 	}
 
@@ -754,7 +1111,7 @@ func (fs *filesystem) getnode(path string, fn func(isopq bool, v uint8) int) (er
 }
 
 func (fs *filesystem) setnode(path string, fn func(v uint8) int) (errc int) {
-	if hasPathPrefix(path, fs.pmpath, fs.filemap.Caseins) {
+	if fs.ispmpath(path) {
 		return -fuse.EPERM
 	}
 
@@ -837,7 +1194,7 @@ func (fs *filesystem) ReopenFile(oldpath string, newpath string, f0 interface{})
 
 func (fs *filesystem) newfile(path string, isopq bool, v uint8, fh uint64, flags int) (wrapfh uint64) {
 	fs.filemux.Lock()
-	f := &file{isopq, v, fh, flags}
+	f := &file{isopq: isopq, v: v, fh: fh, flags: flags}
 	wrapfh = fs.filemap.NewFile(path, f, 0 != v)
 	fs.filemux.Unlock()
 	return
@@ -870,13 +1227,33 @@ func (fs *filesystem) getwfile(path string, wrapfh uint64) (v uint8, fh uint64)
 	fs.filemux.Lock()
 	f := fs.filemap.GetFile(path, wrapfh, true).(*file)
 	fs.filemux.Unlock()
-	if nil != f {
+	if nil != f && 0 == f.v {
+		// only files in fslist[0] are writable; f.v is non-zero if the copy-up failed
 		v, fh = f.v, f.fh
 	}
 
 	return
 }
 
+func (fs *filesystem) getdirs(wrapfh uint64) (list []dirent) {
+	fs.filemux.Lock()
+	f, _ := fs.filemap.GetFile("", wrapfh, false).(*file)
+	if nil != f {
+		list = f.dirs
+	}
+	fs.filemux.Unlock()
+	return
+}
+
+func (fs *filesystem) setdirs(wrapfh uint64, list []dirent) {
+	fs.filemux.Lock()
+	f, _ := fs.filemap.GetFile("", wrapfh, false).(*file)
+	if nil != f {
+		f.dirs = list
+	}
+	fs.filemux.Unlock()
+}
+
 func (fs *filesystem) invfile(path string) {
 	fs.filemux.Lock()
 	fs.filemap.Remove(path)
@@ -888,14 +1265,31 @@ func (fs *filesystem) Init() {
 		fs.Init()
 	}
 
-	_, fs.pathmap = OpenPathmap(fs.fslist[0], fs.pmpath, fs.filemap.Caseins)
+	fs.rmcopyups()
+
+	pmfs := fs.fslist[0]
+	if nil != fs.pmfs {
+		fs.pmfs.Init()
+		pmfs = fs.pmfs
+	}
+
+	_, fs.pathmap = OpenPathmap(pmfs, fs.pmpath, fs.filemap.Caseins)
 	if nil == fs.pathmap {
 		_, fs.pathmap = OpenPathmap(nil, "", fs.filemap.Caseins)
 	}
+	fs.pathmap.Unorm = fs.filemap.Unorm
+	fs.pathmap.Verify = fs.pmverify
+	fs.pathmap.Sorted = fs.pmsorted
+	fs.pathmap.Collide = fs.collide
+	// the index is also used to purge the records under a subtree whiteout (see rmvis)
+	if fs.visindex || 1 < len(fs.fslist) {
+		fs.pathmap.EnableIndex()
+	}
 
 	if 0 != fs.lazytick {
 		fs.lazystopC = make(chan struct{}, 1)
 		fs.lazystopW = &sync.WaitGroup{}
+		fs.lazyflsC = make(chan struct{}, 1)
 		fs.lazystopW.Add(1)
 		go fs._lazyWritevis()
 	}
@@ -908,11 +1302,15 @@ func (fs *filesystem) Destroy() {
 		close(fs.lazystopC)
 		fs.lazystopC = nil
 		fs.lazystopW = nil
+		fs.lazyflsC = nil
 	}
 
 	fs.writevis()
 	fs.pathmap.Close()
 
+	if nil != fs.pmfs {
+		fs.pmfs.Destroy()
+	}
 	for _, fs := range fs.fslist {
 		fs.Destroy()
 	}
@@ -1017,6 +1415,9 @@ func (fs *filesystem) Create(path string, flags int, mode uint32) (errc int, fh
 
 func (fs *filesystem) Open(path string, flags int) (errc int, fh uint64) {
 	errc = fs.getnode(path, func(isopq bool, v uint8) int {
+		if 0 != v && 0 != flags&(fuse.O_WRONLY|fuse.O_RDWR) && nil != fs.nocopy && fs.nocopy(path) {
+			return -fuse.EACCES
+		}
 		errc, fh = fs.fslist[v].Open(path, flags)
 		if 0 == errc {
 			fh = fs.newfile(path, false, v, fh, flags&(fuse.O_RDONLY|fuse.O_WRONLY|fuse.O_RDWR))
@@ -1028,7 +1429,7 @@ func (fs *filesystem) Open(path string, flags int) (errc int, fh uint64) {
 
 func (fs *filesystem) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
 	if ^uint64(0) == fh {
-		if hasPathPrefix(path, fs.pmpath, fs.filemap.Caseins) {
+		if fs.ispmpath(path) {
 			return -fuse.EPERM
 		}
 
@@ -1071,6 +1472,56 @@ func (fs *filesystem) Read(path string, buff []byte, ofst int64, fh uint64) (n i
 	return fs.fslist[v].Read(path, buff, ofst, fh)
 }
 
+// Flags for Fallocate. They have the same values as the Linux FALLOC_FL_* flags.
+const (
+	FallocKeepSize  = 0x01
+	FallocPunchHole = 0x02
+)
+
+// fallocate is implemented by file systems that can allocate space for an open file
+// (see Fallocate).
+type fallocate interface {
+	Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) int
+}
+
+// Function Fallocate allocates space for an open file. The file is copied up (if it has
+// not been already) and the request is passed to the upper layer. If the upper layer does
+// not support it, allocation is emulated by extending the file size; such files may be
+// sparse. Other operations (e.g. punching holes) are not emulated.
+func (fs *filesystem) Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) (errc int) {
+	if 0 > ofst || 0 >= length {
+		return -fuse.EINVAL
+	}
+
+	v, fh := fs.getwfile(path, fh)
+	if UNKNOWN == v {
+		return -fuse.EIO
+	}
+
+	errc = -fuse.ENOSYS
+	if f, ok := fs.fslist[v].(fallocate); ok {
+		errc = f.Fallocate(path, mode, ofst, length, fh)
+	}
+	if -fuse.ENOSYS != errc && -fuse.EOPNOTSUPP != errc {
+		return
+	}
+
+	switch mode {
+	case 0:
+		var stat fuse.Stat_t
+		errc = fs.fslist[v].Getattr(path, &stat, fh)
+		if 0 == errc && ofst+length > stat.Size {
+			errc = fs.fslist[v].Truncate(path, ofst+length, fh)
+		}
+	case FallocKeepSize:
+		errc = 0
+	default:
+		errc = -fuse.EOPNOTSUPP
+	}
+
+	return
+}
+
 func (fs *filesystem) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	v, fh := fs.getwfile(path, fh)
 	if UNKNOWN == v {
@@ -1131,12 +1582,42 @@ func (fs *filesystem) Readdir(path string,
 	ofst int64,
 	fh uint64) (errc int) {
 
+	wrapfh := fh
+
 	isopq, v, fh := fs.getfile(path, fh)
 	if UNKNOWN == v {
 		return -fuse.EIO
 	}
 
-	fs.lsdir(path, isopq, v, fh, fill)
+	// A zero offset starts a new enumeration and takes a fresh snapshot of the
+	// merged directory. Non-zero offsets continue from the snapshot, so that
+	// large directories can be returned over multiple Readdir calls. A non-zero
+	// offset without a snapshot is invalid: restarting the enumeration would
+	// return entries that the caller already has.
+	var list []dirent
+	if 0 != ofst {
+		list = fs.getdirs(wrapfh)
+		if nil == list {
+			return -fuse.EINVAL
+		}
+	} else {
+		errc, list = fs.readdir(path, isopq, v, fh)
+		if 0 != errc {
+			return
+		}
+		fs.setdirs(wrapfh, list)
+	}
+
+	for i := int(ofst); len(list) > i; i++ {
+		if 0 == (i+1)%readdirChunk && fs.interrupted() {
+			return -fuse.EINTR
+		}
+		ent := list[i]
+		if !fill(ent.name, ent.stat, int64(i+1)) {
+			break
+		}
+	}
+
 	return 0
 }
 
@@ -1230,10 +1711,36 @@ func (fs *filesystem) Setchgtime(path string, tmsp fuse.Timespec) (errc int) {
 	})
 }
 
+// Function ispmpath determines whether path is the path map file (or a file rotated from it)
+// or is in the copy-up staging directory and must therefore be hidden. The path map file is
+// never hidden when the path map is stored in a separate file system.
+func (fs *filesystem) ispmpath(path string) bool {
+	if hasPathPrefix(path, fs.cppath, fs.filemap.Caseins) {
+		return true
+	}
+	if nil != fs.pmfs {
+		return false
+	}
+	if hasPathPrefix(path, fs.pmpath, fs.filemap.Caseins) {
+		return true
+	}
+	n := len(fs.pmpath)
+	if len(path) < n+2 || '.' != path[n] ||
+		!hasPathPrefix(path[:n], fs.pmpath, fs.filemap.Caseins) {
+		return false
+	}
+	for _, c := range path[n+1:] {
+		if '0' > c || '9' < c {
+			return false
+		}
+	}
+	return true
+}
+
 func hasPathPrefix(path, prefix string, caseins bool) bool {
 	if caseins {
-		path = strings.ToUpper(path)
-		prefix = strings.ToUpper(prefix)
+		path = Foldpath(path, true, UnormNone)
+		prefix = Foldpath(prefix, true, UnormNone)
 	}
 	return path == prefix ||
 		(len(path) > len(prefix) && path[:len(prefix)] == prefix && path[len(prefix)] == '/')
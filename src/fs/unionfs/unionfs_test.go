@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"math/rand"
 	pathutil "path"
+	"reflect"
 	"sort"
 	"testing"
 	"time"
@@ -637,3 +638,829 @@ func TestUnionfs(t *testing.T) {
 		t.Errorf("%v (seed=%v)", err, seed)
 	}
 }
+
+func TestUnionfsReaddirOffset(t *testing.T) {
+	fs1 := newTestfs()
+	fs2 := newTestfs()
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	for i := 0; 100 > i; i++ {
+		fs := fs2
+		if 0 == i%3 {
+			fs = fs1
+		}
+		errc := fs.Mknod(fmt.Sprintf("/file%03d", i), fuse.S_IFREG|0644, 0)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	for i := 0; 100 > i; i += 10 {
+		errc := ufs.Unlink(fmt.Sprintf("/file%03d", i))
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+
+	errc, fh := ufs.Opendir("/")
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	defer ufs.Releasedir("/", fh)
+
+	all := []string{}
+	ufs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		all = append(all, name)
+		return true
+	}, 0, fh)
+
+	names := []string{}
+	ofst := int64(0)
+	for {
+		cnt := 0
+		errc = ufs.Readdir("/", func(name string, stat *fuse.Stat_t, o int64) bool {
+			if 7 == cnt {
+				return false
+			}
+			names = append(names, name)
+			ofst = o
+			cnt++
+			return true
+		}, ofst, fh)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		if 0 == cnt {
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(all, names) {
+		t.Error()
+	}
+	if 92 != len(names) {
+		t.Error(len(names))
+	}
+
+	// a non-zero offset cannot continue an enumeration that was never started
+	errc, fh2 := ufs.Opendir("/")
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	defer ufs.Releasedir("/", fh2)
+	errc = ufs.Readdir("/", func(name string, stat *fuse.Stat_t, o int64) bool {
+		t.Error(name)
+		return true
+	}, 7, fh2)
+	if -fuse.EINVAL != errc {
+		t.Error(errc)
+	}
+}
+
+func readdirnames(fs fuse.FileSystemInterface, path string) (errc int, names []string) {
+	errc, fh := fs.Opendir(path)
+	if 0 != errc {
+		return
+	}
+	defer fs.Releasedir(path, fh)
+
+	names = []string{}
+	errc = fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			names = append(names, name)
+		}
+		return true
+	}, 0, fh)
+	sort.Strings(names)
+
+	return
+}
+
+func TestUnionfsRenameHidden(t *testing.T) {
+	fs1 := newTestfs()
+	fs2 := newTestfs()
+	for _, path := range []string{"/a", "/a/d", "/x", "/y"} {
+		fs2.Mkdir(path, 0777)
+	}
+	for _, path := range []string{"/a/d/f1", "/a/d/f2", "/x/f"} {
+		fs2.Mknod(path, fuse.S_IFREG|0644, 0)
+	}
+
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	// recreate a removed directory and rename its parent
+	for _, errc := range []int{
+		ufs.Unlink("/a/d/f1"),
+		ufs.Unlink("/a/d/f2"),
+		ufs.Rmdir("/a/d"),
+		ufs.Mkdir("/a/d", 0777),
+		ufs.Rename("/a", "/b"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	errc, names := readdirnames(ufs, "/b/d")
+	if 0 != errc || 0 != len(names) {
+		t.Error(errc, names)
+	}
+
+	// rename a directory over a lower directory that was renamed away
+	for _, errc := range []int{
+		ufs.Rename("/x", "/z"),
+		ufs.Rename("/y", "/x"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	errc, names = readdirnames(ufs, "/x")
+	if 0 != errc || 0 != len(names) {
+		t.Error(errc, names)
+	}
+	errc, names = readdirnames(ufs, "/z")
+	if 0 != errc || !reflect.DeepEqual([]string{"f"}, names) {
+		t.Error(errc, names)
+	}
+}
+
+func writestring(fs fuse.FileSystemInterface, path string, data string) (errc int) {
+	errc = fs.Mknod(path, fuse.S_IFREG|0644, 0)
+	if 0 != errc && -fuse.EEXIST != errc {
+		return
+	}
+
+	errc, fh := fs.Open(path, fuse.O_RDWR)
+	if 0 != errc {
+		return
+	}
+	defer fs.Release(path, fh)
+
+	n := fs.Write(path, []byte(data), 0, fh)
+	if 0 > n {
+		return n
+	}
+	if len(data) != n {
+		return -fuse.EIO
+	}
+
+	return 0
+}
+
+func newTestLayers(t *testing.T) (fs1, fs2 *testFaultfs) {
+	fs1 = newTestFaultfs()
+	fs2 = newTestFaultfs()
+	for _, errc := range []int{
+		fs2.Mkdir("/d", 0777),
+		writestring(fs2, "/d/f", "hello"),
+		writestring(fs2, "/d/g", "world"),
+		writestring(fs2, "/h", "lower"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	return
+}
+
+func TestUnionfsCopyUp(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	errc, fh := ufs.Open("/d/f", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	if _, data := readstring(fs1, "/d/f"); "" != data {
+		t.Error(data)
+	}
+	n := ufs.Write("/d/f", []byte("J"), 0, fh)
+	if 1 != n {
+		t.Error(n)
+	}
+	ufs.Release("/d/f", fh)
+
+	if _, data := readstring(fs1, "/d/f"); "F:Jello" != data {
+		t.Error(data)
+	}
+	if _, data := readstring(fs2, "/d/f"); "F:hello" != data {
+		t.Error(data)
+	}
+	if _, data := readstring(ufs, "/d/f"); "F:Jello" != data {
+		t.Error(data)
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc ||
+		!reflect.DeepEqual([]string{"f", "g"}, names) {
+		t.Error(errc, names)
+	}
+}
+
+func TestUnionfsSpecialFiles(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	if errc := fs2.Mknod("/d/p", fuse.S_IFIFO|0644, 0); 0 != errc {
+		t.Fatal(errc)
+	}
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	if errc := ufs.Mknod("/d/s", fuse.S_IFSOCK|0755, 0); 0 != errc {
+		t.Fatal(errc)
+	}
+	stat := fuse.Stat_t{}
+	if errc := fs1.Getattr("/d/s", &stat, ^uint64(0)); 0 != errc || fuse.S_IFSOCK|0755 != stat.Mode {
+		t.Error(errc, stat.Mode)
+	}
+
+	// copy up of a special file copies the node rather than its content
+	if errc := ufs.Chmod("/d/p", 0600); 0 != errc {
+		t.Fatal(errc)
+	}
+	if errc := fs1.Getattr("/d/p", &stat, ^uint64(0)); 0 != errc || fuse.S_IFIFO|0600 != stat.Mode {
+		t.Error(errc, stat.Mode)
+	}
+	if errc := ufs.Rename("/d/p", "/q"); 0 != errc {
+		t.Error(errc)
+	}
+	if errc := ufs.Getattr("/q", &stat, ^uint64(0)); 0 != errc || fuse.S_IFIFO|0600 != stat.Mode {
+		t.Error(errc, stat.Mode)
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc ||
+		!reflect.DeepEqual([]string{"f", "g", "s"}, names) {
+		t.Error(errc, names)
+	}
+}
+
+func TestUnionfsNocopy(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	ufs := New(Config{
+		Fslist: []fuse.FileSystemInterface{fs1, fs2},
+		Nocopy: func(path string) bool {
+			return "/d/f" == path
+		},
+	})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	if _, data := readstring(ufs, "/d/f"); "F:hello" != data {
+		t.Error(data)
+	}
+	if errc, _ := ufs.Open("/d/f", fuse.O_RDWR); -fuse.EACCES != errc {
+		t.Error(errc)
+	}
+	if errc := ufs.Chmod("/d/f", 0600); -fuse.EACCES != errc {
+		t.Error(errc)
+	}
+	if errc := ufs.Rename("/d", "/e"); -fuse.EACCES != errc {
+		t.Error(errc)
+	}
+	if errc := ufs.Chmod("/d/g", 0600); 0 != errc {
+		t.Error(errc)
+	}
+	stat := fuse.Stat_t{}
+	if errc := fs1.Getattr("/d/f", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+
+	// files that are not copied up can still be deleted
+	if errc := ufs.Unlink("/d/f"); 0 != errc {
+		t.Error(errc)
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc ||
+		!reflect.DeepEqual([]string{"g"}, names) {
+		t.Error(errc, names)
+	}
+}
+
+func TestUnionfsCopyUpFault(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	for _, fault := range []func(enable bool){
+		fs1.shortWrites,
+		func(enable bool) {
+			if enable {
+				fs2.inject("Read", -fuse.EIO)
+			} else {
+				fs2.inject("Read", 0)
+			}
+		},
+	} {
+		errc, fh := ufs.Open("/d/f", fuse.O_RDWR)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		fault(true)
+		n := ufs.Write("/d/f", []byte("J"), 0, fh)
+		fault(false)
+		ufs.Release("/d/f", fh)
+		if -fuse.EIO != n {
+			t.Error(n)
+		}
+
+		if _, data := readstring(fs2, "/d/f"); "F:hello" != data {
+			t.Error(data)
+		}
+		if _, data := readstring(ufs, "/d/f"); "F:hello" != data {
+			t.Error(data)
+		}
+	}
+
+	errc, fh := ufs.Open("/d/f", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	n := ufs.Write("/d/f", []byte("J"), 0, fh)
+	ufs.Release("/d/f", fh)
+	if 1 != n {
+		t.Error(n)
+	}
+	if _, data := readstring(ufs, "/d/f"); "F:Jello" != data {
+		t.Error(data)
+	}
+}
+
+func TestUnionfsCopyUpStaging(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+
+	// staged copy-ups that were left over are removed when the file system is initialized
+	for _, errc := range []int{
+		fs1.Mkdir("/.unionfs.copyup", 0700),
+		writestring(fs1, "/.unionfs.copyup/1", "partial"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+	var stat fuse.Stat_t
+	if errc := fs1.Getattr("/.unionfs.copyup", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+
+	// a copy-up that fails after the file has been copied leaves no partial file
+	errc, fh := ufs.Open("/d/f", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	fs1.inject("Rename", -fuse.EIO)
+	n := ufs.Write("/d/f", []byte("J"), 0, fh)
+	fs1.inject("Rename", 0)
+	ufs.Release("/d/f", fh)
+	if -fuse.EIO != n {
+		t.Error(n)
+	}
+	if errc := fs1.Getattr("/d/f", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+	if errc, names := readdirnames(fs1, "/.unionfs.copyup"); 0 != errc || 0 != len(names) {
+		t.Error(errc, names)
+	}
+	if _, data := readstring(ufs, "/d/f"); "F:hello" != data {
+		t.Error(data)
+	}
+
+	// the staging directory is hidden
+	errc, fh = ufs.Open("/h", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	n = ufs.Write("/h", []byte("L"), 0, fh)
+	ufs.Release("/h", fh)
+	if 1 != n {
+		t.Error(n)
+	}
+	if _, data := readstring(fs1, "/h"); "F:Lower" != data {
+		t.Error(data)
+	}
+	if errc, names := readdirnames(ufs, "/"); 0 != errc || "[d h]" != fmt.Sprint(names) {
+		t.Error(errc, names)
+	}
+	if errc := ufs.Getattr("/.unionfs.copyup", &stat, ^uint64(0)); 0 == errc {
+		t.Error(errc)
+	}
+}
+
+func TestUnionfsWhiteout(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+
+	var stat fuse.Stat_t
+	for _, errc := range []int{
+		ufs.Unlink("/d/f"),
+		ufs.Unlink("/h"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	if errc := ufs.Getattr("/d/f", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+	if errc := ufs.Rmdir("/d"); -fuse.ENOTEMPTY != errc {
+		t.Error(errc)
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc ||
+		!reflect.DeepEqual([]string{"g"}, names) {
+		t.Error(errc, names)
+	}
+	ufs.Destroy()
+
+	// whiteouts survive a remount
+	ufs = New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d"}, names) {
+		t.Error(errc, names)
+	}
+	for _, errc := range []int{
+		ufs.Unlink("/d/g"),
+		ufs.Rmdir("/d"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	if errc := ufs.Getattr("/d/g", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+
+	// a recreated file or directory does not expose lower content
+	for _, errc := range []int{
+		ufs.Mkdir("/d", 0777),
+		writestring(ufs, "/h", "upper"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc || 0 != len(names) {
+		t.Error(errc, names)
+	}
+	if _, data := readstring(ufs, "/h"); "F:upper" != data {
+		t.Error(data)
+	}
+}
+
+func TestUnionfsRemoveTree(t *testing.T) {
+	fs1 := newTestfs()
+	fs2 := newTestfs()
+	for _, path := range []string{"/d", "/d/s", "/e"} {
+		fs2.Mkdir(path, 0777)
+	}
+	for _, path := range []string{"/d/f1", "/d/f2", "/d/s/x", "/e/f"} {
+		fs2.Mknod(path, fuse.S_IFREG|0644, 0)
+	}
+
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+
+	// rm -r of a populated directory leaves a single subtree whiteout
+	for _, errc := range []int{
+		ufs.Unlink("/d/s/x"),
+		ufs.Rmdir("/d/s"),
+		ufs.Unlink("/d/f1"),
+		ufs.Unlink("/d/f2"),
+		ufs.Rmdir("/d"),
+		ufs.Unlink("/e/f"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	pm := ufs.(*filesystem).pathmap
+	pm.Purge()
+	if 2 != pm.len() {
+		t.Error(pm.len())
+	}
+	ufs.Destroy()
+
+	// whiteouts read from the path map file are purged once their directory is listed
+	ufs = New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	if errc, names := readdirnames(ufs, "/e"); 0 != errc || 0 != len(names) {
+		t.Error(errc, names)
+	}
+	if errc := ufs.Rmdir("/e"); 0 != errc {
+		t.Error(errc)
+	}
+	if errc, names := readdirnames(ufs, "/"); 0 != errc || 0 != len(names) {
+		t.Error(errc, names)
+	}
+	ufs.Destroy()
+
+	ec, pm := OpenPathmap(fs1, "/.unionfs", false)
+	if 0 != ec {
+		t.Fatal(ec)
+	}
+	defer pm.Close()
+	if 2 != pm.len() {
+		t.Error(pm.len())
+	}
+}
+
+func TestUnionfsUnorm(t *testing.T) {
+	nfc, nfd := "\u00e9", "e\u0301"
+
+	fs1, fs2 := newTestLayers(t)
+	if errc := writestring(fs2, "/"+nfd, "lower"); 0 != errc {
+		t.Fatal(errc)
+	}
+
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d", nfd, "h"}, names) {
+		t.Error(errc, names)
+	}
+	ufs.Destroy()
+
+	ufs = New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}, Unorm: UnormNFC})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	// names are presented in the normalization form of the file system
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d", "h", nfc}, names) {
+		t.Error(errc, names)
+	}
+
+	// a whiteout applies to all normalization forms of a name
+	if errc := ufs.Unlink("/" + nfd); 0 != errc {
+		t.Fatal(errc)
+	}
+	var stat fuse.Stat_t
+	if errc := ufs.Getattr("/"+nfc, &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d", "h"}, names) {
+		t.Error(errc, names)
+	}
+
+	if errc := writestring(ufs, "/"+nfc, "upper"); 0 != errc {
+		t.Fatal(errc)
+	}
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d", "h", nfc}, names) {
+		t.Error(errc, names)
+	}
+}
+
+func TestUnionfsRename(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+
+	fs1.inject("Rename", -fuse.EIO)
+	if errc := ufs.Rename("/h", "/i"); -fuse.EIO != errc {
+		t.Error(errc)
+	}
+	fs1.inject("Rename", 0)
+	if _, data := readstring(ufs, "/h"); "F:lower" != data {
+		t.Error(data)
+	}
+
+	for _, errc := range []int{
+		ufs.Rename("/h", "/i"),
+		ufs.Rename("/d", "/e"),
+		ufs.Rename("/e/g", "/e/f"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	ufs.Destroy()
+
+	ufs = New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"e", "i"}, names) {
+		t.Error(errc, names)
+	}
+	if errc, names := readdirnames(ufs, "/e"); 0 != errc ||
+		!reflect.DeepEqual([]string{"f"}, names) {
+		t.Error(errc, names)
+	}
+	if _, data := readstring(ufs, "/e/f"); "F:world" != data {
+		t.Error(data)
+	}
+	if _, data := readstring(ufs, "/i"); "F:lower" != data {
+		t.Error(data)
+	}
+}
+
+func TestUnionfsPathmapRecovery(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	pmfs := newTestFaultfs()
+	pmfs.inject("Fsync", -fuse.ENOSYS)
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}, Pmfs: pmfs, Pmsync: true})
+	ufs.Init()
+
+	if errc := ufs.Unlink("/d/f"); 0 != errc {
+		t.Fatal(errc)
+	}
+
+	// the path map update for /h is torn and the file system is not destroyed
+	pmfs.shortWrites(true)
+	if errc := ufs.Unlink("/h"); 0 != errc {
+		t.Fatal(errc)
+	}
+	pmfs.shortWrites(false)
+
+	ufs = New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}, Pmfs: pmfs, Pmsync: true})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d", "h"}, names) {
+		t.Error(errc, names)
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc ||
+		!reflect.DeepEqual([]string{"g"}, names) {
+		t.Error(errc, names)
+	}
+	var stat fuse.Stat_t
+	if errc := pmfs.Getattr("/.unionfs.1", &stat, ^uint64(0)); 0 != errc {
+		t.Error(errc)
+	}
+	if errc := fs1.Getattr("/.unionfs", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+}
+
+func TestUnionfsPathmapHidden(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	fs1.Mknod("/.unionfs.1", fuse.S_IFREG|0644, 0)
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d", "h"}, names) {
+		t.Error(errc, names)
+	}
+	var stat fuse.Stat_t
+	for _, path := range []string{"/.unionfs", "/.unionfs.1"} {
+		if errc := ufs.Getattr(path, &stat, ^uint64(0)); -fuse.EPERM != errc {
+			t.Error(path, errc)
+		}
+	}
+	if errc := ufs.Getattr("/.unionfs.x", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Error(errc)
+	}
+}
+
+func TestUnionfsRenameReplace(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+
+	// replace a lower layer file in a lower layer directory
+	for _, errc := range []int{
+		writestring(ufs, "/t", "upper"),
+		ufs.Rename("/t", "/d/f"),
+		ufs.Rename("/h", "/d/g"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc ||
+		!reflect.DeepEqual([]string{"f", "g"}, names) {
+		t.Error(errc, names)
+	}
+	if _, data := readstring(ufs, "/d/f"); "F:upper" != data {
+		t.Error(data)
+	}
+	if _, data := readstring(ufs, "/d/g"); "F:lower" != data {
+		t.Error(data)
+	}
+
+	// the whiteout of a renamed file is written before the rename
+	fs1.inject("Rename", -fuse.EIO)
+	if errc := ufs.Rename("/d/g", "/i"); -fuse.EIO != errc {
+		t.Error(errc)
+	}
+	fs1.inject("Rename", 0)
+	if _, data := readstring(ufs, "/d/g"); "F:lower" != data {
+		t.Error(data)
+	}
+	ufs.Destroy()
+
+	ufs = New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d"}, names) {
+		t.Error(errc, names)
+	}
+	for _, errc := range []int{
+		ufs.Unlink("/d/f"),
+		ufs.Unlink("/d/g"),
+		ufs.Rmdir("/d"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+	ufs.Destroy()
+
+	// upper layer entries whose path map update was lost take precedence over whiteouts
+	for _, errc := range []int{
+		fs1.Mkdir("/d", 0777),
+		writestring(fs1, "/d/n", "new"),
+		writestring(fs1, "/h", "upper"),
+	} {
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+	}
+
+	ufs = New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	if errc, names := readdirnames(ufs, "/"); 0 != errc ||
+		!reflect.DeepEqual([]string{"d", "h"}, names) {
+		t.Error(errc, names)
+	}
+	if _, data := readstring(ufs, "/d/n"); "F:new" != data {
+		t.Error(data)
+	}
+	if errc, names := readdirnames(ufs, "/d"); 0 != errc ||
+		!reflect.DeepEqual([]string{"n"}, names) {
+		t.Error(errc, names)
+	}
+	if _, data := readstring(ufs, "/h"); "F:upper" != data {
+		t.Error(data)
+	}
+}
+
+func TestUnionfsFallocate(t *testing.T) {
+	fs1, fs2 := newTestLayers(t)
+	if errc := writestring(fs2, "/z", string(make([]byte, 128*1024))); 0 != errc {
+		t.Fatal(errc)
+	}
+	ufs := New(Config{Fslist: []fuse.FileSystemInterface{fs1, fs2}})
+	ufs.Init()
+	defer ufs.Destroy()
+
+	// blocks of zeroes are not written during copy-up
+	fs1.inject("Write", -fuse.EIO)
+	errc := ufs.Chmod("/z", 0600)
+	fs1.inject("Write", 0)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	var stat fuse.Stat_t
+	if errc := fs1.Getattr("/z", &stat, ^uint64(0)); 0 != errc || 128*1024 != stat.Size {
+		t.Error(errc, stat.Size)
+	}
+
+	f := ufs.(interface {
+		Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) int
+	})
+	errc, fh := ufs.Open("/h", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	defer ufs.Release("/h", fh)
+	for _, c := range []struct {
+		mode uint32
+		ofst int64
+		len  int64
+		errc int
+		size int64
+	}{
+		{0, 0, 3, 0, 5},
+		{0, 5, 5, 0, 10},
+		{FallocKeepSize, 10, 10, 0, 10},
+		{FallocKeepSize | FallocPunchHole, 0, 5, -fuse.EOPNOTSUPP, 10},
+		{0, 0, 0, -fuse.EINVAL, 10},
+	} {
+		if errc := f.Fallocate("/h", c.mode, c.ofst, c.len, fh); c.errc != errc {
+			t.Error(c, errc)
+		}
+		if errc := fs1.Getattr("/h", &stat, ^uint64(0)); 0 != errc || c.size != stat.Size {
+			t.Error(c, errc, stat.Size)
+		}
+	}
+	if _, data := readstring(ufs, "/h"); "F:lower\x00\x00\x00\x00\x00" != data {
+		t.Errorf("%q", data)
+	}
+}
@@ -0,0 +1,374 @@
+/*
+ * userfs.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+// Package userfs implements a file system that presents a separate file system to each
+// user that accesses it. Operations on paths are dispatched to the file system of the
+// accessing user (as reported by fuse.Getcontext). Operations on open files are dispatched
+// to the file system that opened the file, regardless of the accessing user: the index of
+// that file system is kept in the high bits of the file handle.
+//
+// Files are reported as owned by the accessing user.
+package userfs
+
+import (
+	"sync"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/billziss-gh/hubfs/fs/nullfs"
+)
+
+const (
+	fhShift = 48
+	fhMask  = 1<<fhShift - 1
+	maxfs   = 1<<(64-fhShift) - 1 // the all-ones file handle is reserved
+)
+
+type filesystem struct {
+	newfs  func(uid uint32) fuse.FileSystemInterface
+	init   func()
+	fsmux  sync.Mutex
+	uidmap map[uint32]uint64 // uid -> index into fslist
+	fslist []fuse.FileSystemInterface
+	loads  map[uint32]chan struct{} // uid -> closed when its file system has been created
+}
+
+type Config struct {
+	// Newfs returns the file system of a user, or nil if the user has no access.
+	Newfs func(uid uint32) fuse.FileSystemInterface
+
+	// Init is called when the file system is mounted.
+	Init func()
+}
+
+func New(c Config) fuse.FileSystemInterface {
+	return &filesystem{
+		newfs:  c.Newfs,
+		init:   c.Init,
+		uidmap: make(map[uint32]uint64),
+		fslist: []fuse.FileSystemInterface{nullfs.New()},
+		loads:  make(map[uint32]chan struct{}),
+	}
+}
+
+// Function userfs returns the file system of the accessing user and its index. File
+// systems are created on first access. They are created and initialized without holding
+// fsmux, so that other users are not blocked; concurrent first accesses by the same user
+// wait for a single creation.
+func (fs *filesystem) userfs() (dstfs fuse.FileSystemInterface, idx uint64) {
+	uid, _, _ := fuse.Getcontext()
+
+	fs.fsmux.Lock()
+	for {
+		if idx, ok := fs.uidmap[uid]; ok {
+			dstfs = fs.fslist[idx]
+			fs.fsmux.Unlock()
+			return dstfs, idx
+		}
+		done := fs.loads[uid]
+		if nil == done {
+			break
+		}
+		fs.fsmux.Unlock()
+		<-done
+		fs.fsmux.Lock()
+	}
+	done := make(chan struct{})
+	fs.loads[uid] = done
+	full := maxfs <= len(fs.fslist)
+	fs.fsmux.Unlock()
+
+	var newfs fuse.FileSystemInterface
+	if !full {
+		newfs = fs.newfs(uid)
+		if nil != newfs {
+			newfs.Init()
+		}
+	}
+
+	fs.fsmux.Lock()
+	delete(fs.loads, uid)
+	if nil != newfs && maxfs > len(fs.fslist) {
+		idx = uint64(len(fs.fslist))
+		fs.fslist = append(fs.fslist, newfs)
+		newfs = nil
+	}
+	fs.uidmap[uid] = idx
+	dstfs = fs.fslist[idx]
+	fs.fsmux.Unlock()
+	close(done)
+
+	if nil != newfs {
+		// the file system table filled up while the file system was being created
+		newfs.Destroy()
+	}
+
+	return dstfs, idx
+}
+
+// Function openfs returns the file system that opened a file and the file handle within
+// that file system.
+func (fs *filesystem) openfs(fh uint64) (dstfs fuse.FileSystemInterface, dstfh uint64) {
+	if ^uint64(0) == fh {
+		dstfs, _ = fs.userfs()
+		return dstfs, fh
+	}
+
+	idx := fh >> fhShift
+	fs.fsmux.Lock()
+	if uint64(len(fs.fslist)) > idx {
+		dstfs = fs.fslist[idx]
+	} else {
+		dstfs = fs.fslist[0]
+	}
+	fs.fsmux.Unlock()
+	return dstfs, fh & fhMask
+}
+
+func wrapfh(idx uint64, fh uint64) uint64 {
+	if ^uint64(0) == fh {
+		return fh
+	}
+	return idx<<fhShift | fh
+}
+
+func setowner(stat *fuse.Stat_t) {
+	stat.Uid, stat.Gid, _ = fuse.Getcontext()
+}
+
+func (fs *filesystem) Init() {
+	if nil != fs.init {
+		fs.init()
+	}
+}
+
+func (fs *filesystem) Destroy() {
+	fs.fsmux.Lock()
+	for _, fs := range fs.fslist {
+		fs.Destroy()
+	}
+	fs.uidmap = make(map[uint32]uint64)
+	fs.fslist = fs.fslist[:1]
+	fs.fsmux.Unlock()
+}
+
+func (fs *filesystem) Statfs(path string, stat *fuse.Statfs_t) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Statfs(path, stat)
+}
+
+func (fs *filesystem) Mknod(path string, mode uint32, dev uint64) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Mknod(path, mode, dev)
+}
+
+func (fs *filesystem) Mkdir(path string, mode uint32) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Mkdir(path, mode)
+}
+
+func (fs *filesystem) Unlink(path string) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Unlink(path)
+}
+
+func (fs *filesystem) Rmdir(path string) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Rmdir(path)
+}
+
+func (fs *filesystem) Link(oldpath string, newpath string) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Link(oldpath, newpath)
+}
+
+func (fs *filesystem) Symlink(target string, newpath string) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Symlink(target, newpath)
+}
+
+func (fs *filesystem) Readlink(path string) (errc int, target string) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Readlink(path)
+}
+
+func (fs *filesystem) Rename(oldpath string, newpath string) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Rename(oldpath, newpath)
+}
+
+func (fs *filesystem) Chmod(path string, mode uint32) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Chmod(path, mode)
+}
+
+func (fs *filesystem) Chown(path string, uid uint32, gid uint32) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Chown(path, uid, gid)
+}
+
+func (fs *filesystem) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Utimens(path, tmsp)
+}
+
+func (fs *filesystem) Access(path string, mask uint32) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Access(path, mask)
+}
+
+func (fs *filesystem) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	dstfs, idx := fs.userfs()
+	errc, fh = dstfs.Create(path, flags, mode)
+	return errc, wrapfh(idx, fh)
+}
+
+func (fs *filesystem) Open(path string, flags int) (errc int, fh uint64) {
+	dstfs, idx := fs.userfs()
+	errc, fh = dstfs.Open(path, flags)
+	return errc, wrapfh(idx, fh)
+}
+
+func (fs *filesystem) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	errc = dstfs.Getattr(path, stat, fh)
+	if 0 == errc {
+		setowner(stat)
+	}
+	return
+}
+
+func (fs *filesystem) Truncate(path string, size int64, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Truncate(path, size, fh)
+}
+
+func (fs *filesystem) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Read(path, buff, ofst, fh)
+}
+
+// fallocate is implemented by file systems that can allocate space for an open file
+// (see Fallocate).
+type fallocate interface {
+	Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) int
+}
+
+func (fs *filesystem) Fallocate(path string, mode uint32, ofst int64, length int64, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	if f, ok := dstfs.(fallocate); ok {
+		return f.Fallocate(path, mode, ofst, length, fh)
+	}
+	return -fuse.ENOSYS
+}
+
+func (fs *filesystem) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Write(path, buff, ofst, fh)
+}
+
+func (fs *filesystem) Flush(path string, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Flush(path, fh)
+}
+
+func (fs *filesystem) Release(path string, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Release(path, fh)
+}
+
+func (fs *filesystem) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Fsync(path, datasync, fh)
+}
+
+func (fs *filesystem) Opendir(path string) (errc int, fh uint64) {
+	dstfs, idx := fs.userfs()
+	errc, fh = dstfs.Opendir(path)
+	return errc, wrapfh(idx, fh)
+}
+
+func (fs *filesystem) Readdir(path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
+	ofst int64,
+	fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if nil != stat {
+			s := *stat
+			stat = &s
+			setowner(stat)
+		}
+		return fill(name, stat, ofst)
+	}, ofst, fh)
+}
+
+func (fs *filesystem) Releasedir(path string, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Releasedir(path, fh)
+}
+
+func (fs *filesystem) Fsyncdir(path string, datasync bool, fh uint64) (errc int) {
+	dstfs, fh := fs.openfs(fh)
+	return dstfs.Fsyncdir(path, datasync, fh)
+}
+
+func (fs *filesystem) Setxattr(path string, name string, value []byte, flags int) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Setxattr(path, name, value, flags)
+}
+
+func (fs *filesystem) Getxattr(path string, name string) (errc int, value []byte) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Getxattr(path, name)
+}
+
+func (fs *filesystem) Removexattr(path string, name string) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Removexattr(path, name)
+}
+
+func (fs *filesystem) Listxattr(path string, fill func(name string) bool) (errc int) {
+	dstfs, _ := fs.userfs()
+	return dstfs.Listxattr(path, fill)
+}
+
+func (fs *filesystem) Chflags(path string, flags uint32) (errc int) {
+	dstfs, _ := fs.userfs()
+	intf, ok := dstfs.(fuse.FileSystemChflags)
+	if !ok {
+		return -fuse.ENOSYS
+	}
+	return intf.Chflags(path, flags)
+}
+
+func (fs *filesystem) Setcrtime(path string, tmsp fuse.Timespec) (errc int) {
+	dstfs, _ := fs.userfs()
+	intf, ok := dstfs.(fuse.FileSystemSetcrtime)
+	if !ok {
+		return -fuse.ENOSYS
+	}
+	return intf.Setcrtime(path, tmsp)
+}
+
+func (fs *filesystem) Setchgtime(path string, tmsp fuse.Timespec) (errc int) {
+	dstfs, _ := fs.userfs()
+	intf, ok := dstfs.(fuse.FileSystemSetchgtime)
+	if !ok {
+		return -fuse.ENOSYS
+	}
+	return intf.Setchgtime(path, tmsp)
+}
+
+var _ fuse.FileSystemInterface = (*filesystem)(nil)
+var _ fuse.FileSystemChflags = (*filesystem)(nil)
+var _ fuse.FileSystemSetcrtime = (*filesystem)(nil)
@@ -0,0 +1,169 @@
+/*
+ * budget.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package git
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Objects received during a fetch are retained until the packfile has been fully
+// parsed, because later objects may be deltas against them. Retained objects are
+// charged against a process-wide memory budget: objects above the spill threshold,
+// or that do not fit in the remaining budget, are staged on disk instead. New
+// fetches are held back while the budget is exhausted.
+
+var (
+	DefaultMemoryBudget   int64 = 256 << 20
+	DefaultSpillThreshold int64 = 4 << 20
+	DefaultSpillDir             = "" // os.TempDir() if empty
+)
+
+type memoryBudget struct {
+	lock  sync.Mutex
+	limit int64
+	used  int64
+	ready chan struct{} // closed when memory is released
+}
+
+var budget = &memoryBudget{
+	limit: DefaultMemoryBudget,
+	ready: make(chan struct{}),
+}
+
+// SetMemoryBudget sets the limit of the memory budget. A limit of 0 disables the budget.
+func SetMemoryBudget(limit int64) {
+	budget.lock.Lock()
+	budget.limit = limit
+	budget.notify()
+	budget.lock.Unlock()
+}
+
+// Function tryAcquire charges n bytes against the budget if they fit.
+func (b *memoryBudget) tryAcquire(n int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if 0 != b.limit && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	if 0 == n {
+		return
+	}
+	b.lock.Lock()
+	b.used -= n
+	b.notify()
+	b.lock.Unlock()
+}
+
+func (b *memoryBudget) notify() {
+	close(b.ready)
+	b.ready = make(chan struct{})
+}
+
+// Function wait blocks while the budget is exhausted.
+func (b *memoryBudget) wait(ctx context.Context) error {
+	for {
+		b.lock.Lock()
+		if 0 == b.limit || b.used < b.limit {
+			b.lock.Unlock()
+			return nil
+		}
+		ready := b.ready
+		b.lock.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// spilledObject is an encoded object whose content is staged in a file.
+type spilledObject struct {
+	hash plumbing.Hash
+	typ  plumbing.ObjectType
+	size int64
+	path string
+}
+
+func spillObject(obj plumbing.EncodedObject) (res *spilledObject, err error) {
+	reader, err := obj.Reader()
+	if nil != err {
+		return nil, err
+	}
+	defer reader.Close()
+
+	file, err := ioutil.TempFile(DefaultSpillDir, "hubfs-spill-*")
+	if nil != err {
+		return nil, err
+	}
+	_, err = io.Copy(file, reader)
+	if e := file.Close(); nil == err {
+		err = e
+	}
+	if nil != err {
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &spilledObject{
+		hash: obj.Hash(),
+		typ:  obj.Type(),
+		size: obj.Size(),
+		path: file.Name(),
+	}, nil
+}
+
+func (o *spilledObject) Hash() plumbing.Hash {
+	return o.hash
+}
+
+func (o *spilledObject) Type() plumbing.ObjectType {
+	return o.typ
+}
+
+func (o *spilledObject) SetType(t plumbing.ObjectType) {
+	o.typ = t
+}
+
+func (o *spilledObject) Size() int64 {
+	return o.size
+}
+
+func (o *spilledObject) SetSize(s int64) {
+	o.size = s
+}
+
+func (o *spilledObject) Reader() (io.ReadCloser, error) {
+	return os.Open(o.path)
+}
+
+func (o *spilledObject) Writer() (io.WriteCloser, error) {
+	return nil, os.ErrPermission
+}
+
+func (o *spilledObject) remove() {
+	os.Remove(o.path)
+}
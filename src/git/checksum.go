@@ -0,0 +1,103 @@
+/*
+ * checksum.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package git
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+)
+
+// ErrChecksum is returned when the content of a fetched object does not hash to its ID.
+var ErrChecksum = errors.New("object checksum mismatch")
+
+var objectTypeNames = map[ObjectType]string{
+	CommitObject: "commit",
+	TreeObject:   "tree",
+	BlobObject:   "blob",
+	TagObject:    "tag",
+}
+
+func newObjectHasher(ot ObjectType, size int64) hash.Hash {
+	h := sha1.New()
+	h.Write([]byte(objectTypeNames[ot] + " " + strconv.FormatInt(size, 10) + "\x00"))
+	return h
+}
+
+// Function newObjectHashers returns a hasher for the object type ot or, if ot is 0, one
+// hasher per object type.
+func newObjectHashers(ot ObjectType, size int64) []hash.Hash {
+	if _, ok := objectTypeNames[ot]; ok {
+		return []hash.Hash{newObjectHasher(ot, size)}
+	}
+	hashers := make([]hash.Hash, 0, len(objectTypeNames))
+	for t := range objectTypeNames {
+		hashers = append(hashers, newObjectHasher(t, size))
+	}
+	return hashers
+}
+
+// Function ObjectHash returns the ID of the object with the specified type and content.
+func ObjectHash(ot ObjectType, content []byte) string {
+	h := newObjectHasher(ot, int64(len(content)))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Function VerifyObject reports whether content hashes to the ID hash. If the object type
+// is not known (e.g. because the content comes from a cache that does not record it)
+// ot may be 0 and all object types are tried.
+func VerifyObject(hash string, ot ObjectType, content []byte) bool {
+	if _, ok := objectTypeNames[ot]; ok {
+		return hash == ObjectHash(ot, content)
+	}
+	for t := range objectTypeNames {
+		if hash == ObjectHash(t, content) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function VerifyBlob reports whether the size bytes read from reader hash to the ID hash
+// of a blob.
+func VerifyBlob(hash string, reader io.Reader, size int64) (bool, error) {
+	return VerifyReader(hash, BlobObject, reader, size)
+}
+
+// Function VerifyReader is like VerifyObject, but reads the size bytes of the content from
+// reader. If ot is 0 all object types are tried while reading the content once.
+func VerifyReader(hash string, ot ObjectType, reader io.Reader, size int64) (bool, error) {
+	hashers := newObjectHashers(ot, size)
+	writers := make([]io.Writer, len(hashers))
+	for i, h := range hashers {
+		writers[i] = h
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), reader)
+	if nil != err {
+		return false, err
+	}
+	if n != size {
+		return false, nil
+	}
+	for _, h := range hashers {
+		if hash == hex.EncodeToString(h.Sum(nil)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
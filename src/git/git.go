@@ -14,16 +14,25 @@
 package git
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	"strings"
+	"sync"
 	"time"
 
 	libtrace "github.com/billziss-gh/golib/trace"
+	"github.com/billziss-gh/hubfs/hooks"
 	"github.com/billziss-gh/hubfs/httputil"
+	"github.com/billziss-gh/hubfs/metrics"
+	"github.com/billziss-gh/hubfs/scrub"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/format/packfile"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
 	"github.com/go-git/go-git/v5/plumbing/storer"
 	"github.com/go-git/go-git/v5/plumbing/transport"
@@ -39,9 +48,23 @@ const (
 	TagObject    ObjectType = 4
 )
 
+// maximum number of concurrent upload-pack sessions per repository
+var DefaultMaxSessions = 4
+
+// number of objects requested by a single upload-pack negotiation
+const fetchBatchSize = 256
+
 type Repository struct {
-	session transport.UploadPackSession
-	advrefs *packp.AdvRefs
+	client   transport.Transport
+	endpoint *transport.Endpoint
+	auth     transport.AuthMethod
+	v2       map[string]string // protocol v2 capabilities (nil if the remote speaks v0)
+	advlock  sync.RWMutex
+	advrefs  *packp.AdvRefs    // protocol v0 advertised references
+	refs     map[string]string // protocol v2 refs (nil until listed)
+	caps     *capability.List  // capabilities used to fetch objects
+	sem      chan struct{}
+	idle     chan transport.UploadPackSession
 }
 
 type Signature struct {
@@ -54,6 +77,25 @@ type Commit struct {
 	Author    Signature
 	Committer Signature
 	TreeHash  string
+	Parents   []string
+	Message   string
+
+	// Armored signature (GPG, SSH or X.509) and the signed payload, which is
+	// the commit encoded without its signature. Empty if the commit is unsigned.
+	SignatureData string
+	SignedPayload []byte
+}
+
+type Tag struct {
+	Name       string
+	Tagger     Signature
+	TargetHash string
+	TargetType ObjectType
+	Message    string
+
+	// Armored signature and signed payload; see Commit.
+	SignatureData string
+	SignedPayload []byte
 }
 
 type TreeEntry struct {
@@ -62,44 +104,305 @@ type TreeEntry struct {
 	Hash string
 }
 
-func OpenRepository(remote string, token string) (res *Repository, err error) {
+// Credentials holds an auth token that is applied to every request of the repositories
+// that use it. The token can be replaced while the repositories are open; sessions that
+// are in use switch to the new token with their next request.
+type Credentials struct {
+	lock  sync.RWMutex
+	token string
+}
+
+func NewCredentials(token string) *Credentials {
+	scrub.AddSecret(token)
+	return &Credentials{token: token}
+}
+
+// Function Token returns the current auth token.
+func (cred *Credentials) Token() string {
+	cred.lock.RLock()
+	defer cred.lock.RUnlock()
+	return cred.token
+}
+
+// Function SetToken replaces the auth token.
+func (cred *Credentials) SetToken(token string) {
+	scrub.AddSecret(token)
+	cred.lock.Lock()
+	cred.token = token
+	cred.lock.Unlock()
+}
+
+func (cred *Credentials) Name() string {
+	return "http-basic-auth"
+}
+
+func (cred *Credentials) String() string {
+	return "http-basic-auth - token:*******"
+}
+
+func (cred *Credentials) SetAuth(req *nethttp.Request) {
+	if token := cred.Token(); "" != token {
+		req.SetBasicAuth(token, "x-oauth-basic")
+	}
+}
+
+var _ http.AuthMethod = (*Credentials)(nil)
+
+// Errors returned by OpenRepository when the remote repository does not exist, is empty
+// or denies access.
+var (
+	ErrRepositoryNotFound     = transport.ErrRepositoryNotFound
+	ErrEmptyRepository        = transport.ErrEmptyRemoteRepository
+	ErrAuthenticationRequired = transport.ErrAuthenticationRequired
+	ErrAuthorizationFailed    = transport.ErrAuthorizationFailed
+)
+
+// OpenRepository opens a remote repository and retrieves its advertised capabilities
+// (see protocol.go). If the remote does not speak protocol v2 all of its references are
+// retrieved as well.
+func OpenRepository(ctx context.Context, remote string, token string) (
+	res *Repository, err error) {
+	return OpenRepositoryWithCredentials(ctx, remote, NewCredentials(token))
+}
+
+// OpenRepositoryWithCredentials is like OpenRepository, but authenticates with
+// credentials that may be shared with other repositories.
+func OpenRepositoryWithCredentials(ctx context.Context, remote string, cred *Credentials) (
+	res *Repository, err error) {
+	if err = ctx.Err(); nil != err {
+		return nil, err
+	}
+
 	endpoint, err := transport.NewEndpoint(remote)
 	if nil != err {
 		return nil, err
 	}
 
 	var auth transport.AuthMethod
-	if "" != token {
-		auth = &http.BasicAuth{
-			Username: token,
-			Password: "x-oauth-basic",
-		}
+	if nil != cred {
+		auth = cred
 	}
 
-	client := http.NewClient(httputil.DefaultClient)
-	session, err := client.NewUploadPackSession(endpoint, auth)
+	v2, advrefs, err := discover(ctx, endpoint, auth)
 	if nil != err {
+		if nil != ctx.Err() {
+			err = ctx.Err()
+		}
 		return nil, err
 	}
 
-	advrefs, err := session.AdvertisedReferences()
+	res = &Repository{
+		client:   http.NewClient(httputil.DefaultClient),
+		endpoint: endpoint,
+		auth:     auth,
+		v2:       v2,
+		advrefs:  advrefs,
+		sem:      make(chan struct{}, DefaultMaxSessions),
+		idle:     make(chan transport.UploadPackSession, DefaultMaxSessions),
+	}
+	if nil != v2 {
+		res.caps = fetchCapabilities(v2)
+	} else {
+		res.caps = advrefs.Capabilities
+	}
+
+	return res, nil
+}
+
+// Function advertisedReferences retrieves the references advertised by the remote.
+// The session is closed on failure; if ctx is cancelled this happens in the background.
+func advertisedReferences(ctx context.Context, session transport.UploadPackSession) (
+	*packp.AdvRefs, error) {
+	type result struct {
+		advrefs *packp.AdvRefs
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		advrefs, err := session.AdvertisedReferences()
+		done <- result{advrefs, err}
+	}()
+
+	select {
+	case r := <-done:
+		if nil != r.err {
+			session.Close()
+			return nil, r.err
+		}
+		return r.advrefs, nil
+	case <-ctx.Done():
+		go func() {
+			<-done
+			session.Close()
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (repository *Repository) Close() (err error) {
+	for {
+		select {
+		case session := <-repository.idle:
+			if e := session.Close(); nil == err {
+				err = e
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Function getSession acquires an upload-pack session from the repository pool,
+// creating a new one if none are idle. At most DefaultMaxSessions sessions are in use.
+func (repository *Repository) getSession(ctx context.Context) (
+	session transport.UploadPackSession, err error) {
+	select {
+	case repository.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case session = <-repository.idle:
+		return session, nil
+	default:
+	}
+
+	session, err = repository.client.NewUploadPackSession(repository.endpoint, repository.auth)
 	if nil != err {
+		<-repository.sem
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Function putSession returns a session acquired by getSession to the pool.
+func (repository *Repository) putSession(session transport.UploadPackSession) {
+	select {
+	case repository.idle <- session:
+	default:
 		session.Close()
+	}
+	<-repository.sem
+}
+
+func (repository *Repository) GetRefs(ctx context.Context) (res map[string]string, err error) {
+	if err = ctx.Err(); nil != err {
 		return nil, err
 	}
 
-	return &Repository{
-		session: session,
-		advrefs: advrefs,
-	}, nil
+	repository.advlock.RLock()
+	advrefs := repository.advrefs
+	refs := repository.refs
+	repository.advlock.RUnlock()
+
+	if nil != repository.v2 {
+		if nil == refs {
+			return repository.RefreshRefs(ctx)
+		}
+		return filterRefs(refs, nil), nil
+	}
+
+	return refsMap(advrefs)
 }
 
-func (repository *Repository) Close() (err error) {
-	return repository.session.Close()
+// ProtocolVersion returns the version of the Git protocol that is used to list the
+// references of the remote (0 or 2).
+func (repository *Repository) ProtocolVersion() int {
+	if nil != repository.v2 {
+		return 2
+	}
+	return 0
 }
 
-func (repository *Repository) GetRefs() (res map[string]string, err error) {
-	stg, err := repository.advrefs.AllReferences()
+// GetRefsWithPrefixes is like GetRefs, but only reports the references whose names start
+// with one of prefixes. If the remote speaks protocol v2 and its references have not been
+// listed yet, only the matching references are retrieved from the remote.
+func (repository *Repository) GetRefsWithPrefixes(ctx context.Context, prefixes []string) (
+	res map[string]string, err error) {
+	if err = ctx.Err(); nil != err {
+		return nil, err
+	}
+
+	repository.advlock.RLock()
+	refs := repository.refs
+	repository.advlock.RUnlock()
+
+	if nil != repository.v2 && nil == refs {
+		return lsRefs(ctx, repository.endpoint, repository.auth, prefixes)
+	}
+
+	res, err = repository.GetRefs(ctx)
+	if nil != err {
+		return nil, err
+	}
+	return filterRefs(res, prefixes), nil
+}
+
+// Function filterRefs returns a copy of refs with the references whose names start with
+// one of prefixes (all references if there are no prefixes).
+func filterRefs(refs map[string]string, prefixes []string) map[string]string {
+	res := make(map[string]string, len(refs))
+	for n, h := range refs {
+		match := 0 == len(prefixes)
+		for _, p := range prefixes {
+			if strings.HasPrefix(n, p) {
+				match = true
+				break
+			}
+		}
+		if match {
+			res[n] = h
+		}
+	}
+	return res
+}
+
+// RefreshRefs retrieves the references currently advertised by the remote and
+// makes them the references reported by GetRefs.
+func (repository *Repository) RefreshRefs(ctx context.Context) (res map[string]string, err error) {
+	defer trace()(&err)
+
+	if nil != repository.v2 {
+		res, err = lsRefs(ctx, repository.endpoint, repository.auth, nil)
+		if nil != err {
+			return nil, err
+		}
+
+		repository.advlock.Lock()
+		repository.refs = res
+		repository.advlock.Unlock()
+
+		return filterRefs(res, nil), nil
+	}
+
+	session, err := repository.client.NewUploadPackSession(repository.endpoint, repository.auth)
+	if nil != err {
+		return nil, err
+	}
+
+	advrefs, err := advertisedReferences(ctx, session)
+	if nil != err {
+		return nil, err
+	}
+	session.Close()
+
+	res, err = refsMap(advrefs)
+	if nil != err {
+		return nil, err
+	}
+
+	repository.advlock.Lock()
+	repository.advrefs = advrefs
+	repository.caps = advrefs.Capabilities
+	repository.advlock.Unlock()
+
+	return res, nil
+}
+
+func refsMap(advrefs *packp.AdvRefs) (res map[string]string, err error) {
+	stg, err := advrefs.AllReferences()
 	if nil != err {
 		return nil, err
 	}
@@ -112,21 +415,54 @@ func (repository *Repository) GetRefs() (res map[string]string, err error) {
 	return res, nil
 }
 
-type storemap map[plumbing.Hash]plumbing.EncodedObject
+// storemap holds the objects of a packfile while it is parsed; see budget.go.
+type storemap struct {
+	objs    map[plumbing.Hash]plumbing.EncodedObject
+	charged int64
+	spilled []*spilledObject
+}
+
+func newStoremap() *storemap {
+	return &storemap{
+		objs: make(map[plumbing.Hash]plumbing.EncodedObject),
+	}
+}
+
+func (m *storemap) close() {
+	budget.release(m.charged)
+	m.charged = 0
+	for _, s := range m.spilled {
+		s.remove()
+	}
+	m.spilled = nil
+	m.objs = nil
+}
 
-func (m storemap) NewEncodedObject() plumbing.EncodedObject {
+func (m *storemap) NewEncodedObject() plumbing.EncodedObject {
 	return &plumbing.MemoryObject{}
 }
 
-func (m storemap) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+func (m *storemap) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
 	hash := obj.Hash()
-	m[hash] = obj
+	size := obj.Size()
+	if DefaultSpillThreshold >= size && budget.tryAcquire(size) {
+		m.charged += size
+		m.objs[hash] = obj
+		return hash, nil
+	}
+
+	spilled, err := spillObject(obj)
+	if nil != err {
+		return plumbing.ZeroHash, err
+	}
+	m.spilled = append(m.spilled, spilled)
+	m.objs[hash] = spilled
 	return hash, nil
 }
 
-func (m storemap) EncodedObject(typ plumbing.ObjectType, hash plumbing.Hash) (
+func (m *storemap) EncodedObject(typ plumbing.ObjectType, hash plumbing.Hash) (
 	plumbing.EncodedObject, error) {
-	obj, ok := m[hash]
+	obj, ok := m.objs[hash]
 	if !ok || (plumbing.AnyObject != typ && obj.Type() != typ) {
 		return nil, plumbing.ErrObjectNotFound
 	}
@@ -134,9 +470,9 @@ func (m storemap) EncodedObject(typ plumbing.ObjectType, hash plumbing.Hash) (
 	return obj, nil
 }
 
-func (m storemap) IterEncodedObjects(typ plumbing.ObjectType) (storer.EncodedObjectIter, error) {
-	lst := make([]plumbing.EncodedObject, 0, len(m))
-	for _, obj := range m {
+func (m *storemap) IterEncodedObjects(typ plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	lst := make([]plumbing.EncodedObject, 0, len(m.objs))
+	for _, obj := range m.objs {
 		if plumbing.AnyObject == typ || obj.Type() == typ {
 			lst = append(lst, obj)
 		}
@@ -144,16 +480,16 @@ func (m storemap) IterEncodedObjects(typ plumbing.ObjectType) (storer.EncodedObj
 	return storer.NewEncodedObjectSliceIter(lst), nil
 }
 
-func (m storemap) HasEncodedObject(hash plumbing.Hash) error {
-	_, ok := m[hash]
+func (m *storemap) HasEncodedObject(hash plumbing.Hash) error {
+	_, ok := m.objs[hash]
 	if !ok {
 		return plumbing.ErrObjectNotFound
 	}
 	return nil
 }
 
-func (m storemap) EncodedObjectSize(hash plumbing.Hash) (int64, error) {
-	obj, ok := m[hash]
+func (m *storemap) EncodedObjectSize(hash plumbing.Hash) (int64, error) {
+	obj, ok := m.objs[hash]
 	if !ok {
 		return 0, plumbing.ErrObjectNotFound
 	}
@@ -175,26 +511,47 @@ func (obs *observer) OnInflatedObjectHeader(ot plumbing.ObjectType, objSize int6
 }
 
 func (obs *observer) OnInflatedObjectContent(h plumbing.Hash, pos int64, crc uint32, content []byte) error {
-	return obs.fn(h.String(), obs.ot, content)
+	// the type of a deltified object is the delta type; VerifyObject then tries all types
+	hash := h.String()
+	if !VerifyObject(hash, obs.ot, content) {
+		return ErrChecksum
+	}
+	return obs.fn(hash, obs.ot, content)
 }
 
 func (obs *observer) OnFooter(h plumbing.Hash) error {
 	return nil
 }
 
-func (repository *Repository) fetchObjects(wants []string,
+func (repository *Repository) fetchObjects(ctx context.Context, wants []string,
 	fn func(hash string, ot ObjectType, content []byte) error) (err error) {
 	defer trace(len(wants))(&err)
 
-	req := packp.NewUploadPackRequestFromCapabilities(repository.advrefs.Capabilities)
+	// hold back new fetches while the memory budget is exhausted
+	err = budget.wait(ctx)
+	if nil != err {
+		return err
+	}
+
+	session, err := repository.getSession(ctx)
+	if nil != err {
+		return err
+	}
+	defer repository.putSession(session)
+
+	repository.advlock.RLock()
+	caps := repository.caps
+	repository.advlock.RUnlock()
+
+	req := packp.NewUploadPackRequestFromCapabilities(caps)
 
 	if nil == req.Capabilities.Set("shallow") {
 		req.Depth = packp.DepthCommits(1)
 	}
-	if repository.advrefs.Capabilities.Supports("no-progress") {
+	if caps.Supports("no-progress") {
 		req.Capabilities.Set("no-progress")
 	}
-	if repository.advrefs.Capabilities.Supports("filter") {
+	if caps.Supports("filter") {
 		req.Capabilities.Set("filter")
 		req.Filter = "tree:0"
 	}
@@ -204,7 +561,7 @@ func (repository *Repository) fetchObjects(wants []string,
 		req.Wants[i] = plumbing.NewHash(w)
 	}
 
-	rsp, err := repository.session.UploadPack(context.Background(), req)
+	rsp, err := session.UploadPack(ctx, req)
 	if nil != err {
 		return err
 	}
@@ -221,7 +578,8 @@ func (repository *Repository) fetchObjects(wants []string,
 	}
 
 	scn := packfile.NewScanner(reader)
-	stg := storemap{}
+	stg := newStoremap()
+	defer stg.close()
 	obs := &observer{fn: fn}
 	parser, err := packfile.NewParserWithStorage(scn, stg, obs)
 	if nil != err {
@@ -236,21 +594,70 @@ func (repository *Repository) fetchObjects(wants []string,
 	return nil
 }
 
-func (repository *Repository) FetchObjects(wants []string,
+// FetchObjects fetches the wanted objects and reports them to fn.
+// Large requests are split into batches that are negotiated concurrently over
+// the repository session pool; calls to fn are serialized. FetchObjects may be
+// called concurrently. Cancelling ctx aborts the fetch and releases the
+// underlying connections.
+func (repository *Repository) FetchObjects(ctx context.Context, wants []string,
 	fn func(hash string, ot ObjectType, content []byte) error) (err error) {
+	defer metrics.StartFetch()()
+	defer func(ctx context.Context) {
+		if nil != err && nil == ctx.Err() {
+			hooks.Fire(hooks.FetchError, map[string]string{
+				"remote": scrub.String(repository.endpoint.String()),
+				"error":  scrub.String(err.Error()),
+			})
+		}
+	}(ctx)
+
+	if fetchBatchSize >= len(wants) {
+		if err = ctx.Err(); nil != err {
+			return err
+		}
+		return repository.fetchObjects(ctx, wants, fn)
+	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var fnmux, errmux sync.Mutex
+	sfn := func(hash string, ot ObjectType, content []byte) error {
+		fnmux.Lock()
+		defer fnmux.Unlock()
+		return fn(hash, ot, content)
+	}
+
+	var wg sync.WaitGroup
 	for i, j := 0, 0; len(wants) > i; i = j {
-		j = i + 256
+		if nil != ctx.Err() {
+			break
+		}
+		j = i + fetchBatchSize
 		if len(wants) < j {
 			j = len(wants)
 		}
-		err = repository.fetchObjects(wants[i:j], fn)
-		if nil != err {
-			return err
-		}
+		wg.Add(1)
+		go func(w []string) {
+			defer wg.Done()
+			e := repository.fetchObjects(ctx, w, sfn)
+			if nil != e {
+				errmux.Lock()
+				if nil == err {
+					err = e
+					cancel()
+				}
+				errmux.Unlock()
+			}
+		}(wants[i:j])
 	}
+	wg.Wait()
 
-	return nil
+	if nil == err {
+		err = ctx.Err()
+	}
+
+	return err
 }
 
 func DecodeCommit(content []byte) (res *Commit, err error) {
@@ -274,10 +681,86 @@ func DecodeCommit(content []byte) (res *Commit, err error) {
 			Time:  c.Committer.When,
 		},
 		TreeHash: c.TreeHash.String(),
+		Message:  c.Message,
+	}
+	for _, h := range c.ParentHashes {
+		res.Parents = append(res.Parents, h.String())
+	}
+	if "" != c.PGPSignature {
+		res.SignatureData = c.PGPSignature
+		res.SignedPayload, err = encodeWithoutSignature(c.EncodeWithoutSignature)
+		if nil != err {
+			res = nil
+		}
 	}
 	return
 }
 
+func DecodeTag(content []byte) (res *Tag, err error) {
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(plumbing.TagObject)
+	obj.Write(content)
+	t := &object.Tag{}
+	err = t.Decode(obj)
+	if nil != err {
+		return
+	}
+	res = &Tag{
+		Name: t.Name,
+		Tagger: Signature{
+			Name:  t.Tagger.Name,
+			Email: t.Tagger.Email,
+			Time:  t.Tagger.When,
+		},
+		TargetHash: t.Target.String(),
+		TargetType: ObjectType(t.TargetType),
+		Message:    t.Message,
+	}
+	if "" != t.PGPSignature {
+		res.SignatureData = t.PGPSignature
+		res.SignedPayload, err = encodeWithoutSignature(t.EncodeWithoutSignature)
+		if nil != err {
+			res = nil
+		}
+	}
+	return
+}
+
+func encodeWithoutSignature(encode func(o plumbing.EncodedObject) error) ([]byte, error) {
+	obj := &plumbing.MemoryObject{}
+	err := encode(obj)
+	if nil != err {
+		return nil, err
+	}
+	reader, err := obj.Reader()
+	if nil != err {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// IsTagContent reports whether content is that of an annotated tag object.
+// Tag objects start with an "object" header, whereas commits start with "tree".
+func IsTagContent(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("object "))
+}
+
+// SignatureType returns the kind of an armored signature: "gpg", "ssh", "x509"
+// or "" if the signature is not recognized.
+func SignatureType(sig string) string {
+	switch {
+	case strings.HasPrefix(sig, "-----BEGIN PGP SIGNATURE-----"):
+		return "gpg"
+	case strings.HasPrefix(sig, "-----BEGIN SSH SIGNATURE-----"):
+		return "ssh"
+	case strings.HasPrefix(sig, "-----BEGIN SIGNED MESSAGE-----"),
+		strings.HasPrefix(sig, "-----BEGIN PKCS7-----"):
+		return "x509"
+	}
+	return ""
+}
+
 func DecodeTree(content []byte) (res []*TreeEntry, err error) {
 	obj := &plumbing.MemoryObject{}
 	obj.SetType(plumbing.TreeObject)
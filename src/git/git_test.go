@@ -14,11 +14,22 @@
 package git
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/billziss-gh/golib/keyring"
 	libtrace "github.com/billziss-gh/golib/trace"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
 )
 
 const remote = "https://github.com/winfsp/hubfs"
@@ -30,13 +41,13 @@ const hash1 = "609d3b892764952ef69676e653e06b2ca904be18"
 var token string
 
 func TestGetRefs(t *testing.T) {
-	repository, err := OpenRepository(remote, token)
+	repository, err := OpenRepository(context.Background(), remote, token)
 	if nil != err {
 		t.Error(err)
 	}
 	defer repository.Close()
 
-	refs, err := repository.GetRefs()
+	refs, err := repository.GetRefs(context.Background())
 	if nil != err {
 		t.Error(err)
 	}
@@ -51,7 +62,7 @@ func TestGetRefs(t *testing.T) {
 		t.Error()
 	}
 
-	refs, err = repository.GetRefs()
+	refs, err = repository.GetRefs(context.Background())
 	if nil != err {
 		t.Error(err)
 	}
@@ -67,8 +78,22 @@ func TestGetRefs(t *testing.T) {
 	}
 }
 
+func TestOpenRepositoryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	repository, err := OpenRepository(ctx, remote, token)
+	if context.Canceled != err {
+		t.Error(err)
+	}
+	if nil != repository {
+		repository.Close()
+		t.Error()
+	}
+}
+
 func TestFetchObjects(t *testing.T) {
-	repository, err := OpenRepository(remote, token)
+	repository, err := OpenRepository(context.Background(), remote, token)
 	if nil != err {
 		t.Error(err)
 	}
@@ -80,7 +105,7 @@ func TestFetchObjects(t *testing.T) {
 	}
 	found0 := false
 	found1 := false
-	err = repository.FetchObjects(wants,
+	err = repository.FetchObjects(context.Background(), wants,
 		func(hash string, ot ObjectType, content []byte) error {
 			if hash0 == hash {
 				found0 = true
@@ -109,7 +134,7 @@ func TestFetchObjects(t *testing.T) {
 		hash0,
 	}
 	found0 = false
-	err = repository.FetchObjects(wants,
+	err = repository.FetchObjects(context.Background(), wants,
 		func(hash string, ot ObjectType, content []byte) error {
 			if hash0 == hash {
 				found0 = true
@@ -131,7 +156,7 @@ func TestFetchObjects(t *testing.T) {
 		hash1,
 	}
 	found1 = false
-	err = repository.FetchObjects(wants,
+	err = repository.FetchObjects(context.Background(), wants,
 		func(hash string, ot ObjectType, content []byte) error {
 			if hash1 == hash {
 				found1 = true
@@ -150,6 +175,384 @@ func TestFetchObjects(t *testing.T) {
 	}
 }
 
+func TestFetchObjectsConcurrent(t *testing.T) {
+	repository, err := OpenRepository(context.Background(), remote, token)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer repository.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; 8 > i; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found := false
+			err := repository.FetchObjects(context.Background(), []string{hash1},
+				func(hash string, ot ObjectType, content []byte) error {
+					if hash1 == hash {
+						found = true
+					}
+					return nil
+				})
+			if nil != err {
+				t.Error(err)
+			}
+			if !found {
+				t.Error()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkFetchObjectsParallel(b *testing.B) {
+	repository, err := OpenRepository(context.Background(), remote, token)
+	if nil != err {
+		b.Fatal(err)
+	}
+	defer repository.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := repository.FetchObjects(context.Background(), []string{hash1},
+				func(hash string, ot ObjectType, content []byte) error {
+					return nil
+				})
+			if nil != err {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func TestDecodeTag(t *testing.T) {
+	content := "object " + hash0 + "\n" +
+		"type commit\n" +
+		"tag v1.0\n" +
+		"tagger Tagger <tagger@example.com> 1600000000 +0000\n" +
+		"\n" +
+		"Release v1.0\n" +
+		"-----BEGIN PGP SIGNATURE-----\n" +
+		"\n" +
+		"iQEzBAABCAAdFiEE\n" +
+		"-----END PGP SIGNATURE-----\n"
+
+	if !IsTagContent([]byte(content)) {
+		t.Error()
+	}
+
+	tag, err := DecodeTag([]byte(content))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "v1.0" != tag.Name || hash0 != tag.TargetHash || CommitObject != tag.TargetType {
+		t.Error(tag)
+	}
+	if "Tagger" != tag.Tagger.Name || "tagger@example.com" != tag.Tagger.Email {
+		t.Error(tag.Tagger)
+	}
+	if "gpg" != SignatureType(tag.SignatureData) {
+		t.Error(tag.SignatureData)
+	}
+	if bytes.Contains(tag.SignedPayload, []byte("PGP SIGNATURE")) ||
+		!bytes.Contains(tag.SignedPayload, []byte("Release v1.0")) {
+		t.Error(string(tag.SignedPayload))
+	}
+}
+
+func TestDecodeCommitSignature(t *testing.T) {
+	content := "tree " + hash1 + "\n" +
+		"author Author <author@example.com> 1600000000 +0000\n" +
+		"committer Committer <committer@example.com> 1600000000 +0000\n" +
+		"gpgsig -----BEGIN SSH SIGNATURE-----\n" +
+		" U1NIU0lH\n" +
+		" -----END SSH SIGNATURE-----\n" +
+		"\n" +
+		"Commit message\n"
+
+	if IsTagContent([]byte(content)) {
+		t.Error()
+	}
+
+	commit, err := DecodeCommit([]byte(content))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if hash1 != commit.TreeHash {
+		t.Error(commit.TreeHash)
+	}
+	if "ssh" != SignatureType(commit.SignatureData) {
+		t.Error(commit.SignatureData)
+	}
+	if bytes.Contains(commit.SignedPayload, []byte("gpgsig")) ||
+		!bytes.Contains(commit.SignedPayload, []byte("Commit message")) {
+		t.Error(string(commit.SignedPayload))
+	}
+}
+
+func TestVerifyGPG(t *testing.T) {
+	entity, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile("", "verify-test-*")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	err = entity.Serialize(file)
+	file.Close()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	payload := []byte("tree " + hash1 + "\n\nCommit message\n")
+	var sig bytes.Buffer
+	err = openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader(payload), nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "gpg" != SignatureType(sig.String()) {
+		t.Fatal(sig.String())
+	}
+
+	policy, err := LoadTrustPolicy(file.Name(), "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	signer, err := policy.Verify(sig.String(), payload)
+	if nil != err || "Signer <signer@example.com>" != signer {
+		t.Error(signer, err)
+	}
+	if _, err = policy.Verify(sig.String(), append(payload, '.')); nil == err {
+		t.Error()
+	}
+
+	policy, _ = LoadTrustPolicy("", "")
+	if _, err = policy.Verify(sig.String(), payload); ErrUntrustedSigner != err {
+		t.Error(err)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	b := &memoryBudget{limit: 100, ready: make(chan struct{})}
+
+	if !b.tryAcquire(60) {
+		t.Error()
+	}
+	if b.tryAcquire(60) {
+		t.Error()
+	}
+	if !b.tryAcquire(40) {
+		t.Error()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.wait(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Error()
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(40)
+	if err := <-done; nil != err {
+		t.Error(err)
+	}
+
+	b.tryAcquire(40)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx); context.DeadlineExceeded != err {
+		t.Error(err)
+	}
+}
+
+func TestSpillObject(t *testing.T) {
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(plumbing.BlobObject)
+	obj.Write([]byte("spilled content"))
+
+	s := newStoremap()
+	threshold := DefaultSpillThreshold
+	DefaultSpillThreshold = 4
+	hash, err := s.SetEncodedObject(obj)
+	DefaultSpillThreshold = threshold
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(s.spilled) || 0 != s.charged {
+		t.Error()
+	}
+
+	o, err := s.EncodedObject(plumbing.BlobObject, hash)
+	if nil != err {
+		t.Fatal(err)
+	}
+	reader, err := o.Reader()
+	if nil != err {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if nil != err || "spilled content" != string(content) {
+		t.Error(err, content)
+	}
+
+	path := s.spilled[0].path
+	s.close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	cred := NewCredentials("")
+	req, _ := http.NewRequest("GET", remote, nil)
+	cred.SetAuth(req)
+	if _, _, ok := req.BasicAuth(); ok {
+		t.Error()
+	}
+
+	cred.SetToken("T1")
+	req, _ = http.NewRequest("GET", remote, nil)
+	cred.SetAuth(req)
+	if u, p, ok := req.BasicAuth(); !ok || "T1" != u || "x-oauth-basic" != p {
+		t.Error(u, p, ok)
+	}
+
+	cred.SetToken("T2")
+	req, _ = http.NewRequest("GET", remote, nil)
+	cred.SetAuth(req)
+	if u, _, _ := req.BasicAuth(); "T2" != u || "T2" != cred.Token() {
+		t.Error(u)
+	}
+}
+
+func TestObjectHash(t *testing.T) {
+	const emptyBlob = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+	const helloBlob = "ce013625030ba8dba906f756967f9e9ca394464a"
+	const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+	if h := ObjectHash(BlobObject, nil); emptyBlob != h {
+		t.Error(h)
+	}
+	if h := ObjectHash(BlobObject, []byte("hello\n")); helloBlob != h {
+		t.Error(h)
+	}
+
+	if !VerifyObject(helloBlob, BlobObject, []byte("hello\n")) ||
+		VerifyObject(helloBlob, BlobObject, []byte("hullo\n")) ||
+		VerifyObject(helloBlob, TreeObject, []byte("hello\n")) {
+		t.Error()
+	}
+	if !VerifyObject(emptyTree, 0, nil) || !VerifyObject(emptyBlob, 0, nil) ||
+		VerifyObject(helloBlob, 0, nil) {
+		t.Error()
+	}
+
+	if ok, err := VerifyBlob(helloBlob, bytes.NewReader([]byte("hello\n")), 6); !ok || nil != err {
+		t.Error(ok, err)
+	}
+	if ok, _ := VerifyBlob(helloBlob, bytes.NewReader([]byte("hello")), 6); ok {
+		t.Error()
+	}
+	if ok, _ := VerifyBlob(helloBlob, bytes.NewReader([]byte("hello\n!")), 6); ok {
+		t.Error()
+	}
+	if ok, err := VerifyReader(emptyTree, 0, bytes.NewReader(nil), 0); !ok || nil != err {
+		t.Error(ok, err)
+	}
+	if ok, _ := VerifyReader(emptyTree, BlobObject, bytes.NewReader(nil), 0); ok {
+		t.Error()
+	}
+}
+
+func TestProtocolV2(t *testing.T) {
+	refs := map[string]string{
+		"refs/heads/master": hash0,
+		"refs/heads/main":   hash1,
+		"refs/tags/v1.0":    hash0,
+	}
+
+	v2 := false
+	lsrefs := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		enc := pktline.NewEncoder(&buf)
+		switch {
+		case "GET" == req.Method && v2 && "version=2" == req.Header.Get("Git-Protocol"):
+			enc.EncodeString("# service=git-upload-pack\n")
+			enc.Flush()
+			enc.EncodeString("version 2\n", "ls-refs\n", "fetch=shallow filter\n")
+			enc.Flush()
+		case "GET" == req.Method:
+			enc.EncodeString("# service=git-upload-pack\n")
+			enc.Flush()
+			enc.EncodeString(
+				hash0+" refs/heads/master\x00side-band-64k ofs-delta\n",
+				hash1+" refs/heads/main\n",
+				hash0+" refs/tags/v1.0\n")
+			enc.Flush()
+		case v2:
+			lsrefs++
+			body, _ := ioutil.ReadAll(req.Body)
+			prefixes := []string{}
+			for _, l := range strings.Split(string(body), "\n") {
+				if i := strings.Index(l, "ref-prefix "); -1 != i {
+					prefixes = append(prefixes, l[i+len("ref-prefix "):])
+				}
+			}
+			for n, h := range filterRefs(refs, prefixes) {
+				enc.EncodeString(h + " " + n + "\n")
+			}
+			enc.Flush()
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	for _, v2 = range []bool{false, true} {
+		repository, err := OpenRepository(context.Background(), server.URL+"/owner/repo", "")
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		if v2 && 2 != repository.ProtocolVersion() || !v2 && 0 != repository.ProtocolVersion() {
+			t.Error(v2, repository.ProtocolVersion())
+		}
+		if v2 && (!repository.caps.Supports("shallow") || !repository.caps.Supports("filter")) {
+			t.Error(repository.caps)
+		}
+
+		m, err := repository.GetRefsWithPrefixes(context.Background(), []string{"refs/heads/main"})
+		if nil != err || 1 != len(m) || hash1 != m["refs/heads/main"] {
+			t.Error(err, m)
+		}
+		m, err = repository.GetRefs(context.Background())
+		if nil != err || 3 != len(m) || hash0 != m["refs/tags/v1.0"] {
+			t.Error(err, m)
+		}
+		m, err = repository.GetRefsWithPrefixes(context.Background(), []string{"refs/tags/"})
+		if nil != err || 1 != len(m) || hash0 != m["refs/tags/v1.0"] {
+			t.Error(err, m)
+		}
+
+		repository.Close()
+	}
+
+	// the refs are only listed with ls-refs until all refs have been listed
+	if 2 != lsrefs {
+		t.Error(lsrefs)
+	}
+}
+
 func TestMain(m *testing.M) {
 	libtrace.Verbose = true
 	libtrace.Pattern = "github.com/billziss-gh/hubfs/*"
@@ -0,0 +1,168 @@
+/*
+ * protocol.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package git
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	nethttp "net/http"
+	"strings"
+
+	"github.com/billziss-gh/hubfs/httputil"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// Git protocol v2 is requested when a repository is opened. A server that speaks v2
+// answers with its capabilities rather than with all of its refs, which may be tens of
+// thousands in busy repositories; refs are then listed with the ls-refs command, which
+// can be restricted to ref name prefixes. Objects are always fetched with protocol v0,
+// which a v2 server continues to support in stateless HTTP requests.
+
+// Function discover requests the capability advertisement of the remote. If the remote
+// speaks protocol v2 it returns the v2 capabilities (e.g. "fetch" -> "shallow filter"),
+// otherwise it returns the protocol v0 advertised references.
+func discover(ctx context.Context, endpoint *transport.Endpoint, auth transport.AuthMethod) (
+	v2 map[string]string, advrefs *packp.AdvRefs, err error) {
+
+	req, err := nethttp.NewRequest("GET",
+		endpoint.String()+"/info/refs?service="+transport.UploadPackServiceName, nil)
+	if nil != err {
+		return nil, nil, err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	content, err := doRequest(ctx, req, auth)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	scn := pktline.NewScanner(bytes.NewReader(content))
+	if scn.Scan() && bytes.HasPrefix(scn.Bytes(), []byte("# service=")) {
+		// the service line and its flush-pkt precede the v0 and (optionally) v2 advertisement
+		if scn.Scan() {
+			scn.Scan()
+		}
+	}
+	if "version 2" == strings.TrimSuffix(string(scn.Bytes()), "\n") {
+		v2 = make(map[string]string)
+		for scn.Scan() && 0 != len(scn.Bytes()) {
+			kv := strings.SplitN(strings.TrimSuffix(string(scn.Bytes()), "\n"), "=", 2)
+			if 2 == len(kv) {
+				v2[kv[0]] = kv[1]
+			} else {
+				v2[kv[0]] = ""
+			}
+		}
+		if nil != scn.Err() {
+			return nil, nil, scn.Err()
+		}
+		return v2, nil, nil
+	}
+
+	advrefs = packp.NewAdvRefs()
+	err = advrefs.Decode(bytes.NewReader(content))
+	if nil != err {
+		if packp.ErrEmptyAdvRefs == err {
+			err = transport.ErrEmptyRemoteRepository
+		}
+		return nil, nil, err
+	}
+	transport.FilterUnsupportedCapabilities(advrefs.Capabilities)
+
+	return nil, advrefs, nil
+}
+
+// Function lsRefs lists the refs of a protocol v2 remote whose names start with one of
+// prefixes (all refs if there are no prefixes).
+func lsRefs(ctx context.Context, endpoint *transport.Endpoint, auth transport.AuthMethod,
+	prefixes []string) (res map[string]string, err error) {
+
+	var body bytes.Buffer
+	enc := pktline.NewEncoder(&body)
+	enc.EncodeString("command=ls-refs\n")
+	body.WriteString("0001") // delim-pkt
+	for _, p := range prefixes {
+		enc.EncodeString("ref-prefix " + p + "\n")
+	}
+	enc.Flush()
+
+	req, err := nethttp.NewRequest("POST",
+		endpoint.String()+"/"+transport.UploadPackServiceName, &body)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Content-Type", "application/x-"+transport.UploadPackServiceName+"-request")
+	req.Header.Set("Accept", "application/x-"+transport.UploadPackServiceName+"-result")
+	content, err := doRequest(ctx, req, auth)
+	if nil != err {
+		return nil, err
+	}
+
+	res = make(map[string]string)
+	scn := pktline.NewScanner(bytes.NewReader(content))
+	for scn.Scan() && 0 != len(scn.Bytes()) {
+		// <oid> SP <refname> *(SP <ref-attribute>) LF
+		fields := strings.Fields(string(scn.Bytes()))
+		if 2 <= len(fields) {
+			res[fields[1]] = fields[0]
+		}
+	}
+	if nil != scn.Err() {
+		return nil, scn.Err()
+	}
+
+	return res, nil
+}
+
+func doRequest(ctx context.Context, req *nethttp.Request, auth transport.AuthMethod) (
+	[]byte, error) {
+	req.Header.Set("User-Agent", "git/1.0")
+	if a, ok := auth.(http.AuthMethod); ok {
+		a.SetAuth(req)
+	}
+
+	rsp, err := httputil.DefaultClient.Do(req.WithContext(ctx))
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	err = http.NewErr(rsp)
+	if nil != err {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(rsp.Body)
+}
+
+// Function fetchCapabilities returns the protocol v0 capabilities that are used to fetch
+// objects from a protocol v2 remote. Every server that speaks v2 supports these; shallow
+// and filter are supported if the v2 fetch command supports them.
+func fetchCapabilities(v2 map[string]string) *capability.List {
+	caps := capability.NewList()
+	caps.Set(capability.Sideband64k)
+	caps.Set(capability.OFSDelta)
+	caps.Set(capability.NoProgress)
+	for _, f := range strings.Fields(v2["fetch"]) {
+		switch f {
+		case "shallow", "filter":
+			caps.Set(capability.Capability(f))
+		}
+	}
+	return caps
+}
@@ -0,0 +1,250 @@
+/*
+ * verify.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrUnknownSignature = errors.New("unknown signature type")
+var ErrUntrustedSigner = errors.New("signer is not trusted")
+
+// TrustPolicy holds the keys that are trusted to sign commits and tags.
+// GPG signatures are checked against an OpenPGP keyring and SSH signatures
+// against an allowed signers file in the format used by ssh-keygen(1).
+type TrustPolicy struct {
+	keyring openpgp.EntityList
+	signers []allowedSigner
+}
+
+type allowedSigner struct {
+	principals string
+	key        ssh.PublicKey
+}
+
+// LoadTrustPolicy loads a trust policy. Either path may be empty.
+func LoadTrustPolicy(keyringPath string, signersPath string) (res *TrustPolicy, err error) {
+	res = &TrustPolicy{}
+
+	if "" != keyringPath {
+		res.keyring, err = readKeyring(keyringPath)
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	if "" != signersPath {
+		res.signers, err = readAllowedSigners(signersPath)
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func readKeyring(path string) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+	if bytes.Contains(content, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(content))
+}
+
+func readAllowedSigners(path string) (res []allowedSigner, err error) {
+	file, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if -1 == i {
+			continue
+		}
+
+		// the remainder of the line has the authorized_keys format: [options] keytype key [comment]
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line[i+1:]))
+		if nil != err {
+			return nil, err
+		}
+		if !allowedNamespace(options, "git") {
+			continue
+		}
+
+		res = append(res, allowedSigner{
+			principals: line[:i],
+			key:        key,
+		})
+	}
+
+	return res, scanner.Err()
+}
+
+func allowedNamespace(options []string, namespace string) bool {
+	for _, o := range options {
+		if strings.HasPrefix(o, "namespaces=") {
+			v := strings.Trim(strings.TrimPrefix(o, "namespaces="), `"`)
+			for _, n := range strings.Split(v, ",") {
+				if namespace == n {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks an armored signature over payload and returns the identity of
+// the signer if the signature is valid and was made by a trusted key.
+func (policy *TrustPolicy) Verify(signature string, payload []byte) (signer string, err error) {
+	switch SignatureType(signature) {
+	case "gpg":
+		return policy.verifyGPG(signature, payload)
+	case "ssh":
+		return policy.verifySSH(signature, payload)
+	default:
+		return "", ErrUnknownSignature
+	}
+}
+
+func (policy *TrustPolicy) verifyGPG(signature string, payload []byte) (string, error) {
+	if 0 == len(policy.keyring) {
+		return "", ErrUntrustedSigner
+	}
+
+	entity, err := openpgp.CheckArmoredDetachedSignature(
+		policy.keyring, bytes.NewReader(payload), strings.NewReader(signature), nil)
+	if nil != err {
+		return "", err
+	}
+
+	for name := range entity.Identities {
+		return name, nil
+	}
+	return entity.PrimaryKey.KeyIdString(), nil
+}
+
+// SSH signature blob; see PROTOCOL.sshsig in the OpenSSH sources
+type sshSignature struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Signature []byte
+}
+
+type sshSignedData struct {
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Hash      []byte
+}
+
+const sshsigMagic = "SSHSIG"
+
+func (policy *TrustPolicy) verifySSH(signature string, payload []byte) (string, error) {
+	blob, err := unarmorSSH(signature)
+	if nil != err {
+		return "", err
+	}
+	if !bytes.HasPrefix(blob, []byte(sshsigMagic)) {
+		return "", ErrUnknownSignature
+	}
+
+	var sig sshSignature
+	err = ssh.Unmarshal(blob[len(sshsigMagic):], &sig)
+	if nil != err {
+		return "", err
+	}
+	if 1 != sig.Version || "git" != sig.Namespace {
+		return "", ErrUnknownSignature
+	}
+
+	var h hash.Hash
+	switch sig.HashAlg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", ErrUnknownSignature
+	}
+	h.Write(payload)
+
+	key, err := ssh.ParsePublicKey(sig.PublicKey)
+	if nil != err {
+		return "", err
+	}
+
+	var s ssh.Signature
+	err = ssh.Unmarshal(sig.Signature, &s)
+	if nil != err {
+		return "", err
+	}
+
+	data := append([]byte(sshsigMagic), ssh.Marshal(sshSignedData{
+		Namespace: sig.Namespace,
+		Reserved:  sig.Reserved,
+		HashAlg:   sig.HashAlg,
+		Hash:      h.Sum(nil),
+	})...)
+	err = key.Verify(data, &s)
+	if nil != err {
+		return "", err
+	}
+
+	marshaled := key.Marshal()
+	for _, a := range policy.signers {
+		if bytes.Equal(marshaled, a.key.Marshal()) {
+			return a.principals, nil
+		}
+	}
+	return "", ErrUntrustedSigner
+}
+
+func unarmorSSH(signature string) ([]byte, error) {
+	var b strings.Builder
+	for _, line := range strings.Split(signature, "\n") {
+		line = strings.TrimSpace(line)
+		if "" == line || strings.HasPrefix(line, "-----") {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return base64.StdEncoding.DecodeString(b.String())
+}
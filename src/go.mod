@@ -3,10 +3,17 @@ module github.com/billziss-gh/hubfs
 go 1.14
 
 require (
+	filippo.io/age v1.0.0
+	github.com/ProtonMail/go-crypto v0.0.0-20210428141323-04723f9f07d7
 	github.com/billziss-gh/cgofuse v1.5.0
 	github.com/billziss-gh/golib v0.2.0
+	github.com/billziss-gh/hubfs/fs/unionfs v0.0.0-00010101000000-000000000000
 	github.com/cli/oauth v0.8.0
 	github.com/go-git/go-git/v5 v5.2.0
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/text v0.3.3
 )
 
 replace github.com/go-git/go-git/v5 v5.2.0 => github.com/billziss-gh/go-git/v5 v5.2.1-0.20210325075736-c1624bffeb12
+
+replace github.com/billziss-gh/hubfs/fs/unionfs => ./fs/unionfs
@@ -0,0 +1,231 @@
+/*
+ * hooks.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+// Package hooks runs user configured actions when events occur in a mount, so that
+// mounts can be integrated with notifications and automation. An action is either a
+// command, which is run with the event in its environment, or an http(s) URL, to which
+// the event is posted as JSON. Actions run one at a time in the background, in the order
+// of their events.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	libtrace "github.com/billziss-gh/golib/trace"
+)
+
+// Events that hooks can be configured for.
+const (
+	Mount         = "mount"          // the file system is mounted and ready
+	Unmount       = "unmount"        // the file system is unmounted
+	RefUpdate     = "ref-update"     // a branch was created, updated or deleted on the server
+	FetchError    = "fetch-error"    // objects could not be fetched from the server
+	Quota         = "quota"          // the cache directory has reached the quota
+	CorruptObject = "corrupt-object" // a cached object does not match its ID
+	Any           = "*"              // all events
+)
+
+var events = []string{Mount, Unmount, RefUpdate, FetchError, Quota, CorruptObject, Any}
+
+// time that an action may run before it is cancelled
+const actionTimeout = 30 * time.Second
+
+// maximum number of events that are waiting for their actions to run
+const queueSize = 256
+
+// Event describes an event. Vars holds event specific values, such as "remote" or "ref".
+type Event struct {
+	Name string            `json:"event"`
+	Time time.Time         `json:"time"`
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+type hook struct {
+	event  string
+	action string
+}
+
+var (
+	lock    sync.RWMutex
+	hooks   []hook
+	once    sync.Once
+	queue   chan Event
+	pending sync.WaitGroup
+)
+
+// Function Add adds a hook from a specification of the form EVENT:ACTION.
+func Add(spec string) error {
+	i := strings.IndexByte(spec, ':')
+	if -1 == i || "" == spec[i+1:] {
+		return fmt.Errorf("invalid hook: %s", spec)
+	}
+	event, action := spec[:i], spec[i+1:]
+	if !isEvent(event) {
+		return fmt.Errorf("invalid hook event: %s (valid events: %s)",
+			event, strings.Join(events, ", "))
+	}
+
+	lock.Lock()
+	hooks = append(hooks, hook{event, action})
+	lock.Unlock()
+	return nil
+}
+
+func isEvent(event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Function Enabled reports whether any hooks are configured for an event.
+func Enabled(event string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, h := range hooks {
+		if h.event == event || Any == h.event {
+			return true
+		}
+	}
+	return false
+}
+
+// Function Fire queues the actions of the hooks that are configured for an event. If the
+// queue is full the event is dropped.
+func Fire(event string, vars map[string]string) {
+	if !Enabled(event) {
+		return
+	}
+
+	once.Do(func() {
+		queue = make(chan Event, queueSize)
+		go run()
+	})
+
+	pending.Add(1)
+	select {
+	case queue <- Event{Name: event, Time: time.Now(), Vars: vars}:
+	default:
+		pending.Done()
+		tracef("event=%s !dropped", event)
+	}
+}
+
+// Function Wait waits until the actions of the events fired so far have run.
+func Wait() {
+	pending.Wait()
+}
+
+func run() {
+	for e := range queue {
+		lock.RLock()
+		list := append([]hook(nil), hooks...)
+		lock.RUnlock()
+
+		for _, h := range list {
+			if h.event == e.Name || Any == h.event {
+				err := runAction(h.action, e)
+				if nil != err {
+					tracef("event=%s action=%q: %v", e.Name, h.action, err)
+				}
+			}
+		}
+		pending.Done()
+	}
+}
+
+func runAction(action string, e Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(action, "http://") || strings.HasPrefix(action, "https://") {
+		return post(ctx, action, e)
+	}
+	return execute(ctx, action, e)
+}
+
+// Function post posts an event as JSON to a webhook URL.
+func post(ctx context.Context, url string, e Event) error {
+	body, err := json.Marshal(&e)
+	if nil != err {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if nil != err {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		return err
+	}
+	rsp.Body.Close()
+	if 200 > rsp.StatusCode || 300 <= rsp.StatusCode {
+		return errors.New("HTTP " + rsp.Status)
+	}
+	return nil
+}
+
+// Function execute runs a command with the shell. The event is passed in the environment
+// as HUBFS_EVENT, HUBFS_TIME and a HUBFS_NAME variable for each of its vars.
+func execute(ctx context.Context, command string, e Event) error {
+	var cmd *exec.Cmd
+	if "windows" == runtime.GOOS {
+		cmd = exec.CommandContext(ctx, "cmd", "/c", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), Environ(e)...)
+	out, err := cmd.CombinedOutput()
+	if nil != err && 0 != len(out) {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+// Function Environ returns the environment variables that describe an event to a command.
+func Environ(e Event) []string {
+	env := []string{
+		"HUBFS_EVENT=" + e.Name,
+		"HUBFS_TIME=" + e.Time.UTC().Format(time.RFC3339),
+	}
+	names := make([]string, 0, len(e.Vars))
+	for n := range e.Vars {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		env = append(env,
+			"HUBFS_"+strings.ToUpper(strings.ReplaceAll(n, "-", "_"))+"="+e.Vars[n])
+	}
+	return env
+}
+
+func tracef(form string, vals ...interface{}) {
+	libtrace.Tracef(1, form, vals...)
+}
@@ -0,0 +1,134 @@
+/*
+ * hooks_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package hooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetHooks() {
+	lock.Lock()
+	hooks = nil
+	lock.Unlock()
+}
+
+func TestAdd(t *testing.T) {
+	defer resetHooks()
+
+	for _, spec := range []string{"", "mount", "mount:", "bogus:true", ":true"} {
+		if err := Add(spec); nil == err {
+			t.Errorf("Add(%q) succeeded", spec)
+		}
+	}
+
+	if Enabled(Mount) {
+		t.Error()
+	}
+	if err := Add("mount:https://example.com/hook?a=b"); nil != err {
+		t.Error(err)
+	}
+	if !Enabled(Mount) || Enabled(Quota) {
+		t.Error()
+	}
+	if err := Add("*:true"); nil != err {
+		t.Error(err)
+	}
+	if !Enabled(Quota) {
+		t.Error()
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	e := Event{
+		Name: RefUpdate,
+		Time: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		Vars: map[string]string{"ref": "refs/heads/main", "remote-url": "x"},
+	}
+	env := strings.Join(Environ(e), "\n")
+	expect := "HUBFS_EVENT=ref-update\n" +
+		"HUBFS_TIME=2022-01-02T03:04:05Z\n" +
+		"HUBFS_REF=refs/heads/main\n" +
+		"HUBFS_REMOTE_URL=x"
+	if expect != env {
+		t.Errorf("got %q", env)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if "windows" == runtime.GOOS {
+		t.Skip("requires /bin/sh")
+	}
+	defer resetHooks()
+
+	dir, err := ioutil.TempDir("", "hooks_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out")
+
+	Add(FetchError + `:echo "$HUBFS_EVENT $HUBFS_REMOTE" >> "` + path + `"`)
+	Fire(Mount, nil)
+	Fire(FetchError, map[string]string{"remote": "https://example.com/a/b"})
+	Fire(FetchError, map[string]string{"remote": "https://example.com/c/d"})
+	Wait()
+
+	out, err := ioutil.ReadFile(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	expect := "fetch-error https://example.com/a/b\nfetch-error https://example.com/c/d\n"
+	if expect != string(out) {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	defer resetHooks()
+
+	events := make(chan Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		if "POST" != r.Method || "application/json" != r.Header.Get("Content-Type") {
+			t.Errorf("method=%s content-type=%s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&e); nil != err {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer server.Close()
+
+	Add("*:" + server.URL)
+	Fire(Quota, map[string]string{"quota": "1024"})
+	Wait()
+
+	select {
+	case e := <-events:
+		if Quota != e.Name || "1024" != e.Vars["quota"] || e.Time.IsZero() {
+			t.Errorf("got %#v", e)
+		}
+	default:
+		t.Error("no event")
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * chaos.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package httputil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChaosEnv is the environment variable that enables fault injection (see ParseChaos).
+const ChaosEnv = "HUBFS_CHAOS"
+
+// ErrChaosDrop is the error reported for connections dropped by fault injection.
+var ErrChaosDrop = errors.New("chaos: connection dropped")
+
+// ChaosConfig determines the faults that are injected into HTTP requests. Probabilities
+// are in the range [0, 1].
+type ChaosConfig struct {
+	Latency   time.Duration // maximum latency added to a request
+	RateLimit float64       // probability of a rate limit (HTTP 429) response
+	Truncate  float64       // probability of a packfile response truncated within 64KB
+	Drop      float64       // probability of a dropped connection
+	Seed      int64         // random seed; 0 uses the current time
+}
+
+// Function ParseChaos parses a fault injection specification of the form
+// "latency=500ms,ratelimit=0.1,truncate=0.05,drop=0.05,seed=1".
+func ParseChaos(spec string) (c ChaosConfig, err error) {
+	for _, s := range strings.Split(spec, ",") {
+		if "" == s {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		if 2 != len(kv) {
+			return ChaosConfig{}, fmt.Errorf("invalid chaos option: %s", s)
+		}
+		switch kv[0] {
+		case "latency":
+			c.Latency, err = time.ParseDuration(kv[1])
+		case "ratelimit":
+			c.RateLimit, err = parseProbability(kv[1])
+		case "truncate":
+			c.Truncate, err = parseProbability(kv[1])
+		case "drop":
+			c.Drop, err = parseProbability(kv[1])
+		case "seed":
+			c.Seed, err = strconv.ParseInt(kv[1], 10, 64)
+		default:
+			err = errors.New("unknown option")
+		}
+		if nil != err {
+			return ChaosConfig{}, fmt.Errorf("invalid chaos option: %s: %v", s, err)
+		}
+	}
+	return
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if nil == err && (0 > p || 1 < p) {
+		err = errors.New("probability out of range")
+	}
+	return p, err
+}
+
+// Function EnableChaos injects faults into the requests of DefaultClient. It must be
+// called before DefaultClient is used. Faults are injected below the retry logic, so
+// that retries and the recovery of higher layers are exercised.
+func EnableChaos(c ChaosConfig) {
+	t := DefaultClient.Transport.(*transport)
+	t.RoundTripper = NewChaosTransport(t.RoundTripper, c)
+}
+
+// Function NewChaosTransport returns a transport that injects faults into the requests
+// made through rt.
+func NewChaosTransport(rt http.RoundTripper, c ChaosConfig) http.RoundTripper {
+	seed := c.Seed
+	if 0 == seed {
+		seed = time.Now().UnixNano()
+	}
+	return &chaosTransport{
+		RoundTripper: rt,
+		config:       c,
+		rand:         rand.New(rand.NewSource(seed)),
+	}
+}
+
+type chaosTransport struct {
+	http.RoundTripper
+	config ChaosConfig
+	mux    sync.Mutex
+	rand   *rand.Rand
+}
+
+func (t *chaosTransport) float64() float64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.rand.Float64()
+}
+
+func (t *chaosTransport) int63n(n int64) int64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.rand.Int63n(n)
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if 0 < t.config.Latency {
+		d := time.Duration(t.int63n(int64(t.config.Latency)))
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if t.config.Drop > t.float64() {
+		if nil != req.Body {
+			req.Body.Close()
+		}
+		return nil, ErrChaosDrop
+	}
+
+	if t.config.RateLimit > t.float64() {
+		if nil != req.Body {
+			req.Body.Close()
+		}
+		header := http.Header{}
+		header.Set("Retry-After", "1")
+		header.Set("X-RateLimit-Remaining", "0")
+		return &http.Response{
+			Status:     "429 Too Many Requests",
+			StatusCode: 429,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+
+	rsp, err := t.RoundTripper.RoundTrip(req)
+	if nil != err {
+		return rsp, err
+	}
+
+	if 200 == rsp.StatusCode &&
+		"application/x-git-upload-pack-result" == rsp.Header.Get("Content-Type") &&
+		t.config.Truncate > t.float64() {
+		n := int64(64 * 1024)
+		if 0 < rsp.ContentLength && n > rsp.ContentLength {
+			n = rsp.ContentLength
+		}
+		rsp.Body = &chaosBody{ReadCloser: rsp.Body, rem: t.int63n(n)}
+	}
+
+	return rsp, nil
+}
+
+// Type chaosBody is a response body that fails with a dropped connection after rem bytes.
+type chaosBody struct {
+	io.ReadCloser
+	rem int64
+}
+
+func (b *chaosBody) Read(p []byte) (n int, err error) {
+	if 0 >= b.rem {
+		return 0, ErrChaosDrop
+	}
+	if int64(len(p)) > b.rem {
+		p = p[:b.rem]
+	}
+	n, err = b.ReadCloser.Read(p)
+	b.rem -= int64(n)
+	return
+}
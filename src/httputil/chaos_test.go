@@ -0,0 +1,129 @@
+/*
+ * chaos_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package httputil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	c, err := ParseChaos("latency=500ms,ratelimit=0.1,truncate=0.05,drop=1,seed=42")
+	if nil != err {
+		t.Fatal(err)
+	}
+	exp := ChaosConfig{
+		Latency:   500 * time.Millisecond,
+		RateLimit: 0.1,
+		Truncate:  0.05,
+		Drop:      1,
+		Seed:      42,
+	}
+	if exp != c {
+		t.Error(c)
+	}
+
+	for _, spec := range []string{"drop", "drop=2", "latency=x", "other=1"} {
+		if _, err := ParseChaos(spec); nil == err {
+			t.Error(spec)
+		}
+	}
+}
+
+func TestChaosTransport(t *testing.T) {
+	body := strings.Repeat("PACK", 32*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	get := func(c ChaosConfig) (int, string, error) {
+		client := &http.Client{Transport: NewChaosTransport(http.DefaultTransport, c)}
+		rsp, err := client.Get(srv.URL)
+		if nil != err {
+			return 0, "", err
+		}
+		defer rsp.Body.Close()
+		b, err := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(b), err
+	}
+
+	if code, b, err := get(ChaosConfig{}); nil != err || 200 != code || body != b {
+		t.Error(code, err)
+	}
+
+	if _, _, err := get(ChaosConfig{Drop: 1}); nil == err {
+		t.Error()
+	}
+
+	if code, _, err := get(ChaosConfig{RateLimit: 1}); nil != err || 429 != code {
+		t.Error(code, err)
+	}
+
+	code, b, err := get(ChaosConfig{Truncate: 1, Seed: 1})
+	if ErrChaosDrop != err || 200 != code || len(body) <= len(b) || !strings.HasPrefix(body, b) {
+		t.Error(code, len(b), err)
+	}
+
+	start := time.Now()
+	if _, _, err := get(ChaosConfig{Latency: 50 * time.Millisecond, Seed: 1}); nil != err {
+		t.Error(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error()
+	}
+}
+
+func TestChaosRetry(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	sleep := DefaultSleep
+	DefaultSleep = time.Millisecond
+	defer func() { DefaultSleep = sleep }()
+
+	client := &http.Client{
+		Transport: &transport{
+			RoundTripper: NewChaosTransport(http.DefaultTransport, ChaosConfig{RateLimit: 0.5, Seed: 1}),
+		},
+	}
+	for i := 0; 10 > i; i++ {
+		rsp, err := client.Post(srv.URL, "text/plain", strings.NewReader("body"))
+		if nil != err {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if 200 != rsp.StatusCode {
+			t.Error(rsp.StatusCode)
+		}
+	}
+	for _, b := range bodies {
+		if "body" != b {
+			t.Error(b)
+		}
+	}
+	if 10 != len(bodies) {
+		t.Error(len(bodies))
+	}
+}
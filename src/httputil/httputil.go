@@ -14,6 +14,8 @@
 package httputil
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 	"time"
 
@@ -21,16 +23,76 @@ import (
 )
 
 var (
-	DefaultRetryCount = 10
-	DefaultSleep      = time.Second
-	DefaultMaxSleep   = time.Second * 30
-	DefaultClient     = &http.Client{
+	DefaultRetryCount      = 10
+	DefaultSleep           = time.Second
+	DefaultMaxSleep        = time.Second * 30
+	DefaultMaxConnsPerHost = 16
+	DefaultClient          = &http.Client{
 		Transport: &transport{
-			RoundTripper: http.DefaultTransport,
+			RoundTripper: newPooledTransport(DefaultTransportConfig()),
 		},
 	}
 )
 
+// TransportConfig contains the connection settings of DefaultClient, which is used for
+// both API and Git requests.
+type TransportConfig struct {
+	HTTP2           bool          // negotiate HTTP/2 where available
+	MaxConnsPerHost int           // number of idle connections kept per host
+	KeepAlive       time.Duration // TCP keepalive period (0: no keepalives)
+	IdleTimeout     time.Duration // idle connections are closed after this time (0: never)
+}
+
+// Function DefaultTransportConfig returns the default connection settings.
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		HTTP2:           true,
+		MaxConnsPerHost: DefaultMaxConnsPerHost,
+		KeepAlive:       30 * time.Second,
+		IdleTimeout:     90 * time.Second,
+	}
+}
+
+// Function ConfigureTransport replaces the connections of DefaultClient with ones that
+// use the settings c. It must be called before any requests are made and before
+// EnableChaos.
+func ConfigureTransport(c TransportConfig) {
+	t := DefaultClient.Transport.(*transport)
+	t.RoundTripper = newPooledTransport(c)
+}
+
+// Function newPooledTransport returns a transport that keeps enough idle
+// connections per host to serve concurrent fetches from the same server and
+// that negotiates HTTP/2 where available, so that requests are multiplexed.
+// Idle connections are kept alive and are closed after c.IdleTimeout, so that
+// bursts of requests reuse connections without a TLS handshake each.
+func newPooledTransport(c TransportConfig) http.RoundTripper {
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return http.DefaultTransport
+	}
+	t = t.Clone()
+	keepalive := c.KeepAlive
+	if 0 == keepalive {
+		keepalive = -1 // net.Dialer uses a default period for 0
+	}
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: keepalive,
+	}).DialContext
+	t.ForceAttemptHTTP2 = c.HTTP2
+	if !c.HTTP2 {
+		// a non-nil empty map disables HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	t.MaxIdleConnsPerHost = c.MaxConnsPerHost
+	if t.MaxIdleConns < c.MaxConnsPerHost {
+		t.MaxIdleConns = c.MaxConnsPerHost
+	}
+	t.IdleConnTimeout = c.IdleTimeout
+	return t
+}
+
 type transport struct {
 	http.RoundTripper
 }
@@ -41,16 +103,30 @@ func (t *transport) RoundTrip(req *http.Request) (rsp *http.Response, err error)
 		retry.Backoff(DefaultSleep, DefaultMaxSleep),
 		func(i int) bool {
 
-			rsp, err = t.RoundTripper.RoundTrip(req)
+			r := req
+			if 0 < i && nil != req.Body {
+				// resend the body consumed by the previous attempt
+				body, e := req.GetBody()
+				if nil != e {
+					return false
+				}
+				r = req.Clone(req.Context())
+				r.Body = body
+			}
+
+			rsp, err = t.RoundTripper.RoundTrip(r)
 
-			// retry on connection errors without body
+			// retry on connection errors if the body can be resent
 			if nil != err {
-				return nil == req.Body
+				return (nil == req.Body || nil != req.GetBody) && nil == req.Context().Err()
 			}
 
-			// retry on HTTP 429, 503, 509
+			// retry on HTTP 429, 503, 509 if the body can be resent
 			switch rsp.StatusCode {
 			case 429, 503, 509:
+				if nil != req.Body && nil == req.GetBody {
+					return false
+				}
 				rsp.Body.Close()
 				return true
 			}
@@ -0,0 +1,76 @@
+/*
+ * httputil_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package httputil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPooledTransport(t *testing.T) {
+	c := DefaultTransportConfig()
+	c.HTTP2 = false
+	c.MaxConnsPerHost = 200
+	c.IdleTimeout = 100 * time.Millisecond
+	rt := newPooledTransport(c).(*http.Transport)
+	defer rt.CloseIdleConnections()
+	if rt.ForceAttemptHTTP2 || nil == rt.TLSNextProto ||
+		200 != rt.MaxIdleConnsPerHost || 200 > rt.MaxIdleConns {
+		t.Error()
+	}
+
+	var lock sync.Mutex
+	addrs := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		addrs[req.RemoteAddr]++
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: rt}
+	get := func() {
+		rsp, err := client.Get(server.URL)
+		if nil != err {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+	}
+
+	// requests in a burst reuse the same connection
+	for i := 0; 3 > i; i++ {
+		get()
+	}
+	lock.Lock()
+	n := len(addrs)
+	lock.Unlock()
+	if 1 != n {
+		t.Error(addrs)
+	}
+
+	// idle connections are closed after IdleTimeout
+	time.Sleep(300 * time.Millisecond)
+	get()
+	lock.Lock()
+	n = len(addrs)
+	lock.Unlock()
+	if 2 != n {
+		t.Error(addrs)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * image.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// Type imageFormat describes how a read-only file system image is created from a
+// directory by an external tool.
+type imageFormat struct {
+	tool string
+	args func(source string, target string) []string
+}
+
+var imageFormats = map[string]imageFormat{
+	"squashfs": {"mksquashfs", func(source string, target string) []string {
+		return []string{source, target, "-noappend", "-all-root", "-no-progress"}
+	}},
+	"erofs": {"mkfs.erofs", func(source string, target string) []string {
+		return []string{"--all-root", target, source}
+	}},
+}
+
+var imageFormatNames = []string{"squashfs", "erofs"}
+
+// Function image creates a read-only file system image of the tree at path
+// (owner/repo/ref[/dir], relative to the remote) in the file target. The tree is first
+// exported to a staging directory (see export), which is then converted by mksquashfs or
+// mkfs.erofs.
+func image(client providers.Client, prefix string, format string, path string, target string,
+	config []string) int {
+
+	f := imageFormats[format]
+	tool, err := exec.LookPath(f.tool)
+	if nil != err {
+		warn("image error: %s is required to create %s images", f.tool, format)
+		return 1
+	}
+	if _, err := os.Lstat(target); nil == err {
+		warn("image error: %s: already exists", target)
+		return 1
+	}
+
+	staging, err := ioutil.TempDir("", "hubfs-image")
+	if nil != err {
+		warn("image error: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(staging)
+	root := filepath.Join(staging, "root")
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	client.StartExpiration()
+	defer client.StopExpiration()
+
+	stats, err := exportTree(ctx, client, prefix, path, root, config)
+	if nil != err {
+		warn("image error: %v", err)
+		return 1
+	}
+
+	cmd := exec.CommandContext(ctx, tool, f.args(root, target)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if nil == err && nil != ctx.Err() {
+		err = errors.New("interrupted")
+	}
+	if nil != err {
+		os.Remove(target)
+		warn("image error: %s: %v", f.tool, err)
+		return 1
+	}
+
+	fmt.Printf("%s: %s image of %d files, %d directories, %d symlinks\n",
+		target, format, stats.Files, stats.Dirs, stats.Symlinks)
+	return 0
+}
@@ -21,14 +21,24 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 	"github.com/billziss-gh/golib/keyring"
 	libtrace "github.com/billziss-gh/golib/trace"
 	"github.com/billziss-gh/hubfs/fs/hubfs"
+	"github.com/billziss-gh/hubfs/fs/macfs"
 	"github.com/billziss-gh/hubfs/fs/port"
+	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/fs/userfs"
+	"github.com/billziss-gh/hubfs/hooks"
+	"github.com/billziss-gh/hubfs/httputil"
 	"github.com/billziss-gh/hubfs/providers"
+	"github.com/billziss-gh/hubfs/scrub"
 )
 
 var (
@@ -44,7 +54,7 @@ var progname = strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
 func warn(format string, a ...interface{}) {
 	format = "%s: " + format + "\n"
 	a = append([]interface{}{progname}, a...)
-	fmt.Fprintf(os.Stderr, format, a...)
+	fmt.Fprint(os.Stderr, scrub.String(fmt.Sprintf(format, a...)))
 }
 
 type optlist []string
@@ -84,10 +94,131 @@ func authNewClientWithKey(provider providers.Provider, authkey string) (
 	return
 }
 
-func mount(client providers.Client, prefix string, mntpnt string, config []string) bool {
+func mount(client providers.Client, newclient func(uid uint32) providers.Client,
+	remote string, prefix string, mntpnt string, config []string) bool {
+	refenc := hubfs.RefEncodingPlus
+	unorm := unionfs.UnormNone
+	mangle := "windows" == runtime.GOOS
+	quota := int64(0)
+	cmtime := false
+	artifacts := false
+	issues := false
+	pmverify := false
+	pmsorted := false
+	macmeta, hasmacmeta := macfs.Deny, false
+	trash := false
+	multiuser := false
+	auditpath, auditfmt := "", ""
+	tracepath := ""
+	pprofaddr := ""
+	intr := false
+	recoverstale := false
 	mntopt := []string{}
 	for _, s := range config {
-		mntopt = append(mntopt, "-o"+s)
+		var err error
+		switch {
+		case strings.HasPrefix(s, "config.refenc="):
+			refenc, err = hubfs.ParseRefEncoding(strings.TrimPrefix(s, "config.refenc="))
+		case strings.HasPrefix(s, "config.unorm="):
+			unorm, err = unionfs.ParseUnorm(strings.TrimPrefix(s, "config.unorm="))
+		case strings.HasPrefix(s, "config.mangle="):
+			mangle = "1" == strings.TrimPrefix(s, "config.mangle=")
+		case strings.HasPrefix(s, "config.mtime="):
+			switch strings.TrimPrefix(s, "config.mtime=") {
+			case "ref":
+				cmtime = false
+			case "commit":
+				cmtime = true
+			default:
+				err = fmt.Errorf("invalid config.mtime value: %s", strings.TrimPrefix(s, "config.mtime="))
+			}
+		case strings.HasPrefix(s, "config.artifacts="):
+			artifacts = "1" == strings.TrimPrefix(s, "config.artifacts=")
+		case strings.HasPrefix(s, "config.issues="):
+			issues = "1" == strings.TrimPrefix(s, "config.issues=")
+		case strings.HasPrefix(s, "config.macmeta="):
+			v := strings.TrimPrefix(s, "config.macmeta=")
+			if "off" == v {
+				hasmacmeta = false
+			} else if macmeta, hasmacmeta = macfs.ParseMode(v); !hasmacmeta {
+				err = fmt.Errorf("invalid config.macmeta value: %s", v)
+			}
+		case strings.HasPrefix(s, "config.trash="):
+			switch strings.TrimPrefix(s, "config.trash=") {
+			case "delete":
+				trash = false
+			case "mount":
+				trash = true
+			default:
+				err = fmt.Errorf("invalid config.trash value: %s", strings.TrimPrefix(s, "config.trash="))
+			}
+		case strings.HasPrefix(s, "config.pmverify="):
+			pmverify = "1" == strings.TrimPrefix(s, "config.pmverify=")
+		case strings.HasPrefix(s, "config.pmsorted="):
+			pmsorted = "1" == strings.TrimPrefix(s, "config.pmsorted=")
+		case strings.HasPrefix(s, "config.audit="):
+			auditpath = strings.TrimPrefix(s, "config.audit=")
+		case strings.HasPrefix(s, "config.auditfmt="):
+			auditfmt = strings.TrimPrefix(s, "config.auditfmt=")
+		case strings.HasPrefix(s, "config.trace="):
+			tracepath = strings.TrimPrefix(s, "config.trace=")
+		case strings.HasPrefix(s, "config.pprof="):
+			pprofaddr = strings.TrimPrefix(s, "config.pprof=")
+		case strings.HasPrefix(s, "config.quota="):
+			quota, err = providers.ParseSize(strings.TrimPrefix(s, "config.quota="))
+		case strings.HasPrefix(s, "config.hook="):
+			err = hooks.Add(strings.TrimPrefix(s, "config.hook="))
+		case isHTTPConfig(s):
+			// see httpConfig
+		case strings.HasPrefix(s, "config.recover="):
+			recoverstale = "1" == strings.TrimPrefix(s, "config.recover=")
+		case strings.HasPrefix(s, "config.multiuser="):
+			multiuser = "1" == strings.TrimPrefix(s, "config.multiuser=")
+			if multiuser && "windows" == runtime.GOOS {
+				err = fmt.Errorf("config.multiuser is not supported on Windows")
+			}
+		default:
+			err = checkWinfspOption(s)
+			intr = intr || "intr" == s
+			mntopt = append(mntopt, "-o"+s)
+		}
+		if nil != err {
+			warn("config error: %v", err)
+			return false
+		}
+	}
+
+	var auditlog *hubfs.AuditLog
+	if "" != auditpath {
+		file, err := os.OpenFile(auditpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if nil == err {
+			defer file.Close()
+			auditlog, err = hubfs.NewAuditLog(file, auditfmt, MyProductVersion)
+		}
+		if nil != err {
+			warn("config error: %v", err)
+			return false
+		}
+	}
+
+	var accesstrace *hubfs.AccessTrace
+	if "" != tracepath {
+		file, err := os.OpenFile(tracepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if nil != err {
+			warn("config error: %v", err)
+			return false
+		}
+		defer file.Close()
+		accesstrace = hubfs.NewAccessTrace(file)
+	}
+
+	if "" != pprofaddr {
+		stop, err := serveDiag(pprofaddr)
+		if nil != err {
+			warn("config error: %v", err)
+			return false
+		}
+		defer stop()
 	}
 
 	caseins := false
@@ -95,33 +226,232 @@ func mount(client providers.Client, prefix string, mntpnt string, config []strin
 		caseins = true
 	}
 
-	if caseins {
-		client.SetConfig([]string{"config._caseins=1"})
+	// see config.hook
+	hookvars := map[string]string{"remote": remote, "mountpoint": mntpnt}
+	mounted := int32(0)
+	ready := func() {
+		atomic.StoreInt32(&mounted, 1)
+		hooks.Fire(hooks.Mount, hookvars)
+	}
+	defer func() {
+		if 1 == atomic.LoadInt32(&mounted) {
+			hooks.Fire(hooks.Unmount, hookvars)
+		}
+		hooks.Wait()
+	}()
+
+	var host *fuse.FileSystemHost
+	newfs := func(client providers.Client, init func()) fuse.FileSystemInterface {
+		if caseins {
+			client.SetConfig([]string{"config._caseins=1"})
+		} else {
+			client.SetConfig([]string{"config._caseins=0"})
+		}
+		switch unorm {
+		case unionfs.UnormNFC:
+			client.SetConfig([]string{"config._unorm=nfc"})
+		case unionfs.UnormNFD:
+			client.SetConfig([]string{"config._unorm=nfd"})
+		}
+		client.StartExpiration()
+
+		trashdir := ""
+		if trash {
+			trashdir = filepath.Join(client.GetDirectory(), ".trash")
+		}
+
+		fs := hubfs.New(hubfs.Config{
+			Client:  client,
+			Remote:  remote,
+			Prefix:  prefix,
+			Caseins: caseins,
+			Overlay: true,
+			Notify: func(path string, action uint32) {
+				host.Notify(path, action)
+			},
+			RefEncoding: refenc,
+			Unorm:       unorm,
+			Mangle:      mangle,
+			Quota:       quota,
+			CommitTime:  cmtime,
+			Artifacts:   artifacts,
+			Issues:      issues,
+			VerifyPaths: pmverify,
+			SortPaths:   pmsorted,
+			Collide: func(path string) {
+				warn("path key collision: %s", path)
+			},
+			AuditLog:    auditlog,
+			AccessTrace: accesstrace,
+			TrashDir:    trashdir,
+			Interrupts:  intr,
+			Init:        init,
+		})
+		if hasmacmeta {
+			fs = macfs.New(macfs.Config{Fs: fs, Mode: macmeta})
+		}
+		return fs
+	}
+
+	var fs fuse.FileSystemInterface
+	if multiuser {
+		// each user gets a file system with its own client; see config.multiuser
+		var clientmux sync.Mutex
+		clients := []providers.Client{}
+		defer func() {
+			clientmux.Lock()
+			for _, client := range clients {
+				client.StopExpiration()
+			}
+			clientmux.Unlock()
+		}()
+		fs = userfs.New(userfs.Config{
+			Newfs: func(uid uint32) fuse.FileSystemInterface {
+				client := newclient(uid)
+				if nil == client {
+					return nil
+				}
+				clientmux.Lock()
+				clients = append(clients, client)
+				clientmux.Unlock()
+				return newfs(client, nil)
+			},
+			Init: ready,
+		})
+
+		// ownership is reported per user and attributes must not be shared among users
+		useropt := []string{
+			"-oallow_other", "-oattr_timeout=0", "-oentry_timeout=0", "-onegative_timeout=0"}
+		for _, s := range mntopt {
+			if !strings.HasPrefix(s, "-ouid=") && !strings.HasPrefix(s, "-ogid=") {
+				useropt = append(useropt, s)
+			}
+		}
+		mntopt = useropt
 	} else {
-		client.SetConfig([]string{"config._caseins=0"})
-	}
-	client.StartExpiration()
-	defer client.StopExpiration()
-
-	fs := hubfs.New(hubfs.Config{
-		Client:  client,
-		Prefix:  prefix,
-		Caseins: caseins,
-		Overlay: true,
-	})
-	host := fuse.NewFileSystemHost(fs)
+		fs = newfs(client, ready)
+		defer client.StopExpiration()
+		mntopt = append(mntopt, attrTimeoutOptions(client)...)
+	}
+	// a previous mount that crashed leaves a mountpoint that cannot be mounted on
+	if recoverstale && isStaleMountpoint(mntpnt) {
+		if err := unmountStale(mntpnt); nil != err {
+			warn("stale mountpoint %s: %v", mntpnt, err)
+		} else {
+			warn("stale mountpoint %s: unmounted", mntpnt)
+		}
+	}
+
+	host = fuse.NewFileSystemHost(fs)
 	host.SetCapCaseInsensitive(caseins)
 	host.SetCapReaddirPlus(true)
 	return host.Mount(mntpnt, mntopt)
 }
 
+// Function attrTimeoutOptions returns the mount options that set the time for which the OS
+// caches file attributes, as determined by the cache policy of the client (see
+// providers.CacheAttrs).
+func attrTimeoutOptions(client providers.Client) []string {
+	s, ok := client.(providers.CachePolicySetter)
+	if !ok {
+		return nil
+	}
+	ttl := s.CachePolicy().LayerPolicy("", "", providers.CacheAttrs).TTL
+	if 0 >= ttl {
+		return nil
+	}
+	if "windows" == runtime.GOOS {
+		return []string{fmt.Sprintf("-oFileInfoTimeout=%d", ttl.Milliseconds())}
+	}
+	sec := strconv.FormatFloat(ttl.Seconds(), 'f', -1, 64)
+	return []string{"-oattr_timeout=" + sec, "-oentry_timeout=" + sec}
+}
+
+// WinFsp mount options that tune the caching and concurrency of the WinFsp FUSE layer and
+// the least value that each accepts. Timeouts are in milliseconds; -1 caches indefinitely.
+var winfspOptions = map[string]int{
+	"FileInfoTimeout":   -1,
+	"DirInfoTimeout":    -1,
+	"VolumeInfoTimeout": -1,
+	"EaTimeout":         -1,
+	"ThreadCount":       0,
+	"KeepFileCache":     0,
+}
+
+// Function checkWinfspOption checks the value of a WinFsp mount option. It fails for
+// WinFsp options on other OSes, where FUSE would otherwise reject them as unknown.
+func checkWinfspOption(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	min, ok := winfspOptions[kv[0]]
+	if !ok {
+		return nil
+	}
+	if "windows" != runtime.GOOS {
+		return fmt.Errorf("%s is only supported on Windows", kv[0])
+	}
+	if "KeepFileCache" == kv[0] {
+		if 2 == len(kv) {
+			return fmt.Errorf("invalid %s value: %s", kv[0], kv[1])
+		}
+		return nil
+	}
+	if 2 != len(kv) {
+		return fmt.Errorf("%s requires a value", kv[0])
+	}
+	if n, err := strconv.Atoi(kv[1]); nil != err || min > n {
+		return fmt.Errorf("invalid %s value: %s", kv[0], kv[1])
+	}
+	return nil
+}
+
+// Function isHTTPConfig reports whether s is a connection setting; see httpConfig.
+func isHTTPConfig(s string) bool {
+	return strings.HasPrefix(s, "config.http2=") ||
+		strings.HasPrefix(s, "config.conns=") ||
+		strings.HasPrefix(s, "config.keepalive=") ||
+		strings.HasPrefix(s, "config.idletimeout=")
+}
+
+// Function httpConfig returns the connection settings in the mount options. These apply
+// to all requests, so they are parsed before the client is created rather than with
+// the other config.* options.
+func httpConfig(mntopt []string) (c httputil.TransportConfig, err error) {
+	c = httputil.DefaultTransportConfig()
+	for _, m := range mntopt {
+		for _, s := range strings.Split(m, ",") {
+			if !isHTTPConfig(s) {
+				continue
+			}
+			i := strings.Index(s, "=")
+			k, v := s[:i], s[i+1:]
+			switch k {
+			case "config.http2":
+				c.HTTP2 = "1" == v
+			case "config.conns":
+				c.MaxConnsPerHost, err = strconv.Atoi(v)
+				if nil == err && 0 >= c.MaxConnsPerHost {
+					err = strconv.ErrRange
+				}
+			case "config.keepalive":
+				c.KeepAlive, err = time.ParseDuration(v)
+			case "config.idletimeout":
+				c.IdleTimeout, err = time.ParseDuration(v)
+			}
+			if nil != err {
+				return c, fmt.Errorf("invalid %s value: %s", k, v)
+			}
+		}
+	}
+	return
+}
+
 func run() int {
 	default_mntopt := optlist{}
 	switch runtime.GOOS {
 	case "windows":
 		default_mntopt = optlist{"uid=-1", "gid=-1", "rellinks", "FileInfoTimeout=-1"}
 	case "linux":
-		default_mntopt = optlist{"uid=-1", "gid=-1", "default_permissions"}
+		default_mntopt = optlist{"uid=-1", "gid=-1", "default_permissions", "intr"}
 	case "darwin":
 		default_mntopt = optlist{"uid=-1", "gid=-1", "default_permissions", "noapplexattr"}
 	}
@@ -132,13 +462,28 @@ func run() int {
 	authkey := ""
 	authonly := false
 	filter := optlist{}
+	lockpath := ""
+	frozen := false
 	mntopt := optlist{}
+	profile := ""
 	remote := "github.com"
 	mntpnt := ""
 	config := []string{"config.dir=:"}
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s [options] [remote] mountpoint\n\n", progname)
+		fmt.Fprintf(os.Stderr, "usage: %s [options] [remote] mountpoint\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] doctor [[remote] mountpoint]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] auth refresh [remote]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] cache verify [remote]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] cache gc [-n] [remote]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] pathmap upgrade [remote]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] export [remote] owner/repo/ref[/dir] target\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] image squashfs|erofs [remote] owner/repo/ref[/dir] file\n",
+			progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] manifest [remote] owner/repo/ref[/dir]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s [options] warmup -trace file [remote]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s top [mountpoint]\n", progname)
+		fmt.Fprintf(os.Stderr, "       %s completion bash|zsh|fish|powershell\n\n", progname)
 		flag.PrintDefaults()
 	}
 
@@ -160,7 +505,11 @@ func run() int {
 			"- rule form: [+-]owner or [+-]owner/repo\n"+
 			"- rule is include (+) or exclude (-) (default: include)\n"+
 			"- rule owner/repo can use wildcards for pattern matching")
+	flag.StringVar(&lockpath, "lock", lockpath,
+		"record the commit that each accessed ref resolves to in lockfile `path`")
+	flag.BoolVar(&frozen, "frozen", frozen, "mount the commits recorded in the lockfile (requires -lock)")
 	flag.Var(&mntopt, "o", "FUSE mount `options`\n(default: "+strings.Join(default_mntopt, ",")+")")
+	flag.StringVar(&profile, "p", profile, "use `profile` from the configuration file")
 
 	flag.Parse()
 
@@ -171,14 +520,181 @@ func run() int {
 		return 0
 	}
 
-	switch flag.NArg() {
-	case 1:
-		mntpnt = flag.Arg(0)
-	case 2:
-		remote = flag.Arg(0)
-		mntpnt = flag.Arg(1)
+	args := flag.Args()
+	if 0 < len(args) && "__complete" == args[0] {
+		c := parseCompletion(flag.CommandLine, args[1:])
+		if "" != profile {
+			applyProfile(c.fset, profile)
+		}
+		if c.remote {
+			for _, m := range mntopt {
+				config = append(config, strings.Split(m, ",")...)
+			}
+			for _, f := range filter {
+				for _, s := range strings.Split(f, ",") {
+					config = append(config, "config._filter="+s)
+				}
+			}
+			c.cands = append(c.cands, completeRemote(c.word, authmeth, authkey, config)...)
+		}
+		c.print()
+		return 0
+	}
+	if 0 < len(args) && "completion" == args[0] {
+		if 2 != len(args) {
+			flag.Usage()
+			return 2
+		}
+		script, err := completionScript(args[1])
+		if nil != err {
+			warn("%v", err)
+			return 2
+		}
+		fmt.Print(script)
+		return 0
+	}
+
+	if 0 < len(args) && "top" == args[0] {
+		switch len(args) {
+		case 1:
+			return top("")
+		case 2:
+			return top(args[1])
+		default:
+			flag.Usage()
+			return 2
+		}
+	}
+
+	doctormode := 0 < len(args) && "doctor" == args[0]
+	if doctormode {
+		args = args[1:]
+	}
+	refreshmode := 1 < len(args) && "auth" == args[0] && "refresh" == args[1]
+	if refreshmode {
+		args = args[2:]
+	}
+	cachemode := 1 < len(args) && "cache" == args[0] && "verify" == args[1]
+	if cachemode {
+		args = args[2:]
+		if 1 < len(args) {
+			flag.Usage()
+			return 2
+		}
+	}
+	gcmode := 1 < len(args) && "cache" == args[0] && "gc" == args[1]
+	gcdryrun := false
+	if gcmode {
+		args = args[2:]
+		if 0 < len(args) && "-n" == args[0] {
+			gcdryrun = true
+			args = args[1:]
+		}
+		if 1 < len(args) {
+			flag.Usage()
+			return 2
+		}
+	}
+	pathmapmode := 1 < len(args) && "pathmap" == args[0] && "upgrade" == args[1]
+	if pathmapmode {
+		args = args[2:]
+		if 1 < len(args) {
+			flag.Usage()
+			return 2
+		}
+	}
+	exportmode := 0 < len(args) && "export" == args[0]
+	exportpath, exporttarget := "", ""
+	if exportmode {
+		switch len(args) {
+		case 3:
+			exportpath, exporttarget = args[1], args[2]
+			args = nil
+		case 4:
+			exportpath, exporttarget = args[2], args[3]
+			args = args[1:2]
+		default:
+			flag.Usage()
+			return 2
+		}
+	}
+	imagemode := 0 < len(args) && "image" == args[0]
+	imageformat := ""
+	if imagemode {
+		switch len(args) {
+		case 4:
+			imageformat, exportpath, exporttarget = args[1], args[2], args[3]
+			args = nil
+		case 5:
+			imageformat, exportpath, exporttarget = args[1], args[3], args[4]
+			args = args[2:3]
+		default:
+			flag.Usage()
+			return 2
+		}
+		if _, ok := imageFormats[imageformat]; !ok {
+			flag.Usage()
+			return 2
+		}
+	}
+	manifestmode := 0 < len(args) && "manifest" == args[0]
+	manifestpath := ""
+	if manifestmode {
+		switch len(args) {
+		case 2:
+			manifestpath = args[1]
+			args = nil
+		case 3:
+			manifestpath = args[2]
+			args = args[1:2]
+		default:
+			flag.Usage()
+			return 2
+		}
+	}
+	warmupmode := 0 < len(args) && "warmup" == args[0]
+	warmuppath := ""
+	if warmupmode {
+		// accept -trace file, --trace file, -trace=file and --trace=file
+		args = args[1:]
+		if 0 < len(args) && strings.HasPrefix(args[0], "-") {
+			opt := strings.TrimPrefix(args[0][1:], "-")
+			if "trace" == opt && 1 < len(args) {
+				warmuppath = args[1]
+				args = args[2:]
+			} else if strings.HasPrefix(opt, "trace=") {
+				warmuppath = strings.TrimPrefix(opt, "trace=")
+				args = args[1:]
+			}
+		}
+		if "" == warmuppath || 1 < len(args) {
+			flag.Usage()
+			return 2
+		}
+	}
+	if "" != profile {
+		r, err := applyProfile(flag.CommandLine, profile)
+		if nil != err {
+			warn("%v", err)
+			return 2
+		}
+		if "" != r {
+			remote = r
+		}
+	}
+	switch {
+	case (refreshmode || cachemode || gcmode || pathmapmode || exportmode || imagemode ||
+		manifestmode || warmupmode) && 1 == len(args):
+		remote = args[0]
+	case (refreshmode || cachemode || gcmode || pathmapmode || exportmode || imagemode ||
+		manifestmode || warmupmode) && 0 == len(args):
+	case !refreshmode && 1 == len(args):
+		mntpnt = args[0]
+	case !refreshmode && 2 == len(args):
+		remote = args[0]
+		mntpnt = args[1]
 	default:
-		if !authonly {
+		if !authonly && !(doctormode && 0 == len(args)) {
 			flag.Usage()
 			return 2
 		}
@@ -186,9 +702,12 @@ func run() int {
 	switch authmeth {
 	case "":
 		authmeth = "full"
+		if refreshmode {
+			authmeth = "force"
+		}
 	case "force", "full", "required", "optional":
 	case "none":
-		if authonly {
+		if authonly || refreshmode {
 			flag.Usage()
 			return 2
 		}
@@ -200,11 +719,31 @@ func run() int {
 		return 2
 	}
 
+	// traces may contain tokens and request headers
+	libtrace.Logger.SetOutput(scrub.NewWriter(libtrace.Logger.Writer()))
+
 	if debug {
 		libtrace.Verbose = true
 		libtrace.Pattern = "*,github.com/billziss-gh/hubfs/*,github.com/billziss-gh/hubfs/fs/*"
 	}
 
+	httpconf, err := httpConfig(mntopt)
+	if nil != err {
+		warn("config error: %v", err)
+		return 1
+	}
+	httputil.ConfigureTransport(httpconf)
+
+	if spec := os.Getenv(httputil.ChaosEnv); "" != spec {
+		c, err := httputil.ParseChaos(spec)
+		if nil != err {
+			warn("%v", err)
+			return 1
+		}
+		httputil.EnableChaos(c)
+		warn("fault injection enabled: %s", spec)
+	}
+
 	uri, err := url.Parse(remote)
 	if nil != uri && "" == uri.Scheme {
 		uri, err = url.Parse("https://" + remote)
@@ -225,6 +764,35 @@ func run() int {
 		authkey = provname
 	}
 
+	if doctormode {
+		for _, m := range mntopt {
+			config = append(config, strings.Split(m, ",")...)
+		}
+		token := ""
+		if strings.HasPrefix(authmeth, "token=") {
+			token = strings.TrimPrefix(authmeth, "token=")
+		}
+		return doctor(provider, authkey, token, uri, mntpnt, config)
+	}
+
+	if refreshmode {
+		return refresh(provider, authkey, authmeth)
+	}
+
+	if cachemode {
+		for _, m := range mntopt {
+			config = append(config, strings.Split(m, ",")...)
+		}
+		return cacheVerify(provider, config)
+	}
+
+	if pathmapmode {
+		for _, m := range mntopt {
+			config = append(config, strings.Split(m, ",")...)
+		}
+		return pathmapUpgrade(provider, config)
+	}
+
 	var client providers.Client
 	switch authmeth {
 	case "force":
@@ -253,11 +821,16 @@ func run() int {
 		return 1
 	}
 
+	// mounts that use the system keyring pick up rotated tokens
+	usekeyring := "none" != authmeth && !strings.HasPrefix(authmeth, "token=")
+
 	if !authonly {
 		if 0 == len(mntopt) {
 			mntopt = default_mntopt
 		}
-		fmt.Printf("%s -o %s %s %s\n", progname, strings.Join(mntopt, ","), remote, mntpnt)
+		if !exportmode && !imagemode && !manifestmode && !warmupmode && !gcmode {
+			fmt.Printf("%s -o %s %s %s\n", progname, strings.Join(mntopt, ","), remote, mntpnt)
+		}
 
 		if debug {
 			mntopt = append(mntopt, "debug")
@@ -285,15 +858,103 @@ func run() int {
 			}
 		}
 
+		overrides, err := repoOverrides()
+		if nil != err {
+			warn("config error: %v", err)
+			return 1
+		}
+		config = append(config, overrides...)
+
+		if warmupmode && !keepsCacheDirectory(config) {
+			warn("warmup requires a cache directory that is kept (-o config.dir=PATH)")
+			return 2
+		}
+		if gcmode && !keepsCacheDirectory(config) {
+			warn("cache gc requires a cache directory that is kept (-o config.dir=PATH)")
+			return 2
+		}
+
+		if "" != lockpath {
+			config = append(config, "config._lock="+lockpath)
+		}
+		if frozen {
+			config = append(config, "config._frozen=1")
+		}
+
+		// per user clients of config.multiuser get the same configuration,
+		// each with its own token and cache directory
+		userconfig, userdir := config, ""
+		var stopmux sync.Mutex
+		var stoplist []func()
+		defer func() {
+			stopmux.Lock()
+			for _, stop := range stoplist {
+				stop()
+			}
+			stopmux.Unlock()
+		}()
+		newclient := func(uid uint32) providers.Client {
+			userkey := fmt.Sprintf("%s#%d", authkey, uid)
+			client, err := newClientWithKey(provider, userkey)
+			if nil != err {
+				client, err = provider.NewClient("")
+			}
+			if nil == err {
+				config := userconfig[:len(userconfig):len(userconfig)]
+				if "" != userdir {
+					config = append(config,
+						"config.dir="+filepath.Join(userdir, "users", strconv.FormatUint(uint64(uid), 10)))
+				}
+				_, err = client.SetConfig(config)
+			}
+			if nil != err {
+				warn("client error: uid=%d: %v", uid, err)
+				return nil
+			}
+			stopmux.Lock()
+			stoplist = append(stoplist, watchToken(client, userkey))
+			stopmux.Unlock()
+			return client
+		}
+
 		config, err = client.SetConfig(config)
+		userdir = client.GetDirectory()
 		if nil != err {
 			warn("config error: %v", err)
 			return 1
 		}
 
-		port.Umask(0)
+		// keep percent-encoded ref names intact (see config.refenc)
+		prefix := uri.Path
+		if "" != uri.RawPath {
+			prefix = uri.RawPath
+		}
+		if exportmode {
+			return export(client, prefix, exportpath, exporttarget, config)
+		}
+		if imagemode {
+			return image(client, prefix, imageformat, exportpath, exporttarget, config)
+		}
+		if manifestmode {
+			return manifest(client, prefix, manifestpath, config)
+		}
+		if warmupmode {
+			return warmup(client, warmuppath, config)
+		}
+		if gcmode {
+			return cacheGC(client, gcdryrun, config)
+		}
 
-		if !mount(client, uri.Path, mntpnt, config) {
+		port.Umask(0)
+		if usekeyring {
+			defer watchToken(client, authkey)()
+		}
+		if stop, err := serveControl(uri.String(), mntpnt); nil == err {
+			defer stop()
+		} else {
+			warn("control socket error: %v", err)
+		}
+		if !mount(client, newclient, uri.String(), prefix, mntpnt, config) {
 			return 1
 		}
 	}
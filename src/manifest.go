@@ -0,0 +1,69 @@
+/*
+ * manifest.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	pathutil "path"
+	"runtime"
+	"strings"
+
+	"github.com/billziss-gh/hubfs/fs/hubfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// Function manifest prints the manifest of the tree at path (owner/repo/ref[/dir],
+// relative to the remote) as JSON.
+func manifest(client providers.Client, prefix string, path string, config []string) int {
+	refenc := hubfs.RefEncodingPlus
+	mangle := "windows" == runtime.GOOS
+	for _, s := range config {
+		var err error
+		switch {
+		case strings.HasPrefix(s, "config.refenc="):
+			refenc, err = hubfs.ParseRefEncoding(strings.TrimPrefix(s, "config.refenc="))
+		case strings.HasPrefix(s, "config.mangle="):
+			mangle = "1" == strings.TrimPrefix(s, "config.mangle=")
+		}
+		if nil != err {
+			warn("config error: %v", err)
+			return 1
+		}
+	}
+
+	client.StartExpiration()
+	defer client.StopExpiration()
+
+	m, err := hubfs.BuildManifest(context.Background(), hubfs.Config{
+		Client:      client,
+		Prefix:      prefix,
+		RefEncoding: refenc,
+		Mangle:      mangle,
+	}, pathutil.Join("/", path))
+	if nil != err {
+		warn("manifest error: %v", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); nil != err {
+		warn("manifest error: %v", err)
+		return 1
+	}
+	return 0
+}
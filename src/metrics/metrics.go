@@ -0,0 +1,213 @@
+/*
+ * metrics.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+// Package metrics collects activity counters of a mount: file system operations per
+// repository, fetches from the servers, object cache hits and the API rate limit budget.
+// The counters are process wide; a Snapshot of them is reported by the control socket
+// of the mount (see hubfs top).
+package metrics
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is the API rate limit budget as last reported by the server.
+type RateLimit struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// Snapshot is a copy of the counters at a point in time. Counters are cumulative; rates
+// are computed from the difference of two snapshots.
+type Snapshot struct {
+	Time         time.Time         `json:"time"`
+	Start        time.Time         `json:"start"`
+	Ops          map[string]uint64 `json:"ops"`           // operations by owner/repository
+	Fetches      int64             `json:"fetches"`       // fetches in flight
+	FetchesTotal uint64            `json:"fetches_total"` // fetches started
+	CacheHits    uint64            `json:"cache_hits"`    // objects found in the cache
+	CacheMisses  uint64            `json:"cache_misses"`  // objects fetched from the server
+	RateLimit    RateLimit         `json:"rate_limit"`
+	Gauges       map[string]int64  `json:"gauges,omitempty"` // current sizes by name
+
+	// identification of the mount; filled in by the control socket
+	Pid        int    `json:"pid,omitempty"`
+	Remote     string `json:"remote,omitempty"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+}
+
+var (
+	lock         sync.Mutex
+	start        = time.Now()
+	ops          = make(map[string]uint64)
+	fetches      int64
+	fetchesTotal uint64
+	cacheHits    uint64
+	cacheMisses  uint64
+	ratelimit    RateLimit
+	gauges       = make(map[string]int64)
+)
+
+// Function CountOp counts a file system operation on a repository.
+func CountOp(repository string) {
+	lock.Lock()
+	ops[repository]++
+	lock.Unlock()
+}
+
+// Function StartFetch counts a fetch from a server. The returned function must be called
+// when the fetch is done.
+func StartFetch() (done func()) {
+	lock.Lock()
+	fetches++
+	fetchesTotal++
+	lock.Unlock()
+	return func() {
+		lock.Lock()
+		fetches--
+		lock.Unlock()
+	}
+}
+
+// Function CountCache counts objects that were found in or missing from the cache.
+func CountCache(hits int, misses int) {
+	lock.Lock()
+	cacheHits += uint64(hits)
+	cacheMisses += uint64(misses)
+	lock.Unlock()
+}
+
+// Function SetRateLimit records the API rate limit budget.
+func SetRateLimit(rl RateLimit) {
+	lock.Lock()
+	ratelimit = rl
+	lock.Unlock()
+}
+
+// Function AddGauge adds delta to the gauge name, which reports the current size of
+// something (e.g. the number of open file handles) rather than a cumulative count.
+func AddGauge(name string, delta int64) {
+	lock.Lock()
+	gauges[name] += delta
+	lock.Unlock()
+}
+
+// Function Take returns a snapshot of the counters.
+func Take() Snapshot {
+	lock.Lock()
+	defer lock.Unlock()
+	s := Snapshot{
+		Time:         time.Now(),
+		Start:        start,
+		Ops:          make(map[string]uint64, len(ops)),
+		Fetches:      fetches,
+		FetchesTotal: fetchesTotal,
+		CacheHits:    cacheHits,
+		CacheMisses:  cacheMisses,
+		RateLimit:    ratelimit,
+		Gauges:       make(map[string]int64, len(gauges)),
+	}
+	for k, v := range ops {
+		s.Ops[k] = v
+	}
+	for k, v := range gauges {
+		s.Gauges[k] = v
+	}
+	return s
+}
+
+// Function OpsRate returns the operations per second of each repository between two
+// snapshots.
+func OpsRate(prev *Snapshot, curr *Snapshot) map[string]float64 {
+	res := make(map[string]float64, len(curr.Ops))
+	secs := curr.Time.Sub(prev.Time).Seconds()
+	for k, v := range curr.Ops {
+		if 0 < secs && prev.Ops[k] <= v {
+			res[k] = float64(v-prev.Ops[k]) / secs
+		} else {
+			res[k] = 0
+		}
+	}
+	return res
+}
+
+// Function HitRate returns the fraction of objects that were found in the cache, or -1
+// if no objects have been requested.
+func (s *Snapshot) HitRate() float64 {
+	if 0 == s.CacheHits+s.CacheMisses {
+		return -1
+	}
+	return float64(s.CacheHits) / float64(s.CacheHits+s.CacheMisses)
+}
+
+// Function Goroutines returns the number of goroutines of each subsystem: the hubfs
+// package (e.g. "providers", "fs/hubfs", "main") of the innermost hubfs function on the
+// stack of a goroutine or of the function that created it; "other" for the rest.
+func Goroutines() map[string]int {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return countGoroutines(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func countGoroutines(stacks []byte) map[string]int {
+	res := make(map[string]int)
+	for _, stack := range bytes.Split(stacks, []byte("\n\n")) {
+		lines := strings.Split(strings.TrimSpace(string(stack)), "\n")
+		if !strings.HasPrefix(lines[0], "goroutine ") {
+			continue
+		}
+		subsys := "other"
+		for _, line := range lines[1:] {
+			if strings.HasPrefix(line, "\t") {
+				continue
+			}
+			if s := subsystem(strings.TrimPrefix(line, "created by ")); "" != s {
+				subsys = s
+				break
+			}
+		}
+		res[subsys]++
+	}
+	return res
+}
+
+// Function subsystem returns the hubfs package of a function in a stack trace (e.g.
+// "github.com/billziss-gh/hubfs/providers.(*gitRepository).fetch(...)") or "".
+func subsystem(fn string) string {
+	const prefix = "github.com/billziss-gh/hubfs/"
+	if strings.HasPrefix(fn, "main.") {
+		return "main"
+	}
+	if !strings.HasPrefix(fn, prefix) {
+		return ""
+	}
+	fn = strings.TrimPrefix(fn, prefix)
+	if i := strings.IndexByte(fn, '('); -1 != i {
+		fn = fn[:i]
+	}
+	i := strings.LastIndexByte(fn, '/') + 1
+	if j := strings.IndexByte(fn[i:], '.'); -1 != j {
+		return fn[:i+j]
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+/*
+ * metrics_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s0 := Take()
+
+	CountOp("winfsp/hubfs")
+	CountOp("winfsp/hubfs")
+	CountOp("winfsp/winfsp")
+	done := StartFetch()
+	CountCache(3, 1)
+	SetRateLimit(RateLimit{Limit: 5000, Remaining: 4999})
+
+	s1 := Take()
+	if 2 != s1.Ops["winfsp/hubfs"]-s0.Ops["winfsp/hubfs"] ||
+		1 != s1.Ops["winfsp/winfsp"]-s0.Ops["winfsp/winfsp"] {
+		t.Error(s1.Ops)
+	}
+	if s0.Fetches+1 != s1.Fetches || s0.FetchesTotal+1 != s1.FetchesTotal {
+		t.Error(s1.Fetches, s1.FetchesTotal)
+	}
+	if 4999 != s1.RateLimit.Remaining {
+		t.Error(s1.RateLimit)
+	}
+
+	done()
+	s2 := Take()
+	if s0.Fetches != s2.Fetches {
+		t.Error(s2.Fetches)
+	}
+
+	s := Snapshot{CacheHits: 3, CacheMisses: 1}
+	if 0.75 != s.HitRate() {
+		t.Error(s.HitRate())
+	}
+	s = Snapshot{}
+	if -1 != s.HitRate() {
+		t.Error(s.HitRate())
+	}
+}
+
+func TestGauges(t *testing.T) {
+	AddGauge("hubfs.handles", 2)
+	AddGauge("hubfs.handles", -1)
+	if s := Take(); 1 != s.Gauges["hubfs.handles"] {
+		t.Error(s.Gauges)
+	}
+	AddGauge("hubfs.handles", -1)
+}
+
+func TestGoroutines(t *testing.T) {
+	stacks := `goroutine 1 [running]:
+main.main()
+	/src/main.go:10 +0x25
+
+goroutine 7 [select]:
+github.com/billziss-gh/hubfs/providers.(*gitRepository).fetch(0xc000010000)
+	/src/providers/git.go:300 +0x65
+github.com/billziss-gh/hubfs/fs/hubfs.(*hubfs).Open(0xc000020000, {0x5e1e40, 0x4})
+	/src/fs/hubfs/hubfs.go:760 +0x1b
+
+goroutine 9 [IO wait]:
+internal/poll.runtime_pollWait(0x7f0, 0x72)
+	/go/src/runtime/netpoll.go:234 +0x89
+created by github.com/billziss-gh/hubfs/providers.(*cache).StartExpiration in goroutine 1
+	/src/providers/cache.go:100 +0x6a
+
+goroutine 11 [chan receive]:
+net/http.(*persistConn).readLoop(0xc000030000)
+	/go/src/net/http/transport.go:2200 +0x4c
+created by net/http.(*Transport).dialConn
+	/go/src/net/http/transport.go:1750 +0x1c9
+`
+	res := countGoroutines([]byte(stacks))
+	if 1 != res["main"] || 2 != res["providers"] || 1 != res["other"] || 3 != len(res) {
+		t.Error(res)
+	}
+	if 0 == len(Goroutines()) {
+		t.Error()
+	}
+}
+
+func TestOpsRate(t *testing.T) {
+	now := time.Now()
+	prev := &Snapshot{Time: now, Ops: map[string]uint64{"a/b": 10}}
+	curr := &Snapshot{Time: now.Add(2 * time.Second), Ops: map[string]uint64{"a/b": 30, "c/d": 4}}
+	rate := OpsRate(prev, curr)
+	if 10 != rate["a/b"] || 2 != rate["c/d"] {
+		t.Error(rate)
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	CountOp("winfsp/hubfs")
+	s := Take()
+	s.Pid = 42
+	b, err := json.Marshal(&s)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var r Snapshot
+	err = json.Unmarshal(b, &r)
+	if nil != err || 42 != r.Pid || s.Ops["winfsp/hubfs"] != r.Ops["winfsp/hubfs"] {
+		t.Error(err, r)
+	}
+}
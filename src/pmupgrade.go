@@ -0,0 +1,94 @@
+/*
+ * pmupgrade.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/billziss-gh/hubfs/fs/ptfs"
+	"github.com/billziss-gh/hubfs/fs/unionfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// Function pathmapUpgrade rewrites the path maps of the writable refs in the cache
+// directory of the remote in the current path map file format and prints the result for
+// each. It returns the process exit code.
+func pathmapUpgrade(provider providers.Provider, config []string) int {
+	client, err := provider.NewClient("")
+	if nil == err {
+		_, err = client.SetConfig(config)
+	}
+	if nil != err {
+		warn("config error: %v", err)
+		return 1
+	}
+
+	dir := client.GetDirectory()
+	if "" == dir {
+		warn("no cache directory")
+		return 1
+	}
+
+	// path maps are kept in DIR/owner/repository/meta/ref (see hubfs.newOverlay)
+	list, err := filepath.Glob(filepath.Join(dir, "*", "*", "meta", "*", ".unionfs"))
+	if nil != err {
+		warn("pathmap upgrade error: %v", err)
+		return 1
+	}
+	if 0 == len(list) {
+		fmt.Printf("%s: no path maps\n", dir)
+		return 0
+	}
+
+	ec := 0
+	for _, path := range list {
+		if !pathmapUpgradeFile(path) {
+			ec = 1
+		}
+	}
+	return ec
+}
+
+// Function pathmapUpgradeFile upgrades a single path map file. The path map is opened as
+// case-insensitive, so that the keys of a legacy file are kept as legacy keys: the keys of
+// a case-sensitive path map are the same under all versions and a legacy key is only
+// migrated when its path is looked up under a case-insensitive mount.
+func pathmapUpgradeFile(path string) bool {
+	errc, pm := unionfs.OpenPathmap(ptfs.New(filepath.Dir(path)), "/.unionfs", true)
+	if 0 != errc {
+		warn("%s: cannot open path map (errc=%d)", path, errc)
+		return false
+	}
+	defer pm.Close()
+
+	if "" != pm.Rotated() {
+		warn("%s: damaged; recovered and moved original to %s", path, pm.Rotated())
+	}
+
+	version := pm.Version()
+	if pm.Current() {
+		fmt.Printf("%s: version %d; up to date\n", path, version)
+		return true
+	}
+
+	n := pm.Upgrade()
+	if 0 > n {
+		warn("%s: cannot write path map (errc=%d)", path, n)
+		return false
+	}
+
+	fmt.Printf("%s: version %d -> %d (%d legacy keys)\n", path, version, pm.Version(), pm.Legacy())
+	return true
+}
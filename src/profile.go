@@ -0,0 +1,176 @@
+/*
+ * profile.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/billziss-gh/golib/appdata"
+	"github.com/billziss-gh/golib/config"
+)
+
+// Function profilePath returns the path of the configuration file that contains the
+// profiles. A profile is a section in this file:
+//
+//	[work]
+//	remote = github.com/myorg
+//	authkey = work
+//	filter = +myorg,-myorg/archive*
+//	dir = /work/hubfs
+//	o = uid=-1,gid=-1,intr
+//
+// Keys are the names of command line options (without the leading dash), as well as
+// "remote" (the default remote) and "dir" (the cache directory; see config.dir).
+//
+// Sections whose name is an owner/repo pattern are not profiles; they override mount
+// options for the matching repositories (see repoOverrides).
+func profilePath() (string, error) {
+	d, err := appdata.ConfigDir()
+	if nil != err {
+		return "", err
+	}
+	return filepath.Join(d, progname, progname+".conf"), nil
+}
+
+func openProfiles() (*os.File, error) {
+	path, err := profilePath()
+	if nil != err {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func readProfiles() (config.Config, error) {
+	file, err := openProfiles()
+	if nil != err {
+		return nil, err
+	}
+	defer file.Close()
+	return config.Read(file)
+}
+
+func isProfileName(name string) bool {
+	return "" != name && !strings.Contains(name, "/")
+}
+
+// Function repoOverrides returns the repository overrides in the configuration file as
+// provider configuration options. A repository override is a section whose name is an
+// owner/repo pattern:
+//
+//	[myorg/*]
+//	refttl = 1m
+//	readonly = 1
+//
+// Overrides are returned in file order; later overrides take precedence.
+func repoOverrides() ([]string, error) {
+	file, err := openProfiles()
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	res := []string{}
+	err = config.ReadFunc(file, func(sect, name string, valu interface{}) {
+		if isProfileName(sect) || "" == sect {
+			return
+		}
+		v, _ := valu.(string)
+		if nil == valu {
+			v = "1"
+		}
+		res = append(res, "config._repo="+sect+":"+name+"="+v)
+	})
+	return res, err
+}
+
+// Function profileNames returns the names of the profiles in the configuration file.
+func profileNames() []string {
+	conf, err := readProfiles()
+	if nil != err {
+		return nil
+	}
+	res := []string{}
+	for name := range conf {
+		if isProfileName(name) {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Function applyProfile sets the flags in fset from the named profile and returns the
+// profile remote (if any). Flags that were set on the command line take precedence,
+// except for list flags such as -o and -filter to which the profile values are added.
+func applyProfile(fset *flag.FlagSet, name string) (remote string, err error) {
+	conf, err := readProfiles()
+	if nil != err {
+		if os.IsNotExist(err) {
+			path, _ := profilePath()
+			return "", fmt.Errorf("unknown profile: %s (no configuration file %s)", name, path)
+		}
+		return "", err
+	}
+	sect, ok := conf[name]
+	if !ok || !isProfileName(name) {
+		return "", fmt.Errorf("unknown profile: %s", name)
+	}
+
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(sect))
+	for k := range sect {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := sect[k]
+		switch k {
+		case "remote":
+			remote = v
+			continue
+		case "dir":
+			k, v = "o", "config.dir="+v
+		case "p", "version":
+			return "", fmt.Errorf("profile %s: invalid option: %s", name, k)
+		}
+		f := fset.Lookup(k)
+		if nil == f {
+			return "", fmt.Errorf("profile %s: unknown option: %s", name, k)
+		}
+		if _, islist := f.Value.(*optlist); set[k] && !islist {
+			continue
+		}
+		if "" == v && isBoolFlag(f) {
+			v = "true"
+		}
+		err = fset.Set(k, v)
+		if nil != err {
+			return "", fmt.Errorf("profile %s: invalid value for %s: %v", name, k, err)
+		}
+	}
+
+	return remote, nil
+}
@@ -0,0 +1,131 @@
+/*
+ * artifact.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The artifacts of the recent workflow runs of a GitHub repository are listed with the
+// API. An artifact is a zip archive that is downloaded into the artifacts directory of
+// the repository cache directory when first read, or into memory if there is no cache
+// directory.
+
+// maximum number of artifacts listed
+const maxArtifacts = 100
+
+type githubArtifact struct {
+	FId      int64     `json:"id"`
+	FName    string    `json:"name"`
+	FExpired bool      `json:"expired"`
+	FCreated time.Time `json:"created_at"`
+	FURL     string    `json:"archive_download_url"`
+}
+
+// Function GetArtifacts returns the unexpired artifacts of the recent workflow runs of
+// the repository. Artifact names are not unique, so artifacts are named NAME-ID. The
+// list is kept for releasesTTL.
+func (r *githubRepository) GetArtifacts(ctx context.Context) (res []Asset, err error) {
+	defer trace(r.FName)(&err)
+
+	client := r.client
+	if nil == client || client.gists || r.wiki {
+		return []Asset{}, nil
+	}
+
+	client.lock.Lock()
+	if nil != r.artifacts && releasesTTL > time.Since(r.artifactsAt) {
+		res = r.artifacts
+		client.lock.Unlock()
+		return res, nil
+	}
+	client.lock.Unlock()
+
+	rsp, err := client.sendrecv(ctx, fmt.Sprintf("/repos/%s/%s/actions/artifacts?per_page=%d",
+		r.owner, r.FName, maxArtifacts))
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var content struct {
+		Artifacts []*githubArtifact `json:"artifacts"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&content)
+	if nil != err {
+		return nil, err
+	}
+
+	res = make([]Asset, 0, len(content.Artifacts))
+	for _, elm := range content.Artifacts {
+		if elm.FExpired {
+			continue
+		}
+		res = append(res, &githubAsset{
+			FId:      elm.FId,
+			FName:    elm.FName + "-" + strconv.FormatInt(elm.FId, 10),
+			FSize:    -1, // the size of the archive is not reported
+			FUpdated: elm.FCreated,
+			FURL:     elm.FURL,
+		})
+	}
+
+	client.lock.Lock()
+	r.artifacts, r.artifactsAt = res, time.Now()
+	client.lock.Unlock()
+
+	return res, nil
+}
+
+// Function GetArtifactReader returns a reader for the zip archive of an artifact.
+func (r *githubRepository) GetArtifactReader(ctx context.Context, artifact0 Asset) (
+	res io.ReaderAt, err error) {
+	defer trace(r.FName, artifact0.Name())(&err)
+
+	artifact := artifact0.(*githubAsset)
+	dir := r.GetDirectory()
+	if "" != dir {
+		return r.client.cachedAsset(ctx, filepath.Join(dir, "artifacts"), artifact)
+	}
+
+	ctx, cancel := withTimeout(ctx, r.client.gitconf.timeouts.blob)
+	defer cancel()
+	rsp, err := r.client.sendrecvAsset(ctx, artifact, -1, 0)
+	if nil != err {
+		return nil, timeoutErr(ctx, err)
+	}
+	defer rsp.Body.Close()
+	content, err := ioutil.ReadAll(rsp.Body)
+	if nil != err {
+		return nil, timeoutErr(ctx, err)
+	}
+	return &memoryArtifact{bytes.NewReader(content)}, nil
+}
+
+// memoryArtifact is the archive of an artifact that is kept in memory.
+type memoryArtifact struct {
+	*bytes.Reader
+}
+
+func (a *memoryArtifact) Close() error {
+	return nil
+}
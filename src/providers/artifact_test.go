@@ -0,0 +1,103 @@
+/*
+ * artifact_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArtifacts(t *testing.T) {
+	content := "PK-artifact-archive"
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		case "/orgs/acme/repos":
+			w.Write([]byte(`[{"name":"a","clone_url":"https://example.com/acme/a.git"}]`))
+		case "/repos/acme/a/actions/artifacts":
+			w.Write([]byte(`{"total_count":2,"artifacts":[
+				{"id":7,"name":"build","created_at":"2022-01-01T00:00:00Z",
+					"archive_download_url":"` + server.URL + `/artifacts/7/zip"},
+				{"id":8,"name":"build","expired":true}]}`))
+		case "/artifacts/7/zip":
+			http.Redirect(w, r, "/storage/7", 302)
+		case "/storage/7":
+			http.ServeContent(w, r, "build.zip", time.Time{}, strings.NewReader(content))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "artifact_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, config := range []string{"", "config.dir=" + dir} {
+		client, err := NewGithubClient(server.URL, "")
+		if nil != err {
+			t.Fatal(err)
+		}
+		if "" != config {
+			client.SetConfig([]string{config})
+		}
+		owner, err := client.OpenOwner(context.Background(), "acme")
+		if nil != err {
+			t.Fatal(err)
+		}
+		repository, err := client.OpenRepository(context.Background(), owner, "a")
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		artifacts, err := repository.(ArtifactRepository).GetArtifacts(context.Background())
+		if nil != err || 1 != len(artifacts) || "build-7" != artifacts[0].Name() ||
+			2022 != artifacts[0].Time().Year() {
+			t.Fatal(err, artifacts)
+		}
+
+		reader, err := repository.(ArtifactRepository).GetArtifactReader(
+			context.Background(), artifacts[0])
+		if nil != err {
+			t.Fatal(err)
+		}
+		if int64(len(content)) != reader.(interface{ Size() int64 }).Size() {
+			t.Error(reader.(interface{ Size() int64 }).Size())
+		}
+		buf := make([]byte, 8)
+		n, err := reader.ReadAt(buf, 3)
+		if 8 != n || nil != err || content[3:11] != string(buf) {
+			t.Error(n, err, string(buf[:n]))
+		}
+		reader.(interface{ Close() error }).Close()
+
+		client.CloseRepository(repository)
+		client.CloseOwner(owner)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "acme", "a", "artifacts", "7")); nil != err {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,498 @@
+/*
+ * attributes.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	pathutil "path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+// attrConfig controls how .gitattributes affect served content.
+type attrConfig struct {
+	eol    string         // "", "lf" or "crlf"; "" disables smudge conversion
+	export bool           // honor export-ignore and export-subst like git archive
+	ident  bool           // expand $Id$ and commit keywords in files with the ident attribute
+	xforms transformRules // content transforms (see transform.go)
+	filter bool           // apply the transforms named by filter attributes
+}
+
+func (c *attrConfig) enabled() bool {
+	return "" != c.eol || c.export || c.ident || 0 < len(c.xforms) || c.filter
+}
+
+// Function ignore reports whether a file with the specified attributes is hidden.
+func (c *attrConfig) ignore(attrs map[string]string) bool {
+	return c.export && attrSet == attrs["export-ignore"]
+}
+
+// Function setEol sets the end-of-line conversion from a config value.
+func (c *attrConfig) setEol(v string) bool {
+	switch v {
+	case "", "none":
+		c.eol = ""
+	case "native":
+		c.eol = "lf"
+		if "windows" == runtime.GOOS {
+			c.eol = "crlf"
+		}
+	case "lf", "crlf":
+		c.eol = v
+	default:
+		return false
+	}
+	return true
+}
+
+const (
+	attrSet   = "\x00set"
+	attrUnset = "\x00unset"
+)
+
+type attrRule struct {
+	base    string // directory of the .gitattributes file ("" for root)
+	pattern string
+	attrs   map[string]string
+}
+
+// attrRules is an ordered list of rules; later rules take precedence.
+type attrRules []*attrRule
+
+var attrMacros = map[string][]string{
+	"binary": {"-diff", "-merge", "-text"},
+}
+
+// Function parseAttributes parses a .gitattributes file found in directory base.
+func parseAttributes(base string, content []byte) (res attrRules) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if 0 == len(fields) || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule := &attrRule{
+			base:    base,
+			pattern: fields[0],
+			attrs:   make(map[string]string),
+		}
+		for _, a := range fields[1:] {
+			if m, ok := attrMacros[a]; ok {
+				for _, a := range m {
+					parseAttribute(rule.attrs, a)
+				}
+			}
+			parseAttribute(rule.attrs, a)
+		}
+		res = append(res, rule)
+	}
+	return
+}
+
+func parseAttribute(attrs map[string]string, a string) {
+	switch {
+	case strings.HasPrefix(a, "-"):
+		attrs[a[1:]] = attrUnset
+	case strings.HasPrefix(a, "!"):
+		attrs[a[1:]] = ""
+	default:
+		if i := strings.IndexByte(a, '='); -1 != i {
+			attrs[a[:i]] = a[i+1:]
+		} else {
+			attrs[a] = attrSet
+		}
+	}
+}
+
+// Function lookup returns the attributes that apply to path (relative to the ref root).
+func (rules attrRules) lookup(path string) map[string]string {
+	res := make(map[string]string)
+	for _, r := range rules {
+		if !r.match(path) {
+			continue
+		}
+		for k, v := range r.attrs {
+			if "" == v {
+				delete(res, k)
+			} else {
+				res[k] = v
+			}
+		}
+	}
+	return res
+}
+
+func (r *attrRule) match(path string) bool {
+	rel := path
+	if "" != r.base {
+		if !strings.HasPrefix(path, r.base+"/") {
+			return false
+		}
+		rel = path[len(r.base)+1:]
+	}
+
+	pattern := r.pattern
+	if !strings.Contains(pattern, "/") {
+		ok, _ := pathutil.Match(pattern, pathutil.Base(rel))
+		return ok
+	}
+	return matchGlob(strings.TrimPrefix(pattern, "/"), rel)
+}
+
+// Function matchGlob matches a slash separated path against a pattern that may
+// contain "**" components, which match zero or more directories.
+func matchGlob(pattern string, name string) bool {
+	pcomp := strings.Split(pattern, "/")
+	ncomp := strings.Split(name, "/")
+	var match func(p, n []string) bool
+	match = func(p, n []string) bool {
+		for 0 < len(p) {
+			if "**" == p[0] {
+				for i := len(n); 0 <= i; i-- {
+					if match(p[1:], n[i:]) {
+						return true
+					}
+				}
+				return false
+			}
+			if 0 == len(n) {
+				return false
+			}
+			if ok, _ := pathutil.Match(p[0], n[0]); !ok {
+				return false
+			}
+			p, n = p[1:], n[1:]
+		}
+		return 0 == len(n)
+	}
+	return match(pcomp, ncomp)
+}
+
+// smudge describes the conversion applied to blob content before it is served.
+type smudge struct {
+	auto     bool           // convert only if content is text
+	crlf     bool           // convert LF to CRLF
+	encoding string         // working tree encoding
+	subst    *exportCommit  // expand $Format:$ placeholders
+	ident    string         // expand $Id$ to this blob hash
+	keywords *exportCommit  // expand $Commit$, $Ref$ and $Date$ with this commit
+	path     string         // path of the file (for xforms)
+	xforms   transformRules // content transforms
+}
+
+// exportCommit is the commit used to expand export-subst placeholders and keywords.
+type exportCommit struct {
+	hash   string
+	commit *git.Commit
+	ref    string // name of the ref that the commit was reached from
+}
+
+// Function newSmudge determines the conversion for a file with the specified attributes.
+// It returns nil if no conversion is necessary.
+func (c *attrConfig) newSmudge(attrs map[string]string, commit *exportCommit) *smudge {
+	s := &smudge{}
+	if c.export && nil != commit && attrSet == attrs["export-subst"] {
+		s.subst = commit
+	}
+
+	text := attrs["text"]
+	if attrUnset == text || "" == c.eol {
+		if nil != s.subst {
+			return s
+		}
+		return nil
+	}
+
+	switch attrs["eol"] {
+	case "crlf":
+		s.crlf = true
+	case "lf":
+	default:
+		if "" == text {
+			break
+		}
+		s.crlf = "crlf" == c.eol
+	}
+	s.auto = "auto" == text || ("" == text && s.crlf)
+
+	switch enc := strings.ToUpper(attrs["working-tree-encoding"]); enc {
+	case "UTF-16", "UTF-16LE", "UTF-16BE", "UTF-16LE-BOM":
+		s.encoding = enc
+	}
+
+	if !s.crlf && "" == s.encoding && nil == s.subst {
+		return nil
+	}
+	return s
+}
+
+// Function identSmudge adds the expansion of $Id$ to the conversion of a file with the
+// ident attribute, whose blob has the specified hash. If commit is not nil, the keywords
+// $Commit$, $Ref$ and $Date$ are also expanded to its hash, the name of its ref and its
+// committer date.
+func (c *attrConfig) identSmudge(s *smudge, hash string, attrs map[string]string,
+	commit *exportCommit) *smudge {
+	if !c.ident || attrSet != attrs["ident"] {
+		return s
+	}
+	if nil == s {
+		s = &smudge{}
+	}
+	s.ident = hash
+	s.keywords = commit
+	return s
+}
+
+// Function name returns a name that identifies the conversion in the object cache.
+func (s *smudge) name() string {
+	n := ""
+	for _, r := range s.xforms {
+		n += ".xf-" + r.name
+	}
+	if s.crlf {
+		n += ".crlf"
+	}
+	if "" != s.encoding {
+		n += "." + strings.ToLower(s.encoding)
+	}
+	if nil != s.subst {
+		n += ".subst-" + s.subst.hash
+	}
+	if "" != s.ident {
+		n += ".ident"
+		if nil != s.keywords {
+			n += "-" + s.keywords.hash
+			if "" != s.keywords.ref {
+				n += "-" + url.PathEscape(s.keywords.ref)
+			}
+		}
+	}
+	return n
+}
+
+// Function apply converts content. Content that appears to be binary is left
+// unchanged for "text=auto" files.
+func (s *smudge) apply(content []byte) []byte {
+	if 0 < len(s.xforms) {
+		content = s.transform(content)
+	}
+
+	if nil != s.subst {
+		content = s.subst.expand(content)
+	}
+
+	if "" != s.ident {
+		content = expandKeyword(content, "Id", s.ident)
+		if nil != s.keywords {
+			content = expandKeyword(content, "Commit", s.keywords.hash)
+			content = expandKeyword(content, "Ref", s.keywords.ref)
+			content = expandKeyword(content, "Date",
+				s.keywords.commit.Committer.Time.Format(time.RFC3339))
+		}
+	}
+
+	if (!s.crlf && "" == s.encoding) || (s.auto && isBinary(content)) {
+		return content
+	}
+
+	if s.crlf {
+		var buf bytes.Buffer
+		buf.Grow(len(content) + len(content)/32)
+		for i, c := range content {
+			if '\n' == c && (0 == i || '\r' != content[i-1]) {
+				buf.WriteByte('\r')
+			}
+			buf.WriteByte(c)
+		}
+		content = buf.Bytes()
+	}
+
+	if "" != s.encoding && utf8.Valid(content) {
+		content = encodeUTF16(content, s.encoding)
+	}
+
+	return content
+}
+
+func isBinary(content []byte) bool {
+	if 8000 < len(content) {
+		content = content[:8000]
+	}
+	return -1 != bytes.IndexByte(content, 0)
+}
+
+func encodeUTF16(content []byte, encoding string) []byte {
+	u := utf16.Encode([]rune(string(content)))
+	res := make([]byte, 0, 2+2*len(u))
+	bigendian := "UTF-16BE" == encoding
+	switch encoding {
+	case "UTF-16":
+		// git writes UTF-16 with a BOM in big-endian order
+		bigendian = true
+		res = append(res, 0xfe, 0xff)
+	case "UTF-16LE-BOM":
+		res = append(res, 0xff, 0xfe)
+	}
+	for _, c := range u {
+		if bigendian {
+			res = append(res, byte(c>>8), byte(c))
+		} else {
+			res = append(res, byte(c), byte(c>>8))
+		}
+	}
+	return res
+}
+
+// Function expand replaces $Format:...$ placeholders in content with commit
+// information, like git archive does for files with the export-subst attribute.
+func (e *exportCommit) expand(content []byte) []byte {
+	const prefix = "$Format:"
+	if !bytes.Contains(content, []byte(prefix)) {
+		return content
+	}
+
+	var buf bytes.Buffer
+	for {
+		i := bytes.Index(content, []byte(prefix))
+		if -1 == i {
+			break
+		}
+		j := bytes.IndexAny(content[i+len(prefix):], "$\n")
+		if -1 == j || '$' != content[i+len(prefix)+j] {
+			buf.Write(content[:i+len(prefix)])
+			content = content[i+len(prefix):]
+			continue
+		}
+		buf.Write(content[:i])
+		buf.WriteString(e.format(string(content[i+len(prefix) : i+len(prefix)+j])))
+		content = content[i+len(prefix)+j+1:]
+	}
+	buf.Write(content)
+	return buf.Bytes()
+}
+
+// Function expandKeyword replaces $keyword$ (and previously expanded $keyword: ... $) in
+// content with $keyword: value $, like git does for $Id$ in files with the ident attribute.
+func expandKeyword(content []byte, keyword string, value string) []byte {
+	prefix := "$" + keyword
+	if !bytes.Contains(content, []byte(prefix)) {
+		return content
+	}
+
+	var buf bytes.Buffer
+	for {
+		i := bytes.Index(content, []byte(prefix))
+		if -1 == i {
+			break
+		}
+		buf.Write(content[:i])
+		rest := content[i+len(prefix):]
+		n := -1
+		if 0 < len(rest) && '$' == rest[0] {
+			n = 1
+		} else if 0 < len(rest) && ':' == rest[0] {
+			if j := bytes.IndexAny(rest, "$\n"); -1 != j && '$' == rest[j] {
+				n = j + 1
+			}
+		}
+		if -1 == n {
+			buf.WriteString(prefix)
+			content = rest
+			continue
+		}
+		buf.WriteString(prefix + ": " + value + " $")
+		content = rest[n:]
+	}
+	buf.Write(content)
+	return buf.Bytes()
+}
+
+// Function format expands a subset of the git pretty format placeholders.
+func (e *exportCommit) format(f string) string {
+	c := e.commit
+	subject := c.Message
+	if i := strings.IndexByte(subject, '\n'); -1 != i {
+		subject = subject[:i]
+	}
+	short := e.hash
+	if 7 < len(short) {
+		short = short[:7]
+	}
+	tree := c.TreeHash
+	shorttree := tree
+	if 7 < len(shorttree) {
+		shorttree = shorttree[:7]
+	}
+
+	var b strings.Builder
+	for i := 0; len(f) > i; i++ {
+		if '%' != f[i] || len(f) == i+1 {
+			b.WriteByte(f[i])
+			continue
+		}
+		i++
+		switch f[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'n':
+			b.WriteByte('\n')
+		case 'H':
+			b.WriteString(e.hash)
+		case 'h':
+			b.WriteString(short)
+		case 'T':
+			b.WriteString(tree)
+		case 't':
+			b.WriteString(shorttree)
+		case 's':
+			b.WriteString(subject)
+		case 'a', 'c':
+			sig := c.Author
+			if 'c' == f[i] {
+				sig = c.Committer
+			}
+			if len(f) == i+1 {
+				b.WriteString(f[i-1:])
+				break
+			}
+			i++
+			switch f[i] {
+			case 'n':
+				b.WriteString(sig.Name)
+			case 'e':
+				b.WriteString(sig.Email)
+			case 'd':
+				b.WriteString(sig.Time.Format("Mon Jan 2 15:04:05 2006 -0700"))
+			case 'I':
+				b.WriteString(sig.Time.Format(time.RFC3339))
+			case 't':
+				b.WriteString(strconv.FormatInt(sig.Time.Unix(), 10))
+			default:
+				b.WriteString(f[i-2 : i+1])
+			}
+		default:
+			b.WriteString(f[i-1 : i+1])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,184 @@
+/*
+ * attributes_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+func TestAttributes(t *testing.T) {
+	rules := parseAttributes("", []byte(`
+# comment
+* text=auto
+*.bat eol=crlf
+*.png binary
+/docs/**/*.txt working-tree-encoding=UTF-16LE
+`))
+	rules = append(rules, parseAttributes("sub", []byte(`
+*.sh eol=lf
+*.bat !eol
+`))...)
+
+	expect := func(path string, k string, v string) {
+		a := rules.lookup(path)
+		if v != a[k] {
+			t.Errorf("path %q attr %q expect %q got %q", path, k, v, a[k])
+		}
+	}
+
+	expect("README.md", "text", "auto")
+	expect("a/b/run.bat", "eol", "crlf")
+	expect("a/b/run.bat", "text", "auto")
+	expect("image.png", "text", attrUnset)
+	expect("image.png", "diff", attrUnset)
+	expect("docs/x/y/file.txt", "working-tree-encoding", "UTF-16LE")
+	expect("docs/file.txt", "working-tree-encoding", "UTF-16LE")
+	expect("other/docs/file.txt", "working-tree-encoding", "")
+	expect("sub/run.sh", "eol", "lf")
+	expect("run.sh", "eol", "")
+	expect("sub/run.bat", "eol", "")
+}
+
+func TestSmudge(t *testing.T) {
+	conf := attrConfig{}
+	conf.setEol("crlf")
+
+	s := conf.newSmudge(map[string]string{"text": "auto"}, nil)
+	if nil == s || !s.crlf || !s.auto {
+		t.Fatal(s)
+	}
+	if c := s.apply([]byte("a\nb\r\nc\n")); !bytes.Equal([]byte("a\r\nb\r\nc\r\n"), c) {
+		t.Errorf("%q", c)
+	}
+	if c := s.apply([]byte("a\n\x00b\n")); !bytes.Equal([]byte("a\n\x00b\n"), c) {
+		t.Errorf("%q", c)
+	}
+
+	if s := conf.newSmudge(map[string]string{"text": attrUnset}, nil); nil != s {
+		t.Error(s)
+	}
+	if s := conf.newSmudge(map[string]string{}, nil); nil != s {
+		t.Error(s)
+	}
+
+	conf.setEol("lf")
+	if s := conf.newSmudge(map[string]string{"text": attrSet}, nil); nil != s {
+		t.Error(s)
+	}
+	s = conf.newSmudge(map[string]string{"eol": "crlf"}, nil)
+	if nil == s || !s.crlf || ".crlf" != s.name() {
+		t.Fatal(s)
+	}
+
+	s = conf.newSmudge(map[string]string{"working-tree-encoding": "utf-16le"}, nil)
+	if nil == s || s.crlf || ".utf-16le" != s.name() {
+		t.Fatal(s)
+	}
+	if c := s.apply([]byte("hi")); !bytes.Equal([]byte("h\x00i\x00"), c) {
+		t.Errorf("%q", c)
+	}
+}
+
+func TestExport(t *testing.T) {
+	conf := attrConfig{export: true}
+
+	if !conf.ignore(map[string]string{"export-ignore": attrSet}) {
+		t.Error()
+	}
+	if conf.ignore(map[string]string{}) {
+		t.Error()
+	}
+
+	commit := &exportCommit{
+		hash: "609d3b892764952ef69676e653e06b2ca904be18",
+		commit: &git.Commit{
+			Author: git.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				Time:  time.Unix(1600000000, 0).UTC(),
+			},
+			TreeHash: "90f898ae1f8d3c976f9224d92e3b08d7813e961e",
+			Message:  "Subject line\n\nBody\n",
+		},
+	}
+
+	if s := conf.newSmudge(map[string]string{}, commit); nil != s {
+		t.Error(s)
+	}
+	s := conf.newSmudge(map[string]string{"export-subst": attrSet}, commit)
+	if nil == s || nil == s.subst {
+		t.Fatal(s)
+	}
+
+	c := s.apply([]byte("v=$Format:%h$ by $Format:%an <%ae>$ at $Format:%at$: $Format:%s$ $Format:x\n"))
+	e := "v=609d3b8 by Author <author@example.com> at 1600000000: Subject line $Format:x\n"
+	if e != string(c) {
+		t.Errorf("%q", c)
+	}
+}
+
+func TestIdent(t *testing.T) {
+	hash := "ce013625030ba8dba906f756967f9e9ca394464a"
+	conf := attrConfig{}
+
+	if s := conf.identSmudge(nil, hash, map[string]string{"ident": attrSet}, nil); nil != s {
+		t.Error(s)
+	}
+	conf.ident = true
+	if !conf.enabled() {
+		t.Error()
+	}
+	if s := conf.identSmudge(nil, hash, map[string]string{}, nil); nil != s {
+		t.Error(s)
+	}
+	s := conf.identSmudge(nil, hash, map[string]string{"ident": attrSet}, nil)
+	if nil == s || ".ident" != s.name() {
+		t.Fatal(s)
+	}
+
+	c := s.apply([]byte("$Id$ $Id: old $ $Id: x\n$Id $Ident$ $Id"))
+	e := "$Id: " + hash + " $ $Id: " + hash + " $ $Id: x\n$Id $Ident$ $Id"
+	if e != string(c) {
+		t.Errorf("%q", c)
+	}
+	if c := s.apply([]byte("no keywords\n")); "no keywords\n" != string(c) {
+		t.Errorf("%q", c)
+	}
+
+	commit := &exportCommit{
+		hash: "609d3b892764952ef69676e653e06b2ca904be18",
+		commit: &git.Commit{
+			Committer: git.Signature{
+				Name: "Committer",
+				Time: time.Unix(1600000000, 0).UTC(),
+			},
+		},
+		ref: "release/1.0",
+	}
+	s = conf.identSmudge(nil, hash, map[string]string{"ident": attrSet}, commit)
+	if nil == s || ".ident-"+commit.hash+"-release%2F1.0" != s.name() {
+		t.Fatal(s)
+	}
+
+	c = s.apply([]byte("$Id$ $Commit$ $Ref: old $ $Date$ $Commits$"))
+	e = "$Id: " + hash + " $ $Commit: " + commit.hash + " $ $Ref: release/1.0 $ " +
+		"$Date: 2020-09-13T12:26:40Z $ $Commits$"
+	if e != string(c) {
+		t.Errorf("%q", c)
+	}
+}
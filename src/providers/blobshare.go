@@ -0,0 +1,191 @@
+/*
+ * blobshare.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/billziss-gh/hubfs/metrics"
+)
+
+// blobSet shares the readers of blobs that are open simultaneously. Trees often
+// contain many identical files (same blob hash); opening them all results in a
+// single backing reader (and a single buffer or file descriptor) per blob. Blobs
+// that are opened simultaneously before they are in the cache are fetched once.
+type blobSet struct {
+	lock  sync.Mutex
+	blobs map[string]*sharedBlob
+	loads map[string]*blobLoad
+}
+
+// blobLoad tracks a blob load in progress; concurrent requests for the same blob wait for it.
+type blobLoad struct {
+	done     chan struct{}
+	err      error
+	canceled bool
+}
+
+type sharedBlob struct {
+	key    string
+	reader io.ReaderAt
+	refs   int
+}
+
+// blobHandle is the reader returned to callers. Each handle has its own offset
+// for sequential reads.
+type blobHandle struct {
+	set    *blobSet
+	blob   *sharedBlob
+	lock   sync.Mutex
+	off    int64
+	closed bool
+}
+
+// Function get returns a new handle to the shared reader for key, if one is open.
+func (s *blobSet) get(key string) (io.ReaderAt, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return nil, false
+	}
+	blob.refs++
+	return &blobHandle{set: s, blob: blob}, true
+}
+
+// Function add shares reader under key and returns a handle to it. If another
+// reader was shared under the same key in the meantime, reader is closed and a
+// handle to the existing reader is returned instead.
+func (s *blobSet) add(key string, reader io.ReaderAt) io.ReaderAt {
+	s.lock.Lock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		if nil == s.blobs {
+			s.blobs = make(map[string]*sharedBlob)
+		}
+		blob = &sharedBlob{key: key, reader: reader}
+		s.blobs[key] = blob
+		metrics.AddGauge("providers.blobs", 1)
+	}
+	blob.refs++
+	s.lock.Unlock()
+
+	if ok {
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	return &blobHandle{set: s, blob: blob}
+}
+
+// Function load returns a new handle to the shared reader for key. If there is none,
+// it calls fn to open the reader and shares it; concurrent loads of the same key wait
+// for the first one and share its reader, or fail with its error.
+func (s *blobSet) load(ctx context.Context, key string,
+	fn func() (io.ReaderAt, error)) (io.ReaderAt, error) {
+	s.lock.Lock()
+	if blob, ok := s.blobs[key]; ok {
+		blob.refs++
+		s.lock.Unlock()
+		return &blobHandle{set: s, blob: blob}, nil
+	}
+	if load, ok := s.loads[key]; ok {
+		s.lock.Unlock()
+		select {
+		case <-load.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if nil != load.err && !load.canceled {
+			return nil, load.err
+		}
+		return s.load(ctx, key, fn)
+	}
+	load := &blobLoad{done: make(chan struct{})}
+	if nil == s.loads {
+		s.loads = make(map[string]*blobLoad)
+	}
+	s.loads[key] = load
+	s.lock.Unlock()
+
+	reader, err := fn()
+	load.err = err
+	load.canceled = nil != ctx.Err()
+
+	var res io.ReaderAt
+	if nil == err && nil != reader {
+		res = s.add(key, reader)
+	}
+
+	s.lock.Lock()
+	delete(s.loads, key)
+	s.lock.Unlock()
+	close(load.done)
+
+	return res, err
+}
+
+func (s *blobSet) release(blob *sharedBlob) (err error) {
+	s.lock.Lock()
+	blob.refs--
+	last := 0 == blob.refs
+	if last {
+		delete(s.blobs, blob.key)
+		metrics.AddGauge("providers.blobs", -1)
+	}
+	s.lock.Unlock()
+
+	if last {
+		if closer, ok := blob.reader.(io.Closer); ok {
+			err = closer.Close()
+		}
+	}
+	return
+}
+
+func (h *blobHandle) ReadAt(p []byte, off int64) (int, error) {
+	return h.blob.reader.ReadAt(p, off)
+}
+
+// Function CacheFile returns the cache file that backs the shared reader, if any.
+func (h *blobHandle) CacheFile() *os.File {
+	file, _ := h.blob.reader.(*os.File)
+	return file
+}
+
+func (h *blobHandle) Read(p []byte) (n int, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	n, err = h.blob.reader.ReadAt(p, h.off)
+	h.off += int64(n)
+	if 0 < n && io.EOF == err {
+		err = nil
+	}
+	return
+}
+
+func (h *blobHandle) Close() error {
+	h.lock.Lock()
+	closed := h.closed
+	h.closed = true
+	h.lock.Unlock()
+	if closed {
+		return os.ErrClosed
+	}
+	return h.set.release(h.blob)
+}
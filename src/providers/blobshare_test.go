@@ -0,0 +1,206 @@
+/*
+ * blobshare_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type testBlobReader struct {
+	*bytes.Reader
+	closed int
+}
+
+func (r *testBlobReader) Close() error {
+	r.closed++
+	return nil
+}
+
+func TestBlobSet(t *testing.T) {
+	var set blobSet
+
+	if _, ok := set.get("a"); ok {
+		t.Error()
+	}
+
+	r0 := &testBlobReader{Reader: bytes.NewReader([]byte("hello"))}
+	h0 := set.add("a", r0)
+
+	h1, ok := set.get("a")
+	if !ok {
+		t.Fatal()
+	}
+
+	r1 := &testBlobReader{Reader: bytes.NewReader([]byte("hello"))}
+	h2 := set.add("a", r1)
+	if 1 != r1.closed {
+		t.Error()
+	}
+
+	b, err := ioutil.ReadAll(h1.(io.Reader))
+	if nil != err || "hello" != string(b) {
+		t.Error(err, b)
+	}
+	b, err = ioutil.ReadAll(h2.(io.Reader))
+	if nil != err || "hello" != string(b) {
+		t.Error(err, b)
+	}
+
+	h0.(io.Closer).Close()
+	h1.(io.Closer).Close()
+	if 0 != r0.closed {
+		t.Error()
+	}
+	if nil == h1.(io.Closer).Close() {
+		t.Error()
+	}
+	h2.(io.Closer).Close()
+	if 1 != r0.closed {
+		t.Error()
+	}
+
+	if _, ok := set.get("a"); ok {
+		t.Error()
+	}
+}
+
+func TestBlobSetCacheFile(t *testing.T) {
+	var set blobSet
+
+	h0 := set.add("a", &testBlobReader{Reader: bytes.NewReader([]byte("hello"))})
+	if nil != h0.(CacheFile).CacheFile() {
+		t.Error()
+	}
+	h0.(io.Closer).Close()
+
+	file, err := ioutil.TempFile("", "blobshare-test-*")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+
+	h1 := set.add("b", file)
+	f := h1.(CacheFile).CacheFile()
+	if file != f {
+		t.Error()
+	}
+	b := make([]byte, 5)
+	n, err := f.ReadAt(b, 0)
+	if nil != err || 5 != n || "hello" != string(b) {
+		t.Error(err, b)
+	}
+
+	h1.(io.Closer).Close()
+	if _, err := file.ReadAt(b, 0); nil == err {
+		t.Error()
+	}
+}
+
+func TestBlobSetLoad(t *testing.T) {
+	var set blobSet
+	ctx := context.Background()
+
+	// fn signals on started when it is called and completes when release is closed
+	calls := int32(0)
+	var started, release chan struct{}
+	fn := func(err error) func() (io.ReaderAt, error) {
+		return func() (io.ReaderAt, error) {
+			atomic.AddInt32(&calls, 1)
+			started <- struct{}{}
+			<-release
+			if nil != err {
+				return nil, err
+			}
+			return &testBlobReader{Reader: bytes.NewReader([]byte("hello"))}, nil
+		}
+	}
+
+	started, release = make(chan struct{}, 16), make(chan struct{})
+	var wg sync.WaitGroup
+	handles := make([]io.ReaderAt, 8)
+	for i := range handles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h, err := set.load(ctx, "a", fn(nil))
+			if nil != err {
+				t.Error(err)
+			}
+			handles[i] = h
+		}(i)
+	}
+	<-started
+	close(release)
+	wg.Wait()
+
+	if 1 != atomic.LoadInt32(&calls) {
+		t.Error(calls)
+	}
+	for _, h := range handles {
+		if nil == h {
+			continue
+		}
+		b, err := ioutil.ReadAll(h.(io.Reader))
+		if nil != err || "hello" != string(b) {
+			t.Error(err, b)
+		}
+		h.(io.Closer).Close()
+	}
+	if 0 != len(set.blobs) || 0 != len(set.loads) {
+		t.Error(set.blobs, set.loads)
+	}
+
+	// errors are delivered to all waiters; a later load retries
+	e := errors.New("fetch error")
+	started, release = make(chan struct{}, 16), make(chan struct{})
+	errs := make(chan error, 2)
+	go func() {
+		_, err := set.load(ctx, "b", fn(e))
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err := set.load(ctx, "b", fn(e))
+		errs <- err
+	}()
+	close(release)
+	if err0, err1 := <-errs, <-errs; e != err0 || e != err1 {
+		t.Error(err0, err1)
+	}
+	h, err := set.load(ctx, "b", fn(nil))
+	if nil != err || nil == h {
+		t.Fatal(err)
+	}
+	h.(io.Closer).Close()
+
+	// a waiter whose context is canceled stops waiting
+	started, release = make(chan struct{}, 16), make(chan struct{})
+	go set.load(ctx, "c", fn(nil))
+	<-started
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := set.load(cctx, "c", fn(nil)); context.Canceled != err {
+		t.Error(err)
+	}
+	close(release)
+}
@@ -60,6 +60,7 @@ type cacheItem struct {
 	libcache.MapItem
 	lastUsedTime time.Time
 	inUse        int64
+	ttl          time.Duration // item time-to-live (0: cache ttl); expiry is in LRU order
 }
 
 type expirable interface {
@@ -81,8 +82,15 @@ func (c *cache) newCacheImap() *cacheImap {
 	return NewCacheImap(&c.lrulist)
 }
 
+func (c *cache) itemTTL(citem *cacheItem) time.Duration {
+	if 0 != citem.ttl && 0 != c.ttl {
+		return citem.ttl
+	}
+	return c.ttl
+}
+
 func (c *cache) touchCacheItem(citem *cacheItem, delta int) {
-	citem.lastUsedTime = time.Now().Add(c.ttl)
+	citem.lastUsedTime = time.Now().Add(c.itemTTL(citem))
 	citem.inUse += int64(delta)
 }
 
@@ -90,7 +98,7 @@ func (c *cache) expireCacheItem(citem *cacheItem, currentTime time.Time, fn func
 	if citem.lastUsedTime.After(currentTime) {
 		return false
 	}
-	citem.lastUsedTime = currentTime.Add(c.ttl)
+	citem.lastUsedTime = currentTime.Add(c.itemTTL(citem))
 	citem.Remove()
 	citem.InsertTail(&c.lrulist)
 	if 0 >= citem.inUse {
@@ -0,0 +1,108 @@
+/*
+ * cacheverify.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+// CacheVerifyStats contains the statistics of a cache verification.
+type CacheVerifyStats struct {
+	Objects int   // number of objects verified
+	Bytes   int64 // number of bytes verified
+	Corrupt int   // number of corrupt objects removed
+	Skipped int   // number of converted objects (see config.attr) that cannot be verified
+	Errors  int   // number of objects that could not be read
+}
+
+// Function VerifyCache re-hashes the objects in the cache directory dir against their IDs
+// and removes the ones that do not match, so that they are fetched again when next
+// needed. The directory may be a client cache directory or the cache directory of a
+// single repository. Function report (if not nil) is called for every object that is
+// corrupt (with git.ErrChecksum) or that cannot be read.
+func VerifyCache(ctx context.Context, dir string, report func(path string, err error)) (
+	stats CacheVerifyStats, err error) {
+
+	if nil == report {
+		report = func(path string, err error) {}
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if nil != ctx.Err() {
+			return ctx.Err()
+		}
+		if nil != err {
+			if path == dir {
+				return err
+			}
+			stats.Errors++
+			report(path, err)
+			return nil
+		}
+		if info.IsDir() {
+			if "quarantine" == info.Name() || ".trash" == info.Name() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		prefix := filepath.Base(filepath.Dir(path))
+		if "objects" != filepath.Base(filepath.Dir(filepath.Dir(path))) || 2 != len(prefix) {
+			return nil
+		}
+		name := info.Name()
+		if ".tmp" == filepath.Ext(name) {
+			return nil
+		}
+		if 38 < len(name) {
+			stats.Skipped++
+			return nil
+		}
+		hash := prefix + name
+		if _, e := hex.DecodeString(hash); nil != e || 40 != len(hash) {
+			return nil
+		}
+
+		file, e := os.Open(path)
+		ok := false
+		if nil == e {
+			ok, e = git.VerifyReader(hash, 0, file, info.Size())
+			file.Close()
+		}
+		if nil != e {
+			stats.Errors++
+			report(path, e)
+			return nil
+		}
+		stats.Objects++
+		stats.Bytes += info.Size()
+		if !ok {
+			stats.Corrupt++
+			if e = os.Remove(path); nil != e {
+				stats.Errors++
+				report(path, e)
+			} else {
+				report(path, git.ErrChecksum)
+			}
+		}
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,84 @@
+/*
+ * cacheverify_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+func TestVerifyCacheDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cacheverify_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const helloBlob = "ce013625030ba8dba906f756967f9e9ca394464a"
+	const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	const badBlob = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+
+	for name, content := range map[string]string{
+		"owner/repo/objects/ce/013625030ba8dba906f756967f9e9ca394464a":      "hello\n",
+		"owner/repo/objects/4b/825dc642cb6eb9a060e54bf8d69288fbee4904":      "",
+		"owner/repo/objects/e6/9de29bb2d1d6434b8b29ae775ad8c2e48c5391":      "rot",
+		"owner/repo/objects/ce/013625030ba8dba906f756967f9e9ca394464a.crlf": "hello\r\n",
+		"owner/repo/objects/ce/013625030ba8dba906f756967f9e9ca394464a.tmp":  "hel",
+		"owner/repo/quarantine/e69de29bb2d1d6434b8b29ae775ad8c2e48c5391":    "rot",
+		"owner/repo/files/main/README":                                      "readme",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	reported := map[string]error{}
+	stats, err := VerifyCache(context.Background(), dir, func(path string, err error) {
+		reported[path] = err
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 3 != stats.Objects || 9 != stats.Bytes || 1 != stats.Corrupt ||
+		1 != stats.Skipped || 0 != stats.Errors {
+		t.Error(stats)
+	}
+
+	bad := objectPath(filepath.Join(dir, "owner", "repo"), badBlob)
+	if 1 != len(reported) || git.ErrChecksum != reported[bad] {
+		t.Error(reported)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	for _, hash := range []string{helloBlob, emptyTree} {
+		if _, err := os.Stat(objectPath(filepath.Join(dir, "owner", "repo"), hash)); nil != err {
+			t.Error(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = VerifyCache(ctx, dir, nil); context.Canceled != err {
+		t.Error(err)
+	}
+}
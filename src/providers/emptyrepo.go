@@ -14,6 +14,7 @@
 package providers
 
 import (
+	"context"
 	"io"
 )
 
@@ -48,31 +49,31 @@ func (*emptyRepositoryT) Name() string {
 	return ""
 }
 
-func (*emptyRepositoryT) GetRefs() ([]Ref, error) {
+func (*emptyRepositoryT) GetRefs(ctx context.Context) ([]Ref, error) {
 	return []Ref{}, nil
 }
 
-func (*emptyRepositoryT) GetRef(name string) (Ref, error) {
+func (*emptyRepositoryT) GetRef(ctx context.Context, name string) (Ref, error) {
 	return nil, ErrNotFound
 }
 
-func (*emptyRepositoryT) GetTempRef(name string) (Ref, error) {
+func (*emptyRepositoryT) GetTempRef(ctx context.Context, name string) (Ref, error) {
 	return nil, ErrNotFound
 }
 
-func (*emptyRepositoryT) GetTree(ref Ref, entry TreeEntry) ([]TreeEntry, error) {
+func (*emptyRepositoryT) GetTree(ctx context.Context, ref Ref, entry TreeEntry) ([]TreeEntry, error) {
 	return []TreeEntry{}, nil
 }
 
-func (*emptyRepositoryT) GetTreeEntry(ref Ref, entry TreeEntry, name string) (TreeEntry, error) {
+func (*emptyRepositoryT) GetTreeEntry(ctx context.Context, ref Ref, entry TreeEntry, name string) (TreeEntry, error) {
 	return nil, ErrNotFound
 }
 
-func (*emptyRepositoryT) GetBlobReader(entry TreeEntry) (io.ReaderAt, error) {
+func (*emptyRepositoryT) GetBlobReader(ctx context.Context, entry TreeEntry) (io.ReaderAt, error) {
 	return nil, ErrNotFound
 }
 
-func (*emptyRepositoryT) GetModule(ref Ref, path string, rootrel bool) (string, error) {
+func (*emptyRepositoryT) GetModule(ctx context.Context, ref Ref, path string, rootrel bool) (string, error) {
 	return "", ErrNotFound
 }
 
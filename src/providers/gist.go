@@ -0,0 +1,127 @@
+/*
+ * gist.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Gists are git repositories, so the gist provider (gist.github.com) presents them as
+// repositories: / user / gist-id / ref / path. It is implemented by a GitHub client whose
+// repository enumeration lists the gists of a user rather than the user's repositories.
+
+func NewGistProvider() *GithubProvider {
+	provider := NewGithubProvider()
+	provider.Scopes = "gist"
+	provider.Gists = true
+	return provider
+}
+
+func NewGistClient(apiURI string, token string) (Client, error) {
+	client, err := NewGithubClient(apiURI, token)
+	if nil != err {
+		return nil, err
+	}
+	client.(*githubClient).gists = true
+	return client, nil
+}
+
+func init() {
+	RegisterProvider("https://gist.github.com", NewGistProvider())
+}
+
+type githubGist struct {
+	Id         string `json:"id"`
+	GitPullURL string `json:"git_pull_url"`
+	Owner      struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+func (client *githubClient) getGistPage(ctx context.Context, path string) ([]*githubRepository, error) {
+	rsp, err := client.sendrecv(ctx, path)
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var content []*githubGist
+	err = json.NewDecoder(rsp.Body).Decode(&content)
+	if nil != err {
+		return nil, err
+	}
+
+	res := make([]*githubRepository, len(content))
+	for i, elm := range content {
+		r := &githubRepository{
+			FName:   elm.Id,
+			FRemote: elm.GitPullURL,
+		}
+		r.FOwner.Login = elm.Owner.Login
+		r.Value = r
+		r.Repository = emptyRepository
+		r.keepdir = client.keepdir
+		res[i] = r
+	}
+
+	return res, nil
+}
+
+// Function getGists returns the gists of a user. The authenticated user's own gists
+// include secret gists.
+func (client *githubClient) getGists(ctx context.Context, owner string) (res []*githubRepository, err error) {
+	defer trace(owner)(&err)
+
+	var path string
+	if client.getLogin() == owner {
+		path = "/gists?per_page=100"
+	} else {
+		path = fmt.Sprintf("/users/%s/gists?per_page=100", owner)
+	}
+
+	res = make([]*githubRepository, 0)
+	for page := 1; ; page++ {
+		lst, err := client.getGistPage(ctx, path+fmt.Sprintf("&page=%d", page))
+		if nil != err {
+			return nil, err
+		}
+		res = append(res, lst...)
+		if len(lst) < 100 {
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// Function gistCloneURI returns the clone URI of a gist.
+func (client *githubClient) gistCloneURI(name string) string {
+	u, err := url.Parse(client.apiURI)
+	if nil != err {
+		return ""
+	}
+	if strings.HasPrefix(u.Host, "api.") {
+		u.Host = "gist." + strings.TrimPrefix(u.Host, "api.")
+		u.Path = "/" + name + ".git"
+	} else {
+		// GitHub Enterprise Server serves gists under /gist
+		u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/v3")
+		u.Path += "/gist/" + name + ".git"
+	}
+	return u.String()
+}
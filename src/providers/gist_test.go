@@ -0,0 +1,67 @@
+/*
+ * gist_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/alice":
+			w.Write([]byte(`{"login":"alice","type":"User"}`))
+		case "/users/alice/gists":
+			w.Write([]byte(`[{"id":"aa0123456789","git_pull_url":"https://gist.example.com/aa0123456789.git",` +
+				`"owner":{"login":"alice"}}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGistProvider().NewClient("")
+	if nil != err {
+		t.Fatal(err)
+	}
+	client.(*githubClient).apiURI = server.URL
+
+	owner, err := client.OpenOwner(context.Background(), "alice")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.CloseOwner(owner)
+
+	repositories, err := client.GetRepositories(context.Background(), owner)
+	if nil != err || 1 != len(repositories) || "aa0123456789" != repositories[0].Name() {
+		t.Fatal(err, repositories)
+	}
+	if r := repositories[0].(*githubRepository); "https://gist.example.com/aa0123456789.git" != r.FRemote {
+		t.Error(r.FRemote)
+	}
+}
+
+func TestGistCloneURI(t *testing.T) {
+	client := &githubClient{apiURI: "https://api.github.com", gists: true}
+	if u := client.cloneURI("alice", "aa01"); "https://gist.github.com/aa01.git" != u {
+		t.Error(u)
+	}
+	client = &githubClient{apiURI: "https://ghe.example.com/api/v3/", gists: true}
+	if u := client.cloneURI("alice", "aa01"); "https://ghe.example.com/gist/aa01.git" != u {
+		t.Error(u)
+	}
+}
@@ -15,6 +15,7 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
@@ -22,70 +23,171 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/billziss-gh/golib/config"
 	"github.com/billziss-gh/hubfs/git"
+	"github.com/billziss-gh/hubfs/hooks"
+	"github.com/billziss-gh/hubfs/metrics"
+	"golang.org/x/text/unicode/norm"
 )
 
 type gitRepository struct {
-	remote  string
-	token   string
-	caseins bool
-	once    sync.Once
-	repo    *git.Repository
-	lock    sync.RWMutex
-	refs    map[string]*gitRef
-	dir     string
+	remote     string
+	cred       *git.Credentials
+	caseins    bool
+	conf       *gitConfig
+	openmux    sync.Mutex
+	opened     bool
+	repo       *git.Repository
+	lock       sync.RWMutex
+	refs       map[string]*gitRef
+	refsTime   time.Time
+	prefixRefs map[string]*prefixRef // refs resolved individually before refs are loaded
+	refreshing bool
+	notify     func(ref string, created bool) // reports branches created or deleted
+	watch      *time.Timer                    // schedules the next revalidation
+	closed     bool
+	treeLoads  map[interface{}]*treeLoad
+	blobs      blobSet
+	pins       *pinSet  // blobs read are pinned in the cache (config.pin)
+	verified   sync.Map // cached objects whose content matches their ID
+	dir        string
 }
 
 type gitRef struct {
-	name       string
-	commitHash string
-	tree       map[string]*gitTreeEntry
-	treeTime   time.Time
-	modules    map[string]string
+	name         string
+	commitHash   string
+	tree         map[string]*gitTreeEntry
+	treeTime     time.Time
+	signature    SignatureInfo
+	tagSignature SignatureInfo
+	commit       *exportCommit
+	modules      map[string]string
+	mtimes       map[string]map[string]time.Time // commit times of directory entries
 }
 
+// prefixRef is a ref that has been resolved individually (see resolveRef); ref is nil if
+// the ref does not exist.
+type prefixRef struct {
+	ref  *gitRef
+	time time.Time
+}
+
+// treeLoad tracks a tree load in progress; concurrent requests for the same tree wait for it.
+type treeLoad struct {
+	done     chan struct{}
+	err      error
+	canceled bool
+}
+
+// maximum number of annotated tags followed when resolving a ref to a commit
+const maxTagDepth = 8
+
+// maximum time spent revalidating refs in the background if config.timeout.refs is 0
+const refreshTimeout = 30 * time.Second
+
 type gitTreeEntry struct {
 	entry  git.TreeEntry
+	path   string
 	size   int64
 	target string
 	tree   map[string]*gitTreeEntry
+	attrs  attrRules // attribute rules in effect in the directory of this entry
+	smudge *smudge
+	crypt  string // name of the transform that decrypts the content (if any)
 }
 
-func NewGitRepository(remote string, token string, caseins bool) (Repository, error) {
+// gitConfig holds settings shared by all repositories of a client.
+type gitConfig struct {
+	trust    *trustPolicy
+	attrs    attrConfig
+	lock     *lockfile
+	refttl   time.Duration // time after which resolved refs are revalidated; 0 means never
+	listings bool          // persist the tree listings of all refs (see policy.go)
+	unorm    string        // Unicode normalization form of path keys: "", "nfc" or "nfd"
+	depth    int           // commits examined for commit times; 0 means defaultHistoryDepth
+	timeouts timeouts
+}
+
+func NewGitRepository(ctx context.Context, remote string, token string, caseins bool) (
+	Repository, error) {
 	r := &gitRepository{
 		remote:  remote,
-		token:   token,
+		cred:    git.NewCredentials(token),
 		caseins: caseins,
+		conf:    &gitConfig{timeouts: defaultTimeouts},
 	}
 
-	var err error
-	r.once.Do(func() { err = r.open() })
+	r.openmux.Lock()
+	err := r.open(ctx)
+	r.openmux.Unlock()
 	if nil != err {
 		return nil, err
 	}
 
+	metrics.AddGauge("providers.repositories", 1)
 	return r, nil
 }
 
-func newGitRepository(remote string, token string, caseins bool) Repository {
+func newGitRepository(remote string, cred *git.Credentials, caseins bool, conf *gitConfig) Repository {
+	metrics.AddGauge("providers.repositories", 1)
 	return &gitRepository{
 		remote:  remote,
-		token:   token,
+		cred:    cred,
 		caseins: caseins,
+		conf:    conf,
 	}
 }
 
-func (r *gitRepository) open() (err error) {
-	r.repo, err = git.OpenRepository(r.remote, r.token)
+// Function open opens the remote repository. Only a repository that does not exist (or
+// is empty) is remembered as unavailable; other failures, such as authentication
+// failures, rate limits or network errors, are returned and the open is retried by the
+// next caller.
+func (r *gitRepository) open(ctx context.Context) (err error) {
+	r.repo, err = git.OpenRepositoryWithCredentials(ctx, r.remote, r.cred)
+	switch {
+	case nil == err:
+		r.opened = true
+	case git.ErrRepositoryNotFound == err || git.ErrEmptyRepository == err:
+		r.opened = true
+		err = ErrNotFound
+	case git.ErrAuthenticationRequired == err || git.ErrAuthorizationFailed == err:
+		err = ErrPermission
+	}
 	return
 }
 
+// Function ensureOpen opens the remote repository on first use.
+func (r *gitRepository) ensureOpen(ctx context.Context) error {
+	r.openmux.Lock()
+	defer r.openmux.Unlock()
+	if !r.opened {
+		if err := r.open(ctx); nil != err {
+			return err
+		}
+	}
+	if nil == r.repo {
+		return ErrNotFound
+	}
+	return nil
+}
+
 func (r *gitRepository) Close() (err error) {
+	r.lock.Lock()
+	if !r.closed {
+		metrics.AddGauge("providers.repositories", -1)
+	}
+	r.closed = true
+	if nil != r.watch {
+		r.watch.Stop()
+		r.watch = nil
+	}
+	r.lock.Unlock()
+
 	if nil != r.repo {
 		err = r.repo.Close()
 	}
@@ -151,6 +253,71 @@ func writeObject(dir string, hash string, content []byte) {
 	}
 }
 
+// Function storeObject stores a fetched object in the cache. The content of fetched
+// objects has been verified against their IDs (see git.ErrChecksum).
+func (r *gitRepository) storeObject(dir string, hash string, content []byte) {
+	writeObject(dir, hash, content)
+	r.verified.Store(hash, true)
+}
+
+// Function verifyContent reports whether the content of an object that was read from the
+// cache matches its ID. An object that does not match is quarantined, so that it is
+// fetched again. Each object is verified once.
+func (r *gitRepository) verifyContent(dir string, hash string, content []byte) bool {
+	if _, ok := r.verified.Load(hash); ok {
+		return true
+	}
+	if !git.VerifyObject(hash, 0, content) {
+		r.quarantineObject(dir, hash)
+		return false
+	}
+	r.verified.Store(hash, true)
+	return true
+}
+
+// Function verifyFile is like verifyContent, but reads the content of a blob from its
+// cache file. It reports false if the blob is not in the cache.
+func (r *gitRepository) verifyFile(dir string, hash string) bool {
+	if _, ok := r.verified.Load(hash); ok {
+		return true
+	}
+	file, err := os.Open(objectPath(dir, hash))
+	if nil != err {
+		return false
+	}
+	ok := false
+	info, err := file.Stat()
+	if nil == err {
+		ok, err = git.VerifyBlob(hash, file, info.Size())
+	}
+	file.Close()
+	if nil != err {
+		return false
+	}
+	if !ok {
+		r.quarantineObject(dir, hash)
+		return false
+	}
+	r.verified.Store(hash, true)
+	return true
+}
+
+// Function quarantineObject moves a cached object whose content does not match its ID to
+// the quarantine directory of the repository and reports it.
+func (r *gitRepository) quarantineObject(dir string, hash string) {
+	path := objectPath(dir, hash)
+	qdir := filepath.Join(dir, "quarantine")
+	err := os.MkdirAll(qdir, 0700)
+	if nil == err {
+		err = os.Rename(path, filepath.Join(qdir, hash))
+	}
+	if nil != err {
+		os.Remove(path)
+	}
+	tracef("repo=%#v object=%s: checksum mismatch; quarantined", r.remote, hash)
+	hooks.Fire(hooks.CorruptObject, map[string]string{"remote": r.remote, "object": hash})
+}
+
 func containsString(l []string, s string) bool {
 	for _, i := range l {
 		if i == s {
@@ -160,7 +327,7 @@ func containsString(l []string, s string) bool {
 	return false
 }
 
-func (r *gitRepository) prefetchObjects(dir string, want []string,
+func (r *gitRepository) prefetchObjects(ctx context.Context, dir string, want []string,
 	fn func(hash string, size int64) error) error {
 
 	if 0 == len(want) {
@@ -171,7 +338,7 @@ func (r *gitRepository) prefetchObjects(dir string, want []string,
 		w := make([]string, 0, len(want))
 		for _, hash := range want {
 			info, err := os.Stat(objectPath(dir, hash))
-			if nil != err {
+			if nil != err || !r.verifyFile(dir, hash) {
 				w = append(w, hash)
 			} else {
 				err = fn(hash, info.Size())
@@ -181,13 +348,14 @@ func (r *gitRepository) prefetchObjects(dir string, want []string,
 			}
 		}
 
+		metrics.CountCache(len(want)-len(w), len(w))
 		want = w
 		if 0 == len(want) {
 			return nil
 		}
 
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
-			writeObject(dir, hash, content)
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
+			r.storeObject(dir, hash, content)
 			if !containsString(want, hash) {
 				return nil
 			}
@@ -198,7 +366,8 @@ func (r *gitRepository) prefetchObjects(dir string, want []string,
 			return fn(hash, info.Size())
 		})
 	} else {
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
+		metrics.CountCache(0, len(want))
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
 			if !containsString(want, hash) {
 				return nil
 			}
@@ -207,7 +376,7 @@ func (r *gitRepository) prefetchObjects(dir string, want []string,
 	}
 }
 
-func (r *gitRepository) fetchObjects(dir string, want []string,
+func (r *gitRepository) fetchObjects(ctx context.Context, dir string, want []string,
 	fn func(hash string, content []byte) error) error {
 
 	if 0 == len(want) {
@@ -218,7 +387,7 @@ func (r *gitRepository) fetchObjects(dir string, want []string,
 		w := make([]string, 0, len(want))
 		for _, hash := range want {
 			content, err := ioutil.ReadFile(objectPath(dir, hash))
-			if nil != err {
+			if nil != err || !r.verifyContent(dir, hash, content) {
 				w = append(w, hash)
 			} else {
 				err = fn(hash, content)
@@ -228,20 +397,22 @@ func (r *gitRepository) fetchObjects(dir string, want []string,
 			}
 		}
 
+		metrics.CountCache(len(want)-len(w), len(w))
 		want = w
 		if 0 == len(want) {
 			return nil
 		}
 
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
-			writeObject(dir, hash, content)
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
+			r.storeObject(dir, hash, content)
 			if !containsString(want, hash) {
 				return nil
 			}
 			return fn(hash, content)
 		})
 	} else {
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
+		metrics.CountCache(0, len(want))
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
 			if !containsString(want, hash) {
 				return nil
 			}
@@ -250,7 +421,7 @@ func (r *gitRepository) fetchObjects(dir string, want []string,
 	}
 }
 
-func (r *gitRepository) refetchObjects(dir string, want []string,
+func (r *gitRepository) refetchObjects(ctx context.Context, dir string, want []string,
 	fn func(hash string, ot git.ObjectType) error) error {
 
 	if 0 == len(want) {
@@ -258,15 +429,15 @@ func (r *gitRepository) refetchObjects(dir string, want []string,
 	}
 
 	if "" != dir {
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
-			writeObject(dir, hash, content)
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
+			r.storeObject(dir, hash, content)
 			if !containsString(want, hash) {
 				return nil
 			}
 			return fn(hash, ot)
 		})
 	} else {
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
 			if !containsString(want, hash) {
 				return nil
 			}
@@ -288,7 +459,7 @@ func (readerAtNopCloser) Close() error {
 	return nil
 }
 
-func (r *gitRepository) fetchReaders(dir string, want []string,
+func (r *gitRepository) fetchReaders(ctx context.Context, dir string, want []string,
 	fn func(hash string, reader io.ReaderAt) error) error {
 
 	if 0 == len(want) {
@@ -298,6 +469,10 @@ func (r *gitRepository) fetchReaders(dir string, want []string,
 	if "" != dir {
 		w := make([]string, 0, len(want))
 		for _, hash := range want {
+			if !r.verifyFile(dir, hash) {
+				w = append(w, hash)
+				continue
+			}
 			reader, err := os.Open(objectPath(dir, hash))
 			if nil != err {
 				w = append(w, hash)
@@ -309,13 +484,14 @@ func (r *gitRepository) fetchReaders(dir string, want []string,
 			}
 		}
 
+		metrics.CountCache(len(want)-len(w), len(w))
 		want = w
 		if 0 == len(want) {
 			return nil
 		}
 
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
-			writeObject(dir, hash, content)
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
+			r.storeObject(dir, hash, content)
 			if !containsString(want, hash) {
 				return nil
 			}
@@ -326,7 +502,8 @@ func (r *gitRepository) fetchReaders(dir string, want []string,
 			return fn(hash, reader)
 		})
 	} else {
-		return r.repo.FetchObjects(want, func(hash string, ot git.ObjectType, content []byte) error {
+		metrics.CountCache(0, len(want))
+		return r.repo.FetchObjects(ctx, want, func(hash string, ot git.ObjectType, content []byte) error {
 			if !containsString(want, hash) {
 				return nil
 			}
@@ -340,25 +517,110 @@ func (r *gitRepository) Name() string {
 	return path.Base(r.remote)
 }
 
-func (r *gitRepository) ensureRefs(fn func(refs map[string]*gitRef) error) error {
-	r.once.Do(func() { r.open() })
-	if nil == r.repo {
-		return ErrNotFound
+func (r *gitRepository) ensureRefs(ctx context.Context, fn func(refs map[string]*gitRef) error) error {
+	if err := r.ensureOpen(ctx); nil != err {
+		return err
 	}
 
 	r.lock.RLock()
 	if nil != r.refs {
+		stale := r.staleRefs()
 		err := fn(r.refs)
 		r.lock.RUnlock()
+		if stale {
+			r.revalidateRefs()
+		}
 		return err
 	}
 	r.lock.RUnlock()
 
-	m, err := r.repo.GetRefs()
+	m, err := r.repo.GetRefs(ctx)
 	if nil != err {
 		return err
 	}
 
+	r.lock.RLock()
+	old := make(map[string]*gitRef, len(r.prefixRefs))
+	for k, p := range r.prefixRefs {
+		if nil != p.ref {
+			old[k] = p.ref
+		}
+	}
+	r.lock.RUnlock()
+
+	refs := r.newRefs(m, old)
+
+	r.lock.Lock()
+	if nil == r.refs {
+		r.refs = refs
+		r.prefixRefs = nil
+		r.refsTime = time.Now()
+		r.scheduleRefs()
+	}
+	err = fn(r.refs)
+	r.lock.Unlock()
+	return err
+}
+
+// Function setRefNotify sets the function that is called with the branches that are
+// created or deleted when the refs are revalidated. While it is set the refs of the
+// open repository are revalidated every refttl, so that changes on the server are
+// noticed without the refs being accessed.
+func (r *gitRepository) setRefNotify(fn func(ref string, created bool)) {
+	r.lock.Lock()
+	r.notify = fn
+	if nil != r.refs {
+		r.scheduleRefs()
+	}
+	r.lock.Unlock()
+}
+
+// Function scheduleRefs schedules the next background revalidation of the refs.
+// It must be called with r.lock held.
+func (r *gitRepository) scheduleRefs() {
+	if nil != r.watch {
+		r.watch.Stop()
+		r.watch = nil
+	}
+	if nil == r.notify || r.closed || 0 == r.conf.refttl ||
+		(nil != r.conf.lock && r.conf.lock.frozen) {
+		return
+	}
+	r.watch = time.AfterFunc(r.conf.refttl, r.revalidateRefs)
+}
+
+// Function diffRefs returns the names of the branches that are in refs but not in old.
+func diffRefs(refs map[string]*gitRef, old map[string]*gitRef) (res []string) {
+	for k, e := range refs {
+		if _, ok := old[k]; !ok && strings.HasPrefix(e.name, "refs/heads/") {
+			res = append(res, e.name)
+		}
+	}
+	sort.Strings(res)
+	return
+}
+
+// Function updatedRefs returns the names of the branches that are in both refs and old
+// but resolve to a different commit.
+func updatedRefs(refs map[string]*gitRef, old map[string]*gitRef) (res []string) {
+	for k, e := range refs {
+		if o, ok := old[k]; ok && o.commitHash != e.commitHash &&
+			strings.HasPrefix(e.name, "refs/heads/") {
+			res = append(res, e.name)
+		}
+	}
+	sort.Strings(res)
+	return
+}
+
+// Function newRefs creates the ref map for the refs in m. Refs in old that still
+// resolve to the same commit are reused so that their cached trees are retained.
+func (r *gitRepository) newRefs(m map[string]string, old map[string]*gitRef) map[string]*gitRef {
+	if nil != r.conf.lock && r.conf.lock.frozen {
+		// frozen refs resolve to the commits recorded in the lockfile
+		m = r.conf.lock.remoteRefs(r.remote)
+	}
+
 	refs := make(map[string]*gitRef, len(m))
 	for n, h := range m {
 		k := n
@@ -366,23 +628,118 @@ func (r *gitRepository) ensureRefs(fn func(refs map[string]*gitRef) error) error
 			k = strings.ToUpper(k)
 		}
 
+		if o, ok := old[k]; ok && o.name == n && o.commitHash == h {
+			refs[k] = o
+			continue
+		}
+
 		refs[k] = &gitRef{
 			name:       n,
 			commitHash: h,
 		}
 	}
 
+	// temporary refs name a commit and never change
+	for k, o := range old {
+		if o.name == o.commitHash {
+			if _, ok := refs[k]; !ok {
+				refs[k] = o
+			}
+		}
+	}
+
+	return refs
+}
+
+// Function staleRefs reports whether the refs are due for revalidation.
+// It must be called with r.lock held.
+func (r *gitRepository) staleRefs() bool {
+	return 0 != r.conf.refttl && !r.refreshing &&
+		r.conf.refttl < time.Since(r.refsTime) &&
+		(nil == r.conf.lock || !r.conf.lock.frozen)
+}
+
+// Function revalidateRefs refreshes the refs in the background. Until the refresh
+// completes, callers continue to be served the previously resolved refs.
+func (r *gitRepository) revalidateRefs() {
 	r.lock.Lock()
-	if nil == r.refs {
-		r.refs = refs
+	if r.refreshing || r.closed {
+		r.lock.Unlock()
+		return
 	}
-	err = fn(r.refs)
+	r.refreshing = true
 	r.lock.Unlock()
-	return err
+
+	go func() {
+		d := r.conf.timeouts.refs
+		if 0 == d {
+			d = refreshTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+
+		m, err := r.repo.RefreshRefs(ctx)
+
+		var created, deleted, updated []string
+		r.lock.Lock()
+		notify := r.notify
+		fire := hooks.Enabled(hooks.RefUpdate)
+		if nil == err {
+			old := r.refs
+			r.refs = r.newRefs(m, old)
+			if nil != notify || fire {
+				created = diffRefs(r.refs, old)
+				deleted = diffRefs(old, r.refs)
+			}
+			if fire {
+				updated = updatedRefs(r.refs, old)
+			}
+		} else {
+			tracef("repo=%#v refresh refs: %v", r.remote, err)
+		}
+		// on failure the stale refs are kept until the next ttl period
+		r.refsTime = time.Now()
+		r.refreshing = false
+		r.scheduleRefs()
+		r.lock.Unlock()
+
+		if nil != notify {
+			for _, n := range created {
+				notify(n, true)
+			}
+			for _, n := range deleted {
+				notify(n, false)
+			}
+		}
+		if fire {
+			for _, n := range created {
+				r.fireRefUpdate(n, m[n], "created")
+			}
+			for _, n := range updated {
+				r.fireRefUpdate(n, m[n], "updated")
+			}
+			for _, n := range deleted {
+				r.fireRefUpdate(n, "", "deleted")
+			}
+		}
+	}()
+}
+
+func (r *gitRepository) fireRefUpdate(ref string, commit string, action string) {
+	hooks.Fire(hooks.RefUpdate, map[string]string{
+		"remote": r.remote,
+		"ref":    ref,
+		"commit": commit,
+		"action": action,
+	})
 }
 
-func (r *gitRepository) GetRefs() (res []Ref, err error) {
-	err = r.ensureRefs(func(refs map[string]*gitRef) error {
+func (r *gitRepository) GetRefs(ctx context.Context) (res []Ref, err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.refs)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	err = r.ensureRefs(ctx, func(refs map[string]*gitRef) error {
 		res = make([]Ref, len(refs))
 		i := 0
 		for _, e := range refs {
@@ -394,24 +751,102 @@ func (r *gitRepository) GetRefs() (res []Ref, err error) {
 	return
 }
 
-func (r *gitRepository) GetRef(name string) (res Ref, err error) {
+func (r *gitRepository) GetRef(ctx context.Context, name string) (res Ref, err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.refs)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
 	k := name
 	if r.caseins {
 		k = strings.ToUpper(k)
 	}
 
-	err = r.ensureRefs(func(refs map[string]*gitRef) error {
-		var ok bool
-		res, ok = refs[k]
-		if !ok {
-			return ErrNotFound
-		}
-		return nil
-	})
+	res, ok, err := r.resolveRef(ctx, name)
+	if !ok {
+		err = r.ensureRefs(ctx, func(refs map[string]*gitRef) error {
+			var ok bool
+			res, ok = refs[k]
+			if !ok {
+				return ErrNotFound
+			}
+			return nil
+		})
+	}
+	if nil == err && nil != r.conf.lock {
+		ref := res.(*gitRef)
+		r.conf.lock.record(r.remote, ref.name, ref.commitHash)
+	}
 	return
 }
 
-func (r *gitRepository) GetTempRef(name string) (res Ref, err error) {
+// Function resolveRef resolves a single ref without loading all refs, if the remote speaks
+// protocol v2: only the refs whose names start with name are retrieved. It reports false
+// if the ref must be looked up in the loaded refs instead: if the remote does not speak
+// v2, if the refs have been loaded already, if ref names are case-insensitive or if the
+// refs are frozen.
+func (r *gitRepository) resolveRef(ctx context.Context, name string) (Ref, bool, error) {
+	if r.caseins || (nil != r.conf.lock && r.conf.lock.frozen) {
+		return nil, false, nil
+	}
+	if err := r.ensureOpen(ctx); nil != err {
+		return nil, true, err
+	}
+	if 2 != r.repo.ProtocolVersion() {
+		return nil, false, nil
+	}
+
+	r.lock.RLock()
+	loaded := nil != r.refs
+	p, found := r.prefixRefs[name]
+	r.lock.RUnlock()
+	if loaded {
+		return nil, false, nil
+	}
+
+	if !found || (0 != r.conf.refttl && r.conf.refttl < time.Since(p.time)) {
+		m, err := r.repo.GetRefsWithPrefixes(ctx, []string{name})
+		if nil != err {
+			if !found {
+				return nil, true, err
+			}
+			// on failure the stale ref is kept until the next ttl period
+			tracef("repo=%#v resolve ref %#v: %v", r.remote, name, err)
+		}
+
+		var ref *gitRef
+		if nil != err {
+			ref = p.ref
+		} else if h, ok := m[name]; ok {
+			if found && nil != p.ref && h == p.ref.commitHash {
+				ref = p.ref
+			} else {
+				ref = &gitRef{
+					name:       name,
+					commitHash: h,
+				}
+			}
+		}
+		p = &prefixRef{ref: ref, time: time.Now()}
+
+		r.lock.Lock()
+		if nil == r.prefixRefs {
+			r.prefixRefs = make(map[string]*prefixRef)
+		}
+		r.prefixRefs[name] = p
+		r.lock.Unlock()
+	}
+
+	if nil == p.ref {
+		return nil, true, ErrNotFound
+	}
+	return p.ref, true, nil
+}
+
+func (r *gitRepository) GetTempRef(ctx context.Context, name string) (res Ref, err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.refs)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
 	_, err = hex.DecodeString(name)
 	if nil != err {
 		return nil, ErrNotFound
@@ -422,7 +857,7 @@ func (r *gitRepository) GetTempRef(name string) (res Ref, err error) {
 		k = strings.ToUpper(k)
 	}
 
-	err = r.ensureRefs(func(refs map[string]*gitRef) error {
+	err = r.ensureRefs(ctx, func(refs map[string]*gitRef) error {
 		var ok bool
 		res, ok = refs[k]
 		if !ok {
@@ -438,8 +873,8 @@ func (r *gitRepository) GetTempRef(name string) (res Ref, err error) {
 	dir := r.dir
 	r.lock.RUnlock()
 
-	err = r.refetchObjects(dir, []string{name}, func(hash string, ot git.ObjectType) error {
-		if git.CommitObject != ot {
+	err = r.refetchObjects(ctx, dir, []string{name}, func(hash string, ot git.ObjectType) error {
+		if git.CommitObject != ot && git.TagObject != ot {
 			return ErrNotFound
 		}
 		return nil
@@ -459,11 +894,10 @@ func (r *gitRepository) GetTempRef(name string) (res Ref, err error) {
 	return ref, nil
 }
 
-func (r *gitRepository) ensureTree(
+func (r *gitRepository) ensureTree(ctx context.Context,
 	ref0 Ref, entry0 TreeEntry, fn func(tree map[string]*gitTreeEntry) error) error {
-	r.once.Do(func() { r.open() })
-	if nil == r.repo {
-		return ErrNotFound
+	if err := r.ensureOpen(ctx); nil != err {
+		return err
 	}
 
 	ref, _ := ref0.(*gitRef)
@@ -489,43 +923,189 @@ func (r *gitRepository) ensureTree(
 	dir := r.dir
 	r.lock.RUnlock()
 
+	// coalesce concurrent loads of the same tree
+	var key interface{} = ref
+	if nil != entry {
+		key = entry
+	}
+	r.lock.Lock()
+	if load, ok := r.treeLoads[key]; ok {
+		r.lock.Unlock()
+		select {
+		case <-load.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if nil != load.err && !load.canceled {
+			return load.err
+		}
+		return r.ensureTree(ctx, ref0, entry0, fn)
+	}
+	load := &treeLoad{done: make(chan struct{})}
+	if nil == r.treeLoads {
+		r.treeLoads = make(map[interface{}]*treeLoad)
+	}
+	r.treeLoads[key] = load
+	r.lock.Unlock()
+
+	load.err = r.loadTree(ctx, dir, ref, entry, fn)
+	load.canceled = nil != ctx.Err()
+
+	r.lock.Lock()
+	delete(r.treeLoads, key)
+	r.lock.Unlock()
+	close(load.done)
+
+	return load.err
+}
+
+// Function loadTree retrieves a tree and its entries and caches it in ref or entry.
+func (r *gitRepository) loadTree(ctx context.Context, dir string,
+	ref *gitRef, entry *gitTreeEntry, fn func(tree map[string]*gitTreeEntry) error) error {
 	var treeTime time.Time
+	var signature, tagSignature SignatureInfo
+	var commit *exportCommit
 	want := []string{""}
 	if nil == entry {
-		err := r.fetchObjects(dir, []string{ref.commitHash}, func(hash string, content []byte) error {
-			c, err := git.DecodeCommit(content)
-			if nil != err {
+		// peel annotated tags until we reach the commit
+		hash := ref.commitHash
+		for i := 0; maxTagDepth > i && "" != hash; i++ {
+			want0 := hash
+			hash = ""
+			err := r.fetchObjects(ctx, dir, []string{want0}, func(h string, content []byte) error {
+				if git.IsTagContent(content) {
+					t, err := git.DecodeTag(content)
+					if nil != err {
+						return nil
+					}
+					if 0 == i {
+						tagSignature = r.conf.trust.signature(t.SignatureData, t.SignedPayload)
+					}
+					if git.TagObject == t.TargetType || git.CommitObject == t.TargetType {
+						hash = t.TargetHash
+					}
+					return nil
+				}
+				c, err := git.DecodeCommit(content)
+				if nil != err {
+					return nil
+				}
+				treeTime = c.Committer.Time
+				signature = r.conf.trust.signature(c.SignatureData, c.SignedPayload)
+				commit = &exportCommit{hash: want0, commit: c, ref: ref.name}
+				want[0] = c.TreeHash
 				return nil
+			})
+			if nil != err {
+				return err
 			}
-			treeTime = c.Committer.Time
-			want[0] = c.TreeHash
-			return nil
-		})
+		}
+		if "" == want[0] {
+			return ErrNotFound
+		}
+		if !r.conf.trust.allow(signature) {
+			tracef("repo=%#v ref=%#v signature=%#v: access denied", r.remote, ref.name, signature)
+			return ErrUntrusted
+		}
+	} else {
+		want[0] = entry.entry.Hash
+		if nil != ref {
+			r.lock.RLock()
+			commit = ref.commit
+			r.lock.RUnlock()
+		}
+	}
+
+	dirpath := ""
+	var attrs attrRules
+	if nil != entry {
+		dirpath = entry.path
+		attrs = entry.attrs
+	}
+
+	persist := "" != dir && !r.conf.attrs.enabled() && (r.conf.listings || r.pinnedRef(ref))
+	var tree map[string]*gitTreeEntry
+	if persist {
+		tree = r.readListing(dir, want[0], dirpath)
+	}
+	var err error
+	if nil == tree {
+		tree, err = r.buildTree(ctx, dir, want[0], dirpath, attrs, commit)
 		if nil != err {
 			return err
 		}
+		if persist {
+			writeListing(dir, want[0], tree)
+		}
+	}
+
+	r.lock.Lock()
+	if nil == entry {
+		if nil == ref.tree {
+			ref.tree = tree
+			ref.treeTime = treeTime
+			ref.signature = signature
+			ref.tagSignature = tagSignature
+			ref.commit = commit
+		}
+		err = fn(ref.tree)
 	} else {
-		want[0] = entry.entry.Hash
+		if nil == entry.tree {
+			entry.tree = tree
+		}
+		err = fn(entry.tree)
 	}
+	r.lock.Unlock()
+	return err
+}
 
+// Function buildTree decodes the tree object hash and computes the sizes of its files and
+// the targets of its symlinks.
+func (r *gitRepository) buildTree(ctx context.Context, dir string, hash string, dirpath string,
+	attrs attrRules, commit *exportCommit) (map[string]*gitTreeEntry, error) {
+	want := []string{hash}
 	tree := make(map[string]*gitTreeEntry)
-	err := r.fetchObjects(dir, want, func(hash string, content []byte) error {
+	err := r.fetchObjects(ctx, dir, want, func(hash string, content []byte) error {
 		t, err := git.DecodeTree(content)
 		if nil != err {
 			return nil
 		}
 		for _, e := range t {
-			k := e.Name
-			if r.caseins {
-				k = strings.ToUpper(k)
-			}
+			k := r.pathKey(e.Name)
 
-			tree[k] = &gitTreeEntry{entry: *e}
+			tree[k] = &gitTreeEntry{entry: *e, path: path.Join(dirpath, e.Name)}
 		}
 		return nil
 	})
 	if nil != err {
-		return err
+		return nil, err
+	}
+
+	if r.conf.attrs.enabled() {
+		attrs, err = r.loadAttributes(ctx, dir, dirpath, attrs, tree)
+		if nil != err {
+			return nil, err
+		}
+		renames := make(map[string]string)
+		for k, e := range tree {
+			a := attrs.lookup(e.path)
+			if r.conf.attrs.ignore(a) {
+				delete(tree, k)
+				continue
+			}
+			e.attrs = attrs
+			if 0100000 == e.entry.Mode&0170000 {
+				e.smudge = r.conf.attrs.newSmudge(a, commit)
+				e.smudge = r.conf.attrs.identSmudge(e.smudge, e.entry.Hash, a, commit)
+				e.smudge = r.conf.attrs.transformSmudge(e.smudge, e.path, a)
+				if nil != e.smudge {
+					if n := e.smudge.rename(e.entry.Name); n != e.entry.Name {
+						renames[k] = n
+					}
+				}
+			}
+		}
+		renameTreeEntries(tree, renames, r.pathKey)
 	}
 
 	want = make([]string, 0, len(tree))
@@ -536,7 +1116,7 @@ func (r *gitRepository) ensureTree(
 			entm[e.entry.Hash] = append(entm[e.entry.Hash], e)
 		}
 	}
-	err = r.prefetchObjects(dir, want, func(hash string, size int64) error {
+	err = r.prefetchObjects(ctx, dir, want, func(hash string, size int64) error {
 		l, ok := entm[hash]
 		if ok {
 			for _, e := range l {
@@ -546,7 +1126,29 @@ func (r *gitRepository) ensureTree(
 		return nil
 	})
 	if nil != err {
-		return err
+		return nil, err
+	}
+
+	want = make([]string, 0, len(tree))
+	entm = make(map[string][]*gitTreeEntry, len(tree))
+	for _, e := range tree {
+		if nil != e.smudge {
+			want = append(want, e.entry.Hash)
+			entm[e.entry.Hash] = append(entm[e.entry.Hash], e)
+		}
+	}
+	err = r.fetchObjects(ctx, dir, want, func(hash string, content []byte) error {
+		l, ok := entm[hash]
+		if ok {
+			for _, e := range l {
+				e.size = int64(len(e.smudge.apply(content)))
+				e.crypt = e.smudge.decrypter(content)
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return nil, err
 	}
 
 	want = make([]string, 0, len(tree))
@@ -560,7 +1162,7 @@ func (r *gitRepository) ensureTree(
 			e.size = int64(len(e.target))
 		}
 	}
-	err = r.fetchObjects(dir, want, func(hash string, content []byte) error {
+	err = r.fetchObjects(ctx, dir, want, func(hash string, content []byte) error {
 		l, ok := entm[hash]
 		if ok {
 			t := string(content)
@@ -571,28 +1173,65 @@ func (r *gitRepository) ensureTree(
 		return nil
 	})
 	if nil != err {
-		return err
+		return nil, err
 	}
 
-	r.lock.Lock()
-	if nil == entry {
-		if nil == ref.tree {
-			ref.tree = tree
-			ref.treeTime = treeTime
-		}
-		err = fn(ref.tree)
-	} else {
-		if nil == entry.tree {
-			entry.tree = tree
-		}
-		err = fn(entry.tree)
+	return tree, nil
+}
+
+// Function loadAttributes returns the attribute rules in effect in directory dirpath,
+// which are the rules of the parent directory plus those of the directory's own
+// .gitattributes file.
+func (r *gitRepository) loadAttributes(ctx context.Context, dir string, dirpath string,
+	parent attrRules, tree map[string]*gitTreeEntry) (attrRules, error) {
+	k := r.pathKey(".gitattributes")
+	e, ok := tree[k]
+	if !ok || 0100000 != e.entry.Mode&0170000 {
+		return parent, nil
 	}
-	r.lock.Unlock()
-	return err
+
+	var rules attrRules
+	err := r.fetchObjects(ctx, dir, []string{e.entry.Hash}, func(hash string, content []byte) error {
+		rules = parseAttributes(dirpath, content)
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	res := make(attrRules, 0, len(parent)+len(rules))
+	res = append(res, parent...)
+	res = append(res, rules...)
+	return res, nil
+}
+
+// Function pathKey returns the key of a path (or file name) in tree and module maps.
+// Paths that differ only in case (if caseins) or in their Unicode normalization (if
+// unorm is set) have the same key.
+func (r *gitRepository) pathKey(path string) string {
+	path = normalizeString(r.conf.unorm, path)
+	if r.caseins {
+		path = normalizeString(r.conf.unorm, strings.ToUpper(path))
+	}
+	return path
 }
 
-func (r *gitRepository) GetTree(ref Ref, entry TreeEntry) (res []TreeEntry, err error) {
-	err = r.ensureTree(ref, entry, func(tree map[string]*gitTreeEntry) error {
+func normalizeString(unorm string, s string) string {
+	switch unorm {
+	case "nfc":
+		return norm.NFC.String(s)
+	case "nfd":
+		return norm.NFD.String(s)
+	}
+	return s
+}
+
+func (r *gitRepository) GetTree(ctx context.Context, ref Ref, entry TreeEntry) (res []TreeEntry, err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.fetch)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	err = r.ensureTree(ctx, ref, entry, func(tree map[string]*gitTreeEntry) error {
 		res = make([]TreeEntry, len(tree))
 		i := 0
 		for _, e := range tree {
@@ -604,13 +1243,14 @@ func (r *gitRepository) GetTree(ref Ref, entry TreeEntry) (res []TreeEntry, err
 	return
 }
 
-func (r *gitRepository) GetTreeEntry(ref Ref, entry TreeEntry, name string) (res TreeEntry, err error) {
-	k := name
-	if r.caseins {
-		k = strings.ToUpper(k)
-	}
+func (r *gitRepository) GetTreeEntry(ctx context.Context, ref Ref, entry TreeEntry, name string) (res TreeEntry, err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.fetch)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	k := r.pathKey(name)
 
-	err = r.ensureTree(ref, entry, func(tree map[string]*gitTreeEntry) error {
+	err = r.ensureTree(ctx, ref, entry, func(tree map[string]*gitTreeEntry) error {
 		var ok bool
 		res, ok = tree[k]
 		if !ok {
@@ -621,29 +1261,140 @@ func (r *gitRepository) GetTreeEntry(ref Ref, entry TreeEntry, name string) (res
 	return
 }
 
-func (r *gitRepository) GetBlobReader(entry TreeEntry) (res io.ReaderAt, err error) {
-	r.once.Do(func() { r.open() })
-	if nil == r.repo {
-		return nil, ErrNotFound
+func (r *gitRepository) GetBlobReader(ctx context.Context, entry TreeEntry) (res io.ReaderAt, err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.blob)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	err = r.ensureOpen(ctx)
+	if nil != err {
+		return nil, err
 	}
 
 	r.lock.RLock()
 	dir := r.dir
 	r.lock.RUnlock()
 
-	want := []string{entry.Hash()}
-	err = r.fetchReaders(dir, want, func(hash string, reader io.ReaderAt) error {
-		res = reader
+	// readers of identical blobs (with identical conversions) are shared
+	key := entry.Hash()
+	e, _ := entry.(*gitTreeEntry)
+	if nil != e && nil != e.smudge {
+		key += e.smudge.name()
+	}
+	// and concurrent fetches of the same blob are coalesced
+	return r.blobs.load(ctx, key, func() (res io.ReaderAt, err error) {
+		if nil != e && nil != e.smudge {
+			res, err = r.getSmudgedReader(ctx, dir, e)
+		} else {
+			want := []string{entry.Hash()}
+			err = r.fetchReaders(ctx, dir, want, func(hash string, reader io.ReaderAt) error {
+				res = reader
+				return nil
+			})
+		}
+		if nil == err && nil != res && nil != r.pins && "" != dir {
+			r.pins.add(key)
+		}
+		return
+	})
+}
+
+// Function PrefetchBlobs fetches the blobs of entries that are not in the cache in
+// batches. It does nothing if the repository has no cache directory.
+func (r *gitRepository) PrefetchBlobs(ctx context.Context, entries []TreeEntry) (err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.blob)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	err = r.ensureOpen(ctx)
+	if nil != err {
+		return err
+	}
+
+	r.lock.RLock()
+	dir := r.dir
+	r.lock.RUnlock()
+	if "" == dir {
+		return nil
+	}
+
+	want := make([]string, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if h := e.Hash(); !seen[h] {
+			seen[h] = true
+			want = append(want, h)
+		}
+	}
+	return r.prefetchObjects(ctx, dir, want, func(hash string, size int64) error {
+		return nil
+	})
+}
+
+// Function renameTreeEntries renames the transformed files of a directory. Collisions
+// are resolved against the original names only, so that the result does not depend on
+// the order of renames: a file is not renamed if a file with the new name exists in the
+// repository or if another file would be renamed to the same name.
+func renameTreeEntries(tree map[string]*gitTreeEntry, renames map[string]string,
+	pathKey func(string) string) {
+	count := make(map[string]int, len(renames))
+	for _, n := range renames {
+		count[pathKey(n)]++
+	}
+	moved := make(map[string]*gitTreeEntry, len(renames))
+	for k, n := range renames {
+		nk := pathKey(n)
+		if _, ok := tree[nk]; !ok && 1 == count[nk] {
+			e := tree[k]
+			e.entry.Name = n
+			moved[nk] = e
+			delete(tree, k)
+		}
+	}
+	for nk, e := range moved {
+		tree[nk] = e
+	}
+}
+
+// Function getSmudgedReader returns a reader for the converted content of a blob.
+// Converted content is kept in the object cache next to the original object.
+func (r *gitRepository) getSmudgedReader(ctx context.Context, dir string, e *gitTreeEntry) (
+	res io.ReaderAt, err error) {
+	hash := e.entry.Hash
+	name := hash + e.smudge.name()
+
+	if "" != dir {
+		reader, err := os.Open(objectPath(dir, name))
+		if nil == err {
+			return reader, nil
+		}
+	}
+
+	err = r.fetchObjects(ctx, dir, []string{hash}, func(h string, content []byte) error {
+		// decrypted content is never stored in the cache directory
+		secret := "" != e.smudge.decrypter(content)
+		content = e.smudge.apply(content)
+		if "" != dir && !secret {
+			writeObject(dir, name, content)
+			reader, err := os.Open(objectPath(dir, name))
+			if nil == err {
+				res = reader
+				return nil
+			}
+		}
+		res = readerAtNopCloser{bytes.NewReader(content)}
 		return nil
 	})
+	if nil == err && nil == res {
+		err = ErrNotFound
+	}
 	return
 }
 
-func (r *gitRepository) ensureModules(
+func (r *gitRepository) ensureModules(ctx context.Context,
 	ref0 Ref, fn func(modules map[string]string) error) error {
-	r.once.Do(func() { r.open() })
-	if nil == r.repo {
-		return ErrNotFound
+	if err := r.ensureOpen(ctx); nil != err {
+		return err
 	}
 
 	ref, _ := ref0.(*gitRef)
@@ -656,12 +1407,12 @@ func (r *gitRepository) ensureModules(
 	}
 	r.lock.RUnlock()
 
-	entry, err := r.GetTreeEntry(ref, nil, ".gitmodules")
+	entry, err := r.GetTreeEntry(ctx, ref, nil, ".gitmodules")
 	if nil != err {
 		return err
 	}
 
-	reader, err := r.GetBlobReader(entry)
+	reader, err := r.GetBlobReader(ctx, entry)
 	if nil != err {
 		return err
 	}
@@ -677,10 +1428,7 @@ func (r *gitRepository) ensureModules(
 		p := s["path"]
 		u := s["url"]
 		if "" != p && "" != u {
-			k := p
-			if r.caseins {
-				k = strings.ToUpper(k)
-			}
+			k := r.pathKey(p)
 
 			modules[k] = u
 		}
@@ -695,13 +1443,14 @@ func (r *gitRepository) ensureModules(
 	return err
 }
 
-func (r *gitRepository) GetModule(ref Ref, path string, rootrel bool) (res string, err error) {
-	k := path
-	if r.caseins {
-		k = strings.ToUpper(k)
-	}
+func (r *gitRepository) GetModule(ctx context.Context, ref Ref, path string, rootrel bool) (res string, err error) {
+	ctx, cancel := withTimeout(ctx, r.conf.timeouts.fetch)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	k := r.pathKey(path)
 
-	err = r.ensureModules(ref, func(modules map[string]string) error {
+	err = r.ensureModules(ctx, ref, func(modules map[string]string) error {
 		var ok bool
 		res, ok = modules[k]
 		if !ok {
@@ -729,6 +1478,23 @@ func (r *gitRef) TreeTime() time.Time {
 	return r.treeTime
 }
 
+func (r *gitRef) Signature() SignatureInfo {
+	return r.signature
+}
+
+func (r *gitRef) TagSignature() SignatureInfo {
+	return r.tagSignature
+}
+
+// Function CommitHash returns the hash of the commit of the ref. Annotated tags are
+// peeled once the tree of the ref has been retrieved.
+func (r *gitRef) CommitHash() string {
+	if nil != r.commit {
+		return r.commit.hash
+	}
+	return r.commitHash
+}
+
 func (e *gitTreeEntry) Name() string {
 	return e.entry.Name
 }
@@ -737,6 +1503,12 @@ func (e *gitTreeEntry) Mode() uint32 {
 	return e.entry.Mode
 }
 
+// Function Decrypted returns the name of the transform that decrypts the content of the
+// entry, or "" if the content is not encrypted.
+func (e *gitTreeEntry) Decrypted() string {
+	return e.crypt
+}
+
 func (e *gitTreeEntry) Size() int64 {
 	return e.size
 }
@@ -15,10 +15,16 @@ package providers
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/billziss-gh/golib/keyring"
@@ -35,7 +41,7 @@ var repository Repository
 var caseins bool
 
 func TestGetRefs(t *testing.T) {
-	refs, err := repository.GetRefs()
+	refs, err := repository.GetRefs(context.Background())
 	if nil != err {
 		t.Error(err)
 	}
@@ -50,7 +56,7 @@ func TestGetRefs(t *testing.T) {
 		t.Error()
 	}
 
-	refs, err = repository.GetRefs()
+	refs, err = repository.GetRefs(context.Background())
 	if nil != err {
 		t.Error(err)
 	}
@@ -67,7 +73,7 @@ func TestGetRefs(t *testing.T) {
 }
 
 func TestGetRef(t *testing.T) {
-	ref, err := repository.GetRef(refName)
+	ref, err := repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -75,7 +81,7 @@ func TestGetRef(t *testing.T) {
 		t.Error()
 	}
 
-	ref, err = repository.GetRef(refName)
+	ref, err = repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -85,7 +91,7 @@ func TestGetRef(t *testing.T) {
 }
 
 func TestGetTempRef(t *testing.T) {
-	ref, err := repository.GetTempRef(commitName)
+	ref, err := repository.GetTempRef(context.Background(), commitName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -93,7 +99,7 @@ func TestGetTempRef(t *testing.T) {
 		t.Error()
 	}
 
-	ref, err = repository.GetTempRef(commitName)
+	ref, err = repository.GetTempRef(context.Background(), commitName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -103,7 +109,7 @@ func TestGetTempRef(t *testing.T) {
 }
 
 func TestGetRefTree(t *testing.T) {
-	ref, err := repository.GetRef(refName)
+	ref, err := repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -111,7 +117,7 @@ func TestGetRefTree(t *testing.T) {
 		t.Error()
 	}
 
-	tree, err := repository.GetTree(ref, nil)
+	tree, err := repository.GetTree(context.Background(), ref, nil)
 	if nil != err {
 		t.Error(err)
 	}
@@ -126,7 +132,7 @@ func TestGetRefTree(t *testing.T) {
 		t.Error()
 	}
 
-	tree, err = repository.GetTree(ref, nil)
+	tree, err = repository.GetTree(context.Background(), ref, nil)
 	if nil != err {
 		t.Error(err)
 	}
@@ -143,7 +149,7 @@ func TestGetRefTree(t *testing.T) {
 }
 
 func TestGetRefTreeEntry(t *testing.T) {
-	ref, err := repository.GetRef(refName)
+	ref, err := repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -151,7 +157,7 @@ func TestGetRefTreeEntry(t *testing.T) {
 		t.Error()
 	}
 
-	entry, err := repository.GetTreeEntry(ref, nil, entryName)
+	entry, err := repository.GetTreeEntry(context.Background(), ref, nil, entryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -159,7 +165,7 @@ func TestGetRefTreeEntry(t *testing.T) {
 		t.Error()
 	}
 
-	entry, err = repository.GetTreeEntry(ref, nil, entryName)
+	entry, err = repository.GetTreeEntry(context.Background(), ref, nil, entryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -170,7 +176,7 @@ func TestGetRefTreeEntry(t *testing.T) {
 }
 
 func TestGetTree(t *testing.T) {
-	ref, err := repository.GetRef(refName)
+	ref, err := repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -178,7 +184,7 @@ func TestGetTree(t *testing.T) {
 		t.Error()
 	}
 
-	entry, err := repository.GetTreeEntry(ref, nil, subtreeName)
+	entry, err := repository.GetTreeEntry(context.Background(), ref, nil, subtreeName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -186,7 +192,7 @@ func TestGetTree(t *testing.T) {
 		t.Error()
 	}
 
-	tree, err := repository.GetTree(nil, entry)
+	tree, err := repository.GetTree(context.Background(), nil, entry)
 	if nil != err {
 		t.Error(err)
 	}
@@ -201,7 +207,7 @@ func TestGetTree(t *testing.T) {
 		t.Error()
 	}
 
-	tree, err = repository.GetTree(nil, entry)
+	tree, err = repository.GetTree(context.Background(), nil, entry)
 	if nil != err {
 		t.Error(err)
 	}
@@ -218,7 +224,7 @@ func TestGetTree(t *testing.T) {
 }
 
 func TestGetTreeEntry(t *testing.T) {
-	ref, err := repository.GetRef(refName)
+	ref, err := repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -226,7 +232,7 @@ func TestGetTreeEntry(t *testing.T) {
 		t.Error()
 	}
 
-	entry, err := repository.GetTreeEntry(ref, nil, subtreeName)
+	entry, err := repository.GetTreeEntry(context.Background(), ref, nil, subtreeName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -234,7 +240,7 @@ func TestGetTreeEntry(t *testing.T) {
 		t.Error()
 	}
 
-	subentry, err := repository.GetTreeEntry(nil, entry, subentryName)
+	subentry, err := repository.GetTreeEntry(context.Background(), nil, entry, subentryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -242,7 +248,7 @@ func TestGetTreeEntry(t *testing.T) {
 		t.Error()
 	}
 
-	subentry, err = repository.GetTreeEntry(nil, entry, subentryName)
+	subentry, err = repository.GetTreeEntry(context.Background(), nil, entry, subentryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -252,7 +258,7 @@ func TestGetTreeEntry(t *testing.T) {
 }
 
 func TestGetBlobReader(t *testing.T) {
-	ref, err := repository.GetRef(refName)
+	ref, err := repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -260,7 +266,7 @@ func TestGetBlobReader(t *testing.T) {
 		t.Error()
 	}
 
-	entry, err := repository.GetTreeEntry(ref, nil, subtreeName)
+	entry, err := repository.GetTreeEntry(context.Background(), ref, nil, subtreeName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -268,7 +274,7 @@ func TestGetBlobReader(t *testing.T) {
 		t.Error()
 	}
 
-	subentry, err := repository.GetTreeEntry(nil, entry, subentryName)
+	subentry, err := repository.GetTreeEntry(context.Background(), nil, entry, subentryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -276,7 +282,7 @@ func TestGetBlobReader(t *testing.T) {
 		t.Error()
 	}
 
-	reader, err := repository.GetBlobReader(subentry)
+	reader, err := repository.GetBlobReader(context.Background(), subentry)
 	if nil != err {
 		t.Error(err)
 	}
@@ -286,7 +292,7 @@ func TestGetBlobReader(t *testing.T) {
 		t.Error()
 	}
 
-	reader, err = repository.GetBlobReader(subentry)
+	reader, err = repository.GetBlobReader(context.Background(), subentry)
 	if nil != err {
 		t.Error(err)
 	}
@@ -303,13 +309,13 @@ func TestGetModule(t *testing.T) {
 	const modulePath = "ext/test"
 	const moduleTarget = "/billziss-gh/secfs.test"
 
-	repository, err := NewGitRepository(remote, "", caseins)
+	repository, err := NewGitRepository(context.Background(), remote, "", caseins)
 	if nil != err {
 		t.Error(err)
 	}
 	defer repository.Close()
 
-	ref, err := repository.GetRef(refName)
+	ref, err := repository.GetRef(context.Background(), refName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -317,7 +323,7 @@ func TestGetModule(t *testing.T) {
 		t.Error()
 	}
 
-	module, err := repository.GetModule(ref, modulePath, true)
+	module, err := repository.GetModule(context.Background(), ref, modulePath, true)
 	if nil != err {
 		t.Error(err)
 	}
@@ -325,7 +331,7 @@ func TestGetModule(t *testing.T) {
 		t.Error()
 	}
 
-	module, err = repository.GetModule(ref, modulePath, true)
+	module, err = repository.GetModule(context.Background(), ref, modulePath, true)
 	if nil != err {
 		t.Error(err)
 	}
@@ -334,6 +340,235 @@ func TestGetModule(t *testing.T) {
 	}
 }
 
+func TestGetCommitTime(t *testing.T) {
+	ref, err := repository.GetRef(context.Background(), commitName)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	r := repository.(CommitTimeRepository)
+	tm, err := r.GetCommitTime(context.Background(), ref, nil)
+	if nil != err || !tm.Equal(ref.TreeTime()) {
+		t.Error(err, tm)
+	}
+
+	subtree, err := repository.GetTreeEntry(context.Background(), ref, nil, subtreeName)
+	if nil != err {
+		t.Fatal(err)
+	}
+	subentry, err := repository.GetTreeEntry(context.Background(), ref, subtree, subentryName)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, entry := range []TreeEntry{subtree, subentry} {
+		tm, err := r.GetCommitTime(context.Background(), ref, entry)
+		if nil != err {
+			t.Error(err)
+		}
+		if tm.IsZero() || tm.After(ref.TreeTime()) {
+			t.Error(entry.Name(), tm, ref.TreeTime())
+		}
+	}
+
+	// the directory was modified no earlier than its entries
+	tm0, _ := r.GetCommitTime(context.Background(), ref, subtree)
+	tm1, _ := r.GetCommitTime(context.Background(), ref, subentry)
+	if tm0.Before(tm1) {
+		t.Error(tm0, tm1)
+	}
+}
+
+func TestDiffRefs(t *testing.T) {
+	refs := func(names ...string) map[string]*gitRef {
+		m := make(map[string]*gitRef)
+		for _, n := range names {
+			m[n] = &gitRef{name: n, commitHash: "0000"}
+		}
+		return m
+	}
+	old := refs("HEAD", "refs/heads/main", "refs/heads/old", "refs/tags/v1")
+	cur := refs("HEAD", "refs/heads/main", "refs/heads/new/x", "refs/heads/a", "refs/tags/v2")
+
+	if d := diffRefs(cur, old); 2 != len(d) || "refs/heads/a" != d[0] || "refs/heads/new/x" != d[1] {
+		t.Error(d)
+	}
+	if d := diffRefs(old, cur); 1 != len(d) || "refs/heads/old" != d[0] {
+		t.Error(d)
+	}
+	if d := diffRefs(cur, cur); 0 != len(d) {
+		t.Error(d)
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const helloBlob = "ce013625030ba8dba906f756967f9e9ca394464a"
+	const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+	r := &gitRepository{remote: "test"}
+
+	writeObject(dir, helloBlob, []byte("hello\n"))
+	if !r.verifyFile(dir, helloBlob) || !r.verifyContent(dir, emptyTree, []byte{}) {
+		t.Error()
+	}
+
+	// verified objects are not verified again
+	writeObject(dir, helloBlob, []byte("hullo\n"))
+	if !r.verifyFile(dir, helloBlob) {
+		t.Error()
+	}
+
+	// objects that do not match are quarantined
+	r = &gitRepository{remote: "test"}
+	if r.verifyFile(dir, helloBlob) {
+		t.Error()
+	}
+	if _, err := os.Stat(objectPath(dir, helloBlob)); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "quarantine", helloBlob)); nil != err ||
+		"hullo\n" != string(content) {
+		t.Error(err)
+	}
+	if r.verifyContent(dir, emptyTree, []byte("x")) {
+		t.Error()
+	}
+
+	// objects that are not in the cache are not quarantined
+	if r.verifyFile(dir, emptyTree) {
+		t.Error()
+	}
+
+	// stored objects are verified
+	r.storeObject(dir, helloBlob, []byte("hello\n"))
+	if !r.verifyFile(dir, helloBlob) {
+		t.Error()
+	}
+}
+
+func TestUpdatedRefs(t *testing.T) {
+	old := map[string]*gitRef{
+		"HEAD":            {name: "HEAD", commitHash: "0000"},
+		"refs/heads/main": {name: "refs/heads/main", commitHash: "0000"},
+		"refs/heads/dev":  {name: "refs/heads/dev", commitHash: "0000"},
+		"refs/tags/v1":    {name: "refs/tags/v1", commitHash: "0000"},
+	}
+	cur := map[string]*gitRef{
+		"HEAD":            {name: "HEAD", commitHash: "1111"},
+		"refs/heads/main": {name: "refs/heads/main", commitHash: "1111"},
+		"refs/heads/new":  {name: "refs/heads/new", commitHash: "1111"},
+		"refs/tags/v1":    {name: "refs/tags/v1", commitHash: "1111"},
+	}
+
+	if d := updatedRefs(cur, old); 1 != len(d) || "refs/heads/main" != d[0] {
+		t.Error(d)
+	}
+	if d := updatedRefs(cur, cur); 0 != len(d) {
+		t.Error(d)
+	}
+}
+
+func TestResolveRef(t *testing.T) {
+	const hash = "609d3b892764952ef69676e653e06b2ca904be18"
+
+	pkt := func(s string) string {
+		return fmt.Sprintf("%04x%s", 4+len(s), s)
+	}
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, string(body))
+		if "GET" == req.Method {
+			io.WriteString(w, pkt("version 2\n")+pkt("ls-refs\n")+"0000")
+			return
+		}
+		// a prefix query for refs/heads/main also matches refs/heads/main2
+		if !strings.Contains(string(body), "ref-prefix ") ||
+			strings.Contains(string(body), "ref-prefix refs/heads/main\n") {
+			io.WriteString(w, pkt(hash+" refs/heads/main\n"))
+			io.WriteString(w, pkt(hash+" refs/heads/main2\n"))
+		}
+		if !strings.Contains(string(body), "ref-prefix ") {
+			io.WriteString(w, pkt(hash+" refs/heads/next\n"))
+		}
+		io.WriteString(w, "0000")
+	}))
+	defer server.Close()
+
+	r := newGitRepository(server.URL+"/owner/repo", nil, false, &gitConfig{}).(*gitRepository)
+	defer r.Close()
+
+	ref, err := r.GetRef(context.Background(), "refs/heads/main")
+	if nil != err || hash != ref.(*gitRef).commitHash {
+		t.Fatal(err)
+	}
+	if _, err = r.GetRef(context.Background(), "refs/tags/main"); ErrNotFound != err {
+		t.Error(err)
+	}
+	if ref1, _ := r.GetRef(context.Background(), "refs/heads/main"); ref != ref1 {
+		t.Error()
+	}
+	if 3 != len(requests) || nil != r.refs {
+		t.Error(requests)
+	}
+
+	// refs that have been resolved individually are kept when all refs are loaded
+	refs, err := r.GetRefs(context.Background())
+	if nil != err || 3 != len(refs) {
+		t.Error(err, refs)
+	}
+	if ref1, _ := r.GetRef(context.Background(), "refs/heads/main"); ref != ref1 {
+		t.Error()
+	}
+	if 4 != len(requests) {
+		t.Error(requests)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	r := newGitRepository(server.URL+"/owner/repo", nil, false, &gitConfig{}).(*gitRepository)
+	defer r.Close()
+
+	// transient failures and denied access are returned and retried
+	if err := r.ensureOpen(context.Background()); nil == err || ErrNotFound == err {
+		t.Error(err)
+	}
+	status = http.StatusUnauthorized
+	if err := r.ensureOpen(context.Background()); ErrPermission != err {
+		t.Error(err)
+	}
+	if 2 != requests {
+		t.Error(requests)
+	}
+
+	// a repository that does not exist is remembered
+	status = http.StatusNotFound
+	if err := r.ensureOpen(context.Background()); ErrNotFound != err {
+		t.Error(err)
+	}
+	status = http.StatusUnauthorized
+	if err := r.ensureOpen(context.Background()); ErrNotFound != err {
+		t.Error(err)
+	}
+	if 3 != requests {
+		t.Error(requests)
+	}
+}
+
 func init() {
 	atinit(func() error {
 		if "windows" == runtime.GOOS || "darwin" == runtime.GOOS {
@@ -348,7 +583,7 @@ func init() {
 			token = os.Getenv("HUBFS_TOKEN")
 		}
 
-		repository, err = NewGitRepository(remote, token, caseins)
+		repository, err = NewGitRepository(context.Background(), remote, token, caseins)
 		if nil != err {
 			return err
 		}
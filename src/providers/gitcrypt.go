@@ -0,0 +1,173 @@
+/*
+ * gitcrypt.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// git-crypt encrypts the files that have the attribute filter=git-crypt (or
+// filter=git-crypt-NAME for a named key) with AES-256 in CTR mode. An encrypted file
+// consists of a header, a 12 byte nonce and the ciphertext; the nonce is the truncated
+// HMAC-SHA1 of the plaintext, which is checked after decryption. Keys are read from key
+// files as written by "git-crypt export-key".
+
+const (
+	gitcryptHeader    = "\x00GITCRYPT\x00"
+	gitcryptNonceLen  = 12
+	gitcryptKeyHeader = "\x00GITCRYPTKEY"
+	gitcryptKeyFormat = 2
+	gitcryptAesKeyLen = 32
+	gitcryptMacKeyLen = 64
+)
+
+var errGitcryptKey = errors.New("invalid git-crypt key file")
+
+type gitcryptTransform struct {
+	aeskey []byte
+	mackey []byte
+}
+
+func (t *gitcryptTransform) Encrypted(content []byte) bool {
+	return len(gitcryptHeader)+gitcryptNonceLen <= len(content) &&
+		gitcryptHeader == string(content[:len(gitcryptHeader)])
+}
+
+// Function Apply decrypts content. Content that is not encrypted is returned unchanged,
+// like git-crypt does.
+func (t *gitcryptTransform) Apply(path string, content []byte) ([]byte, error) {
+	if !t.Encrypted(content) {
+		return content, nil
+	}
+	nonce := content[len(gitcryptHeader) : len(gitcryptHeader)+gitcryptNonceLen]
+	content = content[len(gitcryptHeader)+gitcryptNonceLen:]
+
+	block, err := aes.NewCipher(t.aeskey)
+	if nil != err {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	res := make([]byte, len(content))
+	cipher.NewCTR(block, iv).XORKeyStream(res, content)
+
+	mac := hmac.New(sha1.New, t.mackey)
+	mac.Write(res)
+	if !hmac.Equal(nonce, mac.Sum(nil)[:gitcryptNonceLen]) {
+		return nil, errors.New("git-crypt: wrong key or corrupt file")
+	}
+	return res, nil
+}
+
+// Function loadGitcryptKey reads a git-crypt key file. It returns the name of the
+// transform that uses the key: git-crypt for the default key and git-crypt-NAME for a
+// named key.
+func loadGitcryptKey(path string) (name string, xform *gitcryptTransform, err error) {
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return "", nil, err
+	}
+
+	// legacy key files contain only the AES and HMAC keys
+	if gitcryptAesKeyLen+gitcryptMacKeyLen == len(content) &&
+		gitcryptKeyHeader != string(content[:len(gitcryptKeyHeader)]) {
+		return "git-crypt", &gitcryptTransform{
+			aeskey: content[:gitcryptAesKeyLen],
+			mackey: content[gitcryptAesKeyLen:],
+		}, nil
+	}
+
+	if len(gitcryptKeyHeader)+4 > len(content) ||
+		gitcryptKeyHeader != string(content[:len(gitcryptKeyHeader)]) {
+		return "", nil, errGitcryptKey
+	}
+	content = content[len(gitcryptKeyHeader):]
+	if v := binary.BigEndian.Uint32(content); gitcryptKeyFormat != v {
+		return "", nil, fmt.Errorf("unsupported git-crypt key file format: %d", v)
+	}
+	content = content[4:]
+
+	// fields consist of an id, a length and data; id 0 ends a list of fields and
+	// unknown fields with odd ids must be understood
+	field := func() (id uint32, data []byte, err error) {
+		if 4 > len(content) {
+			return 0, nil, errGitcryptKey
+		}
+		id, content = binary.BigEndian.Uint32(content), content[4:]
+		if 0 == id {
+			return
+		}
+		if 4 > len(content) {
+			return 0, nil, errGitcryptKey
+		}
+		n := binary.BigEndian.Uint32(content)
+		content = content[4:]
+		if uint32(len(content)) < n {
+			return 0, nil, errGitcryptKey
+		}
+		data, content = content[:n], content[n:]
+		return
+	}
+
+	name = "git-crypt"
+	for {
+		id, data, err := field()
+		if nil != err {
+			return "", nil, err
+		}
+		if 0 == id {
+			break
+		} else if 1 == id {
+			name = "git-crypt-" + string(data)
+		} else if 1 == id&1 {
+			return "", nil, errGitcryptKey
+		}
+	}
+
+	// git-crypt decrypts files with the key of version 0
+	for 0 < len(content) {
+		version := ^uint32(0)
+		entry := &gitcryptTransform{}
+		for {
+			id, data, err := field()
+			if nil != err {
+				return "", nil, err
+			}
+			if 0 == id {
+				break
+			}
+			switch {
+			case 1 == id && 4 == len(data):
+				version = binary.BigEndian.Uint32(data)
+			case 3 == id && gitcryptAesKeyLen == len(data):
+				entry.aeskey = data
+			case 5 == id && gitcryptMacKeyLen == len(data):
+				entry.mackey = data
+			case 1 == id&1:
+				return "", nil, errGitcryptKey
+			}
+		}
+		if 0 == version && nil != entry.aeskey && nil != entry.mackey {
+			return name, entry, nil
+		}
+	}
+	return "", nil, errGitcryptKey
+}
@@ -0,0 +1,145 @@
+/*
+ * gitcrypt_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func gitcryptEncrypt(aeskey []byte, mackey []byte, plain []byte) []byte {
+	mac := hmac.New(sha1.New, mackey)
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:gitcryptNonceLen]
+
+	block, _ := aes.NewCipher(aeskey)
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	res := make([]byte, len(plain))
+	cipher.NewCTR(block, iv).XORKeyStream(res, plain)
+
+	return append(append([]byte(gitcryptHeader), nonce...), res...)
+}
+
+func gitcryptKeyFile(name string, aeskey []byte, mackey []byte) []byte {
+	var buf bytes.Buffer
+	field := func(id uint32, data []byte) {
+		binary.Write(&buf, binary.BigEndian, id)
+		if 0 != id {
+			binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+			buf.Write(data)
+		}
+	}
+	buf.WriteString(gitcryptKeyHeader)
+	binary.Write(&buf, binary.BigEndian, uint32(gitcryptKeyFormat))
+	if "" != name {
+		field(1, []byte(name))
+	}
+	field(0, nil)
+	field(1, []byte{0, 0, 0, 0})
+	field(3, aeskey)
+	field(5, mackey)
+	field(0, nil)
+	return buf.Bytes()
+}
+
+func TestGitcrypt(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "gitcrypt_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	aeskey := bytes.Repeat([]byte{'A'}, gitcryptAesKeyLen)
+	mackey := bytes.Repeat([]byte{'M'}, gitcryptMacKeyLen)
+	plain := bytes.Repeat([]byte("secret\n"), 10)
+	enc := gitcryptEncrypt(aeskey, mackey, plain)
+
+	for _, c := range []struct {
+		name    string
+		content []byte
+	}{
+		{"git-crypt", gitcryptKeyFile("", aeskey, mackey)},
+		{"git-crypt-ops", gitcryptKeyFile("ops", aeskey, mackey)},
+		{"git-crypt", append(append([]byte{}, aeskey...), mackey...)},
+	} {
+		path := filepath.Join(tdir, "key")
+		ioutil.WriteFile(path, c.content, 0600)
+		name, xform, err := loadGitcryptKey(path)
+		if nil != err || c.name != name {
+			t.Fatal(name, err)
+		}
+
+		if !xform.Encrypted(enc) || xform.Encrypted(plain) {
+			t.Error()
+		}
+		if res, err := xform.Apply("a", enc); nil != err || !bytes.Equal(plain, res) {
+			t.Error(err)
+		}
+		if res, err := xform.Apply("a", plain); nil != err || !bytes.Equal(plain, res) {
+			t.Error(err)
+		}
+	}
+
+	path := filepath.Join(tdir, "key")
+	ioutil.WriteFile(path, gitcryptKeyFile("", mackey[:gitcryptAesKeyLen], mackey), 0600)
+	_, xform, err := loadGitcryptKey(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := xform.Apply("a", enc); nil == err {
+		t.Error()
+	}
+
+	ioutil.WriteFile(path, []byte("\x00GITCRYPTKEY\x00\x00\x00\x02\x00\x00\x00\x07"), 0600)
+	if _, _, err := loadGitcryptKey(path); nil == err {
+		t.Error()
+	}
+}
+
+func TestGitcryptTransform(t *testing.T) {
+	aeskey := bytes.Repeat([]byte{'a'}, gitcryptAesKeyLen)
+	mackey := bytes.Repeat([]byte{'m'}, gitcryptMacKeyLen)
+	RegisterTransform("git-crypt-test", &gitcryptTransform{aeskey: aeskey, mackey: mackey})
+
+	conf := attrConfig{filter: true}
+	if !conf.enabled() {
+		t.Error()
+	}
+	if s := conf.transformSmudge(nil, "a.txt", map[string]string{"filter": "lfs"}); nil != s {
+		t.Error(s)
+	}
+
+	enc := gitcryptEncrypt(aeskey, mackey, []byte("hello\n"))
+	s := conf.transformSmudge(nil, "a.txt", map[string]string{"filter": "git-crypt-test"})
+	if nil == s || "git-crypt-test" != s.decrypter(enc) || "" != s.decrypter([]byte("hello\n")) {
+		t.Fatal(s)
+	}
+	if c := s.apply(enc); "hello\n" != string(c) {
+		t.Errorf("%q", c)
+	}
+
+	conf.filter = false
+	if s := conf.transformSmudge(nil, "a.txt", map[string]string{"filter": "git-crypt-test"}); nil != s {
+		t.Error(s)
+	}
+}
@@ -14,6 +14,7 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,12 +22,16 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/billziss-gh/golib/appdata"
+	libcache "github.com/billziss-gh/golib/cache"
+	"github.com/billziss-gh/hubfs/git"
 	"github.com/billziss-gh/hubfs/httputil"
+	"github.com/billziss-gh/hubfs/metrics"
 	"github.com/cli/oauth"
 )
 
@@ -37,6 +42,7 @@ type GithubProvider struct {
 	CallbackURI  string
 	Scopes       string
 	ApiURI       string
+	Gists        bool // clients present gists as repositories (see gist.go)
 }
 
 func NewGithubProvider() *GithubProvider {
@@ -67,6 +73,9 @@ func (provider *GithubProvider) Auth() (token string, err error) {
 }
 
 func (provider *GithubProvider) NewClient(token string) (Client, error) {
+	if provider.Gists {
+		return NewGistClient(provider.ApiURI, token)
+	}
 	return NewGithubClient(provider.ApiURI, token)
 }
 
@@ -78,8 +87,11 @@ func init() {
 type githubClient struct {
 	httpClient *http.Client
 	apiURI     string
-	token      string
+	cred       *git.Credentials // shared with the repositories of the client
 	login      string
+	granted    bool // enumerate only the repositories granted to the token (config.repos)
+	hide       int  // kinds of repositories omitted from owner listings (config.hide)
+	gists      bool // repositories are gists (see gist.go)
 	dir        string
 	keepdir    bool
 	caseins    bool
@@ -88,11 +100,22 @@ type githubClient struct {
 	cache      *cache
 	owners     *cacheImap
 	filter     *filterType
+	overrides  overrideList
+	gitconf    gitConfig
+	refNotify  func(owner string, repository string, ref string, created bool)
+	pins       map[string]*pinSet // pinned objects by repository directory (config.pin)
+	starred    []string           // repositories starred by the user; see GetStarred
+	starredAt  time.Time
+	layers     [cacheLayerCount]CacheLayerPolicy // configured cache policy (config.cache)
+	cachelimit int64                             // size limit of retained layers (config.cache.limit)
+	policy     CachePolicy                       // cache policy set by SetCachePolicy
+	retained   map[string]*retainedDir           // retained cache directories; see policy.go
 }
 
 type githubOwner struct {
 	cacheItem
 	repositories *cacheImap
+	partial      bool   // repositories is incomplete; see ensureRepositories
 	FName        string `json:"login"`
 	FType        string `json:"type"`
 }
@@ -101,21 +124,82 @@ type githubRepository struct {
 	cacheItem
 	Repository
 	keepdir bool
+	mntopts MountOptions
 	FName   string `json:"name"`
 	FRemote string `json:"clone_url"`
+	FOwner  struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	FArchived bool `json:"archived"`
+	FDisabled bool `json:"disabled"`
+	FFork     bool `json:"fork"`
+	FHasWiki  bool `json:"has_wiki"`
+	wiki      bool // the wiki of a repository; see addWiki
+
+	client      *githubClient // set when the repository is opened
+	owner       string
+	releases    []Release // see GetReleases
+	releasesAt  time.Time
+	artifacts   []Asset // see GetArtifacts
+	artifactsAt time.Time
+	issues      []Issue // see GetIssues
+	issuesAt    time.Time
+	metadata    *RepositoryMetadata // see GetMetadata
+	metadataAt  time.Time
+}
+
+// suffix of the name under which the wiki of a repository is accessed
+const wikiSuffix = ".wiki"
+
+// kinds of repositories that can be omitted from owner listings (see config.hide)
+const (
+	hideArchived = 1 << iota
+	hideDisabled
+	hideForks
+)
+
+const defaultHide = hideArchived | hideDisabled
+
+// Function parseHide parses a comma-separated list of the kinds of repositories to omit
+// from owner listings: "archived", "disabled" and "forks".
+func parseHide(v string) (hide int, ok bool) {
+	for _, k := range strings.Split(v, ",") {
+		switch k {
+		case "":
+		case "archived":
+			hide |= hideArchived
+		case "disabled":
+			hide |= hideDisabled
+		case "forks":
+			hide |= hideForks
+		default:
+			return 0, false
+		}
+	}
+	return hide, true
+}
+
+// Function hidden determines whether the repository is omitted from owner listings.
+// Hidden repositories can still be accessed by name.
+func (r *githubRepository) hidden(hide int) bool {
+	return (0 != hide&hideArchived && r.FArchived) ||
+		(0 != hide&hideDisabled && r.FDisabled) ||
+		(0 != hide&hideForks && r.FFork)
 }
 
 func NewGithubClient(apiURI string, token string) (Client, error) {
 	client := &githubClient{
 		httpClient: httputil.DefaultClient,
 		apiURI:     apiURI,
-		token:      token,
+		cred:       git.NewCredentials(token),
+		hide:       defaultHide,
+		gitconf:    gitConfig{timeouts: defaultTimeouts},
 	}
 	client.cache = newCache(&client.lock)
 	client.cache.Value = client
 
-	if "" != client.token {
-		rsp, err := client.sendrecv("/user")
+	if "" != token {
+		rsp, err := client.sendrecv(context.Background(), "/user")
 		if nil != err {
 			return nil, err
 		}
@@ -143,8 +227,34 @@ func configValue(s string, k string, v *string) bool {
 	return false
 }
 
+// Function ParseSize parses a size such as 1024, 64K, 256M or 2G.
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	if "" != s {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if 1 != mult {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if nil != err || 0 > n {
+		return 0, errors.New("invalid size")
+	}
+	return n * mult, nil
+}
+
 func (client *githubClient) SetConfig(config []string) ([]string, error) {
 	res := []string{}
+	reload := false
+	lockpath, frozen := "", false
+	xforms := []string{}
 	for _, s := range config {
 		v := ""
 		switch {
@@ -154,13 +264,21 @@ func (client *githubClient) SetConfig(config []string) ([]string, error) {
 					if p, e := os.Executable(); nil == e {
 						if u, e := url.Parse(client.apiURI); nil == e {
 							n := strings.TrimSuffix(filepath.Base(p), ".exe")
-							v = filepath.Join(d, n, u.Hostname())
+							h := u.Hostname()
+							if client.gists {
+								h = "gist." + strings.TrimPrefix(h, "api.")
+							}
+							v = filepath.Join(d, n, h)
 							client.dir = v
 							client.keepdir = false
 						}
 					}
 				}
 			} else {
+				// an absolute directory allows paths within it to exceed MAX_PATH on Windows
+				if a, e := filepath.Abs(v); nil == e {
+					v = a
+				}
 				client.dir = v
 				client.keepdir = true
 			}
@@ -168,54 +286,256 @@ func (client *githubClient) SetConfig(config []string) ([]string, error) {
 			if ttl, e := time.ParseDuration(v); nil == e && 0 < ttl {
 				client.ttl = ttl
 			}
+		case configValue(s, "config.membudget=", &v):
+			if n, e := ParseSize(v); nil == e {
+				git.SetMemoryBudget(n)
+			} else {
+				return nil, errors.New("invalid config.membudget value: " + v)
+			}
+		case configValue(s, "config.refttl=", &v):
+			if ttl, e := time.ParseDuration(v); nil == e && 0 <= ttl {
+				client.gitconf.refttl = ttl
+			}
+		case configValue(s, "config.mtime.depth=", &v):
+			if n, e := strconv.Atoi(v); nil == e && 0 < n {
+				client.gitconf.depth = n
+			} else {
+				return nil, errors.New("invalid config.mtime.depth value: " + v)
+			}
+		case configValue(s, "config.timeout.refs=", &v):
+			if d, e := time.ParseDuration(v); nil == e && 0 <= d {
+				client.gitconf.timeouts.refs = d
+			} else {
+				return nil, errors.New("invalid config.timeout.refs value: " + v)
+			}
+		case configValue(s, "config.timeout.fetch=", &v):
+			if d, e := time.ParseDuration(v); nil == e && 0 <= d {
+				client.gitconf.timeouts.fetch = d
+			} else {
+				return nil, errors.New("invalid config.timeout.fetch value: " + v)
+			}
+		case configValue(s, "config.timeout.api=", &v):
+			if d, e := time.ParseDuration(v); nil == e && 0 <= d {
+				client.gitconf.timeouts.api = d
+			} else {
+				return nil, errors.New("invalid config.timeout.api value: " + v)
+			}
+		case configValue(s, "config.timeout.blob=", &v):
+			if d, e := time.ParseDuration(v); nil == e && 0 <= d {
+				client.gitconf.timeouts.blob = d
+			} else {
+				return nil, errors.New("invalid config.timeout.blob value: " + v)
+			}
+		case configValue(s, "config.trust.keyring=", &v):
+			client.ensureTrust().keyring = v
+			reload = true
+		case configValue(s, "config.trust.signers=", &v):
+			client.ensureTrust().signers = v
+			reload = true
+		case configValue(s, "config.trust.require=", &v):
+			switch v {
+			case "", "none":
+				v = ""
+			case "signed", "verified":
+			default:
+				return nil, errors.New("invalid config.trust.require value: " + v)
+			}
+			client.ensureTrust().require = v
+		case configValue(s, "config.eol=", &v):
+			if !client.gitconf.attrs.setEol(v) {
+				return nil, errors.New("invalid config.eol value: " + v)
+			}
+		case configValue(s, "config.transform=", &v):
+			xforms = append(xforms, v)
+		case configValue(s, "config.gitcrypt.key=", &v):
+			name, xform, err := loadGitcryptKey(v)
+			if nil == err && !validTransformName(name) {
+				err = errors.New("invalid key name " + name)
+			}
+			if nil != err {
+				return nil, fmt.Errorf("config.gitcrypt.key: %s: %v", v, err)
+			}
+			RegisterTransform(name, xform)
+			client.gitconf.attrs.filter = true
+		case configValue(s, "config.sops.key=", &v):
+			if err := addSopsKey(v); nil != err {
+				return nil, err
+			}
+		case configValue(s, "config.repos=", &v):
+			switch v {
+			case "all":
+				client.granted = false
+			case "granted":
+				client.granted = true
+			default:
+				return nil, errors.New("invalid config.repos value: " + v)
+			}
+		case configValue(s, "config.hide=", &v):
+			if hide, ok := parseHide(v); ok {
+				client.hide = hide
+			} else {
+				return nil, errors.New("invalid config.hide value: " + v)
+			}
+		case configValue(s, "config.pin=", &v):
+			if "1" == v {
+				if nil == client.pins {
+					client.pins = make(map[string]*pinSet)
+				}
+			} else {
+				client.pins = nil
+			}
+		case configValue(s, "config.cache.limit=", &v):
+			if n, e := ParseSize(v); nil == e {
+				client.cachelimit = n
+			} else {
+				return nil, errors.New("invalid config.cache.limit value: " + v)
+			}
+		case configValue(s, "config.cache.", &v):
+			err := parseCacheOption(v, &client.layers, func(d time.Duration) {
+				client.gitconf.refttl = d
+			})
+			if nil != err {
+				return nil, err
+			}
+		case configValue(s, "config.export=", &v):
+			client.gitconf.attrs.export = "1" == v
+		case configValue(s, "config.ident=", &v):
+			client.gitconf.attrs.ident = "1" == v
+		case configValue(s, "config._lock=", &v):
+			lockpath = v
+		case configValue(s, "config._frozen=", &v):
+			frozen = "1" == v
 		case configValue(s, "config._caseins=", &v):
 			if "1" == v {
 				client.caseins = true
 			} else {
 				client.caseins = false
 			}
+		case configValue(s, "config._unorm=", &v):
+			switch v {
+			case "", "nfc", "nfd":
+				client.gitconf.unorm = v
+			default:
+				return nil, errors.New("invalid config._unorm value: " + v)
+			}
 		case configValue(s, "config._filter=", &v):
 			if nil == client.filter {
 				client.filter = &filterType{}
 			}
 			client.filter.addRule(v)
+		case configValue(s, "config._repo=", &v):
+			if err := client.overrides.addRule(v); nil != err {
+				return nil, err
+			}
 		default:
 			res = append(res, s)
 		}
 	}
 
+	// transforms are parsed last, so that they can use the keys of any config option
+	for _, v := range xforms {
+		rule, err := parseTransform(v)
+		if nil != err {
+			return nil, err
+		}
+		client.gitconf.attrs.xforms = append(client.gitconf.attrs.xforms, rule)
+	}
+
+	if reload {
+		err := client.gitconf.trust.load()
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	if "" != lockpath {
+		lock, err := newLockfile(lockpath, frozen)
+		if nil != err {
+			return nil, err
+		}
+		client.gitconf.lock = lock
+	} else if frozen {
+		return nil, errors.New("frozen mode requires a lockfile")
+	}
+
 	return res, nil
 }
 
-func (client *githubClient) sendrecv(path string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", client.apiURI+path, nil)
+func (client *githubClient) ensureTrust() *trustPolicy {
+	if nil == client.gitconf.trust {
+		client.gitconf.trust = &trustPolicy{}
+	}
+	return client.gitconf.trust
+}
+
+func (client *githubClient) sendrecv(ctx context.Context, path string) (*http.Response, error) {
+	ctx, cancel := withTimeout(ctx, client.gitconf.timeouts.api)
+	req, err := http.NewRequestWithContext(ctx, "GET", client.apiURI+path, nil)
 	if nil != err {
+		cancel()
 		return nil, err
 	}
 
 	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	if "" != client.token {
-		req.Header.Set("Authorization", "token "+client.token)
+	if token := client.cred.Token(); "" != token {
+		req.Header.Set("Authorization", "token "+token)
 	}
 
 	rsp, err := client.httpClient.Do(req)
 	if nil != err {
-		return nil, err
+		cancel()
+		return nil, timeoutErr(ctx, err)
+	}
+
+	if rl, ok := parseRateLimit(rsp.Header); ok {
+		metrics.SetRateLimit(rl)
 	}
 
+	rsp.Body = &cancelBody{ReadCloser: rsp.Body, ctx: ctx, cancel: cancel}
+
 	if 404 == rsp.StatusCode {
+		rsp.Body.Close()
 		return nil, ErrNotFound
+	} else if (403 == rsp.StatusCode || 429 == rsp.StatusCode) &&
+		"0" == rsp.Header.Get("X-RateLimit-Remaining") {
+		rsp.Body.Close()
+		return nil, ErrRateLimited
 	} else if 400 <= rsp.StatusCode {
+		rsp.Body.Close()
 		return nil, errors.New(fmt.Sprintf("HTTP %d", rsp.StatusCode))
 	}
 
 	return rsp, nil
 }
 
-func (client *githubClient) getOwner(owner string) (res *githubOwner, err error) {
+// Function parseRateLimit parses the API rate limit headers of a response.
+func parseRateLimit(header http.Header) (rl metrics.RateLimit, ok bool) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if nil != err {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if nil != err {
+		return
+	}
+	rl.Limit, rl.Remaining = limit, remaining
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); nil == err {
+		rl.Reset = time.Unix(reset, 0)
+	}
+	return rl, true
+}
+
+func (client *githubClient) getOwner(ctx context.Context, owner string) (res *githubOwner, err error) {
 	defer trace(owner)(&err)
 
-	rsp, err := client.sendrecv(fmt.Sprintf("/users/%s", owner))
+	rsp, err := client.sendrecv(ctx, fmt.Sprintf("/users/%s", owner))
+	if ErrRateLimited == err && "" == client.cred.Token() {
+		// anonymous clients have a low API rate limit; assume that the owner exists
+		// and let the repositories within it be opened by name
+		res = &githubOwner{FName: owner, FType: "User"}
+		res.Value = res
+		return res, nil
+	}
 	if nil != err {
 		return nil, err
 	}
@@ -232,8 +552,8 @@ func (client *githubClient) getOwner(owner string) (res *githubOwner, err error)
 	return &content, nil
 }
 
-func (client *githubClient) getRepositoryPage(path string) ([]*githubRepository, error) {
-	rsp, err := client.sendrecv(path)
+func (client *githubClient) getRepositoryPage(ctx context.Context, path string) ([]*githubRepository, error) {
+	rsp, err := client.sendrecv(ctx, path)
 	if nil != err {
 		return nil, err
 	}
@@ -254,13 +574,31 @@ func (client *githubClient) getRepositoryPage(path string) ([]*githubRepository,
 	return content, nil
 }
 
-func (client *githubClient) getRepositories(owner string, isorg bool) (res []*githubRepository, err error) {
+func (client *githubClient) getRepositories(ctx context.Context, owner string, isorg bool) (res []*githubRepository, err error) {
 	defer trace(owner)(&err)
 
+	if client.gists {
+		return client.getGists(ctx, owner)
+	}
+
+	if client.granted {
+		res = make([]*githubRepository, 0)
+		lst, err := client.getGrantedRepositories(ctx)
+		if nil != err {
+			return nil, err
+		}
+		for _, elm := range lst {
+			if strings.EqualFold(owner, elm.FOwner.Login) {
+				res = append(res, elm)
+			}
+		}
+		return res, nil
+	}
+
 	var path string
 	if isorg {
 		path = fmt.Sprintf("/orgs/%s/repos?type=all&per_page=100", owner)
-	} else if client.login == owner {
+	} else if client.getLogin() == owner {
 		path = "/user/repos?visibility=all&affiliation=owner&per_page=100"
 	} else {
 		path = fmt.Sprintf("/users/%s/repos?type=owner&per_page=100", owner)
@@ -268,7 +606,32 @@ func (client *githubClient) getRepositories(owner string, isorg bool) (res []*gi
 
 	res = make([]*githubRepository, 0)
 	for page := 1; ; page++ {
-		lst, err := client.getRepositoryPage(path + fmt.Sprintf("&page=%d", page))
+		lst, err := client.getRepositoryPage(ctx, path+fmt.Sprintf("&page=%d", page))
+		if nil != err {
+			return nil, err
+		}
+		res = append(res, lst...)
+		if len(lst) < 100 {
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// Function getGrantedRepositories returns the repositories that the token grants access
+// to. For a classic token these are all repositories of the user and of the user's
+// organizations; a fine-grained token grants access to selected repositories of a single
+// owner only and other owners' private repositories appear not to exist.
+func (client *githubClient) getGrantedRepositories(ctx context.Context) (res []*githubRepository, err error) {
+	res = make([]*githubRepository, 0)
+	if "" == client.cred.Token() {
+		return res, nil
+	}
+
+	path := "/user/repos?affiliation=owner,collaborator,organization_member&per_page=100"
+	for page := 1; ; page++ {
+		lst, err := client.getRepositoryPage(ctx, path+fmt.Sprintf("&page=%d", page))
 		if nil != err {
 			return nil, err
 		}
@@ -281,11 +644,67 @@ func (client *githubClient) getRepositories(owner string, isorg bool) (res []*gi
 	return res, nil
 }
 
-func (client *githubClient) GetOwners() ([]Owner, error) {
+// time for which the list of starred repositories is kept
+const starredTTL = 1 * time.Minute
+
+// Function GetStarred returns the repositories starred by the authenticated user. The
+// list is kept for starredTTL, because it is consulted whenever a starred entry is
+// looked up. Anonymous clients have no starred repositories.
+func (client *githubClient) GetStarred(ctx context.Context) (res []string, err error) {
+	defer trace()(&err)
+
+	if "" == client.cred.Token() {
+		return []string{}, nil
+	}
+
+	client.lock.Lock()
+	if nil != client.starred && starredTTL > time.Since(client.starredAt) {
+		res = client.starred
+		client.lock.Unlock()
+		return res, nil
+	}
+	client.lock.Unlock()
+
+	path, getPage := "/user/starred?per_page=100", client.getRepositoryPage
+	if client.gists {
+		path, getPage = "/gists/starred?per_page=100", client.getGistPage
+	}
+
+	res = make([]string, 0)
+	for page := 1; ; page++ {
+		lst, err := getPage(ctx, path+fmt.Sprintf("&page=%d", page))
+		if nil != err {
+			return nil, err
+		}
+		for _, elm := range lst {
+			name := elm.FOwner.Login + "/" + elm.FName
+			if nil != client.filter && !client.filter.match(name) {
+				continue
+			}
+			res = append(res, name)
+		}
+		if len(lst) < 100 {
+			break
+		}
+	}
+
+	client.lock.Lock()
+	client.starred, client.starredAt = res, time.Now()
+	client.lock.Unlock()
+
+	return res, nil
+}
+
+// Function isFineGrained reports whether a token is a fine-grained personal access token.
+func isFineGrained(token string) bool {
+	return strings.HasPrefix(token, "github_pat_")
+}
+
+func (client *githubClient) GetOwners(ctx context.Context) ([]Owner, error) {
 	return []Owner{}, nil
 }
 
-func (client *githubClient) OpenOwner(name string) (Owner, error) {
+func (client *githubClient) OpenOwner(ctx context.Context, name string) (Owner, error) {
 	var res *githubOwner
 	var err error
 
@@ -305,7 +724,7 @@ func (client *githubClient) OpenOwner(name string) (Owner, error) {
 	}
 	client.lock.Unlock()
 
-	res, err = client.getOwner(name)
+	res, err = client.getOwner(ctx, name)
 	if nil != err {
 		return nil, err
 	}
@@ -325,13 +744,87 @@ func (client *githubClient) OpenOwner(name string) (Owner, error) {
 	return res, nil
 }
 
+// Function SuggestOwners returns the authenticated user and the organizations that the
+// user is a member of.
+func (client *githubClient) SuggestOwners(ctx context.Context) (res []string, err error) {
+	defer trace()(&err)
+
+	login := client.getLogin()
+	if "" == login {
+		return nil, nil
+	}
+
+	var names []string
+	if client.gists {
+		// gists are owned by users only
+		names = []string{login}
+	} else if client.granted || isFineGrained(client.cred.Token()) {
+		// fine-grained tokens cannot list organization memberships; suggest the owners
+		// of the granted repositories instead
+		names, err = client.grantedOwners(ctx, login)
+	} else {
+		names, err = client.memberOwners(ctx, login)
+	}
+	if nil != err {
+		return nil, err
+	}
+	res = make([]string, 0, len(names))
+	for _, name := range names {
+		if nil != client.filter && !client.filter.match(name) {
+			continue
+		}
+		res = append(res, name)
+	}
+
+	return res, nil
+}
+
+func (client *githubClient) memberOwners(ctx context.Context, login string) ([]string, error) {
+	rsp, err := client.sendrecv(ctx, "/user/orgs?per_page=100")
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var content []struct {
+		Login string `json:"login"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&content)
+	if nil != err {
+		return nil, err
+	}
+
+	names := []string{login}
+	for _, elm := range content {
+		names = append(names, elm.Login)
+	}
+	return names, nil
+}
+
+func (client *githubClient) grantedOwners(ctx context.Context, login string) ([]string, error) {
+	lst, err := client.getGrantedRepositories(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	names := []string{login}
+	seen := map[string]bool{strings.ToUpper(login): true}
+	for _, elm := range lst {
+		if k := strings.ToUpper(elm.FOwner.Login); "" != k && !seen[k] {
+			seen[k] = true
+			names = append(names, elm.FOwner.Login)
+		}
+	}
+	return names, nil
+}
+
 func (client *githubClient) CloseOwner(owner Owner) {
 	client.lock.Lock()
 	client.cache.touchCacheItem(&owner.(*githubOwner).cacheItem, -1)
 	client.lock.Unlock()
 }
 
-func (client *githubClient) ensureRepositories(owner *githubOwner, fn func() error) error {
+func (client *githubClient) ensureRepositories(ctx context.Context, owner *githubOwner, fn func() error) error {
 	client.lock.Lock()
 	if nil != owner.repositories {
 		err := fn()
@@ -340,7 +833,13 @@ func (client *githubClient) ensureRepositories(owner *githubOwner, fn func() err
 	}
 	client.lock.Unlock()
 
-	repositories, err := client.getRepositories(owner.FName, "Organization" == owner.FType)
+	partial := false
+	repositories, err := client.getRepositories(ctx, owner.FName, "Organization" == owner.FType)
+	if ErrRateLimited == err && "" == client.cred.Token() {
+		// anonymous clients have a low API rate limit; list the repositories that
+		// have been opened by name (see OpenRepository)
+		partial, err = true, nil
+	}
 	if nil != err {
 		return err
 	}
@@ -348,6 +847,7 @@ func (client *githubClient) ensureRepositories(owner *githubOwner, fn func() err
 	client.lock.Lock()
 	if nil == owner.repositories {
 		owner.repositories = client.cache.newCacheImap()
+		owner.partial = partial
 		for _, elm := range repositories {
 			if nil != client.filter && !client.filter.match(owner.FName+"/"+elm.FName) {
 				continue
@@ -361,17 +861,18 @@ func (client *githubClient) ensureRepositories(owner *githubOwner, fn func() err
 	return err
 }
 
-func (client *githubClient) GetRepositories(owner0 Owner) ([]Repository, error) {
+func (client *githubClient) GetRepositories(ctx context.Context, owner0 Owner) ([]Repository, error) {
 	var res []Repository
 	var err error
 
 	owner := owner0.(*githubOwner)
-	err = client.ensureRepositories(owner, func() error {
-		res = make([]Repository, len(owner.repositories.Items()))
-		i := 0
+	err = client.ensureRepositories(ctx, owner, func() error {
+		res = make([]Repository, 0, len(owner.repositories.Items()))
 		for _, elm := range owner.repositories.Items() {
-			res[i] = elm.Value.(Repository)
-			i++
+			r := elm.Value.(*githubRepository)
+			if !r.wiki && !r.hidden(client.hide) {
+				res = append(res, r)
+			}
 		}
 		return nil
 	})
@@ -379,26 +880,65 @@ func (client *githubClient) GetRepositories(owner0 Owner) ([]Repository, error)
 	return res, err
 }
 
-func (client *githubClient) OpenRepository(owner0 Owner, name string) (Repository, error) {
+func (client *githubClient) OpenRepository(ctx context.Context, owner0 Owner, name string) (Repository, error) {
 	var res *githubRepository
 	var err error
 
 	owner := owner0.(*githubOwner)
-	err = client.ensureRepositories(owner, func() error {
+	err = client.ensureProbed(ctx, owner, name)
+	if nil != err {
+		return nil, err
+	}
+
+	err = client.ensureRepositories(ctx, owner, func() error {
 		item, ok := owner.repositories.Get(name)
+		if !ok {
+			item, ok = client.addWiki(owner, name)
+		}
 		if !ok {
 			return ErrNotFound
 		}
 		res = item.Value.(*githubRepository)
 		if emptyRepository == res.Repository {
-			r := newGitRepository(res.FRemote, client.token, client.caseins)
+			opts := client.overrides.options(owner.FName, res.FName, repoOptions{})
+			opts.Caseins = opts.Caseins || client.caseins
+			conf := &client.gitconf
+			policy := client.cachePolicy()
+			refttl := policy.LayerPolicy(owner.FName, res.FName, CacheRefs).TTL
+			listings := policy.LayerPolicy(owner.FName, res.FName, CacheTrees).retained()
+			if refttl != conf.refttl || listings != conf.listings {
+				c := client.gitconf
+				c.refttl, c.listings = refttl, listings
+				conf = &c
+			}
+			r := newGitRepository(res.FRemote, client.cred, opts.Caseins, conf)
+			if notify := client.refNotify; nil != notify {
+				o, n := owner.FName, res.FName
+				r.(*gitRepository).setRefNotify(func(ref string, created bool) {
+					notify(o, n, ref, created)
+				})
+			}
 			if "" != client.dir {
-				err = r.SetDirectory(filepath.Join(client.dir, owner.FName, res.FName))
+				dir := filepath.Join(client.dir, owner.FName, res.FName)
+				err = r.SetDirectory(dir)
 				if nil != err {
 					return err
 				}
+				// the retained layers of the directory are reused; see policy.go
+				delete(client.retained, dir)
+				if nil != client.pins {
+					pins := client.pins[dir]
+					if nil == pins {
+						pins = &pinSet{}
+						client.pins[dir] = pins
+					}
+					r.(*gitRepository).pins = pins
+				}
 			}
 			res.Repository = r
+			res.client, res.owner = client, owner.FName
+			res.mntopts = opts.MountOptions
+			res.ttl = opts.ttl
 		}
 		client.cache.touchCacheItem(&res.cacheItem, +1)
 		return nil
@@ -410,12 +950,153 @@ func (client *githubClient) OpenRepository(owner0 Owner, name string) (Repositor
 	return res, nil
 }
 
+// Function addWiki adds the wiki of a repository to the repositories of an owner, if name
+// is the name of a repository followed by the suffix .wiki and the repository has a wiki.
+// Wikis are accessed by name only: they are not listed by GetRepositories. It must be
+// called with client.lock held.
+func (client *githubClient) addWiki(owner *githubOwner, name string) (*libcache.MapItem, bool) {
+	if client.gists || !strings.HasSuffix(name, wikiSuffix) {
+		return nil, false
+	}
+	item, ok := owner.repositories.Get(strings.TrimSuffix(name, wikiSuffix))
+	if !ok {
+		return nil, false
+	}
+	base := item.Value.(*githubRepository)
+	if !base.FHasWiki || base.wiki {
+		return nil, false
+	}
+
+	elm := &githubRepository{
+		FName:   base.FName + wikiSuffix,
+		FRemote: strings.TrimSuffix(base.FRemote, ".git") + wikiSuffix + ".git",
+		wiki:    true,
+	}
+	elm.Value = elm
+	elm.Repository = emptyRepository
+	elm.keepdir = client.keepdir
+	owner.repositories.Set(elm.FName, &elm.MapItem, true)
+	client.cache.touchCacheItem(&elm.cacheItem, 0)
+	return &elm.MapItem, true
+}
+
+// Function ensureProbed probes a repository that is missing from an incomplete
+// repository list (see ensureRepositories).
+func (client *githubClient) ensureProbed(ctx context.Context, owner *githubOwner, name string) error {
+	missing := false
+	err := client.ensureRepositories(ctx, owner, func() error {
+		if owner.partial {
+			_, ok := owner.repositories.Get(name)
+			missing = !ok
+		}
+		return nil
+	})
+	if nil == err && missing {
+		err = client.probeRepository(ctx, owner, name)
+	}
+	return err
+}
+
+// Function probeRepository adds a repository that is missing from an incomplete
+// repository list, if it can be cloned anonymously. This avoids the API, so it works
+// when the API rate limit has been exhausted.
+func (client *githubClient) probeRepository(ctx context.Context, owner *githubOwner, name string) error {
+	if nil != client.filter && !client.filter.match(owner.FName+"/"+name) {
+		return ErrNotFound
+	}
+
+	remote := client.cloneURI(owner.FName, name)
+	repo, err := git.OpenRepository(ctx, remote, "")
+	if nil != err {
+		if nil != ctx.Err() {
+			return ctx.Err()
+		}
+		return ErrNotFound
+	}
+	repo.Close()
+
+	elm := &githubRepository{
+		FName:   name,
+		FRemote: remote,
+	}
+	elm.Value = elm
+	elm.Repository = emptyRepository
+	elm.keepdir = client.keepdir
+
+	client.lock.Lock()
+	if _, ok := owner.repositories.Get(name); !ok {
+		owner.repositories.Set(name, &elm.MapItem, true)
+		client.cache.touchCacheItem(&elm.cacheItem, 0)
+	}
+	client.lock.Unlock()
+	return nil
+}
+
+// Function cloneURI returns the clone URL of a repository. It is normally reported by
+// the API, but is needed when the API cannot be used.
+func (client *githubClient) cloneURI(owner string, name string) string {
+	if client.gists {
+		return client.gistCloneURI(name)
+	}
+	u, err := url.Parse(client.apiURI)
+	if nil != err {
+		return ""
+	}
+	u.Host = strings.TrimPrefix(u.Host, "api.")
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/v3")
+	u.Path += "/" + owner + "/" + name + ".git"
+	return u.String()
+}
+
 func (client *githubClient) CloseRepository(repository Repository) {
 	client.lock.Lock()
 	client.cache.touchCacheItem(&repository.(*githubRepository).cacheItem, -1)
 	client.lock.Unlock()
 }
 
+// Function SetRefNotify sets the function that is called with the branches that are
+// created or deleted in repositories opened afterwards.
+func (client *githubClient) SetRefNotify(fn func(owner string, repository string, ref string, created bool)) {
+	client.lock.Lock()
+	client.refNotify = fn
+	client.lock.Unlock()
+}
+
+// Function SetToken replaces the auth token of the client after verifying it. Open
+// repositories use the new token for their subsequent requests.
+func (client *githubClient) SetToken(token string) error {
+	login := ""
+	if "" != token {
+		c, err := NewGithubClient(client.apiURI, token)
+		if nil != err {
+			return err
+		}
+		login = c.(*githubClient).login
+	}
+
+	client.lock.Lock()
+	if login != client.login {
+		client.starred = nil
+	}
+	client.login = login
+	client.cred.SetToken(token)
+	client.lock.Unlock()
+	return nil
+}
+
+func (client *githubClient) getLogin() string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.login
+}
+
+// Function GetDirectory returns the cache directory of the client (see config.dir).
+func (client *githubClient) GetDirectory() string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.dir
+}
+
 func (client *githubClient) StartExpiration() {
 	ttl := 30 * time.Second
 	if 0 != client.ttl {
@@ -466,6 +1147,30 @@ func (r *githubRepository) Name() string {
 	return r.FName
 }
 
+// Function MountOptions returns the mount options of the repository, which reflect any
+// overrides in effect when the repository was opened.
+func (r *githubRepository) MountOptions() MountOptions {
+	return r.mntopts
+}
+
+// Function GetCommitTime returns the time of the last commit that modified an entry, or
+// the time of the ref if the repository cannot determine it.
+func (r *githubRepository) GetCommitTime(ctx context.Context, ref Ref, entry TreeEntry) (
+	time.Time, error) {
+	if c, ok := r.Repository.(CommitTimeRepository); ok {
+		return c.GetCommitTime(ctx, ref, entry)
+	}
+	return ref.TreeTime(), nil
+}
+
+// Function PrefetchBlobs fetches the blobs of entries into the cache.
+func (r *githubRepository) PrefetchBlobs(ctx context.Context, entries []TreeEntry) error {
+	if p, ok := r.Repository.(BlobPrefetcher); ok {
+		return p.PrefetchBlobs(ctx, entries)
+	}
+	return nil
+}
+
 func (r *githubRepository) keep() bool {
 	var list []string
 	if dir := r.GetDirectory(); "" != dir {
@@ -476,17 +1181,30 @@ func (r *githubRepository) keep() bool {
 
 func (r *githubRepository) expire(c *cache, currentTime time.Time) bool {
 	return c.expireCacheItem(&r.cacheItem, currentTime, func() {
+		client := c.Value.(*githubClient)
 		if emptyRepository == r.Repository {
+			if 0 != len(client.retained) {
+				client.sweepCache()
+			}
 			return
 		}
 
+		dir := r.GetDirectory()
 		if r.keepdir || r.keep() {
 			tracef("repo=%#v", r.FRemote)
+		} else if ok, err := client.retainDirectory(dir, r.owner, r.FName); ok {
+			tracef("repo=%#v [retainDirectory() = %v]", r.FRemote, err)
+		} else if pins := client.pins[dir]; nil != pins && 0 != pins.len() {
+			err := removeUnpinned(dir, pins)
+			tracef("repo=%#v [removeUnpinned(%d) = %v]", r.FRemote, pins.len(), err)
 		} else {
 			err := r.RemoveDirectory()
 			tracef("repo=%#v [RemoveDirectory() = %v]", r.FRemote, err)
 		}
 		r.Close()
 		r.Repository = emptyRepository
+		if 0 != len(client.retained) {
+			client.sweepCache()
+		}
 	})
 }
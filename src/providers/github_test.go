@@ -14,7 +14,12 @@
 package providers
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,7 +32,7 @@ const repositoryName = "hubfs"
 var client Client
 
 func TestOpenCloseOwner(t *testing.T) {
-	owner, err := client.OpenOwner(ownerName)
+	owner, err := client.OpenOwner(context.Background(), ownerName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -36,7 +41,7 @@ func TestOpenCloseOwner(t *testing.T) {
 	}
 	client.CloseOwner(owner)
 
-	owner, err = client.OpenOwner(ownerName)
+	owner, err = client.OpenOwner(context.Background(), ownerName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -47,7 +52,7 @@ func TestOpenCloseOwner(t *testing.T) {
 }
 
 func TestGetRepositories(t *testing.T) {
-	owner, err := client.OpenOwner(ownerName)
+	owner, err := client.OpenOwner(context.Background(), ownerName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -56,7 +61,7 @@ func TestGetRepositories(t *testing.T) {
 		t.Error()
 	}
 
-	repositories, err := client.GetRepositories(owner)
+	repositories, err := client.GetRepositories(context.Background(), owner)
 	if nil != err {
 		t.Error(err)
 	}
@@ -71,7 +76,7 @@ func TestGetRepositories(t *testing.T) {
 		t.Error()
 	}
 
-	repositories, err = client.GetRepositories(owner)
+	repositories, err = client.GetRepositories(context.Background(), owner)
 	if nil != err {
 		t.Error(err)
 	}
@@ -88,7 +93,7 @@ func TestGetRepositories(t *testing.T) {
 }
 
 func TestOpenCloseRepository(t *testing.T) {
-	owner, err := client.OpenOwner(ownerName)
+	owner, err := client.OpenOwner(context.Background(), ownerName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -97,7 +102,7 @@ func TestOpenCloseRepository(t *testing.T) {
 		t.Error()
 	}
 
-	repository, err := client.OpenRepository(owner, repositoryName)
+	repository, err := client.OpenRepository(context.Background(), owner, repositoryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -106,7 +111,7 @@ func TestOpenCloseRepository(t *testing.T) {
 	}
 	client.CloseRepository(repository)
 
-	repository, err = client.OpenRepository(owner, repositoryName)
+	repository, err = client.OpenRepository(context.Background(), owner, repositoryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -116,11 +121,314 @@ func TestOpenCloseRepository(t *testing.T) {
 	client.CloseRepository(repository)
 }
 
+func TestSuggestOwners(t *testing.T) {
+	owners, err := client.(OwnerSuggester).SuggestOwners(context.Background())
+	if nil != err {
+		t.Error(err)
+	}
+	if "" != client.(*githubClient).login {
+		if 0 == len(owners) || owners[0] != client.(*githubClient).login {
+			t.Error(owners)
+		}
+	} else if 0 != len(owners) {
+		t.Error(owners)
+	}
+}
+
+func TestAnonymousRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		if strings.HasPrefix(r.URL.Path, "/users/") {
+			w.WriteHeader(403)
+		} else {
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGithubClient(server.URL, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	owner, err := client.OpenOwner(context.Background(), "alice")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.CloseOwner(owner)
+	if "alice" != owner.Name() {
+		t.Error()
+	}
+
+	repositories, err := client.GetRepositories(context.Background(), owner)
+	if nil != err || 0 != len(repositories) {
+		t.Error(err, repositories)
+	}
+
+	_, err = client.OpenRepository(context.Background(), owner, "nonexistent")
+	if ErrNotFound != err {
+		t.Error(err)
+	}
+
+	client, err = NewGithubClient(server.URL, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	client.(*githubClient).cred.SetToken("T")
+	_, err = client.OpenOwner(context.Background(), "alice")
+	if ErrRateLimited != err {
+		t.Error(err)
+	}
+}
+
+func TestGrantedRepositories(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"login":"alice"}`))
+		case "/user/repos":
+			w.Write([]byte(`[
+				{"name":"a","clone_url":"https://example.com/alice/a.git","owner":{"login":"alice"}},
+				{"name":"b","clone_url":"https://example.com/acme/b.git","owner":{"login":"acme"}},
+				{"name":"c","clone_url":"https://example.com/acme/c.git","owner":{"login":"acme"}}]`))
+		case "/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		default:
+			// fine-grained tokens cannot access organization memberships or other repositories
+			w.WriteHeader(403)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGithubClient(server.URL, "github_pat_T")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	owners, err := client.(OwnerSuggester).SuggestOwners(context.Background())
+	if nil != err || 2 != len(owners) || "alice" != owners[0] || "acme" != owners[1] {
+		t.Error(err, owners)
+	}
+
+	_, err = client.SetConfig([]string{"config.repos=granted"})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	owner, err := client.OpenOwner(context.Background(), "acme")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.CloseOwner(owner)
+
+	repositories, err := client.GetRepositories(context.Background(), owner)
+	if nil != err || 2 != len(repositories) {
+		t.Error(err, repositories)
+	}
+
+	_, err = client.SetConfig([]string{"config.repos=invalid"})
+	if nil == err {
+		t.Error()
+	}
+}
+
+func TestCloneURI(t *testing.T) {
+	client := &githubClient{apiURI: "https://api.github.com"}
+	if u := client.cloneURI("winfsp", "hubfs"); "https://github.com/winfsp/hubfs.git" != u {
+		t.Error(u)
+	}
+	client = &githubClient{apiURI: "https://ghe.example.com/api/v3/"}
+	if u := client.cloneURI("winfsp", "hubfs"); "https://ghe.example.com/winfsp/hubfs.git" != u {
+		t.Error(u)
+	}
+}
+
+func TestHiddenRepositories(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		case "/orgs/acme/repos":
+			w.Write([]byte(`[
+				{"name":"a","clone_url":"https://example.com/acme/a.git"},
+				{"name":"b","clone_url":"https://example.com/acme/b.git","archived":true},
+				{"name":"c","clone_url":"https://example.com/acme/c.git","disabled":true},
+				{"name":"d","clone_url":"https://example.com/acme/d.git","fork":true}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	list := func(client Client) string {
+		owner, err := client.OpenOwner(context.Background(), "acme")
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer client.CloseOwner(owner)
+		repositories, err := client.GetRepositories(context.Background(), owner)
+		if nil != err {
+			t.Fatal(err)
+		}
+		names := make([]string, len(repositories))
+		for i, r := range repositories {
+			names[i] = r.Name()
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	for _, e := range []struct{ config, names string }{
+		{"", "a,d"},
+		{"config.hide=", "a,b,c,d"},
+		{"config.hide=forks", "a,b,c"},
+		{"config.hide=archived,disabled,forks", "a"},
+	} {
+		client, err := NewGithubClient(server.URL, "")
+		if nil != err {
+			t.Fatal(err)
+		}
+		if "" != e.config {
+			_, err = client.SetConfig([]string{e.config})
+			if nil != err {
+				t.Fatal(err)
+			}
+		}
+		if names := list(client); e.names != names {
+			t.Error(e.config, names)
+		}
+
+		// hidden repositories can still be opened by name
+		owner, _ := client.OpenOwner(context.Background(), "acme")
+		repository, err := client.OpenRepository(context.Background(), owner, "b")
+		if nil != err {
+			t.Error(err)
+		} else {
+			client.CloseRepository(repository)
+		}
+		client.CloseOwner(owner)
+	}
+
+	client, _ := NewGithubClient(server.URL, "")
+	if _, err := client.SetConfig([]string{"config.hide=empty"}); nil == err {
+		t.Error()
+	}
+}
+
+func TestMtimeDepth(t *testing.T) {
+	client, err := NewGithubClient("https://127.0.0.1:1", "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != client.(*githubClient).gitconf.depth {
+		t.Error()
+	}
+	if _, err := client.SetConfig([]string{"config.mtime.depth=16"}); nil != err {
+		t.Error(err)
+	}
+	if 16 != client.(*githubClient).gitconf.depth {
+		t.Error()
+	}
+	for _, v := range []string{"0", "-1", "x"} {
+		if _, err := client.SetConfig([]string{"config.mtime.depth=" + v}); nil == err {
+			t.Error(v)
+		}
+	}
+}
+
+func TestWikis(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		case "/orgs/acme/repos":
+			w.Write([]byte(`[
+				{"name":"a","clone_url":"https://example.com/acme/a.git","has_wiki":true},
+				{"name":"b","clone_url":"https://example.com/acme/b.git"}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGithubClient(server.URL, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	owner, err := client.OpenOwner(context.Background(), "acme")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.CloseOwner(owner)
+
+	repository, err := client.OpenRepository(context.Background(), owner, "a.wiki")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if r := repository.(*githubRepository); "a.wiki" != r.Name() ||
+		"https://example.com/acme/a.wiki.git" != r.FRemote {
+		t.Error(r.Name(), r.FRemote)
+	}
+	client.CloseRepository(repository)
+
+	for _, name := range []string{"b.wiki", "c.wiki", "a.wiki.wiki"} {
+		if _, err = client.OpenRepository(context.Background(), owner, name); ErrNotFound != err {
+			t.Error(name, err)
+		}
+	}
+
+	repositories, err := client.GetRepositories(context.Background(), owner)
+	if nil != err || 2 != len(repositories) {
+		t.Error(err, repositories)
+	}
+}
+
+func TestStarred(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"login":"alice"}`))
+		case "/user/starred":
+			requests++
+			w.Write([]byte(`[
+				{"name":"a","owner":{"login":"alice"}},
+				{"name":"b","owner":{"login":"acme"}}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGithubClient(server.URL, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	lst, err := client.(StarredLister).GetStarred(context.Background())
+	if nil != err || 0 != len(lst) || 0 != requests {
+		t.Error(err, lst, requests)
+	}
+
+	client, err = NewGithubClient(server.URL, "T")
+	if nil != err {
+		t.Fatal(err)
+	}
+	for i := 0; 2 > i; i++ {
+		lst, err = client.(StarredLister).GetStarred(context.Background())
+		if nil != err || "alice/a,acme/b" != strings.Join(lst, ",") {
+			t.Error(err, lst)
+		}
+	}
+	if 1 != requests {
+		t.Error(requests)
+	}
+}
+
 func testExpiration(t *testing.T) {
 	client.StartExpiration()
 	defer client.StopExpiration()
 
-	owner, err := client.OpenOwner(ownerName)
+	owner, err := client.OpenOwner(context.Background(), ownerName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -128,7 +436,7 @@ func testExpiration(t *testing.T) {
 		t.Error()
 	}
 
-	repository, err := client.OpenRepository(owner, repositoryName)
+	repository, err := client.OpenRepository(context.Background(), owner, repositoryName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -141,7 +449,7 @@ func testExpiration(t *testing.T) {
 
 	time.Sleep(3 * time.Second)
 
-	owner, err = client.OpenOwner(ownerName)
+	owner, err = client.OpenOwner(context.Background(), ownerName)
 	if nil != err {
 		t.Error(err)
 	}
@@ -149,7 +457,7 @@ func testExpiration(t *testing.T) {
 		t.Error()
 	}
 
-	repository, err = client.OpenRepository(owner, repositoryName)
+	repository, err = client.OpenRepository(context.Background(), owner, repositoryName)
 	if nil != err {
 		t.Error(err)
 	}
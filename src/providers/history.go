@@ -0,0 +1,180 @@
+/*
+ * history.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+// The commit time of an entry is the time of the last commit that modified it. It is
+// determined by walking the first-parent history of the ref and comparing the directory
+// of the entry in each commit against the same directory in its parent. The commit times
+// of all entries of a directory are determined together and are cached in the ref.
+//
+// Commits and trees are fetched one at a time, so the walk is limited to a number of
+// commits (defaultHistoryDepth or config.mtime.depth). Entries that are not modified
+// within the limit get the time of the oldest commit examined.
+
+// default number of commits examined when determining the commit times of a directory
+const defaultHistoryDepth = 256
+
+func (r *gitRepository) GetCommitTime(ctx context.Context, ref0 Ref, entry0 TreeEntry) (
+	time.Time, error) {
+	ref := ref0.(*gitRef)
+	entry, ok := entry0.(*gitTreeEntry)
+	if !ok || nil == entry {
+		return ref.treeTime, nil
+	}
+
+	dirpath, name := path.Split(entry.path)
+	dirpath = strings.TrimSuffix(dirpath, "/")
+
+	r.lock.RLock()
+	times, ok := ref.mtimes[dirpath]
+	commit := ref.commit
+	dir := r.dir
+	r.lock.RUnlock()
+
+	if !ok {
+		if nil == commit {
+			return ref.treeTime, nil
+		}
+
+		tctx, cancel := withTimeout(ctx, r.conf.timeouts.fetch)
+		var err error
+		times, err = r.commitTimes(tctx, dir, commit, dirpath)
+		err = timeoutErr(tctx, err)
+		cancel()
+		if nil != err {
+			return ref.treeTime, err
+		}
+
+		r.lock.Lock()
+		if nil == ref.mtimes {
+			ref.mtimes = make(map[string]map[string]time.Time)
+		}
+		ref.mtimes[dirpath] = times
+		r.lock.Unlock()
+	}
+
+	if t, ok := times[name]; ok {
+		return t, nil
+	}
+	return ref.treeTime, nil
+}
+
+// Function commitTimes returns the commit times of the entries of a directory.
+func (r *gitRepository) commitTimes(ctx context.Context, dir string,
+	commit *exportCommit, dirpath string) (map[string]time.Time, error) {
+	var comps []string
+	if "" != dirpath {
+		comps = strings.Split(dirpath, "/")
+	}
+
+	c := commit.commit
+	curr, err := r.readTreePath(ctx, dir, c.TreeHash, comps)
+	if nil != err {
+		return nil, err
+	}
+
+	depth := r.conf.depth
+	if 0 == depth {
+		depth = defaultHistoryDepth
+	}
+
+	times := make(map[string]time.Time, len(curr))
+	for i := 0; depth > i && len(curr) > len(times) && 0 < len(c.Parents); i++ {
+		p, err := r.readCommit(ctx, dir, c.Parents[0])
+		if nil != err {
+			return nil, err
+		}
+
+		if p.TreeHash != c.TreeHash {
+			prev, err := r.readTreePath(ctx, dir, p.TreeHash, comps)
+			if nil != err {
+				return nil, err
+			}
+
+			for n, h := range curr {
+				if _, ok := times[n]; !ok && prev[n] != h {
+					times[n] = c.Committer.Time
+				}
+			}
+		}
+
+		c = p
+	}
+
+	for n := range curr {
+		if _, ok := times[n]; !ok {
+			times[n] = c.Committer.Time
+		}
+	}
+
+	return times, nil
+}
+
+// Function readCommit retrieves a commit.
+func (r *gitRepository) readCommit(ctx context.Context, dir string, hash string) (
+	commit *git.Commit, err error) {
+	err = r.fetchObjects(ctx, dir, []string{hash}, func(h string, content []byte) error {
+		commit, err = git.DecodeCommit(content)
+		return err
+	})
+	if nil == err && nil == commit {
+		err = ErrNotFound
+	}
+	return
+}
+
+// Function readTreePath returns the hashes of the entries of the directory at the
+// specified path components below a tree. The result is empty if there is no such
+// directory.
+func (r *gitRepository) readTreePath(ctx context.Context, dir string, hash string,
+	comps []string) (map[string]string, error) {
+	for i := 0; ; i++ {
+		var tree []*git.TreeEntry
+		err := r.fetchObjects(ctx, dir, []string{hash}, func(h string, content []byte) (err error) {
+			tree, err = git.DecodeTree(content)
+			return
+		})
+		if nil != err {
+			return nil, err
+		}
+
+		if len(comps) == i {
+			res := make(map[string]string, len(tree))
+			for _, e := range tree {
+				res[e.Name] = e.Hash
+			}
+			return res, nil
+		}
+
+		hash = ""
+		for _, e := range tree {
+			if comps[i] == e.Name && 0040000 == e.Mode {
+				hash = e.Hash
+				break
+			}
+		}
+		if "" == hash {
+			return nil, nil
+		}
+	}
+}
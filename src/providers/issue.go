@@ -0,0 +1,155 @@
+/*
+ * issue.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The issues and pull requests of a GitHub repository are listed with the API, most
+// recently updated first. Each is presented as a markdown file that contains its title,
+// metadata and description, and as a JSON file that contains the object returned by
+// the API. Comments are not included.
+
+// maximum number of issues and pull requests listed
+const maxIssues = 100
+
+type githubIssue struct {
+	FNumber int    `json:"number"`
+	FTitle  string `json:"title"`
+	FState  string `json:"state"`
+	FBody   string `json:"body"`
+	FURL    string `json:"html_url"`
+	FUser   struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	FLabels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+	FPullRequest *json.RawMessage `json:"pull_request"`
+	FCreated     time.Time        `json:"created_at"`
+	FUpdated     time.Time        `json:"updated_at"`
+	markdown     []byte
+	json         []byte
+}
+
+func (i *githubIssue) Number() int {
+	return i.FNumber
+}
+
+func (i *githubIssue) Time() time.Time {
+	return i.FUpdated
+}
+
+func (i *githubIssue) Markdown() []byte {
+	return i.markdown
+}
+
+func (i *githubIssue) JSON() []byte {
+	return i.json
+}
+
+// Function format returns the markdown presentation of an issue.
+func (i *githubIssue) format() []byte {
+	kind := "issue"
+	if nil != i.FPullRequest {
+		kind = "pull request"
+	}
+	labels := make([]string, len(i.FLabels))
+	for j, l := range i.FLabels {
+		labels[j] = l.Name
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\n", i.FTitle)
+	fmt.Fprintf(&b, "- number: #%d\n", i.FNumber)
+	fmt.Fprintf(&b, "- kind: %s\n", kind)
+	fmt.Fprintf(&b, "- state: %s\n", i.FState)
+	fmt.Fprintf(&b, "- author: %s\n", i.FUser.Login)
+	if 0 != len(labels) {
+		fmt.Fprintf(&b, "- labels: %s\n", strings.Join(labels, ", "))
+	}
+	fmt.Fprintf(&b, "- created: %s\n", i.FCreated.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "- updated: %s\n", i.FUpdated.UTC().Format(time.RFC3339))
+	if "" != i.FURL {
+		fmt.Fprintf(&b, "- url: %s\n", i.FURL)
+	}
+	if body := strings.TrimSpace(strings.ReplaceAll(i.FBody, "\r\n", "\n")); "" != body {
+		b.WriteString("\n")
+		b.WriteString(body)
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// Function GetIssues returns the most recently updated issues and pull requests of the
+// repository. The list is kept for releasesTTL. Gists and wikis have no issues.
+func (r *githubRepository) GetIssues(ctx context.Context) (res []Issue, err error) {
+	defer trace(r.FName)(&err)
+
+	client := r.client
+	if nil == client || client.gists || r.wiki {
+		return []Issue{}, nil
+	}
+
+	client.lock.Lock()
+	if nil != r.issues && releasesTTL > time.Since(r.issuesAt) {
+		res = r.issues
+		client.lock.Unlock()
+		return res, nil
+	}
+	client.lock.Unlock()
+
+	rsp, err := client.sendrecv(ctx, fmt.Sprintf(
+		"/repos/%s/%s/issues?state=all&sort=updated&per_page=%d", r.owner, r.FName, maxIssues))
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var content []json.RawMessage
+	err = json.NewDecoder(rsp.Body).Decode(&content)
+	if nil != err {
+		return nil, err
+	}
+
+	res = make([]Issue, 0, len(content))
+	for _, raw := range content {
+		elm := &githubIssue{}
+		err = json.Unmarshal(raw, elm)
+		if nil != err {
+			return nil, err
+		}
+		var b bytes.Buffer
+		if nil == json.Indent(&b, raw, "", "  ") {
+			b.WriteString("\n")
+			elm.json = b.Bytes()
+		} else {
+			elm.json = raw
+		}
+		elm.markdown = elm.format()
+		res = append(res, elm)
+	}
+
+	client.lock.Lock()
+	r.issues, r.issuesAt = res, time.Now()
+	client.lock.Unlock()
+
+	return res, nil
+}
@@ -0,0 +1,95 @@
+/*
+ * issue_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIssues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		case "/orgs/acme/repos":
+			w.Write([]byte(`[{"name":"a","clone_url":"https://example.com/acme/a.git"}]`))
+		case "/repos/acme/a/issues":
+			if "all" != r.URL.Query().Get("state") {
+				w.WriteHeader(400)
+				return
+			}
+			w.Write([]byte(`[
+				{"number":2,"title":"Fix it","state":"open","body":"Line 1\r\nLine 2",
+					"user":{"login":"bob"},"labels":[{"name":"bug"}],
+					"pull_request":{"url":"x"},
+					"created_at":"2022-01-01T00:00:00Z","updated_at":"2022-01-02T00:00:00Z"},
+				{"number":1,"title":"Broken","state":"closed","body":null,
+					"user":{"login":"alice"},"labels":[],
+					"created_at":"2021-01-01T00:00:00Z","updated_at":"2021-01-02T00:00:00Z"}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGithubClient(server.URL, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	owner, err := client.OpenOwner(context.Background(), "acme")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.CloseOwner(owner)
+	repository, err := client.OpenRepository(context.Background(), owner, "a")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.CloseRepository(repository)
+
+	issues, err := repository.(IssueRepository).GetIssues(context.Background())
+	if nil != err || 2 != len(issues) || 2 != issues[0].Number() || 1 != issues[1].Number() ||
+		2 != issues[0].Time().Day() {
+		t.Fatal(err, issues)
+	}
+
+	md := string(issues[0].Markdown())
+	for _, s := range []string{
+		"# Fix it\n", "- kind: pull request\n", "- state: open\n", "- author: bob\n",
+		"- labels: bug\n", "\nLine 1\nLine 2\n"} {
+		if !strings.Contains(md, s) {
+			t.Error(s, md)
+		}
+	}
+	md = string(issues[1].Markdown())
+	if !strings.Contains(md, "- kind: issue\n") || strings.Contains(md, "labels") ||
+		!strings.HasSuffix(md, "\n") {
+		t.Error(md)
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(issues[1].JSON(), &obj); nil != err || "Broken" != obj["title"] {
+		t.Error(err, obj)
+	}
+
+	again, err := repository.(IssueRepository).GetIssues(context.Background())
+	if nil != err || &issues[0] != &again[0] {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * listing.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+// The trees of a commit-pinned ref (a temporary ref that names a commit, or any ref of a
+// frozen lockfile) never change. The decoded listing of every tree that is loaded for
+// such a ref, including the sizes of its files and the targets of its symlinks, is
+// persisted in the trees directory of the repository cache directory, so that a remount
+// lists the tree without reading the tree object or hashing the blobs of its files.
+
+// listingEntry is the persisted form of a tree entry.
+type listingEntry struct {
+	Name   string `json:"name"`
+	Mode   uint32 `json:"mode"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Target string `json:"target,omitempty"`
+}
+
+func listingPath(dir string, hash string) string {
+	return filepath.Join(dir, "trees", hash)
+}
+
+// Function pinnedRef reports whether the trees of ref never change.
+func (r *gitRepository) pinnedRef(ref *gitRef) bool {
+	return nil != ref &&
+		(ref.name == ref.commitHash || (nil != r.conf.lock && r.conf.lock.frozen))
+}
+
+// Function readListing returns the persisted listing of the tree hash in directory
+// dirpath, or nil if there is none.
+func (r *gitRepository) readListing(dir string, hash string, dirpath string) map[string]*gitTreeEntry {
+	content, err := ioutil.ReadFile(listingPath(dir, hash))
+	if nil != err {
+		return nil
+	}
+	var list []listingEntry
+	err = json.Unmarshal(content, &list)
+	if nil != err {
+		return nil
+	}
+
+	tree := make(map[string]*gitTreeEntry, len(list))
+	for _, l := range list {
+		tree[r.pathKey(l.Name)] = &gitTreeEntry{
+			entry:  git.TreeEntry{Name: l.Name, Mode: l.Mode, Hash: l.Hash},
+			path:   path.Join(dirpath, l.Name),
+			size:   l.Size,
+			target: l.Target,
+		}
+	}
+	return tree
+}
+
+// Function writeListing persists the listing of the tree hash.
+func writeListing(dir string, hash string, tree map[string]*gitTreeEntry) {
+	list := make([]listingEntry, 0, len(tree))
+	for _, e := range tree {
+		list = append(list, listingEntry{
+			Name:   e.entry.Name,
+			Mode:   e.entry.Mode,
+			Hash:   e.entry.Hash,
+			Size:   e.size,
+			Target: e.target,
+		})
+	}
+	content, err := json.Marshal(list)
+	if nil != err {
+		return
+	}
+
+	p := listingPath(dir, hash)
+	if nil == os.MkdirAll(filepath.Dir(p), 0700) {
+		err = ioutil.WriteFile(p+".tmp", content, 0600)
+		if nil == err {
+			err = os.Rename(p+".tmp", p)
+		}
+		if nil != err {
+			os.Remove(p + ".tmp")
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * listing_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+func TestPersistedListing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listing_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const helloBlob = "ce013625030ba8dba906f756967f9e9ca394464a"
+	raw, _ := hex.DecodeString(helloBlob)
+	treeContent := append([]byte("100644 hello\x00"), raw...)
+	treeHash := git.ObjectHash(git.TreeObject, treeContent)
+	commitContent := []byte("tree " + treeHash + "\n" +
+		"author Author <author@example.com> 1600000000 +0000\n" +
+		"committer Committer <committer@example.com> 1600000000 +0000\n" +
+		"\n" +
+		"Commit message\n")
+	commitHash := git.ObjectHash(git.CommitObject, commitContent)
+
+	populate := func() {
+		writeObject(dir, helloBlob, []byte("hello\n"))
+		writeObject(dir, treeHash, treeContent)
+		writeObject(dir, commitHash, commitContent)
+	}
+	getTree := func(name string) {
+		// the repository is never used as all objects are in the cache
+		r := &gitRepository{remote: "test", conf: &gitConfig{}, opened: true,
+			repo: &git.Repository{}, dir: dir}
+		lst, err := r.GetTree(context.Background(), &gitRef{name: name, commitHash: commitHash}, nil)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if 1 != len(lst) || "hello" != lst[0].Name() || 6 != lst[0].Size() ||
+			helloBlob != lst[0].Hash() {
+			t.Error(lst)
+		}
+	}
+
+	populate()
+	getTree(commitHash)
+	if _, err := os.Stat(listingPath(dir, treeHash)); nil != err {
+		t.Error(err)
+	}
+
+	// a remount lists the tree without the tree object and blob
+	os.Remove(objectPath(dir, treeHash))
+	os.Remove(objectPath(dir, helloBlob))
+	getTree(commitHash)
+
+	// trees of refs that are not pinned are not persisted
+	os.RemoveAll(filepath.Join(dir, "trees"))
+	populate()
+	getTree("refs/heads/master")
+	if _, err := os.Stat(listingPath(dir, treeHash)); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * lockfile.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// lockfile records the commit that each ref resolved to. Each line has the form:
+//
+//	<hash> <remote> <ref>
+//
+// In frozen mode refs resolve to the recorded commits and refs that are not
+// recorded do not exist.
+type lockfile struct {
+	path   string
+	frozen bool
+	lock   sync.Mutex
+	refs   map[string]string // "remote ref" -> hash
+}
+
+func newLockfile(path string, frozen bool) (*lockfile, error) {
+	l := &lockfile{
+		path:   path,
+		frozen: frozen,
+		refs:   make(map[string]string),
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		if os.IsNotExist(err) && !frozen {
+			return l, nil
+		}
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if 3 != len(fields) {
+			return nil, fmt.Errorf("%s:%d: invalid lock entry", path, n)
+		}
+		l.refs[fields[1]+" "+fields[2]] = fields[0]
+	}
+
+	return l, scanner.Err()
+}
+
+// Function remoteRefs returns the recorded refs of a remote as a map of ref name to hash.
+func (l *lockfile) remoteRefs(remote string) map[string]string {
+	res := make(map[string]string)
+	prefix := remote + " "
+	l.lock.Lock()
+	for k, h := range l.refs {
+		if strings.HasPrefix(k, prefix) {
+			res[k[len(prefix):]] = h
+		}
+	}
+	l.lock.Unlock()
+	return res
+}
+
+// Function record records the hash that a ref resolved to and updates the lockfile.
+func (l *lockfile) record(remote string, name string, hash string) {
+	if l.frozen {
+		return
+	}
+
+	k := remote + " " + name
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if hash == l.refs[k] {
+		return
+	}
+	l.refs[k] = hash
+
+	err := l.write()
+	if nil != err {
+		tracef("lockfile %q: %v", l.path, err)
+	}
+}
+
+func (l *lockfile) write() error {
+	keys := make([]string, 0, len(l.refs))
+	for k := range l.refs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("# hubfs lockfile; do not edit\n")
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s %s\n", l.refs[k], k)
+	}
+
+	dir, name := filepath.Split(l.path)
+	tmp, err := ioutil.TempFile(dir, name+".tmp*")
+	if nil != err {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if e := tmp.Close(); nil == err {
+		err = e
+	}
+	if nil == err {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if nil != err {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+/*
+ * lockfile_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockfile(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "lockfile_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	path := filepath.Join(tdir, "hubfs.lock")
+
+	_, err = newLockfile(path, true)
+	if nil == err {
+		t.Error()
+	}
+
+	lock, err := newLockfile(path, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	lock.record("https://github.com/winfsp/hubfs", "refs/heads/master", "90f898ae")
+	lock.record("https://github.com/winfsp/hubfs", "refs/tags/v1.0", "609d3b89")
+	lock.record("https://github.com/winfsp/cgofuse", "refs/heads/master", "12345678")
+
+	lock, err = newLockfile(path, true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	refs := lock.remoteRefs("https://github.com/winfsp/hubfs")
+	if 2 != len(refs) ||
+		"90f898ae" != refs["refs/heads/master"] ||
+		"609d3b89" != refs["refs/tags/v1.0"] {
+		t.Error(refs)
+	}
+
+	lock.record("https://github.com/winfsp/hubfs", "refs/heads/master", "00000000")
+	if "90f898ae" != lock.remoteRefs("https://github.com/winfsp/hubfs")["refs/heads/master"] {
+		t.Error()
+	}
+}
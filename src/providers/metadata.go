@@ -0,0 +1,118 @@
+/*
+ * metadata.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The metadata of a GitHub repository is retrieved with the API when requested, rather
+// than taken from the listing of the repositories of its owner, which may be stale.
+
+type githubMetadata struct {
+	FName  string `json:"name"`
+	FOwner struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	FDescription   string   `json:"description"`
+	FDefaultBranch string   `json:"default_branch"`
+	FVisibility    string   `json:"visibility"`
+	FPrivate       bool     `json:"private"`
+	FTopics        []string `json:"topics"`
+	FLicense       *struct {
+		SPDX string `json:"spdx_id"`
+	} `json:"license"`
+	FArchived bool   `json:"archived"`
+	FFork     bool   `json:"fork"`
+	FCloneURL string `json:"clone_url"`
+	FSSHURL   string `json:"ssh_url"`
+	FHTMLURL  string `json:"html_url"`
+}
+
+// Function GetMetadata returns the metadata of the repository. The metadata is kept for
+// releasesTTL. The metadata of gists and wikis is not retrieved; only the fields known
+// from the listing of their owner are reported.
+func (r *githubRepository) GetMetadata(ctx context.Context) (res *RepositoryMetadata, err error) {
+	defer trace(r.FName)(&err)
+
+	client := r.client
+	if nil == client || client.gists || r.wiki {
+		res = &RepositoryMetadata{
+			Name:     r.FName,
+			Owner:    r.FOwner.Login,
+			Topics:   []string{},
+			CloneURL: r.FRemote,
+		}
+		if "" == res.Owner {
+			res.Owner = r.owner
+		}
+		return res, nil
+	}
+
+	client.lock.Lock()
+	if nil != r.metadata && releasesTTL > time.Since(r.metadataAt) {
+		res = r.metadata
+		client.lock.Unlock()
+		return res, nil
+	}
+	client.lock.Unlock()
+
+	rsp, err := client.sendrecv(ctx, fmt.Sprintf("/repos/%s/%s", r.owner, r.FName))
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var content githubMetadata
+	err = json.NewDecoder(rsp.Body).Decode(&content)
+	if nil != err {
+		return nil, err
+	}
+
+	res = &RepositoryMetadata{
+		Name:          content.FName,
+		Owner:         content.FOwner.Login,
+		Description:   content.FDescription,
+		DefaultBranch: content.FDefaultBranch,
+		Visibility:    content.FVisibility,
+		Topics:        content.FTopics,
+		Archived:      content.FArchived,
+		Fork:          content.FFork,
+		CloneURL:      content.FCloneURL,
+		SSHURL:        content.FSSHURL,
+		HTMLURL:       content.FHTMLURL,
+	}
+	if "" == res.Visibility {
+		// older GitHub Enterprise servers do not report visibility
+		res.Visibility = "public"
+		if content.FPrivate {
+			res.Visibility = "private"
+		}
+	}
+	if nil == res.Topics {
+		res.Topics = []string{}
+	}
+	if nil != content.FLicense {
+		res.License = content.FLicense.SPDX
+	}
+
+	client.lock.Lock()
+	r.metadata, r.metadataAt = res, time.Now()
+	client.lock.Unlock()
+
+	return res, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * metadata_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		case "/orgs/acme/repos":
+			w.Write([]byte(`[
+				{"name":"a","clone_url":"https://example.com/acme/a.git"},
+				{"name":"b","clone_url":"https://example.com/acme/b.git"}]`))
+		case "/repos/acme/a":
+			requests++
+			w.Write([]byte(`{"name":"a","owner":{"login":"acme"},"description":"The a",
+				"default_branch":"main","visibility":"internal","topics":["x","y"],
+				"license":{"spdx_id":"MIT"},"fork":true,
+				"clone_url":"https://example.com/acme/a.git","ssh_url":"git@example.com:acme/a.git",
+				"html_url":"https://example.com/acme/a"}`))
+		case "/repos/acme/b":
+			w.Write([]byte(`{"name":"b","owner":{"login":"acme"},"private":true,"license":null}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGithubClient(server.URL, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	owner, err := client.OpenOwner(context.Background(), "acme")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.CloseOwner(owner)
+
+	expected := map[string]string{
+		"a": "&{a acme The a main internal [x y] MIT false true https://example.com/acme/a.git " +
+			"git@example.com:acme/a.git https://example.com/acme/a}",
+		"b": "&{b acme   private []  false false   }",
+	}
+	for _, name := range []string{"a", "b", "a"} {
+		repository, err := client.OpenRepository(context.Background(), owner, name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		metadata, err := repository.(MetadataRepository).GetMetadata(context.Background())
+		if nil != err || expected[name] != fmt.Sprint(metadata) {
+			t.Error(err, metadata)
+		}
+		client.CloseRepository(repository)
+	}
+	if 1 != requests {
+		t.Error(requests)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * override.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"errors"
+	pathutil "path"
+	"strings"
+	"time"
+)
+
+// MountOptions contains the mount options of a repository that may be overridden per
+// repository (see config._repo).
+type MountOptions struct {
+	Caseins  bool // file names in the repository are case-insensitive
+	Readonly bool // the repository is mounted read-only
+}
+
+// MountOptionsRepository is implemented by repositories that report their mount options.
+type MountOptionsRepository interface {
+	MountOptions() MountOptions
+}
+
+// repoOptions contains the options that are in effect for a repository.
+type repoOptions struct {
+	MountOptions
+	ttl       time.Duration // cache time-to-live; 0 uses the client ttl
+	refttl    time.Duration
+	hasrefttl bool
+	cache     [cacheLayerCount]CacheLayerPolicy // cache policy; see policy.go
+}
+
+type overrideRule struct {
+	patt  string
+	apply func(opts *repoOptions)
+}
+
+// Type overrideList is a list of per-repository option overrides. Rules are applied in
+// the order in which they were added, so that later rules take precedence.
+type overrideList []overrideRule
+
+// Function addRule adds a rule of the form "owner/repo:key=value". The owner/repo
+// pattern may use wildcards for pattern matching.
+func (list *overrideList) addRule(rule string) error {
+	i := strings.LastIndex(rule, ":")
+	if -1 == i {
+		return errors.New("invalid repository override: " + rule)
+	}
+	patt := strings.TrimPrefix(pathutil.Clean(rule[:i]), "/")
+	if 1 != strings.Count(patt, "/") {
+		return errors.New("invalid repository pattern: " + rule[:i])
+	}
+	if _, err := pathutil.Match(patt, ""); nil != err {
+		return errors.New("invalid repository pattern: " + rule[:i])
+	}
+	kv := strings.SplitN(rule[i+1:], "=", 2)
+	if 2 != len(kv) {
+		return errors.New("invalid repository override: " + rule)
+	}
+
+	var apply func(opts *repoOptions)
+	switch kv[0] {
+	case "ttl", "refttl", "refs.ttl":
+		d, err := time.ParseDuration(kv[1])
+		if nil != err || 0 > d || ("ttl" == kv[0] && 0 == d) {
+			return errors.New("invalid " + kv[0] + " value: " + kv[1])
+		}
+		if "ttl" == kv[0] {
+			apply = func(opts *repoOptions) { opts.ttl = d }
+		} else {
+			apply = func(opts *repoOptions) { opts.refttl, opts.hasrefttl = d, true }
+		}
+	case "caseins", "readonly":
+		var b bool
+		switch kv[1] {
+		case "1", "true":
+			b = true
+		case "0", "false":
+		default:
+			return errors.New("invalid " + kv[0] + " value: " + kv[1])
+		}
+		if "caseins" == kv[0] {
+			apply = func(opts *repoOptions) { opts.Caseins = b }
+		} else {
+			apply = func(opts *repoOptions) { opts.Readonly = b }
+		}
+	case "trees.ttl", "trees.pin", "trees.priority",
+		"blobs.ttl", "blobs.pin", "blobs.priority":
+		var layers [cacheLayerCount]CacheLayerPolicy
+		if err := parseCacheOption(rule[i+1:], &layers, nil); nil != err {
+			return err
+		}
+		layer, key := CacheTrees, kv[0][len("trees."):]
+		if strings.HasPrefix(kv[0], "blobs.") {
+			layer = CacheBlobs
+		}
+		p := layers[layer]
+		switch key {
+		case "ttl":
+			apply = func(opts *repoOptions) { opts.cache[layer].TTL = p.TTL }
+		case "pin":
+			apply = func(opts *repoOptions) { opts.cache[layer].Pin = p.Pin }
+		case "priority":
+			apply = func(opts *repoOptions) { opts.cache[layer].Priority = p.Priority }
+		}
+	default:
+		return errors.New("unknown repository option: " + kv[0])
+	}
+
+	*list = append(*list, overrideRule{strings.ToUpper(patt), apply})
+	return nil
+}
+
+// Function options returns the options for the repository owner/repo, starting from the
+// defaults in opts.
+func (list overrideList) options(owner string, repo string, opts repoOptions) repoOptions {
+	path := strings.ToUpper(owner + "/" + repo)
+	for _, rule := range list {
+		if m, _ := pathutil.Match(rule.patt, path); m {
+			rule.apply(&opts)
+		}
+	}
+	return opts
+}
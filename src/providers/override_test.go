@@ -0,0 +1,73 @@
+/*
+ * override_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverride(t *testing.T) {
+	var list overrideList
+
+	for _, rule := range []string{
+		"myorg/*:refttl=1m",
+		"myorg/*:readonly=1",
+		"myorg/docs:readonly=false",
+		"*/hubfs:caseins=true",
+		"*/hubfs:ttl=5m",
+	} {
+		if err := list.addRule(rule); nil != err {
+			t.Error(rule, err)
+		}
+	}
+
+	for _, rule := range []string{
+		"myorg:readonly=1",
+		"myorg/a/b:readonly=1",
+		"myorg/*",
+		"myorg/*:readonly",
+		"myorg/*:readonly=maybe",
+		"myorg/*:ttl=0",
+		"myorg/*:refttl=-1s",
+		"myorg/*:prefetch=all",
+		"myorg/[:readonly=1",
+	} {
+		if err := list.addRule(rule); nil == err {
+			t.Error(rule)
+		}
+	}
+
+	expect := func(owner, repo string, e repoOptions) {
+		o := list.options(owner, repo, repoOptions{})
+		if e != o {
+			t.Errorf("%s/%s expect %+v got %+v", owner, repo, e, o)
+		}
+	}
+
+	expect("other", "repo", repoOptions{})
+	expect("MyOrg", "code", repoOptions{
+		MountOptions: MountOptions{Readonly: true},
+		refttl:       time.Minute,
+		hasrefttl:    true,
+	})
+	expect("myorg", "docs", repoOptions{
+		refttl:    time.Minute,
+		hasrefttl: true,
+	})
+	expect("winfsp", "hubfs", repoOptions{
+		MountOptions: MountOptions{Caseins: true},
+		ttl:          5 * time.Minute,
+	})
+}
@@ -0,0 +1,104 @@
+/*
+ * pin.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// With config.pin the blobs that are read are pinned in the cache for the lifetime of the
+// client. The cache directory of a repository is normally removed when the repository
+// expires; the pinned objects are retained instead, so that a repository that is
+// reopened does not fetch them again.
+
+// pinSet holds the names of the pinned objects of a repository.
+type pinSet struct {
+	lock  sync.Mutex
+	names map[string]bool
+}
+
+func (p *pinSet) add(name string) {
+	p.lock.Lock()
+	if nil == p.names {
+		p.names = make(map[string]bool)
+	}
+	p.names[name] = true
+	p.lock.Unlock()
+}
+
+func (p *pinSet) has(name string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.names[name]
+}
+
+func (p *pinSet) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.names)
+}
+
+// Function removeUnpinned removes the cache directory of a repository except for the
+// pinned objects.
+func removeUnpinned(dir string, pins *pinSet) error {
+	infos, err := ioutil.ReadDir(dir)
+	if nil != err {
+		return err
+	}
+
+	for _, info := range infos {
+		if "objects" != info.Name() {
+			if e := os.RemoveAll(filepath.Join(dir, info.Name())); nil == err {
+				err = e
+			}
+		}
+	}
+
+	if e := removeUnpinnedObjects(filepath.Join(dir, "objects"), pins); nil == err {
+		err = e
+	}
+
+	return err
+}
+
+// Function removeUnpinnedObjects removes the objects directory of a repository except for
+// the pinned objects. A nil pins removes all objects.
+func removeUnpinnedObjects(objdir string, pins *pinSet) error {
+	if nil == pins {
+		return os.RemoveAll(objdir)
+	}
+
+	var err error
+	infos, _ := ioutil.ReadDir(objdir)
+	for _, info := range infos {
+		subdir := filepath.Join(objdir, info.Name())
+		names, _ := ioutil.ReadDir(subdir)
+		kept := 0
+		for _, n := range names {
+			if pins.has(info.Name() + n.Name()) {
+				kept++
+			} else if e := os.RemoveAll(filepath.Join(subdir, n.Name())); nil == err {
+				err = e
+			}
+		}
+		if 0 == kept {
+			os.Remove(subdir)
+		}
+	}
+
+	return err
+}
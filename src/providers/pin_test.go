@@ -0,0 +1,72 @@
+/*
+ * pin_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveUnpinned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pin_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"objects/aa/1111",
+		"objects/aa/2222",
+		"objects/bb/3333",
+		"objects/cc/4444.smudge",
+		"files/main/README",
+		"meta/main/.unionfs",
+		"tree",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		err = ioutil.WriteFile(path, []byte(name), 0600)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	var pins pinSet
+	pins.add("aa1111")
+	pins.add("cc4444.smudge")
+	if 2 != pins.len() || !pins.has("aa1111") || pins.has("aa2222") {
+		t.Error()
+	}
+
+	err = removeUnpinned(dir, &pins)
+	if nil != err {
+		t.Error(err)
+	}
+
+	list := []string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if nil == err && dir != path {
+			rel, _ := filepath.Rel(dir, path)
+			list = append(list, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	expect := "objects objects/aa objects/aa/1111 objects/cc objects/cc/4444.smudge"
+	if got := fmt.Sprint(list); "["+expect+"]" != got {
+		t.Error(got)
+	}
+}
@@ -0,0 +1,338 @@
+/*
+ * policy.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The content that a client caches is split into layers, each of which is controlled per
+// repository by a cache policy:
+//
+// - refs: the resolved refs of a repository. TTL is the time after which resolved refs are
+// revalidated (see config.refttl); 0 means never.
+// - trees: the listings of the trees of refs. When a policy retains trees (Pin or a non-zero
+// TTL), the listings of the trees of all refs are persisted in the trees directory of the
+// repository cache directory (otherwise only those of commit-pinned refs are).
+// - blobs: the objects in the objects directory of the repository cache directory.
+// - attrs: the file attributes that the OS caches. TTL is the time for which attributes are
+// cached; 0 means the OS default. Attributes are cached for the whole mount, so only the
+// policy for the empty owner and repository applies.
+//
+// The cache directory of a repository is normally removed when the repository expires.
+// The trees and blobs layers of a repository are instead retained: for TTL after the
+// repository expires or indefinitely if Pin is set. Retained layers are reused when the
+// repository is reopened. When the size of the retained layers that are not pinned
+// exceeds the limit set by config.cache.limit, layers are evicted in order of increasing
+// Priority and then in order of expiration. Nothing is removed when the cache directory is
+// kept (config.dir=PATH).
+
+// CacheLayer identifies a layer of cached content.
+type CacheLayer int
+
+const (
+	CacheRefs  CacheLayer = iota // resolved refs
+	CacheTrees                   // tree listings
+	CacheBlobs                   // objects
+	CacheAttrs                   // file attributes cached by the OS
+	cacheLayerCount
+)
+
+var cacheLayerNames = [cacheLayerCount]string{"refs", "trees", "blobs", "attrs"}
+
+// the names of the directories of the layers that are retained
+var cacheLayerDirs = map[CacheLayer]string{CacheTrees: "trees", CacheBlobs: "objects"}
+
+func (layer CacheLayer) String() string {
+	if 0 <= layer && cacheLayerCount > layer {
+		return cacheLayerNames[layer]
+	}
+	return "CacheLayer(" + strconv.Itoa(int(layer)) + ")"
+}
+
+// CacheLayerPolicy is the policy of a cache layer. Fields that do not apply to a layer are
+// ignored.
+type CacheLayerPolicy struct {
+	TTL      time.Duration // time-to-live; meaning depends on the layer
+	Pin      bool          // the layer is retained indefinitely (trees, blobs)
+	Priority int           // layers with lower priority are evicted first (trees, blobs)
+}
+
+// Function retained reports whether a trees or blobs layer is retained when its repository
+// expires.
+func (p CacheLayerPolicy) retained() bool {
+	return p.Pin || 0 != p.TTL
+}
+
+// CachePolicy determines the policy of each cache layer of a repository. It is consulted
+// when repositories are opened and expire and must not call back into the client.
+type CachePolicy interface {
+	LayerPolicy(owner string, repository string, layer CacheLayer) CacheLayerPolicy
+}
+
+// Function parseCacheOption parses a cache option of the form layer.key=value and applies
+// it to the layer policies in layers. The refs TTL is reported separately in refttl,
+// because it is also set by config.refttl.
+func parseCacheOption(s string, layers *[cacheLayerCount]CacheLayerPolicy,
+	refttl func(d time.Duration)) error {
+	kv := strings.SplitN(s, "=", 2)
+	if 2 != len(kv) {
+		return errors.New("invalid cache option: " + s)
+	}
+	i := strings.IndexByte(kv[0], '.')
+	if -1 == i {
+		return errors.New("invalid cache option: " + s)
+	}
+
+	layer := CacheLayer(-1)
+	for l, n := range cacheLayerNames {
+		if n == kv[0][:i] {
+			layer = CacheLayer(l)
+		}
+	}
+	if -1 == layer {
+		return errors.New("unknown cache layer: " + kv[0][:i])
+	}
+
+	key, v := kv[0][i+1:], kv[1]
+	switch {
+	case "ttl" == key:
+		d, err := time.ParseDuration(v)
+		if nil != err || 0 > d {
+			return errors.New("invalid " + kv[0] + " value: " + v)
+		}
+		if CacheRefs == layer {
+			refttl(d)
+		} else {
+			layers[layer].TTL = d
+		}
+	case "pin" == key && (CacheTrees == layer || CacheBlobs == layer):
+		switch v {
+		case "1", "true":
+			layers[layer].Pin = true
+		case "0", "false":
+			layers[layer].Pin = false
+		default:
+			return errors.New("invalid " + kv[0] + " value: " + v)
+		}
+	case "priority" == key && (CacheTrees == layer || CacheBlobs == layer):
+		n, err := strconv.Atoi(v)
+		if nil != err {
+			return errors.New("invalid " + kv[0] + " value: " + v)
+		}
+		layers[layer].Priority = n
+	default:
+		return errors.New("unknown cache option: " + kv[0])
+	}
+	return nil
+}
+
+// Function LayerPolicy implements the cache policy that is configured with the
+// config.cache options and overridden per repository (see config._repo).
+func (client *githubClient) LayerPolicy(owner string, repository string,
+	layer CacheLayer) CacheLayerPolicy {
+	opts := repoOptions{cache: client.layers}
+	if "" != owner || "" != repository {
+		opts = client.overrides.options(owner, repository, opts)
+	}
+	if 0 > layer || cacheLayerCount <= layer {
+		return CacheLayerPolicy{}
+	}
+	p := opts.cache[layer]
+	if CacheRefs == layer {
+		p.TTL = client.gitconf.refttl
+		if opts.hasrefttl {
+			p.TTL = opts.refttl
+		}
+	}
+	return p
+}
+
+// Function SetCachePolicy replaces the configured cache policy of the client. A nil policy
+// restores the configured one.
+func (client *githubClient) SetCachePolicy(policy CachePolicy) {
+	client.lock.Lock()
+	client.policy = policy
+	client.lock.Unlock()
+}
+
+// Function CachePolicy returns the cache policy of the client.
+func (client *githubClient) CachePolicy() CachePolicy {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.cachePolicy()
+}
+
+// Function cachePolicy returns the cache policy of the client. It must be called with
+// client.lock held.
+func (client *githubClient) cachePolicy() CachePolicy {
+	if nil != client.policy {
+		return client.policy
+	}
+	return client
+}
+
+// retainedDir is the cache directory of an expired repository whose layers are retained.
+type retainedDir struct {
+	owner      string
+	repository string
+	time       time.Time    // expiration time
+	layers     []CacheLayer // retained layers
+}
+
+// Function retainDirectory removes the cache directory of an expired repository except
+// for the layers that are retained and the pinned objects. It reports whether anything
+// was retained. It must be called with client.lock held.
+func (client *githubClient) retainDirectory(dir string, owner string, repository string) (
+	bool, error) {
+	if "" == dir {
+		return false, nil
+	}
+
+	policy := client.cachePolicy()
+	keep := map[string]bool{}
+	var layers []CacheLayer
+	for _, layer := range []CacheLayer{CacheTrees, CacheBlobs} {
+		if policy.LayerPolicy(owner, repository, layer).retained() {
+			keep[cacheLayerDirs[layer]] = true
+			layers = append(layers, layer)
+		}
+	}
+	if 0 == len(layers) {
+		return false, nil
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if nil != err {
+		return false, err
+	}
+	for _, info := range infos {
+		if keep[info.Name()] {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		if "objects" == info.Name() {
+			if e := removeUnpinnedObjects(path, client.pins[dir]); nil == err {
+				err = e
+			}
+		} else if e := os.RemoveAll(path); nil == err {
+			err = e
+		}
+	}
+
+	if nil == client.retained {
+		client.retained = make(map[string]*retainedDir)
+	}
+	client.retained[dir] = &retainedDir{owner, repository, time.Now(), layers}
+	return true, err
+}
+
+// Function sweepCache removes the retained layers whose time-to-live has elapsed. If the
+// retained layers that are not pinned exceed the cache limit, it then evicts retained
+// layers in order of increasing priority and expiration until they no longer do. It must
+// be called with client.lock held.
+func (client *githubClient) sweepCache() {
+	type layerDir struct {
+		rd       *retainedDir
+		dir      string
+		layer    CacheLayer
+		priority int
+		size     int64
+	}
+
+	policy := client.cachePolicy()
+	now := time.Now()
+	var list []layerDir
+	total := int64(0)
+	for dir, rd := range client.retained {
+		for _, layer := range append([]CacheLayer(nil), rd.layers...) {
+			p := policy.LayerPolicy(rd.owner, rd.repository, layer)
+			if p.Pin {
+				continue
+			}
+			if p.TTL <= now.Sub(rd.time) {
+				client.removeLayer(rd, dir, layer)
+				continue
+			}
+			if 0 < client.cachelimit {
+				size := dirSize(filepath.Join(dir, cacheLayerDirs[layer]))
+				list = append(list, layerDir{rd, dir, layer, p.Priority, size})
+				total += size
+			}
+		}
+	}
+
+	if 0 < client.cachelimit && client.cachelimit < total {
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].priority != list[j].priority {
+				return list[i].priority < list[j].priority
+			}
+			return list[i].rd.time.Before(list[j].rd.time)
+		})
+		for _, l := range list {
+			if client.cachelimit >= total {
+				break
+			}
+			client.removeLayer(l.rd, l.dir, l.layer)
+			total -= l.size
+		}
+	}
+
+	// forget the directories that no longer retain any layers
+	for dir, rd := range client.retained {
+		if 0 == len(rd.layers) {
+			delete(client.retained, dir)
+			if infos, err := ioutil.ReadDir(dir); nil == err && 0 == len(infos) {
+				os.Remove(dir)
+			}
+		}
+	}
+}
+
+// Function removeLayer removes a retained layer of the cache directory of a repository,
+// except for the pinned objects.
+func (client *githubClient) removeLayer(rd *retainedDir, dir string, layer CacheLayer) {
+	path := filepath.Join(dir, cacheLayerDirs[layer])
+	var err error
+	if CacheBlobs == layer {
+		err = removeUnpinnedObjects(path, client.pins[dir])
+	} else {
+		err = os.RemoveAll(path)
+	}
+	for i, l := range rd.layers {
+		if layer == l {
+			rd.layers = append(rd.layers[:i], rd.layers[i+1:]...)
+			break
+		}
+	}
+	tracef("dir=%#v layer=%v [= %v]", dir, layer, err)
+}
+
+// Function dirSize returns the total size of the files in a directory tree.
+func dirSize(dir string) (size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if nil == err && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
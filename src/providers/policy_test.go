@@ -0,0 +1,249 @@
+/*
+ * policy_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheOption(t *testing.T) {
+	var layers [cacheLayerCount]CacheLayerPolicy
+	refttl := time.Duration(-1)
+
+	for _, s := range []string{
+		"refs.ttl=30s",
+		"trees.ttl=1h",
+		"trees.pin=1",
+		"blobs.ttl=10m",
+		"blobs.priority=-2",
+		"attrs.ttl=2s",
+	} {
+		if err := parseCacheOption(s, &layers, func(d time.Duration) { refttl = d }); nil != err {
+			t.Error(s, err)
+		}
+	}
+
+	for _, s := range []string{
+		"trees.ttl",
+		"trees=1h",
+		"tags.ttl=1h",
+		"trees.ttl=-1s",
+		"trees.ttl=forever",
+		"trees.pin=maybe",
+		"trees.priority=high",
+		"trees.size=1",
+		"refs.pin=1",
+		"attrs.priority=1",
+	} {
+		if err := parseCacheOption(s, &layers, func(d time.Duration) {}); nil == err {
+			t.Error(s)
+		}
+	}
+
+	if 30*time.Second != refttl {
+		t.Error(refttl)
+	}
+	expect := [cacheLayerCount]CacheLayerPolicy{
+		CacheTrees: {TTL: time.Hour, Pin: true},
+		CacheBlobs: {TTL: 10 * time.Minute, Priority: -2},
+		CacheAttrs: {TTL: 2 * time.Second},
+	}
+	if expect != layers {
+		t.Errorf("expect %+v got %+v", expect, layers)
+	}
+
+	if "blobs" != CacheBlobs.String() || "CacheLayer(7)" != CacheLayer(7).String() {
+		t.Error()
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	client := &githubClient{}
+	client.gitconf.refttl = time.Minute
+	client.layers[CacheBlobs] = CacheLayerPolicy{TTL: time.Hour}
+
+	for _, rule := range []string{
+		"myorg/*:blobs.pin=1",
+		"myorg/*:trees.ttl=5m",
+		"myorg/docs:refs.ttl=10s",
+		"myorg/docs:blobs.priority=3",
+	} {
+		if err := client.overrides.addRule(rule); nil != err {
+			t.Error(rule, err)
+		}
+	}
+	for _, rule := range []string{
+		"myorg/*:attrs.ttl=1s",
+		"myorg/*:trees.pin=maybe",
+		"myorg/*:blobs.priority=high",
+	} {
+		if err := client.overrides.addRule(rule); nil == err {
+			t.Error(rule)
+		}
+	}
+
+	var policy CachePolicy = client
+	expect := func(owner, repo string, layer CacheLayer, e CacheLayerPolicy) {
+		if p := policy.LayerPolicy(owner, repo, layer); e != p {
+			t.Errorf("%s/%s %v expect %+v got %+v", owner, repo, layer, e, p)
+		}
+	}
+
+	expect("", "", CacheRefs, CacheLayerPolicy{TTL: time.Minute})
+	expect("", "", CacheBlobs, CacheLayerPolicy{TTL: time.Hour})
+	expect("other", "repo", CacheTrees, CacheLayerPolicy{})
+	expect("myorg", "code", CacheRefs, CacheLayerPolicy{TTL: time.Minute})
+	expect("myorg", "code", CacheTrees, CacheLayerPolicy{TTL: 5 * time.Minute})
+	expect("myorg", "code", CacheBlobs, CacheLayerPolicy{TTL: time.Hour, Pin: true})
+	expect("myorg", "docs", CacheRefs, CacheLayerPolicy{TTL: 10 * time.Second})
+	expect("myorg", "docs", CacheBlobs, CacheLayerPolicy{TTL: time.Hour, Pin: true, Priority: 3})
+	expect("myorg", "docs", CacheLayer(7), CacheLayerPolicy{})
+
+	if client != client.CachePolicy() {
+		t.Error()
+	}
+	other := &githubClient{}
+	client.SetCachePolicy(other)
+	if other != client.CachePolicy() {
+		t.Error()
+	}
+	client.SetCachePolicy(nil)
+	if client != client.CachePolicy() {
+		t.Error()
+	}
+}
+
+func TestRetainDirectory(t *testing.T) {
+	root, err := ioutil.TempDir("", "policy_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, name := range []string{
+		"keep/repo/objects/aa/1111",
+		"keep/repo/trees/main",
+		"keep/repo/files/main/README",
+		"blobs/repo/objects/aa/1111",
+		"blobs/repo/objects/bb/2222",
+		"blobs/repo/trees/main",
+		"blobs/repo/meta/main/.unionfs",
+		"small/repo/trees/main",
+		"none/repo/objects/aa/1111",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		err = ioutil.WriteFile(path, []byte(strings.Repeat("x", 100)), 0600)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	client := &githubClient{}
+	for _, rule := range []string{
+		"keep/*:trees.pin=1",
+		"keep/*:blobs.ttl=1h",
+		"blobs/*:blobs.ttl=1h",
+		"blobs/*:blobs.priority=1",
+		"small/*:trees.ttl=1h",
+	} {
+		if err := client.overrides.addRule(rule); nil != err {
+			t.Fatal(rule, err)
+		}
+	}
+	client.pins = map[string]*pinSet{filepath.Join(root, "blobs", "repo"): {}}
+	client.pins[filepath.Join(root, "blobs", "repo")].add("bb2222")
+
+	list := func() string {
+		list := []string{}
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if nil == err && info.Mode().IsRegular() {
+				rel, _ := filepath.Rel(root, path)
+				list = append(list, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		sort.Strings(list)
+		return strings.Join(list, " ")
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	for _, owner := range []string{"keep", "blobs", "small", "none"} {
+		ok, err := client.retainDirectory(filepath.Join(root, owner, "repo"), owner, "repo")
+		if nil != err || ("none" == owner) == ok {
+			t.Error(owner, ok, err)
+		}
+	}
+	if ok, err := client.retainDirectory("", "keep", "repo"); ok || nil != err {
+		t.Error(ok, err)
+	}
+
+	expect := "blobs/repo/objects/aa/1111 blobs/repo/objects/bb/2222 " +
+		"keep/repo/objects/aa/1111 keep/repo/trees/main " +
+		"none/repo/objects/aa/1111 " +
+		"small/repo/trees/main"
+	if got := list(); expect != got {
+		t.Error(got)
+	}
+	if 3 != len(client.retained) {
+		t.Error(len(client.retained))
+	}
+
+	// unpinned layers whose TTL has elapsed are removed
+	client.retained[filepath.Join(root, "keep", "repo")].time = time.Now().Add(-2 * time.Hour)
+	client.sweepCache()
+	expect = "blobs/repo/objects/aa/1111 blobs/repo/objects/bb/2222 " +
+		"keep/repo/trees/main " +
+		"none/repo/objects/aa/1111 " +
+		"small/repo/trees/main"
+	if got := list(); expect != got {
+		t.Error(got)
+	}
+	if 3 != len(client.retained) {
+		t.Error(len(client.retained))
+	}
+
+	// over the limit lower priority layers are evicted first; pinned objects are kept
+	client.cachelimit = 250
+	client.sweepCache()
+	expect = "blobs/repo/objects/aa/1111 blobs/repo/objects/bb/2222 " +
+		"keep/repo/trees/main " +
+		"none/repo/objects/aa/1111"
+	if got := list(); expect != got {
+		t.Error(got)
+	}
+	client.cachelimit = 150
+	client.sweepCache()
+	expect = "blobs/repo/objects/bb/2222 " +
+		"keep/repo/trees/main " +
+		"none/repo/objects/aa/1111"
+	if got := list(); expect != got {
+		t.Error(got)
+	}
+	if got := fmt.Sprint(len(client.retained)); "1" != got {
+		t.Error(got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "small", "repo")); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
@@ -14,9 +14,12 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/url"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -30,11 +33,12 @@ type Provider interface {
 
 type Client interface {
 	SetConfig(config []string) ([]string, error)
-	GetOwners() ([]Owner, error)
-	OpenOwner(name string) (Owner, error)
+	GetDirectory() string
+	GetOwners(ctx context.Context) ([]Owner, error)
+	OpenOwner(ctx context.Context, name string) (Owner, error)
 	CloseOwner(owner Owner)
-	GetRepositories(owner Owner) ([]Repository, error)
-	OpenRepository(owner Owner, name string) (Repository, error)
+	GetRepositories(ctx context.Context, owner Owner) ([]Repository, error)
+	OpenRepository(ctx context.Context, owner Owner, name string) (Repository, error)
 	CloseRepository(repository Repository)
 	StartExpiration()
 	StopExpiration()
@@ -50,18 +54,155 @@ type Repository interface {
 	SetDirectory(path string) error
 	RemoveDirectory() error
 	Name() string
-	GetRefs() ([]Ref, error)
-	GetRef(name string) (Ref, error)
-	GetTempRef(name string) (Ref, error)
-	GetTree(ref Ref, entry TreeEntry) ([]TreeEntry, error)
-	GetTreeEntry(ref Ref, entry TreeEntry, name string) (TreeEntry, error)
-	GetBlobReader(entry TreeEntry) (io.ReaderAt, error)
-	GetModule(ref Ref, path string, rootrel bool) (string, error)
+	GetRefs(ctx context.Context) ([]Ref, error)
+	GetRef(ctx context.Context, name string) (Ref, error)
+	GetTempRef(ctx context.Context, name string) (Ref, error)
+	GetTree(ctx context.Context, ref Ref, entry TreeEntry) ([]TreeEntry, error)
+	GetTreeEntry(ctx context.Context, ref Ref, entry TreeEntry, name string) (TreeEntry, error)
+	GetBlobReader(ctx context.Context, entry TreeEntry) (io.ReaderAt, error)
+	GetModule(ctx context.Context, ref Ref, path string, rootrel bool) (string, error)
+}
+
+// CacheFile is implemented by blob readers whose content is fully materialized
+// in the disk cache. The returned file remains open until the reader is closed;
+// it must not be closed by the caller.
+type CacheFile interface {
+	CacheFile() *os.File
+}
+
+// OwnerSuggester is implemented by clients that can suggest owners that are not
+// listed by GetOwners, such as the authenticated user and the user's organizations.
+type OwnerSuggester interface {
+	SuggestOwners(ctx context.Context) ([]string, error)
+}
+
+// StarredLister is implemented by clients that can list the repositories starred by the
+// authenticated user. Repositories are named as owner/repository.
+type StarredLister interface {
+	GetStarred(ctx context.Context) ([]string, error)
+}
+
+// RefNotifier is implemented by clients that report branches that are created or deleted
+// on the server while a repository is open (see config.refttl).
+type RefNotifier interface {
+	SetRefNotify(fn func(owner string, repository string, ref string, created bool))
+}
+
+// TokenSetter is implemented by clients whose auth token can be replaced while they are
+// in use, so that a rotated token can take effect without a remount.
+type TokenSetter interface {
+	SetToken(token string) error
+}
+
+// CachePolicySetter is implemented by clients whose cache policy can be replaced
+// programmatically (see policy.go).
+type CachePolicySetter interface {
+	SetCachePolicy(policy CachePolicy)
+	CachePolicy() CachePolicy
+}
+
+// CommitTimeRepository is implemented by repositories that can determine the time of the
+// last commit that modified a tree entry (see config.mtime).
+type CommitTimeRepository interface {
+	GetCommitTime(ctx context.Context, ref Ref, entry TreeEntry) (time.Time, error)
+}
+
+// BlobPrefetcher is implemented by repositories that can fetch the blobs of many tree
+// entries into the cache in a single batch (see hubfs export).
+type BlobPrefetcher interface {
+	PrefetchBlobs(ctx context.Context, entries []TreeEntry) error
+}
+
+// ReleaseRepository is implemented by repositories that have releases with downloadable
+// assets (see .releases).
+type ReleaseRepository interface {
+	GetReleases(ctx context.Context) ([]Release, error)
+	GetAssetReader(ctx context.Context, asset Asset) (io.ReaderAt, error)
+}
+
+// ArtifactRepository is implemented by repositories that have build artifacts (see
+// .artifacts). An artifact is a zip archive; the reader of an artifact implements
+// Size() int64.
+type ArtifactRepository interface {
+	GetArtifacts(ctx context.Context) ([]Asset, error)
+	GetArtifactReader(ctx context.Context, artifact Asset) (io.ReaderAt, error)
+}
+
+// IssueRepository is implemented by repositories that have issues and pull requests
+// (see .issues).
+type IssueRepository interface {
+	GetIssues(ctx context.Context) ([]Issue, error)
+}
+
+// MetadataRepository is implemented by repositories that can report metadata about
+// themselves (see .hubfs_repo.json).
+type MetadataRepository interface {
+	GetMetadata(ctx context.Context) (*RepositoryMetadata, error)
+}
+
+// RepositoryMetadata describes a repository as reported by its provider. Fields that
+// the provider does not report are left empty.
+type RepositoryMetadata struct {
+	Name          string   `json:"name"`
+	Owner         string   `json:"owner"`
+	Description   string   `json:"description"`
+	DefaultBranch string   `json:"default_branch"`
+	Visibility    string   `json:"visibility"`
+	Topics        []string `json:"topics"`
+	License       string   `json:"license"`
+	Archived      bool     `json:"archived"`
+	Fork          bool     `json:"fork"`
+	CloneURL      string   `json:"clone_url"`
+	SSHURL        string   `json:"ssh_url"`
+	HTMLURL       string   `json:"html_url"`
+}
+
+type Release interface {
+	Name() string // tag name
+	Time() time.Time
+	Assets() []Asset
+}
+
+type Asset interface {
+	Name() string
+	Size() int64
+	Time() time.Time
+}
+
+type Issue interface {
+	Number() int
+	Time() time.Time // time of last update
+	Markdown() []byte
+	JSON() []byte
 }
 
 type Ref interface {
 	Name() string
 	TreeTime() time.Time
+	Signature() SignatureInfo
+	TagSignature() SignatureInfo
+}
+
+// CommitRef is implemented by refs that report the hash of their commit.
+type CommitRef interface {
+	CommitHash() string
+}
+
+type SignatureStatus int
+
+const (
+	SignatureNone       SignatureStatus = iota // object is not signed
+	SignatureUnverified                        // object is signed; signature was not checked
+	SignatureGood                              // signature verified against a trusted key
+	SignatureBad                               // signature is invalid or signer is not trusted
+)
+
+// SignatureInfo describes the signature of a commit or annotated tag.
+// Signature information is available once the tree of a ref has been retrieved.
+type SignatureInfo struct {
+	Status SignatureStatus
+	Type   string // "gpg", "ssh", "x509" or "" if unknown
+	Signer string // signer identity if the signature was verified
 }
 
 type TreeEntry interface {
@@ -72,8 +213,24 @@ type TreeEntry interface {
 	Hash() string
 }
 
+// DecryptedTreeEntry is implemented by tree entries whose content is decrypted by a
+// transform (see config.gitcrypt.key and config.sops.key). Decrypted returns the name of
+// the transform, or "" if the content of the entry is not encrypted.
+type DecryptedTreeEntry interface {
+	Decrypted() string
+}
+
 var ErrNotFound = errors.New("not found")
 
+// ErrRateLimited is returned when the API rate limit of a provider has been exhausted.
+var ErrRateLimited = errors.New("rate limited")
+
+// ErrTimeout is returned when a remote operation does not complete within its timeout.
+var ErrTimeout = errors.New("timed out")
+
+// ErrPermission is returned when a remote denies access to a repository.
+var ErrPermission = errors.New("permission denied")
+
 var lock sync.RWMutex
 var providers = make(map[string]Provider)
 
@@ -91,6 +248,17 @@ func GetProvider(name string) Provider {
 	return providers[name]
 }
 
+func GetProviderNames() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	res := make([]string, 0, len(providers))
+	for name := range providers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
 func RegisterProvider(name string, provider Provider) {
 	lock.Lock()
 	defer lock.Unlock()
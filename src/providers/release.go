@@ -0,0 +1,314 @@
+/*
+ * release.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The releases of a GitHub repository are listed with the API. The assets of a release
+// are downloaded into the assets directory of the repository cache directory when first
+// read and are then read from there, like blobs. Without a cache directory the ranges of
+// an asset that are read are downloaded as they are read.
+
+// time for which the list of releases of a repository is kept
+const releasesTTL = 1 * time.Minute
+
+type githubRelease struct {
+	FTag       string         `json:"tag_name"`
+	FDraft     bool           `json:"draft"`
+	FPublished time.Time      `json:"published_at"`
+	FAssets    []*githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	FId      int64     `json:"id"`
+	FName    string    `json:"name"`
+	FSize    int64     `json:"size"`
+	FUpdated time.Time `json:"updated_at"`
+	FURL     string    `json:"url"`
+}
+
+func (r *githubRelease) Name() string {
+	return r.FTag
+}
+
+func (r *githubRelease) Time() time.Time {
+	return r.FPublished
+}
+
+func (r *githubRelease) Assets() []Asset {
+	res := make([]Asset, len(r.FAssets))
+	for i, a := range r.FAssets {
+		res[i] = a
+	}
+	return res
+}
+
+func (a *githubAsset) Name() string {
+	return a.FName
+}
+
+func (a *githubAsset) Size() int64 {
+	return a.FSize
+}
+
+func (a *githubAsset) Time() time.Time {
+	return a.FUpdated
+}
+
+// Function GetReleases returns the published releases of the repository. The list is
+// kept for releasesTTL. Gists and wikis have no releases.
+func (r *githubRepository) GetReleases(ctx context.Context) (res []Release, err error) {
+	defer trace(r.FName)(&err)
+
+	client := r.client
+	if nil == client || client.gists || r.wiki {
+		return []Release{}, nil
+	}
+
+	client.lock.Lock()
+	if nil != r.releases && releasesTTL > time.Since(r.releasesAt) {
+		res = r.releases
+		client.lock.Unlock()
+		return res, nil
+	}
+	client.lock.Unlock()
+
+	res = make([]Release, 0)
+	path := fmt.Sprintf("/repos/%s/%s/releases?per_page=100", r.owner, r.FName)
+	for page := 1; ; page++ {
+		lst, err := client.getReleasePage(ctx, path+fmt.Sprintf("&page=%d", page))
+		if nil != err {
+			return nil, err
+		}
+		for _, elm := range lst {
+			if !elm.FDraft {
+				res = append(res, elm)
+			}
+		}
+		if len(lst) < 100 {
+			break
+		}
+	}
+
+	client.lock.Lock()
+	r.releases, r.releasesAt = res, time.Now()
+	client.lock.Unlock()
+
+	return res, nil
+}
+
+func (client *githubClient) getReleasePage(ctx context.Context, path string) ([]*githubRelease, error) {
+	rsp, err := client.sendrecv(ctx, path)
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var content []*githubRelease
+	err = json.NewDecoder(rsp.Body).Decode(&content)
+	if nil != err {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// Function GetAssetReader returns a reader for the content of a release asset.
+func (r *githubRepository) GetAssetReader(ctx context.Context, asset0 Asset) (
+	res io.ReaderAt, err error) {
+	defer trace(r.FName, asset0.Name())(&err)
+
+	asset := asset0.(*githubAsset)
+	dir := r.GetDirectory()
+	if "" == dir {
+		return &assetReader{client: r.client, asset: asset}, nil
+	}
+	return r.client.cachedAsset(ctx, filepath.Join(dir, "assets"), asset)
+}
+
+// Function cachedAsset returns a reader for an asset that is downloaded into dir, unless
+// it has been downloaded already.
+func (client *githubClient) cachedAsset(ctx context.Context, dir string, asset *githubAsset) (
+	io.ReaderAt, error) {
+	path := filepath.Join(dir, strconv.FormatInt(asset.FId, 10))
+	file, err := openAsset(path, asset.FSize)
+	if nil == err {
+		return file, nil
+	}
+
+	ctx, cancel := withTimeout(ctx, client.gitconf.timeouts.blob)
+	defer cancel()
+	err = client.downloadAsset(ctx, asset, path)
+	if nil != err {
+		return nil, timeoutErr(ctx, err)
+	}
+	return openAsset(path, asset.FSize)
+}
+
+// Function openAsset opens a downloaded asset, if its size matches. A negative size
+// matches any size.
+func openAsset(path string, size int64) (*assetFile, error) {
+	file, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if nil == err && 0 <= size && size != info.Size() {
+		err = errors.New("asset size mismatch")
+	}
+	if nil != err {
+		file.Close()
+		return nil, err
+	}
+	return &assetFile{file, info.Size()}, nil
+}
+
+// Function downloadAsset downloads an asset into the file at path.
+func (client *githubClient) downloadAsset(ctx context.Context, asset *githubAsset, path string) error {
+	rsp, err := client.sendrecvAsset(ctx, asset, -1, 0)
+	if nil != err {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if nil != err {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if nil != err {
+		return err
+	}
+	n, err := io.Copy(file, rsp.Body)
+	if nil == err && 0 <= asset.FSize && asset.FSize != n {
+		err = io.ErrUnexpectedEOF
+	}
+	if e := file.Close(); nil == err {
+		err = e
+	}
+	if nil == err {
+		err = os.Rename(file.Name(), path)
+	}
+	if nil != err {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Function sendrecvAsset requests the content of an asset, or the range of n bytes at
+// offset ofst if ofst is not negative. The API redirects the request to the server that
+// stores the asset.
+func (client *githubClient) sendrecvAsset(ctx context.Context, asset *githubAsset, ofst int64, n int) (
+	*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", asset.FURL, nil)
+	if nil != err {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/octet-stream")
+	if token := client.cred.Token(); "" != token {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	if 0 <= ofst {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", ofst, ofst+int64(n)-1))
+	}
+
+	rsp, err := client.httpClient.Do(req)
+	if nil != err {
+		return nil, err
+	}
+
+	if 404 == rsp.StatusCode {
+		rsp.Body.Close()
+		return nil, ErrNotFound
+	} else if 400 <= rsp.StatusCode {
+		rsp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("HTTP %d", rsp.StatusCode))
+	}
+
+	if 0 < ofst && 206 != rsp.StatusCode {
+		// the server does not support ranges: skip to the requested range
+		_, err = io.CopyN(ioutil.Discard, rsp.Body, ofst)
+		if nil != err {
+			rsp.Body.Close()
+			return nil, err
+		}
+	}
+
+	return rsp, nil
+}
+
+// assetFile reads a downloaded asset.
+type assetFile struct {
+	*os.File
+	size int64
+}
+
+func (f *assetFile) CacheFile() *os.File {
+	return f.File
+}
+
+func (f *assetFile) Size() int64 {
+	return f.size
+}
+
+// assetReader reads an asset by downloading the ranges that are read.
+type assetReader struct {
+	client *githubClient
+	asset  *githubAsset
+}
+
+func (a *assetReader) ReadAt(p []byte, ofst int64) (n int, err error) {
+	size := a.asset.FSize
+	if ofst >= size {
+		return 0, io.EOF
+	}
+	m := len(p)
+	if int64(m) > size-ofst {
+		m = int(size - ofst)
+	}
+
+	ctx, cancel := withTimeout(context.Background(), a.client.gitconf.timeouts.blob)
+	defer cancel()
+	rsp, err := a.client.sendrecvAsset(ctx, a.asset, ofst, m)
+	if nil != err {
+		return 0, timeoutErr(ctx, err)
+	}
+	defer rsp.Body.Close()
+
+	n, err = io.ReadFull(rsp.Body, p[:m])
+	if nil != err {
+		return n, timeoutErr(ctx, err)
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (a *assetReader) Close() error {
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+ * release_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReleases(t *testing.T) {
+	content := "0123456789abcdef"
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		case "/orgs/acme/repos":
+			w.Write([]byte(`[{"name":"a","clone_url":"https://example.com/acme/a.git"}]`))
+		case "/repos/acme/a/releases":
+			w.Write([]byte(`[
+				{"tag_name":"v1","published_at":"2022-01-01T00:00:00Z","assets":[
+					{"id":7,"name":"a.bin","size":16,"url":"` + server.URL + `/assets/7"}]},
+				{"tag_name":"v2","draft":true}]`))
+		case "/assets/7":
+			if "application/octet-stream" != r.Header.Get("Accept") {
+				w.WriteHeader(400)
+				return
+			}
+			http.Redirect(w, r, "/storage/7", 302)
+		case "/storage/7":
+			http.ServeContent(w, r, "a.bin", time.Time{}, strings.NewReader(content))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "release_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, config := range []string{"", "config.dir=" + dir} {
+		client, err := NewGithubClient(server.URL, "")
+		if nil != err {
+			t.Fatal(err)
+		}
+		if "" != config {
+			client.SetConfig([]string{config})
+		}
+		owner, err := client.OpenOwner(context.Background(), "acme")
+		if nil != err {
+			t.Fatal(err)
+		}
+		repository, err := client.OpenRepository(context.Background(), owner, "a")
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		releases, err := repository.(ReleaseRepository).GetReleases(context.Background())
+		if nil != err || 1 != len(releases) || "v1" != releases[0].Name() ||
+			2022 != releases[0].Time().Year() || 1 != len(releases[0].Assets()) {
+			t.Fatal(err, releases)
+		}
+		asset := releases[0].Assets()[0]
+		if "a.bin" != asset.Name() || 16 != asset.Size() {
+			t.Error(asset)
+		}
+
+		reader, err := repository.(ReleaseRepository).GetAssetReader(context.Background(), asset)
+		if nil != err {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 10)
+		n, err := reader.ReadAt(buf, 10)
+		if 6 != n || "abcdef" != string(buf[:n]) {
+			t.Error(n, err, string(buf[:n]))
+		}
+		n, err = reader.ReadAt(buf, 2)
+		if 10 != n || nil != err || !bytes.Equal([]byte(content[2:12]), buf) {
+			t.Error(n, err, string(buf[:n]))
+		}
+		_, isfile := reader.(CacheFile)
+		if ("" != config) != isfile {
+			t.Error(config, isfile)
+		}
+		reader.(interface{ Close() error }).Close()
+
+		client.CloseRepository(repository)
+		client.CloseOwner(owner)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "acme", "a", "assets", "7")); nil != err {
+		t.Error(err)
+	}
+}
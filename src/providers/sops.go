@@ -0,0 +1,566 @@
+/*
+ * sops.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	pathutil "path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// SOPS encrypts the values of YAML, JSON and dotenv files (and the content of other files,
+// which it stores as JSON) with AES-256-GCM using a data key. The data key is stored in
+// the "sops" metadata of the file, encrypted for each recipient (age, PGP or a cloud
+// KMS). Each value is authenticated together with the path of keys that leads to it, so
+// values cannot be moved around; the MAC over all values in the metadata is not checked.
+// Decrypted files are presented like "sops --decrypt" presents them, but without
+// the metadata; YAML and JSON formatting may differ.
+
+type sopsTransform struct {
+	lock sync.RWMutex
+	age  []age.Identity
+	pgp  openpgp.EntityList
+}
+
+var sopsXform *sopsTransform
+
+var sopsValueRe = regexp.MustCompile(
+	`ENC\[AES256_GCM,data:([A-Za-z0-9+/=]*),iv:([A-Za-z0-9+/=]+),tag:([A-Za-z0-9+/=]+),type:([a-z]+)\]`)
+
+// Function addSopsKey adds the age identities or PGP secret keys of a file to the sops
+// transform, which is registered when the first key is added.
+func addSopsKey(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return err
+	}
+
+	var ids []age.Identity
+	var pgp openpgp.EntityList
+	switch t := bytes.TrimSpace(content); {
+	case bytes.Contains(t, []byte("AGE-SECRET-KEY-1")):
+		ids, err = age.ParseIdentities(bytes.NewReader(t))
+	case bytes.HasPrefix(t, []byte("-----BEGIN PGP")):
+		pgp, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(t))
+	default:
+		pgp, err = openpgp.ReadKeyRing(bytes.NewReader(t))
+	}
+	if nil != err {
+		return fmt.Errorf("invalid SOPS key file %s: %v", path, err)
+	}
+
+	xformLock.Lock()
+	if nil == sopsXform {
+		sopsXform = &sopsTransform{}
+		transforms["sops"] = sopsXform
+	}
+	xform := sopsXform
+	xformLock.Unlock()
+
+	xform.lock.Lock()
+	xform.age = append(xform.age, ids...)
+	xform.pgp = append(xform.pgp, pgp...)
+	xform.lock.Unlock()
+	return nil
+}
+
+func (t *sopsTransform) Encrypted(content []byte) bool {
+	return bytes.Contains(content, []byte("ENC[AES256_GCM,")) &&
+		bytes.Contains(content, []byte("lastmodified"))
+}
+
+// Function Apply decrypts a SOPS file. Like SOPS it determines the format of the file
+// from its extension; files other than YAML, JSON and dotenv files are binary files.
+func (t *sopsTransform) Apply(path string, content []byte) ([]byte, error) {
+	key, err := t.dataKey(content)
+	if nil != err {
+		return nil, err
+	}
+	switch strings.ToLower(pathutil.Ext(path)) {
+	case ".yaml", ".yml":
+		return sopsDecryptYAML(key, content)
+	case ".json":
+		return sopsDecryptJSON(key, content, false)
+	case ".env":
+		return sopsDecryptDotenv(key, content)
+	case ".ini":
+		return nil, errors.New("SOPS INI files are not supported")
+	default:
+		return sopsDecryptJSON(key, content, true)
+	}
+}
+
+// Function dataKey decrypts the data key of a SOPS file. Encrypted data keys are armored
+// age files or PGP messages; they are found in the metadata of all formats, after any
+// escaped newlines have been restored.
+func (t *sopsTransform) dataKey(content []byte) ([]byte, error) {
+	text := strings.ReplaceAll(string(content), `\n`, "\n")
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if 0 < len(t.age) {
+		for _, enc := range sopsArmored(text, agearmor.Header, agearmor.Footer) {
+			msg, err := age.Decrypt(agearmor.NewReader(strings.NewReader(enc)), t.age...)
+			if nil != err {
+				continue
+			}
+			if key, err := ioutil.ReadAll(msg); nil == err {
+				return key, nil
+			}
+		}
+	}
+	if 0 < len(t.pgp) {
+		for _, enc := range sopsArmored(text, "-----BEGIN PGP MESSAGE-----", "-----END PGP MESSAGE-----") {
+			block, err := armor.Decode(strings.NewReader(enc))
+			if nil != err {
+				continue
+			}
+			msg, err := openpgp.ReadMessage(block.Body, t.pgp, nil, nil)
+			if nil != err {
+				continue
+			}
+			if key, err := ioutil.ReadAll(msg.UnverifiedBody); nil == err {
+				return key, nil
+			}
+		}
+	}
+	return nil, errors.New("no SOPS key can decrypt the data key")
+}
+
+// Function sopsArmored returns the armored blocks of text with their lines trimmed.
+func sopsArmored(text string, begin string, end string) (res []string) {
+	for {
+		i := strings.Index(text, begin)
+		if -1 == i {
+			return
+		}
+		j := strings.Index(text[i:], end)
+		if -1 == j {
+			return
+		}
+		lines := strings.Split(text[i:i+j+len(end)], "\n")
+		for k := range lines {
+			lines[k] = strings.Trim(lines[k], " \t\r\"',")
+		}
+		res = append(res, strings.Join(lines, "\n")+"\n")
+		text = text[i+j+len(end):]
+	}
+}
+
+// Function sopsDecryptValue decrypts an encrypted value. It returns the plaintext and the
+// type of the value (str, int, float, bool, bytes or comment).
+func sopsDecryptValue(key []byte, value string, aad string) (string, string, error) {
+	m := sopsValueRe.FindStringSubmatch(value)
+	if nil == m || len(m[0]) != len(value) {
+		return "", "", errors.New("invalid SOPS value")
+	}
+	data, err0 := base64.StdEncoding.DecodeString(m[1])
+	iv, err1 := base64.StdEncoding.DecodeString(m[2])
+	tag, err2 := base64.StdEncoding.DecodeString(m[3])
+	if nil != err0 || nil != err1 || nil != err2 || 0 == len(iv) {
+		return "", "", errors.New("invalid SOPS value")
+	}
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return "", "", err
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if nil != err {
+		return "", "", err
+	}
+	plain, err := aead.Open(nil, iv, append(data, tag...), []byte(aad))
+	if nil != err {
+		return "", "", errors.New("SOPS value cannot be decrypted")
+	}
+	return string(plain), m[4], nil
+}
+
+// Function sopsPath returns the additional authenticated data of a value: the keys
+// that lead to it, each followed by a colon.
+func sopsPath(keys []string) string {
+	if 0 == len(keys) {
+		return ""
+	}
+	return strings.Join(keys, ":") + ":"
+}
+
+// Type sopsObject is a JSON object that keeps the order of its members.
+type sopsObject []sopsMember
+
+type sopsMember struct {
+	key   string
+	value interface{}
+}
+
+func (o sopsObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if 0 < i {
+			buf.WriteByte(',')
+		}
+		if err := sopsMarshal(&buf, m.key); nil != err {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := sopsMarshal(&buf, m.value); nil != err {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func sopsMarshal(buf *bytes.Buffer, v interface{}) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); nil != err {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1) // remove newline
+	return nil
+}
+
+// Function sopsParseJSON parses a JSON value, keeping the order of object members.
+func sopsParseJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if nil != err {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := sopsObject{}
+		for dec.More() {
+			k, err := dec.Token()
+			if nil != err {
+				return nil, err
+			}
+			v, err := sopsParseJSON(dec)
+			if nil != err {
+				return nil, err
+			}
+			obj = append(obj, sopsMember{k.(string), v})
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			v, err := sopsParseJSON(dec)
+			if nil != err {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err = dec.Token()
+		return arr, err
+	default:
+		return tok, nil
+	}
+}
+
+// Function sopsDecryptTree decrypts the values of a parsed JSON tree in place.
+func sopsDecryptTree(key []byte, v interface{}, keys []string) (interface{}, error) {
+	switch v := v.(type) {
+	case sopsObject:
+		for i := range v {
+			d, err := sopsDecryptTree(key, v[i].value, append(keys[:len(keys):len(keys)], v[i].key))
+			if nil != err {
+				return nil, err
+			}
+			v[i].value = d
+		}
+		return v, nil
+	case []interface{}:
+		for i := range v {
+			d, err := sopsDecryptTree(key, v[i], keys)
+			if nil != err {
+				return nil, err
+			}
+			v[i] = d
+		}
+		return v, nil
+	case string:
+		if !strings.HasPrefix(v, "ENC[") {
+			return v, nil
+		}
+		plain, typ, err := sopsDecryptValue(key, v, sopsPath(keys))
+		if nil != err {
+			return nil, err
+		}
+		switch typ {
+		case "int", "float":
+			return json.Number(plain), nil
+		case "bool":
+			b, err := strconv.ParseBool(plain)
+			if nil != err {
+				return nil, err
+			}
+			return b, nil
+		default:
+			return plain, nil
+		}
+	default:
+		return v, nil
+	}
+}
+
+// Function sopsDecryptJSON decrypts a JSON file, or a binary file whose content is
+// stored in the "data" member of a JSON file.
+func sopsDecryptJSON(key []byte, content []byte, binary bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	tree, err := sopsParseJSON(dec)
+	if nil != err {
+		return nil, err
+	}
+	obj, ok := tree.(sopsObject)
+	if !ok {
+		return nil, errors.New("invalid SOPS file")
+	}
+	res := sopsObject{}
+	for _, m := range obj {
+		if "sops" != m.key {
+			res = append(res, m)
+		}
+	}
+
+	if binary {
+		if 1 != len(res) || "data" != res[0].key {
+			return nil, errors.New("invalid SOPS binary file")
+		}
+		s, ok := res[0].value.(string)
+		if !ok {
+			return nil, errors.New("invalid SOPS binary file")
+		}
+		plain, _, err := sopsDecryptValue(key, s, "data:")
+		if nil != err {
+			return nil, err
+		}
+		return []byte(plain), nil
+	}
+
+	if _, err = sopsDecryptTree(key, res, nil); nil != err {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	if err = enc.Encode(res); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Function sopsDecryptDotenv decrypts a dotenv file, which consists of KEY=VALUE lines.
+func sopsDecryptDotenv(key []byte, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		i := strings.IndexByte(line, '=')
+		if strings.HasPrefix(line, "sops_") {
+			continue
+		}
+		if -1 != i && strings.HasPrefix(line[i+1:], "ENC[") {
+			k := line[:i]
+			v := strings.TrimRight(line[i+1:], "\r\n")
+			plain, _, err := sopsDecryptValue(key, v, k+":")
+			if nil != err {
+				return nil, err
+			}
+			line = k + "=" + plain + line[i+1+len(v):]
+		}
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), nil
+}
+
+// Function sopsDecryptYAML decrypts a YAML file. SOPS writes YAML files in block style,
+// so the keys that lead to a value can be determined from indentation; values in flow
+// style collections are left encrypted.
+func sopsDecryptYAML(key []byte, content []byte) ([]byte, error) {
+	type level struct {
+		indent int
+		key    string
+	}
+	var stack []level
+	keys := func() []string {
+		res := make([]string, len(stack))
+		for i, l := range stack {
+			res[i] = l.key
+		}
+		return res
+	}
+	pop := func(indent int) {
+		for 0 < len(stack) && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	var buf bytes.Buffer
+	meta, block := false, -1
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		text := strings.TrimRight(line, "\r\n")
+		rest := strings.TrimLeft(text, " ")
+		indent := len(text) - len(rest)
+
+		switch {
+		case "" == rest:
+			if !meta {
+				buf.WriteString(line)
+			}
+			continue
+		case meta && 0 < indent:
+			continue
+		case 0 <= block && indent > block:
+			buf.WriteString(line)
+			continue
+		case strings.HasPrefix(rest, "#"):
+			if c := strings.TrimSpace(rest[1:]); strings.HasPrefix(c, "ENC[") {
+				if plain, _, err := sopsDecryptValue(key, c, sopsPath(keys())); nil == err {
+					line = text[:indent] + "#" + plain + line[len(text):]
+				}
+			}
+			buf.WriteString(line)
+			continue
+		}
+		meta, block = false, -1
+		if 0 == indent && (strings.HasPrefix(rest, "sops:")) {
+			meta = true
+			continue
+		}
+		if "---" == rest || "..." == rest {
+			stack = nil
+			buf.WriteString(line)
+			continue
+		}
+
+		// list items belong to the key above them, even if it has the same indentation
+		for "-" == rest || strings.HasPrefix(rest, "- ") {
+			pop(indent + 1)
+			n := len(rest)
+			rest = strings.TrimLeft(strings.TrimPrefix(rest[1:], " "), " ")
+			indent += n - len(rest)
+		}
+		pop(indent)
+
+		k, v, ok := yamlKeyValue(rest)
+		if !ok {
+			k, v = "", rest
+		}
+		switch {
+		case "" == v || strings.HasPrefix(v, "|") || strings.HasPrefix(v, ">"):
+			if ok {
+				stack = append(stack, level{indent, k})
+			}
+			if "" != v {
+				block = indent
+			}
+		case strings.HasPrefix(v, "ENC["):
+			if j := strings.IndexByte(v, ']'); -1 != j {
+				v = v[:j+1]
+			}
+			path := keys()
+			if ok {
+				path = append(path, k)
+			}
+			plain, typ, err := sopsDecryptValue(key, v, sopsPath(path))
+			if nil != err {
+				return nil, err
+			}
+			switch typ {
+			case "int", "float", "bool":
+				plain = strings.ToLower(plain)
+			default:
+				plain = strconv.Quote(plain)
+			}
+			i := strings.LastIndex(text, v)
+			line = text[:i] + plain + line[len(text):]
+		}
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), nil
+}
+
+// Function yamlKeyValue splits a block mapping entry into its key and value.
+func yamlKeyValue(s string) (k string, v string, ok bool) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		i := 1
+		for ; len(s) > i && '"' != s[i]; i++ {
+			if '\\' == s[i] {
+				i++
+			}
+		}
+		if len(s) <= i {
+			return "", "", false
+		}
+		k, err := strconv.Unquote(s[:i+1])
+		if nil != err {
+			return "", "", false
+		}
+		return yamlValue(k, s[i+1:])
+	case strings.HasPrefix(s, "'"):
+		i := 1
+		for ; len(s) > i; i++ {
+			if '\'' == s[i] {
+				if len(s) > i+1 && '\'' == s[i+1] {
+					i++
+					continue
+				}
+				break
+			}
+		}
+		if len(s) <= i {
+			return "", "", false
+		}
+		return yamlValue(strings.ReplaceAll(s[1:i], "''", "'"), s[i+1:])
+	default:
+		i := strings.Index(s, ": ")
+		if -1 == i {
+			if !strings.HasSuffix(s, ":") {
+				return "", "", false
+			}
+			i = len(s) - 1
+		}
+		return yamlValue(s[:i], s[i:])
+	}
+}
+
+func yamlValue(k string, s string) (string, string, bool) {
+	if !strings.HasPrefix(s, ":") || (1 < len(s) && ' ' != s[1]) {
+		return "", "", false
+	}
+	v := strings.TrimSpace(s[1:])
+	if strings.HasPrefix(v, "#") {
+		v = ""
+	}
+	return k, v, true
+}
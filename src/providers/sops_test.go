@@ -0,0 +1,214 @@
+/*
+ * sops_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+func sopsEncryptValue(key []byte, plain string, typ string, aad string) string {
+	block, _ := aes.NewCipher(key)
+	iv := bytes.Repeat([]byte{7}, 32)
+	aead, _ := cipher.NewGCMWithNonceSize(block, len(iv))
+	enc := aead.Seal(nil, iv, []byte(plain), []byte(aad))
+	n := len(enc) - aead.Overhead()
+	return "ENC[AES256_GCM,data:" + base64.StdEncoding.EncodeToString(enc[:n]) +
+		",iv:" + base64.StdEncoding.EncodeToString(iv) +
+		",tag:" + base64.StdEncoding.EncodeToString(enc[n:]) +
+		",type:" + typ + "]"
+}
+
+func TestSopsValue(t *testing.T) {
+	key := bytes.Repeat([]byte{'k'}, 32)
+	enc := sopsEncryptValue(key, "hello", "str", "a:b:")
+
+	plain, typ, err := sopsDecryptValue(key, enc, "a:b:")
+	if nil != err || "hello" != plain || "str" != typ {
+		t.Error(plain, typ, err)
+	}
+	if _, _, err := sopsDecryptValue(key, enc, "a:"); nil == err {
+		t.Error()
+	}
+	if _, _, err := sopsDecryptValue(key, enc+" ", "a:b:"); nil == err {
+		t.Error()
+	}
+}
+
+func TestSopsDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{'k'}, 32)
+
+	env := "A=" + sopsEncryptValue(key, "x y", "str", "A:") + "\n" +
+		"# comment\n" +
+		"B=plain\n" +
+		"sops_version=3.7.1\n"
+	if c, err := sopsDecryptDotenv(key, []byte(env)); nil != err ||
+		"A=x y\n# comment\nB=plain\n" != string(c) {
+		t.Errorf("%v %q", err, c)
+	}
+
+	json := `{"db": {"user": "` + sopsEncryptValue(key, "root", "str", "db:user:") + `",` +
+		`"port": "` + sopsEncryptValue(key, "5432", "int", "db:port:") + `"},` +
+		`"hosts": ["` + sopsEncryptValue(key, "a", "str", "hosts:") + `"],` +
+		`"sops": {"version": "3.7.1"}}`
+	expect := "{\n" +
+		"    \"db\": {\n" +
+		"        \"user\": \"root\",\n" +
+		"        \"port\": 5432\n" +
+		"    },\n" +
+		"    \"hosts\": [\n" +
+		"        \"a\"\n" +
+		"    ]\n" +
+		"}\n"
+	if c, err := sopsDecryptJSON(key, []byte(json), false); nil != err || expect != string(c) {
+		t.Errorf("%v %q", err, c)
+	}
+
+	bin := `{"data": "` + sopsEncryptValue(key, "\x00\x01", "str", "data:") + `", "sops": {}}`
+	if c, err := sopsDecryptJSON(key, []byte(bin), true); nil != err || "\x00\x01" != string(c) {
+		t.Errorf("%v %q", err, c)
+	}
+
+	yaml := "db:\n" +
+		"    user: " + sopsEncryptValue(key, "root", "str", "db:user:") + "\n" +
+		"    enabled: " + sopsEncryptValue(key, "True", "bool", "db:enabled:") + "\n" +
+		"hosts:\n" +
+		"- " + sopsEncryptValue(key, "a", "str", "hosts:") + "\n" +
+		"- name: " + sopsEncryptValue(key, "b", "str", "hosts:name:") + "\n" +
+		"plain: text\n" +
+		"sops:\n" +
+		"    version: 3.7.1\n"
+	expect = "db:\n" +
+		"    user: \"root\"\n" +
+		"    enabled: true\n" +
+		"hosts:\n" +
+		"- \"a\"\n" +
+		"- name: \"b\"\n" +
+		"plain: text\n"
+	if c, err := sopsDecryptYAML(key, []byte(yaml)); nil != err || expect != string(c) {
+		t.Errorf("%v %q", err, c)
+	}
+}
+
+func TestSopsDataKey(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "sops_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	datakey := bytes.Repeat([]byte{'d'}, 32)
+
+	id, err := age.GenerateX25519Identity()
+	if nil != err {
+		t.Fatal(err)
+	}
+	var agebuf bytes.Buffer
+	aw := agearmor.NewWriter(&agebuf)
+	w, err := age.Encrypt(aw, id.Recipient())
+	if nil != err {
+		t.Fatal(err)
+	}
+	w.Write(datakey)
+	w.Close()
+	aw.Close()
+
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var pgpbuf bytes.Buffer
+	pw, err := armor.Encode(&pgpbuf, "PGP MESSAGE", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	w, err = openpgp.Encrypt(pw, []*openpgp.Entity{entity}, nil, nil, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	w.Write(datakey)
+	w.Close()
+	pw.Close()
+	var keybuf bytes.Buffer
+	kw, err := armor.Encode(&keybuf, openpgp.PrivateKeyType, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	entity.SerializePrivate(kw, nil)
+	kw.Close()
+
+	indent := func(s string) string {
+		return "        " + strings.ReplaceAll(strings.TrimSpace(s), "\n", "\n        ")
+	}
+	content := "a: " + sopsEncryptValue(datakey, "b", "str", "a:") + "\n" +
+		"sops:\n" +
+		"    age:\n" +
+		"    -   recipient: " + id.Recipient().String() + "\n" +
+		"        enc: |\n" + indent(agebuf.String()) + "\n" +
+		"    pgp:\n" +
+		"    -   enc: |\n" + indent(pgpbuf.String()) + "\n" +
+		"    lastmodified: '2021-01-01T00:00:00Z'\n"
+
+	xform := &sopsTransform{}
+	if !xform.Encrypted([]byte(content)) {
+		t.Error()
+	}
+	if _, err := xform.dataKey([]byte(content)); nil == err {
+		t.Error()
+	}
+
+	agepath := filepath.Join(tdir, "age.txt")
+	ioutil.WriteFile(agepath, []byte("# comment\n"+id.String()+"\n"), 0600)
+	pgppath := filepath.Join(tdir, "pgp.asc")
+	ioutil.WriteFile(pgppath, keybuf.Bytes(), 0600)
+	for _, c := range []struct {
+		path string
+		text string
+	}{
+		{agepath, content},
+		{pgppath, content},
+		{pgppath, strings.ReplaceAll(content, "\n", "\\n")},
+	} {
+		sopsXform = nil
+		if err := addSopsKey(c.path); nil != err {
+			t.Fatal(err)
+		}
+		if key, err := sopsXform.dataKey([]byte(c.text)); nil != err || !bytes.Equal(datakey, key) {
+			t.Error(c.path, err)
+		}
+		if res, err := sopsXform.Apply("a.yaml", []byte(content)); nil != err ||
+			"a: \"b\"\n" != string(res) {
+			t.Errorf("%v %q", err, res)
+		}
+	}
+	sopsXform = nil
+	delete(transforms, "sops")
+
+	ioutil.WriteFile(agepath, []byte("AGE-SECRET-KEY-1XXXX\n"), 0600)
+	if err := addSopsKey(agepath); nil == err {
+		t.Error()
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * timeout.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Timeouts bound the duration of remote operations, so that a server that hangs results in
+// ErrTimeout rather than in a file system operation that blocks indefinitely. A timeout of
+// 0 means no timeout. See the config.timeout.* options.
+type timeouts struct {
+	refs  time.Duration // listing and resolving refs
+	fetch time.Duration // fetching commits and trees
+	api   time.Duration // each request made to enumerate owners and repositories
+	blob  time.Duration // fetching the content of a file
+}
+
+var defaultTimeouts = timeouts{
+	refs:  1 * time.Minute,
+	fetch: 5 * time.Minute,
+	api:   1 * time.Minute,
+	blob:  30 * time.Minute,
+}
+
+// Function withTimeout returns a context that is cancelled when ctx is done or when the
+// timeout d expires. A timeout of 0 means no timeout.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if 0 == d {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// Function timeoutErr returns ErrTimeout if err occurred after ctx reached its deadline.
+func timeoutErr(ctx context.Context, err error) error {
+	if nil != err && context.DeadlineExceeded == ctx.Err() {
+		return ErrTimeout
+	}
+	return err
+}
+
+// cancelBody cancels the context of a request when its response body is closed. Reads
+// that fail because the request timed out report ErrTimeout.
+type cancelBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if io.EOF != err {
+		err = timeoutErr(b.ctx, err)
+	}
+	return
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
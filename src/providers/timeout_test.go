@@ -0,0 +1,83 @@
+/*
+ * timeout_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/users/slowbody" == r.URL.Path {
+			w.Write([]byte(`{"login":`))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	client, err := NewGithubClient(server.URL, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	_, err = client.SetConfig([]string{"config.timeout.api=invalid"})
+	if nil == err {
+		t.Error()
+	}
+	_, err = client.SetConfig([]string{"config.timeout.api=100ms"})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	_, err = client.OpenOwner(context.Background(), "alice")
+	if ErrTimeout != err {
+		t.Error(err)
+	}
+
+	rsp, err := client.(*githubClient).sendrecv(context.Background(), "/users/slowbody")
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if ErrTimeout != err {
+		t.Error(err)
+	}
+
+	conf := &gitConfig{timeouts: timeouts{refs: 100 * time.Millisecond}}
+	r := newGitRepository(server.URL+"/owner/repo", nil, false, conf)
+	defer r.Close()
+	_, err = r.GetRefs(context.Background())
+	if ErrTimeout != err {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.GetRefs(ctx)
+	if ErrTimeout == err || nil == err {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * transform.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Type Transform converts the content of files before it is served (e.g. decompresses
+// or decrypts it). Transforms are registered by name with RegisterTransform and applied
+// to the files that match the patterns of config.transform. Transformed content is kept
+// in the object cache under a name derived from the transform name, so the output of a
+// registered transform should depend only on its input.
+type Transform interface {
+	// Apply returns the transformed content of the file at path (relative to the ref root).
+	// If it fails the file is served unchanged.
+	Apply(path string, content []byte) ([]byte, error)
+}
+
+// Type TransformRenamer is implemented by transforms that also change the names of the
+// files that they are applied to (e.g. by removing an extension).
+type TransformRenamer interface {
+	Rename(name string) string
+}
+
+// Type TransformDecrypter is implemented by transforms that decrypt content. Decrypted
+// content is never stored in the cache directory and decrypted files are read-only.
+type TransformDecrypter interface {
+	// Encrypted reports whether content is encrypted, i.e. whether Apply decrypts it.
+	Encrypted(content []byte) bool
+}
+
+var (
+	xformLock  sync.RWMutex
+	transforms = map[string]Transform{
+		"gunzip": gunzipTransform{},
+		"nbpy":   notebookTransform{},
+	}
+)
+
+// Function RegisterTransform registers a transform. Transform names may only contain
+// letters, digits, '-' and '_', because they name objects in the cache directory.
+func RegisterTransform(name string, xform Transform) {
+	if !validTransformName(name) {
+		panic("invalid transform name: " + name)
+	}
+	xformLock.Lock()
+	defer xformLock.Unlock()
+	transforms[name] = xform
+}
+
+func validTransformName(name string) bool {
+	return "" != name && "" == strings.Trim(name,
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_")
+}
+
+func GetTransformNames() []string {
+	xformLock.RLock()
+	defer xformLock.RUnlock()
+	res := make([]string, 0, len(transforms))
+	for name := range transforms {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// transformRule applies a transform to the files that match a pattern, which has the
+// syntax of a .gitattributes pattern.
+type transformRule struct {
+	match attrRule
+	name  string
+	xform Transform
+}
+
+type transformRules []*transformRule
+
+// Function parseTransform parses a config.transform value of the form PATTERN:NAME.
+func parseTransform(v string) (*transformRule, error) {
+	i := strings.LastIndexByte(v, ':')
+	if 0 >= i {
+		return nil, errors.New("invalid config.transform value: " + v)
+	}
+	pattern, name := v[:i], v[i+1:]
+
+	xformLock.RLock()
+	xform, ok := transforms[name]
+	xformLock.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown transform: " + name +
+			" (known transforms: " + strings.Join(GetTransformNames(), ", ") + ")")
+	}
+
+	return &transformRule{match: attrRule{pattern: pattern}, name: name, xform: xform}, nil
+}
+
+// Function lookup returns the rules that apply to path (relative to the ref root) in
+// the order in which they were configured.
+func (rules transformRules) lookup(path string) (res transformRules) {
+	for _, r := range rules {
+		if r.match.match(path) {
+			res = append(res, r)
+		}
+	}
+	return
+}
+
+// Function transformSmudge adds the transforms that apply to path to the conversion of a
+// file. A transform that is named by the filter attribute of the file (e.g. git-crypt)
+// is applied first, followed by the transforms of config.transform; transforms are
+// applied before any other conversion.
+func (c *attrConfig) transformSmudge(s *smudge, path string, attrs map[string]string) *smudge {
+	xforms := c.xforms.lookup(path)
+	if name := attrs["filter"]; c.filter && "" != name {
+		xformLock.RLock()
+		xform, ok := transforms[name]
+		xformLock.RUnlock()
+		if ok {
+			xforms = append(transformRules{{name: name, xform: xform}}, xforms...)
+		}
+	}
+	if 0 == len(xforms) {
+		return s
+	}
+	if nil == s {
+		s = &smudge{}
+	}
+	s.path = path
+	s.xforms = xforms
+	return s
+}
+
+// Function rename returns the name under which a converted file is presented.
+func (s *smudge) rename(name string) string {
+	for _, r := range s.xforms {
+		if renamer, ok := r.xform.(TransformRenamer); ok {
+			name = renamer.Rename(name)
+		}
+	}
+	return name
+}
+
+// Function decrypter returns the name of the transform that decrypts content, or "" if
+// content is not encrypted.
+func (s *smudge) decrypter(content []byte) string {
+	for _, r := range s.xforms {
+		if d, ok := r.xform.(TransformDecrypter); ok && d.Encrypted(content) {
+			return r.name
+		}
+	}
+	return ""
+}
+
+// Function transform applies the transforms of a conversion to content.
+func (s *smudge) transform(content []byte) []byte {
+	for _, r := range s.xforms {
+		c, err := r.xform.Apply(s.path, content)
+		if nil != err {
+			tracef("path=%q transform=%s: %v", s.path, r.name, err)
+			return content
+		}
+		content = c
+	}
+	return content
+}
+
+// gunzipTransform decompresses gzip files and removes their .gz extension.
+type gunzipTransform struct{}
+
+func (gunzipTransform) Apply(path string, content []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if nil != err {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (gunzipTransform) Rename(name string) string {
+	if n := strings.TrimSuffix(name, ".gz"); "" != n {
+		return n
+	}
+	return name
+}
+
+// notebookTransform renders Jupyter notebooks as Python scripts in the "percent" format,
+// where each cell starts with a "# %%" line and markdown cells are comments.
+type notebookTransform struct{}
+
+func (notebookTransform) Apply(path string, content []byte) ([]byte, error) {
+	var notebook struct {
+		Cells []struct {
+			Type   string          `json:"cell_type"`
+			Source json.RawMessage `json:"source"`
+		} `json:"cells"`
+	}
+	err := json.Unmarshal(content, &notebook)
+	if nil != err {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for i, cell := range notebook.Cells {
+		// the source of a cell is either a string or a list of lines
+		var source string
+		var lines []string
+		if err = json.Unmarshal(cell.Source, &source); nil != err {
+			if err = json.Unmarshal(cell.Source, &lines); nil != err {
+				return nil, err
+			}
+			source = strings.Join(lines, "")
+		}
+		source = strings.TrimRight(source, "\n")
+
+		if 0 < i {
+			buf.WriteString("\n")
+		}
+		switch cell.Type {
+		case "code":
+			buf.WriteString("# %%\n")
+			if "" != source {
+				buf.WriteString(source)
+				buf.WriteString("\n")
+			}
+		default:
+			buf.WriteString("# %% [" + cell.Type + "]\n")
+			for _, l := range strings.Split(source, "\n") {
+				if "" == l {
+					buf.WriteString("#\n")
+				} else {
+					buf.WriteString("# " + l + "\n")
+				}
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (notebookTransform) Rename(name string) string {
+	if n := strings.TrimSuffix(name, ".ipynb"); n != name && "" != n {
+		return n + ".py"
+	}
+	return name
+}
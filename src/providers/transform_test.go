@@ -0,0 +1,156 @@
+/*
+ * transform_test.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+type testTransform struct{}
+
+func (testTransform) Apply(path string, content []byte) ([]byte, error) {
+	if "fail" == string(content) {
+		return nil, errors.New("fail")
+	}
+	return bytes.ToUpper(content), nil
+}
+
+func TestTransform(t *testing.T) {
+	RegisterTransform("upper", testTransform{})
+
+	conf := attrConfig{}
+	for _, v := range []string{"*.gz:gunzip", "/docs/**/*.txt:upper", "nb/*.ipynb:nbpy"} {
+		r, err := parseTransform(v)
+		if nil != err {
+			t.Fatal(err)
+		}
+		conf.xforms = append(conf.xforms, r)
+	}
+	for _, v := range []string{"*.gz", ":gunzip", "*.gz:nosuch"} {
+		if _, err := parseTransform(v); nil == err {
+			t.Error(v)
+		}
+	}
+	if !conf.enabled() {
+		t.Error()
+	}
+
+	if s := conf.transformSmudge(nil, "docs/a.md", nil); nil != s {
+		t.Error(s)
+	}
+	if s := conf.transformSmudge(nil, "nb/sub/a.ipynb", nil); nil != s {
+		t.Error(s)
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("hello\n"))
+	w.Close()
+	s := conf.transformSmudge(nil, "sub/data.txt.gz", nil)
+	if nil == s || ".xf-gunzip" != s.name() || "data.txt" != s.rename("data.txt.gz") {
+		t.Fatal(s)
+	}
+	if c := s.apply(buf.Bytes()); "hello\n" != string(c) {
+		t.Errorf("%q", c)
+	}
+	if c := s.apply([]byte("not gzip")); "not gzip" != string(c) {
+		t.Errorf("%q", c)
+	}
+
+	// transforms are applied before other conversions
+	conf.setEol("crlf")
+	s = conf.newSmudge(map[string]string{"text": attrSet}, nil)
+	s = conf.transformSmudge(s, "docs/x/a.txt", nil)
+	if nil == s || ".xf-upper.crlf" != s.name() || "a.txt" != s.rename("a.txt") {
+		t.Fatal(s)
+	}
+	if c := s.apply([]byte("a\nb\n")); "A\r\nB\r\n" != string(c) {
+		t.Errorf("%q", c)
+	}
+	if c := s.apply([]byte("fail")); "fail" != string(c) {
+		t.Errorf("%q", c)
+	}
+}
+
+func TestTransformRenames(t *testing.T) {
+	names := func(tree map[string]*gitTreeEntry) (res []string) {
+		for k, e := range tree {
+			res = append(res, k+"="+e.entry.Name)
+		}
+		sort.Strings(res)
+		return
+	}
+	newtree := func(names ...string) map[string]*gitTreeEntry {
+		tree := make(map[string]*gitTreeEntry)
+		for _, n := range names {
+			tree[strings.ToUpper(n)] = &gitTreeEntry{entry: git.TreeEntry{Name: n}}
+		}
+		return tree
+	}
+
+	// renames are resolved against the original names, regardless of map order
+	for i := 0; 20 > i; i++ {
+		tree := newtree("a.gz.gz", "a.gz", "b.gz", "B", "c.gz", "c.Z")
+		renameTreeEntries(tree, map[string]string{
+			"A.GZ.GZ": "a.gz",
+			"A.GZ":    "a",
+			"B.GZ":    "b",
+			"C.GZ":    "c",
+			"C.Z":     "C",
+		}, strings.ToUpper)
+		expect := []string{"A=a", "A.GZ.GZ=a.gz.gz", "B=B", "B.GZ=b.gz", "C.GZ=c.gz", "C.Z=c.Z"}
+		if n := names(tree); !reflect.DeepEqual(expect, n) {
+			t.Fatal(n)
+		}
+	}
+}
+
+func TestNotebookTransform(t *testing.T) {
+	notebook := `{
+ "cells": [
+  {"cell_type": "markdown", "metadata": {}, "source": ["# Title\n", "\n", "Text"]},
+  {"cell_type": "code", "metadata": {}, "outputs": [], "source": ["import os\n", "print(os.name)\n"]},
+  {"cell_type": "code", "metadata": {}, "outputs": [], "source": "x = 1"},
+  {"cell_type": "code", "metadata": {}, "outputs": [], "source": []}
+ ],
+ "metadata": {},
+ "nbformat": 4,
+ "nbformat_minor": 5
+}`
+	expect := "# %% [markdown]\n# # Title\n#\n# Text\n" +
+		"\n# %%\nimport os\nprint(os.name)\n" +
+		"\n# %%\nx = 1\n" +
+		"\n# %%\n"
+
+	xform := notebookTransform{}
+	c, err := xform.Apply("a.ipynb", []byte(notebook))
+	if nil != err || expect != string(c) {
+		t.Errorf("%v %q", err, c)
+	}
+	if _, err := xform.Apply("a.ipynb", []byte("{")); nil == err {
+		t.Error()
+	}
+	if "a.py" != xform.Rename("a.ipynb") || ".ipynb" != xform.Rename(".ipynb") ||
+		"a.txt" != xform.Rename("a.txt") {
+		t.Error()
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * trust.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package providers
+
+import (
+	"errors"
+
+	"github.com/billziss-gh/hubfs/git"
+)
+
+var ErrUntrusted = errors.New("untrusted signature")
+
+type trustPolicy struct {
+	policy  *git.TrustPolicy
+	keyring string
+	signers string
+	require string // "", "signed" or "verified"
+}
+
+func (t *trustPolicy) load() (err error) {
+	t.policy = nil
+	if "" != t.keyring || "" != t.signers {
+		t.policy, err = git.LoadTrustPolicy(t.keyring, t.signers)
+	}
+	return
+}
+
+// Function signature returns the signature information for a signed object.
+// If a trust policy has been loaded the signature is verified against it.
+func (t *trustPolicy) signature(sig string, payload []byte) SignatureInfo {
+	info := newSignatureInfo(sig)
+	if nil == t || nil == t.policy || SignatureNone == info.Status {
+		return info
+	}
+
+	signer, err := t.policy.Verify(sig, payload)
+	if nil != err {
+		tracef("signature verification failed: %v", err)
+		info.Status = SignatureBad
+	} else {
+		info.Status = SignatureGood
+		info.Signer = signer
+	}
+	return info
+}
+
+// Function allow reports whether a commit with the specified signature may be accessed.
+func (t *trustPolicy) allow(info SignatureInfo) bool {
+	if nil == t {
+		return true
+	}
+	switch t.require {
+	case "signed":
+		return SignatureNone != info.Status
+	case "verified":
+		return SignatureGood == info.Status
+	}
+	return true
+}
+
+func newSignatureInfo(sig string) SignatureInfo {
+	if "" == sig {
+		return SignatureInfo{}
+	}
+	return SignatureInfo{
+		Status: SignatureUnverified,
+		Type:   git.SignatureType(sig),
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * scrub.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+// Package scrub redacts secrets from text that is written to logs, traces and dumps.
+// It recognizes auth tokens by their format, values of Authorization headers and
+// credentials embedded in URLs. Secrets that have no recognizable format can be
+// registered with AddSecret.
+package scrub
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in scrubbed text.
+const Redacted = "[REDACTED]"
+
+// minimum length of a registered secret; shorter strings are too likely to be innocuous
+const minSecretLen = 8
+
+var (
+	tokenRe = regexp.MustCompile(
+		`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`)
+	headerRe = regexp.MustCompile(
+		`(?i)((?:proxy-)?authorization["']?\s*[:=]\s*(?:\[\]string\{)?["']?` +
+			`(?:(?:basic|bearer|token)\s+)?)[^\s"',}\]]+`)
+	userinfoRe = regexp.MustCompile(
+		`\b([A-Za-z][A-Za-z0-9+.-]*://)[^/\s@"']+@`)
+
+	lock    sync.RWMutex
+	secrets []string
+)
+
+// Function AddSecret registers a secret to be redacted wherever it appears.
+func AddSecret(secret string) {
+	if minSecretLen > len(secret) {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// Function String returns s with all secrets redacted.
+func String(s string) string {
+	lock.RLock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, Redacted, -1)
+	}
+	lock.RUnlock()
+
+	s = tokenRe.ReplaceAllString(s, Redacted)
+	s = headerRe.ReplaceAllString(s, "${1}"+Redacted)
+	s = userinfoRe.ReplaceAllString(s, "${1}"+Redacted+"@")
+	return s
+}
+
+type writer struct {
+	w io.Writer
+}
+
+// Function NewWriter returns a writer that redacts secrets from the data written to w.
+// Each write is scrubbed independently, so a secret that is split across writes is not
+// recognized; this is not an issue for writers that receive whole lines such as the
+// writer of a log.Logger.
+func NewWriter(w io.Writer) io.Writer {
+	if _, ok := w.(*writer); ok {
+		return w
+	}
+	return &writer{w}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	_, err := io.WriteString(w.w, String(string(p)))
+	if nil != err {
+		return 0, err
+	}
+	return len(p), nil
+}
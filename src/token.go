@@ -0,0 +1,105 @@
+/*
+ * token.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/billziss-gh/golib/keyring"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// how often a mount checks the system keyring for a rotated auth token
+const tokenPollInterval = 15 * time.Second
+
+// Function watchToken keeps the auth token of a client in sync with the token that is
+// stored in the system keyring under authkey, so that a rotated token takes effect
+// without a remount. The keyring is checked periodically and when the process receives
+// SIGHUP. The returned function stops watching.
+func watchToken(client providers.Client, authkey string) (stop func()) {
+	setter, ok := client.(providers.TokenSetter)
+	if !ok {
+		return func() {}
+	}
+
+	token, _ := keyring.Get(MyProductName, authkey)
+	stopC := make(chan struct{})
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(tokenPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopC:
+				return
+			case <-ticker.C:
+			case <-hupC:
+			}
+
+			t, err := keyring.Get(MyProductName, authkey)
+			if nil != err || t == token {
+				continue
+			}
+			// remember the token even if it is rejected, so that it is not retried
+			token = t
+			err = setter.SetToken(t)
+			if nil != err {
+				warn("auth token for %s not refreshed: %v", authkey, err)
+				continue
+			}
+			warn("auth token for %s refreshed", authkey)
+		}
+	}()
+
+	return func() {
+		signal.Stop(hupC)
+		close(stopC)
+		wg.Wait()
+	}
+}
+
+// Function refresh stores a new auth token in the system keyring, either the token
+// specified with -auth token=T or one obtained by interactive auth. Running mounts
+// that use the keyring pick it up (see watchToken).
+func refresh(provider providers.Provider, authkey string, authmeth string) int {
+	var err error
+	if strings.HasPrefix(authmeth, "token=") {
+		token := strings.TrimPrefix(authmeth, "token=")
+		_, err = provider.NewClient(token)
+		if nil == err {
+			err = keyring.Set(MyProductName, authkey, token)
+		}
+	} else {
+		_, err = authNewClientWithKey(provider, authkey)
+	}
+	if nil != err {
+		warn("auth error: %v", err)
+		return 1
+	}
+
+	fmt.Printf("auth token for %s updated; running mounts use it within %v or on SIGHUP\n",
+		authkey, tokenPollInterval)
+	return 0
+}
@@ -0,0 +1,231 @@
+/*
+ * top.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/golib/appdata"
+	"github.com/billziss-gh/hubfs/metrics"
+)
+
+// Every mount listens on a control socket in the control directory. A client that
+// connects to the socket receives a JSON snapshot of the metrics of the mount, after
+// which the connection is closed. The command hubfs top polls the control socket and
+// displays the activity of the mount.
+
+// interval between updates of hubfs top
+const topInterval = time.Second
+
+// Function controlDir returns the directory of the control sockets of running mounts.
+func controlDir() (string, error) {
+	dir, err := appdata.CacheDir()
+	if nil != err {
+		return "", err
+	}
+	return filepath.Join(dir, progname, "control"), nil
+}
+
+// Function serveControl listens on the control socket of a mount. The returned
+// function stops listening and removes the socket.
+func serveControl(remote string, mntpnt string) (stop func(), err error) {
+	dir, err := controlDir()
+	if nil != err {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if nil != err {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%d.sock", os.Getpid()))
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if nil != err {
+		return nil, err
+	}
+
+	if a, e := filepath.Abs(mntpnt); nil == e {
+		mntpnt = a
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			s := metrics.Take()
+			s.Pid = os.Getpid()
+			s.Remote = remote
+			s.Mountpoint = mntpnt
+			conn.SetWriteDeadline(time.Now().Add(topInterval))
+			json.NewEncoder(conn).Encode(&s)
+			conn.Close()
+		}
+	}()
+
+	return func() {
+		listener.Close()
+		os.Remove(path)
+	}, nil
+}
+
+// Function querySnapshot retrieves the metrics of the mount that listens on a control
+// socket.
+func querySnapshot(path string) (s metrics.Snapshot, err error) {
+	conn, err := net.DialTimeout("unix", path, topInterval)
+	if nil != err {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(topInterval))
+	err = json.NewDecoder(conn).Decode(&s)
+	return
+}
+
+// Function findControl returns the control socket of the mount at mntpnt, or of the
+// only running mount if mntpnt is empty.
+func findControl(mntpnt string) (string, error) {
+	dir, err := controlDir()
+	if nil != err {
+		return "", err
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.sock"))
+
+	if "" != mntpnt {
+		if a, e := filepath.Abs(mntpnt); nil == e {
+			mntpnt = a
+		}
+	}
+
+	found := []string{}
+	mntpnts := []string{}
+	for _, path := range paths {
+		s, err := querySnapshot(path)
+		if nil != err {
+			continue
+		}
+		if "" == mntpnt || s.Mountpoint == mntpnt {
+			found = append(found, path)
+			mntpnts = append(mntpnts, s.Mountpoint)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		if "" != mntpnt {
+			return "", errors.New("no running mount at " + mntpnt)
+		}
+		return "", errors.New("no running mounts")
+	case 1:
+		return found[0], nil
+	default:
+		return "", errors.New("multiple running mounts; specify one of: " +
+			strings.Join(mntpnts, ", "))
+	}
+}
+
+// Function top displays the activity of a running mount until interrupted.
+func top(mntpnt string) int {
+	path, err := findControl(mntpnt)
+	if nil != err {
+		warn("%v", err)
+		return 1
+	}
+
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	defer signal.Stop(intr)
+
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+
+	var prev *metrics.Snapshot
+	for {
+		curr, err := querySnapshot(path)
+		if nil != err {
+			warn("mount has exited: %v", err)
+			return 1
+		}
+		if nil == prev {
+			prev = &curr
+		}
+		fmt.Print("\x1b[H\x1b[2J" + formatTop(prev, &curr))
+		prev = &curr
+
+		select {
+		case <-intr:
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// Function formatTop formats the activity of a mount between two snapshots.
+func formatTop(prev *metrics.Snapshot, curr *metrics.Snapshot) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s - %s on %s - pid %d - up %v\n\n",
+		progname, curr.Remote, curr.Mountpoint, curr.Pid,
+		curr.Time.Sub(curr.Start).Round(time.Second))
+
+	fmt.Fprintf(&b, "fetches in flight: %d (total %d)\n", curr.Fetches, curr.FetchesTotal)
+	if r := curr.HitRate(); 0 <= r {
+		fmt.Fprintf(&b, "cache hit rate:    %.1f%% (%d of %d objects)\n",
+			100*r, curr.CacheHits, curr.CacheHits+curr.CacheMisses)
+	} else {
+		fmt.Fprintf(&b, "cache hit rate:    -\n")
+	}
+	if rl := curr.RateLimit; 0 != rl.Limit {
+		fmt.Fprintf(&b, "rate limit:        %d of %d remaining", rl.Remaining, rl.Limit)
+		if !rl.Reset.IsZero() {
+			fmt.Fprintf(&b, ", resets in %v", rl.Reset.Sub(curr.Time).Round(time.Second))
+		}
+		fmt.Fprintf(&b, "\n")
+	} else {
+		fmt.Fprintf(&b, "rate limit:        -\n")
+	}
+
+	rate := metrics.OpsRate(prev, curr)
+	names := make([]string, 0, len(rate))
+	for name := range rate {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if rate[names[i]] != rate[names[j]] {
+			return rate[names[i]] > rate[names[j]]
+		}
+		if curr.Ops[names[i]] != curr.Ops[names[j]] {
+			return curr.Ops[names[i]] > curr.Ops[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	fmt.Fprintf(&b, "\n%-48s %10s %12s\n", "REPOSITORY", "OPS/S", "OPS")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%-48s %10.1f %12d\n", name, rate[name], curr.Ops[name])
+	}
+
+	return b.String()
+}
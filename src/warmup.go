@@ -0,0 +1,88 @@
+/*
+ * warmup.go
+ *
+ * Copyright 2021-2022 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Hubfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/billziss-gh/hubfs/fs/hubfs"
+	"github.com/billziss-gh/hubfs/providers"
+)
+
+// Function warmup fetches the files recorded in the access trace at tracepath (see
+// config.trace) into the cache directory of the client.
+func warmup(client providers.Client, tracepath string, config []string) int {
+	refenc := hubfs.RefEncodingPlus
+	mangle := "windows" == runtime.GOOS
+	for _, s := range config {
+		var err error
+		switch {
+		case strings.HasPrefix(s, "config.refenc="):
+			refenc, err = hubfs.ParseRefEncoding(strings.TrimPrefix(s, "config.refenc="))
+		case strings.HasPrefix(s, "config.mangle="):
+			mangle = "1" == strings.TrimPrefix(s, "config.mangle=")
+		}
+		if nil != err {
+			warn("config error: %v", err)
+			return 1
+		}
+	}
+
+	file, err := os.Open(tracepath)
+	if nil != err {
+		warn("warmup error: %v", err)
+		return 1
+	}
+	paths, err := hubfs.ReadAccessTrace(file)
+	file.Close()
+	if nil != err {
+		warn("warmup error: %s: %v", tracepath, err)
+		return 1
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	client.StartExpiration()
+	defer client.StopExpiration()
+
+	// trace paths include the prefix of the traced mount
+	stats, err := hubfs.Warmup(ctx, hubfs.Config{
+		Client:      client,
+		RefEncoding: refenc,
+		Mangle:      mangle,
+	}, paths)
+	if nil != err {
+		warn("warmup error: %v", err)
+		return 1
+	}
+
+	fmt.Printf("%s: %d files fetched, %d missing\n", tracepath, stats.Files, stats.Missing)
+	return 0
+}
+
+// Function keepsCacheDirectory reports whether config sets a cache directory that is kept
+// when the client stops (config.dir=PATH).
+func keepsCacheDirectory(config []string) bool {
+	dir := ""
+	for _, s := range config {
+		if strings.HasPrefix(s, "config.dir=") {
+			dir = strings.TrimPrefix(s, "config.dir=")
+		}
+	}
+	return "" != dir && ":" != dir
+}